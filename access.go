@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	// AccessPublic = anyone can request the transformation, even when reads
+	// need an API key or URLs need to be signed
+	AccessPublic = "public"
+	// AccessRestricted = the transformation needs an API key (or a bearer
+	// token) allowed to read or a signed URL, even when anyone can read
+	AccessRestricted = "restricted"
+)
+
+func isValidAccess(access string) bool {
+	return access == AccessPublic || access == AccessRestricted
+}
+
+// transformationAccess returns the access of the named transformation a
+// parameters string asks for, "" when it follows the server's settings
+func transformationAccess(conf *Configuration, parametersStr string) string {
+	// Downloads and other options of restricted transformations are
+	// restricted as well, invalid options are refused later on
+	parametersStr, _, _ = removeRequestOptions(parametersStr)
+	name := parseTransformationName(parametersStr)
+	if name == "" {
+		return ""
+	}
+	return conf.transformations[name].access
+}
+
+// accessAuthorised checks credentials, which can be empty, allow reading
+// images of a transformation with the given access
+func accessAuthorised(access, key, token string) bool {
+	switch access {
+	case AccessPublic:
+		return true
+	case AccessRestricted:
+		// Anonymous reads may be allowed, these need to be authenticated
+		if key == "" && token == "" {
+			return false
+		}
+	}
+	return credentialsAuthorised(key, token, ReadPermission)
+}
+
+// authoriseImageRequest checks a request for a transformed image may be
+// answered before anything is processed. It returns the parameters without
+// the signature, whether the URL was signed and an error status for requests
+// which can't be answered.
+func authoriseImageRequest(params martini.Params, req *http.Request, tenant *Tenant, conf *Configuration) (string, bool, int, string) {
+	parametersStr := stripURLSignature(params["parameters"])
+	access := transformationAccess(conf, parametersStr)
+	if access == AccessPublic {
+		return parametersStr, false, 0, ""
+	}
+
+	// Restricted transformations take signed URLs instead of credentials
+	_, signature := removeParameter(params["parameters"], parameterSignature)
+	signedInstead := access == AccessRestricted && signature != "" && tenant.urlSigningSecret() != ""
+	if !signedInstead && !accessAuthorised(access, requestKey(params, req), bearerToken(req)) {
+		return "", false, http.StatusUnauthorized, ""
+	}
+
+	signed := conf.signedURLs || signedInstead
+	if signed {
+		var err error
+		parametersStr, err = verifyURLSignature(params["parameters"], params["_1"], tenant.urlSigningSecret(), time.Now())
+		if err != nil {
+			return "", false, http.StatusForbidden, fmt.Sprintf("Invalid URL: %s", err)
+		}
+	}
+	return parametersStr, signed, 0, ""
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestAuthoriseImageRequest(t *testing.T) {
+	oldPermissions := permissionsByKey
+	defer func() { permissionsByKey = oldPermissions }()
+	permissionsByKey = map[string]map[string]bool{"": {ReadPermission: false}, "KEY": {ReadPermission: true}}
+	oldSecret := urlSigningSecret
+	defer func() { urlSigningSecret = oldSecret }()
+	urlSigningSecret = "secret"
+
+	conf := &Configuration{transformations: map[string]Transformation{
+		"preview":  {access: AccessPublic},
+		"original": {access: AccessRestricted},
+		"thumb":    {},
+	}}
+
+	cases := []struct {
+		parameters, key string
+		status          int
+	}{
+		{"t_preview", "", 0},
+		{"t_thumb", "", http.StatusUnauthorized},
+		{"t_thumb", "KEY", 0},
+		{"t_original", "KEY", 0},
+		{signURL("t_original", "cat.jpg", "secret", 0), "", 0},
+		{"t_original,s_00", "", http.StatusForbidden},
+		{"t_preview,mask_star.png", "", 0},
+	}
+	for _, c := range cases {
+		params := martini.Params{"parameters": c.parameters, "_1": "cat.jpg", "apikey": c.key}
+		_, _, status, _ := authoriseImageRequest(params, httptest.NewRequest("GET", "/image/x/cat.jpg", nil), nil, conf)
+		if status != c.status {
+			t.Errorf("Expected %d for %s with key %q, got: %d", c.status, c.parameters, c.key, status)
+		}
+	}
+
+	// Restricted transformations need credentials even when anyone can read
+	permissionsByKey[""][ReadPermission] = true
+	for parameters, status := range map[string]int{"t_thumb": 0, "t_original": http.StatusUnauthorized, "t_original,dl_cat": http.StatusUnauthorized, "t_original,mask_star.png": http.StatusUnauthorized} {
+		_, _, got, _ := authoriseImageRequest(martini.Params{"parameters": parameters, "_1": "cat.jpg"}, httptest.NewRequest("GET", "/image/x/cat.jpg", nil), nil, conf)
+		if got != status {
+			t.Errorf("Expected %d for %s without a key, got: %d", status, parameters, got)
+		}
+	}
+
+	// Public transformations don't need to be signed
+	conf.signedURLs = true
+	parameters, signed, status, _ := authoriseImageRequest(martini.Params{"parameters": "t_preview", "_1": "cat.jpg"}, httptest.NewRequest("GET", "/image/x/cat.jpg", nil), nil, conf)
+	if status != 0 || signed || parameters != "t_preview" {
+		t.Errorf("Expected t_preview to be served unsigned, got: %d %v %s", status, signed, parameters)
+	}
+	_, _, status, _ = authoriseImageRequest(martini.Params{"parameters": "t_thumb", "_1": "cat.jpg"}, httptest.NewRequest("GET", "/image/x/cat.jpg", nil), nil, conf)
+	if status != http.StatusForbidden {
+		t.Errorf("Expected unsigned t_thumb to be forbidden, got: %d", status)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Access log formats
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+var (
+	// Where access log lines are written to, nil when disabled
+	accessLogWriter io.Writer
+	accessLogMutex  sync.Mutex
+)
+
+// accessLogEntry is one line of the access log
+type accessLogEntry struct {
+	Time           time.Time `json:"time"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	Protocol       string    `json:"protocol"`
+	Status         int       `json:"status"`
+	Bytes          int       `json:"bytes"`
+	Referer        string    `json:"referer,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	DurationMillis float64   `json:"duration_ms"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Transformation string    `json:"transformation,omitempty"`
+}
+
+// accessLogInit opens the access log, "stdout" or "-" write it to the
+// standard output, anything else is a path of a file it is appended to
+func accessLogInit() error {
+	switch currentConfig().accessLogOutput {
+	case "":
+		return nil
+	case "stdout", "-":
+		accessLogWriter = os.Stdout
+	default:
+		file, err := os.OpenFile(currentConfig().accessLogOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		accessLogWriter = file
+	}
+	return nil
+}
+
+func accessLogCleanUp() {
+	if file, ok := accessLogWriter.(*os.File); ok && file != os.Stdout {
+		file.Close()
+	}
+}
+
+// writeAccessLog is a middleware adding answered requests to the access log
+func writeAccessLog(c martini.Context, res http.ResponseWriter, req *http.Request) {
+	if accessLogWriter == nil {
+		return
+	}
+	start := time.Now()
+
+	c.Next()
+
+	rw := res.(martini.ResponseWriter)
+	requestLog := requestLogFor(req)
+	entry := accessLogEntry{
+		Time:           start,
+		Method:         req.Method,
+		URI:            req.URL.RequestURI(),
+		Protocol:       req.Proto,
+		Status:         rw.Status(),
+		Bytes:          rw.Size(),
+		Referer:        req.Referer(),
+		UserAgent:      req.UserAgent(),
+		DurationMillis: float64(time.Since(start)) / float64(time.Millisecond),
+		RequestID:      requestLog.id,
+	}
+	if ip := clientIP(req); ip != nil {
+		entry.RemoteAddr = ip.String()
+	}
+	if currentConfig().accessLogTransformation {
+		entry.Transformation = requestLog.transformation
+	}
+
+	line := formatAccessLog(entry, currentConfig().accessLogFormat, currentConfig().accessLogTransformation)
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	io.WriteString(accessLogWriter, line)
+}
+
+// formatAccessLog turns an entry into a line of the access log. The
+// transformation name is appended to the Common and Combined Log Format lines
+// when asked for, "-" stands for custom transformations.
+func formatAccessLog(entry accessLogEntry, format string, withTransformation bool) string {
+	if format == accessLogJSON {
+		data, _ := json.Marshal(entry)
+		return string(data) + "\n"
+	}
+
+	line := fmt.Sprintf("%s - - [%s] %s %d %s",
+		clfField(entry.RemoteAddr),
+		entry.Time.Format(clfTimeFormat),
+		strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Protocol),
+		entry.Status,
+		clfBytes(entry.Bytes))
+	if format == accessLogCombined {
+		line += " " + strconv.Quote(clfField(entry.Referer)) + " " + strconv.Quote(clfField(entry.UserAgent))
+	}
+	if withTransformation {
+		line += " " + strconv.Quote(clfField(entry.Transformation))
+	}
+	return line + "\n"
+}
+
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func clfBytes(bytes int) string {
+	if bytes == 0 {
+		return "-"
+	}
+	return strconv.Itoa(bytes)
+}
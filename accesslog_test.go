@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatAccessLog(t *testing.T) {
+	entry := accessLogEntry{
+		Time:           time.Date(2015, 3, 14, 9, 26, 53, 0, time.UTC),
+		RemoteAddr:     "192.0.2.7",
+		Method:         "GET",
+		URI:            "/image/t_square/cat.jpg",
+		Protocol:       "HTTP/1.1",
+		Status:         200,
+		Bytes:          5120,
+		UserAgent:      `Mozilla/5.0 "quoted"`,
+		DurationMillis: 12.5,
+		Transformation: "square",
+	}
+
+	cases := []struct {
+		format             string
+		withTransformation bool
+		exp                string
+	}{
+		{accessLogCommon, false, `192.0.2.7 - - [14/Mar/2015:09:26:53 +0000] "GET /image/t_square/cat.jpg HTTP/1.1" 200 5120` + "\n"},
+		{accessLogCombined, false, `192.0.2.7 - - [14/Mar/2015:09:26:53 +0000] "GET /image/t_square/cat.jpg HTTP/1.1" 200 5120 "-" "Mozilla/5.0 \"quoted\""` + "\n"},
+		{accessLogCommon, true, `192.0.2.7 - - [14/Mar/2015:09:26:53 +0000] "GET /image/t_square/cat.jpg HTTP/1.1" 200 5120 "square"` + "\n"},
+		{accessLogJSON, true, `{"time":"2015-03-14T09:26:53Z","remote_addr":"192.0.2.7","method":"GET","uri":"/image/t_square/cat.jpg","protocol":"HTTP/1.1","status":200,"bytes":5120,"user_agent":"Mozilla/5.0 \"quoted\"","duration_ms":12.5,"transformation":"square"}` + "\n"},
+	}
+
+	for _, c := range cases {
+		line := formatAccessLog(entry, c.format, c.withTransformation)
+		if line != c.exp {
+			t.Errorf("Expected %s access log line:\n%s\ngot:\n%s", c.format, c.exp, line)
+		}
+	}
+}
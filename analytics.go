@@ -0,0 +1,190 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
+)
+
+const (
+	analyticsKeyPrefix = "analytics:"
+
+	// Only the most requested images are kept, the sets are trimmed every
+	// analyticsTrimInterval requests on average
+	analyticsMaxImages    = 10000
+	analyticsTrimInterval = 100
+
+	defaultAnalyticsLimit = 10
+	maxAnalyticsLimit     = 1000
+
+	// Custom transformations are counted together under this name, like in
+	// the access log
+	customTransformationName = "-"
+)
+
+// AnalyticsEntry is how often a transformation or an image was served and
+// how many bytes that took
+type AnalyticsEntry struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// AnalyticsResponse is a struct to represent a JSON response for the analytics handler
+type AnalyticsResponse struct {
+	Status          string           `json:"status"`
+	ErrorMessage    string           `json:"errorMessage,omitempty"`
+	Since           *time.Time       `json:"since,omitempty"`
+	Transformations []AnalyticsEntry `json:"transformations,omitempty"`
+	Unused          []string         `json:"unused,omitempty"`
+	Images          []AnalyticsEntry `json:"images,omitempty"`
+}
+
+// analyticsPrefix returns the prefix of the analytics keys of a tenant, the
+// server's own for nil
+func analyticsPrefix(tenant *Tenant) string {
+	if tenant == nil {
+		return analyticsKeyPrefix
+	}
+	return analyticsKeyPrefix + "tenant:" + tenant.name + ":"
+}
+
+// recordAnalytics is a middleware counting the images served per
+// transformation and per image when analytics is enabled
+func recordAnalytics(c martini.Context, res http.ResponseWriter, req *http.Request) {
+	c.Next()
+
+	entry := requestLogFor(req)
+	rw := res.(martini.ResponseWriter)
+	if entry.imagePath == "" || rw.Status() >= http.StatusBadRequest {
+		return
+	}
+	name := entry.transformation
+	if name == "" {
+		name = customTransformationName
+	}
+	tenant := tenantFor(req)
+	imagePath := entry.imagePath
+	if tenant != nil {
+		imagePath = strings.TrimPrefix(imagePath, tenant.prefix)
+	}
+	addAnalytics(analyticsPrefix(tenant), name, imagePath, rw.Size())
+}
+
+func addAnalytics(prefix, transformation, imagePath string, size int) {
+	Conn.Do("SETNX", prefix+"since", time.Now().Unix())
+	Conn.Do("ZINCRBY", prefix+"transformations:requests", 1, transformation)
+	Conn.Do("ZINCRBY", prefix+"transformations:bytes", size, transformation)
+	Conn.Do("ZINCRBY", prefix+"images:requests", 1, imagePath)
+	Conn.Do("ZINCRBY", prefix+"images:bytes", size, imagePath)
+
+	if rand.Intn(analyticsTrimInterval) == 0 {
+		Conn.Do("ZREMRANGEBYRANK", prefix+"images:requests", 0, -analyticsMaxImages-1)
+		Conn.Do("ZREMRANGEBYRANK", prefix+"images:bytes", 0, -analyticsMaxImages-1)
+	}
+}
+
+// topAnalytics returns the limit (all for 0) members of a set with the
+// highest scores and their scores in its companion set
+func topAnalytics(key, otherKey string, limit int, byBytes bool) ([]AnalyticsEntry, error) {
+	values, err := redis.Strings(Conn.Do("ZREVRANGE", key, 0, limit-1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AnalyticsEntry, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, _ := strconv.ParseFloat(values[i+1], 64)
+		other, _ := redis.Float64(Conn.Do("ZSCORE", otherKey, values[i]))
+		entry := AnalyticsEntry{Name: values[i], Requests: int64(score), Bytes: int64(other)}
+		if byBytes {
+			entry.Requests, entry.Bytes = int64(other), int64(score)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// getAnalytics returns the usage of all transformations, the ones of conf
+// which were never used and the top images by requests or bytes
+func getAnalytics(prefix string, conf *Configuration, limit int, byBytes bool) (AnalyticsResponse, error) {
+	response := AnalyticsResponse{Status: "ok"}
+	if since, err := redis.Int64(Conn.Do("GET", prefix+"since")); err == nil {
+		t := time.Unix(since, 0)
+		response.Since = &t
+	}
+
+	first, second := "requests", "bytes"
+	if byBytes {
+		first, second = second, first
+	}
+	var err error
+	response.Transformations, err = topAnalytics(prefix+"transformations:"+first, prefix+"transformations:"+second, 0, byBytes)
+	if err != nil {
+		return response, err
+	}
+	response.Images, err = topAnalytics(prefix+"images:"+first, prefix+"images:"+second, limit, byBytes)
+	if err != nil {
+		return response, err
+	}
+
+	used := make(map[string]bool, len(response.Transformations))
+	for _, entry := range response.Transformations {
+		used[entry.Name] = true
+	}
+	for name := range conf.transformations {
+		if !used[name] {
+			response.Unused = append(response.Unused, name)
+		}
+	}
+	sort.Strings(response.Unused)
+	return response, nil
+}
+
+// analyticsHandler returns the requests and bytes served per transformation
+// and for the most requested images to admins, ?limit= sets how many images
+// and ?sort=bytes orders them by bandwidth
+func analyticsHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, AnalyticsResponse{Status: "error", ErrorMessage: "API key invalid or missing"})
+	}
+
+	limit := defaultAnalyticsLimit
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxAnalyticsLimit {
+			return jsonResponse(res, http.StatusBadRequest, AnalyticsResponse{Status: "error", ErrorMessage: "limit needs to be between 1 and " + strconv.Itoa(maxAnalyticsLimit)})
+		}
+	}
+	byBytes := req.URL.Query().Get("sort") == "bytes"
+
+	tenant := tenantFor(req)
+	response, err := getAnalytics(analyticsPrefix(tenant), tenant.config(), limit, byBytes)
+	if err != nil {
+		slog.Error("reading analytics failed", "error", err)
+		return jsonResponse(res, http.StatusInternalServerError, AnalyticsResponse{Status: "error", ErrorMessage: "reading analytics failed"})
+	}
+	return jsonResponse(res, http.StatusOK, response)
+}
+
+// analyticsResetHandler starts counting from scratch, e.g. after pruning
+func analyticsResetHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, AnalyticsResponse{Status: "error", ErrorMessage: "API key invalid or missing"})
+	}
+
+	prefix := analyticsPrefix(tenantFor(req))
+	_, err := Conn.Do("DEL", prefix+"since", prefix+"transformations:requests", prefix+"transformations:bytes", prefix+"images:requests", prefix+"images:bytes")
+	if err != nil {
+		slog.Error("resetting analytics failed", "error", err)
+		return jsonResponse(res, http.StatusInternalServerError, AnalyticsResponse{Status: "error", ErrorMessage: "resetting analytics failed"})
+	}
+	return jsonResponse(res, http.StatusOK, AnalyticsResponse{Status: "ok"})
+}
@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestAnalyticsPrefix(t *testing.T) {
+	if prefix := analyticsPrefix(nil); prefix != "analytics:" {
+		t.Errorf("Unexpected prefix: %s", prefix)
+	}
+	if prefix := analyticsPrefix(&Tenant{name: "acme"}); prefix != "analytics:tenant:acme:" {
+		t.Errorf("Unexpected prefix for a tenant: %s", prefix)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Audited actions
+	auditUpload       = "upload"
+	auditUploadCancel = "upload-cancel"
+	auditPurge        = "purge"
+	auditPurgeJob     = "purge-job"
+	auditKeyCreate    = "key-create"
+	auditKeyUpdate    = "key-update"
+	auditKeyRemove    = "key-remove"
+	auditDownloadURL  = "download-url"
+
+	// Results of audited actions
+	auditSucceeded = "succeeded"
+	auditDenied    = "denied"
+	auditFailed    = "failed"
+)
+
+var (
+	// Where audit events are appended to, nil when only sent to the webhook
+	// or disabled
+	auditWriter io.Writer
+	auditMutex  sync.Mutex
+)
+
+// AuditEvent is one line of the audit log and the body of webhook calls
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Actor      string    `json:"actor"`
+	Target     string    `json:"target,omitempty"`
+	Result     string    `json:"result"`
+	Status     int       `json:"status,omitempty"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+type auditTargetKey struct{}
+
+// auditTarget is what an audited request acts on, set by its handler when it
+// isn't a part of the URL
+type auditTarget struct {
+	path string
+}
+
+// auditInit opens the audit log, "stdout" or "-" write it to the standard
+// output, anything else is a path of a file it is appended to
+func auditInit() error {
+	switch currentConfig().auditLogOutput {
+	case "":
+		return nil
+	case "stdout", "-":
+		auditWriter = os.Stdout
+	default:
+		file, err := os.OpenFile(currentConfig().auditLogOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		auditWriter = file
+	}
+	return nil
+}
+
+func auditCleanUp() {
+	if file, ok := auditWriter.(*os.File); ok && file != os.Stdout {
+		file.Close()
+	}
+}
+
+func auditEnabled() bool {
+	return auditWriter != nil || currentConfig().auditLogWebhook != ""
+}
+
+// audited returns a middleware adding the requests of a route to the audit
+// log once they are answered
+func audited(action string) martini.Handler {
+	return func(c martini.Context, params martini.Params, res http.ResponseWriter, req *http.Request) {
+		if !auditEnabled() {
+			return
+		}
+		target := &auditTarget{}
+		req = req.WithContext(context.WithValue(req.Context(), auditTargetKey{}, target))
+		c.Map(req)
+
+		c.Next()
+
+		for _, param := range []string{"_1", "key", "id"} {
+			if target.path == "" {
+				target.path = params[param]
+			}
+		}
+		writeAudit(httpAuditEvent(params, req, action, target.path, res.(martini.ResponseWriter).Status()))
+	}
+}
+
+// setAuditTarget records what an audited request acts on, it does nothing
+// for requests which aren't audited
+func setAuditTarget(req *http.Request, path string) {
+	if target, ok := req.Context().Value(auditTargetKey{}).(*auditTarget); ok {
+		target.path = path
+	}
+}
+
+// httpAuditEvent describes an action taken by an HTTP request answered with
+// the given status
+func httpAuditEvent(params martini.Params, req *http.Request, action, target string, status int) AuditEvent {
+	event := AuditEvent{
+		Time:      time.Now(),
+		Action:    action,
+		Actor:     auditActor(requestKey(params, req), bearerToken(req)),
+		Target:    target,
+		Result:    auditResult(status),
+		Status:    status,
+		Protocol:  "http",
+		RequestID: requestLogFor(req).id,
+	}
+	if ip := clientIP(req); ip != nil {
+		event.RemoteAddr = ip.String()
+	}
+	return event
+}
+
+// auditResult tells apart denied and failed actions by their status
+func auditResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return auditDenied
+	case status >= 400:
+		return auditFailed
+	}
+	return auditSucceeded
+}
+
+// auditActor names who took an action: the API key, or the subject of a
+// bearer token as "jwt:<sub>", tokens were already verified when the action
+// was authorised
+func auditActor(key, token string) string {
+	if token != "" && currentConfig().jwtAuth != nil {
+		parts := strings.Split(token, ".")
+		var claims struct {
+			Subject string `json:"sub"`
+		}
+		if len(parts) == 3 && decodeJWTPart(parts[1], &claims) == nil && claims.Subject != "" {
+			return "jwt:" + claims.Subject
+		}
+		return "jwt"
+	}
+	if key == "" {
+		return "anonymous"
+	}
+	return key
+}
+
+// writeAudit appends an event to the audit log and sends it to the webhook
+func writeAudit(event AuditEvent) {
+	if auditWriter != nil {
+		data, _ := json.Marshal(event)
+		auditMutex.Lock()
+		_, err := auditWriter.Write(append(data, '\n'))
+		auditMutex.Unlock()
+		if err != nil {
+			slog.Error("writing to the audit log failed", "action", event.Action, "target", event.Target, "error", err)
+		}
+	}
+	if webhook := currentConfig().auditLogWebhook; webhook != "" {
+		timeout := time.Duration(currentConfig().auditLogWebhookTimeout) * time.Millisecond
+		go func() {
+			err := notifyAuditWebhook(webhook, timeout, event)
+			if err != nil {
+				slog.Error("notifying the audit webhook failed", "action", event.Action, "target", event.Target, "url", webhook, "error", err)
+			}
+		}()
+	}
+}
+
+func notifyAuditWebhook(webhookURL string, timeout time.Duration, event AuditEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestHTTPAuditEvent(t *testing.T) {
+	req := httptest.NewRequest("DELETE", "/cache/cat.jpg", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	event := httpAuditEvent(martini.Params{"apikey": "KEY"}, req, auditPurge, "cat.jpg", http.StatusOK)
+	if event.Actor != "KEY" || event.Target != "cat.jpg" || event.Result != auditSucceeded || event.RemoteAddr != "192.0.2.1" || event.Protocol != "http" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+	if event := httpAuditEvent(martini.Params{}, req, auditPurge, "cat.jpg", http.StatusUnauthorized); event.Actor != "anonymous" || event.Result != auditDenied {
+		t.Errorf("Expected an anonymous denied event: %+v", event)
+	}
+	if result := auditResult(http.StatusNotFound); result != auditFailed {
+		t.Errorf("Expected a failure, got: %s", result)
+	}
+
+	// Does nothing for requests which aren't audited
+	setAuditTarget(req, "dog.jpg")
+}
+
+func TestWriteAudit(t *testing.T) {
+	oldWriter := auditWriter
+	defer func() { auditWriter = oldWriter }()
+	var buf bytes.Buffer
+	auditWriter = &buf
+
+	writeAudit(AuditEvent{Action: auditKeyRemove, Actor: "ADMIN", Target: "KEY", Result: auditSucceeded})
+	writeAudit(AuditEvent{Action: auditUpload, Actor: "KEY", Result: auditFailed})
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got: %q", buf.String())
+	}
+	var event AuditEvent
+	if err := json.Unmarshal(lines[0], &event); err != nil || event.Action != auditKeyRemove || event.Target != "KEY" {
+		t.Errorf("Unexpected event: %+v, %v", event, err)
+	}
+}
@@ -6,57 +6,140 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
 	"github.com/twinj/uuid"
 )
 
 const (
-	// GetPermission = permission to get (and transform) images
-	GetPermission = "get"
-	// UploadPermission = permission to upload images
-	UploadPermission = "upload"
+	// ReadPermission = permission to get (and transform) images
+	ReadPermission = "read"
+	// WritePermission = permission to upload images
+	WritePermission = "write"
+	// AdminPermission = permission to manage the server (cache, API keys...)
+	AdminPermission = "admin"
+
+	// Alternatives to passing an API key as part of the URL
+	apiKeyHeader     = "X-Pixlserv-Key"
+	apiKeyQueryParam = "apikey"
+
+	// Channel used to tell all instances to reload API keys
+	authKeysChannel = "auth:keys"
 )
 
 var (
-	permissionsByKey map[string]map[string]bool
+	permissionsByKey     map[string]map[string]bool
+	permissionsByKeyLock sync.RWMutex
+
+	// Permission names used before scopes were introduced
+	legacyPermissions = map[string]string{
+		"get":    ReadPermission,
+		"upload": WritePermission,
+	}
+
+	defaultKeyPermissions = []string{ReadPermission, WritePermission}
 )
 
+// APIKey describes an API key and its permissions
+type APIKey struct {
+	Key         string   `json:"key"`
+	Secret      string   `json:"secret,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
 func init() {
 	// Change the UUID format to remove surrounding braces and dashes
 	uuid.SwitchFormat(uuid.Clean)
 }
 
 func authInit() error {
-	keys, err := listKeys()
+	err := loadPermissions()
 	if err != nil {
 		return err
 	}
 
-	permissionsByKey = make(map[string]map[string]bool)
+	// Keys can be modified by other instances or the api-key command
+	go redisSubscribe(authKeysChannel, func(data string) {
+		err := loadPermissions()
+		if err != nil {
+			slog.Error("reloading API keys failed", "error", err)
+		}
+	})
+	// Keys changed while redis was unavailable weren't published
+	onRedisReconnect(func() {
+		err := loadPermissions()
+		if err != nil {
+			slog.Error("reloading API keys failed", "error", err)
+		}
+	})
+
+	return nil
+}
+
+func loadPermissions() error {
+	permissions, err := readPermissions(currentConfig())
+	if err != nil {
+		return err
+	}
+	setPermissions(permissions)
+	return nil
+}
+
+// readPermissions reads the permissions of all API keys, and of requests
+// without one as a configuration sets them
+func readPermissions(c *Configuration) (map[string]map[string]bool, error) {
+	keys, err := listKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make(map[string]map[string]bool)
 
 	// Set up permissions for when there's no API key
-	permissionsByKey[""] = make(map[string]bool)
-	permissionsByKey[""][GetPermission] = !Config.authorisedGet
-	permissionsByKey[""][UploadPermission] = !Config.authorisedUpload
+	permissions[""] = make(map[string]bool)
+	permissions[""][ReadPermission] = !c.authorisedGet
+	permissions[""][WritePermission] = !c.authorisedUpload
 
 	// Set up permissions for API keys
 	for _, key := range keys {
-		permissions, err := infoAboutKey(key)
+		keyPermissions, err := infoAboutKey(key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		permissionsByKey[key] = make(map[string]bool)
-		for _, permission := range permissions {
-			permissionsByKey[key][permission] = true
+		permissions[key] = make(map[string]bool)
+		for _, permission := range keyPermissions {
+			permissions[key][permission] = true
 		}
 	}
+	return permissions, nil
+}
 
-	return nil
+func setPermissions(permissions map[string]map[string]bool) {
+	permissionsByKeyLock.Lock()
+	permissionsByKey = permissions
+	permissionsByKeyLock.Unlock()
+}
+
+// isKnownKey reports whether an API key was added, requests without one
+// don't have a known key
+func isKnownKey(key string) bool {
+	permissionsByKeyLock.RLock()
+	defer permissionsByKeyLock.RUnlock()
+
+	_, ok := permissionsByKey[key]
+	return key != "" && ok
 }
 
 func hasPermission(key, permission string) bool {
+	permissionsByKeyLock.RLock()
+	defer permissionsByKeyLock.RUnlock()
+
 	val, ok := permissionsByKey[key][permission]
 	if ok {
 		return val
@@ -64,10 +147,32 @@ func hasPermission(key, permission string) bool {
 	return false
 }
 
-func generateKey() (string, string, error) {
+// requestKey returns the API key a request was made with, it can be a part of
+// the URL, a header or a query parameter
+func requestKey(params martini.Params, req *http.Request) string {
+	if key := params["apikey"]; key != "" {
+		return key
+	}
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	return req.URL.Query().Get(apiKeyQueryParam)
+}
+
+// Tells all instances to reload API keys.
+func keysChanged() {
+	Conn.Do("PUBLISH", authKeysChannel, "")
+}
+
+func generateKey(permissions []string) (string, string, error) {
+	permissions, err := validPermissions(permissions)
+	if err != nil {
+		return "", "", err
+	}
+
 	key := uuid.NewV4().String()
 	secretKey := uuid.NewV4().String()
-	_, err := Conn.Do("SADD", "api-keys", key)
+	_, err = Conn.Do("SADD", "api-keys", key)
 	if err != nil {
 		return "", "", err
 	}
@@ -75,7 +180,7 @@ func generateKey() (string, string, error) {
 	if err != nil {
 		return "", "", err
 	}
-	_, err = Conn.Do("SADD", "key:"+key+":permissions", GetPermission, UploadPermission)
+	err = setKeyPermissions(key, permissions)
 	return key, secretKey, err
 }
 
@@ -99,10 +204,22 @@ func infoAboutKey(key string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	permissions, err := redis.Strings(Conn.Do("SMEMBERS", "key:"+key+":permissions"))
+	stored, err := redis.Strings(Conn.Do("SMEMBERS", "key:"+key+":permissions"))
 	if err != nil {
 		return nil, err
 	}
+
+	unique := make(map[string]bool)
+	for _, permission := range stored {
+		if newName, ok := legacyPermissions[permission]; ok {
+			permission = newName
+		}
+		unique[permission] = true
+	}
+	permissions := make([]string, 0, len(unique))
+	for permission := range unique {
+		permissions = append(permissions, permission)
+	}
 	sort.Strings(permissions)
 	return permissions, nil
 }
@@ -111,6 +228,25 @@ func listKeys() ([]string, error) {
 	return redis.Strings(Conn.Do("SMEMBERS", "api-keys"))
 }
 
+// Returns all API keys with their permissions (without secrets).
+func listKeysWithPermissions() ([]APIKey, error) {
+	keys, err := listKeys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	result := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		permissions, err := infoAboutKey(key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, APIKey{Key: key, Permissions: permissions})
+	}
+	return result, nil
+}
+
 func modifyKey(key, op, permission string) error {
 	err := checkKeyExists(key)
 	if err != nil {
@@ -119,13 +255,46 @@ func modifyKey(key, op, permission string) error {
 	if op != "add" && op != "remove" {
 		return errors.New("modifier needs to be 'add' or 'remove'")
 	}
-	if permission != GetPermission && permission != UploadPermission {
-		return fmt.Errorf("modifier needs to end with a valid permission: %s or %s", GetPermission, UploadPermission)
+	permission, ok := validPermission(permission)
+	if !ok {
+		return fmt.Errorf("modifier needs to end with a valid permission: %s, %s or %s", ReadPermission, WritePermission, AdminPermission)
 	}
 	if op == "add" {
 		_, err = Conn.Do("SADD", "key:"+key+":permissions", permission)
 	} else {
-		_, err = Conn.Do("SREM", "key:"+key+":permissions", permission)
+		args := append([]interface{}{"key:" + key + ":permissions"}, permissionNames(permission)...)
+		_, err = Conn.Do("SREM", args...)
+	}
+	if err == nil {
+		keysChanged()
+	}
+	return err
+}
+
+// Replaces the permissions (KEYS[1]) of a key with ARGV atomically, a
+// script is a single command so it can be run on the shared connection
+var setPermissionsScript = redis.NewScript(1, `
+redis.call("DEL", KEYS[1])
+if #ARGV > 0 then
+	redis.call("SADD", KEYS[1], unpack(ARGV))
+end
+return 1
+`)
+
+// Replaces all permissions of a key.
+func setKeyPermissions(key string, permissions []string) error {
+	permissions, err := validPermissions(permissions)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{"key:" + key + ":permissions"}
+	for _, permission := range permissions {
+		args = append(args, permission)
+	}
+	_, err = setPermissionsScript.Do(Conn, args...)
+	if err == nil {
+		keysChanged()
 	}
 	return err
 }
@@ -139,7 +308,10 @@ func removeKey(key string) error {
 	if err != nil {
 		return err
 	}
-	_, err = Conn.Do("DEL", "key:"+key+":permissions")
+	_, err = Conn.Do("DEL", "key:"+key, "key:"+key+":permissions")
+	if err == nil {
+		keysChanged()
+	}
 	return err
 }
 
@@ -158,7 +330,38 @@ func getSecretForKey(key string) (string, error) {
 }
 
 func authPermissionsOptions() string {
-	return fmt.Sprintf("%s/%s", GetPermission, UploadPermission)
+	return fmt.Sprintf("%s/%s/%s", ReadPermission, WritePermission, AdminPermission)
+}
+
+// Checks a permission name, legacy names are translated to current ones.
+func validPermission(permission string) (string, bool) {
+	if newName, ok := legacyPermissions[permission]; ok {
+		permission = newName
+	}
+	return permission, permission == ReadPermission || permission == WritePermission || permission == AdminPermission
+}
+
+func validPermissions(permissions []string) ([]string, error) {
+	result := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		valid, ok := validPermission(strings.TrimSpace(permission))
+		if !ok {
+			return nil, fmt.Errorf("invalid permission: %s, use %s", permission, authPermissionsOptions())
+		}
+		result = append(result, valid)
+	}
+	return result, nil
+}
+
+// Returns a permission's name and its legacy names as stored in redis.
+func permissionNames(permission string) []interface{} {
+	names := []interface{}{permission}
+	for legacyName, newName := range legacyPermissions {
+		if newName == permission {
+			names = append(names, legacyName)
+		}
+	}
+	return names
 }
 
 func checkKeyExists(key string) error {
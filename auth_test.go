@@ -0,0 +1,18 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidPermissions(t *testing.T) {
+	act, err := validPermissions([]string{"get", "write", " admin"})
+	exp := []string{ReadPermission, WritePermission, AdminPermission}
+	if err != nil || !reflect.DeepEqual(act, exp) {
+		t.Errorf("Expected: %v, actual: %v (%v)", exp, act, err)
+	}
+
+	if _, err := validPermissions([]string{"delete"}); err == nil {
+		t.Error("Expected an unknown permission to be rejected")
+	}
+}
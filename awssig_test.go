@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequestV4(t *testing.T) {
+	// Example from the AWS General Reference
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	credentials := awsCredentials{"AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", ""}
+
+	signAWSRequestV4(req, nil, credentials, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	exp := "Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if act := req.Header.Get("Authorization"); !strings.HasSuffix(act, exp) {
+		t.Errorf("Expected signature: %s, actual authorization: %s", exp, act)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// expandGlobs returns the files matching any of the patterns, each of them
+// needs to match at least one file
+func expandGlobs(patterns []string) ([]string, error) {
+	unique := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			unique[match] = true
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("no files match %s", pattern)
+		}
+	}
+
+	paths := make([]string, 0, len(unique))
+	for path := range unique {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// storageOriginals returns the original images in the storage whose paths
+// start with prefix, cached transformed images are left out
+func storageOriginals(prefix string) ([]string, error) {
+	paths, err := storageImpl.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	originals := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if _, ok := originalPath(path); !ok {
+			originals = append(originals, path)
+		}
+	}
+	sort.Strings(originals)
+	return originals, nil
+}
+
+// runBatch calls transform for every path from concurrency goroutines,
+// progress is called after each of them (never concurrently). It returns
+// how many failed.
+func runBatch(paths []string, concurrency int, transform func(string) error, progress func(done int, path string, err error)) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	type result struct {
+		path string
+		err  error
+	}
+	queue := make(chan string)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range queue {
+				results <- result{path, transform(path)}
+			}
+		}()
+	}
+	go func() {
+		for _, path := range paths {
+			queue <- path
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	done, failed := 0, 0
+	for r := range results {
+		done++
+		if r.err != nil {
+			failed++
+		}
+		progress(done, r.path, r.err)
+	}
+	return failed
+}
+
+// transformFile transforms an image file on disk, the result is saved into
+// outputDir (next to the original when empty) named like cached images are
+func transformFile(path, parametersStr, outputDir string) error {
+	outputName, encoded, err := transformFileData(path, parametersStr)
+	if err != nil {
+		return err
+	}
+
+	if outputDir == "" {
+		outputDir = filepath.Dir(path)
+	}
+	return ioutil.WriteFile(filepath.Join(outputDir, outputName), encoded, 0644)
+}
+
+// transformFileData transforms an image file on disk and returns the result
+// with the name it's saved under
+func transformFileData(path, parametersStr string) (string, []byte, error) {
+	transformation, _, baseName, err := resolveTransformation(currentConfig(), parametersStr, filepath.Base(path))
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	outputName, _ := transformation.createFilePath(baseName)
+	encoded, _, _, _, err := processImage(context.Background(), data, outputName, baseName, &transformation)
+	return outputName, encoded, err
+}
+
+// transformStored transforms an image kept in the storage and adds the
+// result to the cache as if it had been requested
+func transformStored(path, parametersStr string) error {
+	transformation, _, baseImagePath, err := resolveTransformation(currentConfig(), parametersStr, path)
+	if err != nil {
+		return err
+	}
+	sourceInfo, err := statSource(baseImagePath)
+	if err != nil {
+		return err
+	}
+	data, err := fetchImage(baseImagePath)
+	if err != nil {
+		return err
+	}
+
+	fullImagePath, _ := transformation.createFilePath(baseImagePath)
+	encoded, format, fit, _, err := processImage(context.Background(), data, fullImagePath, baseImagePath, &transformation)
+	if err != nil {
+		return err
+	}
+	persistDerived(fullImagePath, encoded, format)
+	pushToEdges(fullImagePath, encoded, format)
+	err = addEncodedToCache(fullImagePath, encoded, format)
+	if err != nil {
+		return err
+	}
+	setCacheSource(fullImagePath, sourceInfo)
+	setCacheParameters(fullImagePath, &transformation)
+	setCacheExpiry(fullImagePath, &transformation)
+	if fit != nil {
+		setCacheFit(fullImagePath, fit)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestExpandGlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.jpg", "b.jpg", "c.png"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d.jpg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := expandGlobs([]string{filepath.Join(dir, "*.jpg"), filepath.Join(dir, "a.jpg")})
+	if err != nil || len(paths) != 2 || paths[0] != filepath.Join(dir, "a.jpg") || paths[1] != filepath.Join(dir, "b.jpg") {
+		t.Errorf("Unexpected glob result: %v, %v", paths, err)
+	}
+
+	if _, err := expandGlobs([]string{filepath.Join(dir, "*.gif")}); err == nil {
+		t.Error("Expected an error for a pattern matching no files")
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	paths := []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"}
+	var calls int32
+	transform := func(path string) error {
+		atomic.AddInt32(&calls, 1)
+		if path == "c.jpg" {
+			return errors.New("corrupt image")
+		}
+		return nil
+	}
+
+	last := 0
+	var failedPaths []string
+	failed := runBatch(paths, 3, transform, func(done int, path string, err error) {
+		if done != last+1 {
+			t.Errorf("Expected progress %d, got: %d", last+1, done)
+		}
+		last = done
+		if err != nil {
+			failedPaths = append(failedPaths, path)
+		}
+	})
+
+	if calls != 4 || last != 4 {
+		t.Errorf("Expected all 4 images to be transformed, got: %d calls, %d reported", calls, last)
+	}
+	if failed != 1 || len(failedPaths) != 1 || failedPaths[0] != "c.jpg" {
+		t.Errorf("Expected c.jpg to fail, got: %d, %v", failed, failedPaths)
+	}
+}
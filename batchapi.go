@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Max. number of images transformed in one batch request
+	maxBatchImages = 100
+	// Max. size of a batch request's body in bytes
+	maxBatchRequestSize = 1 << 20
+	// Images of a batch request transformed at the same time, the
+	// processing pool still limits how many are generated
+	batchConcurrency = 4
+
+	// BatchOutputURL = results are the URLs of the transformed images, which
+	// are cached and served from the cache
+	BatchOutputURL = "url"
+	// BatchOutputBase64 = results contain the transformed images
+	BatchOutputBase64 = "base64"
+)
+
+// BatchRequest lists images to transform as image URLs would ask for them
+type BatchRequest struct {
+	Images []BatchImage `json:"images"`
+	Output string       `json:"output"`
+}
+
+// BatchImage is an image path with the parameters to transform it with
+type BatchImage struct {
+	Path       string `json:"path"`
+	Parameters string `json:"parameters"`
+}
+
+// BatchResult is the outcome of transforming one image of a batch request
+type BatchResult struct {
+	Path         string `json:"path"`
+	Parameters   string `json:"parameters"`
+	Status       string `json:"status"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	URL          string `json:"url,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+	Size         int    `json:"size,omitempty"`
+	Data         string `json:"data,omitempty"`
+}
+
+// BatchResponse is a struct to represent a JSON response for the batch
+// handler, results are in the order of the requested images
+type BatchResponse struct {
+	Status       string        `json:"status"`
+	ErrorMessage string        `json:"errorMessage,omitempty"`
+	Results      []BatchResult `json:"results,omitempty"`
+}
+
+// parseBatchRequest reads a JSON batch request
+func parseBatchRequest(req *http.Request) (*BatchRequest, error) {
+	var r BatchRequest
+	err := json.NewDecoder(io.LimitReader(req.Body, maxBatchRequestSize)).Decode(&r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %s", err)
+	}
+	if len(r.Images) == 0 || len(r.Images) > maxBatchImages {
+		return nil, fmt.Errorf("between 1 and %d images are needed", maxBatchImages)
+	}
+	switch r.Output {
+	case "":
+		r.Output = BatchOutputURL
+	case BatchOutputURL, BatchOutputBase64:
+	default:
+		return nil, fmt.Errorf("invalid output: %s (available: %s, %s)", r.Output, BatchOutputURL, BatchOutputBase64)
+	}
+	return &r, nil
+}
+
+// batchHandler transforms several images in one request, each of them is
+// authorised and transformed like an image URL would be
+func batchHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	r, err := parseBatchRequest(req)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, BatchResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+
+	tenant := tenantFor(req)
+	key, token := requestKey(params, req), bearerToken(req)
+	results := make([]BatchResult, len(r.Images))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, batchConcurrency)
+	for i, batchImage := range r.Images {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, batchImage BatchImage) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[i] = transformBatchImage(req, tenant, key, token, batchImage, r.Output)
+		}(i, batchImage)
+	}
+	wg.Wait()
+	return jsonResponse(res, http.StatusOK, BatchResponse{Status: "ok", Results: results})
+}
+
+// transformBatchImage transforms an image of a batch request, returning its
+// URL or the image itself
+func transformBatchImage(req *http.Request, tenant *Tenant, key, token string, batchImage BatchImage, output string) BatchResult {
+	result := BatchResult{Path: batchImage.Path, Parameters: batchImage.Parameters, Status: "error"}
+	conf := tenant.config()
+	if !accessAuthorised(transformationAccess(conf, batchImage.Parameters), key, token) {
+		result.ErrorMessage = "API key invalid or missing"
+		return result
+	}
+
+	requestedPath, version := splitVersion(batchImage.Path)
+	imagePath, err := tenant.storagePath(requestedPath)
+	if err != nil {
+		result.ErrorMessage = "Image not found: " + requestedPath
+		return result
+	}
+	transformation, _, baseImagePath, err := resolveTransformation(conf, batchImage.Parameters, imagePath)
+	if err != nil {
+		result.ErrorMessage = err.Error()
+		return result
+	}
+	transformation.version = version
+	transformation = transformation.withTextVariables(requestTextVariables(key, req))
+	fullImagePath, err := transformation.createFilePath(baseImagePath)
+	if err != nil {
+		result.ErrorMessage = err.Error()
+		return result
+	}
+
+	data, err := transformedImage(req.Context(), fullImagePath, baseImagePath, transformation)
+	if err == ErrNotFound {
+		result.ErrorMessage = "Image not found: " + requestedPath
+		return result
+	}
+	if err != nil {
+		result.ErrorMessage = err.Error()
+		return result
+	}
+
+	result.Status = "ok"
+	result.ContentType = http.DetectContentType(data)
+	result.Size = len(data)
+	if output == BatchOutputBase64 {
+		result.Data = base64.StdEncoding.EncodeToString(data)
+		return result
+	}
+	result.URL = tenantURLPrefix(req) + batchImageURL(tenant, conf, batchImage)
+	return result
+}
+
+// batchImageURL returns the path of the image URL a batch image is served
+// at (without a tenant's prefix), signed when URLs need to be
+func batchImageURL(tenant *Tenant, conf *Configuration, batchImage BatchImage) string {
+	parametersStr := batchImage.Parameters
+	if conf.signedURLs && tenant.urlSigningSecret() != "" {
+		parametersStr = signURL(parametersStr, batchImage.Path, tenant.urlSigningSecret(), 0)
+	}
+	segments := strings.Split(batchImage.Path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/image/" + parametersStr + "/" + strings.Join(segments, "/")
+}
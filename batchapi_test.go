@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseBatchRequest(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/batch", strings.NewReader(`{"images": [{"path": "cat.jpg", "parameters": "w_400,h_300"}, {"path": "dog.jpg", "parameters": "t_square"}]}`))
+	r, err := parseBatchRequest(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(r.Images) != 2 || r.Images[1].Path != "dog.jpg" || r.Images[1].Parameters != "t_square" || r.Output != BatchOutputURL {
+		t.Errorf("Unexpected request: %+v", r)
+	}
+
+	invalid := []string{
+		`{"images": []}`,
+		`{"images": [{"path": "cat.jpg", "parameters": "w_400"}], "output": "binary"}`,
+		`{"images": "cat.jpg"}`,
+		`not json`,
+		`{"images": [` + strings.Repeat(`{"path": "cat.jpg", "parameters": "w_400"},`, maxBatchImages) + `{"path": "cat.jpg", "parameters": "w_400"}]}`,
+	}
+	for _, body := range invalid {
+		req, _ := http.NewRequest("POST", "/batch", strings.NewReader(body))
+		if _, err := parseBatchRequest(req); err == nil {
+			t.Errorf("Expected an error for %.60s", body)
+		}
+	}
+}
+
+func TestBatchImageURL(t *testing.T) {
+	conf := &Configuration{}
+	batchImage := BatchImage{Path: "v_2/photos/my cat.jpg", Parameters: "w_400,h_300"}
+	if url := batchImageURL(nil, conf, batchImage); url != "/image/w_400,h_300/v_2/photos/my%20cat.jpg" {
+		t.Errorf("Unexpected URL: %s", url)
+	}
+
+	defer func(secret string) { urlSigningSecret = secret }(urlSigningSecret)
+	urlSigningSecret = "secret"
+	conf.signedURLs = true
+	url := batchImageURL(nil, conf, batchImage)
+	expected := "/image/" + signURL("w_400,h_300", "v_2/photos/my cat.jpg", "secret", 0) + "/v_2/photos/my%20cat.jpg"
+	if url != expected || !strings.Contains(url, ","+parameterSignature+"_") {
+		t.Errorf("Expected a signed URL, got %s", url)
+	}
+}
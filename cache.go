@@ -4,28 +4,173 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	"log"
+	"io"
+	"log/slog"
+	"math/rand"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ReshNesh/pixlserv/engine"
 	"github.com/garyburd/redigo/redis"
 )
 
 const (
 	candidatesToRemove = 5
+
+	// Redis channel used to tell other instances that a cached image was removed
+	cacheInvalidationChannel = "cache:invalidate"
+	// Redis channel used to tell other instances that a cached image was regenerated
+	cacheRefreshChannel = "cache:refresh"
+	// Redis key used so that only one instance prunes the cache at a time
+	cachePruneLockKey     = "cache:prunelock"
+	cachePruneLockSeconds = 60
+
+	// Cached images of a namespace end with --ns_NAME-- before the extension
+	cacheNamespacePrefix = "ns_"
+)
+
+var (
+	pruning int32 // 1 while pruneCache is running
+
+	// instanceID identifies this server among others sharing the same redis
+	instanceID = strconv.FormatInt(rand.New(rand.NewSource(time.Now().UnixNano())).Int63(), 36)
+
+	// Matches what names of cached images start with after the original's
+	// name: transformations, IIIF and Deep Zoom images and hashed ones
+	cachedVariantRe = "(?:" + engine.ParameterCropping + "|iiif|dzi|hash)_[^/]*"
+
+	// Matches paths of cached images, captures the original's path parts
+	cachedPathRe = regexp.MustCompile("^(.*)--" + cachedVariantRe + "--(\\.[^./]+)$")
+
+	// Valid cache namespaces and where they are in names of cached images
+	cacheNamespaceRe  = regexp.MustCompile("^[a-z0-9-]{1,64}$")
+	cachedNamespaceRe = regexp.MustCompile("--" + cacheNamespacePrefix + "([a-z0-9-]{1,64})--\\.[^./]+$")
+
+	redisGlobReplacer = strings.NewReplacer("\\", "\\\\", "*", "\\*", "?", "\\?", "[", "\\[", "]", "\\]")
+)
+
+// CacheEntry is metadata about a cached image shared between all server
+// instances using the same redis, the image itself is kept in storage
+type CacheEntry struct {
+	Path    string    `json:"path"`
+	Format  string    `json:"format"`
+	Size    int       `json:"size"`
+	Hits    int       `json:"hits"`
+	Created time.Time `json:"created"`
+	// Parameters of images cached under a hashed name
+	Parameters string `json:"parameters,omitempty"`
+}
+
+// Redis keys of cache counters shared by all instances
+const (
+	statsHitsKey           = "stats:hits"
+	statsMissesKey         = "stats:misses"
+	statsBytesFromCacheKey = "stats:bytesfromcache"
+	statsBytesGeneratedKey = "stats:bytesgenerated"
+	statsEvictionsKey      = "stats:evictions"
+	statsPurgedKey         = "stats:purged"
 )
 
+// CacheStats describes how effective the cache is
+type CacheStats struct {
+	Hits           int64   `json:"hits"`
+	Misses         int64   `json:"misses"`
+	HitRate        float64 `json:"hitRate"`
+	BytesFromCache int64   `json:"bytesFromCache"`
+	BytesGenerated int64   `json:"bytesGenerated"`
+	Entries        int64   `json:"entries"`
+	Size           int64   `json:"size"`
+	Evictions      int64   `json:"evictions"`
+	Purged         int64   `json:"purged"`
+}
+
+// cacheInit starts listening for cache invalidations from other instances.
+// Those matter when each instance keeps cached images on its own disk.
+func cacheInit() {
+	hotCache = newMemoryCache(currentConfig().cacheMemoryLimit)
+
+	go redisSubscribe(cacheInvalidationChannel, func(data string) {
+		parts := strings.SplitN(data, " ", 2)
+		if len(parts) != 2 || parts[0] == instanceID {
+			return
+		}
+		hotCache.remove(parts[1])
+		err := deleteImage(parts[1])
+		if err != nil && err != ErrNotFound {
+			slog.Error("removing an invalidated image failed", "path", parts[1], "error", err)
+		}
+	})
+
+	go redisSubscribe(cacheRefreshChannel, func(data string) {
+		parts := strings.SplitN(data, " ", 2)
+		if len(parts) != 2 || parts[0] == instanceID {
+			return
+		}
+		hotCache.remove(parts[1])
+		// A local copy is outdated now, it will be generated again when
+		// requested next time
+		if storageName == "local" || storageShards != nil {
+			deleteImage(parts[1])
+		}
+	})
+}
+
+// cacheNamespaceSuffix returns what is added to names of cached images of a
+// namespace
+func cacheNamespaceSuffix(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return "--" + cacheNamespacePrefix + namespace
+}
+
+// inCacheNamespace reports whether a cached image belongs to the configured
+// namespace, images cached without one belong to servers without one
+func inCacheNamespace(cachedPath string) bool {
+	namespace := ""
+	if matches := cachedNamespaceRe.FindStringSubmatch(cachedPath); matches != nil {
+		namespace = matches[1]
+	}
+	return namespace == currentConfig().cacheNamespace
+}
+
+func cacheKey(filePath string) string {
+	return fmt.Sprintf("image:%s", filePath)
+}
+
 // Adds the given file to the cache.
 func addToCache(filePath string, img image.Image, format string) error {
-	log.Println("Adding to cache:", filePath)
+	buffer := getEncodeBuffer()
+	defer putEncodeBuffer(buffer)
+	err := writeImage(img, format, buffer)
+	if err != nil {
+		return err
+	}
+	return addEncodedToCache(filePath, buffer.Bytes(), format)
+}
+
+// addEncodedToCache adds an image which is already encoded to the cache
+func addEncodedToCache(filePath string, data []byte, format string) error {
+	slog.Debug("adding to cache", "path", filePath)
 
 	// Save the image
-	size, err := saveImage(img, format, filePath)
+	size := len(data)
+	err := storageImpl.Put(filePath, data, contentTypeFor(format))
 	if err == nil {
-		key := fmt.Sprintf("image:%s", filePath)
+		key := cacheKey(filePath)
+
+		// The image might have been cached by another request in the meantime
+		oldSize, err := redis.Int(Conn.Do("HGET", key, "size"))
+		if err == nil {
+			Conn.Do("DECRBY", "totalcachesize", oldSize)
+		}
 
 		// Add a record to the cache
-		Conn.Do("HSET", key, "size", size)
+		Conn.Do("HMSET", key, "size", size, "format", format, "etag", imageETag(data), "created", time.Now().Unix(), "hits", 0, "preview", "")
 
 		Conn.Do("SETNX", "totalcachesize", 0)
 		Conn.Do("INCRBY", "totalcachesize", size)
@@ -41,42 +186,458 @@ func addToCache(filePath string, img image.Image, format string) error {
 	return err
 }
 
-func removeFromCache(key string) {
+// removeFromCache removes a cached image and its records, it reports whether
+// the image left the access queues
+func removeFromCache(key string) bool {
 	size, err := redis.Int(Conn.Do("HGET", key, "size"))
+	if err == redis.ErrNil {
+		// Access times are recorded without checking the image's record,
+		// which may also have expired, so the queues can have orphans
+		Conn.Do("ZREM", "imageaccesstimestamps", key)
+		Conn.Do("ZREM", "imageaccesscounts", key)
+		return true
+	}
 	if err != nil {
-		return
+		return false
 	}
 
-	err = deleteImage(strings.Replace(key, "image:", "", 1))
-	if err != nil {
-		log.Println("Error removing image:", err)
-		return
+	// A file which is already gone only needs its record removed
+	filePath := strings.Replace(key, "image:", "", 1)
+	err = deleteImage(filePath)
+	if err != nil && err != ErrNotFound {
+		slog.Error("removing a cached image failed", "path", filePath, "error", err)
+		return false
 	}
 
-	log.Printf("Removing from cache: %s", key)
+	slog.Debug("removing from cache", "path", filePath)
+	hotCache.remove(filePath)
 	Conn.Do("DEL", key)
 	Conn.Do("ZREM", "imageaccesstimestamps", key)
 	Conn.Do("ZREM", "imageaccesscounts", key)
 	Conn.Do("DECRBY", "totalcachesize", size)
+	Conn.Do("PUBLISH", cacheInvalidationChannel, instanceID+" "+filePath)
+	return true
+}
+
+// cachedImage is an encoded image opened for reading from the cache
+type cachedImage struct {
+	io.ReadCloser
+	format string
+	// Empty for images cached before ETags were recorded
+	etag string
+	size int
 }
 
-// Loads a file specified by its path from the cache.
-func loadFromCache(filePath string) (image.Image, string, error) {
-	log.Println("Cache lookup for:", filePath)
+// Opens a file specified by its path from the cache.
+func openFromCache(filePath string) (*cachedImage, error) {
+	slog.Debug("cache lookup", "path", filePath)
 
-	exists, err := redis.Bool(Conn.Do("EXISTS", fmt.Sprintf("image:%s", filePath)))
+	key := cacheKey(filePath)
+	values, err := redis.Strings(Conn.Do("HMGET", key, "size", "format", "etag", "expires"))
+	if err == errRedisUnavailable {
+		return openFromStorage(filePath)
+	}
 	if err != nil {
-		return nil, "", err
+		return nil, err
+	}
+	if len(values) != 4 || values[0] == "" {
+		return nil, errors.New("image not found")
+	}
+	if expires, err := strconv.ParseInt(values[3], 10, 64); err == nil && expires <= time.Now().Unix() {
+		// Generated again, other instances need to drop their copies
+		refreshCached(filePath)
+		return nil, errors.New("image expired")
 	}
 
-	if exists {
-		key := fmt.Sprintf("image:%s", filePath)
-		cacheUpdateLastAccess(key)
+	reader, err := storageImpl.Get(filePath)
+	if err != nil {
+		return nil, err
+	}
+	cacheUpdateLastAccess(key)
+	Conn.Do("HINCRBY", key, "hits", 1)
+
+	size, _ := strconv.Atoi(values[0])
+	return &cachedImage{reader, values[1], values[2], size}, nil
+}
+
+// openFromStorage opens a cached image without its metadata while redis is
+// unavailable, images generated since can't be found this way
+func openFromStorage(filePath string) (*cachedImage, error) {
+	info, err := storageImpl.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := storageImpl.Get(filePath)
+	if err != nil {
+		return nil, err
+	}
+	format := strings.TrimPrefix(path.Ext(filePath), ".")
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	return &cachedImage{reader, format, "", int(info.Size)}, nil
+}
+
+// Returns metadata about a cached image.
+func getCacheEntry(filePath string) (*CacheEntry, error) {
+	values, err := redis.StringMap(Conn.Do("HGETALL", cacheKey(filePath)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errors.New("image not found")
+	}
 
-		return loadImage(filePath)
+	entry := &CacheEntry{Path: filePath, Format: values["format"], Parameters: values["parameters"]}
+	entry.Size, _ = strconv.Atoi(values["size"])
+	entry.Hits, _ = strconv.Atoi(values["hits"])
+	created, err := strconv.ParseInt(values["created"], 10, 64)
+	if err == nil {
+		entry.Created = time.Unix(created, 0)
 	}
 
-	return nil, "", errors.New("image not found")
+	return entry, nil
+}
+
+// Returns paths of all cached variants of an image. These are named
+// following createFilePath, e.g. cat--c_e,g_nw,...--.jpg or
+// cat--hash_...--.jpg for cat.jpg.
+func cachedVariants(imagePath string) ([]string, error) {
+	i := strings.LastIndex(imagePath, ".")
+	if i == -1 {
+		return nil, fmt.Errorf("invalid image path")
+	}
+	prefix := imagePath[:i] + "--"
+	suffix := "--" + imagePath[i:]
+	variantRe := regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + cachedVariantRe + regexp.QuoteMeta(suffix) + "$")
+
+	// Look at both the index and the storage, either could have been
+	// changed without the other knowing (e.g. by another instance)
+	unique := make(map[string]bool)
+	keys, err := cacheKeysMatching(cacheKey(redisGlobEscape(prefix) + "*" + redisGlobEscape(suffix)))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		unique[strings.TrimPrefix(key, "image:")] = true
+	}
+	paths, err := storageImpl.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, filePath := range paths {
+		unique[filePath] = true
+	}
+
+	variants := make([]string, 0, len(unique))
+	for filePath := range unique {
+		if variantRe.MatchString(filePath) && inCacheNamespace(filePath) {
+			variants = append(variants, filePath)
+		}
+	}
+	return variants, nil
+}
+
+// Removes all cached variants of an image, returns how many were removed.
+func purgeImage(imagePath string) (int, error) {
+	variants, err := cachedVariants(imagePath)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, variant := range variants {
+		if removeCachedFile(variant) {
+			removed++
+		}
+	}
+	purgeDerived(imagePath)
+	forgetSourceMetadata(imagePath)
+	Conn.Do("INCRBY", statsPurgedKey, removed)
+	slog.Info("purged cached variants", "image", imagePath, "removed", removed)
+	go cdnPurge([]string{imagePath})
+
+	return removed, nil
+}
+
+// Removes a cached file whether it is indexed or not, reports whether
+// anything was removed.
+func removeCachedFile(filePath string) bool {
+	key := cacheKey(filePath)
+	exists, err := redis.Bool(Conn.Do("EXISTS", key))
+	if err == nil && exists {
+		removeFromCache(key)
+		return true
+	}
+
+	hotCache.remove(filePath)
+	err = deleteImage(filePath)
+	if err != nil {
+		if err != ErrNotFound {
+			slog.Error("removing a cached image failed", "path", filePath, "error", err)
+		}
+		return false
+	}
+	return true
+}
+
+// Returns the path of the original image a cached image was created from.
+func originalPath(cachedPath string) (string, bool) {
+	matches := cachedPathRe.FindStringSubmatch(cachedPath)
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[1] + matches[2], true
+}
+
+// Returns paths of all cached images created from originals matching
+// a pattern. The pattern is either a path prefix (products/2015/) or
+// a glob (products/*/cat*.jpg).
+func cachedImagesMatching(pattern string) ([]string, error) {
+	// Listing can be limited to the part before the first wildcard
+	prefix := pattern
+	isGlob := false
+	if i := strings.IndexAny(pattern, "*?["); i != -1 {
+		prefix = pattern[:i]
+		isGlob = true
+	}
+	if _, err := path.Match(pattern, ""); isGlob && err != nil {
+		return nil, err
+	}
+
+	unique := make(map[string]bool)
+	keys, err := cacheKeysMatching(cacheKey(redisGlobEscape(prefix) + "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		unique[strings.TrimPrefix(key, "image:")] = true
+	}
+	paths, err := storageImpl.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, filePath := range paths {
+		unique[filePath] = true
+	}
+
+	matching := make([]string, 0)
+	for cachedPath := range unique {
+		original, ok := originalPath(cachedPath)
+		if !ok || !inCacheNamespace(cachedPath) {
+			continue
+		}
+		if isGlob {
+			ok, _ = path.Match(pattern, original)
+		} else {
+			ok = strings.HasPrefix(original, prefix)
+		}
+		if ok {
+			matching = append(matching, cachedPath)
+		}
+	}
+	return matching, nil
+}
+
+// Returns all keys matching a redis glob-style pattern.
+func cacheKeysMatching(pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	cursor := 0
+	for {
+		values, err := redis.Values(Conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		_, err = redis.Scan(values, &cursor, &batch)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// Escapes characters with a special meaning in redis patterns.
+func redisGlobEscape(str string) string {
+	return redisGlobReplacer.Replace(str)
+}
+
+func missingKey(imagePath string) string {
+	return "missing:" + imagePath
+}
+
+// Reports whether an original image was recently found not to exist.
+func isKnownMissing(imagePath string) bool {
+	if currentConfig().cacheNegativeTTL == 0 {
+		return false
+	}
+	exists, err := redis.Bool(Conn.Do("EXISTS", missingKey(imagePath)))
+	return err == nil && exists
+}
+
+// Remembers that an original image doesn't exist for a short time so that
+// repeated requests for it don't reach the storage.
+func rememberMissing(imagePath string) {
+	if currentConfig().cacheNegativeTTL == 0 {
+		return
+	}
+	Conn.Do("SETEX", missingKey(imagePath), currentConfig().cacheNegativeTTL, 1)
+}
+
+// Forgets that an original image was missing, e.g. when it gets uploaded.
+func forgetMissing(imagePath string) {
+	if currentConfig().cacheNegativeTTL == 0 {
+		return
+	}
+	Conn.Do("DEL", missingKey(imagePath))
+}
+
+// Returns a string identifying the version of a file.
+func fileVersion(info *FileInfo) string {
+	if info.ETag != "" {
+		return info.ETag
+	}
+	return strconv.FormatInt(info.ModTime.UnixNano(), 10)
+}
+
+// Records which version of the original image a cached image was created from.
+func setCacheSource(filePath string, sourceInfo *FileInfo) {
+	Conn.Do("HMSET", cacheKey(filePath), "source", fileVersion(sourceInfo), "sourcemodified", sourceInfo.ModTime.Unix())
+}
+
+// Records the parameters of an image cached under a hashed name, which can't
+// be told from the name itself.
+func setCacheParameters(filePath string, transformation *Transformation) {
+	if strings.Contains(path.Base(filePath), "--"+hashedCachePrefix) {
+		Conn.Do("HSET", cacheKey(filePath), "parameters", transformation.cacheParameters())
+	}
+}
+
+// Records when a cached image expires, using the TTL of its transformation or
+// the configured one. Images without a TTL don't expire.
+func setCacheExpiry(filePath string, transformation *Transformation) {
+	ttl := currentConfig().cacheTTL
+	if transformation != nil && transformation.cacheTTL > 0 {
+		ttl = transformation.cacheTTL
+	}
+	if ttl == 0 {
+		Conn.Do("HDEL", cacheKey(filePath), "expires")
+		return
+	}
+	Conn.Do("HSET", cacheKey(filePath), "expires", time.Now().Unix()+int64(ttl))
+}
+
+// Reports whether any cached images can expire, so that checking the ones
+// kept in memory can be skipped otherwise.
+func cacheExpiryEnabled() bool {
+	if currentConfig().cacheTTL > 0 {
+		return true
+	}
+	confs := []*Configuration{currentConfig()}
+	for _, tenant := range currentConfig().tenants {
+		confs = append(confs, tenant.config())
+	}
+	for _, conf := range confs {
+		for _, t := range conf.transformations {
+			if t.cacheTTL > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns an image from the memory cache unless it expired.
+func cachedInMemory(filePath string) ([]byte, bool) {
+	data, ok := hotCache.get(filePath)
+	if !ok || !cacheExpiryEnabled() {
+		return data, ok
+	}
+	expires, err := redis.Int64(Conn.Do("HGET", cacheKey(filePath), "expires"))
+	if err == nil && expires <= time.Now().Unix() {
+		hotCache.remove(filePath)
+		return nil, false
+	}
+	return data, true
+}
+
+// Returns the modification time of the original a cached image was created
+// from, zero time if unknown.
+func cacheSourceModTime(filePath string) time.Time {
+	modified, err := redis.Int64(Conn.Do("HGET", cacheKey(filePath), "sourcemodified"))
+	if err != nil || modified <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(modified, 0)
+}
+
+// Reports whether the original image changed since a cached image was
+// created from it.
+func cacheSourceChanged(filePath string, sourceInfo *FileInfo) bool {
+	source, err := redis.String(Conn.Do("HGET", cacheKey(filePath), "source"))
+	if err != nil || source == "" {
+		// Unknown, e.g. created before versions were recorded
+		setCacheSource(filePath, sourceInfo)
+		return false
+	}
+	return source != fileVersion(sourceInfo)
+}
+
+// Reports whether it's time to check if the original of a cached image
+// changed. It is checked at most once per revalidation interval by any of
+// the instances.
+func cacheShouldRevalidate(filePath string) bool {
+	if currentConfig().cacheRevalidateInterval == 0 {
+		return false
+	}
+	_, err := redis.String(Conn.Do("SET", "revalidated:"+filePath, 1, "NX", "EX", currentConfig().cacheRevalidateInterval))
+	return err == nil
+}
+
+// Lets other instances know that a cached image was generated again.
+func refreshCached(filePath string) {
+	hotCache.remove(filePath)
+	Conn.Do("PUBLISH", cacheRefreshChannel, instanceID+" "+filePath)
+}
+
+// Records an image of the given size served from the cache.
+func cacheRecordHit(size int) {
+	cacheRequestsTotal.WithLabelValues("hit").Inc()
+	Conn.Do("INCR", statsHitsKey)
+	Conn.Do("INCRBY", statsBytesFromCacheKey, size)
+}
+
+// Records an image of the given size which had to be generated.
+func cacheRecordMiss(size int) {
+	cacheRequestsTotal.WithLabelValues("miss").Inc()
+	Conn.Do("INCR", statsMissesKey)
+	Conn.Do("INCRBY", statsBytesGeneratedKey, size)
+}
+
+// Returns statistics about the cache collected by all instances.
+func getCacheStats() (CacheStats, error) {
+	var stats CacheStats
+	values, err := redis.Strings(Conn.Do("MGET", statsHitsKey, statsMissesKey, statsBytesFromCacheKey, statsBytesGeneratedKey, "totalcachesize", statsEvictionsKey, statsPurgedKey))
+	if err != nil {
+		return stats, err
+	}
+	counters := []*int64{&stats.Hits, &stats.Misses, &stats.BytesFromCache, &stats.BytesGenerated, &stats.Size, &stats.Evictions, &stats.Purged}
+	for i, counter := range counters {
+		*counter, _ = strconv.ParseInt(values[i], 10, 64)
+	}
+
+	stats.Entries, err = redis.Int64(Conn.Do("ZCARD", "imageaccesstimestamps"))
+	if err != nil {
+		return stats, err
+	}
+	if stats.Hits+stats.Misses > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+
+	return stats, nil
 }
 
 func cacheUpdateLastAccess(key string) {
@@ -85,31 +646,85 @@ func cacheUpdateLastAccess(key string) {
 	Conn.Do("ZINCRBY", "imageaccesscounts", 1, key)
 }
 
+// Removes least recently (or frequently) used images until the cache is
+// within the configured limits. Access times and counts are kept in redis
+// so the order of removal is preserved across restarts and shared by all
+// instances.
 func pruneCache() {
+	if currentConfig().cacheLimit == 0 && currentConfig().cacheMaxEntries == 0 {
+		return
+	}
+
+	// Only one pruning run at a time
+	if !atomic.CompareAndSwapInt32(&pruning, 0, 1) {
+		return
+	}
+
 	go func() {
-		if Config.cacheLimit == 0 {
+		defer atomic.StoreInt32(&pruning, 0)
+
+		if !cacheOverLimit() {
 			return
 		}
 
-		totalCacheSize, err := redis.Int(Conn.Do("GET", "totalcachesize"))
+		// Also make sure no other instance is pruning
+		_, err := redis.String(Conn.Do("SET", cachePruneLockKey, instanceID, "NX", "EX", cachePruneLockSeconds))
 		if err != nil {
 			return
 		}
+		defer releaseLockScript.Do(Conn, cachePruneLockKey, instanceID)
 
-		if totalCacheSize < Config.cacheLimit {
-			return
+		for cacheOverLimit() {
+			candidates := getCacheRemovalCandidates()
+			if len(candidates) == 0 {
+				return
+			}
+			removed := 0
+			for _, candidate := range candidates {
+				if removeFromCache(candidate) {
+					removed++
+				}
+			}
+			// Images which can't be removed would be candidates forever
+			if removed == 0 {
+				slog.Warn("pruning the cache stopped, no image could be removed")
+				return
+			}
+			Conn.Do("INCRBY", statsEvictionsKey, removed)
+		}
+	}()
+}
+
+// Deletes a lock (KEYS[1]) only while the instance in ARGV[1] holds it, the
+// lock of a run which took longer than its expiry may be another's by then
+var releaseLockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func cacheOverLimit() bool {
+	if currentConfig().cacheLimit > 0 {
+		totalCacheSize, err := redis.Int(Conn.Do("GET", "totalcachesize"))
+		if err == nil && totalCacheSize > currentConfig().cacheLimit {
+			return true
 		}
+	}
 
-		candidates := getCacheRemovalCandidates()
-		for _, candidate := range candidates {
-			removeFromCache(candidate)
+	if currentConfig().cacheMaxEntries > 0 {
+		entries, err := redis.Int(Conn.Do("ZCARD", "imageaccesstimestamps"))
+		if err == nil && entries > currentConfig().cacheMaxEntries {
+			return true
 		}
-	}()
+	}
+
+	return false
 }
 
 func getCacheRemovalCandidates() []string {
 	set := "imageaccesstimestamps" // LRU
-	if Config.cacheStrategy == LFU {
+	if currentConfig().cacheStrategy == LFU {
 		set = "imageaccesscounts"
 	}
 	// Remove multiple for better performance (especially LFU)
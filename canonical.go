@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// canonicalParameters returns the canonical form of a parameters string: the
+// engine's parameters in a fixed order (w, h, c, g, f, gam, exp, z) without
+// those set to their defaults, followed by the others. The names of named
+// transformations are kept.
+func canonicalParameters(parametersStr string, conf *Configuration) (string, error) {
+	rest := parametersStr
+	var extras []string
+	for _, key := range requestParameters {
+		var value string
+		rest, value = removeParameter(rest, key)
+		if value != "" {
+			extras = append(extras, key+"_"+value)
+		}
+	}
+	if rest != originalParameters && parseTransformationName(rest) == "" {
+		if !conf.allowCustomTransformations {
+			return parametersStr, nil
+		}
+		params, err := parseParameters(rest, conf)
+		if err != nil {
+			return "", err
+		}
+		// Pipelines keep their names rather than the chains they stand for
+		if _, pipeline := expandFilterPipeline(rest, conf.filterPipelines); pipeline != "" {
+			params.Filter = pipeline
+		}
+		rest = params.Encode()
+	}
+	return strings.Join(append([]string{rest}, extras...), ","), nil
+}
+
+// redirectToCanonical answers a request whose parameters (the path segment
+// requested) aren't in their canonical form with a permanent redirect to the
+// URL with canonical ones, it reports false when they are or can't be parsed
+func redirectToCanonical(res http.ResponseWriter, req *http.Request, segment, parametersStr string, conf *Configuration) (int, string, bool) {
+	canonical, err := canonicalParameters(parametersStr, conf)
+	if err != nil || canonical == segment {
+		return 0, "", false
+	}
+	i := strings.Index(req.URL.Path, "/"+segment+"/")
+	if i == -1 {
+		return 0, "", false
+	}
+	location := url.URL{
+		Path:     req.URL.Path[:i] + "/" + canonical + req.URL.Path[i+len(segment)+1:],
+		RawQuery: req.URL.RawQuery,
+	}
+	res.Header().Set("Location", location.String())
+	return http.StatusMovedPermanently, "", true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanonicalParameters(t *testing.T) {
+	c := &Configuration{allowCustomTransformations: true, filterPipelines: map[string]string{"editorial": "grayscale|vignette:30"}}
+	tests := map[string]string{
+		"w_400,h_300":                 "w_400,h_300",
+		"h_300,w_400":                 "w_400,h_300",
+		"h_300,c_e,w_400,g_nw":        "w_400,h_300",
+		"w_0400,z_1":                  "w_400",
+		"q_auto,h_300,dl_cat,w_400":   "w_400,h_300,q_auto,dl_cat",
+		"f_editorial,w_400":           "w_400,f_editorial",
+		"dl_cat,t_square":             "t_square,dl_cat",
+		"original":                    "original",
+		"g_c,c_p,w_400,h_300,gam_2.0": "w_400,h_300,c_p,g_c,gam_2",
+	}
+	for parametersStr, expected := range tests {
+		canonical, err := canonicalParameters(parametersStr, c)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", parametersStr, err)
+		} else if canonical != expected {
+			t.Errorf("Expected %s to become %s, got %s", parametersStr, expected, canonical)
+		}
+	}
+
+	if _, err := canonicalParameters("w_400,c_x", c); err == nil {
+		t.Error("Expected an error for invalid parameters")
+	}
+	c.allowCustomTransformations = false
+	if canonical, _ := canonicalParameters("h_300,w_400", c); canonical != "h_300,w_400" {
+		t.Errorf("Expected custom parameters to be kept when they aren't allowed, got %s", canonical)
+	}
+}
+
+func TestRedirectToCanonical(t *testing.T) {
+	c := &Configuration{allowCustomTransformations: true}
+	req, _ := http.NewRequest("GET", "/KEY/image/h_300,w_400/v_2/cats/cat.jpg?x=1", nil)
+	res := httptest.NewRecorder()
+	status, _, redirected := redirectToCanonical(res, req, "h_300,w_400", "h_300,w_400", c)
+	if !redirected || status != http.StatusMovedPermanently {
+		t.Fatalf("Expected a permanent redirect, got %d", status)
+	}
+	if location := res.Header().Get("Location"); location != "/KEY/image/w_400,h_300/v_2/cats/cat.jpg?x=1" {
+		t.Errorf("Unexpected location: %s", location)
+	}
+
+	req, _ = http.NewRequest("GET", "/image/w_400,h_300/cat.jpg", nil)
+	if _, _, redirected := redirectToCanonical(httptest.NewRecorder(), req, "w_400,h_300", "w_400,h_300", c); redirected {
+		t.Error("Expected no redirect for canonical parameters")
+	}
+}
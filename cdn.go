@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/twinj/uuid"
+)
+
+const (
+	fastlyKeyEnvVar       = "PIXLSERV_FASTLY_KEY"
+	cloudflareTokenEnvVar = "PIXLSERV_CLOUDFLARE_TOKEN"
+
+	fastlyAPI     = "https://api.fastly.com"
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+	cloudFrontAPI = "https://cloudfront.amazonaws.com/2020-05-31"
+
+	// Max. number of keys/tags/paths in a single purge request
+	fastlyPurgeBatch     = 256
+	cloudflarePurgeBatch = 30
+	cloudFrontPurgeBatch = 1000
+
+	cdnTimeout = 30 * time.Second
+)
+
+var (
+	cdnClient = &http.Client{Timeout: cdnTimeout}
+
+	// Characters not allowed in surrogate keys or cache tags
+	surrogateKeyReplacer = strings.NewReplacer(" ", "%20", ",", "%2C")
+)
+
+// cdnPurger removes copies of images from a CDN's cache
+type cdnPurger interface {
+	// Name of the CDN for logging
+	name() string
+	// Removes all variants of the given original images
+	purge(imagePaths []string) error
+}
+
+// cdnInit sets up purging for all CDNs in a configuration
+func cdnInit(c *Configuration) error {
+	c.cdnPurgers = nil
+
+	if c.cdnFastlyServiceID != "" {
+		key := os.Getenv(fastlyKeyEnvVar)
+		if key == "" {
+			return fmt.Errorf("%s not set", fastlyKeyEnvVar)
+		}
+		c.cdnPurgers = append(c.cdnPurgers, &fastlyPurger{c.cdnFastlyServiceID, key})
+	}
+
+	if c.cdnCloudflareZoneID != "" {
+		token := os.Getenv(cloudflareTokenEnvVar)
+		if token == "" {
+			return fmt.Errorf("%s not set", cloudflareTokenEnvVar)
+		}
+		c.cdnPurgers = append(c.cdnPurgers, &cloudflarePurger{c.cdnCloudflareZoneID, token})
+	}
+
+	if c.cdnCloudFrontDistributionID != "" {
+		credentials := awsCredentials{os.Getenv(awsKeyEnvVar), os.Getenv(awsSecretEnvVar), os.Getenv("AWS_SESSION_TOKEN")}
+		if credentials.accessKey == "" || credentials.secretKey == "" {
+			return fmt.Errorf("%s and %s need to be set to purge CloudFront", awsKeyEnvVar, awsSecretEnvVar)
+		}
+		c.cdnPurgers = append(c.cdnPurgers, &cloudFrontPurger{c.cdnCloudFrontDistributionID, credentials})
+	}
+
+	return nil
+}
+
+// surrogateKeys returns the keys a response is tagged with so that it can be
+// purged from a CDN: the original image's path and the transformation name
+func surrogateKeys(transformationName, imagePath string) []string {
+	keys := []string{imageSurrogateKey(imagePath)}
+	if transformationName != "" {
+		keys = append(keys, "transformation:"+transformationName)
+	}
+	return keys
+}
+
+func imageSurrogateKey(imagePath string) string {
+	return surrogateKeyReplacer.Replace(imagePath)
+}
+
+// setSurrogateKeys adds the keys to a response, Surrogate-Key is used by
+// Fastly, Cache-Tag by Cloudflare
+func setSurrogateKeys(res http.ResponseWriter, keys []string) {
+	res.Header().Set("Surrogate-Key", strings.Join(keys, " "))
+	res.Header().Set("Cache-Tag", strings.Join(keys, ","))
+}
+
+func cdnURLsKey(imagePath string) string {
+	return "cdnurls:" + imagePath
+}
+
+// cdnRecordURL remembers a URL an image was requested with, needed by CDNs
+// which can only purge by URL
+func cdnRecordURL(imagePath, urlPath string) {
+	if currentConfig().cdnCloudFrontDistributionID == "" {
+		return
+	}
+	Conn.Do("SADD", cdnURLsKey(imagePath), urlPath)
+}
+
+// cdnPurge removes all variants of the given original images from all
+// configured CDNs
+func cdnPurge(imagePaths []string) {
+	if len(imagePaths) == 0 {
+		return
+	}
+	for _, purger := range currentConfig().cdnPurgers {
+		err := purger.purge(imagePaths)
+		if err != nil {
+			slog.Error("CDN purge failed", "cdn", purger.name(), "images", len(imagePaths), "error", err)
+		}
+	}
+}
+
+// fastlyPurger purges by surrogate keys using the Fastly API
+type fastlyPurger struct {
+	serviceID, key string
+}
+
+func (p *fastlyPurger) name() string {
+	return "Fastly"
+}
+
+func (p *fastlyPurger) purge(imagePaths []string) error {
+	for start := 0; start < len(imagePaths); start += fastlyPurgeBatch {
+		end := minInt(start+fastlyPurgeBatch, len(imagePaths))
+		keys := make([]string, 0, end-start)
+		for _, imagePath := range imagePaths[start:end] {
+			keys = append(keys, imageSurrogateKey(imagePath))
+		}
+
+		req, err := http.NewRequest("POST", fastlyAPI+"/service/"+p.serviceID+"/purge", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Fastly-Key", p.key)
+		req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+		err = cdnDo(req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloudflarePurger purges by cache tags using the Cloudflare API
+type cloudflarePurger struct {
+	zoneID, token string
+}
+
+func (p *cloudflarePurger) name() string {
+	return "Cloudflare"
+}
+
+func (p *cloudflarePurger) purge(imagePaths []string) error {
+	for start := 0; start < len(imagePaths); start += cloudflarePurgeBatch {
+		end := minInt(start+cloudflarePurgeBatch, len(imagePaths))
+		tags := make([]string, 0, end-start)
+		for _, imagePath := range imagePaths[start:end] {
+			tags = append(tags, imageSurrogateKey(imagePath))
+		}
+
+		body, err := json.Marshal(map[string][]string{"tags": tags})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", cloudflareAPI+"/zones/"+p.zoneID+"/purge_cache", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+p.token)
+		req.Header.Set("Content-Type", "application/json")
+		err = cdnDo(req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloudFrontPurger creates CloudFront invalidations for all URLs the images
+// were requested with, CloudFront doesn't support tagging responses
+type cloudFrontPurger struct {
+	distributionID string
+	credentials    awsCredentials
+}
+
+type cloudFrontInvalidationBatch struct {
+	XMLName         xml.Name `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+	Quantity        int      `xml:"Paths>Quantity"`
+	Items           []string `xml:"Paths>Items>Path"`
+	CallerReference string   `xml:"CallerReference"`
+}
+
+func (p *cloudFrontPurger) name() string {
+	return "CloudFront"
+}
+
+func (p *cloudFrontPurger) purge(imagePaths []string) error {
+	urls := make([]string, 0)
+	for _, imagePath := range imagePaths {
+		paths, err := redis.Strings(Conn.Do("SMEMBERS", cdnURLsKey(imagePath)))
+		if err != nil {
+			return err
+		}
+		urls = append(urls, paths...)
+	}
+
+	for start := 0; start < len(urls); start += cloudFrontPurgeBatch {
+		end := minInt(start+cloudFrontPurgeBatch, len(urls))
+		batch := cloudFrontInvalidationBatch{Quantity: end - start, Items: urls[start:end], CallerReference: uuid.NewV4().String()}
+		body, err := xml.Marshal(batch)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest("POST", cloudFrontAPI+"/distribution/"+p.distributionID+"/invalidation", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/xml")
+		signAWSRequestV4(req, body, p.credentials, "us-east-1", "cloudfront", time.Now())
+		err = cdnDo(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The URLs will be recorded again when requested
+	for _, imagePath := range imagePaths {
+		Conn.Do("DEL", cdnURLsKey(imagePath))
+	}
+	return nil
+}
+
+func cdnDo(req *http.Request) error {
+	resp, err := cdnClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+// Client hints giving the width an image is displayed at in physical
+// pixels, the first one sent is used
+var widthHints = []string{"Sec-CH-Width", "Width"}
+
+// hintedWidth returns the width a client hints an image is displayed at, 0
+// when it doesn't say
+func hintedWidth(req *http.Request) int {
+	for _, name := range widthHints {
+		value := strings.TrimSpace(req.Header.Get(name))
+		if value == "" {
+			continue
+		}
+		width, err := strconv.ParseFloat(value, 64)
+		if err != nil || width < 1 {
+			return 0
+		}
+		return int(width + 0.5)
+	}
+	return 0
+}
+
+// bucketWidth rounds a width up to the nearest of the widths in ascending
+// order, the biggest one if it's bigger than all of them
+func bucketWidth(width int, buckets []int) int {
+	if len(buckets) == 0 {
+		return width
+	}
+	for _, bucket := range buckets {
+		if bucket >= width {
+			return bucket
+		}
+	}
+	return buckets[len(buckets)-1]
+}
+
+// applyClientHints returns the transformation to use for a request, images
+// with a width but no height are made as wide as the client hints they are
+// displayed, rounded to the configured widths, but never wider than asked
+func applyClientHints(req *http.Request, res http.ResponseWriter, transformation Transformation) Transformation {
+	if !currentConfig().clientHints {
+		return transformation
+	}
+
+	res.Header().Set("Accept-CH", strings.Join(widthHints, ", "))
+	// Responses differ depending on the hints
+	addVary(res, widthHints...)
+
+	// The width only sets the maximum when the height follows it
+	params := *transformation.params
+	if params.Cropping != engine.CroppingModeExact || params.Width == 0 || params.Height != 0 {
+		return transformation
+	}
+	hinted := hintedWidth(req)
+	if hinted == 0 {
+		return transformation
+	}
+	width := bucketWidth(hinted, currentConfig().clientHintsWidths)
+	if width >= params.Width*params.Scale {
+		return transformation
+	}
+
+	// Hints are in physical pixels, so they already include scaling
+	params.Width = width
+	params.Scale = 1
+	transformation.params = &params
+	return transformation
+}
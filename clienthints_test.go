@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestApplyClientHints(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{clientHints: true, clientHintsWidths: []int{320, 640, 1280}})
+
+	cases := []struct {
+		parameters string
+		scale      int
+		hints      map[string]string
+		expected   string
+	}{
+		{"w_1000", 1, map[string]string{"Sec-CH-Width": "500"}, "c_e,g_nw,h_0,w_640,f_none,s_1"},
+		{"w_1000", 1, map[string]string{"Width": "200"}, "c_e,g_nw,h_0,w_320,f_none,s_1"},
+		{"w_1000", 1, map[string]string{"Sec-CH-Width": "300", "Width": "900"}, "c_e,g_nw,h_0,w_320,f_none,s_1"},
+		// Never wider than the URL asks for
+		{"w_500", 1, map[string]string{"Sec-CH-Width": "500"}, "c_e,g_nw,h_0,w_500,f_none,s_1"},
+		{"w_1000", 1, map[string]string{"Sec-CH-Width": "2000"}, "c_e,g_nw,h_0,w_1000,f_none,s_1"},
+		// Hints include the device pixel ratio
+		{"w_400", 2, map[string]string{"Sec-CH-Width": "600"}, "c_e,g_nw,h_0,w_640,f_none,s_1"},
+		// Only a width with the height following it is a maximum
+		{"w_1000,h_500", 1, map[string]string{"Sec-CH-Width": "500"}, "c_e,g_nw,h_500,w_1000,f_none,s_1"},
+		{"w_1000,c_p", 1, map[string]string{"Sec-CH-Width": "500"}, "c_p,g_nw,h_0,w_1000,f_none,s_1"},
+		{"w_1000", 1, map[string]string{"Sec-CH-Width": "wide"}, "c_e,g_nw,h_0,w_1000,f_none,s_1"},
+		{"w_1000", 1, nil, "c_e,g_nw,h_0,w_1000,f_none,s_1"},
+	}
+	for _, c := range cases {
+		params, err := engine.ParseParameters(c.parameters, engine.Limits{})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", c.parameters, err)
+		}
+		params.Scale = c.scale
+		req := httptest.NewRequest("GET", "/image/"+c.parameters+"/cat.jpg", nil)
+		for name, value := range c.hints {
+			req.Header.Set(name, value)
+		}
+		res := httptest.NewRecorder()
+		transformation := applyClientHints(req, res, Transformation{params: &params})
+		if transformation.params.ToString() != c.expected {
+			t.Errorf("%s %v: expected: %s, actual: %s", c.parameters, c.hints, c.expected, transformation.params.ToString())
+		}
+		if res.Header().Get("Accept-CH") == "" || res.Header().Get("Vary") == "" {
+			t.Errorf("%s: expected Accept-CH and Vary headers, got: %v", c.parameters, res.Header())
+		}
+	}
+}
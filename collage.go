@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Max. number of columns and rows of a collage grid
+	maxCollageGrid = 10
+
+	defaultCollageLayout = "2x2"
+	defaultCollageFormat = "jpg"
+)
+
+var (
+	collageGridRe     = regexp.MustCompile(`^([0-9]+)x([0-9]+)$`)
+	collageTemplateRe = regexp.MustCompile(`^1[+ ]([0-9]+)$`)
+
+	defaultCollageBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// collageLayout splits a collage into a grid of columns and rows, each cell
+// covers one or more of its squares
+type collageLayout struct {
+	columns, rows int
+	cells         []image.Rectangle
+}
+
+// parseCollageLayout reads a grid like 3x2, filled row by row, or a template
+// like 1+3 with a big cell on the left and 3 stacked on the right (the + is
+// left as a space by query strings)
+func parseCollageLayout(str string) (*collageLayout, error) {
+	if matches := collageGridRe.FindStringSubmatch(str); matches != nil {
+		columns, _ := strconv.Atoi(matches[1])
+		rows, _ := strconv.Atoi(matches[2])
+		if columns < 1 || rows < 1 || columns > maxCollageGrid || rows > maxCollageGrid {
+			return nil, fmt.Errorf("grids can have 1 to %d columns and rows", maxCollageGrid)
+		}
+		layout := &collageLayout{columns: columns, rows: rows}
+		for y := 0; y < rows; y++ {
+			for x := 0; x < columns; x++ {
+				layout.cells = append(layout.cells, image.Rect(x, y, x+1, y+1))
+			}
+		}
+		return layout, nil
+	}
+
+	if matches := collageTemplateRe.FindStringSubmatch(str); matches != nil {
+		n, _ := strconv.Atoi(matches[1])
+		if n < 2 || n > maxCollageGrid {
+			return nil, fmt.Errorf("templates can have 2 to %d small cells", maxCollageGrid)
+		}
+		// The big cell takes all but the last column
+		layout := &collageLayout{columns: n, rows: n, cells: []image.Rectangle{image.Rect(0, 0, n-1, n)}}
+		for y := 0; y < n; y++ {
+			layout.cells = append(layout.cells, image.Rect(n-1, y, n, y+1))
+		}
+		return layout, nil
+	}
+
+	return nil, fmt.Errorf("invalid layout: %s", str)
+}
+
+// rectangles returns where the cells are on a collage of the given size, with
+// gutters between the cells and along the edges
+func (l *collageLayout) rectangles(width, height, gutter int) ([]image.Rectangle, error) {
+	if width-(l.columns+1)*gutter < l.columns || height-(l.rows+1)*gutter < l.rows {
+		return nil, fmt.Errorf("the gutters leave no room for the images")
+	}
+	// Lines between the squares, each square starts a gutter after one
+	xs := make([]int, l.columns+1)
+	for i := range xs {
+		xs[i] = i * (width - gutter) / l.columns
+	}
+	ys := make([]int, l.rows+1)
+	for i := range ys {
+		ys[i] = i * (height - gutter) / l.rows
+	}
+
+	rectangles := make([]image.Rectangle, len(l.cells))
+	for i, cell := range l.cells {
+		rectangles[i] = image.Rect(xs[cell.Min.X]+gutter, ys[cell.Min.Y]+gutter, xs[cell.Max.X], ys[cell.Max.Y])
+	}
+	return rectangles, nil
+}
+
+// collage is a parsed request for a collage
+type collage struct {
+	images        []string
+	layout        *collageLayout
+	width, height int
+	gutter        int
+	background    color.Color
+	format        string
+}
+
+// parseCollage reads the images (repeated or comma separated), the layout,
+// the size (e.g. 1200x630) and optionally the gutter, the background colour
+// and the format (jpg or png) of a request
+func parseCollage(req *http.Request, limits engine.Limits) (*collage, error) {
+	query := req.URL.Query()
+	c := &collage{background: defaultCollageBackground, format: iiifFormats[defaultCollageFormat]}
+	for _, value := range query["images"] {
+		for _, imagePath := range strings.Split(value, ",") {
+			if imagePath = strings.TrimSpace(imagePath); imagePath != "" {
+				c.images = append(c.images, imagePath)
+			}
+		}
+	}
+
+	layout := query.Get("layout")
+	if layout == "" {
+		layout = defaultCollageLayout
+	}
+	var err error
+	c.layout, err = parseCollageLayout(layout)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.images) == 0 || len(c.images) > len(c.layout.cells) {
+		return nil, fmt.Errorf("between 1 and %d images are needed", len(c.layout.cells))
+	}
+
+	size := strings.SplitN(query.Get("size"), "x", 2)
+	if len(size) != 2 {
+		return nil, fmt.Errorf("size needs to be like 1200x630")
+	}
+	c.width, err = strconv.Atoi(size[0])
+	if err == nil {
+		c.height, err = strconv.Atoi(size[1])
+	}
+	if err != nil || c.width <= 0 || c.height <= 0 {
+		return nil, fmt.Errorf("invalid size: %s", query.Get("size"))
+	}
+	err = engine.Params{Width: c.width, Height: c.height, Scale: 1}.CheckLimits(limits)
+	if err != nil {
+		return nil, err
+	}
+
+	if gutterStr := query.Get("gutter"); gutterStr != "" {
+		c.gutter, err = strconv.Atoi(gutterStr)
+		if err != nil || c.gutter < 0 {
+			return nil, fmt.Errorf("invalid gutter: %s", gutterStr)
+		}
+	}
+	if background := query.Get("background"); background != "" {
+		c.background, err = parseHexColor(background)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if format := query.Get("format"); format != "" {
+		var ok bool
+		c.format, ok = iiifFormats[format]
+		if !ok {
+			return nil, fmt.Errorf("invalid format: %s (available: jpg, png)", format)
+		}
+	}
+	return c, nil
+}
+
+// compose draws the images over the background, each of them filling its
+// cell. Cells without an image are left empty.
+func (c *collage) compose(images []image.Image) (image.Image, error) {
+	rectangles, err := c.layout.rectangles(c.width, c.height, c.gutter)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, c.width, c.height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c.background), image.ZP, draw.Src)
+	for i, source := range images {
+		cell := rectangles[i]
+		params := engine.Params{Width: cell.Dx(), Height: cell.Dy(), Scale: 1, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+		resized := engine.Transform(source, params)
+		draw.Draw(img, cell, resized, resized.Bounds().Min, draw.Over)
+	}
+	return img, nil
+}
+
+// collageHandler answers requests for collages of stored images
+func collageHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Images are written to the response by serveCollage itself
+	status, body := serveCollage(params, req, res)
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// serveCollage composes stored images into a grid or template, it returns 0
+// when it wrote the response itself
+func serveCollage(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, ReadPermission) {
+		return http.StatusUnauthorized, ""
+	}
+	c, err := parseCollage(req, configFor(req).outputLimits())
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+
+	tenant := tenantFor(req)
+	images := make([]image.Image, len(c.images))
+	for i, requestedPath := range c.images {
+		imagePath, err := tenant.storagePath(requestedPath)
+		if err == nil {
+			images[i], err = loadStoredImage(imagePath)
+		}
+		if err == ErrNotFound || err == errTenantImageNotFound {
+			return http.StatusNotFound, "Image not found: " + requestedPath
+		}
+		if err != nil {
+			return iiifErrorStatus(err), err.Error()
+		}
+	}
+
+	err = processingPool.acquire(req.Context())
+	if err != nil {
+		res.Header().Set("Retry-After", strconv.Itoa(currentConfig().processingRetryAfter))
+		return currentConfig().processingOverloadStatus, err.Error()
+	}
+	defer processingPool.release()
+	img, err := c.compose(images)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	buffer := getEncodeBuffer()
+	defer putEncodeBuffer(buffer)
+	transformation := &Transformation{}
+	err = writeImageWithOptions(img, c.format, transformation.jpegOptions(), transformation.pngOptions(), buffer)
+	if err != nil {
+		slog.Error("encoding a collage failed", "error", err)
+		return http.StatusInternalServerError, "server error"
+	}
+
+	if cacheControl := cacheControlFor(transformation, ""); cacheControl != "" {
+		res.Header().Set("Cache-Control", cacheControl)
+	}
+	return respondWithImage(res, req, buffer.Bytes(), time.Time{})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestParseCollageLayout(t *testing.T) {
+	layout, err := parseCollageLayout("3x2")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if layout.columns != 3 || layout.rows != 2 || len(layout.cells) != 6 || layout.cells[4] != image.Rect(1, 1, 2, 2) {
+		t.Errorf("Unexpected layout: %+v", layout)
+	}
+
+	layout, err = parseCollageLayout("1+2")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []image.Rectangle{image.Rect(0, 0, 1, 2), image.Rect(1, 0, 2, 1), image.Rect(1, 1, 2, 2)}
+	if len(layout.cells) != len(expected) {
+		t.Fatalf("Unexpected cells: %v", layout.cells)
+	}
+	for i, cell := range expected {
+		if layout.cells[i] != cell {
+			t.Errorf("Cell %d: expected %v, got: %v", i, cell, layout.cells[i])
+		}
+	}
+	if layout, err = parseCollageLayout("1 3"); err != nil || layout.cells[0] != image.Rect(0, 0, 2, 3) {
+		t.Errorf("Unexpected layout: %+v (%v)", layout, err)
+	}
+
+	for _, str := range []string{"", "0x2", "11x1", "1+1", "2+2", "grid"} {
+		if _, err := parseCollageLayout(str); err == nil {
+			t.Errorf("Expected an error for %q", str)
+		}
+	}
+}
+
+func TestCollageLayoutRectangles(t *testing.T) {
+	layout, _ := parseCollageLayout("1+2")
+	rectangles, err := layout.rectangles(210, 110, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []image.Rectangle{image.Rect(10, 10, 100, 100), image.Rect(110, 10, 200, 50), image.Rect(110, 60, 200, 100)}
+	for i, rectangle := range expected {
+		if rectangles[i] != rectangle {
+			t.Errorf("Cell %d: expected %v, got: %v", i, rectangle, rectangles[i])
+		}
+	}
+
+	if _, err := layout.rectangles(20, 20, 10); err == nil {
+		t.Error("Expected an error for gutters wider than the collage")
+	}
+}
+
+func TestParseCollage(t *testing.T) {
+	req := httptest.NewRequest("GET", "/collage?images=a.jpg,b.jpg&images=c.jpg&layout=1%2B2&size=1200x630&gutter=4&background=000&format=png", nil)
+	c, err := parseCollage(req, engine.Limits{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(c.images) != 3 || c.width != 1200 || c.height != 630 || c.gutter != 4 || c.format != "png" || len(c.layout.cells) != 3 {
+		t.Errorf("Unexpected collage: %+v", c)
+	}
+	if r, g, b, _ := c.background.RGBA(); r != 0 || g != 0 || b != 0 {
+		t.Errorf("Expected a black background, got: %v", c.background)
+	}
+
+	req = httptest.NewRequest("GET", "/collage?images=a.jpg&size=100x100", nil)
+	c, err = parseCollage(req, engine.Limits{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if c.format != "jpeg" || c.gutter != 0 || c.layout.columns != 2 || c.layout.rows != 2 {
+		t.Errorf("Unexpected defaults: %+v", c)
+	}
+
+	for _, query := range []string{
+		"size=100x100",
+		"images=a.jpg,b.jpg,c.jpg&layout=2x1&size=100x100",
+		"images=a.jpg&size=100",
+		"images=a.jpg&size=100x100&gutter=-1",
+		"images=a.jpg&size=100x100&background=red",
+		"images=a.jpg&size=100x100&format=gif",
+	} {
+		req := httptest.NewRequest("GET", "/collage?"+query, nil)
+		if _, err := parseCollage(req, engine.Limits{}); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/collage?images=a.jpg&size=2000x100", nil)
+	if _, err := parseCollage(req, engine.Limits{MaxWidth: 1000}); err == nil {
+		t.Error("Expected an error for a collage over the output limits")
+	}
+}
+
+func TestCollageCompose(t *testing.T) {
+	layout, _ := parseCollageLayout("2x1")
+	c := &collage{images: []string{"red.png"}, layout: layout, width: 50, height: 20, gutter: 5, background: color.RGBA{0, 0, 255, 255}}
+	red := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for i := 0; i < len(red.Pix); i += 4 {
+		red.Pix[i], red.Pix[i+3] = 255, 255
+	}
+
+	img, err := c.compose([]image.Image{red})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 50, 20) {
+		t.Errorf("Unexpected bounds: %v", img.Bounds())
+	}
+	blue := color.RGBA{0, 0, 255, 255}
+	for _, test := range []struct {
+		x, y     int
+		expected color.RGBA
+	}{
+		{2, 10, blue},
+		{12, 10, color.RGBA{255, 0, 0, 255}},
+		{12, 2, blue},
+		{27, 10, blue},
+		{37, 10, blue},
+	} {
+		if c := color.RGBAModel.Convert(img.At(test.x, test.y)).(color.RGBA); c != test.expected {
+			t.Errorf("%d,%d: expected %v, got: %v", test.x, test.y, test.expected, c)
+		}
+	}
+}
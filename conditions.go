@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+var (
+	// Parameters conditions can change, the scale comes from the URL
+	conditionParameters = []string{engine.ParameterWidth, engine.ParameterHeight, engine.ParameterCropping, engine.ParameterGravity, engine.ParameterFilter, engine.ParameterGamma, engine.ParameterExposure, engine.ParameterZoom, engine.ParameterSafeZone, engine.ParameterOpacity}
+
+	conditionOperators = []string{"<=", ">=", "!=", "==", "<", ">"}
+)
+
+// Condition changes some of the parameters of a named transformation for
+// originals it matches, e.g. "if: portrait" with "parameters: g_n"
+type Condition struct {
+	expression string
+	terms      []conditionTerm
+	keys       []string      // Parameters the condition sets
+	params     engine.Params // The transformation's parameters with the condition's applied
+}
+
+// conditionTerm compares a property of an original to a value, terms of
+// shapes (portrait...) don't have an operator
+type conditionTerm struct {
+	property, operator string
+	number             float64
+	str                string
+}
+
+// parseConditions reads the conditions of a named transformation, each of
+// them has an expression (if) and parameters overriding the transformation's
+func parseConditions(conditions []interface{}, parametersStr string, conf *Configuration) ([]*Condition, error) {
+	parsed := make([]*Condition, 0, len(conditions))
+	for _, conditionMap := range conditions {
+		m, ok := conditionMap.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("conditions need an if and parameters")
+		}
+		expression, _ := m["if"].(string)
+		overrides, _ := m["parameters"].(string)
+		if expression == "" || overrides == "" {
+			return nil, fmt.Errorf("conditions need an if and parameters")
+		}
+
+		c := &Condition{expression: expression}
+		var err error
+		c.terms, err = parseConditionExpression(expression)
+		if err != nil {
+			return nil, err
+		}
+		merged, keys, err := mergeParameters(parametersStr, overrides)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition parameters: %s (%s)", overrides, err)
+		}
+		c.keys = keys
+		c.params, err = parseTrustedParameters(merged, conf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition parameters: %s (%s)", overrides, err)
+		}
+		parsed = append(parsed, c)
+	}
+	return parsed, nil
+}
+
+// parseConditionExpression reads terms joined by "and" such as
+// "width > 2000", "format == png" or "portrait"
+func parseConditionExpression(expression string) ([]conditionTerm, error) {
+	var terms []conditionTerm
+	for _, termStr := range strings.Split(strings.ToLower(expression), " and ") {
+		termStr = strings.TrimSpace(termStr)
+		switch termStr {
+		case "portrait", "landscape", "square":
+			terms = append(terms, conditionTerm{property: termStr})
+			continue
+		}
+
+		var term conditionTerm
+		for _, operator := range conditionOperators {
+			if i := strings.Index(termStr, operator); i != -1 {
+				term = conditionTerm{property: strings.TrimSpace(termStr[:i]), operator: operator, str: strings.TrimSpace(termStr[i+len(operator):])}
+				break
+			}
+		}
+		switch term.property {
+		case "width", "height", "aspect":
+			var err error
+			term.number, err = strconv.ParseFloat(term.str, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid condition: %s (%s needs a number)", expression, term.property)
+			}
+		case "format":
+			if term.operator != "==" && term.operator != "!=" {
+				return nil, fmt.Errorf("invalid condition: %s (formats can only be compared with == and !=)", expression)
+			}
+			if term.str == "jpg" {
+				term.str = "jpeg"
+			}
+		default:
+			return nil, fmt.Errorf("invalid condition: %s (available: width, height, aspect, format, portrait, landscape and square)", expression)
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// mergeParameters overrides parameters in a parameters string with those of
+// another one, it returns the keys the other one sets
+func mergeParameters(parametersStr, overrides string) (string, []string, error) {
+	parts := strings.Split(parametersStr, ",")
+	var keys []string
+	for _, override := range strings.Split(overrides, ",") {
+		key := strings.SplitN(override, "_", 2)[0]
+		if !containsString(conditionParameters, key) {
+			return "", nil, fmt.Errorf("%s can't be set by conditions", key)
+		}
+		keys = append(keys, key)
+
+		replaced := false
+		for i, part := range parts {
+			if strings.SplitN(part, "_", 2)[0] == key {
+				parts[i] = override
+				replaced = true
+			}
+		}
+		if !replaced {
+			parts = append(parts, override)
+		}
+	}
+	return strings.Join(parts, ","), keys, nil
+}
+
+// matches reports whether an original of the given size and format meets
+// all terms of the condition
+func (c *Condition) matches(width, height int, format string) bool {
+	for _, term := range c.terms {
+		if !term.matches(width, height, format) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t conditionTerm) matches(width, height int, format string) bool {
+	var value float64
+	switch t.property {
+	case "portrait":
+		return height > width
+	case "landscape":
+		return width > height
+	case "square":
+		return width == height
+	case "format":
+		return (format == t.str) == (t.operator == "==")
+	case "width":
+		value = float64(width)
+	case "height":
+		value = float64(height)
+	case "aspect":
+		value = float64(width) / float64(height)
+	}
+
+	switch t.operator {
+	case "<":
+		return value < t.number
+	case "<=":
+		return value <= t.number
+	case ">":
+		return value > t.number
+	case ">=":
+		return value >= t.number
+	case "==":
+		return value == t.number
+	}
+	return value != t.number
+}
+
+// apply sets the parameters the condition changes
+func (c *Condition) apply(params *engine.Params) {
+	for _, key := range c.keys {
+		switch key {
+		case engine.ParameterWidth:
+			params.Width = c.params.Width
+		case engine.ParameterHeight:
+			params.Height = c.params.Height
+		case engine.ParameterCropping:
+			params.Cropping = c.params.Cropping
+		case engine.ParameterGravity:
+			params.Gravity = c.params.Gravity
+		case engine.ParameterFilter:
+			params.Filter = c.params.Filter
+		case engine.ParameterGamma:
+			params.Gamma = c.params.Gamma
+		case engine.ParameterExposure:
+			params.Exposure = c.params.Exposure
+		case engine.ParameterZoom:
+			params.Zoom = c.params.Zoom
+		case engine.ParameterSafeZone:
+			params.SafeZone = c.params.SafeZone
+		case engine.ParameterOpacity:
+			params.Transparency = c.params.Transparency
+		}
+	}
+}
+
+// hash tells versions of conditions apart in cached images' names
+func (c *Condition) hash() []byte {
+	h := sha1.New()
+	io.WriteString(h, c.expression)
+	io.WriteString(h, c.params.ToString())
+	io.WriteString(h, strings.Join(c.keys, ","))
+	return h.Sum(nil)
+}
+
+// forSource returns the transformation with the parameters of the conditions
+// an original of the given size and format matches, later conditions take
+// precedence
+func (t *Transformation) forSource(width, height int, format string) *Transformation {
+	if len(t.conditions) == 0 {
+		return t
+	}
+	params := *t.params
+	for _, c := range t.conditions {
+		if c.matches(width, height, format) {
+			c.apply(&params)
+		}
+	}
+	resolved := *t
+	resolved.params = &params
+	resolved.conditions = nil
+	return &resolved
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"image"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestParseConditions(t *testing.T) {
+	conf := &Configuration{transformations: make(map[string]Transformation)}
+	err := parseTransformations(conf, []interface{}{
+		map[interface{}]interface{}{
+			"name":       "hero",
+			"parameters": "w_1600,h_900,c_p,g_c",
+			"conditions": []interface{}{
+				map[interface{}]interface{}{"if": "portrait", "parameters": "g_n"},
+				map[interface{}]interface{}{"if": "width < 1600 and format == JPG", "parameters": "w_800,h_450"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	hero := conf.transformations["hero"]
+	if len(hero.conditions) != 2 {
+		t.Fatalf("Expected 2 conditions, got: %d", len(hero.conditions))
+	}
+
+	tests := []struct {
+		width, height int
+		format        string
+		expected      engine.Params
+	}{
+		{3000, 2000, "jpeg", engine.Params{Width: 1600, Height: 900, Scale: 1, Cropping: "p", Gravity: "c", Filter: engine.DefaultFilter}},
+		{2000, 3000, "png", engine.Params{Width: 1600, Height: 900, Scale: 1, Cropping: "p", Gravity: "n", Filter: engine.DefaultFilter}},
+		{1000, 1500, "jpeg", engine.Params{Width: 800, Height: 450, Scale: 1, Cropping: "p", Gravity: "n", Filter: engine.DefaultFilter}},
+		{1000, 500, "png", engine.Params{Width: 1600, Height: 900, Scale: 1, Cropping: "p", Gravity: "c", Filter: engine.DefaultFilter}},
+	}
+	for _, test := range tests {
+		resolved := hero.forSource(test.width, test.height, test.format)
+		if *resolved.params != test.expected || resolved.conditions != nil {
+			t.Errorf("%dx%d %s: expected %+v, got: %+v", test.width, test.height, test.format, test.expected, *resolved.params)
+		}
+	}
+	if *hero.params != tests[0].expected {
+		t.Errorf("Expected the transformation to be left as it was, got: %+v", *hero.params)
+	}
+
+	// The scale comes from the URL
+	scaled := hero
+	params := hero.params.WithScale(2)
+	scaled.params = &params
+	if resolved := scaled.forSource(2000, 3000, "png"); resolved.params.Scale != 2 || resolved.params.Gravity != "n" {
+		t.Errorf("Expected the scale to be kept, got: %+v", *resolved.params)
+	}
+
+	// Images are cached separately from those of the same parameters without conditions
+	plain := Transformation{params: hero.params}
+	withConditions, _ := hero.createFilePath("cat.jpg")
+	withoutConditions, _ := plain.createFilePath("cat.jpg")
+	if withConditions == withoutConditions {
+		t.Errorf("Expected different cached names, got: %s", withConditions)
+	}
+}
+
+func TestInvalidConditions(t *testing.T) {
+	invalid := []map[interface{}]interface{}{
+		{"if": "portrait"},
+		{"parameters": "g_n"},
+		{"if": "tall", "parameters": "g_n"},
+		{"if": "width > wide", "parameters": "g_n"},
+		{"if": "format > png", "parameters": "g_n"},
+		{"if": "portrait and", "parameters": "g_n"},
+		{"if": "portrait", "parameters": "s_2"},
+		{"if": "portrait", "parameters": "g_up"},
+	}
+	for _, condition := range invalid {
+		_, err := parseConditions([]interface{}{condition}, "w_100", &Configuration{})
+		if err == nil {
+			t.Errorf("Expected an error for %v", condition)
+		}
+	}
+}
+
+func TestConditionShapes(t *testing.T) {
+	terms, err := parseConditionExpression("square and aspect >= 1 and height != 10")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c := &Condition{terms: terms}
+	if !c.matches(20, 20, "png") || c.matches(10, 10, "png") || c.matches(20, 10, "png") {
+		t.Error("Unexpected matches")
+	}
+	if img := image.Rect(0, 0, 30, 20); !(&Condition{terms: []conditionTerm{{property: "landscape"}}}).matches(img.Dx(), img.Dy(), "gif") {
+		t.Error("Expected a landscape image to match")
+	}
+}
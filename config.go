@@ -3,12 +3,24 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
 
 	"github.com/ReshNesh/go-colorful"
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
 	"gopkg.in/yaml.v1"
 )
 
@@ -22,134 +34,1688 @@ const (
 const (
 	defaultThrottlingRate             = 60 // Requests per min
 	defaultCacheLimit                 = 0  // No. of bytes
+	defaultCacheMaxEntries            = 0  // No. of cached images
+	defaultCacheMemoryLimit           = 0  // No. of bytes kept in memory
+	defaultCacheNegativeTTL           = 0  // Seconds
+	defaultCacheRevalidateInterval    = 0  // Seconds
 	defaultJpegQuality                = 75
+	defaultJpegEncoderTimeout         = 5000 // Milliseconds
+	defaultJpegEncoderProgressive     = true
+	defaultFFmpegTimeout              = 30000           // Milliseconds
+	defaultUpscalerTimeout            = 20000           // Milliseconds
 	defaultUploadMaxFileSize          = 5 * 1024 * 1024 // No. of bytes
 	defaultUploadMaxPixels            = 5000000         // 5 megapixels
+	defaultUploadMemoryLimit          = 1024 * 1024     // No. of bytes
 	defaultAllowCustomTransformations = true
 	defaultAllowCustomScale           = true
 	defaultAsyncUploads               = false
 	defaultAuthorisedGet              = false
 	defaultAuthorisedUpload           = false
+	defaultSignedURLs                 = false
+	defaultCloudinaryURLs             = false
+	defaultCanonicalURLs              = false
+	defaultJWTPermissionsClaim        = "scope"
+	defaultCORSMaxAge                 = 0 // Seconds
+	defaultOutputMaxWidth             = 8000
+	defaultOutputMaxHeight            = 8000
+	defaultOutputMaxPixels            = 40000000 // 40 megapixels
+	defaultOutputMaxScale             = 4
+	defaultSourceMaxPixels            = 100000000 // 100 megapixels
+	defaultSourceMaxFrames            = 500
+	defaultTracingSampleRatio         = 1.0
+	defaultLogFormat                  = "logfmt"
+	defaultLogLevel                   = "info"
+	defaultProcessingQueue            = 100
+	defaultProcessingRetryAfter       = 1        // Seconds
+	defaultScriptTimeout              = 1000     // Milliseconds
+	defaultScriptMaxPixels            = 50000000 // 50 megapixels
+	defaultScriptMaxMemory            = 1 << 30  // No. of bytes
+	defaultImgproxySignatureSize      = 32       // Bytes of HMAC-SHA256
+	defaultImgproxySourcePrefix       = "local:///"
+	defaultSaveDataQuality            = 50
+	defaultAutoQualityTarget          = 0.98 // SSIM
+	defaultAutoQualityMin             = 40
+	defaultAutoQualityMax             = 90
+	defaultFallbackStatus             = http.StatusNotFound
+	defaultFallbackMaxAge             = 60 // Seconds
+	defaultAutocertCacheDir           = "autocert-cache"
+	defaultAutocertHTTPAddress        = ":80"
 	defaultLocalPath                  = "local-images"
 	defaultCacheStrategy              = LRU
 	defaultFontPath                   = "fonts/DejaVuSans.ttf"
+	defaultContentSafetyTimeout       = 5000 // Milliseconds
+	defaultContentSafetyThreshold     = 0.8
+	defaultAuditWebhookTimeout        = 5000 // Milliseconds
+	defaultCachePeerTimeout           = 5000 // Milliseconds
+	defaultLargeSourceCommand         = "vipsthumbnail"
+	defaultLargeSourcePixels          = 50000000 // 50 megapixels
+	defaultLargeSourceTimeout         = 60000    // Milliseconds
+	defaultMaskPath                   = "masks"
+	defaultLQIPHeader                 = "Link"
+	defaultLQIPWidth                  = 16    // Pixels
+	defaultEdgePushTimeout            = 30000 // Milliseconds
 )
 
 var (
-	// Config is a global configuration object
-	Config Configuration
+	// The configuration in use, it is replaced as a whole when the
+	// configuration is reloaded while requests read it
+	activeConfig atomic.Pointer[Configuration]
 )
 
+func init() {
+	activeConfig.Store(new(Configuration))
+}
+
+// currentConfig returns the configuration in use, code reading several
+// options which need to agree should keep what it returns
+func currentConfig() *Configuration {
+	return activeConfig.Load()
+}
+
+// setConfig switches to a configuration, what depends on it has to be
+// ready before
+func setConfig(c *Configuration) {
+	activeConfig.Store(c)
+}
+
 // Configuration specifies server configuration options
 type Configuration struct {
 	throttlingRate, cacheLimit, jpegQuality, uploadMaxFileSize, uploadMaxPixels                 int
 	allowCustomTransformations, allowCustomScale, asyncUploads, authorisedGet, authorisedUpload bool
-	localPath, cacheStrategy                                                                    string
+	localPath, cacheStrategy, storage                                                           string
 	corsAllowOrigins                                                                            []string
 	transformations                                                                             map[string]Transformation
+	transformationVersions                                                                      map[string]int // Versions the names of versioned transformations serve, the latest if not set
 	eagerTransformations                                                                        []Transformation
+
+	jpegSubsampling jpegenc.Subsampling
+	pngOptimization *PNGOptimization // nil when PNG images aren't optimized
+
+	jpegEncoderCommand     string // External encoder like MozJPEG's cjpeg, "" for the Go one
+	jpegEncoderProgressive bool
+	jpegEncoderTimeout     int
+
+	ffmpegCommand string // Videos can't be generated when ""
+	ffmpegTimeout int
+
+	largeSourceCommand string // Originals are always decoded in memory when ""
+	largeSourcePixels  int    // Originals with more pixels are shrunk by the command first
+	largeSourceTimeout int
+
+	maskPath string // Storage path mask images (mask_star.png) are loaded from
+
+	lqipHeader string // Header carrying previews of images, none are sent when ""
+	lqipWidth  int
+
+	edgePushTargets []*edgeTarget // Stores in other regions new variants are pushed to
+	edgePushTimeout int
+
+	upscalerURL     string // Images are enlarged in Go when ""
+	upscalerTimeout int
+
+	shadowConfig      *Configuration // Candidate configuration sampled requests are processed with as well, nil for none
+	shadowSampleRatio float64
+
+	contentSafetyURL       string // Images aren't classified when ""
+	contentSafetyTimeout   int
+	contentSafetyThreshold float64 // Images scoring this or more are blocked or flagged
+	contentSafetyFlagOnly  bool    // Flagged images are still stored and served
+	contentSafetyWebhook   string  // Notified of images over the threshold, "" for none
+
+	cacheMaxEntries, cacheMemoryLimit, cacheNegativeTTL, cacheRevalidateInterval int
+	cacheHashedNames                                                             bool // Name all cached images after a hash of their parameters
+	cacheHistory                                                                 bool // Record the variants generated of each original
+	cacheNamespace                                                               string
+	cacheTTL                                                                     int           // Seconds cached images are served for, 0 = until they are removed
+	cacheMetadataTTL                                                             int           // Seconds the metadata of originals is remembered for, 0 = not remembered
+	cacheMaintenanceSchedule                                                     *cronSchedule // nil = no scheduled maintenance
+	cachePaths                                                                   []string      // Directories cached images are spread over, none = in the storage
+	cachePeerURL, cachePeerSecret                                                string        // Instances share generated images when set
+	cachePeerTimeout                                                             int           // Milliseconds
+	cacheControl                                                                 *CacheControl
+	pathCacheControls                                                            []PathCacheControl
+
+	cdnSurrogateKeys                                                     bool
+	cdnFastlyServiceID, cdnCloudflareZoneID, cdnCloudFrontDistributionID string
+
+	signedURLs bool
+
+	jwtAlgorithm, jwtIssuer, jwtAudience, jwtJWKSURL, jwtPublicKey, jwtPermissionsClaim string
+
+	rateLimitHits, rateLimitMisses *RateLimit
+	rateLimitRedis                 bool
+
+	// What is served while redis can't be reached, reads are and writes aren't by default
+	degradedReadsClosed, degradedWritesOpen bool
+
+	hotlinkProtection, hotlinkAllowEmpty bool
+	hotlinkAllowedDomains                []string
+	hotlinkPlaceholder                   []byte
+
+	trustedProxies          ipList
+	ipFilter, adminIPFilter *IPFilter
+
+	corsAllowMethods, corsAllowHeaders, corsExposeHeaders []string
+	corsMaxAge                                            int
+
+	outputMaxWidth, outputMaxHeight, outputMaxPixels, outputMaxScale int
+	outputMaxBytes                                                   int // Encoded images are fitted in this many bytes, 0 = no cap
+
+	sourceMaxPixels, sourceMaxFrames int
+	sourceFormatLimits               map[string]sourceLimits // Limits of originals of each format, see sourceLimits
+
+	uploadMemoryLimit  int
+	uploadChunksPath   string // Directory chunks of resumable uploads are kept in
+	deduplicateUploads bool   // Identical uploads are stored once
+	allowedFormats     []string
+	storageReplicas    []string // Backends writes are copied to
+
+	storageFallbacks       []string // Backends read from when the storage doesn't have a file
+	storageFallbackTimeout int      // Milliseconds, 0 = no timeout
+	storageBackfill        bool
+	httpOrigins            map[string]*httpOrigin // Read-only storages by name
+
+	metadataKeep []uint16 // EXIF tags copied from originals to transformed images
+
+	deterministic bool // Identical requests give byte-identical images, see makeDeterministic
+
+	metrics bool
+
+	tracing            bool
+	tracingSampleRatio float64
+
+	logFormat, logLevel string
+
+	accessLogOutput, accessLogFormat string
+	accessLogTransformation          bool
+
+	auditLogOutput, auditLogWebhook string
+	auditLogWebhookTimeout          int
+
+	debugEndpoints bool
+
+	dashboard bool
+
+	analytics bool
+
+	errorImages bool
+	defaultFont *truetype.Font // For error images and placeholder labels
+
+	tlsCertFile, tlsKeyFile string
+
+	autocertDomains                                      []string
+	autocertCacheDir, autocertEmail, autocertHTTPAddress string
+	http3                                                bool
+
+	unixSocket, unixSocketOwner, unixSocketGroup string
+	unixSocketMode                               os.FileMode
+	adminAddress                                 string // Management routes are only served here when set
+
+	grpcAddress string
+
+	scriptTimeout, scriptMaxPixels, scriptMaxMemory int
+
+	processingWorkers, processingQueue, processingRetryAfter int
+	processingMemoryLimit                                    int
+	processingMaxWait                                        int            // Milliseconds requests wait for a worker, 0 = no limit
+	processingOverloadStatus                                 int            // 503 or 429
+	processingTimeouts                                       map[string]int // Milliseconds by stage, stages without one aren't limited
+	processingBackend                                        string
+
+	thumbor, thumborAllowUnsafe bool
+
+	cloudinaryURLs bool
+
+	canonicalURLs bool // Redirect to URLs with parameters in their canonical form
+
+	iiif        bool
+	iiifBaseURL string
+
+	dzi                     bool
+	dziTileSize, dziOverlap int
+	dziFormat               string // Extension of tiles, jpg or png
+
+	socialCards       map[string]*SocialCard // Templates of social cards by name
+	socialCardsSigned bool                   // Cards are only composed for signed payloads
+
+	downloads                         bool   // Originals can be downloaded through signed expiring URLs
+	downloadBaseURL                   string // Prefix of download URLs, e.g. https://images.example.com
+	downloadExpiry, downloadMaxExpiry int    // Seconds download URLs are valid for by default and at most
+
+	imgproxy, imgproxyAllowInsecure bool
+	imgproxySignatureSize           int
+	imgproxySourcePrefix            string
+
+	saveData                                             bool
+	saveDataQuality, saveDataMaxWidth, saveDataMaxHeight int
+
+	autoQualityTarget              float64 // SSIM images encoded with q_auto need to reach
+	autoQualityMin, autoQualityMax int
+
+	clientHints       bool
+	clientHintsWidths []int
+
+	fallbackImage                  string
+	fallbackStatus, fallbackMaxAge int
+
+	originalURLs   map[string]string // Public base URLs of originals by storage backend
+	serveOriginals bool              // Stream originals from the storage when there is no public URL
+
+	headers               map[string]string
+	pathHeaders           []PathHeaders
+	transformationHeaders bool // Whether any named transformation has headers
+
+	placeholders bool
+
+	tenants []*Tenant
+
+	defaultKeyQuota *Quota
+	keyQuotas       map[string]*Quota
+
+	derivedPrefix string // Where generated variants are persisted, "" for nowhere
+
+	parameterPolicy  *ParameterPolicy // Restricts custom transformations, nil for no restrictions
+	strictParameters bool             // Unknown, malformed and duplicate parameters of custom transformations are rejected
+
+	filterPipelines map[string]string // Chains of filters by name
+
+	pathPolicies []*PathPolicy // Restrict transformations by image path prefix
+
+	// Built from the options above before the configuration is used
+	jwtAuth                         *jwtVerifier // Validates bearer tokens, nil when JWT authentication is disabled
+	cdnPurgers                      []cdnPurger  // Purgers of all configured CDNs
+	hitRateLimiter, missRateLimiter rateLimiter  // For requests served from the cache and requests which need an image to be transformed, nil when not limited
+}
+
+func configInit(path string) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	setConfig(c)
+	configFilePath = path
+	return nil
+}
+
+// loadConfig reads a configuration file ("" for none) with the options set in
+// the environment and on the command line applied, options which aren't set
+// get their default values
+func loadConfig(configFilePath string) (*Configuration, error) {
+	m, err := readConfig(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(m)
+}
+
+// readConfig reads the options in a configuration file ("" for none) and
+// applies the ones set in the environment and on the command line
+func readConfig(configFilePath string) (map[interface{}]interface{}, error) {
+	m := make(map[interface{}]interface{})
+	if configFilePath != "" {
+		data, err := ioutil.ReadFile(configFilePath)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.Unmarshal([]byte(data), &m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The environment and the command line take precedence over the file
+	err := applyConfigOverrides(m, os.Environ(), configFlags)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-func configInit(configFilePath string) error {
-	Config = Configuration{defaultThrottlingRate, defaultCacheLimit, defaultJpegQuality, defaultUploadMaxFileSize, defaultUploadMaxPixels, defaultAllowCustomTransformations, defaultAllowCustomScale, defaultAsyncUploads, defaultAuthorisedGet, defaultAuthorisedUpload, defaultLocalPath, defaultCacheStrategy, nil, make(map[string]Transformation), make([]Transformation, 0)}
+// parseConfig builds a configuration from the options read by readConfig
+func parseConfig(m map[interface{}]interface{}) (*Configuration, error) {
+	var err error
+	conf := &Configuration{
+		throttlingRate:             defaultThrottlingRate,
+		cacheLimit:                 defaultCacheLimit,
+		cacheMaxEntries:            defaultCacheMaxEntries,
+		cacheMemoryLimit:           defaultCacheMemoryLimit,
+		cacheNegativeTTL:           defaultCacheNegativeTTL,
+		cacheRevalidateInterval:    defaultCacheRevalidateInterval,
+		jpegQuality:                defaultJpegQuality,
+		jpegEncoderTimeout:         defaultJpegEncoderTimeout,
+		jpegEncoderProgressive:     defaultJpegEncoderProgressive,
+		ffmpegTimeout:              defaultFFmpegTimeout,
+		upscalerTimeout:            defaultUpscalerTimeout,
+		contentSafetyTimeout:       defaultContentSafetyTimeout,
+		contentSafetyThreshold:     defaultContentSafetyThreshold,
+		auditLogWebhookTimeout:     defaultAuditWebhookTimeout,
+		cachePeerTimeout:           defaultCachePeerTimeout,
+		uploadMaxFileSize:          defaultUploadMaxFileSize,
+		uploadMaxPixels:            defaultUploadMaxPixels,
+		uploadMemoryLimit:          defaultUploadMemoryLimit,
+		uploadChunksPath:           filepath.Join(os.TempDir(), "pixlserv-uploads"),
+		allowedFormats:             supportedFormats,
+		allowCustomTransformations: defaultAllowCustomTransformations,
+		allowCustomScale:           defaultAllowCustomScale,
+		asyncUploads:               defaultAsyncUploads,
+		authorisedGet:              defaultAuthorisedGet,
+		authorisedUpload:           defaultAuthorisedUpload,
+		signedURLs:                 defaultSignedURLs,
+		cloudinaryURLs:             defaultCloudinaryURLs,
+		canonicalURLs:              defaultCanonicalURLs,
+		jwtPermissionsClaim:        defaultJWTPermissionsClaim,
+		corsAllowMethods:           []string{"GET", "HEAD"},
+		corsAllowHeaders:           []string{"Authorization", "If-Modified-Since", "If-None-Match", apiKeyHeader},
+		corsExposeHeaders:          []string{"Content-Length", "ETag", "Last-Modified"},
+		corsMaxAge:                 defaultCORSMaxAge,
+		outputMaxWidth:             defaultOutputMaxWidth,
+		outputMaxHeight:            defaultOutputMaxHeight,
+		outputMaxPixels:            defaultOutputMaxPixels,
+		outputMaxScale:             defaultOutputMaxScale,
+		sourceMaxPixels:            defaultSourceMaxPixels,
+		sourceMaxFrames:            defaultSourceMaxFrames,
+		tracingSampleRatio:         defaultTracingSampleRatio,
+		logFormat:                  defaultLogFormat,
+		logLevel:                   defaultLogLevel,
+		scriptTimeout:              defaultScriptTimeout,
+		processingWorkers:          runtime.NumCPU(),
+		processingQueue:            defaultProcessingQueue,
+		processingRetryAfter:       defaultProcessingRetryAfter,
+		processingOverloadStatus:   http.StatusServiceUnavailable,
+		processingBackend:          goProcessor,
+		scriptMaxPixels:            defaultScriptMaxPixels,
+		scriptMaxMemory:            defaultScriptMaxMemory,
+		imgproxySignatureSize:      defaultImgproxySignatureSize,
+		imgproxySourcePrefix:       defaultImgproxySourcePrefix,
+		saveDataQuality:            defaultSaveDataQuality,
+		autoQualityTarget:          defaultAutoQualityTarget,
+		autoQualityMin:             defaultAutoQualityMin,
+		autoQualityMax:             defaultAutoQualityMax,
+		fallbackStatus:             defaultFallbackStatus,
+		fallbackMaxAge:             defaultFallbackMaxAge,
+		clientHintsWidths:          []int{320, 480, 640, 768, 1024, 1280, 1600, 1920, 2560},
+		localPath:                  defaultLocalPath,
+		maskPath:                   defaultMaskPath,
+		cacheStrategy:              defaultCacheStrategy,
+		transformations:            make(map[string]Transformation),
+		eagerTransformations:       make([]Transformation, 0),
+	}
+
+	throttlingRate, ok := m["throttling-rate"].(int)
+	if ok && throttlingRate >= 0 {
+		conf.throttlingRate = throttlingRate
+	}
+
+	jpegQuality, ok := m["jpeg-quality"].(int)
+	if ok && jpegQuality >= 1 && jpegQuality <= 100 {
+		conf.jpegQuality = jpegQuality
+	}
+
+	jpegEncoderConfig, ok := m["jpeg-encoder"].(map[interface{}]interface{})
+	if ok {
+		command, ok := jpegEncoderConfig["command"].(string)
+		if ok && command != "" {
+			path, err := exec.LookPath(command)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jpeg-encoder command: %s", err)
+			}
+			conf.jpegEncoderCommand = path
+		}
+		progressive, ok := jpegEncoderConfig["progressive"].(bool)
+		if ok {
+			conf.jpegEncoderProgressive = progressive
+		}
+		timeout, ok := jpegEncoderConfig["timeout"].(int)
+		if ok && timeout > 0 {
+			conf.jpegEncoderTimeout = timeout
+		}
+	}
+
+	ffmpegConfig, ok := m["ffmpeg"].(map[interface{}]interface{})
+	if ok {
+		command, ok := ffmpegConfig["command"].(string)
+		if ok && command != "" {
+			path, err := exec.LookPath(command)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ffmpeg command: %s", err)
+			}
+			conf.ffmpegCommand = path
+		}
+		timeout, ok := ffmpegConfig["timeout"].(int)
+		if ok && timeout > 0 {
+			conf.ffmpegTimeout = timeout
+		}
+	}
+
+	largeSourcesConfig, ok := m["large-sources"].(map[interface{}]interface{})
+	if ok {
+		command, ok := largeSourcesConfig["command"].(string)
+		if !ok || command == "" {
+			command = defaultLargeSourceCommand
+		}
+		path, err := exec.LookPath(command)
+		if err != nil {
+			return nil, fmt.Errorf("invalid large-sources command: %s", err)
+		}
+		conf.largeSourceCommand = path
+		conf.largeSourcePixels = defaultLargeSourcePixels
+		pixels, ok := largeSourcesConfig["pixels"].(int)
+		if ok && pixels > 0 {
+			conf.largeSourcePixels = pixels
+		}
+		conf.largeSourceTimeout = defaultLargeSourceTimeout
+		timeout, ok := largeSourcesConfig["timeout"].(int)
+		if ok && timeout > 0 {
+			conf.largeSourceTimeout = timeout
+		}
+	}
+
+	lqipConfig, ok := m["lqip"].(map[interface{}]interface{})
+	if ok {
+		conf.lqipHeader = defaultLQIPHeader
+		header, ok := lqipConfig["header"].(string)
+		if ok && header != "" {
+			conf.lqipHeader = http.CanonicalHeaderKey(header)
+		}
+		conf.lqipWidth = defaultLQIPWidth
+		if value, ok := lqipConfig["width"]; ok {
+			width, ok := value.(int)
+			if !ok || width < 1 || width > maxLQIPWidth {
+				return nil, fmt.Errorf("invalid lqip width: %v (needs to be between 1 and %d)", value, maxLQIPWidth)
+			}
+			conf.lqipWidth = width
+		}
+	}
+
+	upscalerConfig, ok := m["upscaler"].(map[interface{}]interface{})
+	if ok {
+		upscalerURL, _ := upscalerConfig["url"].(string)
+		if upscalerURL != "" {
+			parsed, err := url.Parse(upscalerURL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				return nil, fmt.Errorf("invalid upscaler url: %s", upscalerURL)
+			}
+			conf.upscalerURL = upscalerURL
+		}
+		timeout, ok := upscalerConfig["timeout"].(int)
+		if ok && timeout > 0 {
+			conf.upscalerTimeout = timeout
+		}
+	}
+
+	contentSafetyConfig, ok := m["content-safety"].(map[interface{}]interface{})
+	if ok {
+		classifierURL, _ := contentSafetyConfig["url"].(string)
+		parsed, err := url.Parse(classifierURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, fmt.Errorf("invalid content-safety url: %s", classifierURL)
+		}
+		conf.contentSafetyURL = classifierURL
+		timeout, ok := contentSafetyConfig["timeout"].(int)
+		if ok && timeout > 0 {
+			conf.contentSafetyTimeout = timeout
+		}
+		if value, ok := contentSafetyConfig["threshold"]; ok {
+			threshold, ok := value.(float64)
+			if !ok || threshold <= 0 || threshold > 1 {
+				return nil, fmt.Errorf("invalid content-safety threshold: %v (between 0 and 1 needed)", value)
+			}
+			conf.contentSafetyThreshold = threshold
+		}
+		action, _ := contentSafetyConfig["action"].(string)
+		switch action {
+		case "", "block":
+		case "flag":
+			conf.contentSafetyFlagOnly = true
+		default:
+			return nil, fmt.Errorf("invalid content-safety action: %s (block or flag)", action)
+		}
+		webhook, _ := contentSafetyConfig["webhook"].(string)
+		if webhook != "" {
+			parsed, err := url.Parse(webhook)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				return nil, fmt.Errorf("invalid content-safety webhook: %s", webhook)
+			}
+			conf.contentSafetyWebhook = webhook
+		}
+		if conf.contentSafetyFlagOnly && conf.contentSafetyWebhook == "" {
+			return nil, fmt.Errorf("invalid content-safety action: flag (a webhook is needed)")
+		}
+	}
+
+	pngOptimizationMap, ok := m["png-optimization"].(map[interface{}]interface{})
+	if ok {
+		conf.pngOptimization, err = parsePNGOptimization(pngOptimizationMap)
+		if err != nil {
+			return nil, fmt.Errorf("invalid png-optimization: %s", err)
+		}
+	}
+
+	// 444 or 420, strings are accepted from overrides
+	if subsampling, ok := m["jpeg-subsampling"]; ok {
+		value := fmt.Sprint(subsampling)
+		if value != subsampling444 && value != subsampling420 {
+			return nil, fmt.Errorf("invalid jpeg-subsampling: %s (available: %s, %s)", value, subsampling444, subsampling420)
+		}
+		conf.jpegSubsampling = parseSubsampling(value)
+	}
+
+	edgePush, ok := m["edge-push"].(map[interface{}]interface{})
+	if ok {
+		err = parseEdgePush(edgePush, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	encoding, ok := m["encoding"].(map[interface{}]interface{})
+	if ok {
+		err = parseEncoding(encoding, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uploadMaxFileSize, ok := m["upload-max-file-size"].(int)
+	if ok && uploadMaxFileSize > 0 {
+		conf.uploadMaxFileSize = uploadMaxFileSize
+	}
+
+	uploadMaxPixels, ok := m["upload-max-pixels"].(int)
+	if ok && uploadMaxPixels > 0 {
+		conf.uploadMaxPixels = uploadMaxPixels
+	}
+
+	sourceMaxPixels, ok := m["source-max-pixels"].(int)
+	if ok && sourceMaxPixels >= 0 {
+		conf.sourceMaxPixels = sourceMaxPixels
+	}
+
+	sourceMaxFrames, ok := m["source-max-frames"].(int)
+	if ok && sourceMaxFrames >= 0 {
+		conf.sourceMaxFrames = sourceMaxFrames
+	}
+
+	outputLimits, ok := m["output-limits"].(map[interface{}]interface{})
+	if ok {
+		parseOutputLimits(conf, outputLimits)
+	}
+
+	// Named transformations and the parameter policy can use pipelines
+	filterPipelines, ok := m["filter-pipelines"].(map[interface{}]interface{})
+	if ok {
+		conf.filterPipelines, err = parseFilterPipelines(filterPipelines)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	parameterPolicy, ok := m["parameter-policy"].(map[interface{}]interface{})
+	if ok {
+		conf.parameterPolicy, err = parseParameterPolicy(parameterPolicy, conf.filterPipelines)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter policy: %s", err)
+		}
+	}
+
+	strictParameters, ok := m["strict-parameters"].(bool)
+	if ok {
+		conf.strictParameters = strictParameters
+	}
+
+	uploadMemoryLimit, ok := m["upload-memory-limit"].(int)
+	if ok && uploadMemoryLimit >= 0 {
+		conf.uploadMemoryLimit = uploadMemoryLimit
+	}
+
+	uploadChunksPath, ok := m["upload-chunks-path"].(string)
+	if ok && uploadChunksPath != "" {
+		conf.uploadChunksPath = uploadChunksPath
+	}
+
+	deduplicateUploads, ok := m["deduplicate-uploads"].(bool)
+	if ok {
+		conf.deduplicateUploads = deduplicateUploads
+	}
+
+	metadata, ok := m["metadata"].(map[interface{}]interface{})
+	if ok {
+		keep, ok := metadata["keep"].([]interface{})
+		if ok {
+			conf.metadataKeep, err = parseMetadataKeep(stringList(keep))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	allowedFormats, ok := m["allowed-formats"].([]interface{})
+	if ok {
+		conf.allowedFormats = stringList(allowedFormats)
+		for i, format := range conf.allowedFormats {
+			format = strings.ToLower(format)
+			if format == "jpg" {
+				format = "jpeg"
+			}
+			if !isSupportedFormat(format) {
+				return nil, fmt.Errorf("unsupported image format: %s", format)
+			}
+			conf.allowedFormats[i] = format
+		}
+	}
+
+	sourceFormats, ok := m["source-formats"].(map[interface{}]interface{})
+	if ok {
+		err = parseSourceFormats(sourceFormats, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	allowCustomTransformations, ok := m["allow-custom-transformations"].(bool)
+	if ok {
+		conf.allowCustomTransformations = allowCustomTransformations
+	}
+
+	allowCustomScale, ok := m["allow-custom-scale"].(bool)
+	if ok {
+		conf.allowCustomScale = allowCustomScale
+	}
+
+	asyncUploads, ok := m["async-uploads"].(bool)
+	if ok {
+		conf.asyncUploads = asyncUploads
+	}
+
+	authorisation, ok := m["authorisation"].(map[interface{}]interface{})
+	if ok {
+		get, ok := authorisation["get"].(bool)
+		if ok {
+			conf.authorisedGet = get
+		}
+		upload, ok := authorisation["upload"].(bool)
+		if ok {
+			conf.authorisedUpload = upload
+		}
+	}
+
+	jwt, ok := m["jwt"].(map[interface{}]interface{})
+	if ok {
+		conf.jwtAlgorithm, _ = jwt["algorithm"].(string)
+		conf.jwtIssuer, _ = jwt["issuer"].(string)
+		conf.jwtAudience, _ = jwt["audience"].(string)
+		conf.jwtJWKSURL, _ = jwt["jwks-url"].(string)
+		conf.jwtPublicKey, _ = jwt["public-key"].(string)
+		permissionsClaim, ok := jwt["permissions-claim"].(string)
+		if ok {
+			conf.jwtPermissionsClaim = permissionsClaim
+		}
+	}
+
+	rateLimit, ok := m["rate-limit"].(map[interface{}]interface{})
+	if ok {
+		conf.rateLimitHits, err = parseRateLimit(rateLimit["cache-hits"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit for cache hits: %s", err)
+		}
+		conf.rateLimitMisses, err = parseRateLimit(rateLimit["cache-misses"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit for cache misses: %s", err)
+		}
+		redis, ok := rateLimit["redis"].(bool)
+		if ok {
+			conf.rateLimitRedis = redis
+		}
+	}
+
+	degradedMode, ok := m["degraded-mode"].(map[interface{}]interface{})
+	if ok {
+		readsOpen, err := parseDegradedPolicy(degradedMode["reads"], true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid degraded mode policy for reads: %s", err)
+		}
+		conf.degradedReadsClosed = !readsOpen
+		conf.degradedWritesOpen, err = parseDegradedPolicy(degradedMode["writes"], false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid degraded mode policy for writes: %s", err)
+		}
+	}
+
+	trustedProxies, ok := m["trusted-proxies"].([]interface{})
+	if ok {
+		conf.trustedProxies, err = parseIPList(trustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxies: %s", err)
+		}
+	}
+
+	ipFilter, ok := m["ip-filter"].(map[interface{}]interface{})
+	if ok {
+		conf.ipFilter, err = parseIPFilter(ipFilter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP filter: %s", err)
+		}
+		admin, ok := ipFilter["admin"].(map[interface{}]interface{})
+		if ok {
+			conf.adminIPFilter, err = parseIPFilter(admin)
+			if err != nil {
+				return nil, fmt.Errorf("invalid admin IP filter: %s", err)
+			}
+		}
+	}
+
+	hotlinkProtection, ok := m["hotlink-protection"].(map[interface{}]interface{})
+	if ok {
+		conf.hotlinkProtection = true
+		conf.hotlinkAllowEmpty = true
+		allowEmpty, ok := hotlinkProtection["allow-empty-referer"].(bool)
+		if ok {
+			conf.hotlinkAllowEmpty = allowEmpty
+		}
+		domains, _ := hotlinkProtection["allowed-domains"].([]interface{})
+		for _, domain := range domains {
+			domainStr, ok := domain.(string)
+			if ok {
+				conf.hotlinkAllowedDomains = append(conf.hotlinkAllowedDomains, domainStr)
+			}
+		}
+		placeholder, ok := hotlinkProtection["placeholder"].(string)
+		if ok {
+			conf.hotlinkPlaceholder, err = ioutil.ReadFile(placeholder)
+			if err != nil {
+				return nil, fmt.Errorf("loading hotlink placeholder failed: %s", err)
+			}
+		}
+	}
+
+	metrics, ok := m["metrics"].(bool)
+	if ok {
+		conf.metrics = metrics
+	}
+
+	logConfig, ok := m["log"].(map[interface{}]interface{})
+	if ok {
+		format, ok := logConfig["format"].(string)
+		if ok {
+			conf.logFormat = format
+		}
+		level, ok := logConfig["level"].(string)
+		if ok {
+			conf.logLevel = level
+		}
+	}
+
+	accessLog, ok := m["access-log"].(map[interface{}]interface{})
+	if ok {
+		conf.accessLogOutput = "stdout"
+		conf.accessLogFormat = accessLogCombined
+		output, ok := accessLog["output"].(string)
+		if ok {
+			conf.accessLogOutput = output
+		}
+		format, ok := accessLog["format"].(string)
+		if ok {
+			format = strings.ToLower(format)
+			if format != accessLogCommon && format != accessLogCombined && format != accessLogJSON {
+				return nil, fmt.Errorf("unknown access log format: %s", format)
+			}
+			conf.accessLogFormat = format
+		}
+		transformation, ok := accessLog["include-transformation"].(bool)
+		if ok {
+			conf.accessLogTransformation = transformation
+		}
+	}
+
+	auditLog, ok := m["audit-log"].(map[interface{}]interface{})
+	if ok {
+		output, _ := auditLog["output"].(string)
+		conf.auditLogOutput = output
+		webhook, _ := auditLog["webhook"].(string)
+		if webhook != "" {
+			parsed, err := url.Parse(webhook)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				return nil, fmt.Errorf("invalid audit-log webhook: %s", webhook)
+			}
+			conf.auditLogWebhook = webhook
+		}
+		if conf.auditLogOutput == "" && conf.auditLogWebhook == "" {
+			conf.auditLogOutput = "stdout"
+		}
+		timeout, ok := auditLog["timeout"].(int)
+		if ok && timeout > 0 {
+			conf.auditLogWebhookTimeout = timeout
+		}
+	}
+
+	tracing, ok := m["tracing"].(map[interface{}]interface{})
+	if ok {
+		conf.tracing = true
+		switch ratio := tracing["sample-ratio"].(type) {
+		case int:
+			conf.tracingSampleRatio = float64(ratio)
+		case float64:
+			conf.tracingSampleRatio = ratio
+		}
+		if conf.tracingSampleRatio < 0 || conf.tracingSampleRatio > 1 {
+			return nil, fmt.Errorf("tracing sample ratio needs to be between 0 and 1")
+		}
+	}
+
+	shadow, ok := m["shadow"].(map[interface{}]interface{})
+	if ok {
+		configFilePath, _ := shadow["config"].(string)
+		if configFilePath == "" {
+			return nil, fmt.Errorf("invalid shadow: config missing")
+		}
+		candidate, err := loadShadowConfig(configFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shadow config %s: %s", configFilePath, err)
+		}
+		conf.shadowConfig = candidate
+		conf.shadowSampleRatio = defaultShadowSampleRatio
+		switch ratio := shadow["sample-ratio"].(type) {
+		case int:
+			conf.shadowSampleRatio = float64(ratio)
+		case float64:
+			conf.shadowSampleRatio = ratio
+		}
+		if conf.shadowSampleRatio < 0 || conf.shadowSampleRatio > 1 {
+			return nil, fmt.Errorf("shadow sample ratio needs to be between 0 and 1")
+		}
+	}
+
+	processingConfig, ok := m["processing"].(map[interface{}]interface{})
+	if ok {
+		workers, ok := processingConfig["workers"].(int)
+		if ok && workers >= 0 {
+			conf.processingWorkers = workers
+		}
+		queue, ok := processingConfig["queue"].(int)
+		if ok && queue >= 0 {
+			conf.processingQueue = queue
+		}
+		retryAfter, ok := processingConfig["retry-after"].(int)
+		if ok && retryAfter > 0 {
+			conf.processingRetryAfter = retryAfter
+		}
+		memoryLimit, ok := processingConfig["memory-limit"].(int)
+		if ok && memoryLimit >= 0 {
+			conf.processingMemoryLimit = memoryLimit
+		}
+		backend, ok := processingConfig["backend"].(string)
+		if ok && backend != "" {
+			conf.processingBackend = backend
+		}
+		maxWait, ok := processingConfig["max-wait"].(int)
+		if ok && maxWait >= 0 {
+			conf.processingMaxWait = maxWait
+		}
+		timeouts, ok := processingConfig["timeouts"].(map[interface{}]interface{})
+		if ok {
+			conf.processingTimeouts = make(map[string]int)
+			for _, stage := range processingStages {
+				timeout, ok := timeouts[stage].(int)
+				if ok && timeout > 0 {
+					conf.processingTimeouts[stage] = timeout
+				}
+			}
+			for stage := range timeouts {
+				if !containsString(processingStages, fmt.Sprint(stage)) {
+					return nil, fmt.Errorf("invalid processing timeout: %v (fetch, decode, transform or encode)", stage)
+				}
+			}
+		}
+		if value, ok := processingConfig["overload-status"]; ok {
+			status, _ := value.(int)
+			if status != http.StatusServiceUnavailable && status != http.StatusTooManyRequests {
+				return nil, fmt.Errorf("invalid processing overload-status: %v (503 or 429)", value)
+			}
+			conf.processingOverloadStatus = status
+		}
+	}
+
+	scriptsConfig, ok := m["scripts"].(map[interface{}]interface{})
+	if ok {
+		timeout, ok := scriptsConfig["timeout"].(int)
+		if ok && timeout > 0 {
+			conf.scriptTimeout = timeout
+		}
+		maxPixels, ok := scriptsConfig["max-pixels"].(int)
+		if ok && maxPixels >= 0 {
+			conf.scriptMaxPixels = maxPixels
+		}
+		maxMemory, ok := scriptsConfig["max-memory"].(int)
+		if ok && maxMemory >= 0 {
+			conf.scriptMaxMemory = maxMemory
+		}
+	}
+
+	thumborConfig, ok := m["thumbor"].(map[interface{}]interface{})
+	if ok {
+		conf.thumbor = true
+		conf.thumborAllowUnsafe, _ = thumborConfig["allow-unsafe"].(bool)
+	}
+
+	iiifConfig, ok := m["iiif"].(map[interface{}]interface{})
+	if ok {
+		conf.iiif = true
+		conf.iiifBaseURL, _ = iiifConfig["base-url"].(string)
+	}
+
+	dziConfig, ok := m["dzi"].(map[interface{}]interface{})
+	if ok {
+		conf.dzi = true
+		conf.dziTileSize, conf.dziOverlap, conf.dziFormat = defaultDZITileSize, defaultDZIOverlap, defaultDZIFormat
+		if tileSize, ok := dziConfig["tile-size"].(int); ok {
+			if tileSize < 1 {
+				return nil, fmt.Errorf("invalid dzi tile-size: %d", tileSize)
+			}
+			conf.dziTileSize = tileSize
+		}
+		if overlap, ok := dziConfig["overlap"].(int); ok {
+			if overlap < 0 || overlap >= conf.dziTileSize {
+				return nil, fmt.Errorf("invalid dzi overlap: %d", overlap)
+			}
+			conf.dziOverlap = overlap
+		}
+		if format, ok := dziConfig["format"].(string); ok {
+			if _, ok := iiifFormats[format]; !ok {
+				return nil, fmt.Errorf("invalid dzi format: %s (available: jpg, png)", format)
+			}
+			conf.dziFormat = format
+		}
+	}
+
+	downloads, ok := m["downloads"].(map[interface{}]interface{})
+	if ok {
+		conf.downloads = true
+		conf.downloadExpiry, conf.downloadMaxExpiry = defaultDownloadExpiry, defaultDownloadMaxExpiry
+		conf.downloadBaseURL, _ = downloads["base-url"].(string)
+		if maxExpiry, ok := downloads["max-expiry"].(int); ok {
+			if maxExpiry < 1 {
+				return nil, fmt.Errorf("invalid downloads max-expiry: %d", maxExpiry)
+			}
+			conf.downloadMaxExpiry = maxExpiry
+		}
+		if expiry, ok := downloads["expiry"].(int); ok {
+			conf.downloadExpiry = expiry
+		}
+		if conf.downloadExpiry < 1 || conf.downloadExpiry > conf.downloadMaxExpiry {
+			return nil, fmt.Errorf("invalid downloads expiry: %d (at most max-expiry)", conf.downloadExpiry)
+		}
+	}
+
+	socialCards, ok := m["social-cards"].(map[interface{}]interface{})
+	if ok {
+		templates, _ := socialCards["templates"].([]interface{})
+		conf.socialCards, err = parseSocialCards(templates)
+		if err != nil {
+			return nil, err
+		}
+		conf.socialCardsSigned, _ = socialCards["signed"].(bool)
+	}
+
+	imgproxyConfig, ok := m["imgproxy"].(map[interface{}]interface{})
+	if ok {
+		conf.imgproxy = true
+		conf.imgproxyAllowInsecure, _ = imgproxyConfig["allow-insecure"].(bool)
+		signatureSize, ok := imgproxyConfig["signature-size"].(int)
+		if ok && signatureSize >= 1 && signatureSize <= defaultImgproxySignatureSize {
+			conf.imgproxySignatureSize = signatureSize
+		}
+		sourcePrefix, ok := imgproxyConfig["source-prefix"].(string)
+		if ok {
+			conf.imgproxySourcePrefix = sourcePrefix
+		}
+	}
+
+	saveDataConfig, ok := m["save-data"].(map[interface{}]interface{})
+	if ok {
+		conf.saveData = true
+		quality, ok := saveDataConfig["quality"].(int)
+		if ok && quality >= 1 && quality <= 100 {
+			conf.saveDataQuality = quality
+		}
+		maxWidth, ok := saveDataConfig["max-width"].(int)
+		if ok && maxWidth >= 0 {
+			conf.saveDataMaxWidth = maxWidth
+		}
+		maxHeight, ok := saveDataConfig["max-height"].(int)
+		if ok && maxHeight >= 0 {
+			conf.saveDataMaxHeight = maxHeight
+		}
+	}
+
+	autoQualityConfig, ok := m["auto-quality"].(map[interface{}]interface{})
+	if ok {
+		target, ok := autoQualityConfig["target"].(float64)
+		if ok {
+			if target <= 0 || target >= 1 {
+				return nil, fmt.Errorf("auto-quality target needs to be between 0 and 1: %v", target)
+			}
+			conf.autoQualityTarget = target
+		}
+		minQuality, ok := autoQualityConfig["min-quality"].(int)
+		if ok && minQuality >= 1 && minQuality <= 100 {
+			conf.autoQualityMin = minQuality
+		}
+		maxQuality, ok := autoQualityConfig["max-quality"].(int)
+		if ok && maxQuality >= 1 && maxQuality <= 100 {
+			conf.autoQualityMax = maxQuality
+		}
+		if conf.autoQualityMin > conf.autoQualityMax {
+			return nil, fmt.Errorf("auto-quality min-quality can't be more than max-quality")
+		}
+	}
+
+	clientHintsConfig, ok := m["client-hints"].(map[interface{}]interface{})
+	if ok {
+		conf.clientHints = true
+		widths, ok := clientHintsConfig["widths"].([]interface{})
+		if ok {
+			conf.clientHintsWidths = make([]int, 0, len(widths))
+			for _, value := range widths {
+				width, ok := value.(int)
+				if !ok || width < 1 {
+					return nil, fmt.Errorf("invalid client hints width: %v", value)
+				}
+				conf.clientHintsWidths = append(conf.clientHintsWidths, width)
+			}
+			conf.clientHintsWidths = sortedWidths(conf.clientHintsWidths)
+		}
+	}
+
+	fallbackConfig, ok := m["fallback-image"].(map[interface{}]interface{})
+	if ok {
+		conf.fallbackImage, _ = fallbackConfig["path"].(string)
+		status, ok := fallbackConfig["status"].(int)
+		if ok {
+			if status != http.StatusOK && status != http.StatusNotFound {
+				return nil, fmt.Errorf("invalid fallback image status: %d", status)
+			}
+			conf.fallbackStatus = status
+		}
+		maxAge, ok := fallbackConfig["max-age"].(int)
+		if ok && maxAge >= 0 {
+			conf.fallbackMaxAge = maxAge
+		}
+	}
+
+	redirectOriginals, ok := m["redirect-originals"].(map[interface{}]interface{})
+	if ok {
+		conf.originalURLs = make(map[string]string)
+		for backend, baseURL := range redirectOriginals {
+			backendName, _ := backend.(string)
+			baseURLStr, ok := baseURL.(string)
+			if !ok || !strings.HasPrefix(baseURLStr, "http") {
+				return nil, fmt.Errorf("invalid URL of originals for %v: %v", backend, baseURL)
+			}
+			conf.originalURLs[backendName] = baseURLStr
+		}
+	}
+
+	serveOriginals, ok := m["serve-originals"].(bool)
+	if ok {
+		conf.serveOriginals = serveOriginals
+	}
+
+	grpcConfig, ok := m["grpc"].(map[interface{}]interface{})
+	if ok {
+		conf.grpcAddress, _ = grpcConfig["address"].(string)
+	}
+
+	listenConfig, ok := m["listen"].(map[interface{}]interface{})
+	if ok {
+		conf.unixSocket, _ = listenConfig["socket"].(string)
+		conf.unixSocketOwner, _ = listenConfig["socket-owner"].(string)
+		conf.unixSocketGroup, _ = listenConfig["socket-group"].(string)
+		conf.adminAddress, _ = listenConfig["admin-address"].(string)
+		switch mode := listenConfig["socket-mode"].(type) {
+		case string:
+			parsed, err := strconv.ParseUint(mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid socket mode: %s", mode)
+			}
+			conf.unixSocketMode = os.FileMode(parsed)
+		case int:
+			// Numbers starting with 0 are octal in YAML
+			conf.unixSocketMode = os.FileMode(mode)
+		}
+	}
+
+	tlsConfig, ok := m["tls"].(map[interface{}]interface{})
+	if ok {
+		conf.tlsCertFile, _ = tlsConfig["cert-file"].(string)
+		conf.tlsKeyFile, _ = tlsConfig["key-file"].(string)
+
+		http3, ok := tlsConfig["http3"].(bool)
+		if ok {
+			conf.http3 = http3
+		}
+
+		autocertConfig, ok := tlsConfig["autocert"].(map[interface{}]interface{})
+		if ok {
+			if conf.tlsCertFile != "" {
+				return nil, fmt.Errorf("TLS can use either certificate files or autocert")
+			}
+			domains, _ := autocertConfig["domains"].([]interface{})
+			conf.autocertDomains = stringList(domains)
+			if len(conf.autocertDomains) == 0 {
+				return nil, fmt.Errorf("autocert needs a list of domains")
+			}
+			conf.autocertCacheDir = defaultAutocertCacheDir
+			cacheDir, ok := autocertConfig["cache-dir"].(string)
+			if ok {
+				conf.autocertCacheDir = cacheDir
+			}
+			conf.autocertEmail, _ = autocertConfig["email"].(string)
+			conf.autocertHTTPAddress = defaultAutocertHTTPAddress
+			httpAddress, ok := autocertConfig["http-address"].(string)
+			if ok {
+				conf.autocertHTTPAddress = httpAddress
+			}
+		} else if conf.tlsCertFile == "" || conf.tlsKeyFile == "" {
+			return nil, fmt.Errorf("TLS needs both a cert-file and a key-file")
+		}
+	}
+
+	debugEndpoints, ok := m["debug-endpoints"].(bool)
+	if ok {
+		conf.debugEndpoints = debugEndpoints
+	}
+
+	dashboard, ok := m["dashboard"].(bool)
+	if ok {
+		conf.dashboard = dashboard
+	}
+
+	analytics, ok := m["analytics"].(bool)
+	if ok {
+		conf.analytics = analytics
+	}
+
+	errorImages, ok := m["error-images"].(bool)
+	if ok {
+		conf.errorImages = errorImages
+	}
+
+	placeholders, ok := m["placeholders"].(bool)
+	if ok {
+		conf.placeholders = placeholders
+	}
+
+	if conf.errorImages || conf.placeholders {
+		fontBytes, err := ioutil.ReadFile(defaultFontPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading the default font failed: %s", err)
+		}
+		conf.defaultFont, err = freetype.ParseFont(fontBytes)
+		if err != nil {
+			return nil, fmt.Errorf("loading the default font failed: %s", err)
+		}
+	}
+
+	signedURLs, ok := m["signed-urls"].(bool)
+	if ok {
+		conf.signedURLs = signedURLs
+	}
+
+	cloudinaryURLs, ok := m["cloudinary-urls"].(bool)
+	if ok {
+		conf.cloudinaryURLs = cloudinaryURLs
+	}
+
+	canonicalURLs, ok := m["canonical-urls"].(bool)
+	if ok {
+		conf.canonicalURLs = canonicalURLs
+	}
+
+	localPath, ok := m["local-path"].(string)
+	if ok {
+		conf.localPath = localPath
+	}
+
+	maskPath, ok := m["mask-path"].(string)
+	if ok {
+		conf.maskPath = maskPath
+	}
+
+	storage, ok := m["storage"].(string)
+	if ok {
+		conf.storage = storage
+	}
+
+	storageReplicas, ok := m["storage-replicas"].([]interface{})
+	if ok {
+		conf.storageReplicas = stringList(storageReplicas)
+	}
+
+	httpOrigins, ok := m["http-origins"].(map[interface{}]interface{})
+	if ok {
+		origins, err := parseHTTPOrigins(httpOrigins)
+		if err != nil {
+			return nil, err
+		}
+		conf.httpOrigins = origins
+	}
+
+	storageFallbacks, ok := m["storage-fallbacks"].(map[interface{}]interface{})
+	if ok {
+		backends, _ := storageFallbacks["backends"].([]interface{})
+		conf.storageFallbacks = stringList(backends)
+		timeout, ok := storageFallbacks["timeout"].(int)
+		if ok && timeout >= 0 {
+			conf.storageFallbackTimeout = timeout
+		}
+		backfill, ok := storageFallbacks["backfill"].(bool)
+		if ok {
+			conf.storageBackfill = backfill
+		}
+	}
+
+	cache, ok := m["cache"].(map[interface{}]interface{})
+	if ok {
+		limit, ok := cache["limit"].(int)
+		if ok && limit >= 0 {
+			conf.cacheLimit = limit
+		}
+
+		maxEntries, ok := cache["max-entries"].(int)
+		if ok && maxEntries >= 0 {
+			conf.cacheMaxEntries = maxEntries
+		}
+
+		memoryLimit, ok := cache["memory-limit"].(int)
+		if ok && memoryLimit >= 0 {
+			conf.cacheMemoryLimit = memoryLimit
+		}
+
+		negativeTTL, ok := cache["negative-ttl"].(int)
+		if ok && negativeTTL >= 0 {
+			conf.cacheNegativeTTL = negativeTTL
+		}
+
+		metadataTTL, ok := cache["metadata-ttl"].(int)
+		if ok && metadataTTL >= 0 {
+			conf.cacheMetadataTTL = metadataTTL
+		}
+
+		peers, ok := cache["peers"].(map[interface{}]interface{})
+		if ok {
+			self, _ := peers["self"].(string)
+			parsed, err := url.Parse(self)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("invalid cache peers self: %q (URL of this instance needed)", self)
+			}
+			conf.cachePeerURL = strings.TrimSuffix(self, "/")
+			conf.cachePeerSecret, _ = peers["secret"].(string)
+			if conf.cachePeerSecret == "" {
+				return nil, fmt.Errorf("invalid cache peers: secret missing")
+			}
+			timeout, ok := peers["timeout"].(int)
+			if ok && timeout > 0 {
+				conf.cachePeerTimeout = timeout
+			}
+		}
+
+		revalidateInterval, ok := cache["revalidate-interval"].(int)
+		if ok && revalidateInterval >= 0 {
+			conf.cacheRevalidateInterval = revalidateInterval
+		}
+
+		strategy, ok := cache["strategy"].(string)
+		if ok && (strategy == LRU || strategy == LFU) {
+			conf.cacheStrategy = strategy
+		}
+
+		hashedNames, ok := cache["hashed-names"].(bool)
+		if ok {
+			conf.cacheHashedNames = hashedNames
+		}
+
+		history, ok := cache["history"].(bool)
+		if ok {
+			conf.cacheHistory = history
+		}
+
+		paths, ok := cache["paths"].([]interface{})
+		if ok {
+			conf.cachePaths = stringList(paths)
+			seen := make(map[string]bool)
+			for _, cachePath := range conf.cachePaths {
+				cachePath = filepath.Clean(cachePath)
+				if cachePath == "." || seen[cachePath] {
+					return nil, fmt.Errorf("invalid cache paths: %v (distinct directories needed)", paths)
+				}
+				seen[cachePath] = true
+			}
+		}
 
-	if configFilePath == "" {
-		return nil
-	}
+		ttl, ok := cache["ttl"].(int)
+		if ok && ttl >= 0 {
+			conf.cacheTTL = ttl
+		}
 
-	data, err := ioutil.ReadFile(configFilePath)
-	if err != nil {
-		return err
-	}
+		maintenance, ok := cache["maintenance"].(string)
+		if ok && maintenance != "" {
+			schedule, err := parseCron(maintenance)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cache maintenance: %s", err)
+			}
+			conf.cacheMaintenanceSchedule = schedule
+		}
 
-	m := make(map[interface{}]interface{})
-	err = yaml.Unmarshal([]byte(data), &m)
-	if err != nil {
-		return err
+		namespace, ok := cache["namespace"].(string)
+		if ok {
+			if namespace != "" && !cacheNamespaceRe.MatchString(namespace) {
+				return nil, fmt.Errorf("invalid cache namespace: %s (lowercase letters, digits and dashes)", namespace)
+			}
+			conf.cacheNamespace = namespace
+		}
 	}
 
-	throttlingRate, ok := m["throttling-rate"].(int)
-	if ok && throttlingRate >= 0 {
-		Config.throttlingRate = throttlingRate
+	derivedImages, ok := m["derived-images"].(map[interface{}]interface{})
+	if ok {
+		enabled, _ := derivedImages["enabled"].(bool)
+		if enabled {
+			conf.derivedPrefix = defaultDerivedPrefix
+			prefix, ok := derivedImages["prefix"].(string)
+			if ok {
+				conf.derivedPrefix = strings.Trim(prefix, "/") + "/"
+				if conf.derivedPrefix == "/" {
+					return nil, fmt.Errorf("derived images need a prefix")
+				}
+			}
+		}
 	}
 
-	jpegQuality, ok := m["jpeg-quality"].(int)
-	if ok && jpegQuality >= 1 && jpegQuality <= 100 {
-		Config.jpegQuality = jpegQuality
-	}
+	cacheControl, ok := m["cache-control"].(map[interface{}]interface{})
+	if ok {
+		defaultMap, ok := cacheControl["default"].(map[interface{}]interface{})
+		if ok {
+			conf.cacheControl, err = parseCacheControl(defaultMap)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default cache control: %s", err)
+			}
+		}
 
-	uploadMaxFileSize, ok := m["upload-max-file-size"].(int)
-	if ok && uploadMaxFileSize > 0 {
-		Config.uploadMaxFileSize = uploadMaxFileSize
+		paths, _ := cacheControl["paths"].([]interface{})
+		for _, pathMap := range paths {
+			pathCacheControl, ok := pathMap.(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			prefix, ok := pathCacheControl["prefix"].(string)
+			if !ok {
+				return nil, fmt.Errorf("cache control for paths needs a prefix")
+			}
+			c, err := parseCacheControl(pathCacheControl)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cache control for %s: %s", prefix, err)
+			}
+			conf.pathCacheControls = append(conf.pathCacheControls, PathCacheControl{prefix, c})
+		}
+		// Longest prefixes first
+		sort.Sort(byPrefixLength(conf.pathCacheControls))
 	}
 
-	uploadMaxPixels, ok := m["upload-max-pixels"].(int)
-	if ok && uploadMaxPixels > 0 {
-		Config.uploadMaxPixels = uploadMaxPixels
+	quotas, ok := m["quotas"].(map[interface{}]interface{})
+	if ok {
+		defaultMap, ok := quotas["default"].(map[interface{}]interface{})
+		if ok {
+			conf.defaultKeyQuota, err = parseQuota(defaultMap)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default quota: %s", err)
+			}
+		}
+
+		keys, _ := quotas["keys"].(map[interface{}]interface{})
+		conf.keyQuotas = make(map[string]*Quota, len(keys))
+		for key, value := range keys {
+			keyQuota, ok := value.(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			conf.keyQuotas[fmt.Sprint(key)], err = parseQuota(keyQuota)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quota for %v: %s", key, err)
+			}
+		}
 	}
 
-	allowCustomTransformations, ok := m["allow-custom-transformations"].(bool)
+	headers, ok := m["headers"].(map[interface{}]interface{})
 	if ok {
-		Config.allowCustomTransformations = allowCustomTransformations
+		defaultMap, ok := headers["default"].(map[interface{}]interface{})
+		if ok {
+			conf.headers, err = parseHeaders(defaultMap)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default headers: %s", err)
+			}
+		}
+
+		paths, _ := headers["paths"].([]interface{})
+		for _, pathMap := range paths {
+			pathHeaders, ok := pathMap.(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			prefix, ok := pathHeaders["prefix"].(string)
+			if !ok {
+				return nil, fmt.Errorf("headers for paths need a prefix")
+			}
+			headersMap, _ := pathHeaders["headers"].(map[interface{}]interface{})
+			h, err := parseHeaders(headersMap)
+			if err != nil {
+				return nil, fmt.Errorf("invalid headers for %s: %s", prefix, err)
+			}
+			conf.pathHeaders = append(conf.pathHeaders, PathHeaders{prefix, h})
+		}
+		// Longest prefixes first
+		sort.Sort(byHeadersPrefixLength(conf.pathHeaders))
 	}
 
-	allowCustomScale, ok := m["allow-custom-scale"].(bool)
+	cdn, ok := m["cdn"].(map[interface{}]interface{})
 	if ok {
-		Config.allowCustomScale = allowCustomScale
+		surrogateKeys, ok := cdn["surrogate-keys"].(bool)
+		if ok {
+			conf.cdnSurrogateKeys = surrogateKeys
+		}
+
+		fastly, ok := cdn["fastly"].(map[interface{}]interface{})
+		if ok {
+			conf.cdnFastlyServiceID, _ = fastly["service-id"].(string)
+		}
+
+		cloudflare, ok := cdn["cloudflare"].(map[interface{}]interface{})
+		if ok {
+			conf.cdnCloudflareZoneID, _ = cloudflare["zone-id"].(string)
+		}
+
+		cloudFront, ok := cdn["cloudfront"].(map[interface{}]interface{})
+		if ok {
+			conf.cdnCloudFrontDistributionID, _ = cloudFront["distribution-id"].(string)
+		}
 	}
 
-	asyncUploads, ok := m["async-uploads"].(bool)
+	corsAllowOrigins, ok := m["cors-allow-origins"].([]interface{})
 	if ok {
-		Config.asyncUploads = asyncUploads
+		conf.corsAllowOrigins = stringList(corsAllowOrigins)
 	}
 
-	authorisation, ok := m["authorisation"].(map[interface{}]interface{})
+	cors, ok := m["cors"].(map[interface{}]interface{})
 	if ok {
-		get, ok := authorisation["get"].(bool)
+		allowOrigins, ok := cors["allow-origins"].([]interface{})
 		if ok {
-			Config.authorisedGet = get
+			conf.corsAllowOrigins = stringList(allowOrigins)
 		}
-		upload, ok := authorisation["upload"].(bool)
+		allowMethods, ok := cors["allow-methods"].([]interface{})
+		if ok {
+			conf.corsAllowMethods = stringList(allowMethods)
+		}
+		allowHeaders, ok := cors["allow-headers"].([]interface{})
+		if ok {
+			conf.corsAllowHeaders = stringList(allowHeaders)
+		}
+		exposeHeaders, ok := cors["expose-headers"].([]interface{})
 		if ok {
-			Config.authorisedUpload = upload
+			conf.corsExposeHeaders = stringList(exposeHeaders)
+		}
+		maxAge, ok := cors["max-age"].(int)
+		if ok && maxAge >= 0 {
+			conf.corsMaxAge = maxAge
 		}
 	}
 
-	localPath, ok := m["local-path"].(string)
+	transformationVersions, ok := m["transformation-versions"].(map[interface{}]interface{})
 	if ok {
-		Config.localPath = localPath
+		conf.transformationVersions, err = parseTransformationVersions(transformationVersions)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	cache, ok := m["cache"].(map[interface{}]interface{})
+	transformations, ok := m["transformations"].([]interface{})
 	if ok {
-		limit, ok := cache["limit"].(int)
-		if ok {
-			Config.cacheLimit = limit
+		err = parseTransformations(conf, transformations)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		strategy, ok := cache["strategy"].(string)
-		if ok && (strategy == LRU || strategy == LFU) {
-			Config.cacheStrategy = strategy
+	// Path policies name transformations so they are read after them
+	pathPolicies, ok := m["path-policies"].([]interface{})
+	if ok {
+		conf.pathPolicies, err = parsePathPolicies(conf, pathPolicies)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	corsAllowOrigins, ok := m["cors-allow-origins"].([]interface{})
+	tenants, ok := m["tenants"].([]interface{})
 	if ok {
-		allowOrigins := make([]string, 0)
-		for _, origin := range corsAllowOrigins {
-			originStr, ok := origin.(string)
-			if ok {
-				allowOrigins = append(allowOrigins, originStr)
-			}
+		conf.tenants, err = parseTenants(conf, tenants)
+		if err != nil {
+			return nil, err
 		}
-		Config.corsAllowOrigins = allowOrigins
 	}
 
-	transformations, ok := m["transformations"].([]interface{})
+	deterministic, ok := m["deterministic"].(bool)
+	if ok && deterministic {
+		conf.makeDeterministic()
+	}
+
+	return conf, nil
+}
+
+// parseOutputLimits reads the limits on the size of transformed images
+func parseOutputLimits(conf *Configuration, outputLimits map[interface{}]interface{}) {
+	maxWidth, ok := outputLimits["max-width"].(int)
+	if ok && maxWidth >= 0 {
+		conf.outputMaxWidth = maxWidth
+	}
+	maxHeight, ok := outputLimits["max-height"].(int)
+	if ok && maxHeight >= 0 {
+		conf.outputMaxHeight = maxHeight
+	}
+	maxPixels, ok := outputLimits["max-pixels"].(int)
+	if ok && maxPixels >= 0 {
+		conf.outputMaxPixels = maxPixels
+	}
+	maxScale, ok := outputLimits["max-scale"].(int)
+	if ok && maxScale >= 0 {
+		conf.outputMaxScale = maxScale
+	}
+	maxBytes, ok := outputLimits["max-bytes"].(int)
+	if ok && maxBytes >= 0 {
+		conf.outputMaxBytes = maxBytes
+	}
+}
+
+// parseWatermark reads a watermark of a named transformation or a social card
+func parseWatermark(m map[interface{}]interface{}) (*Watermark, error) {
+	imagePath, ok := m["source"].(string)
+	if !ok {
+		return nil, fmt.Errorf("a watermark needs to have a source specified")
+	}
+
+	gravity, ok := m["gravity"].(string)
+	if !ok || !engine.IsValidGravity(gravity) {
+		return nil, fmt.Errorf("missing or invalid gravity: %s", gravity)
+	}
+
+	// x and y will default to 0 if not found in config
+	x, ok := m["x-pos"].(int)
+	if x < 0 {
+		return nil, fmt.Errorf("x-pos must be at least 0")
+	}
+	y, ok := m["y-pos"].(int)
+	if y < 0 {
+		return nil, fmt.Errorf("y-pos must be at least 0")
+	}
+
+	return &Watermark{imagePath, gravity, x, y}, nil
+}
+
+// parseText reads a text overlay of a named transformation or a social card
+func parseText(m map[interface{}]interface{}) (*Text, error) {
+	content, ok := m["content"].(string)
+
+	gravity, ok := m["gravity"].(string)
+	if !ok || !engine.IsValidGravity(gravity) {
+		return nil, fmt.Errorf("missing or invalid gravity: %s", gravity)
+	}
+
+	// x and y will default to 0 if not found in config
+	x, ok := m["x-pos"].(int)
+	if x < 0 {
+		return nil, fmt.Errorf("x-pos must be at least 0")
+	}
+	y, ok := m["y-pos"].(int)
+	if y < 0 {
+		return nil, fmt.Errorf("y-pos must be at least 0")
+	}
+
+	colorStr, ok := m["color"].(string)
+	if !ok {
+		return nil, fmt.Errorf("text needs to have a color specified")
+	}
+	color, err := colorful.Hex(colorStr)
+	if err != nil {
+		return nil, err
+	}
+
+	fontFilePath, ok := m["font"].(string)
+	if !ok {
+		fontFilePath = defaultFontPath
+	}
+	if _, err := os.Stat(fontFilePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("font does not exist: %s", fontFilePath)
+	}
+	fontBytes, err := ioutil.ReadFile(fontFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("loading font failed: %s", err)
+	}
+	font, err := freetype.ParseFont(fontBytes)
+	if err != nil {
+		return nil, fmt.Errorf("loading font failed: %s", err)
+	}
+
+	size, ok := m["size"].(int)
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("%v is not a valid size", m["size"])
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("size needs to be at least 1")
 	}
 
+	return &Text{engine.Text{Content: content, Gravity: gravity, X: x, Y: y, Size: size, Font: font, Color: color}, fontFilePath}, nil
+}
+
+// parseTransformations reads named transformations into a configuration
+func parseTransformations(conf *Configuration, transformations []interface{}) error {
+	// Latest versions of versioned transformations by name
+	versions := make(map[string]int)
+	unversioned := make(map[string]bool)
 	for _, transformationMap := range transformations {
 		transformation, ok := transformationMap.(map[interface{}]interface{})
 		if !ok {
@@ -161,7 +1727,23 @@ func configInit(configFilePath string) error {
 			continue
 		}
 
-		params, err := parseParameters(parametersStr)
+		parametersStr, autoQuality, err := removeQuality(parametersStr)
+		if err != nil {
+			return fmt.Errorf("invalid transformation parameters: %s (%s)", parametersStr, err)
+		}
+		parametersStr, subsampling, err := removeSubsampling(parametersStr)
+		if err != nil {
+			return fmt.Errorf("invalid transformation parameters: %s (%s)", parametersStr, err)
+		}
+		parametersStr, maxBytes, err := removeMaxBytes(parametersStr)
+		if err != nil {
+			return fmt.Errorf("invalid transformation parameters: %s (%s)", parametersStr, err)
+		}
+		parametersStr, mask, err := removeMask(parametersStr)
+		if err != nil {
+			return fmt.Errorf("invalid transformation parameters: %s (%s)", parametersStr, err)
+		}
+		params, err := parseTrustedParameters(parametersStr, conf)
 		if err != nil {
 			return fmt.Errorf("invalid transformation parameters: %s (%s)", parametersStr, err)
 		}
@@ -174,107 +1756,262 @@ func configInit(configFilePath string) error {
 			return fmt.Errorf("invalid transformation name: %s", name)
 		}
 
-		t := Transformation{&params, nil, make([]*Text, 0)}
+		t := Transformation{params: &params, texts: make([]*Text, 0), autoQuality: autoQuality, subsampling: subsampling, maxBytes: maxBytes, mask: mask}
 
-		watermarkMap, ok := transformation["watermark"].(map[interface{}]interface{})
-		if ok {
-			imagePath, ok := watermarkMap["source"].(string)
-			if !ok {
-				return fmt.Errorf("a watermark needs to have a source specified")
+		// Versions are served as name@version, the name serves the current one
+		key := name
+		if value, ok := transformation["version"]; ok {
+			version, ok := value.(int)
+			if !ok || version < 1 {
+				return fmt.Errorf("invalid version of transformation %s: %v (a number from 1 needed)", name, value)
 			}
-
-			gravity, ok := watermarkMap["gravity"].(string)
-			if !ok || !isValidGravity(gravity) {
-				return fmt.Errorf("missing or invalid gravity: %s", gravity)
+			key = versionedTransformationName(name, version)
+			if _, ok := conf.transformations[key]; ok {
+				return fmt.Errorf("transformation %s is defined twice", key)
 			}
-
-			// x and y will default to 0 if not found in config
-			x, ok := watermarkMap["x-pos"].(int)
-			if x < 0 {
-				return fmt.Errorf("x-pos must be at least 0")
+			if versions[name] == 0 && unversioned[name] {
+				return fmt.Errorf("transformation %s needs a version like its other definitions", name)
+			}
+			if version > versions[name] {
+				versions[name] = version
 			}
-			y, ok := watermarkMap["y-pos"].(int)
-			if y < 0 {
-				return fmt.Errorf("y-pos must be at least 0")
+			t.preset = key
+		} else {
+			if versions[name] != 0 {
+				return fmt.Errorf("transformation %s needs a version like its other definitions", name)
 			}
+			unversioned[name] = true
+		}
 
-			t.watermark = &Watermark{imagePath, gravity, x, y}
+		if conditions, ok := transformation["conditions"].([]interface{}); ok {
+			t.conditions, err = parseConditions(conditions, parametersStr, conf)
+			if err != nil {
+				return fmt.Errorf("transformation %s: %s", name, err)
+			}
 		}
 
-		texts, ok := transformation["text"].([]interface{})
+		watermarkMap, ok := transformation["watermark"].(map[interface{}]interface{})
 		if ok {
+			t.watermark, err = parseWatermark(watermarkMap)
+			if err != nil {
+				return err
+			}
+		}
 
+		texts, ok := transformation["text"].([]interface{})
+		if ok {
 			for _, textMap := range texts {
 				text, ok := textMap.(map[interface{}]interface{})
 				if !ok {
 					continue
 				}
+				parsed, err := parseText(text)
+				if err != nil {
+					return err
+				}
+				t.texts = append(t.texts, parsed)
+			}
+		}
 
-				content, ok := text["content"].(string)
+		scriptPath, ok := transformation["script"].(string)
+		if ok {
+			t.script, err = loadScript(scriptPath)
+			if err != nil {
+				return fmt.Errorf("loading script for %s failed: %s", name, err)
+			}
+		}
 
-				gravity, ok := text["gravity"].(string)
-				if !ok || !isValidGravity(gravity) {
-					return fmt.Errorf("missing or invalid gravity: %s", gravity)
-				}
+		cacheTTL, ok := transformation["cache-ttl"].(int)
+		if ok && cacheTTL > 0 {
+			t.cacheTTL = cacheTTL
+		}
 
-				// x and y will default to 0 if not found in config
-				x, ok := text["x-pos"].(int)
-				if x < 0 {
-					return fmt.Errorf("x-pos must be at least 0")
-				}
-				y, ok := text["y-pos"].(int)
-				if y < 0 {
-					return fmt.Errorf("y-pos must be at least 0")
-				}
+		cacheControlMap, ok := transformation["cache-control"].(map[interface{}]interface{})
+		if ok {
+			t.cacheControl, err = parseCacheControl(cacheControlMap)
+			if err != nil {
+				return fmt.Errorf("invalid cache control for %s: %s", name, err)
+			}
+		}
 
-				colorStr, ok := text["color"].(string)
-				if !ok {
-					return fmt.Errorf("text needs to have a color specified")
-				}
-				color, err := colorful.Hex(colorStr)
-				if err != nil {
-					return err
-				}
+		pngOptimizationMap, ok := transformation["png-optimization"].(map[interface{}]interface{})
+		if ok {
+			t.pngOptimization, err = parsePNGOptimization(pngOptimizationMap)
+			if err != nil {
+				return fmt.Errorf("invalid png-optimization for %s: %s", name, err)
+			}
+		}
 
-				fontFilePath, ok := text["font"].(string)
-				if !ok {
-					fontFilePath = defaultFontPath
-				}
-				if _, err := os.Stat(fontFilePath); os.IsNotExist(err) {
-					return fmt.Errorf("font does not exist: %s", fontFilePath)
-				}
-				fontBytes, err := ioutil.ReadFile(fontFilePath)
-				if err != nil {
-					return fmt.Errorf("loading font failed: %s", err)
+		headersMap, ok := transformation["headers"].(map[interface{}]interface{})
+		if ok {
+			t.headers, err = parseHeaders(headersMap)
+			if err != nil {
+				return fmt.Errorf("invalid headers for %s: %s", name, err)
+			}
+			conf.transformationHeaders = true
+		}
+
+		access, ok := transformation["access"].(string)
+		if ok {
+			if !isValidAccess(access) {
+				return fmt.Errorf("invalid access for %s: %s (available: %s, %s)", name, access, AccessPublic, AccessRestricted)
+			}
+			t.access = access
+		}
+
+		srcset, ok := transformation["srcset"].([]interface{})
+		if ok {
+			for _, value := range srcset {
+				width, ok := value.(int)
+				if !ok || width < 1 {
+					return fmt.Errorf("invalid srcset width for %s: %v", name, value)
 				}
-				font, err := freetype.ParseFont(fontBytes)
+				t.srcset = append(t.srcset, width)
+			}
+			t.srcset = sortedWidths(t.srcset)
+			for variantName, variant := range srcsetVariants(key, t) {
+				err = variant.params.CheckLimits(conf.outputLimits())
 				if err != nil {
-					return fmt.Errorf("loading font failed: %s", err)
+					return fmt.Errorf("invalid srcset width for %s: %s", name, err)
 				}
+				conf.transformations[variantName] = variant
+			}
+		}
 
-				size, ok := text["size"].(int)
-				if !ok {
-					return fmt.Errorf("%v is not a valid size %s", text["size"])
+		densities, ok := transformation["densities"].([]interface{})
+		if ok {
+			if len(t.srcset) > 0 {
+				return fmt.Errorf("%s can't have both srcset widths and densities", name)
+			}
+			if !conf.allowCustomScale {
+				return fmt.Errorf("densities of %s need allow-custom-scale", name)
+			}
+			for _, value := range densities {
+				density, ok := value.(int)
+				if !ok || density < 1 {
+					return fmt.Errorf("invalid density for %s: %v", name, value)
 				}
-				if size < 1 {
-					return fmt.Errorf("size needs to be at least 1")
+				t.densities = append(t.densities, density)
+			}
+			t.densities = sortedWidths(t.densities)
+			for _, density := range t.densities {
+				params := t.params.WithScale(density)
+				err = params.CheckLimits(conf.outputLimits())
+				if err != nil {
+					return fmt.Errorf("invalid density for %s: %s", name, err)
 				}
-
-				t.texts = append(t.texts, &Text{content, gravity, fontFilePath, x, y, size, font, color})
 			}
 		}
 
-		Config.transformations[name] = t
+		conf.transformations[key] = t
 
 		eager, ok := transformation["eager"].(bool)
 		if ok && eager {
-			Config.eagerTransformations = append(Config.eagerTransformations, t)
+			conf.eagerTransformations = append(conf.eagerTransformations, t)
 		}
 	}
 
+	return setCurrentTransformationVersions(conf, versions)
+}
+
+// versionedTransformationName returns the name a version of a named
+// transformation is served under
+func versionedTransformationName(name string, version int) string {
+	return name + "@" + strconv.Itoa(version)
+}
+
+// setCurrentTransformationVersions makes the names of versioned
+// transformations serve the versions transformation-versions sets, the
+// latest ones otherwise
+func setCurrentTransformationVersions(conf *Configuration, versions map[string]int) error {
+	for name := range conf.transformationVersions {
+		if _, ok := versions[name]; !ok {
+			return fmt.Errorf("invalid transformation-versions: %s has no versions", name)
+		}
+	}
+	for name, latest := range versions {
+		current, ok := conf.transformationVersions[name]
+		if !ok {
+			current = latest
+		}
+		t, ok := conf.transformations[versionedTransformationName(name, current)]
+		if !ok {
+			return fmt.Errorf("invalid transformation-versions: %s has no version %d", name, current)
+		}
+		conf.transformations[name] = t
+		for _, width := range t.srcset {
+			conf.transformations[srcsetVariantName(name, width)] = conf.transformations[srcsetVariantName(t.preset, width)]
+		}
+	}
 	return nil
 }
 
+// parseTransformationVersions reads the current versions of versioned
+// transformations by their names
+func parseTransformationVersions(m map[interface{}]interface{}) (map[string]int, error) {
+	versions := make(map[string]int)
+	for key, value := range m {
+		name := fmt.Sprint(key)
+		version, ok := value.(int)
+		if !ok || version < 1 {
+			return nil, fmt.Errorf("invalid transformation-versions: %v for %s (a number from 1 needed)", value, name)
+		}
+		versions[name] = version
+	}
+	return versions, nil
+}
+
+// Returns the strings in a list, ignoring other values.
+func stringList(values []interface{}) []string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		str, ok := value.(string)
+		if ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// Parses a rate limit map with a rate per minute and an optional burst
+// (the rate by default), returns nil if there is no limit.
+func parseRateLimit(value interface{}) (*RateLimit, error) {
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil
+	}
+	rate, ok := m["rate"].(int)
+	if !ok || rate <= 0 {
+		return nil, fmt.Errorf("rate needs to be at least 1")
+	}
+	burst, ok := m["burst"].(int)
+	if !ok {
+		burst = rate
+	}
+	if burst <= 0 {
+		return nil, fmt.Errorf("burst needs to be at least 1")
+	}
+	return &RateLimit{rate, burst}, nil
+}
+
+// Parses allow and deny lists of networks, returns nil if both are empty.
+func parseIPFilter(m map[interface{}]interface{}) (*IPFilter, error) {
+	allowValues, _ := m["allow"].([]interface{})
+	allow, err := parseIPList(allowValues)
+	if err != nil {
+		return nil, err
+	}
+	denyValues, _ := m["deny"].([]interface{})
+	deny, err := parseIPList(denyValues)
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	return &IPFilter{allow, deny}, nil
+}
+
 var (
 	transformationNameConfigRe = regexp.MustCompile("^([0-9A-Za-z-]+)$")
 )
@@ -282,3 +2019,9 @@ var (
 func isValidTransformationName(name string) bool {
 	return transformationNameConfigRe.MatchString(name)
 }
+
+type byPrefixLength []PathCacheControl
+
+func (a byPrefixLength) Len() int           { return len(a) }
+func (a byPrefixLength) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPrefixLength) Less(i, j int) bool { return len(a[i].prefix) > len(a[j].prefix) }
@@ -0,0 +1,30 @@
+-- Used by the "products" transformation in config/example.yaml.
+--
+-- Product photos are cropped to the requested frame, photos of sale items
+-- (under sale/) are watermarked and photos which are too dark to show the
+-- product well get a grayscale version instead.
+
+local function brightness(image)
+  local total, samples = 0, 0
+  local stepX = math.max(1, math.floor(image:width() / 10))
+  local stepY = math.max(1, math.floor(image:height() / 10))
+  for x = 0, image:width() - 1, stepX do
+    for y = 0, image:height() - 1, stepY do
+      local r, g, b = image:pixel(x, y)
+      total = total + 0.299 * r + 0.587 * g + 0.114 * b
+      samples = samples + 1
+    end
+  end
+  return total / samples
+end
+
+function transform(image, request)
+  local result = image:apply()
+  if brightness(result) < 40 then
+    result = result:filter("grayscale")
+  end
+  if string.find(request.path, "^sale/") then
+    result = result:watermark("watermark.png", "se", 10, 10)
+  end
+  return result
+end
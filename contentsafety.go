@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Max. size of a classifier's response
+const maxClassifierResponseSize = 64 * 1024
+
+// errContentBlocked is returned for images the classifier scores over the
+// threshold when they are blocked
+var errContentBlocked = errors.New("image blocked by content classification")
+
+// Sources of classified images
+const (
+	contentSourceUpload = "upload"
+	contentSourceOrigin = "origin"
+)
+
+// ClassificationResult is what the classifier responds with, scores are
+// between 0 (safe) and 1
+type ClassificationResult struct {
+	Score  float64            `json:"score"`
+	Labels map[string]float64 `json:"labels,omitempty"`
+}
+
+// ContentSafetyEvent is POSTed to the webhook for images over the threshold
+type ContentSafetyEvent struct {
+	Image   string             `json:"image"`
+	Source  string             `json:"source"`
+	Score   float64            `json:"score"`
+	Labels  map[string]float64 `json:"labels,omitempty"`
+	Blocked bool               `json:"blocked"`
+}
+
+// checkContentSafety sends an uploaded or fetched image to the classifier and
+// returns errContentBlocked when it is over the threshold and flagging isn't
+// enough. Images are let through when the classifier fails so that an outage
+// doesn't stop uploads.
+func checkContentSafety(conf *Configuration, imagePath, source string, data []byte) error {
+	if conf.contentSafetyURL == "" {
+		return nil
+	}
+	start := time.Now()
+	result, err := classifyImage(conf.contentSafetyURL, time.Duration(conf.contentSafetyTimeout)*time.Millisecond, data)
+	if err != nil {
+		slog.Error("classifying an image failed", "image", imagePath, "url", conf.contentSafetyURL, "error", err)
+		return nil
+	}
+	slog.Debug("image classified", "image", imagePath, "score", result.Score, "duration", time.Since(start))
+	if result.Score < conf.contentSafetyThreshold {
+		return nil
+	}
+
+	event := ContentSafetyEvent{imagePath, source, result.Score, result.Labels, !conf.contentSafetyFlagOnly}
+	slog.Warn("image over the content safety threshold", "image", imagePath, "source", source, "score", result.Score, "blocked", event.Blocked)
+	if conf.contentSafetyWebhook != "" {
+		go func() {
+			err := notifyContentSafetyWebhook(conf.contentSafetyWebhook, time.Duration(conf.contentSafetyTimeout)*time.Millisecond, event)
+			if err != nil {
+				slog.Error("notifying the content safety webhook failed", "image", imagePath, "url", conf.contentSafetyWebhook, "error", err)
+			}
+		}()
+	}
+	if event.Blocked {
+		return errContentBlocked
+	}
+	return nil
+}
+
+// classifyImage POSTs an image as it is to the classifier, which responds
+// with a JSON ClassificationResult
+func classifyImage(classifierURL string, timeout time.Duration, data []byte) (*ClassificationResult, error) {
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Post(classifierURL, http.DetectContentType(data), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, maxClassifierResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	var result ClassificationResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, fmt.Errorf("decoding the response failed: %s", err)
+	}
+	return &result, nil
+}
+
+func notifyContentSafetyWebhook(webhookURL string, timeout time.Duration, event ContentSafetyEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	return nil
+}
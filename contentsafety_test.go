@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckContentSafety(t *testing.T) {
+	classifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		score := 0.1
+		if string(data) == "unsafe" {
+			score = 0.95
+		}
+		json.NewEncoder(w).Encode(ClassificationResult{Score: score, Labels: map[string]float64{"nudity": score}})
+	}))
+	defer classifier.Close()
+	events := make(chan ContentSafetyEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ContentSafetyEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer webhook.Close()
+
+	conf := &Configuration{contentSafetyURL: classifier.URL, contentSafetyTimeout: 1000, contentSafetyThreshold: 0.8, contentSafetyWebhook: webhook.URL}
+	if err := checkContentSafety(conf, "a.jpg", contentSourceUpload, []byte("safe")); err != nil {
+		t.Errorf("Unexpected error for a safe image: %v", err)
+	}
+	if err := checkContentSafety(conf, "b.jpg", contentSourceOrigin, []byte("unsafe")); err != errContentBlocked {
+		t.Errorf("Expected the image to be blocked, got %v", err)
+	}
+	select {
+	case event := <-events:
+		if event.Image != "b.jpg" || event.Source != contentSourceOrigin || event.Score != 0.95 || !event.Blocked || event.Labels["nudity"] != 0.95 {
+			t.Errorf("Unexpected webhook event: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the webhook to be notified")
+	}
+
+	conf.contentSafetyFlagOnly = true
+	if err := checkContentSafety(conf, "c.jpg", contentSourceUpload, []byte("unsafe")); err != nil {
+		t.Errorf("Expected a flagged image to be let through, got %v", err)
+	}
+	if event := <-events; event.Image != "c.jpg" || event.Blocked {
+		t.Errorf("Unexpected webhook event: %+v", event)
+	}
+
+	// Classifier outages don't block images
+	conf.contentSafetyFlagOnly = false
+	conf.contentSafetyURL = classifier.URL + "/missing"
+	classifier.Config.Handler = http.NotFoundHandler()
+	if err := checkContentSafety(conf, "d.jpg", contentSourceUpload, []byte("unsafe")); err != nil {
+		t.Errorf("Expected images to be let through when the classifier fails, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a cron-style schedule of minutes, hours, days of the
+// month, months and days of the week, e.g. "30 3 * * 1-5"
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64 // Bit sets of the allowed values
+	anyDay, anyWeekday                     bool
+}
+
+// cronFields are the ranges of the fields of a schedule in order
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // Sunday is 0 or 7
+}
+
+// parseCron reads a schedule made of 5 fields separated by spaces. Fields are
+// *, numbers, ranges (1-5) and lists of those (1,15), all of them optionally
+// with a step (*/15). @hourly, @daily, @weekly and @monthly are accepted too.
+func parseCron(spec string) (*cronSchedule, error) {
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule: %s (5 fields needed)", spec)
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule: %s (%s: %s)", spec, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	// Sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minutes: sets[0], hours: sets[1], days: sets[2], months: sets[3], weekdays: sets[4],
+		anyDay: strings.HasPrefix(fields[2], "*"), anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%s is out of range (%d-%d)", part, min, max)
+		}
+		for value := from; value <= to; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the schedule includes the minute of a time
+func (s *cronSchedule) matches(t time.Time) bool {
+	return s.minutes&(1<<uint(t.Minute())) != 0 && s.hours&(1<<uint(t.Hour())) != 0 && s.months&(1<<uint(t.Month())) != 0 && s.dayMatches(t)
+}
+
+// next returns the first time after t the schedule includes, zero time when
+// there is none within 5 years (e.g. for the 31st of February)
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.matches(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// dayMatches reports whether the schedule includes the day of a time. Like
+// in cron, when both days of the month and of the week are restricted either
+// of them matching is enough.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"}
+	for _, spec := range invalid {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+	for _, spec := range []string{"@daily", "0 3 * * *", "*/15 1-5,22 1 */2 7", "5/20 * * * 1-5"} {
+		if _, err := parseCron(spec); err != nil {
+			t.Errorf("Unexpected error for %q: %s", spec, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 3, 30, 20, 0, time.UTC) // A Wednesday
+	tests := map[string]time.Time{
+		"0 3 * * *":     time.Date(2024, time.February, 1, 3, 0, 0, 0, time.UTC),
+		"*/15 * * * *":  time.Date(2024, time.January, 31, 3, 45, 0, 0, time.UTC),
+		"@hourly":       time.Date(2024, time.January, 31, 4, 0, 0, 0, time.UTC),
+		"30 2 * * 7":    time.Date(2024, time.February, 4, 2, 30, 0, 0, time.UTC),
+		"0 0 29 2 *":    time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		"0 0 13 * 5":    time.Date(2024, time.February, 2, 0, 0, 0, 0, time.UTC), // The 13th or a Friday
+		"5/20 4 * * *":  time.Date(2024, time.January, 31, 4, 5, 0, 0, time.UTC),
+		"31 3 31 1 3":   time.Date(2024, time.January, 31, 3, 31, 0, 0, time.UTC),
+		"0 12 1 */6 *":  time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC),
+		"0 0 30 2 * ":   {},
+		"59 23 31 12 *": time.Date(2024, time.December, 31, 23, 59, 0, 0, time.UTC),
+	}
+	for spec, expected := range tests {
+		schedule, err := parseCron(spec)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", spec, err)
+		}
+		if next := schedule.next(from); !next.Equal(expected) {
+			t.Errorf("Expected %q to run next at %s, got %s", spec, expected, next)
+		}
+		if !expected.IsZero() && !schedule.matches(expected) {
+			t.Errorf("Expected %q to match %s", spec, expected)
+		}
+	}
+}
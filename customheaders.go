@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// PathHeaders are static headers sent with responses under a path prefix
+type PathHeaders struct {
+	prefix  string
+	headers map[string]string
+}
+
+type byHeadersPrefixLength []PathHeaders
+
+func (a byHeadersPrefixLength) Len() int           { return len(a) }
+func (a byHeadersPrefixLength) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byHeadersPrefixLength) Less(i, j int) bool { return len(a[i].prefix) > len(a[j].prefix) }
+
+// parseHeaders reads a map of static headers from configuration, an empty
+// value removes a header
+func parseHeaders(m map[interface{}]interface{}) (map[string]string, error) {
+	headers := make(map[string]string, len(m))
+	for key, value := range m {
+		name, ok := key.(string)
+		if !ok || name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("%v is not a valid header name", key)
+		}
+		var str string
+		switch v := value.(type) {
+		case nil:
+		case string:
+			str = v
+		case int, bool, float64:
+			str = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%v is not a valid value for %s", value, name)
+		}
+		if strings.ContainsAny(str, "\r\n") {
+			return nil, fmt.Errorf("the value of %s can't contain line breaks", name)
+		}
+		headers[http.CanonicalHeaderKey(name)] = str
+	}
+	return headers, nil
+}
+
+// setHeaders sets static headers on a response, removing the ones without a
+// value
+func setHeaders(header http.Header, headers map[string]string) {
+	for name, value := range headers {
+		if value == "" {
+			header.Del(name)
+		} else {
+			header.Set(name, value)
+		}
+	}
+}
+
+// applyCustomHeaders sets the configured headers for a request, the ones of
+// a named transformation take precedence over the ones for the longest
+// matching path prefix and then the default ones. Transformations are looked
+// up in the configuration of the request's tenant.
+func applyCustomHeaders(header http.Header, conf *Configuration, path, transformationName string) {
+	setHeaders(header, currentConfig().headers)
+	for _, pathHeaders := range currentConfig().pathHeaders {
+		if strings.HasPrefix(path, pathHeaders.prefix) {
+			setHeaders(header, pathHeaders.headers)
+			break
+		}
+	}
+	if transformation, ok := conf.transformations[transformationName]; ok && transformationName != "" {
+		setHeaders(header, transformation.headers)
+	}
+}
+
+// customHeaders is a middleware adding the configured static headers to
+// responses right before they are written, so they override the standard
+// ones such as Cache-Control
+func customHeaders(res http.ResponseWriter, req *http.Request) {
+	if len(currentConfig().headers) == 0 && len(currentConfig().pathHeaders) == 0 && !configFor(req).transformationHeaders {
+		return
+	}
+	rw := res.(martini.ResponseWriter)
+	rw.Before(func(rw martini.ResponseWriter) {
+		applyCustomHeaders(rw.Header(), configFor(req), req.URL.Path, requestLogFor(req).transformation)
+	})
+}
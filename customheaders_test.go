@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := parseHeaders(map[interface{}]interface{}{
+		"x-frame-options":        "DENY",
+		"Timing-Allow-Origin":    "*",
+		"X-Powered-By":           nil,
+		"Surrogate-Control-TTLs": 60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers["X-Frame-Options"] != "DENY" || headers["Surrogate-Control-Ttls"] != "60" {
+		t.Errorf("Unexpected headers: %v", headers)
+	}
+	if value, ok := headers["X-Powered-By"]; !ok || value != "" {
+		t.Error("Expected a header without a value to be kept for removal")
+	}
+
+	invalid := []map[interface{}]interface{}{
+		{"X Frame": "DENY"},
+		{"X-Frame-Options:": "DENY"},
+		{"Content-Security-Policy": "default-src 'none'\r\nSet-Cookie: a=b"},
+		{"X-List": []interface{}{"a", "b"}},
+	}
+	for _, m := range invalid {
+		if _, err := parseHeaders(m); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
+
+func TestApplyCustomHeaders(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{
+		headers: map[string]string{"X-Frame-Options": "DENY", "X-Content-Type-Options": "nosniff"},
+		pathHeaders: []PathHeaders{
+			{"/image/", map[string]string{"Content-Security-Policy": "default-src 'none'"}},
+			{"/image/w_100/", map[string]string{"X-Frame-Options": "SAMEORIGIN"}},
+		},
+		transformations: map[string]Transformation{
+			"avatar": {headers: map[string]string{"Cache-Control": "private, max-age=60", "X-Content-Type-Options": ""}},
+		},
+	})
+	sort.Sort(byHeadersPrefixLength(currentConfig().pathHeaders))
+
+	header := http.Header{}
+	applyCustomHeaders(header, currentConfig(), "/healthz", "")
+	if header.Get("X-Frame-Options") != "DENY" || header.Get("Content-Security-Policy") != "" {
+		t.Errorf("Expected only the default headers, got: %v", header)
+	}
+
+	header = http.Header{"Cache-Control": {"public, max-age=3600"}}
+	applyCustomHeaders(header, currentConfig(), "/image/w_100/cat.jpg", "")
+	if header.Get("X-Frame-Options") != "SAMEORIGIN" || header.Get("Content-Security-Policy") != "" {
+		t.Errorf("Expected the headers for the longest prefix, got: %v", header)
+	}
+	if header.Get("Cache-Control") != "public, max-age=3600" {
+		t.Error("Expected other headers to be left alone")
+	}
+
+	header = http.Header{"Cache-Control": {"public, max-age=3600"}}
+	applyCustomHeaders(header, currentConfig(), "/image/t_avatar/cat.jpg", "avatar")
+	if header.Get("Cache-Control") != "private, max-age=60" {
+		t.Errorf("Expected the transformation to override Cache-Control, got: %q", header.Get("Cache-Control"))
+	}
+	if _, ok := header["X-Content-Type-Options"]; ok {
+		t.Error("Expected a header without a value to be removed")
+	}
+	if header.Get("Content-Security-Policy") != "default-src 'none'" {
+		t.Errorf("Expected the headers for the path too, got: %v", header)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+// How many of the latest requests the dashboard shows
+const dashboardRecentRequests = 50
+
+// RecentRequest is a request answered by the server as shown on the dashboard
+type RecentRequest struct {
+	Time           time.Time
+	Method, Path   string
+	Status, Bytes  int
+	Duration       time.Duration
+	Transformation string
+	CacheStatus    string
+}
+
+// requestHistory keeps the latest requests in a ring buffer
+type requestHistory struct {
+	sync.Mutex
+	entries []RecentRequest
+	next    int
+}
+
+var recentRequests = newRequestHistory(dashboardRecentRequests)
+
+func newRequestHistory(size int) *requestHistory {
+	return &requestHistory{entries: make([]RecentRequest, 0, size)}
+}
+
+func (h *requestHistory) add(r RecentRequest) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, r)
+		return
+	}
+	h.entries[h.next] = r
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// list returns the requests newest first
+func (h *requestHistory) list() []RecentRequest {
+	h.Lock()
+	defer h.Unlock()
+	list := make([]RecentRequest, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		list = append(list, h.entries[(h.next+i)%len(h.entries)])
+	}
+	return list
+}
+
+// dashboardTransformation is a named transformation as shown on the dashboard
+type dashboardTransformation struct {
+	Name, Parameters string
+	Eager            bool
+}
+
+type dashboardData struct {
+	Stats           CacheStats
+	MemoryStats     MemoryCacheStats
+	StatsError      bool
+	Requests        []RecentRequest
+	Transformations []dashboardTransformation
+	Storage         string
+	Started         time.Time
+}
+
+var serverStarted = time.Now()
+
+// dashboardHandler serves a page for admins with cache statistics, the latest
+// requests and named transformations, purges and warm-ups can be started
+// from it using the JSON endpoints
+func dashboardHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return http.StatusUnauthorized, "Unauthorized"
+	}
+
+	conf := configFor(req)
+	data := dashboardData{MemoryStats: hotCache.stats(), Requests: recentRequests.list(), Storage: storageName, Started: serverStarted}
+	stats, err := getCacheStats()
+	if err != nil {
+		slog.Error("retrieving cache statistics failed", "error", err)
+		data.StatsError = true
+	}
+	data.Stats = stats
+
+	eager := make(map[*engine.Params]bool)
+	for _, t := range conf.eagerTransformations {
+		eager[t.params] = true
+	}
+	for name, t := range conf.transformations {
+		data.Transformations = append(data.Transformations, dashboardTransformation{name, t.params.ToString(), eager[t.params]})
+	}
+	sort.Slice(data.Transformations, func(i, j int) bool {
+		return data.Transformations[i].Name < data.Transformations[j].Name
+	})
+
+	var buf bytes.Buffer
+	err = dashboardTemplate.Execute(&buf, data)
+	if err != nil {
+		slog.Error("rendering the dashboard failed", "error", err)
+		return http.StatusInternalServerError, "Server error"
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	return http.StatusOK, buf.String()
+}
+
+// The page links to the JSON endpoints relatively so that it works with the
+// API key in the path or in the query and with tenant prefixes
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"percent": func(rate float64) string { return strconv.FormatFloat(rate*100, 'f', 1, 64) + "%" },
+	"since":   func(t time.Time) string { return time.Since(t).Round(time.Second).String() },
+	"ms": func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pixlserv</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.25em 1em 0.25em 0; border-bottom: 1px solid #ddd; }
+form { margin-bottom: 1em; }
+pre { background: #f4f4f4; padding: 1em; }
+</style>
+</head>
+<body>
+<h1>pixlserv</h1>
+<p>Storage: {{.Storage}}, up for {{since .Started}}</p>
+
+<h2>Cache</h2>
+{{if .StatsError}}<p>Cache statistics couldn't be read from redis.</p>{{end}}
+<table>
+<tr><th></th><th>Hits</th><th>Misses</th><th>Hit rate</th><th>Entries</th><th>Size (bytes)</th></tr>
+<tr><td>Storage cache</td><td>{{.Stats.Hits}}</td><td>{{.Stats.Misses}}</td><td>{{percent .Stats.HitRate}}</td><td>{{.Stats.Entries}}</td><td>{{.Stats.Size}}</td></tr>
+<tr><td>Memory cache</td><td>{{.MemoryStats.Hits}}</td><td>{{.MemoryStats.Misses}}</td><td>{{percent .MemoryStats.HitRate}}</td><td>{{.MemoryStats.Entries}}</td><td>{{.MemoryStats.Size}}</td></tr>
+</table>
+<p>Evictions: {{.Stats.Evictions}}, purged: {{.Stats.Purged}}, bytes from cache: {{.Stats.BytesFromCache}}, bytes generated: {{.Stats.BytesGenerated}}</p>
+
+<h2>Operations</h2>
+<form data-action="cache/purge">
+<label>Purge pattern <input name="pattern" placeholder="products/2015/" required></label>
+<button>Purge</button>
+</form>
+<form data-action="cache/warm">
+<label>Warm up prefix <input name="prefix" placeholder="products/" required></label>
+<label>transformations <input name="transformations" placeholder="all"></label>
+<button>Warm up</button>
+</form>
+<pre id="result" hidden></pre>
+
+<h2>Transformations</h2>
+<table>
+<tr><th>Name</th><th>Parameters</th><th>Eager</th></tr>
+{{range .Transformations}}<tr><td>{{.Name}}</td><td>{{.Parameters}}</td><td>{{if .Eager}}yes{{end}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+
+<h2>Recent requests</h2>
+<table>
+<tr><th>Time</th><th>Request</th><th>Status</th><th>Bytes</th><th>ms</th><th>Transformation</th><th>Cache</th></tr>
+{{range .Requests}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Method}} {{.Path}}</td><td>{{.Status}}</td><td>{{.Bytes}}</td><td>{{ms .Duration}}</td><td>{{.Transformation}}</td><td>{{.CacheStatus}}</td></tr>
+{{else}}<tr><td colspan="7">None yet</td></tr>
+{{end}}</table>
+
+<script>
+var result = document.getElementById("result");
+function show(text) {
+	result.hidden = false;
+	result.textContent = text;
+}
+function poll(url) {
+	fetch(url).then(function(r) { return r.json(); }).then(function(body) {
+		show(JSON.stringify(body, null, 2));
+		if (body.job && body.job.state === "running") {
+			setTimeout(function() { poll(url); }, 2000);
+		}
+	});
+}
+document.querySelectorAll("form").forEach(function(form) {
+	form.addEventListener("submit", function(e) {
+		e.preventDefault();
+		var action = form.getAttribute("data-action");
+		fetch(action + location.search, {method: "POST", body: new URLSearchParams(new FormData(form))})
+			.then(function(r) { return r.json(); })
+			.then(function(body) {
+				show(JSON.stringify(body, null, 2));
+				if (body.job) {
+					poll(action + "/" + body.job.id + location.search);
+				}
+			})
+			.catch(function(err) { show(String(err)); });
+	});
+});
+</script>
+</body>
+</html>
+`))
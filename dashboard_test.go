@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestHistory(t *testing.T) {
+	h := newRequestHistory(3)
+	if len(h.list()) != 0 {
+		t.Error("Expected an empty history")
+	}
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/e"} {
+		h.add(RecentRequest{Path: path})
+	}
+	list := h.list()
+	if len(list) != 3 || list[0].Path != "/e" || list[1].Path != "/d" || list[2].Path != "/c" {
+		t.Errorf("Expected the latest requests newest first, got: %+v", list)
+	}
+}
+
+func TestDashboardTemplate(t *testing.T) {
+	data := dashboardData{
+		Stats:           CacheStats{Hits: 3, Misses: 1, HitRate: 0.75},
+		Requests:        []RecentRequest{{Time: time.Now(), Method: "GET", Path: "/image/t_thumb/<cat>.jpg", Status: 200, Duration: 1500 * time.Microsecond}},
+		Transformations: []dashboardTransformation{{"thumb", "w_100,h_100", true}},
+		Started:         time.Now(),
+	}
+	var buf bytes.Buffer
+	if err := dashboardTemplate.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	for _, expected := range []string{"75.0%", "thumb", "w_100,h_100", "&lt;cat&gt;.jpg", "<td>1.5</td>"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("Expected the page to contain %q", expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+// Requests for images with this header get debug headers telling how they
+// were served, when they are made with the admin permission
+const debugHeader = "X-Pixlserv-Debug"
+
+// debugRoutes serves profiles, runtime variables and encoder comparisons to
+// admins when debug-endpoints is enabled
+func debugRoutes(r martini.Router) {
+	r.Get("/debug/pprof/cmdline", adminOnly(pprof.Cmdline))
+	r.Get("/debug/pprof/profile", adminOnly(pprof.Profile))
+	r.Get("/debug/pprof/symbol", adminOnly(pprof.Symbol))
+	r.Post("/debug/pprof/symbol", adminOnly(pprof.Symbol))
+	r.Get("/debug/pprof/trace", adminOnly(pprof.Trace))
+	// The index also serves the named profiles (heap, goroutine...)
+	r.Get("/debug/pprof/**", adminOnly(pprof.Index))
+	r.Get("/debug/vars", adminOnly(expvar.Handler().ServeHTTP))
+	r.Post("/debug/encoders", encoderComparisonHandler)
+}
+
+// adminOnly lets only requests with the admin permission through to handler
+func adminOnly(handler http.HandlerFunc) martini.Handler {
+	return func(params martini.Params, req *http.Request, res http.ResponseWriter) {
+		if !isAuthorised(params, req, AdminPermission) {
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(res, req)
+	}
+}
+
+// wantsDebugHeaders reports whether a request asks for debug headers and is
+// allowed to get them
+func wantsDebugHeaders(params martini.Params, req *http.Request) bool {
+	return req.Header.Get(debugHeader) != "" && isAuthorised(params, req, AdminPermission)
+}
+
+// setDebugHeaders tells where an image came from and, for images the request
+// generated, how long it waited for a worker and was transformed and the
+// dimensions of the original
+func setDebugHeaders(res http.ResponseWriter, entry *requestLog) {
+	if !entry.debug {
+		return
+	}
+	header := res.Header()
+	header.Set("Pixlserv-Cache", entry.cacheStatus)
+	if entry.transformDuration != 0 {
+		header.Set("Pixlserv-Queue-Wait", formatMillis(entry.queueWait))
+		header.Set("Pixlserv-Transform-Duration", formatMillis(entry.transformDuration))
+	}
+	if entry.sourceWidth != 0 {
+		header.Set("Pixlserv-Source-Dimensions", strconv.Itoa(entry.sourceWidth)+"x"+strconv.Itoa(entry.sourceHeight))
+	}
+}
+
+// formatMillis formats a duration in milliseconds, e.g. 12.5
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+)
+
+const (
+	gifExtensionIntroducer = 0x21
+	gifImageSeparator      = 0x2C
+)
+
+var (
+	// Formats which can be decoded
+	supportedFormats = []string{"jpeg", "png"}
+
+	// Magic numbers of image formats
+	imageSignatures = []struct {
+		format, magic string
+	}{
+		{"jpeg", "\xff\xd8\xff"},
+		{"png", "\x89PNG\r\n\x1a\n"},
+		{"gif", "GIF87a"},
+		{"gif", "GIF89a"},
+	}
+)
+
+// sourceLimits restricts originals before they are decoded, 0 means no limit
+type sourceLimits struct {
+	maxPixels, maxWidth, maxHeight, maxFrames int
+}
+
+// unsupportedFormatError is returned for files which aren't images in one of
+// the allowed formats
+type unsupportedFormatError string
+
+func (e unsupportedFormatError) Error() string {
+	return string(e)
+}
+
+// imageTooLargeError is returned for images which would take too much memory
+// to decode
+type imageTooLargeError string
+
+func (e imageTooLargeError) Error() string {
+	return string(e)
+}
+
+// sniffImageFormat returns the format of an image based on its first bytes
+// or "" if it isn't recognised
+func sniffImageFormat(header []byte) string {
+	for _, signature := range imageSignatures {
+		if bytes.HasPrefix(header, []byte(signature.magic)) {
+			return signature.format
+		}
+	}
+	return ""
+}
+
+// checkImageFormat makes sure the content of a file is an image in one of the
+// allowed formats whatever its extension says. The reader is rewound
+// afterwards.
+func checkImageFormat(r io.ReadSeeker, allowedFormats []string) (string, error) {
+	header := make([]byte, 16)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", unsupportedFormatError("not an image")
+	}
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	format := sniffImageFormat(header[:n])
+	if format == "" {
+		return "", unsupportedFormatError("not an image")
+	}
+	for _, allowed := range allowedFormats {
+		if format == allowed {
+			return format, nil
+		}
+	}
+	return "", unsupportedFormatError("image format not allowed: " + format)
+}
+
+// sourceLimits returns the limits originals of a format are checked against,
+// those set for the format take precedence over the server wide ones
+func (c *Configuration) sourceLimits(format string) sourceLimits {
+	limits := sourceLimits{maxPixels: c.sourceMaxPixels, maxFrames: c.sourceMaxFrames}
+	formatLimits := c.sourceFormatLimits[format]
+	if formatLimits.maxPixels != 0 {
+		limits.maxPixels = formatLimits.maxPixels
+	}
+	if formatLimits.maxFrames != 0 {
+		limits.maxFrames = formatLimits.maxFrames
+	}
+	limits.maxWidth, limits.maxHeight = formatLimits.maxWidth, formatLimits.maxHeight
+	return limits
+}
+
+// parseSourceFormats reads the source-formats section of the configuration:
+// formats which are turned off and limits of the others
+func parseSourceFormats(m map[interface{}]interface{}, conf *Configuration) error {
+	conf.sourceFormatLimits = make(map[string]sourceLimits)
+	for key, value := range m {
+		format := strings.ToLower(fmt.Sprint(key))
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if !isKnownFormat(format) {
+			return fmt.Errorf("invalid source-formats: unknown format %s", format)
+		}
+		settings, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("invalid source-formats for %s", format)
+		}
+
+		if enabled, ok := settings["enabled"].(bool); ok && !enabled {
+			allowed := make([]string, 0, len(conf.allowedFormats))
+			for _, f := range conf.allowedFormats {
+				if f != format {
+					allowed = append(allowed, f)
+				}
+			}
+			conf.allowedFormats = allowed
+		}
+
+		var limits sourceLimits
+		for name, limit := range map[string]*int{"max-pixels": &limits.maxPixels, "max-width": &limits.maxWidth, "max-height": &limits.maxHeight, "max-frames": &limits.maxFrames} {
+			value, ok := settings[name]
+			if !ok {
+				continue
+			}
+			n, ok := value.(int)
+			if !ok || n < 1 {
+				return fmt.Errorf("invalid source-formats %s for %s: %v (needs to be at least 1)", name, format, value)
+			}
+			*limit = n
+		}
+		if limits.maxFrames != 0 && format != "gif" {
+			return fmt.Errorf("invalid source-formats for %s: only gif images have frames", format)
+		}
+		conf.sourceFormatLimits[format] = limits
+	}
+	if len(conf.allowedFormats) == 0 {
+		return fmt.Errorf("invalid source-formats: all formats are turned off")
+	}
+	return nil
+}
+
+// isKnownFormat reports whether images of a format are recognised by their
+// content, whether they can be decoded or not
+func isKnownFormat(format string) bool {
+	for _, signature := range imageSignatures {
+		if signature.format == format {
+			return true
+		}
+	}
+	return false
+}
+
+func isSupportedFormat(format string) bool {
+	for _, supported := range supportedFormats {
+		if format == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// formatExtension returns the file extension images of a format are stored with
+func formatExtension(format string) string {
+	// Not a big fan of .jpeg file extensions
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+// checkImageLimits inspects image headers and rejects images whose decoded
+// size or number of frames exceeds the given limits before they are
+// decoded. The reader is rewound afterwards.
+func checkImageLimits(r io.ReadSeeker, limits sourceLimits) error {
+	defer r.Seek(0, 0)
+
+	c, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+
+	pixels := c.Width * c.Height
+	if limits.maxPixels > 0 && pixels > limits.maxPixels {
+		return imageTooLargeError(fmt.Sprintf("too many pixels: %d, allowed: %d", pixels, limits.maxPixels))
+	}
+	if limits.maxWidth > 0 && c.Width > limits.maxWidth {
+		return imageTooLargeError(fmt.Sprintf("too wide: %d pixels, allowed: %d", c.Width, limits.maxWidth))
+	}
+	if limits.maxHeight > 0 && c.Height > limits.maxHeight {
+		return imageTooLargeError(fmt.Sprintf("too high: %d pixels, allowed: %d", c.Height, limits.maxHeight))
+	}
+
+	maxFrames := limits.maxFrames
+	if format == "gif" && maxFrames > 0 {
+		_, err = r.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+		frames := gifFrameCount(bufio.NewReader(r), maxFrames+1)
+		if frames > maxFrames {
+			return imageTooLargeError(fmt.Sprintf("too many frames: more than %d", maxFrames))
+		}
+	}
+
+	return nil
+}
+
+// gifFrameCount counts image descriptors in a GIF without decoding them,
+// it stops counting at limit. Truncated data is counted up to where it ends.
+func gifFrameCount(r *bufio.Reader, limit int) int {
+	// Header and logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0
+	}
+	if flags := header[10]; flags&0x80 != 0 {
+		r.Discard(3 << ((flags & 0x07) + 1))
+	}
+
+	frames := 0
+	for frames < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return frames
+		}
+		switch b {
+		case gifExtensionIntroducer:
+			// Label followed by sub-blocks
+			r.ReadByte()
+			skipGIFSubBlocks(r)
+		case gifImageSeparator:
+			frames++
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return frames
+			}
+			if flags := descriptor[8]; flags&0x80 != 0 {
+				r.Discard(3 << ((flags & 0x07) + 1))
+			}
+			// LZW minimum code size followed by sub-blocks
+			r.ReadByte()
+			skipGIFSubBlocks(r)
+		default:
+			// Trailer or malformed data
+			return frames
+		}
+	}
+	return frames
+}
+
+// Skips a sequence of sub-blocks ended by an empty one.
+func skipGIFSubBlocks(r *bufio.Reader) {
+	for {
+		size, err := r.ReadByte()
+		if err != nil || size == 0 {
+			return
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func TestCheckImageLimits(t *testing.T) {
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 100, 100)))
+	if err := checkImageLimits(bytes.NewReader(pngData.Bytes()), sourceLimits{maxPixels: 10000}); err != nil {
+		t.Errorf("Expected the image to be within limits: %v", err)
+	}
+	if _, ok := checkImageLimits(bytes.NewReader(pngData.Bytes()), sourceLimits{maxPixels: 9999}).(imageTooLargeError); !ok {
+		t.Error("Expected the image to have too many pixels")
+	}
+	if _, ok := checkImageLimits(bytes.NewReader(pngData.Bytes()), sourceLimits{maxHeight: 99}).(imageTooLargeError); !ok {
+		t.Error("Expected the image to be too high")
+	}
+
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), palette.Plan9))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var gifData bytes.Buffer
+	gif.EncodeAll(&gifData, anim)
+	if frames := gifFrameCount(bufio.NewReader(bytes.NewReader(gifData.Bytes())), 100); frames != 3 {
+		t.Errorf("Expected 3 frames, actual: %d", frames)
+	}
+	if err := checkImageLimits(bytes.NewReader(gifData.Bytes()), sourceLimits{maxFrames: 3}); err != nil {
+		t.Errorf("Expected the animation to be within limits: %v", err)
+	}
+	if _, ok := checkImageLimits(bytes.NewReader(gifData.Bytes()), sourceLimits{maxFrames: 2}).(imageTooLargeError); !ok {
+		t.Error("Expected the animation to have too many frames")
+	}
+}
+
+func TestCheckImageFormat(t *testing.T) {
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	format, err := checkImageFormat(bytes.NewReader(pngData.Bytes()), []string{"jpeg", "png"})
+	if err != nil || format != "png" {
+		t.Errorf("Expected png, actual: %q (%v)", format, err)
+	}
+
+	if _, err := checkImageFormat(bytes.NewReader(pngData.Bytes()), []string{"jpeg"}); err == nil {
+		t.Error("Expected png not to be allowed")
+	}
+	if _, err := checkImageFormat(bytes.NewReader([]byte("<html><script></script></html>")), []string{"jpeg", "png"}); err == nil {
+		t.Error("Expected HTML to be rejected")
+	}
+	if _, err := checkImageFormat(bytes.NewReader(nil), []string{"jpeg", "png"}); err == nil {
+		t.Error("Expected an empty file to be rejected")
+	}
+}
+
+func TestParseSourceFormats(t *testing.T) {
+	conf := &Configuration{allowedFormats: supportedFormats, sourceMaxPixels: 1000, sourceMaxFrames: 10}
+	err := parseSourceFormats(map[interface{}]interface{}{
+		"jpg": map[interface{}]interface{}{"enabled": false},
+		"png": map[interface{}]interface{}{"max-width": 200, "max-pixels": 500},
+	}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.allowedFormats) != 1 || conf.allowedFormats[0] != "png" || len(supportedFormats) != 2 {
+		t.Errorf("Expected only png to be allowed, got: %v", conf.allowedFormats)
+	}
+	if limits := conf.sourceLimits("png"); limits != (sourceLimits{maxPixels: 500, maxWidth: 200, maxFrames: 10}) {
+		t.Errorf("Unexpected png limits: %+v", limits)
+	}
+	if limits := conf.sourceLimits("gif"); limits != (sourceLimits{maxPixels: 1000, maxFrames: 10}) {
+		t.Errorf("Expected the server wide limits for gif, got: %+v", limits)
+	}
+
+	for _, m := range []map[interface{}]interface{}{
+		{"tiff": map[interface{}]interface{}{"enabled": false}},
+		{"png": map[interface{}]interface{}{"max-frames": 5}},
+		{"gif": map[interface{}]interface{}{"max-frames": 0}},
+		{"jpeg": map[interface{}]interface{}{"enabled": false}, "png": map[interface{}]interface{}{"enabled": false}},
+	} {
+		if err := parseSourceFormats(m, &Configuration{allowedFormats: supportedFormats}); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
+)
+
+var uploadHashRe = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// uploadHashKey is the redis key the path of an uploaded image is indexed
+// under, the same content uploaded for different tenants is stored for each
+func uploadHashKey(tenant *Tenant, hash string) string {
+	prefix := ""
+	if tenant != nil {
+		prefix = tenant.prefix
+	}
+	return "uploadhash:" + prefix + hash
+}
+
+// contentHash returns the hex encoded SHA-256 of an upload's content
+func contentHash(file io.ReadSeeker) (string, error) {
+	file.Seek(0, 0)
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	file.Seek(0, 0)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadedWithHash returns the path (in the storage) of an image uploaded
+// before with the given content hash, "" when there's none. Entries of images
+// which were removed since are forgotten.
+func uploadedWithHash(tenant *Tenant, hash string) (string, error) {
+	key := uploadHashKey(tenant, hash)
+	imagePath, err := redis.String(Conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = storageImpl.Stat(imagePath)
+	if err == ErrNotFound {
+		Conn.Do("DEL", key)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return imagePath, nil
+}
+
+// rememberUploadHash indexes a stored upload by its content hash
+func rememberUploadHash(tenant *Tenant, hash, imagePath string) {
+	Conn.Do("SET", uploadHashKey(tenant, hash), imagePath)
+}
+
+// uploadHashHandler looks up the path of an image uploaded before by the
+// SHA-256 of its content, so that clients can skip uploading it again
+func uploadHashHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, WritePermission) {
+		return jsonResponse(res, http.StatusUnauthorized, UploadResponse{"error", "API key invalid or missing", ""})
+	}
+
+	hash := strings.ToLower(params["hash"])
+	if !uploadHashRe.MatchString(hash) {
+		return jsonResponse(res, http.StatusBadRequest, UploadResponse{"error", "invalid hash", ""})
+	}
+	tenant := tenantFor(req)
+	imagePath, err := uploadedWithHash(tenant, hash)
+	if err != nil {
+		return jsonResponse(res, http.StatusInternalServerError, UploadResponse{"error", err.Error(), ""})
+	}
+	if imagePath == "" {
+		return jsonResponse(res, http.StatusNotFound, UploadResponse{"error", "no image uploaded with this hash", ""})
+	}
+	if tenant != nil {
+		imagePath = strings.TrimPrefix(imagePath, tenant.prefix)
+	}
+	return jsonResponse(res, http.StatusOK, UploadResponse{"ok", "", imagePath})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestUploadHashKey(t *testing.T) {
+	hash := strings.Repeat("a", 64)
+	if key := uploadHashKey(nil, hash); key != "uploadhash:"+hash {
+		t.Errorf("Unexpected key: %s", key)
+	}
+	if key := uploadHashKey(&Tenant{name: "acme", prefix: "acme/"}, hash); key != "uploadhash:acme/"+hash {
+		t.Errorf("Expected the key of a tenant to have its prefix, got: %s", key)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	file := strings.NewReader("image")
+	file.Seek(3, 0)
+	hash, err := contentHash(file)
+	if err != nil || hash != "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d" {
+		t.Errorf("Unexpected hash: %s, %v", hash, err)
+	}
+	if offset, _ := file.Seek(0, 1); offset != 0 {
+		t.Errorf("Expected the upload to be read from the start again, offset: %d", offset)
+	}
+}
+
+func TestUploadHashHandlerInvalidHash(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{deduplicateUploads: true})
+	oldPermissions := permissionsByKey
+	defer func() { permissionsByKey = oldPermissions }()
+	permissionsByKey = map[string]map[string]bool{"KEY": {WritePermission: true}}
+
+	req := httptest.NewRequest("GET", "/uploads/hashes/"+strings.Repeat("a", 64), nil)
+	if status, _ := uploadHashHandler(martini.Params{"hash": strings.Repeat("a", 64)}, req, httptest.NewRecorder()); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 Unauthorized, got: %d", status)
+	}
+
+	for _, hash := range []string{"abc", strings.Repeat("g", 64), strings.Repeat("a", 65)} {
+		req := httptest.NewRequest("GET", "/KEY/uploads/hashes/"+hash, nil)
+		if status, _ := uploadHashHandler(martini.Params{"apikey": "KEY", "hash": hash}, req, httptest.NewRecorder()); status != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 Bad Request, got: %d", hash, status)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// parseDegradedPolicy parses whether requests are served ("open") or refused
+// ("closed") while redis can't be reached
+func parseDegradedPolicy(value interface{}, defaultOpen bool) (bool, error) {
+	if value == nil {
+		return defaultOpen, nil
+	}
+	switch value {
+	case "open":
+		return true, nil
+	case "closed":
+		return false, nil
+	}
+	return false, fmt.Errorf("%v (available: open, closed)", value)
+}
+
+// isReadRequest reports whether a request only reads, reads can be served
+// from the storage and the keys loaded before redis went away
+func isReadRequest(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// degradedMode refuses requests the degraded mode policy doesn't allow while
+// redis can't be reached, health checks are always answered
+func degradedMode(res http.ResponseWriter, req *http.Request) {
+	if redisAvailable() || req.URL.Path == "/healthz" || req.URL.Path == "/readyz" {
+		return
+	}
+	if isReadRequest(req) {
+		if !currentConfig().degradedReadsClosed {
+			return
+		}
+	} else if currentConfig().degradedWritesOpen {
+		return
+	}
+	res.Header().Set("Retry-After", strconv.Itoa(int(redisReconnectDelay.Seconds())))
+	http.Error(res, "Service degraded: redis unavailable", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// brokenConn is a redis connection which broke
+type brokenConn struct {
+	closed bool
+}
+
+func (c *brokenConn) Close() error { c.closed = true; return nil }
+func (c *brokenConn) Err() error   { return errors.New("connection reset") }
+func (c *brokenConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return nil, c.Err()
+}
+func (c *brokenConn) Send(commandName string, args ...interface{}) error { return c.Err() }
+func (c *brokenConn) Flush() error                                       { return c.Err() }
+func (c *brokenConn) Receive() (interface{}, error)                      { return nil, c.Err() }
+
+func TestReconnectingConn(t *testing.T) {
+	broken := &brokenConn{}
+	dialed := make(chan bool, 1)
+	c := &reconnectingConn{conn: broken, dial: func() (redis.Conn, error) {
+		select {
+		case dialed <- true:
+		default:
+		}
+		return nil, errors.New("connection refused")
+	}}
+	if _, err := c.Do("GET", "key"); err == nil || err == errRedisUnavailable {
+		t.Errorf("Expected the connection's error, got %v", err)
+	}
+	if c.available() || !broken.closed {
+		t.Errorf("Expected the broken connection to be dropped")
+	}
+	if _, err := c.Do("GET", "key"); err != errRedisUnavailable {
+		t.Errorf("Expected errRedisUnavailable, got %v", err)
+	}
+	select {
+	case <-dialed:
+	case <-time.After(2 * redisReconnectDelay):
+		t.Errorf("Expected a reconnection attempt")
+	}
+}
+
+func TestParseDegradedPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		open  bool
+	}{{nil, true}, {"open", true}, {"closed", false}} {
+		open, err := parseDegradedPolicy(tc.value, true)
+		if err != nil || open != tc.open {
+			t.Errorf("Expected %v for %v, got %v, %v", tc.open, tc.value, open, err)
+		}
+	}
+	if _, err := parseDegradedPolicy("sometimes", true); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
+
+func TestDegradedMode(t *testing.T) {
+	defer func(conn redis.Conn) { Conn = conn }(Conn)
+	Conn = &reconnectingConn{}
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{})
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/image/w_400/cat.jpg", http.StatusOK},
+		{"POST", "/upload", http.StatusServiceUnavailable},
+		{"DELETE", "/image/cat.jpg", http.StatusServiceUnavailable},
+		{"GET", "/readyz", http.StatusOK},
+	} {
+		res := httptest.NewRecorder()
+		degradedMode(res, httptest.NewRequest(tc.method, tc.path, nil))
+		if res.Code != tc.status {
+			t.Errorf("Expected %d for %s %s, got %d", tc.status, tc.method, tc.path, res.Code)
+		}
+	}
+
+	setConfig(&Configuration{degradedReadsClosed: true, degradedWritesOpen: true})
+	res := httptest.NewRecorder()
+	degradedMode(res, httptest.NewRequest("GET", "/image/w_400/cat.jpg", nil))
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected reads to be refused, got %d", res.Code)
+	}
+	res = httptest.NewRecorder()
+	degradedMode(res, httptest.NewRequest("POST", "/upload", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected writes to be served, got %d", res.Code)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strconv"
+)
+
+const (
+	// Parameter setting the density of output images in dots per inch (dpi_300)
+	parameterDPI = "dpi"
+	// JFIF keeps densities in 16 bits
+	maxDPI = 65535
+
+	metersPerInch = 0.0254
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// removeDPI removes the density parameter from a parameters string like
+// "w_400,dpi_300" and returns its value, 0 when there is none
+func removeDPI(parametersStr string) (string, int, error) {
+	rest, value := removeParameter(parametersStr, parameterDPI)
+	if value == "" {
+		return rest, 0, nil
+	}
+	dpi, err := strconv.Atoi(value)
+	if err != nil || dpi < 1 || dpi > maxDPI {
+		return rest, 0, fmt.Errorf("invalid density: %s (needs to be between 1 and %d)", value, maxDPI)
+	}
+	return rest, dpi, nil
+}
+
+// setDensity records the density of an encoded JPEG or PNG image in its
+// metadata, images in other formats are returned as they are
+func setDensity(data []byte, format string, dpi int) []byte {
+	switch format {
+	case "jpeg":
+		return setJPEGDensity(data, dpi)
+	case "png":
+		return setPNGDensity(data, dpi)
+	}
+	return data
+}
+
+// setJPEGDensity sets the density in the JFIF segment of a JPEG image, one is
+// added after the start of the image when there is none
+func setJPEGDensity(data []byte, dpi int) []byte {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return data
+	}
+	// Units (1 = dots per inch), horizontal and vertical density
+	density := []byte{1, byte(dpi >> 8), byte(dpi), byte(dpi >> 8), byte(dpi)}
+	if len(data) >= 18 && data[2] == 0xff && data[3] == 0xe0 && bytes.Equal(data[6:11], []byte("JFIF\x00")) {
+		updated := append([]byte(nil), data...)
+		copy(updated[13:18], density)
+		return updated
+	}
+
+	jfif := []byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1}
+	jfif = append(jfif, density...)
+	jfif = append(jfif, 0, 0) // No thumbnail
+	updated := make([]byte, 0, len(data)+len(jfif))
+	updated = append(updated, data[:2]...)
+	updated = append(updated, jfif...)
+	return append(updated, data[2:]...)
+}
+
+// setPNGDensity replaces the pHYs chunk of a PNG image, which keeps densities
+// in pixels per metre, or adds one after the header
+func setPNGDensity(data []byte, dpi int) []byte {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return data
+	}
+	ppm := uint32(math.Round(float64(dpi) / metersPerInch))
+	chunk := make([]byte, 8, 21)
+	binary.BigEndian.PutUint32(chunk, 9)
+	copy(chunk[4:], "pHYs")
+	chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+	chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+	chunk = append(chunk, 1) // Metres
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	updated := make([]byte, 0, len(data)+len(chunk))
+	updated = append(updated, pngSignature...)
+	for offset := len(pngSignature); offset+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		end := offset + 12 + length
+		if length < 0 || end > len(data) {
+			return data
+		}
+		switch string(data[offset+4 : offset+8]) {
+		case "pHYs":
+			// Replaced by the new one
+		case "IHDR":
+			updated = append(updated, data[offset:end]...)
+			updated = append(updated, chunk...)
+		default:
+			updated = append(updated, data[offset:end]...)
+		}
+		offset = end
+	}
+	return updated
+}
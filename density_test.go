@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestRemoveDPI(t *testing.T) {
+	rest, dpi, err := removeDPI("w_400,dpi_300")
+	if err != nil || rest != "w_400" || dpi != 300 {
+		t.Errorf("Unexpected result: %s, %d, %v", rest, dpi, err)
+	}
+	if _, dpi, err := removeDPI("w_400"); err != nil || dpi != 0 {
+		t.Errorf("Expected no density, got %d, %v", dpi, err)
+	}
+	for _, parametersStr := range []string{"w_400,dpi_0", "w_400,dpi_70000", "w_400,dpi_high"} {
+		if _, _, err := removeDPI(parametersStr); err == nil {
+			t.Errorf("Expected an error for %s", parametersStr)
+		}
+	}
+}
+
+func TestSetJPEGDensity(t *testing.T) {
+	var buffer bytes.Buffer
+	jpeg.Encode(&buffer, image.NewGray(image.Rect(0, 0, 4, 4)), nil)
+
+	// The standard library doesn't write a JFIF segment
+	updated := setDensity(buffer.Bytes(), "jpeg", 300)
+	if !bytes.Equal(updated[6:11], []byte("JFIF\x00")) || updated[13] != 1 || binary.BigEndian.Uint16(updated[14:]) != 300 || binary.BigEndian.Uint16(updated[16:]) != 300 {
+		t.Fatalf("Expected a JFIF segment with 300 dpi, got % x", updated[:20])
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(updated)); err != nil {
+		t.Errorf("Expected the image to stay valid: %s", err)
+	}
+
+	changed := setDensity(updated, "jpeg", 72)
+	if len(changed) != len(updated) || binary.BigEndian.Uint16(changed[14:]) != 72 {
+		t.Errorf("Expected the JFIF segment to be updated")
+	}
+}
+
+func TestSetPNGDensity(t *testing.T) {
+	var buffer bytes.Buffer
+	png.Encode(&buffer, image.NewGray(image.Rect(0, 0, 4, 4)))
+
+	updated := setDensity(buffer.Bytes(), "png", 300)
+	i := bytes.Index(updated, []byte("pHYs"))
+	if i == -1 || i > bytes.Index(updated, []byte("IDAT")) {
+		t.Fatal("Expected a pHYs chunk before the image data")
+	}
+	// 300 dpi = 11811 pixels per metre
+	if binary.BigEndian.Uint32(updated[i+4:]) != 11811 || binary.BigEndian.Uint32(updated[i+8:]) != 11811 || updated[i+12] != 1 {
+		t.Errorf("Unexpected pHYs chunk: % x", updated[i:i+13])
+	}
+	if _, err := png.Decode(bytes.NewReader(updated)); err != nil {
+		t.Errorf("Expected the image to stay valid: %s", err)
+	}
+
+	changed := setDensity(updated, "png", 72)
+	if len(changed) != len(updated) || bytes.Count(changed, []byte("pHYs")) != 1 {
+		t.Errorf("Expected the pHYs chunk to be replaced")
+	}
+
+	if gif := []byte("GIF89a"); !bytes.Equal(setDensity(gif, "gif", 300), gif) {
+		t.Error("Expected other formats to be left as they are")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+const defaultDerivedPrefix = "derived/"
+
+// derivedPath returns where a generated variant is persisted in the storage,
+// "" when variants aren't persisted. Variants of tenants' images are kept
+// under their prefix so that they end up in their storage.
+func derivedPath(fullImagePath string) string {
+	if currentConfig().derivedPrefix == "" {
+		return ""
+	}
+	for _, tenant := range currentConfig().tenants {
+		if strings.HasPrefix(fullImagePath, tenant.prefix) {
+			return tenant.prefix + currentConfig().derivedPrefix + strings.TrimPrefix(fullImagePath, tenant.prefix)
+		}
+	}
+	return currentConfig().derivedPrefix + fullImagePath
+}
+
+// isDerivedPath reports whether a file in the storage is a persisted variant
+func isDerivedPath(filePath string) bool {
+	if currentConfig().derivedPrefix == "" {
+		return false
+	}
+	if strings.HasPrefix(filePath, currentConfig().derivedPrefix) {
+		return true
+	}
+	for _, tenant := range currentConfig().tenants {
+		if strings.HasPrefix(filePath, tenant.prefix+currentConfig().derivedPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// persistDerived writes a generated variant back to the storage, unlike
+// cached images these aren't pruned
+func persistDerived(fullImagePath string, data []byte, format string) {
+	filePath := derivedPath(fullImagePath)
+	if filePath == "" {
+		return
+	}
+	err := storageImpl.Put(filePath, data, contentTypeFor(format))
+	if err != nil {
+		slog.Error("persisting a derived image failed", "path", filePath, "error", err)
+	}
+}
+
+// loadDerived returns a persisted variant and its format when it is at least
+// as new as its original
+func loadDerived(fullImagePath string, sourceInfo *FileInfo) ([]byte, string, bool) {
+	filePath := derivedPath(fullImagePath)
+	if filePath == "" {
+		return nil, "", false
+	}
+	info, err := storageImpl.Stat(filePath)
+	if err != nil || info.ModTime.Before(sourceInfo.ModTime) {
+		return nil, "", false
+	}
+	data, err := fetchImage(filePath)
+	if err != nil {
+		slog.Error("reading a derived image failed", "path", filePath, "error", err)
+		return nil, "", false
+	}
+	header := data
+	if len(header) > 16 {
+		header = header[:16]
+	}
+	format := sniffImageFormat(header)
+	if format == "" {
+		return nil, "", false
+	}
+	return data, format, true
+}
+
+// purgeDerived removes the persisted variants of an image
+func purgeDerived(imagePath string) {
+	i := strings.LastIndex(imagePath, ".")
+	if currentConfig().derivedPrefix == "" || i == -1 {
+		return
+	}
+	paths, err := storageImpl.List(derivedPath(imagePath[:i] + "--"))
+	if err != nil {
+		slog.Error("listing derived images failed", "image", imagePath, "error", err)
+		return
+	}
+	// Persisted variants are named like cached ones, only under the prefix
+	for _, filePath := range paths {
+		if original, ok := originalPath(filePath); !ok || original != derivedPath(imagePath) || !inCacheNamespace(filePath) {
+			continue
+		}
+		err := deleteImage(filePath)
+		if err != nil && err != ErrNotFound {
+			slog.Error("removing a derived image failed", "path", filePath, "error", err)
+		}
+	}
+}
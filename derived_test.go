@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDerivedPath(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{tenants: []*Tenant{{name: "acme", prefix: "acme/"}}})
+
+	if path := derivedPath("cat--w_100--.jpg"); path != "" {
+		t.Errorf("Expected no path when disabled, got: %s", path)
+	}
+	currentConfig().derivedPrefix = defaultDerivedPrefix
+	if path := derivedPath("photos/cat--w_100--.jpg"); path != "derived/photos/cat--w_100--.jpg" {
+		t.Errorf("Unexpected path: %s", path)
+	}
+	if path := derivedPath("acme/cat--w_100--.jpg"); path != "acme/derived/cat--w_100--.jpg" {
+		t.Errorf("Expected the tenant's prefix first, got: %s", path)
+	}
+}
+
+func TestPersistDerived(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConfig, oldStorage := currentConfig(), storageImpl
+	defer func() { setConfig(oldConfig); storageImpl = oldStorage }()
+	setConfig(&Configuration{derivedPrefix: defaultDerivedPrefix})
+	storageImpl = &tenantStorage{&localStorage{dir}}
+
+	variant := "cat--c_e,g_c,h_10,w_10,f_none,s_1--.jpg"
+	persistDerived(variant, []byte("\x89PNG\r\n\x1a\nrest"), "png")
+	persistDerived("dog--c_e,g_c,h_10,w_10,f_none,s_1--.jpg", []byte("\xff\xd8\xffrest"), "jpeg")
+
+	data, format, ok := loadDerived(variant, &FileInfo{ModTime: time.Now().Add(-time.Hour)})
+	if !ok || format != "png" || string(data[8:]) != "rest" {
+		t.Errorf("Unexpected derived image: %q %s %t", data, format, ok)
+	}
+	if _, _, ok := loadDerived(variant, &FileInfo{ModTime: time.Now().Add(time.Hour)}); ok {
+		t.Error("Expected a variant older than its original to be ignored")
+	}
+
+	purgeDerived("cat.jpg")
+	if _, err := storageImpl.Stat("derived/" + variant); err != ErrNotFound {
+		t.Errorf("Expected the variant to be purged, got: %v", err)
+	}
+	if _, err := storageImpl.Stat("derived/dog--c_e,g_c,h_10,w_10,f_none,s_1--.jpg"); err != nil {
+		t.Errorf("Expected other images' variants to be kept, got: %v", err)
+	}
+}
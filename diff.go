@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+// DiffResponse says how much two images differ
+type DiffResponse struct {
+	Status           string  `json:"status"`
+	ErrorMessage     string  `json:"errorMessage,omitempty"`
+	Width            int     `json:"width,omitempty"`
+	Height           int     `json:"height,omitempty"`
+	Resized          bool    `json:"resized,omitempty"`
+	DifferentPixels  int     `json:"differentPixels"`
+	DifferentPercent float64 `json:"differentPercent"`
+	SSIM             float64 `json:"ssim"`
+}
+
+// diffRequest is a parsed request for comparing two images
+type diffRequest struct {
+	a, b      string
+	threshold int
+	heatmap   bool
+}
+
+// parseDiffRequest reads the paths of the images (a and b) and optionally the
+// threshold (0-255) under which differences are ignored and whether to answer
+// with a heatmap (output=heatmap) of a request
+func parseDiffRequest(req *http.Request) (*diffRequest, error) {
+	query := req.URL.Query()
+	r := &diffRequest{a: query.Get("a"), b: query.Get("b")}
+	if r.a == "" || r.b == "" {
+		return nil, fmt.Errorf("the paths of both images (a and b) are needed")
+	}
+	if thresholdStr := query.Get("threshold"); thresholdStr != "" {
+		var err error
+		r.threshold, err = strconv.Atoi(thresholdStr)
+		if err != nil || r.threshold < 0 || r.threshold > 255 {
+			return nil, fmt.Errorf("invalid threshold: %s (needs to be between 0 and 255)", thresholdStr)
+		}
+	}
+	switch output := query.Get("output"); output {
+	case "", "json":
+	case "heatmap":
+		r.heatmap = true
+	default:
+		return nil, fmt.Errorf("invalid output: %s (available: json, heatmap)", output)
+	}
+	return r, nil
+}
+
+// matchSize resizes b to the size of a when they differ
+func matchSize(a, b image.Image) (image.Image, bool) {
+	size := a.Bounds().Size()
+	if b.Bounds().Size() == size {
+		return b, false
+	}
+	return engine.Transform(b, engine.Params{Width: size.X, Height: size.Y, Scale: 1, Cropping: engine.CroppingModeExact, Gravity: engine.DefaultGravity, Filter: engine.DefaultFilter}), true
+}
+
+// diffImages compares two images, the second one is resized to the size of
+// the first when they differ
+func diffImages(a, b image.Image, threshold int) (DiffResponse, error) {
+	size := a.Bounds().Size()
+	b, resized := matchSize(a, b)
+	comparison, err := engine.Compare(a, b, threshold)
+	if err != nil {
+		return DiffResponse{}, err
+	}
+	return DiffResponse{
+		Status:           "ok",
+		Width:            size.X,
+		Height:           size.Y,
+		Resized:          resized,
+		DifferentPixels:  comparison.DifferentPixels,
+		DifferentPercent: 100 * float64(comparison.DifferentPixels) / float64(size.X*size.Y),
+		SSIM:             comparison.SSIM,
+	}, nil
+}
+
+// diffHandler compares two stored images, answering with JSON metrics or a
+// heatmap of the differences
+func diffHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Heatmaps are written to the response by serveDiff itself
+	status, body := serveDiff(params, req, res)
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// serveDiff compares two stored images, it returns 0 when it wrote a heatmap
+// to the response itself
+func serveDiff(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, ReadPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, DiffResponse{Status: "error", ErrorMessage: "API key invalid or missing"})
+	}
+	r, err := parseDiffRequest(req)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, DiffResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+
+	tenant := tenantFor(req)
+	images := make([]image.Image, 2)
+	for i, requestedPath := range []string{r.a, r.b} {
+		imagePath, err := tenant.storagePath(requestedPath)
+		if err == nil {
+			images[i], err = loadStoredImage(imagePath)
+		}
+		if err == ErrNotFound || err == errTenantImageNotFound {
+			return jsonResponse(res, http.StatusNotFound, DiffResponse{Status: "error", ErrorMessage: "Image not found: " + requestedPath})
+		}
+		if err != nil {
+			return jsonResponse(res, iiifErrorStatus(err), DiffResponse{Status: "error", ErrorMessage: err.Error()})
+		}
+	}
+
+	err = processingPool.acquire(req.Context())
+	if err != nil {
+		res.Header().Set("Retry-After", strconv.Itoa(currentConfig().processingRetryAfter))
+		return jsonResponse(res, currentConfig().processingOverloadStatus, DiffResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+	defer processingPool.release()
+
+	if !r.heatmap {
+		diff, err := diffImages(images[0], images[1], r.threshold)
+		if err != nil {
+			return jsonResponse(res, http.StatusInternalServerError, DiffResponse{Status: "error", ErrorMessage: err.Error()})
+		}
+		return jsonResponse(res, http.StatusOK, diff)
+	}
+
+	b, _ := matchSize(images[0], images[1])
+	heatmap, err := engine.Heatmap(images[0], b)
+	if err != nil {
+		return jsonResponse(res, http.StatusInternalServerError, DiffResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+	buffer := getEncodeBuffer()
+	defer putEncodeBuffer(buffer)
+	err = writeImage(heatmap, "png", buffer)
+	if err != nil {
+		slog.Error("encoding a heatmap failed", "error", err)
+		return jsonResponse(res, http.StatusInternalServerError, DiffResponse{Status: "error", ErrorMessage: "server error"})
+	}
+	res.Header().Set("Cache-Control", "no-store")
+	return respondWithImage(res, req, buffer.Bytes(), time.Time{})
+}
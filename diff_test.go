@@ -0,0 +1,52 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseDiffRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "/diff?a=renders/old.png&b=renders/new.png&threshold=8&output=heatmap", nil)
+	r, err := parseDiffRequest(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r.a != "renders/old.png" || r.b != "renders/new.png" || r.threshold != 8 || !r.heatmap {
+		t.Errorf("Unexpected request: %+v", r)
+	}
+
+	for _, query := range []string{"a=old.png", "b=new.png", "a=old.png&b=new.png&threshold=256", "a=old.png&b=new.png&threshold=x", "a=old.png&b=new.png&output=gif"} {
+		req := httptest.NewRequest("GET", "/diff?"+query, nil)
+		if _, err := parseDiffRequest(req); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestDiffImages(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	b := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for _, x := range []int{0, 1, 2, 3, 4} {
+		b.SetRGBA(x, 0, color.RGBA{255, 255, 255, 255})
+	}
+	diff, err := diffImages(a, b, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if diff.Status != "ok" || diff.Width != 10 || diff.Height != 10 || diff.Resized || diff.DifferentPixels != 5 || diff.DifferentPercent != 5 {
+		t.Errorf("Unexpected diff: %+v", diff)
+	}
+	if diff.SSIM >= 1 {
+		t.Errorf("Expected an SSIM below 1, got: %f", diff.SSIM)
+	}
+
+	diff, err = diffImages(a, image.NewRGBA(image.Rect(0, 0, 20, 5)), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !diff.Resized || diff.DifferentPixels != 0 {
+		t.Errorf("Expected a resized and identical image, got: %+v", diff)
+	}
+}
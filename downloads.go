@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	downloadSigningSecretEnvVar = "PIXLSERV_DOWNLOAD_SIGNING_SECRET"
+
+	// Originals are downloaded from /download/PATH?e=EXPIRES&filename=NAME&s=SIGNATURE
+	downloadPath = "/download/"
+
+	defaultDownloadExpiry    = 3600      // Seconds
+	defaultDownloadMaxExpiry = 7 * 86400 // Seconds
+)
+
+var downloadSigningSecret string
+
+// downloadsInit loads the secret used to sign download URLs when downloads
+// are enabled
+func downloadsInit() error {
+	downloadSigningSecret = os.Getenv(downloadSigningSecretEnvVar)
+	return checkDownloads(currentConfig())
+}
+
+// checkDownloads makes sure there is a secret when a configuration enables
+// downloads
+func checkDownloads(c *Configuration) error {
+	if c.downloads && downloadSigningSecret == "" {
+		return fmt.Errorf("%s not set", downloadSigningSecretEnvVar)
+	}
+	return nil
+}
+
+// DownloadResponse is a struct to represent a JSON response for the download
+// URL handler
+type DownloadResponse struct {
+	Status       string     `json:"status"`
+	ErrorMessage string     `json:"errorMessage,omitempty"`
+	URL          string     `json:"url,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+}
+
+// downloadSignature computes the signature of a download URL, it covers the
+// path of the original (in the storage), the expiry and the file name
+func downloadSignature(imagePath string, expires int64, filename, secret string) string {
+	return hex.EncodeToString(hmacSHA256([]byte(secret), "download\n"+imagePath+"\n"+strconv.FormatInt(expires, 10)+"\n"+filename))
+}
+
+// downloadURL returns a URL an original can be downloaded from until expires
+// (a Unix timestamp), under the given file name or its own when it's ""
+func downloadURL(baseURL, imagePath, filename string, expires int64, secret string) string {
+	segments := strings.Split(imagePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	query := url.Values{}
+	query.Set(parameterExpires, strconv.FormatInt(expires, 10))
+	if filename != "" {
+		query.Set("filename", filename)
+	}
+	query.Set(parameterSignature, downloadSignature(imagePath, expires, filename, secret))
+	return strings.TrimSuffix(baseURL, "/") + downloadPath + strings.Join(segments, "/") + "?" + query.Encode()
+}
+
+// verifyDownloadURL checks the signature and the expiry of a download URL,
+// it returns when the URL expires
+func verifyDownloadURL(imagePath string, query url.Values, secret string, now time.Time) (time.Time, error) {
+	expires, err := strconv.ParseInt(query.Get(parameterExpires), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("missing expiry")
+	}
+	signature, err := hex.DecodeString(query.Get(parameterSignature))
+	if err != nil || len(signature) == 0 {
+		return time.Time{}, fmt.Errorf("invalid signature")
+	}
+	expected, _ := hex.DecodeString(downloadSignature(imagePath, expires, query.Get("filename"), secret))
+	if !hmac.Equal(signature, expected) {
+		return time.Time{}, fmt.Errorf("invalid signature")
+	}
+	if now.Unix() > expires {
+		return time.Time{}, fmt.Errorf("URL expired")
+	}
+	return time.Unix(expires, 0), nil
+}
+
+// downloadCreateHandler mints an expiring download URL for an original, keys
+// which can upload originals can share them
+func downloadCreateHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, WritePermission) {
+		return jsonResponse(res, http.StatusUnauthorized, DownloadResponse{"error", "API key invalid or missing", "", nil})
+	}
+
+	imagePath, err := tenantFor(req).storagePath(req.FormValue("path"))
+	if err != nil || req.FormValue("path") == "" {
+		return jsonResponse(res, http.StatusBadRequest, DownloadResponse{"error", "invalid path", "", nil})
+	}
+	setAuditTarget(req, imagePath)
+	expiresIn := currentConfig().downloadExpiry
+	if expiresInStr := req.FormValue("expires-in"); expiresInStr != "" {
+		expiresIn, err = strconv.Atoi(expiresInStr)
+		if err != nil || expiresIn <= 0 || expiresIn > currentConfig().downloadMaxExpiry {
+			return jsonResponse(res, http.StatusBadRequest, DownloadResponse{"error", fmt.Sprintf("expires-in needs to be between 1 and %d seconds", currentConfig().downloadMaxExpiry), "", nil})
+		}
+	}
+	filename := ""
+	if requested := req.FormValue("filename"); requested != "" {
+		filename = downloadFilename(requested, imagePath)
+	}
+
+	_, err = storageImpl.Stat(imagePath)
+	if err == ErrNotFound {
+		return jsonResponse(res, http.StatusNotFound, DownloadResponse{"error", "Image not found: " + req.FormValue("path"), "", nil})
+	}
+	if err != nil {
+		return jsonResponse(res, http.StatusInternalServerError, DownloadResponse{"error", err.Error(), "", nil})
+	}
+
+	expires := time.Now().Add(time.Duration(expiresIn) * time.Second).Truncate(time.Second)
+	return jsonResponse(res, http.StatusOK, DownloadResponse{"ok", "", downloadURL(currentConfig().downloadBaseURL, imagePath, filename, expires.Unix(), downloadSigningSecret), &expires})
+}
+
+// downloadHandler serves an original through a signed download URL as an
+// attachment, whether or not originals are served otherwise
+func downloadHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	imagePath := params["_1"]
+	query := req.URL.Query()
+	expires, err := verifyDownloadURL(imagePath, query, downloadSigningSecret, time.Now())
+	if err != nil {
+		return http.StatusForbidden, fmt.Sprintf("Invalid URL: %s", err)
+	}
+
+	filename := query.Get("filename")
+	if filename == "" {
+		filename = imagePath
+	}
+	setContentDisposition(res, downloadFilename(filename, imagePath))
+	// Shared caches would keep serving the original after the URL expired
+	maxAge := int(time.Until(expires).Seconds())
+	return streamStoredOriginal(res, req, imagePath, fmt.Sprintf("private, max-age=%d", maxAge))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestDownloadURL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	downloadURLStr := downloadURL("https://images.example.com/", "photos/a cat.jpg", "Cat.jpg", now.Unix()+60, "secret")
+	u, err := url.Parse(downloadURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(downloadURLStr, "https://images.example.com/download/photos/a%20cat.jpg?") || u.Query().Get("filename") != "Cat.jpg" {
+		t.Errorf("Unexpected URL: %s", downloadURLStr)
+	}
+
+	expires, err := verifyDownloadURL("photos/a cat.jpg", u.Query(), "secret", now)
+	if err != nil || expires.Unix() != now.Unix()+60 {
+		t.Errorf("Expected the URL to be valid, got: %v, %v", expires, err)
+	}
+	if _, err := verifyDownloadURL("photos/a cat.jpg", u.Query(), "secret", now.Add(2*time.Minute)); err == nil || err.Error() != "URL expired" {
+		t.Errorf("Expected the URL to have expired, got: %v", err)
+	}
+	if _, err := verifyDownloadURL("photos/dog.jpg", u.Query(), "secret", now); err == nil {
+		t.Error("Expected the signature not to cover other paths")
+	}
+	if _, err := verifyDownloadURL("photos/a cat.jpg", u.Query(), "other", now); err == nil {
+		t.Error("Expected the signature not to match other secrets")
+	}
+	tampered := u.Query()
+	tampered.Set("filename", "Dog.jpg")
+	if _, err := verifyDownloadURL("photos/a cat.jpg", tampered, "secret", now); err == nil {
+		t.Error("Expected the signature to cover the file name")
+	}
+	tampered = u.Query()
+	tampered.Set("e", "1800000000")
+	if _, err := verifyDownloadURL("photos/a cat.jpg", tampered, "secret", now); err == nil {
+		t.Error("Expected the signature to cover the expiry")
+	}
+}
+
+func TestDownloadHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("\x89PNG\r\n\x1a\noriginal")
+	if err := ioutil.WriteFile(filepath.Join(dir, "cat.png"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig, oldStorage, oldSecret := currentConfig(), storageImpl, downloadSigningSecret
+	defer func() { setConfig(oldConfig); storageImpl, downloadSigningSecret = oldStorage, oldSecret }()
+	setConfig(&Configuration{downloads: true})
+	storageImpl = &localStorage{dir}
+	downloadSigningSecret = "secret"
+
+	target := downloadURL("", "cat.png", "", time.Now().Unix()+60, "secret")
+	res := httptest.NewRecorder()
+	downloadHandler(martini.Params{"_1": "cat.png"}, httptest.NewRequest("GET", target, nil), res)
+	if res.Code != http.StatusOK || res.Body.String() != string(data) {
+		t.Errorf("Unexpected response: %d %q", res.Code, res.Body.String())
+	}
+	if disposition := res.Header().Get("Content-Disposition"); disposition != `attachment; filename=cat.png` {
+		t.Errorf("Unexpected Content-Disposition: %s", disposition)
+	}
+	if cacheControl := res.Header().Get("Cache-Control"); !strings.HasPrefix(cacheControl, "private, max-age=") {
+		t.Errorf("Unexpected Cache-Control: %s", cacheControl)
+	}
+
+	target = downloadURL("", "cat.png", "", time.Now().Unix()-60, "secret")
+	if status, _ := downloadHandler(martini.Params{"_1": "cat.png"}, httptest.NewRequest("GET", target, nil), httptest.NewRecorder()); status != http.StatusForbidden {
+		t.Errorf("Expected 403 Forbidden for expired URLs, got: %d", status)
+	}
+}
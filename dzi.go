@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+const (
+	dziNamespace = "http://schemas.microsoft.com/deepzoom/2008"
+
+	// Cached Deep Zoom tiles are named like cat--dzi_HASH--.jpg
+	dziCachePrefix = "dzi_"
+
+	defaultDZITileSize = 254
+	defaultDZIOverlap  = 1
+	defaultDZIFormat   = "jpg"
+)
+
+// Tiles are requested like /dzi/cat.jpg_files/12/3_4.jpg
+var dziTileRe = regexp.MustCompile(`^(.+)_files/([0-9]+)/([0-9]+)_([0-9]+)\.(\w+)$`)
+
+// dziImage is the descriptor of a Deep Zoom image
+type dziImage struct {
+	XMLName  xml.Name `xml:"Image"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	TileSize int      `xml:"TileSize,attr"`
+	Overlap  int      `xml:"Overlap,attr"`
+	Format   string   `xml:"Format,attr"`
+	Size     struct {
+		Width  int `xml:"Width,attr"`
+		Height int `xml:"Height,attr"`
+	}
+}
+
+// dziTile is a parsed request for a tile of a Deep Zoom image
+type dziTile struct {
+	identifier         string
+	level, column, row int
+	format             string
+}
+
+func parseDZITile(path string) (*dziTile, error) {
+	matches := dziTileRe.FindStringSubmatch(path)
+	if matches == nil {
+		return nil, iiifRequestError("invalid tile: " + path)
+	}
+	t := &dziTile{identifier: matches[1], format: matches[5]}
+	for i, value := range []*int{&t.level, &t.column, &t.row} {
+		var err error
+		*value, err = strconv.Atoi(matches[i+2])
+		if err != nil {
+			return nil, iiifRequestError("invalid tile: " + path)
+		}
+	}
+	if t.format != currentConfig().dziFormat {
+		return nil, iiifRequestError("tiles are served as " + currentConfig().dziFormat)
+	}
+	return t, nil
+}
+
+// cachePath returns the name the tile is cached under, it is found among the
+// cached variants of the original when purging
+func (t *dziTile) cachePath() (string, error) {
+	i := strings.LastIndex(t.identifier, ".")
+	if i == -1 {
+		return "", iiifRequestError("invalid identifier")
+	}
+	key := fmt.Sprintf("%d/%d_%d.%s/%d/%d", t.level, t.column, t.row, t.format, currentConfig().dziTileSize, currentConfig().dziOverlap)
+	sum := sha1.Sum([]byte(key))
+	return t.identifier[:i] + "--" + dziCachePrefix + hex.EncodeToString(sum[:]) + cacheNamespaceSuffix(currentConfig().cacheNamespace) + "--" + t.identifier[i:], nil
+}
+
+// dziMaxLevel returns the level at which an image has its full size, the
+// image is halved for each level below down to 1x1 at level 0
+func dziMaxLevel(width, height int) int {
+	side := width
+	if height > side {
+		side = height
+	}
+	return int(math.Ceil(math.Log2(float64(side))))
+}
+
+// geometry works out which part of an original of the given size a tile
+// shows and the size of the tile. Tiles overlap their neighbours by the
+// configured number of pixels.
+func (t *dziTile) geometry(width, height int) (engine.Geometry, error) {
+	maxLevel := dziMaxLevel(width, height)
+	if t.level > maxLevel {
+		return engine.Geometry{}, iiifRequestError("level out of range")
+	}
+	scale := math.Pow(2, float64(t.level-maxLevel))
+	levelWidth := int(math.Ceil(float64(width) * scale))
+	levelHeight := int(math.Ceil(float64(height) * scale))
+
+	tileSize, overlap := currentConfig().dziTileSize, currentConfig().dziOverlap
+	x, y := t.column*tileSize, t.row*tileSize
+	if x >= levelWidth || y >= levelHeight {
+		return engine.Geometry{}, iiifRequestError("tile out of range")
+	}
+	tile := image.Rect(x-overlap, y-overlap, x+tileSize+overlap, y+tileSize+overlap).Intersect(image.Rect(0, 0, levelWidth, levelHeight))
+
+	region := image.Rect(
+		int(math.Floor(float64(tile.Min.X)/scale)),
+		int(math.Floor(float64(tile.Min.Y)/scale)),
+		int(math.Ceil(float64(tile.Max.X)/scale)),
+		int(math.Ceil(float64(tile.Max.Y)/scale)),
+	).Intersect(image.Rect(0, 0, width, height))
+	return engine.Geometry{Crop: region, Width: tile.Dx(), Height: tile.Dy()}, nil
+}
+
+func dziHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Tiles are written to the response by serveDZI itself
+	status, body := serveDZI(params, req, res)
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// serveDZI answers requests for Deep Zoom descriptors (cat.jpg.dzi) and
+// their tiles, which are generated when first requested and cached
+func serveDZI(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, ReadPermission) {
+		return http.StatusUnauthorized, ""
+	}
+	// Viewers load images from other origins
+	if res.Header().Get("Access-Control-Allow-Origin") == "" {
+		res.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	if status, body, answered := checkHotlink(req, res); answered {
+		return status, body
+	}
+
+	tenant := tenantFor(req)
+	path := params["_1"]
+	if strings.HasSuffix(path, ".dzi") {
+		identifier := strings.TrimSuffix(path, ".dzi")
+		imagePath, err := tenant.storagePath(identifier)
+		if err != nil {
+			return http.StatusNotFound, "Image not found: " + identifier
+		}
+		return serveDZIDescriptor(res, imagePath)
+	}
+
+	t, err := parseDZITile(path)
+	if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	requestedPath := t.identifier
+	t.identifier, err = tenant.storagePath(requestedPath)
+	if err != nil {
+		return http.StatusNotFound, "Image not found: " + requestedPath
+	}
+	fullImagePath, err := t.cachePath()
+	if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	return serveRegionImage(params, req, res, t.identifier, fullImagePath, dziErrorStatus, func(ctx context.Context) (*generatedImage, error) {
+		return generateDZITile(ctx, fullImagePath, t)
+	})
+}
+
+// dziErrorStatus returns the status code a failed tile request is answered
+// with, viewers treat tiles outside of the image like missing ones
+func dziErrorStatus(err error) int {
+	if _, ok := err.(iiifRequestError); ok {
+		return http.StatusNotFound
+	}
+	return iiifErrorStatus(err)
+}
+
+func generateDZITile(ctx context.Context, fullImagePath string, t *dziTile) (*generatedImage, error) {
+	return generateRegionImage(ctx, fullImagePath, t.identifier, iiifFormats[t.format], engine.DefaultFilter, t.geometry)
+}
+
+// serveDZIDescriptor answers with the XML describing a Deep Zoom image
+func serveDZIDescriptor(res http.ResponseWriter, identifier string) (int, string) {
+	if isKnownMissing(identifier) {
+		return http.StatusNotFound, "Image not found: " + identifier
+	}
+	source, err := sourceMetadata(identifier)
+	if err == ErrNotFound {
+		rememberMissing(identifier)
+		return http.StatusNotFound, "Image not found: " + identifier
+	}
+	if err != nil {
+		return iiifErrorStatus(err), err.Error()
+	}
+
+	descriptor := dziImage{Xmlns: dziNamespace, TileSize: currentConfig().dziTileSize, Overlap: currentConfig().dziOverlap, Format: currentConfig().dziFormat}
+	descriptor.Size.Width, descriptor.Size.Height = source.Width, source.Height
+	body, err := xml.Marshal(descriptor)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	res.Header().Set("Content-Type", "application/xml")
+	return http.StatusOK, xml.Header + string(body)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseDZITile(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{dziTileSize: defaultDZITileSize, dziOverlap: defaultDZIOverlap, dziFormat: defaultDZIFormat})
+
+	tile, err := parseDZITile("photos/cat.jpg_files/12/3_4.jpg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if tile.identifier != "photos/cat.jpg" || tile.level != 12 || tile.column != 3 || tile.row != 4 {
+		t.Errorf("Unexpected tile: %+v", tile)
+	}
+	path, _ := tile.cachePath()
+	if matches := cachedPathRe.FindStringSubmatch(path); matches == nil || matches[1]+matches[2] != "photos/cat.jpg" {
+		t.Errorf("Expected the cache path to be recognised as a variant of the original, got: %s", path)
+	}
+
+	for _, path := range []string{"cat.jpg_files/12/3_4.png", "cat.jpg_files/x/3_4.jpg", "cat.jpg/12/3_4.jpg"} {
+		if _, err := parseDZITile(path); err == nil {
+			t.Errorf("Expected an error for %s", path)
+		}
+	}
+}
+
+func TestDZITileGeometry(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{dziTileSize: 254, dziOverlap: 1, dziFormat: "jpg"})
+
+	// 1000x600 has levels 0 to 10
+	if level := dziMaxLevel(1000, 600); level != 10 {
+		t.Errorf("Expected a max. level of 10, got: %d", level)
+	}
+
+	cases := []struct {
+		level, column, row int
+		geometry           string
+	}{
+		// Full size, the first tile overlaps on the right and bottom only
+		{10, 0, 0, "(0,0)-(255,255) 255x255"},
+		{10, 1, 1, "(253,253)-(509,509) 256x256"},
+		// The last tiles are cut off by the image
+		{10, 3, 2, "(761,507)-(1000,600) 239x93"},
+		// Half size, tiles cover twice as many pixels of the original
+		{9, 1, 0, "(506,0)-(1000,510) 247x255"},
+		{0, 0, 0, "(0,0)-(1000,600) 1x1"},
+	}
+	for _, c := range cases {
+		tile := &dziTile{level: c.level, column: c.column, row: c.row}
+		geometry, err := tile.geometry(1000, 600)
+		if err != nil {
+			t.Errorf("%d/%d_%d: unexpected error: %s", c.level, c.column, c.row, err)
+			continue
+		}
+		actual := fmt.Sprintf("%v %dx%d", geometry.Crop, geometry.Width, geometry.Height)
+		if actual != c.geometry {
+			t.Errorf("%d/%d_%d: expected %s, got: %s", c.level, c.column, c.row, c.geometry, actual)
+		}
+	}
+
+	for _, tile := range []*dziTile{{level: 11}, {level: 10, column: 4}, {level: 9, row: 2}} {
+		if _, err := tile.geometry(1000, 600); dziErrorStatus(err) != 404 {
+			t.Errorf("Expected tile %+v to be missing, got: %v", tile, err)
+		}
+	}
+}
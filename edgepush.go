@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// Variants waiting to be pushed to each edge store, new ones aren't pushed
+// while a store's queue is full
+const edgePushQueueSize = 1000
+
+// Pushers of all configured edge stores
+var edgePushers []*edgePusher
+
+// edgeTarget is a store in another region new variants are pushed to,
+// either an S3 bucket or an rsync destination
+type edgeTarget struct {
+	s3Bucket, s3Region, s3Endpoint string
+	s3PathStyle                    bool
+	rsync                          string
+}
+
+// edgeStore puts variants in a store in another region
+type edgeStore interface {
+	// Name of the store for logging
+	name() string
+	push(ctx context.Context, filePath string, data []byte, contentType string) error
+}
+
+// edgePusher pushes variants to a store one at a time, in the background
+type edgePusher struct {
+	edgeStore
+	queue chan edgePush
+}
+
+type edgePush struct {
+	path, contentType string
+	data              []byte
+}
+
+// parseEdgePush reads the edge-push section of the configuration
+func parseEdgePush(m map[interface{}]interface{}, conf *Configuration) error {
+	conf.edgePushTimeout = defaultEdgePushTimeout
+	timeout, ok := m["timeout"].(int)
+	if ok && timeout > 0 {
+		conf.edgePushTimeout = timeout
+	}
+
+	targets, _ := m["targets"].([]interface{})
+	if len(targets) == 0 {
+		return fmt.Errorf("invalid edge-push: no targets")
+	}
+	for _, value := range targets {
+		settings, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("invalid edge-push target: %v", value)
+		}
+		target := &edgeTarget{}
+		target.s3Bucket, _ = settings["s3"].(string)
+		target.s3Region, _ = settings["region"].(string)
+		target.s3Endpoint, _ = settings["endpoint"].(string)
+		target.s3PathStyle, _ = settings["path-style"].(bool)
+		target.rsync, _ = settings["rsync"].(string)
+		if (target.s3Bucket == "") == (target.rsync == "") {
+			return fmt.Errorf("invalid edge-push target: %v (needs either s3 or rsync)", value)
+		}
+		if target.s3Bucket != "" {
+			if _, err := s3RegionFor(target.s3Region, target.s3Endpoint, target.s3PathStyle); err != nil {
+				return fmt.Errorf("invalid edge-push target %s: %s", target.s3Bucket, err)
+			}
+		}
+		conf.edgePushTargets = append(conf.edgePushTargets, target)
+	}
+	return nil
+}
+
+// edgePushInit sets up pushing to all edge stores in the configuration
+func edgePushInit() error {
+	edgePushers = nil
+	for _, target := range currentConfig().edgePushTargets {
+		store, err := target.store()
+		if err != nil {
+			return err
+		}
+		pusher := &edgePusher{store, make(chan edgePush, edgePushQueueSize)}
+		go pusher.run()
+		edgePushers = append(edgePushers, pusher)
+		slog.Info("pushing variants to an edge store", "store", store.name())
+	}
+	return nil
+}
+
+// store connects to the target
+func (t *edgeTarget) store() (edgeStore, error) {
+	if t.rsync != "" {
+		command, err := exec.LookPath("rsync")
+		if err != nil {
+			return nil, fmt.Errorf("edge-push to %s: %s", t.rsync, err)
+		}
+		return &rsyncEdgeStore{command, t.rsync}, nil
+	}
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		return nil, fmt.Errorf("edge-push to %s: %s", t.s3Bucket, err)
+	}
+	region, err := s3RegionFor(t.s3Region, t.s3Endpoint, t.s3PathStyle)
+	if err != nil {
+		return nil, fmt.Errorf("edge-push to %s: %s", t.s3Bucket, err)
+	}
+	timeout := time.Duration(currentConfig().edgePushTimeout) * time.Millisecond
+	return &s3EdgeStore{newS3(auth, region, false, timeout).Bucket(t.s3Bucket)}, nil
+}
+
+// edgePath returns where a variant is put in edge stores, where servers in
+// their region with derived-images find it
+func edgePath(fullImagePath string) string {
+	if filePath := derivedPath(fullImagePath); filePath != "" {
+		return filePath
+	}
+	return defaultDerivedPrefix + fullImagePath
+}
+
+// pushToEdges queues a newly generated variant to be pushed to the edge
+// stores, requests never wait for it
+func pushToEdges(fullImagePath string, data []byte, format string) {
+	if len(edgePushers) == 0 {
+		return
+	}
+	push := edgePush{edgePath(fullImagePath), contentTypeFor(format), data}
+	for _, pusher := range edgePushers {
+		select {
+		case pusher.queue <- push:
+		default:
+			slog.Warn("edge push queue full, variant not pushed", "store", pusher.name(), "path", push.path)
+		}
+	}
+}
+
+func (p *edgePusher) run() {
+	for push := range p.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(currentConfig().edgePushTimeout)*time.Millisecond)
+		err := p.push(ctx, push.path, push.data, push.contentType)
+		cancel()
+		if err != nil {
+			slog.Error("pushing a variant to an edge store failed", "store", p.name(), "path", push.path, "error", err)
+		}
+	}
+}
+
+// s3EdgeStore pushes variants to an S3 bucket, usually in another region
+type s3EdgeStore struct {
+	bucket *s3.Bucket
+}
+
+func (s *s3EdgeStore) name() string {
+	return "s3:" + s.bucket.Name
+}
+
+// push can't be cancelled by ctx, the bucket's HTTP client gives pushes up
+// after the edge-push timeout instead
+func (s *s3EdgeStore) push(ctx context.Context, filePath string, data []byte, contentType string) error {
+	return s.bucket.Put(filePath, data, contentType, s3.Private)
+}
+
+// rsyncEdgeStore pushes variants to an rsync destination like
+// host:/srv/pixlserv/images, directories are created as needed
+type rsyncEdgeStore struct {
+	command, destination string
+}
+
+func (s *rsyncEdgeStore) name() string {
+	return "rsync:" + s.destination
+}
+
+func (s *rsyncEdgeStore) push(ctx context.Context, filePath string, data []byte, contentType string) error {
+	dir, err := ioutil.TempDir("", "pixlserv-edge")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, filepath.FromSlash(filePath))
+	err = os.MkdirAll(filepath.Dir(local), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(local, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	// With --relative the path after /./ is kept at the destination
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command, "--relative", "--times", dir+"/./"+filePath, s.destination)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingEdgeStore is an edge store remembering what was pushed to it
+type recordingEdgeStore struct {
+	pushed chan edgePush
+}
+
+func (s *recordingEdgeStore) name() string { return "recording" }
+func (s *recordingEdgeStore) push(ctx context.Context, filePath string, data []byte, contentType string) error {
+	s.pushed <- edgePush{filePath, contentType, data}
+	return nil
+}
+
+func TestParseEdgePush(t *testing.T) {
+	conf := &Configuration{}
+	err := parseEdgePush(map[interface{}]interface{}{"targets": []interface{}{
+		map[interface{}]interface{}{"s3": "pixlserv-us", "region": "us-east-1"},
+		map[interface{}]interface{}{"rsync": "pixlserv@ap.example.com:/srv/images"},
+	}}, conf)
+	if err != nil || len(conf.edgePushTargets) != 2 || conf.edgePushTimeout != defaultEdgePushTimeout {
+		t.Fatalf("Unexpected edge-push settings: %+v, %v", conf.edgePushTargets, err)
+	}
+	if conf.edgePushTargets[0].s3Bucket != "pixlserv-us" || conf.edgePushTargets[1].rsync != "pixlserv@ap.example.com:/srv/images" {
+		t.Errorf("Unexpected targets: %+v %+v", conf.edgePushTargets[0], conf.edgePushTargets[1])
+	}
+
+	invalid := []map[interface{}]interface{}{
+		{},
+		{"targets": []interface{}{map[interface{}]interface{}{"region": "us-east-1"}}},
+		{"targets": []interface{}{map[interface{}]interface{}{"s3": "pixlserv-us", "rsync": "host:/srv"}}},
+		{"targets": []interface{}{map[interface{}]interface{}{"s3": "pixlserv-us", "region": "moon-1"}}},
+	}
+	for _, m := range invalid {
+		if err := parseEdgePush(m, &Configuration{}); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
+
+func TestPushToEdges(t *testing.T) {
+	oldConfig, oldPushers := currentConfig(), edgePushers
+	defer func() { setConfig(oldConfig); edgePushers = oldPushers }()
+	setConfig(&Configuration{edgePushTimeout: defaultEdgePushTimeout})
+	store := &recordingEdgeStore{make(chan edgePush, 1)}
+	pusher := &edgePusher{store, make(chan edgePush, 1)}
+	edgePushers = []*edgePusher{pusher}
+
+	pushToEdges("cat--w_100--.jpg", []byte("variant"), "jpeg")
+	// The queue is full, the variant isn't waited for
+	pushToEdges("dog--w_100--.jpg", []byte("variant"), "jpeg")
+	go pusher.run()
+	defer close(pusher.queue)
+
+	select {
+	case push := <-store.pushed:
+		if push.path != "derived/cat--w_100--.jpg" || push.contentType != "image/jpeg" || string(push.data) != "variant" {
+			t.Errorf("Unexpected push: %+v", push)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the variant to be pushed")
+	}
+	select {
+	case push := <-store.pushed:
+		t.Errorf("Expected variants over the queue size to be dropped, got %s", push.path)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestS3EdgeStoreTimeout(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{edgePushTimeout: 500})
+	t.Setenv(awsKeyEnvVar, "AKIDEXAMPLE")
+	t.Setenv(awsSecretEnvVar, "secret")
+
+	store, err := (&edgeTarget{s3Bucket: "pixlserv-us", s3Region: "us-east-1"}).store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout := store.(*s3EdgeStore).bucket.HTTPClient().Timeout; timeout != 500*time.Millisecond {
+		t.Errorf("Expected pushes to be given up after 500ms, got %s", timeout)
+	}
+}
+
+func TestRsyncEdgeStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Records its arguments and copies the file it's given
+	command := filepath.Join(dir, "rsync")
+	script := "#!/bin/sh\necho \"$@\" > " + dir + "/args\ncp \"$3\" \"$4/pushed\"\n"
+	err = ioutil.WriteFile(command, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &rsyncEdgeStore{command, dir}
+	err = store.push(context.Background(), "derived/photos/cat--w_100--.jpg", []byte("variant"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed, _ := ioutil.ReadFile(filepath.Join(dir, "pushed"))
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if string(pushed) != "variant" || !strings.Contains(string(args), "/./derived/photos/cat--w_100--.jpg "+dir) {
+		t.Errorf("Unexpected push: %q with %s", pushed, args)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/jpegenc"
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Max. number of encoder settings compared in one request
+	maxComparedEncoders = 20
+	// Max. size of an encoder comparison request's body in bytes
+	maxEncoderComparisonRequestSize = 64 * 1024
+
+	encoderGo      = "go"
+	encoderCommand = "command"
+)
+
+// EncoderComparisonRequest asks for an image transformed as its parameters
+// say to be encoded with each of the encoder settings
+type EncoderComparisonRequest struct {
+	Image      string            `json:"image"`
+	Parameters string            `json:"parameters"`
+	Encoders   []EncoderSettings `json:"encoders"`
+}
+
+// EncoderSettings selects an encoder and its options, options which aren't
+// set are taken from the configuration
+type EncoderSettings struct {
+	Format      string `json:"format"`                // jpeg or png
+	Encoder     string `json:"encoder,omitempty"`     // JPEG: go or command (jpeg-encoder)
+	Quality     int    `json:"quality,omitempty"`     // JPEG
+	Subsampling string `json:"subsampling,omitempty"` // JPEG: 444 or 420
+	Colors      int    `json:"colors,omitempty"`      // PNG palette size, 0 keeps the colors
+	Dither      *bool  `json:"dither,omitempty"`      // PNG
+	Compression string `json:"compression,omitempty"` // PNG
+}
+
+// EncoderResult is the outcome of encoding the image with one of the settings
+type EncoderResult struct {
+	EncoderSettings
+	Status       string  `json:"status"`
+	ErrorMessage string  `json:"errorMessage,omitempty"`
+	Bytes        int     `json:"bytes,omitempty"`
+	EncodeMillis float64 `json:"encodeMillis,omitempty"`
+	SSIM         float64 `json:"ssim,omitempty"` // Of the decoded result and the transformed image before encoding
+}
+
+// EncoderComparisonResponse is a struct to represent a JSON response for the
+// encoder comparison handler, results are in the order of the settings
+type EncoderComparisonResponse struct {
+	Status       string          `json:"status"`
+	ErrorMessage string          `json:"errorMessage,omitempty"`
+	Width        int             `json:"width,omitempty"`
+	Height       int             `json:"height,omitempty"`
+	Results      []EncoderResult `json:"results,omitempty"`
+}
+
+// parseEncoderComparisonRequest reads a JSON encoder comparison request, the
+// configured encoders of the format of the image are compared to a few
+// qualities of the Go encoders when none are listed
+func parseEncoderComparisonRequest(req *http.Request) (*EncoderComparisonRequest, error) {
+	var r EncoderComparisonRequest
+	err := json.NewDecoder(io.LimitReader(req.Body, maxEncoderComparisonRequestSize)).Decode(&r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %s", err)
+	}
+	if r.Image == "" || r.Parameters == "" {
+		return nil, fmt.Errorf("the image and the parameters are needed")
+	}
+	if len(r.Encoders) > maxComparedEncoders {
+		return nil, fmt.Errorf("at most %d encoders can be compared", maxComparedEncoders)
+	}
+	for _, settings := range r.Encoders {
+		_, _, err := settings.options()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &r, nil
+}
+
+// defaultComparedEncoders returns the settings compared when a request lists
+// none
+func defaultComparedEncoders(format string) []EncoderSettings {
+	if format == "png" {
+		return []EncoderSettings{
+			{Format: "png"},
+			{Format: "png", Compression: pngCompressionBest},
+			{Format: "png", Colors: 256, Compression: pngCompressionBest},
+		}
+	}
+	encoders := []EncoderSettings{{Format: "jpeg"}}
+	for _, quality := range []int{50, 75, 90} {
+		encoders = append(encoders, EncoderSettings{Format: "jpeg", Encoder: encoderGo, Quality: quality})
+	}
+	return encoders
+}
+
+// options returns the JPEG or PNG options of the settings, nil PNG options
+// encode PNG images without optimization
+func (s EncoderSettings) options() (*jpegenc.Options, *PNGOptimization, error) {
+	switch s.Format {
+	case "jpeg":
+		if s.Encoder != "" && s.Encoder != encoderGo && s.Encoder != encoderCommand {
+			return nil, nil, fmt.Errorf("invalid encoder: %s (available: %s, %s)", s.Encoder, encoderGo, encoderCommand)
+		}
+		if s.Encoder == encoderCommand && currentConfig().jpegEncoderCommand == "" {
+			return nil, nil, fmt.Errorf("no jpeg-encoder command is configured")
+		}
+		if s.Quality < 0 || s.Quality > 100 {
+			return nil, nil, fmt.Errorf("quality needs to be between 1 and 100: %d", s.Quality)
+		}
+		if s.Subsampling != "" && s.Subsampling != subsampling444 && s.Subsampling != subsampling420 {
+			return nil, nil, fmt.Errorf("invalid subsampling: %s (available: %s, %s)", s.Subsampling, subsampling444, subsampling420)
+		}
+		options := &jpegenc.Options{Quality: s.Quality, Subsampling: currentConfig().jpegSubsampling}
+		if options.Quality == 0 {
+			options.Quality = currentConfig().jpegQuality
+		}
+		if s.Subsampling != "" {
+			options.Subsampling = parseSubsampling(s.Subsampling)
+		}
+		return options, nil, nil
+	case "png":
+		if s.Colors == 0 && s.Dither == nil && s.Compression == "" {
+			return nil, currentConfig().pngOptimization, nil
+		}
+		m := map[interface{}]interface{}{"colors": s.Colors}
+		if s.Dither != nil {
+			m["dither"] = *s.Dither
+		}
+		if s.Compression != "" {
+			m["compression"] = s.Compression
+		}
+		o, err := parsePNGOptimization(m)
+		return nil, o, err
+	}
+	return nil, nil, fmt.Errorf("invalid format: %s (available: jpeg, png)", s.Format)
+}
+
+// encode encodes an image with the settings, JPEG images are encoded as
+// jpeg-encoder says unless an encoder is selected
+func (s EncoderSettings) encode(img image.Image, w io.Writer) error {
+	jpegOptions, pngOptions, err := s.options()
+	if err != nil {
+		return err
+	}
+	switch {
+	case s.Format == "png":
+		return encodePNG(img, pngOptions, w)
+	case s.Encoder == encoderGo:
+		return jpegenc.Encode(w, img, jpegOptions)
+	case s.Encoder == encoderCommand:
+		data, err := encodeWithCommand(img, jpegOptions)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	return writeJPEG(img, jpegOptions, w)
+}
+
+// compareEncoders encodes an image with each of the settings and measures
+// the size, the time taken and the similarity of the result to the image
+func compareEncoders(img image.Image, encoders []EncoderSettings) []EncoderResult {
+	results := make([]EncoderResult, len(encoders))
+	for i, settings := range encoders {
+		result := EncoderResult{EncoderSettings: settings, Status: "error"}
+		var buffer bytes.Buffer
+		start := time.Now()
+		err := settings.encode(img, &buffer)
+		duration := time.Since(start)
+		if err == nil {
+			var decoded image.Image
+			decoded, _, err = image.Decode(bytes.NewReader(buffer.Bytes()))
+			if err == nil {
+				var diff DiffResponse
+				diff, err = diffImages(img, decoded, 0)
+				result.SSIM = diff.SSIM
+			}
+		}
+		if err != nil {
+			result.ErrorMessage = err.Error()
+		} else {
+			result.Status = "ok"
+			result.Bytes = buffer.Len()
+			result.EncodeMillis = float64(duration) / float64(time.Millisecond)
+		}
+		results[i] = result
+	}
+	return results
+}
+
+// encoderComparisonHandler transforms an image and encodes the result with
+// several encoders and settings, answering with how they compare
+func encoderComparisonHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, EncoderComparisonResponse{Status: "error", ErrorMessage: "API key invalid or missing"})
+	}
+	r, err := parseEncoderComparisonRequest(req)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, EncoderComparisonResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+	transformation, _, imagePath, err := resolveTransformation(currentConfig(), r.Parameters, r.Image)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, EncoderComparisonResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+
+	img, format, err := loadImage(imagePath)
+	if err == ErrNotFound {
+		return jsonResponse(res, http.StatusNotFound, EncoderComparisonResponse{Status: "error", ErrorMessage: "Image not found: " + imagePath})
+	}
+	if err != nil {
+		return jsonResponse(res, iiifErrorStatus(err), EncoderComparisonResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+	err = processingPool.acquire(req.Context())
+	if err == errOverloaded {
+		res.Header().Set("Retry-After", strconv.Itoa(currentConfig().processingRetryAfter))
+	}
+	if err != nil {
+		return jsonResponse(res, iiifErrorStatus(err), EncoderComparisonResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+	defer processingPool.release()
+	transformed, err := transformCropAndResize(img, format, imagePath, &transformation)
+	if err != nil {
+		return jsonResponse(res, http.StatusInternalServerError, EncoderComparisonResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+
+	encoders := r.Encoders
+	if len(encoders) == 0 {
+		encoders = defaultComparedEncoders(format)
+	}
+	size := transformed.Bounds().Size()
+	return jsonResponse(res, http.StatusOK, EncoderComparisonResponse{Status: "ok", Width: size.X, Height: size.Y, Results: compareEncoders(transformed, encoders)})
+}
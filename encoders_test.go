@@ -0,0 +1,51 @@
+package main
+
+import (
+	"image"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseEncoderComparisonRequest(t *testing.T) {
+	invalid := []string{
+		`{"image": "a.jpg"}`,
+		`{"image": "a.jpg", "parameters": "w_100", "encoders": [{"format": "webp"}]}`,
+		`{"image": "a.jpg", "parameters": "w_100", "encoders": [{"format": "jpeg", "encoder": "command"}]}`,
+		`{"image": "a.jpg", "parameters": "w_100", "encoders": [{"format": "jpeg", "subsampling": "422"}]}`,
+		`{"image": "a.jpg", "parameters": "w_100", "encoders": [{"format": "png", "compression": "max"}]}`,
+	}
+	for _, body := range invalid {
+		req, _ := http.NewRequest("POST", "/debug/encoders", strings.NewReader(body))
+		if _, err := parseEncoderComparisonRequest(req); err == nil {
+			t.Errorf("Expected an error for %s", body)
+		}
+	}
+}
+
+func TestCompareEncoders(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 48, 32))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(256))
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	results := compareEncoders(img, []EncoderSettings{
+		{Format: "jpeg", Encoder: encoderGo, Quality: 30},
+		{Format: "jpeg", Encoder: encoderGo, Quality: 95, Subsampling: subsampling444},
+		{Format: "png"},
+	})
+	for _, result := range results {
+		if result.Status != "ok" || result.Bytes == 0 || result.SSIM <= 0 {
+			t.Fatalf("Unexpected result: %+v", result)
+		}
+	}
+	if results[0].Bytes >= results[1].Bytes || results[0].SSIM >= results[1].SSIM {
+		t.Errorf("Expected a lower quality to be smaller and less similar, got: %+v", results)
+	}
+	if results[2].SSIM < 0.999 {
+		t.Errorf("Expected PNG to be lossless, got SSIM %f", results[2].SSIM)
+	}
+}
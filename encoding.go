@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+)
+
+// parseEncoding reads the encoding section, which sets how images of each
+// output format are encoded unless a URL or a named transformation says
+// otherwise. It takes precedence over jpeg-quality, jpeg-subsampling,
+// jpeg-encoder's progressive and png-optimization.
+func parseEncoding(m map[interface{}]interface{}, conf *Configuration) error {
+	for key, value := range m {
+		format := fmt.Sprint(key)
+		settings, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("invalid encoding for %s", format)
+		}
+		switch format {
+		case "jpeg", "jpg":
+			if err := parseJPEGEncoding(settings, conf); err != nil {
+				return fmt.Errorf("invalid encoding for %s: %s", format, err)
+			}
+		case "png":
+			o, err := parsePNGOptimization(settings)
+			if err != nil {
+				return fmt.Errorf("invalid encoding for %s: %s", format, err)
+			}
+			conf.pngOptimization = o
+		default:
+			// Images are served in the format of their originals
+			return fmt.Errorf("invalid encoding format: %s (available: jpeg, png)", format)
+		}
+	}
+	return nil
+}
+
+// parseJPEGEncoding reads the quality, the chroma subsampling and whether
+// JPEG images are progressive
+func parseJPEGEncoding(m map[interface{}]interface{}, conf *Configuration) error {
+	if value, ok := m["quality"]; ok {
+		quality, ok := value.(int)
+		if !ok || quality < 1 || quality > 100 {
+			return fmt.Errorf("quality needs to be between 1 and 100: %v", value)
+		}
+		conf.jpegQuality = quality
+	}
+	// 444 or 420, strings are accepted from overrides
+	if subsampling, ok := m["subsampling"]; ok {
+		value := fmt.Sprint(subsampling)
+		if value != subsampling444 && value != subsampling420 {
+			return fmt.Errorf("invalid subsampling: %s (available: %s, %s)", value, subsampling444, subsampling420)
+		}
+		conf.jpegSubsampling = parseSubsampling(value)
+	}
+	if value, ok := m["progressive"]; ok {
+		progressive, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("progressive needs to be Yes or No: %v", value)
+		}
+		conf.jpegEncoderProgressive = progressive
+	}
+	return nil
+}
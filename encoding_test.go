@@ -0,0 +1,39 @@
+package main
+
+import (
+	"image/png"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+func TestParseEncoding(t *testing.T) {
+	conf := &Configuration{jpegQuality: defaultJpegQuality}
+	err := parseEncoding(map[interface{}]interface{}{
+		"jpeg": map[interface{}]interface{}{"quality": 82, "subsampling": 444, "progressive": true},
+		"png":  map[interface{}]interface{}{"compression": "speed"},
+	}, conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conf.jpegQuality != 82 || conf.jpegSubsampling != jpegenc.Subsampling444 || !conf.jpegEncoderProgressive {
+		t.Errorf("Unexpected JPEG settings: %d, %v, %t", conf.jpegQuality, conf.jpegSubsampling, conf.jpegEncoderProgressive)
+	}
+	if conf.pngOptimization == nil || conf.pngOptimization.compression != png.BestSpeed {
+		t.Errorf("Unexpected PNG settings: %+v", conf.pngOptimization)
+	}
+
+	invalid := []map[interface{}]interface{}{
+		{"webp": map[interface{}]interface{}{"quality": 75}},
+		{"jpeg": map[interface{}]interface{}{"quality": 0}},
+		{"jpeg": map[interface{}]interface{}{"subsampling": 422}},
+		{"jpeg": map[interface{}]interface{}{"progressive": "maybe"}},
+		{"png": map[interface{}]interface{}{"compression": "fast"}},
+		{"jpeg": 82},
+	}
+	for _, m := range invalid {
+		if err := parseEncoding(m, &Configuration{}); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Adjust changes the gamma and exposure (in stops) of an image, 0 leaves
+// either as it is. Both are applied to linear light values and the whole
+// curve is worked out in floating point before rounding each channel once,
+// so that dark tones don't band like they would in sRGB values. Images with
+// 16 bits per channel keep them.
+func Adjust(img image.Image, gamma, exposure float64) image.Image {
+	if IsHighBitDepth(img) {
+		return adjust16(img, gamma, exposure)
+	}
+	table := adjustmentTable(gamma, exposure)
+	bounds := img.Bounds()
+
+	if gray, ok := img.(*image.Gray); ok {
+		adjusted := image.NewGray(bounds)
+		for i, v := range gray.Pix {
+			adjusted.Pix[i] = table[v]
+		}
+		return adjusted
+	}
+
+	// Colors of transparent pixels are adjusted before being multiplied by alpha
+	adjusted := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			adjusted.SetNRGBA(x, y, color.NRGBA{table[c.R], table[c.G], table[c.B], c.A})
+		}
+	}
+	return adjusted
+}
+
+// adjust16 is Adjust for images with 16 bits per channel
+func adjust16(img image.Image, gamma, exposure float64) image.Image {
+	table := adjustmentTable16(gamma, exposure)
+	bounds := img.Bounds()
+
+	if gray, ok := img.(*image.Gray16); ok {
+		adjusted := image.NewGray16(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				adjusted.SetGray16(x, y, color.Gray16{table[gray.Gray16At(x, y).Y]})
+			}
+		}
+		return adjusted
+	}
+
+	adjusted := image.NewNRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			adjusted.SetNRGBA64(x, y, color.NRGBA64{table[c.R], table[c.G], table[c.B], c.A})
+		}
+	}
+	return adjusted
+}
+
+// adjustmentTable maps sRGB channel values to adjusted ones
+func adjustmentTable(gamma, exposure float64) [256]uint8 {
+	curve := adjustmentCurve(gamma, exposure)
+	var table [256]uint8
+	for i := range table {
+		table[i] = uint8(math.Round(curve(float64(i)/255) * 255))
+	}
+	return table
+}
+
+// adjustmentTable16 maps 16-bit sRGB channel values to adjusted ones
+func adjustmentTable16(gamma, exposure float64) []uint16 {
+	curve := adjustmentCurve(gamma, exposure)
+	table := make([]uint16, 65536)
+	for i := range table {
+		table[i] = uint16(math.Round(curve(float64(i)/65535) * 65535))
+	}
+	return table
+}
+
+// adjustmentCurve returns the adjustment of sRGB values between 0 and 1
+func adjustmentCurve(gamma, exposure float64) func(float64) float64 {
+	if gamma == 0 {
+		gamma = 1
+	}
+	gain := math.Exp2(exposure)
+	return func(v float64) float64 {
+		linear := srgbToLinear(v)
+		linear = math.Min(1, linear*gain)
+		linear = math.Pow(linear, 1/gamma)
+		return linearToSRGB(linear)
+	}
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
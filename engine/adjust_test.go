@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseAdjustments(t *testing.T) {
+	params, err := ParseParameters("w_10,gam_2.2,exp_-1", Limits{})
+	if err != nil || params.Gamma != 2.2 || params.Exposure != -1 {
+		t.Errorf("Unexpected parameters: %+v %v", params, err)
+	}
+	if params.ToString() != "c_e,g_nw,h_0,w_10,f_none,s_1,gam_2.2,exp_-1" {
+		t.Errorf("Unexpected string: %s", params.ToString())
+	}
+
+	// Gamma 1 doesn't change images, they keep their names
+	params, _ = ParseParameters("w_10,gam_1,exp_0", Limits{})
+	if params.HasAdjustments() || params.ToString() != "c_e,g_nw,h_0,w_10,f_none,s_1" {
+		t.Errorf("Expected no adjustments, got: %s", params.ToString())
+	}
+
+	for _, parameters := range []string{"w_10,gam_0", "w_10,gam_20", "w_10,exp_6", "w_10,exp_x"} {
+		if _, err := ParseParameters(parameters, Limits{}); err == nil {
+			t.Errorf("Expected an error for %s", parameters)
+		}
+	}
+}
+
+func TestAdjust(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0, 128, 255, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{64, 64, 64, 100})
+
+	// One stop doubles linear light, 128 is about 22% of it in sRGB
+	adjusted := Adjust(img, 0, 1).(*image.NRGBA)
+	if c := adjusted.NRGBAAt(0, 0); c.R != 0 || c.G != 176 || c.B != 255 {
+		t.Errorf("Unexpected color: %v", c)
+	}
+	if c := adjusted.NRGBAAt(1, 0); c.A != 100 {
+		t.Errorf("Expected alpha to be kept, got: %v", c)
+	}
+
+	// Gamma above 1 brightens midtones, black and white stay
+	adjusted = Adjust(img, 2, 0).(*image.NRGBA)
+	if c := adjusted.NRGBAAt(0, 0); c.R != 0 || c.G <= 128 || c.B != 255 {
+		t.Errorf("Unexpected color: %v", c)
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	gray.Pix[0] = 128
+	if adjusted, ok := Adjust(gray, 0.5, 0).(*image.Gray); !ok || adjusted.Pix[0] >= 128 {
+		t.Errorf("Expected a darker gray image, got: %v", adjusted)
+	}
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Builder builds parameters step by step, e.g.
+// NewParams().Width(400).Cropping(CroppingModePart).Gravity(GravityCenter),
+// for programs constructing pixlserv URLs
+type Builder struct {
+	params Params
+}
+
+// NewParams returns a Builder starting from the default parameters
+func NewParams() *Builder {
+	return &Builder{Params{0, 0, DefaultScale, DefaultCroppingMode, DefaultGravity, DefaultFilter, 0, 0, 0, 0, 0}}
+}
+
+// Width sets the width, 0 calculates it from the height
+func (b *Builder) Width(width int) *Builder {
+	b.params.Width = width
+	return b
+}
+
+// Height sets the height, 0 calculates it from the width
+func (b *Builder) Height(height int) *Builder {
+	b.params.Height = height
+	return b
+}
+
+// Scale sets the scale, e.g. 2 for @2x images
+func (b *Builder) Scale(scale int) *Builder {
+	b.params.Scale = scale
+	return b
+}
+
+// Cropping sets the cropping mode, one of the CroppingMode constants
+func (b *Builder) Cropping(cropping string) *Builder {
+	b.params.Cropping = cropping
+	return b
+}
+
+// Gravity sets the gravity, one of the Gravity constants
+func (b *Builder) Gravity(gravity string) *Builder {
+	b.params.Gravity = gravity
+	return b
+}
+
+// GravityOffset sets the gravity and moves the part of an image which is
+// kept by the given number of pixels
+func (b *Builder) GravityOffset(name string, x, y int) *Builder {
+	b.params.Gravity = gravity{name: name, x: x, y: y}.String()
+	return b
+}
+
+// Filter sets the filter, e.g. FilterGrayScale or hue:90. More filters are
+// applied one after the other.
+func (b *Builder) Filter(filters ...string) *Builder {
+	b.params.Filter = strings.Join(filters, FilterChainSeparator)
+	return b
+}
+
+// Gamma sets the gamma adjustment
+func (b *Builder) Gamma(gamma float64) *Builder {
+	b.params.Gamma = gamma
+	return b
+}
+
+// Exposure sets the exposure adjustment in stops
+func (b *Builder) Exposure(exposure float64) *Builder {
+	b.params.Exposure = exposure
+	return b
+}
+
+// Zoom sets the zoom of the part of an image kept by the p and k cropping
+// modes
+func (b *Builder) Zoom(zoom float64) *Builder {
+	b.params.Zoom = zoom
+	return b
+}
+
+// SafeZone sets the part of an image around its gravity, in percent of its
+// size, which the p and k cropping modes never cut
+func (b *Builder) SafeZone(percent float64) *Builder {
+	b.params.SafeZone = percent
+	return b
+}
+
+// Opacity sets the opacity, in percent, the alpha channel of an image is
+// multiplied by
+func (b *Builder) Opacity(percent int) *Builder {
+	b.params.Transparency = MaxOpacity - percent
+	return b
+}
+
+// Build returns the parameters after validating them like ParseParameters
+// would in a URL, with filters and gravities in their canonical form
+func (b *Builder) Build(limits Limits) (Params, error) {
+	if b.params.Width == 0 && b.params.Height == 0 {
+		return b.params, fmt.Errorf("both width and height can't be 0")
+	}
+	params, err := ParseParameters(b.params.Encode(), limits)
+	if err != nil {
+		return params, err
+	}
+	params.Scale = b.params.Scale
+	return params, params.CheckLimits(limits)
+}
+
+// Encode returns the parameters string, see Params.Encode
+func (b *Builder) Encode() string {
+	return b.params.Encode()
+}
+
+// Encode turns parameters into a string like "w_400,c_p,g_c" for URLs which
+// ParseParameters parses back, default values are left out. The scale isn't
+// included, it's part of an image's path (cat@2x.jpg).
+func (p Params) Encode() string {
+	var parts []string
+	add := func(key, value string) {
+		parts = append(parts, key+"_"+value)
+	}
+	if p.Width != 0 {
+		add(ParameterWidth, strconv.Itoa(p.Width))
+	}
+	if p.Height != 0 {
+		add(ParameterHeight, strconv.Itoa(p.Height))
+	}
+	if p.Cropping != "" && p.Cropping != DefaultCroppingMode {
+		add(ParameterCropping, p.Cropping)
+	}
+	if p.Gravity != "" && p.Gravity != DefaultGravity {
+		add(ParameterGravity, p.Gravity)
+	}
+	if p.Filter != "" && p.Filter != DefaultFilter {
+		add(ParameterFilter, p.Filter)
+	}
+	floats := []struct {
+		key   string
+		value float64
+	}{
+		{ParameterGamma, p.Gamma},
+		{ParameterExposure, p.Exposure},
+		{ParameterZoom, p.Zoom},
+		{ParameterSafeZone, p.SafeZone},
+	}
+	for _, f := range floats {
+		if f.value != 0 {
+			add(f.key, strconv.FormatFloat(f.value, 'f', -1, 64))
+		}
+	}
+	if p.Transparency != 0 {
+		add(ParameterOpacity, strconv.Itoa(p.Opacity()))
+	}
+	return strings.Join(parts, ",")
+}
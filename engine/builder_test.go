@@ -0,0 +1,43 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	b := NewParams().Width(400).Cropping(CroppingModePart).Gravity(GravityCenter)
+	if b.Encode() != "w_400,c_p,g_c" {
+		t.Errorf("Unexpected parameters: %s", b.Encode())
+	}
+
+	params, err := NewParams().Width(400).Height(300).Scale(2).GravityOffset(GravityNorth, 0, -20).Filter(FilterGrayScale, "HUE:-270").Zoom(1.5).Build(Limits{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := Params{400, 300, 2, DefaultCroppingMode, "n:0:-20", "grayscale|hue:90", 0, 0, 1.5, 0, 0}
+	if params != expected {
+		t.Errorf("Expected %+v, got: %+v", expected, params)
+	}
+
+	if _, err := NewParams().Cropping(CroppingModePart).Build(Limits{}); err == nil {
+		t.Error("Expected an error without a width or height")
+	}
+	if _, err := NewParams().Width(400).Gravity("up").Build(Limits{}); err == nil {
+		t.Error("Expected an error for an unknown gravity")
+	}
+	if _, err := NewParams().Width(400).Height(400).Scale(3).Build(Limits{MaxScale: 2}); err == nil {
+		t.Error("Expected an error for a scale over the limit")
+	}
+}
+
+func TestParamsEncode(t *testing.T) {
+	for _, str := range []string{"w_400,h_300", "h_300,c_k,g_se:10p:0,f_grayscale|vignette:30,gam_2.2,exp_-1,z_0.5"} {
+		params, err := ParseParameters(str, Limits{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if encoded := params.Encode(); encoded != str {
+			t.Errorf("Expected %s, got: %s", str, encoded)
+		}
+	}
+}
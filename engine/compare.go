@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+)
+
+const (
+	// Side of the windows SSIM is worked out in and how far apart they are
+	ssimWindow = 8
+	ssimStride = 4
+)
+
+var (
+	// ErrSizeMismatch is returned when comparing images of different sizes
+	ErrSizeMismatch = errors.New("images have different sizes")
+
+	// Constants stabilising SSIM for dark and flat windows
+	ssimC1 = math.Pow(0.01*255, 2)
+	ssimC2 = math.Pow(0.03*255, 2)
+)
+
+// Comparison says how much two images of the same size differ
+type Comparison struct {
+	// Number of pixels with a channel differing by more than the threshold
+	DifferentPixels int
+	// Mean structural similarity of the luma of the images, 1 when they match
+	SSIM float64
+}
+
+// Compare compares two images of the same size pixel by pixel, differences
+// of at most threshold (0-255) in every channel are ignored
+func Compare(a, b image.Image, threshold int) (Comparison, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return Comparison{}, ErrSizeMismatch
+	}
+	rgbaA, rgbaB := toRGBA(a), toRGBA(b)
+
+	var comparison Comparison
+	for i := 0; i < len(rgbaA.Pix); i += 4 {
+		if pixelDifference(rgbaA.Pix[i:i+4], rgbaB.Pix[i:i+4]) > threshold {
+			comparison.DifferentPixels++
+		}
+	}
+	comparison.SSIM = ssim(luma(rgbaA), luma(rgbaB), rgbaA.Bounds().Dx(), rgbaA.Bounds().Dy())
+	return comparison, nil
+}
+
+// Heatmap shows where two images of the same size differ, in red over a faded
+// grey version of the first image. Any difference shows, bigger ones more.
+func Heatmap(a, b image.Image) (image.Image, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return nil, ErrSizeMismatch
+	}
+	rgbaA, rgbaB := toRGBA(a), toRGBA(b)
+	lumaA := luma(rgbaA)
+
+	heatmap := image.NewRGBA(rgbaA.Bounds())
+	for i := 0; i < len(rgbaA.Pix); i += 4 {
+		base := 191 + lumaA[i/4]/4
+		r, g, b := base, base, base
+		if d := pixelDifference(rgbaA.Pix[i:i+4], rgbaB.Pix[i:i+4]); d > 0 {
+			alpha := 0.25 + 0.75*float64(d)/255
+			r = base + (255-base)*alpha
+			g = base * (1 - alpha)
+			b = base * (1 - alpha)
+		}
+		heatmap.Pix[i] = uint8(math.Round(r))
+		heatmap.Pix[i+1] = uint8(math.Round(g))
+		heatmap.Pix[i+2] = uint8(math.Round(b))
+		heatmap.Pix[i+3] = 255
+	}
+	return heatmap, nil
+}
+
+// toRGBA copies an image to one starting at 0,0
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// pixelDifference returns the biggest difference between the channels of two
+// pixels
+func pixelDifference(a, b []uint8) int {
+	max := 0
+	for i := range a {
+		d := int(a[i]) - int(b[i])
+		if d < 0 {
+			d = -d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+func luma(img *image.RGBA) []float64 {
+	values := make([]float64, len(img.Pix)/4)
+	for i := range values {
+		values[i] = 0.299*float64(img.Pix[4*i]) + 0.587*float64(img.Pix[4*i+1]) + 0.114*float64(img.Pix[4*i+2])
+	}
+	return values
+}
+
+// ssim averages the structural similarity of overlapping windows, images
+// smaller than a window are compared as a whole
+func ssim(a, b []float64, width, height int) float64 {
+	windowWidth, windowHeight := ssimWindow, ssimWindow
+	if width < windowWidth {
+		windowWidth = width
+	}
+	if height < windowHeight {
+		windowHeight = height
+	}
+	if windowWidth == 0 || windowHeight == 0 {
+		return 1
+	}
+
+	var sum float64
+	var windows int
+	n := float64(windowWidth * windowHeight)
+	for y := 0; y+windowHeight <= height; y += ssimStride {
+		for x := 0; x+windowWidth <= width; x += ssimStride {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for wy := y; wy < y+windowHeight; wy++ {
+				for wx := x; wx < x+windowWidth; wx++ {
+					va, vb := a[wy*width+wx], b[wy*width+wx]
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+				}
+			}
+			meanA, meanB := sumA/n, sumB/n
+			varianceA := sumAA/n - meanA*meanA
+			varianceB := sumBB/n - meanB*meanB
+			covariance := sumAB/n - meanA*meanB
+			sum += ((2*meanA*meanB + ssimC1) * (2*covariance + ssimC2)) /
+				((meanA*meanA + meanB*meanB + ssimC1) * (varianceA + varianceB + ssimC2))
+			windows++
+		}
+	}
+	return sum / float64(windows)
+}
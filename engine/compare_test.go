@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func gradientImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8((x*7 + y*13) % 256)
+			img.SetRGBA(x, y, color.RGBA{v, 255 - v, v / 2, 255})
+		}
+	}
+	return img
+}
+
+func TestCompare(t *testing.T) {
+	a := gradientImage(32, 24)
+	comparison, err := Compare(a, gradientImage(32, 24), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if comparison.DifferentPixels != 0 || math.Abs(comparison.SSIM-1) > 1e-9 {
+		t.Errorf("Expected identical images, got: %+v", comparison)
+	}
+
+	b := gradientImage(32, 24)
+	for x := 0; x < 10; x++ {
+		b.SetRGBA(x, 0, color.RGBA{0, 0, 0, 255})
+	}
+	b.SetRGBA(20, 20, color.RGBA{a.Pix[b.PixOffset(20, 20)] + 3, 255 - a.Pix[b.PixOffset(20, 20)], a.Pix[b.PixOffset(20, 20)] / 2, 255})
+	comparison, err = Compare(a, b, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if comparison.DifferentPixels != 11 {
+		t.Errorf("Expected 11 different pixels, got: %d", comparison.DifferentPixels)
+	}
+	if comparison.SSIM >= 1 || comparison.SSIM < 0.5 {
+		t.Errorf("Expected a slightly lower SSIM, got: %f", comparison.SSIM)
+	}
+	if thresholded, _ := Compare(a, b, 3); thresholded.DifferentPixels != 10 {
+		t.Errorf("Expected 10 pixels over the threshold, got: %d", thresholded.DifferentPixels)
+	}
+
+	if _, err := Compare(a, gradientImage(24, 32), 0); err != ErrSizeMismatch {
+		t.Errorf("Expected a size mismatch, got: %v", err)
+	}
+}
+
+func TestCompareSmallImages(t *testing.T) {
+	comparison, err := Compare(gradientImage(3, 2), gradientImage(3, 2), 0)
+	if err != nil || math.Abs(comparison.SSIM-1) > 1e-9 {
+		t.Errorf("Unexpected comparison: %+v (%v)", comparison, err)
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	b := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	b.SetRGBA(1, 1, color.RGBA{255, 255, 255, 255})
+	heatmap, err := Heatmap(a, b)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if c := color.RGBAModel.Convert(heatmap.At(0, 0)).(color.RGBA); c != (color.RGBA{191, 191, 191, 255}) {
+		t.Errorf("Expected faded grey where nothing differs, got: %v", c)
+	}
+	if c := color.RGBAModel.Convert(heatmap.At(1, 1)).(color.RGBA); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Expected red where everything differs, got: %v", c)
+	}
+	if _, err := Heatmap(a, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != ErrSizeMismatch {
+		t.Errorf("Expected a size mismatch, got: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// 4x4 Bayer matrix, thresholds are (n+0.5)/16 of a level
+var bayer4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// IsHighBitDepth reports whether an image has 16 bits per channel, such as
+// decoded 16-bit PNG images
+func IsHighBitDepth(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// newCanvas returns an empty image to draw parts of img on, with 16 bits per
+// channel when img has them so that they aren't truncated
+func newCanvas(img image.Image, rect image.Rectangle) draw.Image {
+	if IsHighBitDepth(img) {
+		return image.NewRGBA64(rect)
+	}
+	return image.NewRGBA(rect)
+}
+
+// Dither reduces an image with 16 bits per channel to 8 bits using ordered
+// dithering, so that smooth gradients don't band the way they do when the
+// low bits are dropped. Other images are returned as they are.
+func Dither(img image.Image) image.Image {
+	if !IsHighBitDepth(img) {
+		return img
+	}
+	bounds := img.Bounds()
+
+	if gray, ok := img.(*image.Gray16); ok {
+		dithered := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				t := ditherThreshold(x, y)
+				dithered.SetGray(x, y, color.Gray{ditherChannel(gray.Gray16At(x, y).Y, t)})
+			}
+		}
+		return dithered
+	}
+
+	// Colors of transparent pixels are dithered before being multiplied by alpha
+	dithered := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			t := ditherThreshold(x, y)
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			dithered.SetNRGBA(x, y, color.NRGBA{ditherChannel(c.R, t), ditherChannel(c.G, t), ditherChannel(c.B, t), ditherChannel(c.A, t)})
+		}
+	}
+	return dithered
+}
+
+func ditherThreshold(x, y int) float64 {
+	return (bayer4[y&3][x&3] + 0.5) / 16
+}
+
+// ditherChannel rounds a 16-bit channel value to 8 bits up or down depending
+// on the threshold, values exactly on a level aren't changed
+func ditherChannel(v uint16, threshold float64) uint8 {
+	return uint8(math.Min(255, math.Floor(float64(v)*255/65535+threshold)))
+}
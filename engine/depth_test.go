@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// gradient16 returns a horizontal gray gradient spanning a single 8-bit level
+func gradient16(width int) *image.RGBA64 {
+	img := image.NewRGBA64(image.Rect(0, 0, width, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < width; x++ {
+			v := uint16(257*100 + 257*x/width)
+			img.SetRGBA64(x, y, color.RGBA64{v, v, v, 0xffff})
+		}
+	}
+	return img
+}
+
+func TestIsHighBitDepth(t *testing.T) {
+	rect := image.Rect(0, 0, 1, 1)
+	for _, img := range []image.Image{image.NewRGBA64(rect), image.NewNRGBA64(rect), image.NewGray16(rect)} {
+		if !IsHighBitDepth(img) {
+			t.Errorf("Expected %T to have a high bit depth", img)
+		}
+	}
+	for _, img := range []image.Image{image.NewRGBA(rect), image.NewNRGBA(rect), image.NewGray(rect), image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)} {
+		if IsHighBitDepth(img) {
+			t.Errorf("Expected %T not to have a high bit depth", img)
+		}
+	}
+}
+
+func TestDither(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	if Dither(img) != image.Image(img) {
+		t.Errorf("Expected 8-bit images to be kept")
+	}
+
+	// Truncating would make every pixel 100, dithering mixes in 101 more
+	// often the further right pixels are
+	dithered := Dither(gradient16(16)).(*image.NRGBA)
+	left, right := 0, 0
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			left += int(dithered.NRGBAAt(x, y).R) - 100
+			right += int(dithered.NRGBAAt(x+8, y).R) - 100
+		}
+	}
+	if left >= right || right == 0 || right > 32 {
+		t.Errorf("Expected more 101s on the right, got %d on the left and %d on the right", left, right)
+	}
+
+	// Values exactly on an 8-bit level aren't changed
+	gray := image.NewGray16(image.Rect(0, 0, 4, 4))
+	for i := range gray.Pix {
+		gray.Pix[i] = 0xff
+	}
+	ditheredGray, ok := Dither(gray).(*image.Gray)
+	if !ok {
+		t.Fatalf("Expected a gray image, got: %T", Dither(gray))
+	}
+	for _, v := range ditheredGray.Pix {
+		if v != 255 {
+			t.Fatalf("Expected white to stay white, got: %d", v)
+		}
+	}
+}
+
+func TestHighBitDepthIsKept(t *testing.T) {
+	img := gradient16(16)
+	params := Params{Width: 8, Height: 4, Scale: 1, Cropping: CroppingModeKeepScale, Gravity: GravityCenter, Filter: DefaultFilter}
+	if cropped := Transform(img, params); !IsHighBitDepth(cropped) {
+		t.Errorf("Expected the crop to keep 16 bits, got: %T", cropped)
+	}
+	if adjusted := Adjust(img, 1.2, 0); !IsHighBitDepth(adjusted) {
+		t.Errorf("Expected the adjustment to keep 16 bits, got: %T", adjusted)
+	}
+	if gray := grayScale(img); !IsHighBitDepth(gray) {
+		t.Errorf("Expected grayscale to keep 16 bits, got: %T", gray)
+	}
+	for _, filter := range []string{"hue:90", "vignette", "denoise"} {
+		fn, _, _ := lookupFilter(filter)
+		if filtered := fn(img); !IsHighBitDepth(filtered) {
+			t.Errorf("Expected %s to keep 16 bits, got: %T", filter, filtered)
+		}
+	}
+
+	// Gamma 1 leaves values between 8-bit levels as they are
+	adjusted := Adjust(img, 1, 0).(*image.NRGBA64)
+	if c := adjusted.NRGBA64At(15, 0); c.R != img.RGBA64At(15, 0).R {
+		t.Errorf("Expected %d, got: %d", img.RGBA64At(15, 0).R, c.R)
+	}
+}
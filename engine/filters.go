@@ -0,0 +1,461 @@
+package engine
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// FilterHue rotates hues by the given degrees, e.g. f_hue:90
+	FilterHue = "hue"
+	// FilterTint blends an image's luminance in a color by the given percentage
+	// (50 by default), e.g. f_tint:ff0000:40
+	FilterTint = "tint"
+	// FilterDuotone maps luminance to a gradient from a dark to a light color,
+	// e.g. f_duotone:1a237e:ffeb3b
+	FilterDuotone = "duotone"
+	// FilterVignette darkens the edges of an image by the given percentage (50
+	// by default), e.g. f_vignette:60
+	FilterVignette = "vignette"
+	// FilterDenoise smooths noise out of photos before they are resized,
+	// stronger the higher the given strength (30 by default), e.g. f_denoise:50
+	FilterDenoise = "denoise"
+
+	// FilterChainSeparator separates filters applied one after the other,
+	// e.g. f_grayscale|vignette:30
+	FilterChainSeparator = "|"
+
+	defaultTintStrength     = 50
+	defaultVignetteStrength = 50
+	defaultDenoiseStrength  = 30
+	// Distance from the center, relative to the ellipse touching the edges,
+	// where vignettes start
+	vignetteStart = 0.5
+)
+
+// Filter turns a resized and cropped image into a filtered one
+type Filter func(img image.Image) image.Image
+
+var (
+	filters = make(map[string]Filter)
+
+	// Filter names are used in URLs and cached images' names
+	filterNameRe = regexp.MustCompile("^[a-z0-9-]+$")
+)
+
+func init() {
+	RegisterFilter(FilterGrayScale, grayScale)
+}
+
+// RegisterFilter makes a filter available under the given name so that it
+// can be applied using the f parameter. Custom filters can be compiled in by
+// adding a file which calls this function from init().
+func RegisterFilter(name string, fn Filter) {
+	if fn == nil {
+		panic("filter: function is nil for " + name)
+	}
+	if !filterNameRe.MatchString(name) || name == DefaultFilter || name == FilterHue || name == FilterTint || name == FilterDuotone || name == FilterVignette || name == FilterDenoise {
+		panic("filter: invalid name: " + name)
+	}
+	if _, ok := filters[name]; ok {
+		panic("filter: registered twice: " + name)
+	}
+	filters[name] = fn
+}
+
+// IsValidFilter reports whether str is the name of a registered filter or a
+// filter with valid arguments such as hue:90
+func IsValidFilter(str string) bool {
+	_, _, err := lookupFilter(str)
+	return err == nil
+}
+
+// CanonicalFilter returns a value of the f parameter in the form it's cached
+// under, e.g. hue:90 for hue:-270
+func CanonicalFilter(str string) (string, error) {
+	_, canonical, err := lookupFilter(strings.ToLower(str))
+	return canonical, err
+}
+
+// IsFilterName reports whether str names a filter, with or without arguments
+func IsFilterName(str string) bool {
+	_, ok := filters[str]
+	return ok || str == FilterHue || str == FilterTint || str == FilterDuotone || str == FilterVignette || str == FilterDenoise
+}
+
+// FilterName returns the name of a filter without its arguments, e.g. hue
+// for hue:90
+func FilterName(str string) string {
+	return strings.SplitN(str, ":", 2)[0]
+}
+
+// lookupFilter returns the filter a value of the f parameter stands for and
+// the value in its canonical form so that equal filters share cached images
+func lookupFilter(str string) (Filter, string, error) {
+	if strings.Contains(str, FilterChainSeparator) {
+		return lookupFilterChain(strings.Split(str, FilterChainSeparator))
+	}
+
+	args := strings.Split(str, ":")
+	switch args[0] {
+	case FilterHue:
+		if len(args) != 2 {
+			return nil, "", fmt.Errorf("hue needs degrees, e.g. hue:90")
+		}
+		degrees, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid hue degrees: %s", args[1])
+		}
+		degrees = (degrees%360 + 360) % 360
+		return hueRotation(float64(degrees)), fmt.Sprintf("%s:%d", FilterHue, degrees), nil
+	case FilterTint:
+		if len(args) != 2 && len(args) != 3 {
+			return nil, "", fmt.Errorf("tint needs a color and optionally a strength, e.g. tint:ff0000:40")
+		}
+		tint, err := parseHexColor(args[1])
+		if err != nil {
+			return nil, "", err
+		}
+		strength := defaultTintStrength
+		if len(args) == 3 {
+			strength, err = strconv.Atoi(args[2])
+			if err != nil || strength < 0 || strength > 100 {
+				return nil, "", fmt.Errorf("tint strength needs to be between 0 and 100: %s", args[2])
+			}
+		}
+		return tinting(tint, strength), fmt.Sprintf("%s:%02x%02x%02x:%d", FilterTint, tint.R, tint.G, tint.B, strength), nil
+	case FilterDuotone:
+		if len(args) != 3 {
+			return nil, "", fmt.Errorf("duotone needs a dark and a light color, e.g. duotone:1a237e:ffeb3b")
+		}
+		dark, err := parseHexColor(args[1])
+		if err != nil {
+			return nil, "", err
+		}
+		light, err := parseHexColor(args[2])
+		if err != nil {
+			return nil, "", err
+		}
+		return duotone(dark, light), fmt.Sprintf("%s:%02x%02x%02x:%02x%02x%02x", FilterDuotone, dark.R, dark.G, dark.B, light.R, light.G, light.B), nil
+	case FilterVignette:
+		if len(args) > 2 {
+			return nil, "", fmt.Errorf("vignette takes a strength, e.g. vignette:60")
+		}
+		strength := defaultVignetteStrength
+		if len(args) == 2 {
+			var err error
+			strength, err = strconv.Atoi(args[1])
+			if err != nil || strength < 0 || strength > 100 {
+				return nil, "", fmt.Errorf("vignette strength needs to be between 0 and 100: %s", args[1])
+			}
+		}
+		return vignette(strength), fmt.Sprintf("%s:%d", FilterVignette, strength), nil
+	case FilterDenoise:
+		if len(args) > 2 {
+			return nil, "", fmt.Errorf("denoise takes a strength, e.g. denoise:50")
+		}
+		strength := defaultDenoiseStrength
+		if len(args) == 2 {
+			var err error
+			strength, err = strconv.Atoi(args[1])
+			if err != nil || strength < 1 || strength > 100 {
+				return nil, "", fmt.Errorf("denoise strength needs to be between 1 and 100: %s", args[1])
+			}
+		}
+		return denoise(strength), fmt.Sprintf("%s:%d", FilterDenoise, strength), nil
+	}
+
+	if filter, ok := filters[str]; ok {
+		return filter, str, nil
+	}
+	return nil, "", fmt.Errorf("unknown filter: %s", str)
+}
+
+// lookupFilterChain returns a filter applying the given ones in order
+func lookupFilterChain(strs []string) (Filter, string, error) {
+	chain := make([]Filter, len(strs))
+	canonical := make([]string, len(strs))
+	for i, str := range strs {
+		var err error
+		chain[i], canonical[i], err = lookupFilter(str)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	filter := func(img image.Image) image.Image {
+		for _, fn := range chain {
+			img = fn(img)
+		}
+		return img
+	}
+	return filter, strings.Join(canonical, FilterChainSeparator), nil
+}
+
+// splitFilterChain splits a value of the f parameter into the filters
+// applied before resizing and the ones applied after, either is empty when
+// there aren't any
+func splitFilterChain(str string) (string, string) {
+	var before, after []string
+	for _, filter := range strings.Split(str, FilterChainSeparator) {
+		if appliesBeforeResizing(filter) {
+			before = append(before, filter)
+		} else {
+			after = append(after, filter)
+		}
+	}
+	return strings.Join(before, FilterChainSeparator), strings.Join(after, FilterChainSeparator)
+}
+
+// parseHexColor parses colors like ff0000 and f00
+func parseHexColor(str string) (color.NRGBA, error) {
+	if len(str) == 3 {
+		str = string([]byte{str[0], str[0], str[1], str[1], str[2], str[2]})
+	}
+	value, err := strconv.ParseUint(str, 16, 32)
+	if len(str) != 6 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", str)
+	}
+	return color.NRGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}, nil
+}
+
+func grayScale(img image.Image) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Max.X, bounds.Max.Y
+	var gray draw.Image = image.NewGray(bounds)
+	if IsHighBitDepth(img) {
+		gray = image.NewGray16(bounds)
+	}
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			oldColor := img.At(x, y)
+			gray.Set(x, y, gray.ColorModel().Convert(oldColor))
+		}
+	}
+	return gray
+}
+
+// mapColors returns an image with each pixel's color changed by fn, alpha is
+// kept. fn gets channel values between 0 and 255, which have fractions for
+// images with 16 bits per channel so that they keep them.
+func mapColors(img image.Image, fn func(r, g, b float64) (float64, float64, float64)) image.Image {
+	bounds := img.Bounds()
+	if IsHighBitDepth(img) {
+		mapped := image.NewNRGBA64(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				r, g, b := fn(float64(c.R)/257, float64(c.G)/257, float64(c.B)/257)
+				mapped.SetNRGBA64(x, y, color.NRGBA64{clampChannel16(r), clampChannel16(g), clampChannel16(b), c.A})
+			}
+		}
+		return mapped
+	}
+
+	mapped := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			r, g, b := fn(float64(c.R), float64(c.G), float64(c.B))
+			mapped.SetNRGBA(x, y, color.NRGBA{clampChannel(r), clampChannel(g), clampChannel(b), c.A})
+		}
+	}
+	return mapped
+}
+
+func clampChannel(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(255, v))))
+}
+
+// clampChannel16 turns a channel value between 0 and 255 into a 16-bit one
+func clampChannel16(v float64) uint16 {
+	return uint16(math.Round(math.Max(0, math.Min(65535, v*257))))
+}
+
+// hueRotation rotates hues around the gray axis keeping luminance like CSS's
+// hue-rotate()
+func hueRotation(degrees float64) Filter {
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	m := [9]float64{
+		0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928,
+		0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283,
+		0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072,
+	}
+	return func(img image.Image) image.Image {
+		return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+			return m[0]*r + m[1]*g + m[2]*b, m[3]*r + m[4]*g + m[5]*b, m[6]*r + m[7]*g + m[8]*b
+		})
+	}
+}
+
+// tinting blends pixels with the tint color scaled by their luminance, so
+// that shading is kept while the colors change
+func tinting(tint color.NRGBA, strength int) Filter {
+	s := float64(strength) / 100
+	return func(img image.Image) image.Image {
+		return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+			l := (0.299*r + 0.587*g + 0.114*b) / 255
+			return r + (l*float64(tint.R)-r)*s, g + (l*float64(tint.G)-g)*s, b + (l*float64(tint.B)-b)*s
+		})
+	}
+}
+
+// duotone replaces colors by the point of a gradient from dark to light
+// their luminance falls on
+func duotone(dark, light color.NRGBA) Filter {
+	return func(img image.Image) image.Image {
+		return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+			l := (0.299*r + 0.587*g + 0.114*b) / 255
+			return float64(dark.R) + (float64(light.R)-float64(dark.R))*l,
+				float64(dark.G) + (float64(light.G)-float64(dark.G))*l,
+				float64(dark.B) + (float64(light.B)-float64(dark.B))*l
+		})
+	}
+}
+
+// vignette darkens pixels more the further they are from the center. The
+// distance is measured relative to the ellipse touching the edges, so that
+// the falloff follows the aspect ratio of the (resized) image.
+func vignette(strength int) Filter {
+	s := float64(strength) / 100
+	return func(img image.Image) image.Image {
+		bounds := img.Bounds()
+		high := IsHighBitDepth(img)
+		var vignetted draw.Image = image.NewNRGBA(bounds)
+		if high {
+			vignetted = image.NewNRGBA64(bounds)
+		}
+		halfWidth, halfHeight := float64(bounds.Dx())/2, float64(bounds.Dy())/2
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				dx := (float64(x-bounds.Min.X) + 0.5 - halfWidth) / halfWidth
+				dy := (float64(y-bounds.Min.Y) + 0.5 - halfHeight) / halfHeight
+				// 0 up to where the vignette starts, 1 in the corners
+				t := math.Max(0, math.Min(1, (math.Hypot(dx, dy)-vignetteStart)/(math.Sqrt2-vignetteStart)))
+				factor := 1 - s*t*t*(3-2*t)
+
+				if high {
+					c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+					vignetted.Set(x, y, color.NRGBA64{clampChannel16(float64(c.R) / 257 * factor), clampChannel16(float64(c.G) / 257 * factor), clampChannel16(float64(c.B) / 257 * factor), c.A})
+					continue
+				}
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				vignetted.Set(x, y, color.NRGBA{clampChannel(float64(c.R) * factor), clampChannel(float64(c.G) * factor), clampChannel(float64(c.B) * factor), c.A})
+			}
+		}
+		return vignetted
+	}
+}
+
+// appliesBeforeResizing reports whether a filter works on the original
+// pixels rather than the resized image. Noise is removed before it's
+// averaged into the resized pixels.
+func appliesBeforeResizing(str string) bool {
+	return FilterName(str) == FilterDenoise
+}
+
+const (
+	denoiseRadius = 2
+	// Squared color distances are looked up with this many low bits dropped
+	denoiseDistanceShift = 6
+)
+
+// denoise is a bilateral filter: each pixel becomes an average of its
+// neighbours weighted by how close they are and how similar their colors
+// are, so that noise is smoothed while edges stay sharp
+func denoise(strength int) Filter {
+	sigmaRange := float64(strength) * 0.8
+	sigmaSpace := float64(denoiseRadius) * 0.75
+
+	var spatial [2*denoiseRadius + 1][2*denoiseRadius + 1]float64
+	for dy := -denoiseRadius; dy <= denoiseRadius; dy++ {
+		for dx := -denoiseRadius; dx <= denoiseRadius; dx++ {
+			spatial[dy+denoiseRadius][dx+denoiseRadius] = math.Exp(-float64(dx*dx+dy*dy) / (2 * sigmaSpace * sigmaSpace))
+		}
+	}
+	rangeWeights := make([]float64, 3*255*255>>denoiseDistanceShift+1)
+	for i := range rangeWeights {
+		d2 := float64(i << denoiseDistanceShift)
+		rangeWeights[i] = math.Exp(-d2 / (2 * sigmaRange * sigmaRange))
+	}
+
+	return func(img image.Image) image.Image {
+		if IsHighBitDepth(img) {
+			return denoise16(img, &spatial, rangeWeights)
+		}
+		bounds := img.Bounds()
+		src := image.NewNRGBA(bounds)
+		draw.Draw(src, bounds, img, bounds.Min, draw.Src)
+		denoised := image.NewNRGBA(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := src.PixOffset(x, y)
+				center := src.Pix[i : i+4]
+				var r, g, b, total float64
+				for dy := -denoiseRadius; dy <= denoiseRadius; dy++ {
+					ny := y + dy
+					if ny < bounds.Min.Y || ny >= bounds.Max.Y {
+						continue
+					}
+					for dx := -denoiseRadius; dx <= denoiseRadius; dx++ {
+						nx := x + dx
+						if nx < bounds.Min.X || nx >= bounds.Max.X {
+							continue
+						}
+						j := src.PixOffset(nx, ny)
+						n := src.Pix[j : j+4]
+						dr, dg, db := int(n[0])-int(center[0]), int(n[1])-int(center[1]), int(n[2])-int(center[2])
+						w := spatial[dy+denoiseRadius][dx+denoiseRadius] * rangeWeights[(dr*dr+dg*dg+db*db)>>denoiseDistanceShift]
+						r += w * float64(n[0])
+						g += w * float64(n[1])
+						b += w * float64(n[2])
+						total += w
+					}
+				}
+				copy(denoised.Pix[i:i+4], []uint8{clampChannel(r / total), clampChannel(g / total), clampChannel(b / total), center[3]})
+			}
+		}
+		return denoised
+	}
+}
+
+// denoise16 is denoise for images with 16 bits per channel, colors are
+// compared on their high bytes so that the same weights apply
+func denoise16(img image.Image, spatial *[2*denoiseRadius + 1][2*denoiseRadius + 1]float64, rangeWeights []float64) image.Image {
+	bounds := img.Bounds()
+	src := image.NewNRGBA64(bounds)
+	draw.Draw(src, bounds, img, bounds.Min, draw.Src)
+	denoised := image.NewNRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			center := src.NRGBA64At(x, y)
+			var r, g, b, total float64
+			for dy := -denoiseRadius; dy <= denoiseRadius; dy++ {
+				ny := y + dy
+				if ny < bounds.Min.Y || ny >= bounds.Max.Y {
+					continue
+				}
+				for dx := -denoiseRadius; dx <= denoiseRadius; dx++ {
+					nx := x + dx
+					if nx < bounds.Min.X || nx >= bounds.Max.X {
+						continue
+					}
+					n := src.NRGBA64At(nx, ny)
+					dr, dg, db := int(n.R>>8)-int(center.R>>8), int(n.G>>8)-int(center.G>>8), int(n.B>>8)-int(center.B>>8)
+					w := spatial[dy+denoiseRadius][dx+denoiseRadius] * rangeWeights[(dr*dr+dg*dg+db*db)>>denoiseDistanceShift]
+					r += w * float64(n.R)
+					g += w * float64(n.G)
+					b += w * float64(n.B)
+					total += w
+				}
+			}
+			denoised.SetNRGBA64(x, y, color.NRGBA64{clampChannel16(r / total / 257), clampChannel16(g / total / 257), clampChannel16(b / total / 257), center.A})
+		}
+	}
+	return denoised
+}
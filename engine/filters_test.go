@@ -0,0 +1,205 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestRegisterFilter(t *testing.T) {
+	if _, err := ParseParameters("w_10,f_invert-test", Limits{}); err == nil {
+		t.Error("Expected an unregistered filter to be rejected")
+	}
+
+	RegisterFilter("invert-test", func(img image.Image) image.Image {
+		bounds := img.Bounds()
+		inverted := image.NewGray(bounds)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+				inverted.SetGray(x, y, color.Gray{255 - gray.Y})
+			}
+		}
+		return inverted
+	})
+
+	params, err := ParseParameters("w_10,h_10,f_Invert-Test", Limits{})
+	if err != nil {
+		t.Fatalf("Expected a registered filter to be accepted, got: %s", err)
+	}
+	img := Transform(image.NewGray(image.Rect(0, 0, 20, 20)), params)
+	if gray := color.GrayModel.Convert(img.At(5, 5)).(color.Gray); gray.Y != 255 {
+		t.Errorf("Expected the filter to be applied, got: %v", gray)
+	}
+
+	for _, name := range []string{"invert-test", FilterGrayScale, DefaultFilter, "a,b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected registering %q to panic", name)
+				}
+			}()
+			RegisterFilter(name, grayScale)
+		}()
+	}
+}
+
+func TestHueAndTintFilters(t *testing.T) {
+	params, err := ParseParameters("w_1,h_1,f_hue:-270", Limits{})
+	if err != nil || params.Filter != "hue:90" {
+		t.Errorf("Expected a canonical hue filter, got: %q %v", params.Filter, err)
+	}
+	params, err = ParseParameters("w_1,h_1,f_tint:F00", Limits{})
+	if err != nil || params.Filter != "tint:ff0000:50" {
+		t.Errorf("Expected a canonical tint filter, got: %q %v", params.Filter, err)
+	}
+	for _, value := range []string{"hue", "hue:x", "tint:ff00", "tint:ff0000:101", "grayscale:1"} {
+		if IsValidFilter(value) {
+			t.Errorf("Expected %q to be invalid", value)
+		}
+	}
+	if !IsFilterName(FilterHue) || FilterName("tint:ff0000:50") != FilterTint {
+		t.Error("Expected hue and tint to be filter names")
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{200, 0, 0, 128})
+	params = Params{1, 1, 1, CroppingModeKeepScale, DefaultGravity, "hue:120", 0, 0, 0, 0, 0}
+	c := color.NRGBAModel.Convert(Transform(img, params).At(0, 0)).(color.NRGBA)
+	if c.G <= c.R || c.G <= c.B || c.A != 128 {
+		t.Errorf("Expected red to turn green, got: %v", c)
+	}
+
+	img.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	params.Filter = "tint:0000ff:100"
+	c = color.NRGBAModel.Convert(Transform(img, params).At(0, 0)).(color.NRGBA)
+	if c != (color.NRGBA{0, 0, 255, 255}) {
+		t.Errorf("Expected white to turn blue, got: %v", c)
+	}
+}
+
+func TestDuotoneFilter(t *testing.T) {
+	params, err := ParseParameters("w_2,h_1,f_duotone:000080:FFFF00", Limits{})
+	if err != nil || params.Filter != "duotone:000080:ffff00" {
+		t.Errorf("Expected a canonical duotone filter, got: %q %v", params.Filter, err)
+	}
+	if IsValidFilter("duotone:000080") {
+		t.Error("Expected duotone with one color to be invalid")
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0, 0, 0, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{255, 255, 255, 255})
+	params.Cropping = CroppingModeKeepScale
+	filtered := Transform(img, params)
+	if c := color.NRGBAModel.Convert(filtered.At(0, 0)); c != (color.NRGBA{0, 0, 128, 255}) {
+		t.Errorf("Expected black to turn dark blue, got: %v", c)
+	}
+	if c := color.NRGBAModel.Convert(filtered.At(1, 0)); c != (color.NRGBA{255, 255, 0, 255}) {
+		t.Errorf("Expected white to turn yellow, got: %v", c)
+	}
+}
+
+func TestVignetteFilter(t *testing.T) {
+	params, err := ParseParameters("w_40,h_20,f_vignette", Limits{})
+	if err != nil || params.Filter != "vignette:50" {
+		t.Errorf("Expected a canonical vignette filter, got: %q %v", params.Filter, err)
+	}
+	if IsValidFilter("vignette:150") {
+		t.Error("Expected a strength above 100 to be invalid")
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 40, 20))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	params, _ = ParseParameters("w_40,h_20,c_k,f_vignette:100", Limits{})
+	vignetted := Transform(img, params)
+	gray := func(x, y int) uint8 {
+		return color.GrayModel.Convert(vignetted.At(x, y)).(color.Gray).Y
+	}
+	if gray(20, 10) != 200 {
+		t.Errorf("Expected the center to be kept, got: %d", gray(20, 10))
+	}
+	if gray(0, 0) > 20 {
+		t.Errorf("Expected a dark corner, got: %d", gray(0, 0))
+	}
+	// The ellipse follows the aspect ratio, edge midpoints are darkened about
+	// alike (pixel centers are a bit closer to the long edges)
+	if diff := int(gray(0, 10)) - int(gray(20, 0)); diff < -10 || diff > 10 {
+		t.Errorf("Expected edge midpoints to match, got: %d and %d", gray(0, 10), gray(20, 0))
+	}
+}
+
+func TestDenoiseFilter(t *testing.T) {
+	params, err := ParseParameters("w_20,h_20,f_denoise", Limits{})
+	if err != nil || params.Filter != "denoise:30" || !appliesBeforeResizing(params.Filter) {
+		t.Errorf("Expected a canonical denoise filter, got: %q %v", params.Filter, err)
+	}
+	if IsValidFilter("denoise:0") {
+		t.Error("Expected a strength of 0 to be invalid")
+	}
+
+	// Noisy flat areas are smoothed, the edge between them is kept
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			v := uint8(40)
+			if x >= 10 {
+				v = 220
+			}
+			v += uint8((x*7+y*13)%9) - 4
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	params, _ = ParseParameters("w_20,h_20,c_k,f_denoise:40", Limits{})
+	denoised := Transform(img, params)
+	variation := func(img image.Image) int {
+		low, high := 255, 0
+		for y := 2; y < 18; y++ {
+			for x := 2; x < 8; x++ {
+				v := int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+				if v < low {
+					low = v
+				}
+				if v > high {
+					high = v
+				}
+			}
+		}
+		return high - low
+	}
+	if variation(denoised) >= variation(img) {
+		t.Errorf("Expected less noise, got a variation of %d (%d)", variation(denoised), variation(img))
+	}
+	if c := color.GrayModel.Convert(denoised.At(10, 10)).(color.Gray); c.Y < 200 {
+		t.Errorf("Expected the edge to be kept, got: %v", c)
+	}
+}
+
+func TestFilterChains(t *testing.T) {
+	params, err := ParseParameters("w_1,h_1,f_Tint:F00:40|hue:-90|denoise", Limits{})
+	if err != nil || params.Filter != "tint:ff0000:40|hue:270|denoise:30" {
+		t.Errorf("Expected a canonical chain, got: %q %v", params.Filter, err)
+	}
+	for _, value := range []string{"grayscale|", "|grayscale", "grayscale|sepia", "grayscale||hue:90"} {
+		if IsValidFilter(value) {
+			t.Errorf("Expected %q to be invalid", value)
+		}
+	}
+	if before, after := splitFilterChain("grayscale|denoise:30|vignette:50"); before != "denoise:30" || after != "grayscale|vignette:50" {
+		t.Errorf("Unexpected split: %q %q", before, after)
+	}
+
+	// Tinting a grayscale image keeps the tint, the other way round it's lost
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{128, 128, 128, 255})
+	params = Params{1, 1, 1, CroppingModeKeepScale, DefaultGravity, "grayscale|tint:ff0000:100", 0, 0, 0, 0, 0}
+	if c := color.NRGBAModel.Convert(Transform(img, params).At(0, 0)).(color.NRGBA); c.R <= c.G {
+		t.Errorf("Expected a red tint, got: %v", c)
+	}
+	params.Filter = "tint:ff0000:100|grayscale"
+	if c := color.NRGBAModel.Convert(Transform(img, params).At(0, 0)).(color.NRGBA); c.R != c.G || c.G != c.B {
+		t.Errorf("Expected a grey pixel, got: %v", c)
+	}
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"image"
+	"math"
+)
+
+// Geometry describes how Transform crops and resizes an image, it lets other
+// implementations (e.g. native libraries) produce the same result
+type Geometry struct {
+	// Part of the original image which is kept
+	Crop image.Rectangle
+	// Size of the result, the cropped part is resized to it
+	Width, Height int
+}
+
+// Enlarges reports whether the cropped part of an image is enlarged
+func (g Geometry) Enlarges() bool {
+	return g.Width > g.Crop.Dx() || g.Height > g.Crop.Dy()
+}
+
+// Plan works out how an image of the given size is cropped and resized
+// according to the parameters
+func Plan(parameters Params, imgWidth, imgHeight int) Geometry {
+	width := parameters.Width
+	height := parameters.Height
+	full := image.Rect(0, 0, imgWidth, imgHeight)
+
+	// Scaling factor
+	if parameters.Cropping != CroppingModeKeepScale {
+		width *= parameters.Scale
+		height *= parameters.Scale
+	}
+
+	switch parameters.Cropping {
+	case CroppingModeAll:
+		if float32(width)*(float32(imgHeight)/float32(imgWidth)) > float32(height) {
+			// Keep height
+			width = 0
+		} else {
+			// Keep width
+			height = 0
+		}
+		fallthrough
+	case CroppingModeExact:
+		width, height = fillInSize(width, height, imgWidth, imgHeight)
+		return Geometry{full, width, height}
+	case CroppingModeMinimum:
+		// With a single dimension the other one follows from it
+		if width != 0 && height != 0 {
+			if float32(width)*(float32(imgHeight)/float32(imgWidth)) > float32(height) {
+				// Keep width, the height is bigger than asked for
+				height = 0
+			} else {
+				// Keep height, the width is bigger than asked for
+				width = 0
+			}
+		}
+		width, height = fillInSize(width, height, imgWidth, imgHeight)
+		return Geometry{full, width, height}
+	case CroppingModePart:
+		var croppedWidth, croppedHeight int
+		if float32(width)*(float32(imgHeight)/float32(imgWidth)) > float32(height) {
+			// Whole width displayed
+			croppedWidth = imgWidth
+			croppedHeight = int((float32(imgWidth) / float32(width)) * float32(height))
+		} else {
+			// Whole height displayed
+			croppedWidth = int((float32(imgHeight) / float32(height)) * float32(width))
+			croppedHeight = imgHeight
+		}
+		croppedWidth, croppedHeight = zoomCrop(croppedWidth, croppedHeight, parameters.Zoom, imgWidth, imgHeight)
+		return Geometry{safeCrop(parameters, croppedWidth, croppedHeight, imgWidth, imgHeight), width, height}
+	case CroppingModeKeepScale:
+		// If passed in dimensions are bigger use those of the image
+		if width > imgWidth {
+			width = imgWidth
+		}
+		if height > imgHeight {
+			height = imgHeight
+		}
+		croppedWidth, croppedHeight := zoomCrop(width, height, parameters.Zoom, imgWidth, imgHeight)
+		return Geometry{safeCrop(parameters, croppedWidth, croppedHeight, imgWidth, imgHeight), width, height}
+	}
+	return Geometry{full, imgWidth, imgHeight}
+}
+
+// fillInSize replaces a zero dimension with one keeping the aspect ratio of
+// the image, rounded the way the resize package does it
+func fillInSize(width, height, imgWidth, imgHeight int) (int, int) {
+	switch {
+	case width == 0 && height == 0:
+		return imgWidth, imgHeight
+	case width == 0:
+		scale := float64(imgHeight) / float64(height)
+		return int(0.7 + float64(imgWidth)/scale), height
+	case height == 0:
+		scale := float64(imgWidth) / float64(width)
+		return width, int(0.7 + float64(imgHeight)/scale)
+	}
+	return width, height
+}
+
+// zoomCrop scales the size of the part of an image which is kept by 1/zoom,
+// a part which would be bigger than the image is shrunk to fit it keeping its
+// aspect ratio
+func zoomCrop(width, height int, zoom float64, imgWidth, imgHeight int) (int, int) {
+	if zoom == 0 {
+		return width, height
+	}
+	zoomedWidth, zoomedHeight := float64(width)/zoom, float64(height)/zoom
+	if fit := math.Min(float64(imgWidth)/zoomedWidth, float64(imgHeight)/zoomedHeight); fit < 1 {
+		zoomedWidth *= fit
+		zoomedHeight *= fit
+	}
+	return int(math.Max(1, math.Round(zoomedWidth))), int(math.Max(1, math.Round(zoomedHeight)))
+}
+
+// safeCrop places the part of an image of the given size which is kept
+// according to the gravity. With a safe zone the part is first enlarged,
+// keeping its aspect ratio, until it covers the zone and then moved over it,
+// as far as the image allows.
+func safeCrop(parameters Params, width, height, imgWidth, imgHeight int) image.Rectangle {
+	if parameters.SafeZone == 0 {
+		return image.Rect(0, 0, width, height).Add(gravityPoint(parameters.Gravity, width, height, imgWidth, imgHeight))
+	}
+	zoneWidth := int(math.Max(1, math.Round(float64(imgWidth)*parameters.SafeZone/100)))
+	zoneHeight := int(math.Max(1, math.Round(float64(imgHeight)*parameters.SafeZone/100)))
+	zone := image.Rect(0, 0, zoneWidth, zoneHeight).Add(gravityPoint(parameters.Gravity, zoneWidth, zoneHeight, imgWidth, imgHeight))
+
+	if cover := math.Max(float64(zoneWidth)/float64(width), float64(zoneHeight)/float64(height)); cover > 1 {
+		coveringWidth, coveringHeight := float64(width)*cover, float64(height)*cover
+		if fit := math.Min(float64(imgWidth)/coveringWidth, float64(imgHeight)/coveringHeight); fit < 1 {
+			coveringWidth *= fit
+			coveringHeight *= fit
+		}
+		width, height = int(math.Max(1, math.Round(coveringWidth))), int(math.Max(1, math.Round(coveringHeight)))
+	}
+
+	pt := gravityPoint(parameters.Gravity, width, height, imgWidth, imgHeight)
+	if width >= zone.Dx() {
+		pt.X = clampInt(pt.X, zone.Max.X-width, zone.Min.X)
+	}
+	if height >= zone.Dy() {
+		pt.Y = clampInt(pt.Y, zone.Max.Y-height, zone.Min.Y)
+	}
+	pt.X = clampInt(pt.X, 0, imgWidth-width)
+	pt.Y = clampInt(pt.Y, 0, imgHeight-height)
+	return image.Rect(0, 0, width, height).Add(pt)
+}
+
+// gravityPoint returns where the part of an image of the given size which is
+// kept starts, moved by the gravity's offsets as far as the image allows
+func gravityPoint(str string, width, height, imgWidth, imgHeight int) image.Point {
+	g, err := parseGravity(str)
+	if err != nil {
+		g = gravity{name: str}
+	}
+	pt := calculateTopLeftPointFromGravity(g.name, width, height, imgWidth, imgHeight)
+	if g.xp {
+		g.x = g.x * imgWidth / 100
+	}
+	if g.yp {
+		g.y = g.y * imgHeight / 100
+	}
+	pt = pt.Add(image.Pt(g.x, g.y))
+	pt.X = clampInt(pt.X, 0, imgWidth-width)
+	pt.Y = clampInt(pt.Y, 0, imgHeight-height)
+	return pt
+}
+
+func clampInt(value, min, max int) int {
+	if value > max {
+		value = max
+	}
+	if value < min {
+		value = min
+	}
+	return value
+}
@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"image"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		params   Params
+		expected Geometry
+	}{
+		{Params{400, 300, 1, CroppingModeExact, GravityNorth, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 400, 300}},
+		{Params{400, 0, 1, CroppingModeExact, GravityNorth, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 400, 200}},
+		{Params{200, 200, 2, CroppingModeAll, GravityNorth, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 400, 200}},
+		{Params{100, 100, 1, CroppingModePart, GravityCenter, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(200, 0, 600, 400), 100, 100}},
+		{Params{100, 100, 1, CroppingModePart, GravityWest, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 400, 400), 100, 100}},
+		{Params{100, 100, 2, CroppingModeKeepScale, GravitySouthEast, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(700, 300, 800, 400), 100, 100}},
+		{Params{1000, 100, 1, CroppingModeKeepScale, GravityNorth, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 800, 100), 800, 100}},
+		{Params{100, 100, 1, CroppingModePart, GravityCenter, DefaultFilter, 0, 0, 2, 0, 0}, Geometry{image.Rect(300, 100, 500, 300), 100, 100}},
+		{Params{100, 100, 1, CroppingModePart, GravityCenter, DefaultFilter, 0, 0, 0.5, 0, 0}, Geometry{image.Rect(200, 0, 600, 400), 100, 100}},
+		{Params{200, 100, 1, CroppingModePart, GravityNorthWest, DefaultFilter, 0, 0, 0.5, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 200, 100}},
+		{Params{100, 100, 1, CroppingModeKeepScale, GravitySouthEast, DefaultFilter, 0, 0, 2, 0, 0}, Geometry{image.Rect(750, 350, 800, 400), 100, 100}},
+		{Params{400, 300, 1, CroppingModeExact, GravityNorth, DefaultFilter, 0, 0, 2, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 400, 300}},
+		{Params{100, 100, 1, CroppingModePart, "c:50:-20", DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(250, 0, 650, 400), 100, 100}},
+		{Params{100, 100, 1, CroppingModePart, "w:10p:0", DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(80, 0, 480, 400), 100, 100}},
+		{Params{100, 100, 1, CroppingModePart, "e:50:0", DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(400, 0, 800, 400), 100, 100}},
+		{Params{100, 100, 1, CroppingModeKeepScale, "nw:30:-10p", DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(30, 0, 130, 100), 100, 100}},
+		{Params{100, 100, 1, CroppingModeKeepScale, "c:0:25p", DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(350, 250, 450, 350), 100, 100}},
+		{Params{200, 200, 1, CroppingModeMinimum, GravityNorth, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 400, 200}},
+		{Params{400, 100, 1, CroppingModeMinimum, GravityNorth, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 400, 200}},
+		{Params{100, 100, 2, CroppingModeMinimum, GravityNorth, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 400, 200}},
+		{Params{100, 0, 1, CroppingModeMinimum, GravityNorth, DefaultFilter, 0, 0, 0, 0, 0}, Geometry{image.Rect(0, 0, 800, 400), 100, 50}},
+		// Parts are enlarged to cover the safe zone and moved over it
+		{Params{100, 100, 1, CroppingModeKeepScale, GravityCenter, DefaultFilter, 0, 0, 0, 50, 0}, Geometry{image.Rect(200, 0, 600, 400), 100, 100}},
+		{Params{100, 100, 1, CroppingModePart, GravityCenter, DefaultFilter, 0, 0, 4, 25, 0}, Geometry{image.Rect(300, 100, 500, 300), 100, 100}},
+		{Params{100, 100, 1, CroppingModeKeepScale, "e:-100:0", DefaultFilter, 0, 0, 0, 25, 0}, Geometry{image.Rect(500, 100, 700, 300), 100, 100}},
+		{Params{100, 100, 1, CroppingModePart, GravityNorthWest, DefaultFilter, 0, 0, 0, 25, 0}, Geometry{image.Rect(0, 0, 400, 400), 100, 100}},
+		// Zones which can't be covered at the aspect ratio are covered as far as possible
+		{Params{400, 100, 1, CroppingModePart, GravityCenter, DefaultFilter, 0, 0, 0, 80, 0}, Geometry{image.Rect(0, 100, 800, 300), 400, 100}},
+	}
+
+	for _, test := range tests {
+		actual := Plan(test.params, 800, 400)
+		if actual != test.expected {
+			t.Errorf("Plan(%s) = %v, expected %v", test.params.ToString(), actual, test.expected)
+		}
+	}
+}
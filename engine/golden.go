@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Golden JPEG images are decoded to compare them
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+// GoldenMismatchError is returned by CompareGolden when an image differs from
+// its golden image or there is none
+type GoldenMismatchError string
+
+func (e GoldenMismatchError) Error() string {
+	return string(e)
+}
+
+// EncodeDeterministic encodes an image as "jpeg" or "png" the way pixlserv
+// does in deterministic mode, so that the same image always gives the same
+// bytes whichever machine encodes it. JPEG images are encoded with the given
+// options (the encoder's defaults when nil). Images with 16 bits per channel
+// are dithered down to 8.
+func EncodeDeterministic(w io.Writer, img image.Image, format string, options *jpegenc.Options) error {
+	img = Dither(img)
+	switch format {
+	case "jpeg", "jpg":
+		return jpegenc.Encode(w, img, options)
+	case "png":
+		return png.Encode(w, img)
+	}
+	return fmt.Errorf("format %s can't be encoded deterministically", format)
+}
+
+// CompareGolden compares an encoded image with the golden image of the same
+// name in dir, e.g. in tests of transformation presets. With update the
+// golden image is written instead, after an intended change. Mismatches are
+// GoldenMismatchErrors saying how much the images differ.
+func CompareGolden(dir, name string, encoded []byte, update bool) error {
+	goldenPath := filepath.Join(dir, name)
+	if update {
+		return os.WriteFile(goldenPath, encoded, 0644)
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if os.IsNotExist(err) {
+		return GoldenMismatchError(fmt.Sprintf("no golden image %s", goldenPath))
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(golden, encoded) {
+		return nil
+	}
+
+	// Says how much the images differ when both can be decoded
+	a, _, errA := image.Decode(bytes.NewReader(golden))
+	b, _, errB := image.Decode(bytes.NewReader(encoded))
+	if errA != nil || errB != nil {
+		return GoldenMismatchError(fmt.Sprintf("differs from %s", goldenPath))
+	}
+	sizeA, sizeB := a.Bounds().Size(), b.Bounds().Size()
+	if sizeA != sizeB {
+		return GoldenMismatchError(fmt.Sprintf("differs from %s: %dx%d instead of %dx%d", goldenPath, sizeB.X, sizeB.Y, sizeA.X, sizeA.Y))
+	}
+	comparison, err := Compare(a, b, 0)
+	if err != nil {
+		return err
+	}
+	percent := 100 * float64(comparison.DifferentPixels) / float64(sizeA.X*sizeA.Y)
+	return GoldenMismatchError(fmt.Sprintf("differs from %s: %d different pixels (%.2f%%), SSIM %.4f", goldenPath, comparison.DifferentPixels, percent, comparison.SSIM))
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+func TestEncodeDeterministic(t *testing.T) {
+	img := gradientImage(32, 24)
+	for _, format := range []string{"jpeg", "png"} {
+		var a, b bytes.Buffer
+		if err := EncodeDeterministic(&a, img, format, &jpegenc.Options{Quality: 80}); err != nil {
+			t.Fatal(err)
+		}
+		if err := EncodeDeterministic(&b, img, format, &jpegenc.Options{Quality: 80}); err != nil {
+			t.Fatal(err)
+		}
+		if a.Len() == 0 || !bytes.Equal(a.Bytes(), b.Bytes()) {
+			t.Errorf("Expected identical %s images", format)
+		}
+	}
+	if err := EncodeDeterministic(&bytes.Buffer{}, img, "gif", nil); err == nil {
+		t.Error("Expected an error for GIF images")
+	}
+}
+
+func TestCompareGolden(t *testing.T) {
+	dir := t.TempDir()
+
+	var black, white, large bytes.Buffer
+	png.Encode(&black, image.NewGray(image.Rect(0, 0, 10, 10)))
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	img.Pix[0] = 255
+	png.Encode(&white, img)
+	png.Encode(&large, image.NewGray(image.Rect(0, 0, 20, 10)))
+
+	if _, ok := CompareGolden(dir, "a.png", black.Bytes(), false).(GoldenMismatchError); !ok {
+		t.Error("Expected a missing golden image to be a mismatch")
+	}
+	if err := CompareGolden(dir, "a.png", black.Bytes(), true); err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := os.ReadFile(filepath.Join(dir, "a.png")); !bytes.Equal(written, black.Bytes()) {
+		t.Error("Expected the golden image to be written")
+	}
+	if err := CompareGolden(dir, "a.png", black.Bytes(), false); err != nil {
+		t.Errorf("Expected the same image to match, got: %v", err)
+	}
+	err := CompareGolden(dir, "a.png", white.Bytes(), false)
+	if _, ok := err.(GoldenMismatchError); !ok || !strings.Contains(err.Error(), "1 different pixels") {
+		t.Errorf("Expected 1 different pixel, got: %v", err)
+	}
+	err = CompareGolden(dir, "a.png", large.Bytes(), false)
+	if _, ok := err.(GoldenMismatchError); !ok || !strings.Contains(err.Error(), "20x10 instead of 10x10") {
+		t.Errorf("Expected the sizes to differ, got: %v", err)
+	}
+}
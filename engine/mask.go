@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/nfnt/resize"
+)
+
+// Mask cuts an image out with a mask image stretched to its size, so that
+// images get shapes other than rectangles. Opaque masks keep what's under
+// their white parts and cut what's under their black ones (grays fade it),
+// masks with transparency keep what's under their opaque parts. The alpha
+// channel of the image is multiplied by the mask's value, images with 16
+// bits per channel keep them.
+func Mask(img, mask image.Image) image.Image {
+	bounds := img.Bounds()
+	if mask.Bounds().Size() != bounds.Size() {
+		mask = resize.Resize(uint(bounds.Dx()), uint(bounds.Dy()), mask, resize.Bilinear)
+	}
+	coverage := maskCoverage(mask)
+	offset := mask.Bounds().Min.Sub(bounds.Min)
+
+	if IsHighBitDepth(img) {
+		masked := image.NewNRGBA64(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				c.A = uint16(uint32(c.A) * coverage(x+offset.X, y+offset.Y) / 0xffff)
+				masked.SetNRGBA64(x, y, c)
+			}
+		}
+		return masked
+	}
+
+	masked := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			c.A = uint8((uint32(c.A)*coverage(x+offset.X, y+offset.Y) + 0x7fff) / 0xffff)
+			masked.SetNRGBA(x, y, c)
+		}
+	}
+	return masked
+}
+
+// maskCoverage returns how much of the image a mask keeps at each of its
+// pixels, between 0 and 0xffff: the luminance of opaque masks and the alpha
+// of the others
+func maskCoverage(mask image.Image) func(x, y int) uint32 {
+	if opaque, ok := mask.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return func(x, y int) uint32 {
+			return uint32(color.Gray16Model.Convert(mask.At(x, y)).(color.Gray16).Y)
+		}
+	}
+	return func(x, y int) uint32 {
+		_, _, _, a := mask.At(x, y).RGBA()
+		return a
+	}
+}
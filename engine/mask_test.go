@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	// Opaque masks cut out by luminance
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	gray.SetGray(0, 0, color.Gray{255})
+	gray.SetGray(3, 3, color.Gray{128})
+	masked := Mask(img, gray).(*image.NRGBA)
+	for _, c := range []struct {
+		x, y  int
+		alpha uint8
+	}{{0, 0, 255}, {3, 0, 0}, {0, 3, 0}, {3, 3, 128}} {
+		if a := masked.NRGBAAt(c.x, c.y).A; a != c.alpha {
+			t.Errorf("Expected alpha %d at %d,%d, got %d", c.alpha, c.x, c.y, a)
+		}
+	}
+
+	// and are stretched to the image's size
+	small := image.NewUniform(color.Gray{128})
+	stretched := image.NewGray(image.Rect(0, 0, 2, 2))
+	draw.Draw(stretched, stretched.Bounds(), small, image.Point{}, draw.Src)
+	masked = Mask(img, stretched).(*image.NRGBA)
+	if masked.Bounds() != img.Bounds() || masked.NRGBAAt(3, 3).A != 128 {
+		t.Errorf("Expected the mask to cover the image, got %v", masked.NRGBAAt(3, 3))
+	}
+
+	// Masks with transparency cut out by alpha, whatever their colors
+	shape := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	shape.SetNRGBA(1, 2, color.NRGBA{0, 0, 0, 255})
+	masked = Mask(img, shape).(*image.NRGBA)
+	if masked.NRGBAAt(1, 2) != (color.NRGBA{255, 255, 255, 255}) || masked.NRGBAAt(2, 2).A != 0 {
+		t.Errorf("Expected only the mask's opaque pixel to be kept, got %v and %v", masked.NRGBAAt(1, 2), masked.NRGBAAt(2, 2))
+	}
+
+	deep := image.NewRGBA64(image.Rect(0, 0, 4, 4))
+	deep.SetRGBA64(1, 2, color.RGBA64{65535, 0, 0, 65535})
+	if masked, ok := Mask(deep, shape).(*image.NRGBA64); !ok || masked.NRGBA64At(1, 2).A != 65535 {
+		t.Errorf("Expected a 16-bit image, got %v", masked)
+	}
+}
@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+)
+
+// Fade multiplies the alpha channel of an image by an opacity in percent, so
+// that the image can be shown in a lighter state (hovered, disabled) without
+// storing a second version of it. Images with 16 bits per channel keep them.
+func Fade(img image.Image, opacity int) image.Image {
+	if opacity >= MaxOpacity {
+		return img
+	}
+	bounds := img.Bounds()
+
+	if IsHighBitDepth(img) {
+		faded := image.NewNRGBA64(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				c.A = uint16((uint32(c.A)*uint32(opacity) + MaxOpacity/2) / MaxOpacity)
+				faded.SetNRGBA64(x, y, c)
+			}
+		}
+		return faded
+	}
+
+	faded := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			c.A = uint8((int(c.A)*opacity + MaxOpacity/2) / MaxOpacity)
+			faded.SetNRGBA(x, y, c)
+		}
+	}
+	return faded
+}
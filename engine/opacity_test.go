@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseOpacity(t *testing.T) {
+	params, err := ParseParameters("w_10,o_40", Limits{})
+	if err != nil || params.Opacity() != 40 {
+		t.Errorf("Expected an opacity of 40%%, got: %d %v", params.Opacity(), err)
+	}
+	if params.ToString() != "c_e,g_nw,h_0,w_10,f_none,s_1,o_40" || params.Encode() != "w_10,o_40" {
+		t.Errorf("Unexpected strings: %s %s", params.ToString(), params.Encode())
+	}
+
+	// Fully opaque images keep their names
+	params, _ = ParseParameters("w_10,o_100", Limits{})
+	if params.Transparency != 0 || params.ToString() != "c_e,g_nw,h_0,w_10,f_none,s_1" {
+		t.Errorf("Expected no transparency, got: %s", params.ToString())
+	}
+	params, _ = ParseParameters("w_10,o_0", Limits{})
+	if params.Opacity() != 0 || params.ToString() != "c_e,g_nw,h_0,w_10,f_none,s_1,o_0" {
+		t.Errorf("Expected a transparent image, got: %s", params.ToString())
+	}
+
+	for _, parameters := range []string{"w_10,o_-1", "w_10,o_101", "w_10,o_0.5"} {
+		if _, err := ParseParameters(parameters, Limits{}); err == nil {
+			t.Errorf("Expected an error for %s", parameters)
+		}
+	}
+}
+
+func TestFade(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0, 128, 255, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{64, 64, 64, 100})
+
+	faded := Fade(img, 50).(*image.NRGBA)
+	if c := faded.NRGBAAt(0, 0); c != (color.NRGBA{0, 128, 255, 128}) {
+		t.Errorf("Expected the color to be kept at half the alpha, got: %v", c)
+	}
+	if c := faded.NRGBAAt(1, 0); c.A != 50 {
+		t.Errorf("Expected alpha 50, got: %v", c)
+	}
+	if Fade(img, 100) != image.Image(img) {
+		t.Errorf("Expected opaque images to be left as they are")
+	}
+
+	deep := image.NewRGBA64(image.Rect(0, 0, 1, 1))
+	deep.SetRGBA64(0, 0, color.RGBA64{65535, 0, 0, 65535})
+	if faded, ok := Fade(deep, 25).(*image.NRGBA64); !ok || faded.NRGBA64At(0, 0).A != 16384 {
+		t.Errorf("Expected a quarter of the alpha in 16 bits, got: %v", faded)
+	}
+}
@@ -0,0 +1,366 @@
+// Package engine parses pixlserv's transformation parameters and transforms
+// images accordingly. It doesn't depend on the server, its storage or cache
+// so that it can be embedded in other programs.
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Names of the parameters in strings like "w_400,h_300"
+	ParameterWidth    = "w"
+	ParameterHeight   = "h"
+	ParameterCropping = "c"
+	ParameterGravity  = "g"
+	ParameterFilter   = "f"
+	ParameterScale    = "s"
+	ParameterGamma    = "gam"
+	ParameterExposure = "exp"
+	ParameterZoom     = "z"
+	ParameterSafeZone = "sz"
+	ParameterOpacity  = "o"
+
+	// CroppingModeExact crops an image exactly to given dimensions
+	CroppingModeExact = "e"
+	// CroppingModeAll crops an image so that all of it is displayed in a frame of at most given dimensions
+	CroppingModeAll = "a"
+	// CroppingModePart crops an image so that it fills a frame of given dimensions
+	CroppingModePart = "p"
+	// CroppingModeKeepScale crops an image so that it fills a frame of given dimensions, keeps scale
+	CroppingModeKeepScale = "k"
+	// CroppingModeMinimum scales an image so that it covers a frame of at least given dimensions, never crops
+	CroppingModeMinimum = "m"
+
+	GravityNorth     = "n"
+	GravityNorthEast = "ne"
+	GravityEast      = "e"
+	GravitySouthEast = "se"
+	GravitySouth     = "s"
+	GravitySouthWest = "sw"
+	GravityWest      = "w"
+	GravityNorthWest = "nw"
+	GravityCenter    = "c"
+
+	FilterGrayScale = "grayscale"
+
+	DefaultScale        = 1
+	DefaultCroppingMode = CroppingModeExact
+	DefaultGravity      = GravityNorthWest
+	DefaultFilter       = "none"
+
+	// Limits of gamma and exposure (in stops) adjustments
+	MinGamma    = 0.1
+	MaxGamma    = 10
+	MaxExposure = 5
+
+	// Limits of zooming into (above 1) or out of the part of an image which
+	// is kept
+	MinZoom = 0.1
+	MaxZoom = 10
+
+	// Largest safe zone, in percent of an image's width and height
+	MaxSafeZone = 100
+
+	// Opacity, in percent, of images left as they are
+	MaxOpacity = 100
+)
+
+// Params is a struct of parameters specifying an image transformation
+type Params struct {
+	Width, Height, Scale      int
+	Cropping, Gravity, Filter string
+	// Adjustments applied in linear light, 0 leaves an image as it is
+	Gamma, Exposure float64
+	// Zoom scales the part of an image kept by the p and k cropping modes
+	// around its gravity, 0 keeps it as it is
+	Zoom float64
+	// SafeZone is the part of an image around its gravity, in percent of
+	// its width and height, which the p and k cropping modes never cut, 0
+	// for none
+	SafeZone float64
+	// Transparency is 100 minus the opacity, in percent, the alpha channel
+	// of an image is multiplied by, 0 leaves it opaque
+	Transparency int
+}
+
+// Limits restricts the size of transformed images, 0 means no limit
+type Limits struct {
+	MaxWidth, MaxHeight, MaxPixels, MaxScale int
+}
+
+// ToString turns parameters into a unique string for each possible assignment of parameters
+func (p Params) ToString() string {
+	// 0 as a value for width or height means that it will be calculated
+	str := fmt.Sprintf("%s_%s,%s_%s,%s_%d,%s_%d,%s_%s,%s_%d", ParameterCropping, p.Cropping, ParameterGravity, p.Gravity, ParameterHeight, p.Height, ParameterWidth, p.Width, ParameterFilter, p.Filter, ParameterScale, p.Scale)
+	// Only added when set so that names of other images stay the same
+	if p.Gamma != 0 {
+		str += fmt.Sprintf(",%s_%s", ParameterGamma, strconv.FormatFloat(p.Gamma, 'f', -1, 64))
+	}
+	if p.Exposure != 0 {
+		str += fmt.Sprintf(",%s_%s", ParameterExposure, strconv.FormatFloat(p.Exposure, 'f', -1, 64))
+	}
+	if p.Zoom != 0 {
+		str += fmt.Sprintf(",%s_%s", ParameterZoom, strconv.FormatFloat(p.Zoom, 'f', -1, 64))
+	}
+	if p.SafeZone != 0 {
+		str += fmt.Sprintf(",%s_%s", ParameterSafeZone, strconv.FormatFloat(p.SafeZone, 'f', -1, 64))
+	}
+	if p.Transparency != 0 {
+		str += fmt.Sprintf(",%s_%d", ParameterOpacity, p.Opacity())
+	}
+	return str
+}
+
+// HasAdjustments reports whether gamma or exposure are adjusted
+func (p Params) HasAdjustments() bool {
+	return p.Gamma != 0 || p.Exposure != 0
+}
+
+// Opacity returns the opacity, in percent, the alpha channel of an image is
+// multiplied by
+func (p Params) Opacity() int {
+	return MaxOpacity - p.Transparency
+}
+
+// WithScale returns a copy of a Params struct with the scale set to the given value
+func (p Params) WithScale(scale int) Params {
+	return Params{p.Width, p.Height, scale, p.Cropping, p.Gravity, p.Filter, p.Gamma, p.Exposure, p.Zoom, p.SafeZone, p.Transparency}
+}
+
+// ParseParameters turns a string like "w_400,h_300" into a Params struct.
+// Also validates the parameters to make sure they have valid values and
+// the output image fits in the limits.
+// w = width, h = height
+func ParseParameters(parametersStr string, limits Limits) (Params, error) {
+	params := Params{0, 0, DefaultScale, DefaultCroppingMode, DefaultGravity, DefaultFilter, 0, 0, 0, 0, 0}
+	parts := strings.Split(parametersStr, ",")
+	for _, part := range parts {
+		// Like unknown parameters, malformed ones are ignored (see
+		// CheckParameters)
+		keyAndValue := strings.SplitN(part, "_", 2)
+		if len(keyAndValue) != 2 {
+			continue
+		}
+		key := keyAndValue[0]
+		value := keyAndValue[1]
+
+		switch key {
+		case ParameterWidth, ParameterHeight:
+			value, err := strconv.Atoi(value)
+			if err != nil {
+				return params, fmt.Errorf("could not parse value for parameter: %q", key)
+			}
+			if value <= 0 {
+				return params, fmt.Errorf("value %d must be > 0: %q", value, key)
+			}
+			if key == ParameterWidth {
+				params.Width = value
+			} else {
+				params.Height = value
+			}
+		case ParameterCropping:
+			value = strings.ToLower(value)
+			if len(value) > 1 {
+				return params, fmt.Errorf("value %q must have only 1 character", key)
+			}
+			if !IsValidCroppingMode(value) {
+				return params, fmt.Errorf("invalid value for %q", key)
+			}
+			params.Cropping = value
+		case ParameterGravity:
+			value = strings.ToLower(value)
+			gravity, err := parseGravity(value)
+			if err != nil {
+				return params, fmt.Errorf("invalid value for %q: %s", key, err)
+			}
+			params.Gravity = gravity.String()
+		case ParameterFilter:
+			value = strings.ToLower(value)
+			_, canonical, err := lookupFilter(value)
+			if err != nil {
+				return params, fmt.Errorf("invalid value for %q: %s", key, err)
+			}
+			params.Filter = canonical
+		case ParameterGamma:
+			value, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return params, fmt.Errorf("could not parse value for parameter: %q", key)
+			}
+			if value < MinGamma || value > MaxGamma {
+				return params, fmt.Errorf("value %g must be between %g and %g: %q", value, float64(MinGamma), float64(MaxGamma), key)
+			}
+			if value != 1 {
+				params.Gamma = value
+			}
+		case ParameterExposure:
+			value, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return params, fmt.Errorf("could not parse value for parameter: %q", key)
+			}
+			if value < -MaxExposure || value > MaxExposure {
+				return params, fmt.Errorf("value %g must be between %d and %d: %q", value, -MaxExposure, MaxExposure, key)
+			}
+			params.Exposure = value
+		case ParameterZoom:
+			value, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return params, fmt.Errorf("could not parse value for parameter: %q", key)
+			}
+			if value < MinZoom || value > MaxZoom {
+				return params, fmt.Errorf("value %g must be between %g and %g: %q", value, float64(MinZoom), float64(MaxZoom), key)
+			}
+			if value != 1 {
+				params.Zoom = value
+			}
+		case ParameterSafeZone:
+			value, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return params, fmt.Errorf("could not parse value for parameter: %q", key)
+			}
+			if value <= 0 || value > MaxSafeZone {
+				return params, fmt.Errorf("value %g must be > 0 and at most %d: %q", value, MaxSafeZone, key)
+			}
+			params.SafeZone = value
+		case ParameterOpacity:
+			value, err := strconv.Atoi(value)
+			if err != nil {
+				return params, fmt.Errorf("could not parse value for parameter: %q", key)
+			}
+			if value < 0 || value > MaxOpacity {
+				return params, fmt.Errorf("value %d must be between 0 and %d: %q", value, MaxOpacity, key)
+			}
+			params.Transparency = MaxOpacity - value
+		}
+	}
+
+	if params.Width == 0 && params.Height == 0 {
+		return params, fmt.Errorf("both width and height can't be 0")
+	}
+
+	return params, params.CheckLimits(limits)
+}
+
+// CheckParameters reports the parts of a parameters string ParseParameters
+// would ignore or which override each other: unknown keys, parts without a
+// value and keys given more than once, all of them in one error
+func CheckParameters(parametersStr string) error {
+	known := make(map[string]bool)
+	for _, key := range []string{ParameterWidth, ParameterHeight, ParameterCropping, ParameterGravity, ParameterFilter, ParameterScale, ParameterGamma, ParameterExposure, ParameterZoom, ParameterSafeZone, ParameterOpacity} {
+		known[key] = true
+	}
+	seen := make(map[string]bool)
+	var problems []string
+	for _, part := range strings.Split(parametersStr, ",") {
+		keyAndValue := strings.SplitN(part, "_", 2)
+		key := keyAndValue[0]
+		switch {
+		case len(keyAndValue) != 2 || key == "" || keyAndValue[1] == "":
+			problems = append(problems, fmt.Sprintf("malformed parameter %q", part))
+		case !known[key]:
+			problems = append(problems, fmt.Sprintf("unknown parameter %q", part))
+		case seen[key]:
+			problems = append(problems, fmt.Sprintf("duplicate parameter %q", key))
+		}
+		seen[key] = true
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid parameters: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// CheckLimits makes sure the output image isn't bigger than the limits
+// allow, the error names the violated limit
+func (p Params) CheckLimits(limits Limits) error {
+	if limits.MaxScale > 0 && p.Scale > limits.MaxScale {
+		return fmt.Errorf("scale %d exceeds the limit of %d (max-scale)", p.Scale, limits.MaxScale)
+	}
+	width, height := p.Width*p.Scale, p.Height*p.Scale
+	if limits.MaxWidth > 0 && width > limits.MaxWidth {
+		return fmt.Errorf("width %d exceeds the limit of %d (max-width)", width, limits.MaxWidth)
+	}
+	if limits.MaxHeight > 0 && height > limits.MaxHeight {
+		return fmt.Errorf("height %d exceeds the limit of %d (max-height)", height, limits.MaxHeight)
+	}
+	if limits.MaxPixels > 0 && width*height > limits.MaxPixels {
+		return fmt.Errorf("%d pixels exceed the limit of %d (max-pixels)", width*height, limits.MaxPixels)
+	}
+	return nil
+}
+
+// IsValidCroppingMode reports whether str is one of the cropping modes
+func IsValidCroppingMode(str string) bool {
+	return str == CroppingModeExact || str == CroppingModeAll || str == CroppingModePart || str == CroppingModeKeepScale || str == CroppingModeMinimum
+}
+
+// IsValidGravity reports whether str is one of the gravities
+func IsValidGravity(str string) bool {
+	return str == GravityNorth || str == GravityNorthEast || str == GravityEast || str == GravitySouthEast || str == GravitySouth || str == GravitySouthWest || str == GravityWest || str == GravityNorthWest || str == GravityCenter
+}
+
+// GravityName returns a gravity without its offsets, e.g. c for c:50:-20
+func GravityName(str string) string {
+	return strings.SplitN(str, ":", 2)[0]
+}
+
+// gravity is a gravity with offsets moving the part of an image which is
+// kept from where the gravity puts it
+type gravity struct {
+	name   string
+	x, y   int
+	xp, yp bool // Offsets in percent of the image's size
+}
+
+// parseGravity reads a gravity optionally followed by horizontal and vertical
+// offsets in pixels or percent (with p or %), e.g. c:+50:-20 or n:0:10p
+func parseGravity(str string) (gravity, error) {
+	parts := strings.Split(str, ":")
+	g := gravity{name: parts[0]}
+	if !IsValidGravity(g.name) {
+		return g, fmt.Errorf("unknown gravity: %s", g.name)
+	}
+	if len(parts) == 1 {
+		return g, nil
+	}
+	if len(parts) != 3 {
+		return g, fmt.Errorf("gravity offsets need to be like c:+50:-20")
+	}
+	var err error
+	g.x, g.xp, err = parseGravityOffset(parts[1])
+	if err == nil {
+		g.y, g.yp, err = parseGravityOffset(parts[2])
+	}
+	return g, err
+}
+
+func parseGravityOffset(str string) (int, bool, error) {
+	percent := strings.HasSuffix(str, "p") || strings.HasSuffix(str, "%")
+	if percent {
+		str = str[:len(str)-1]
+	}
+	offset, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid gravity offset: %s", str)
+	}
+	if percent && (offset < -100 || offset > 100) {
+		return 0, false, fmt.Errorf("gravity offsets need to be between -100%% and 100%%: %d", offset)
+	}
+	return offset, percent && offset != 0, nil
+}
+
+// String returns the gravity in its canonical form, without zero offsets
+func (g gravity) String() string {
+	if g.x == 0 && g.y == 0 {
+		return g.name
+	}
+	offset := func(value int, percent bool) string {
+		if percent {
+			return strconv.Itoa(value) + "p"
+		}
+		return strconv.Itoa(value)
+	}
+	return g.name + ":" + offset(g.x, g.xp) + ":" + offset(g.y, g.yp)
+}
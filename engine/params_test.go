@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseParameters(t *testing.T) {
+	act, _ := ParseParameters("w_400,h_300", Limits{})
+	exp := Params{400, 300, DefaultScale, DefaultCroppingMode, DefaultGravity, DefaultFilter, 0, 0, 0, 0, 0}
+	if act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, act)
+	}
+
+	act, _ = ParseParameters("w_200,h_300,c_k,g_c", Limits{})
+	exp = Params{200, 300, DefaultScale, CroppingModeKeepScale, GravityCenter, DefaultFilter, 0, 0, 0, 0, 0}
+	if act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, act)
+	}
+}
+
+func TestParseParametersLimits(t *testing.T) {
+	limits := Limits{MaxWidth: 1000, MaxPixels: 500000, MaxScale: 2}
+
+	if _, err := ParseParameters("w_1000,h_500", limits); err != nil {
+		t.Errorf("Expected the parameters to be within limits: %v", err)
+	}
+	if _, err := ParseParameters("w_100000,h_100", limits); err == nil || !strings.Contains(err.Error(), "max-width") {
+		t.Errorf("Expected max-width to be exceeded, got: %v", err)
+	}
+	if _, err := ParseParameters("w_1000,h_1000", limits); err == nil || !strings.Contains(err.Error(), "max-pixels") {
+		t.Errorf("Expected max-pixels to be exceeded, got: %v", err)
+	}
+
+	params, _ := ParseParameters("w_100,h_100", limits)
+	if err := params.WithScale(3).CheckLimits(limits); err == nil || !strings.Contains(err.Error(), "max-scale") {
+		t.Errorf("Expected max-scale to be exceeded, got: %v", err)
+	}
+}
+
+func TestParseZoom(t *testing.T) {
+	params, err := ParseParameters("w_100,h_100,c_p,z_1.5", Limits{})
+	if err != nil || params.Zoom != 1.5 {
+		t.Errorf("Expected a zoom of 1.5, got: %v %v", params.Zoom, err)
+	}
+	if !strings.HasSuffix(params.ToString(), ",z_1.5") {
+		t.Errorf("Expected the zoom in %s", params.ToString())
+	}
+
+	// Not zooming leaves the names of cached images as they were
+	params, _ = ParseParameters("w_100,h_100,c_p,z_1", Limits{})
+	if params.Zoom != 0 || strings.Contains(params.ToString(), "z_") {
+		t.Errorf("Expected no zoom, got: %s", params.ToString())
+	}
+
+	for _, value := range []string{"0", "0.05", "11", "x"} {
+		if _, err := ParseParameters("w_100,z_"+value, Limits{}); err == nil {
+			t.Errorf("Expected an error for z_%s", value)
+		}
+	}
+}
+
+func TestParseSafeZone(t *testing.T) {
+	params, err := ParseParameters("w_100,h_100,c_p,sz_30", Limits{})
+	if err != nil || params.SafeZone != 30 {
+		t.Errorf("Expected a safe zone of 30%%, got: %v %v", params.SafeZone, err)
+	}
+	if !strings.HasSuffix(params.ToString(), ",sz_30") {
+		t.Errorf("Expected the safe zone in %s", params.ToString())
+	}
+	for _, value := range []string{"0", "-5", "101", "x"} {
+		if _, err := ParseParameters("w_100,sz_"+value, Limits{}); err == nil {
+			t.Errorf("Expected an error for sz_%s", value)
+		}
+	}
+}
+
+func TestParseGravityOffsets(t *testing.T) {
+	tests := map[string]string{
+		"c":         "c",
+		"C:+50:-20": "c:50:-20",
+		"n:0:10%":   "n:0:10p",
+		"se:-5p:0p": "se:-5p:0",
+		"w:0:0":     "w",
+	}
+	for value, expected := range tests {
+		params, err := ParseParameters("w_100,h_100,c_p,g_"+value, Limits{})
+		if err != nil || params.Gravity != expected {
+			t.Errorf("g_%s: expected %s, got: %s %v", value, expected, params.Gravity, err)
+		}
+	}
+	if GravityName("c:50:-20") != GravityCenter {
+		t.Error("Expected c to be the name of c:50:-20")
+	}
+
+	for _, value := range []string{"up", "c:50", "c:50:-20:1", "c:x:0", "c:101p:0", "c::"} {
+		if _, err := ParseParameters("w_100,h_100,g_"+value, Limits{}); err == nil {
+			t.Errorf("Expected an error for g_%s", value)
+		}
+	}
+}
+
+func TestCheckParameters(t *testing.T) {
+	for _, valid := range []string{"w_400", "w_400,h_300,c_p,g_c,f_grayscale,s_2,gam_2.2,exp_1,z_1.5"} {
+		if err := CheckParameters(valid); err != nil {
+			t.Errorf("%s: unexpected error: %v", valid, err)
+		}
+	}
+	err := CheckParameters("wd_400,h_300,foo,h_200,c_")
+	if err == nil || err.Error() != `invalid parameters: unknown parameter "wd_400", malformed parameter "foo", duplicate parameter "h", malformed parameter "c_"` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Ignored when not checked
+	if params, err := ParseParameters("w_400,foo,wd_500", Limits{}); err != nil || params.Width != 400 {
+		t.Errorf("Expected malformed and unknown parameters to be ignored: %+v, %v", params, err)
+	}
+}
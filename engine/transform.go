@@ -0,0 +1,351 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"github.com/nfnt/resize"
+)
+
+// Text specifies a text overlay to be applied to an image
+type Text struct {
+	Content, Gravity string
+	X, Y, Size       int
+	Font             *truetype.Font
+	Color            color.Color
+}
+
+// FontMetrics defines font metrics for a Text struct as rounded up integers
+type FontMetrics struct {
+	width, height, ascent, descent float64
+}
+
+// Upscaler enlarges an image to the given size, e.g. using a super-resolution
+// model. The result is resized to exactly that size if it's different.
+type Upscaler func(img image.Image, width, height int) (image.Image, error)
+
+// Set while images are being transformed when the configuration is reloaded
+var upscaler atomic.Pointer[Upscaler]
+
+// SetUpscaler makes Transform enlarge images using fn, nil goes back to
+// bilinear interpolation. Images are enlarged using Lanczos resampling when
+// fn fails, it's up to fn to report its errors.
+func SetUpscaler(fn Upscaler) {
+	upscaler.Store(&fn)
+}
+
+// Transform resizes and crops an image and applies a filter to it as the
+// parameters specify
+func Transform(img image.Image, parameters Params) (imgNew image.Image) {
+	bounds := img.Bounds()
+	geometry := Plan(parameters, bounds.Dx(), bounds.Dy())
+
+	before, after := splitFilterChain(parameters.Filter)
+	// Only the part of the image which is kept is filtered, it keeps its
+	// place so that it's cropped like the image would be
+	if filter, _, err := lookupFilter(before); err == nil {
+		img = filter(subImage(img, geometry.Crop))
+	}
+	filter, _, err := lookupFilter(after)
+	if err != nil {
+		filter = nil
+	}
+
+	// Resize and crop
+	switch parameters.Cropping {
+	case CroppingModeExact, CroppingModeAll, CroppingModeMinimum:
+		imgNew = resizeImage(img, geometry.Width, geometry.Height)
+	case CroppingModePart, CroppingModeKeepScale:
+		croppedRect := image.Rect(0, 0, geometry.Crop.Dx(), geometry.Crop.Dy())
+		imgDraw := newCanvas(img, croppedRect)
+		draw.Draw(imgDraw, croppedRect, img, geometry.Crop.Min, draw.Src)
+
+		imgNew = imgDraw
+		// Zoomed parts of images kept at their scale are resized too
+		if parameters.Cropping == CroppingModePart || croppedRect.Size() != image.Pt(geometry.Width, geometry.Height) {
+			imgNew = resizeImage(imgDraw, geometry.Width, geometry.Height)
+		}
+	}
+
+	// Adjustments are applied before filters so that grayscale images are
+	// adjusted the same way as colored ones
+	if parameters.HasAdjustments() {
+		imgNew = Adjust(imgNew, parameters.Gamma, parameters.Exposure)
+	}
+
+	// Filters
+	if filter != nil {
+		imgNew = filter(imgNew)
+	}
+
+	return
+}
+
+// resizeImage resizes an image to the given size, enlargements are made by
+// the upscaler when there is one
+func resizeImage(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	var fn Upscaler
+	if p := upscaler.Load(); p != nil {
+		fn = *p
+	}
+	if fn == nil || (width <= bounds.Dx() && height <= bounds.Dy()) {
+		return resize.Resize(uint(width), uint(height), img, resize.Bilinear)
+	}
+
+	upscaled, err := fn(img, width, height)
+	if err != nil || upscaled == nil {
+		return resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+	}
+	if upscaled.Bounds().Dx() != width || upscaled.Bounds().Dy() != height {
+		upscaled = resize.Resize(uint(width), uint(height), upscaled, resize.Lanczos3)
+	}
+	return upscaled
+}
+
+// subImage returns the part of an image in the rectangle
+func subImage(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	part := newCanvas(img, rect)
+	draw.Draw(part, rect, img, rect.Min, draw.Src)
+	return part
+}
+
+// ScaleWatermark resizes a watermark made for images of scale 1 for images
+// of the given scale
+func ScaleWatermark(watermark image.Image, scale int) image.Image {
+	bounds := watermark.Bounds()
+	return resize.Resize(uint(bounds.Max.X*scale), uint(bounds.Max.Y*scale), watermark, resize.Bilinear)
+}
+
+// DrawWatermark draws a watermark over an image, it is placed according to
+// gravity and moved by x and y pixels (multiplied by scale) from there
+func DrawWatermark(img, watermarkSrc image.Image, gravity string, x, y, scale int) image.Image {
+	watermarkBounds := watermarkSrc.Bounds()
+	bounds := img.Bounds()
+
+	// Make sure we have a transparent watermark if possible
+	watermark := image.NewRGBA(watermarkBounds)
+	draw.Draw(watermark, watermarkBounds, watermarkSrc, watermarkBounds.Min, draw.Src)
+
+	pt := calculateTopLeftPointFromGravity(gravity, watermarkBounds.Dx(), watermarkBounds.Dy(), bounds.Dx(), bounds.Dy())
+	pt = pt.Add(getTranslation(gravity, x*scale, y*scale))
+	wX := pt.X
+	wY := pt.Y
+
+	watermarkRect := image.Rect(wX, wY, watermarkBounds.Dx()+wX, watermarkBounds.Dy()+wY)
+	finalImage := newCanvas(img, bounds)
+	draw.Draw(finalImage, bounds, img, bounds.Min, draw.Src)
+	draw.Draw(finalImage, watermarkRect, watermark, watermarkBounds.Min, draw.Over)
+	return finalImage
+}
+
+// DrawTexts draws text overlays over an image, their sizes and positions
+// are multiplied by scale
+func DrawTexts(img image.Image, texts []*Text, scale int) (image.Image, error) {
+	bounds := img.Bounds()
+	rgba := newCanvas(img, bounds)
+	draw.Draw(rgba, bounds, img, image.ZP, draw.Src)
+
+	dpi := float64(72) // Multiply this by scale for a baaad time
+
+	c := freetype.NewContext()
+	c.SetDPI(dpi)
+	c.SetClip(rgba.Bounds())
+	c.SetDst(rgba)
+
+	for _, text := range texts {
+		size := float64(text.Size * scale)
+
+		c.SetSrc(image.NewUniform(text.Color))
+		c.SetFont(text.Font)
+		c.SetFontSize(size)
+
+		fontMetrics := text.getFontMetrics(scale)
+		width := int(c.PointToFix32(fontMetrics.width) >> 8)
+		height := int(c.PointToFix32(fontMetrics.height) >> 8)
+
+		pt := calculateTopLeftPointFromGravity(text.Gravity, width, height, bounds.Dx(), bounds.Dy())
+		pt = pt.Add(getTranslation(text.Gravity, text.X*scale, text.Y*scale))
+		x := pt.X
+		y := pt.Y + int(c.PointToFix32(fontMetrics.ascent)>>8)
+
+		_, err := c.DrawString(text.Content, freetype.Pt(x, y))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rgba, nil
+}
+
+// TextBlock draws a text wrapped into lines of at most maxWidth pixels, and
+// at most maxLines lines (0 for any number), on a transparent image. Lines are
+// aligned the way the text's gravity says, the block can be drawn over images
+// with DrawWatermark.
+func TextBlock(text *Text, maxWidth, maxLines int) (image.Image, error) {
+	lines := text.wrap(maxWidth, maxLines)
+	metrics := text.getFontMetrics(1)
+	lineHeight := int(math.Ceil(metrics.height))
+	width := 0
+	for _, line := range lines {
+		if lineWidth := text.lineWidth(line); lineWidth > width {
+			width = lineWidth
+		}
+	}
+	block := image.NewRGBA(image.Rect(0, 0, width, lineHeight*len(lines)))
+
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetClip(block.Bounds())
+	c.SetDst(block)
+	c.SetSrc(image.NewUniform(text.Color))
+	c.SetFont(text.Font)
+	c.SetFontSize(float64(text.Size))
+	ascent := int(math.Ceil(metrics.ascent))
+	for i, line := range lines {
+		x := 0
+		switch text.Gravity {
+		case GravityNorthEast, GravityEast, GravitySouthEast:
+			x = width - text.lineWidth(line)
+		case GravityNorth, GravitySouth, GravityCenter:
+			x = (width - text.lineWidth(line)) / 2
+		}
+		_, err := c.DrawString(line, freetype.Pt(x, i*lineHeight+ascent))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// wrap splits a text into lines of at most maxWidth pixels, words longer than
+// that get a line of their own. The last of maxLines lines (0 for any number)
+// ends with an ellipsis when the text is longer.
+func (t *Text) wrap(maxWidth, maxLines int) []string {
+	lines := make([]string, 0)
+	line := ""
+	for _, word := range strings.Fields(t.Content) {
+		switch {
+		case line == "":
+			line = word
+		case t.lineWidth(line+" "+word) > maxWidth:
+			lines = append(lines, line)
+			line = word
+		default:
+			line += " " + word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	if maxLines > 0 && len(lines) > maxLines {
+		last := lines[maxLines-1]
+		// Words are dropped until the ellipsis fits
+		for t.lineWidth(last+"…") > maxWidth {
+			i := strings.LastIndex(last, " ")
+			if i == -1 {
+				break
+			}
+			last = last[:i]
+		}
+		lines = append(lines[:maxLines-1], last+"…")
+	}
+	return lines
+}
+
+// lineWidth returns the width of a line of the text in pixels, points are
+// pixels at 72 DPI
+func (t *Text) lineWidth(line string) int {
+	measured := *t
+	measured.Content = line
+	return int(math.Ceil(measured.getFontMetrics(1).width))
+}
+
+func (t *Text) getFontMetrics(scale int) FontMetrics {
+	// Adapted from: https://code.google.com/p/plotinum/
+
+	// Converts truetype.FUnit to float64
+	fUnit2Float64 := float64(t.Size) / float64(t.Font.FUnitsPerEm())
+
+	width := 0
+	prev, hasPrev := truetype.Index(0), false
+	for _, rune := range t.Content {
+		index := t.Font.Index(rune)
+		if hasPrev {
+			width += int(t.Font.Kerning(t.Font.FUnitsPerEm(), prev, index))
+		}
+		width += int(t.Font.HMetric(t.Font.FUnitsPerEm(), index).AdvanceWidth)
+		prev, hasPrev = index, true
+	}
+	widthFloat := float64(width) * fUnit2Float64 * float64(scale)
+
+	bounds := t.Font.Bounds(t.Font.FUnitsPerEm())
+	height := float64(bounds.YMax-bounds.YMin) * fUnit2Float64 * float64(scale)
+	ascent := float64(bounds.YMax) * fUnit2Float64 * float64(scale)
+	descent := float64(bounds.YMin) * fUnit2Float64 * float64(scale)
+
+	return FontMetrics{widthFloat, height, ascent, descent}
+}
+
+func calculateTopLeftPointFromGravity(gravity string, width, height, imgWidth, imgHeight int) image.Point {
+	// Assuming width <= imgWidth && height <= imgHeight
+	switch gravity {
+	case GravityNorth:
+		return image.Point{(imgWidth - width) / 2, 0}
+	case GravityNorthEast:
+		return image.Point{imgWidth - width, 0}
+	case GravityEast:
+		return image.Point{imgWidth - width, (imgHeight - height) / 2}
+	case GravitySouthEast:
+		return image.Point{imgWidth - width, imgHeight - height}
+	case GravitySouth:
+		return image.Point{(imgWidth - width) / 2, imgHeight - height}
+	case GravitySouthWest:
+		return image.Point{0, imgHeight - height}
+	case GravityWest:
+		return image.Point{0, (imgHeight - height) / 2}
+	case GravityNorthWest:
+		return image.Point{0, 0}
+	case GravityCenter:
+		return image.Point{(imgWidth - width) / 2, (imgHeight - height) / 2}
+	}
+	panic("This point should not be reached")
+}
+
+// getTranslation returns a point specifying a translation by a given
+// horizontal and vertical offset according to gravity
+func getTranslation(gravity string, h, v int) image.Point {
+	switch gravity {
+	case GravityNorth:
+		return image.Point{0, v}
+	case GravityNorthEast:
+		return image.Point{-h, v}
+	case GravityEast:
+		return image.Point{-h, 0}
+	case GravitySouthEast:
+		return image.Point{-h, -v}
+	case GravitySouth:
+		return image.Point{0, -v}
+	case GravitySouthWest:
+		return image.Point{h, -v}
+	case GravityWest:
+		return image.Point{h, 0}
+	case GravityNorthWest:
+		return image.Point{h, v}
+	case GravityCenter:
+		return image.Point{0, 0}
+	}
+	panic("This point should not be reached")
+}
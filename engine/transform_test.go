@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/golang/freetype"
+)
+
+func TestCalculateTopLeftPointFromGravity(t *testing.T) {
+	exp := image.Point{200, 0}
+	act := calculateTopLeftPointFromGravity(GravityNorth, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("N failed", act, exp)
+	}
+
+	exp = image.Point{400, 0}
+	act = calculateTopLeftPointFromGravity(GravityNorthEast, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("NE failed", act, exp)
+	}
+
+	exp = image.Point{400, 150}
+	act = calculateTopLeftPointFromGravity(GravityEast, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("E failed", act, exp)
+	}
+
+	exp = image.Point{400, 300}
+	act = calculateTopLeftPointFromGravity(GravitySouthEast, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("SE failed", act, exp)
+	}
+	exp = image.Point{200, 300}
+	act = calculateTopLeftPointFromGravity(GravitySouth, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("S failed", act, exp)
+	}
+	exp = image.Point{0, 300}
+	act = calculateTopLeftPointFromGravity(GravitySouthWest, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("SW failed", act, exp)
+	}
+	exp = image.Point{0, 150}
+	act = calculateTopLeftPointFromGravity(GravityWest, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("W failed", act, exp)
+	}
+
+	exp = image.Point{0, 0}
+	act = calculateTopLeftPointFromGravity(GravityNorthWest, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("NW failed", act, exp)
+	}
+
+	exp = image.Point{200, 150}
+	act = calculateTopLeftPointFromGravity(GravityCenter, 400, 300, 800, 600)
+	if act != exp {
+		t.Errorf("C failed", act, exp)
+	}
+}
+
+func TestUpscaler(t *testing.T) {
+	defer SetUpscaler(nil)
+	calls := 0
+	SetUpscaler(func(img image.Image, width, height int) (image.Image, error) {
+		calls++
+		return image.NewGray(image.Rect(0, 0, width*2, height*2)), nil
+	})
+
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	params, _ := ParseParameters("w_5,h_5", Limits{})
+	Transform(img, params)
+	if calls != 0 {
+		t.Error("Expected downscaling not to use the upscaler")
+	}
+
+	params, _ = ParseParameters("w_20,h_20", Limits{})
+	if bounds := Transform(img, params).Bounds(); calls != 1 || bounds.Dx() != 20 || bounds.Dy() != 20 {
+		t.Errorf("Expected an upscaled image of 20x20, got: %v (%d calls)", bounds, calls)
+	}
+
+	// Failures fall back to resampling
+	SetUpscaler(func(img image.Image, width, height int) (image.Image, error) {
+		return nil, errors.New("unavailable")
+	})
+	if bounds := Transform(img, params).Bounds(); bounds.Dx() != 20 || bounds.Dy() != 20 {
+		t.Errorf("Expected an image of 20x20, got: %v", bounds)
+	}
+}
+
+func TestZoomKeepingScale(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	params, _ := ParseParameters("w_100,h_50,c_k,g_c,z_2", Limits{})
+	zoomed := Transform(img, params)
+	if zoomed.Bounds() != image.Rect(0, 0, 100, 50) {
+		t.Errorf("Expected the zoomed part to keep the size, got: %v", zoomed.Bounds())
+	}
+}
+
+func TestTextWrap(t *testing.T) {
+	fontBytes, err := ioutil.ReadFile("../fonts/DejaVuSans.ttf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	font, err := freetype.ParseFont(fontBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := &Text{Content: "The quick  brown fox jumps over the lazy dog", Gravity: GravitySouthWest, Size: 20, Font: font, Color: color.White}
+	maxWidth := text.lineWidth("The quick brown fox")
+
+	lines := text.wrap(maxWidth, 0)
+	if len(lines) < 2 || lines[0] != "The quick brown fox" || strings.Join(lines, " ") != "The quick brown fox jumps over the lazy dog" {
+		t.Errorf("Unexpected lines: %q", lines)
+	}
+	for _, line := range lines {
+		if text.lineWidth(line) > maxWidth {
+			t.Errorf("Line %q is wider than %d", line, maxWidth)
+		}
+	}
+	lines = text.wrap(maxWidth, 1)
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], "…") || text.lineWidth(lines[0]) > maxWidth {
+		t.Errorf("Expected a single line ending with an ellipsis: %q", lines)
+	}
+	if lines := (&Text{Content: "Supercalifragilistic", Size: 20, Font: font}).wrap(10, 0); len(lines) != 1 {
+		t.Errorf("Expected long words to be kept whole: %q", lines)
+	}
+
+	block, err := TextBlock(text, maxWidth, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Bounds().Dx() > maxWidth || block.Bounds().Dy() != 2*int(math.Ceil(text.getFontMetrics(1).height)) {
+		t.Errorf("Unexpected block size: %v", block.Bounds())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/golang/freetype/truetype"
+)
+
+const (
+	// Size of error images when the parameters don't give one
+	defaultErrorImageWidth  = 400
+	defaultErrorImageHeight = 300
+
+	maxErrorImageSize = 2000
+	minErrorImageSize = 50
+)
+
+var (
+	errorImageWidthRe  = regexp.MustCompile("(?:^|,)" + engine.ParameterWidth + "_(\\d+)")
+	errorImageHeightRe = regexp.MustCompile("(?:^|,)" + engine.ParameterHeight + "_(\\d+)")
+
+	errorImageBackground = color.RGBA{0xee, 0xee, 0xee, 0xff}
+	errorImageForeground = color.RGBA{0xb0, 0x00, 0x20, 0xff}
+)
+
+// errorImageDimensions returns the size of an error image for a parameters
+// string, also when it isn't valid, a missing dimension follows a 4:3 ratio
+func errorImageDimensions(parametersStr string) (int, int) {
+	width, height := 0, 0
+	if matches := errorImageWidthRe.FindStringSubmatch(parametersStr); matches != nil {
+		width, _ = strconv.Atoi(matches[1])
+	}
+	if matches := errorImageHeightRe.FindStringSubmatch(parametersStr); matches != nil {
+		height, _ = strconv.Atoi(matches[1])
+	}
+	switch {
+	case width == 0 && height == 0:
+		width, height = defaultErrorImageWidth, defaultErrorImageHeight
+	case width == 0:
+		width = height * 4 / 3
+	case height == 0:
+		height = width * 3 / 4
+	}
+	return clampErrorImageSize(width), clampErrorImageSize(height)
+}
+
+func clampErrorImageSize(size int) int {
+	if size < minErrorImageSize {
+		return minErrorImageSize
+	}
+	if size > maxErrorImageSize {
+		return maxErrorImageSize
+	}
+	return size
+}
+
+// renderErrorImage draws an error message centred on a PNG image
+func renderErrorImage(width, height int, message string, font *truetype.Font) ([]byte, error) {
+	img, err := renderLabelledImage(width, height, errorImageBackground, errorImageForeground, message, font)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	err = png.Encode(&buffer, img)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// respondWithErrorImage answers a failed image request with an image showing
+// the error at the requested size, the status is kept
+func respondWithErrorImage(res http.ResponseWriter, status int, message, parametersStr string) bool {
+	width, height := errorImageDimensions(parametersStr)
+	data, err := renderErrorImage(width, height, strconv.Itoa(status)+" "+message, currentConfig().defaultFont)
+	if err != nil {
+		return false
+	}
+	res.Header().Set("Content-Type", "image/png")
+	res.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Del("ETag")
+	res.Header().Del("Last-Modified")
+	res.WriteHeader(status)
+	res.Write(data)
+	return true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorImageDimensions(t *testing.T) {
+	cases := []struct {
+		parameters    string
+		width, height int
+	}{
+		{"w_300,h_200", 300, 200},
+		{"h_300,w_x,c_z", 400, 300},
+		{"w_800", 800, 600},
+		{"t_unknown", 400, 300},
+		{"w_10,h_99999", 50, 2000},
+	}
+	for _, c := range cases {
+		width, height := errorImageDimensions(c.parameters)
+		if width != c.width || height != c.height {
+			t.Errorf("%s: expected: %dx%d, actual: %dx%d", c.parameters, c.width, c.height, width, height)
+		}
+	}
+}
+
+func TestRespondWithErrorImage(t *testing.T) {
+	res := httptest.NewRecorder()
+	res.Header().Set("ETag", `"stale"`)
+	if !respondWithErrorImage(res, http.StatusBadRequest, "Unknown transformation: t_x", "w_120,h_80") {
+		t.Fatal("Expected an error image")
+	}
+	if res.Code != http.StatusBadRequest || res.Header().Get("Content-Type") != "image/png" || res.Header().Get("ETag") != "" {
+		t.Errorf("Unexpected response: %d %v", res.Code, res.Header())
+	}
+	img, err := png.Decode(bytes.NewReader(res.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Expected a PNG image: %s", err)
+	}
+	if img.Bounds().Dx() != 120 || img.Bounds().Dy() != 80 {
+		t.Errorf("Expected a 120x80 image, got: %v", img.Bounds())
+	}
+}
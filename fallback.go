@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-martini/martini"
+)
+
+// fallbackWriter responds with the configured status and caching policy
+// instead of those of the fallback image it writes
+type fallbackWriter struct {
+	http.ResponseWriter
+	status       int
+	cacheControl string
+}
+
+func (w *fallbackWriter) WriteHeader(status int) {
+	w.Header().Set("Cache-Control", w.cacheControl)
+	if status == http.StatusOK {
+		status = w.status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// fallbackCacheControl returns the Cache-Control header of fallback images,
+// they shouldn't be cached for long in case the original appears
+func fallbackCacheControl(maxAge int) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return "max-age=" + strconv.Itoa(maxAge)
+}
+
+// serveFallback answers a request for an image which doesn't exist with the
+// configured fallback image transformed the same way, or with an error
+// without one
+func serveFallback(params martini.Params, req *http.Request, res http.ResponseWriter, transformation Transformation, transformationName, baseImagePath string) (int, string) {
+	if currentConfig().fallbackImage == "" || baseImagePath == currentConfig().fallbackImage {
+		return http.StatusNotFound, "Image not found: " + baseImagePath
+	}
+	writer := &fallbackWriter{res, currentConfig().fallbackStatus, fallbackCacheControl(currentConfig().fallbackMaxAge)}
+	return serveImage(params, req, writer, transformation, transformationName, currentConfig().fallbackImage)
+}
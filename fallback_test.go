@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFallbackWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("Cache-Control", "max-age=31536000")
+	writer := &fallbackWriter{recorder, http.StatusNotFound, fallbackCacheControl(0)}
+	writer.WriteHeader(http.StatusOK)
+	if recorder.Code != http.StatusNotFound || recorder.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("Expected a 404 which isn't cached, got: %d %q", recorder.Code, recorder.Header().Get("Cache-Control"))
+	}
+
+	recorder = httptest.NewRecorder()
+	writer = &fallbackWriter{recorder, http.StatusNotFound, fallbackCacheControl(60)}
+	writer.WriteHeader(http.StatusNotModified)
+	if recorder.Code != http.StatusNotModified || recorder.Header().Get("Cache-Control") != "max-age=60" {
+		t.Errorf("Expected other statuses to be kept, got: %d %q", recorder.Code, recorder.Header().Get("Cache-Control"))
+	}
+}
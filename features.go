@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+
+	"github.com/go-martini/martini"
+)
+
+// Version of pixlserv, set at build time with -ldflags "-X main.version=..."
+var version = "1.0"
+
+// VersionResponse is a struct to represent a JSON response for the version handler
+type VersionResponse struct {
+	Status       string          `json:"status"`
+	ErrorMessage string          `json:"errorMessage,omitempty"`
+	Version      string          `json:"version"`
+	GoVersion    string          `json:"goVersion"`
+	Build        map[string]bool `json:"build"`
+	Features     []string        `json:"features,omitempty"`
+}
+
+// buildFeatures tells which optional subsystems were compiled in, those
+// depending on native libraries need build tags
+func buildFeatures() map[string]bool {
+	_, vips := processors["vips"]
+	return map[string]bool{
+		"vips": vips,
+		"avif": isSupportedFormat("avif"),
+		// No face detection is part of pixlserv yet
+		"face-detection": false,
+	}
+}
+
+// activeFeatures returns the optional features a configuration turns on,
+// external commands and hooks included, sorted by name
+func activeFeatures(conf *Configuration) []string {
+	features := map[string]bool{
+		"processing-backend:" + conf.processingBackend: true,
+		"storage:" + conf.storage:                      conf.storage != "",
+		"storage-replicas":                             len(conf.storageReplicas) > 0,
+		"storage-fallbacks":                            len(conf.storageFallbacks) > 0,
+		"cache-paths":                                  len(conf.cachePaths) > 0,
+		"cache-peers":                                  conf.cachePeerURL != "",
+		"edge-push":                                    len(conf.edgePushTargets) > 0,
+		"jpeg-encoder":                                 conf.jpegEncoderCommand != "",
+		"png-optimization":                             conf.pngOptimization != nil,
+		"ffmpeg":                                       conf.ffmpegCommand != "",
+		"large-sources":                                conf.largeSourceCommand != "",
+		"upscaler":                                     conf.upscalerURL != "",
+		"content-safety":                               conf.contentSafetyURL != "",
+		"shadow":                                       conf.shadowConfig != nil,
+		"jwt":                                          conf.jwtAlgorithm != "",
+		"signed-urls":                                  conf.signedURLs,
+		"rate-limit":                                   conf.rateLimitHits != nil || conf.rateLimitMisses != nil,
+		"tls":                                          conf.tlsCertFile != "" || len(conf.autocertDomains) > 0,
+		"http3":                                        conf.http3,
+		"grpc":                                         conf.grpcAddress != "",
+		"admin-address":                                conf.adminAddress != "",
+		"metrics":                                      conf.metrics,
+		"tracing":                                      conf.tracing,
+		"analytics":                                    conf.analytics,
+		"dashboard":                                    conf.dashboard,
+		"debug-endpoints":                              conf.debugEndpoints,
+		"thumbor":                                      conf.thumbor,
+		"imgproxy":                                     conf.imgproxy,
+		"iiif":                                         conf.iiif,
+		"dzi":                                          conf.dzi,
+		"downloads":                                    conf.downloads,
+		"social-cards":                                 len(conf.socialCards) > 0,
+		"placeholders":                                 conf.placeholders,
+		"tenants":                                      len(conf.tenants) > 0,
+		"deduplicate-uploads":                          conf.deduplicateUploads,
+		"deterministic":                                conf.deterministic,
+	}
+	var active []string
+	for name, on := range features {
+		if on {
+			active = append(active, name)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+// versionHandler reports the version and the compiled in subsystems, admins
+// also get the features turned on by the configuration
+func versionHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	response := VersionResponse{Status: "ok", Version: version, GoVersion: runtime.Version(), Build: buildFeatures()}
+	if requestKey(params, req) != "" || req.Header.Get("Authorization") != "" {
+		if !isAuthorised(params, req, AdminPermission) {
+			return jsonResponse(res, http.StatusUnauthorized, VersionResponse{Status: "error", ErrorMessage: "API key invalid or missing"})
+		}
+		response.Features = activeFeatures(currentConfig())
+	}
+	return jsonResponse(res, http.StatusOK, response)
+}
+
+// printFeatures writes the version command's report, the active features
+// only with a configuration
+func printFeatures(w io.Writer, conf *Configuration) {
+	fmt.Fprintf(w, "pixlserv %s (%s)\n", version, runtime.Version())
+	build := buildFeatures()
+	names := make([]string, 0, len(build))
+	for name := range build {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Compiled in:")
+	for _, name := range names {
+		state := "no"
+		if build[name] {
+			state = "yes"
+		}
+		fmt.Fprintf(w, "  %s: %s\n", name, state)
+	}
+	if conf == nil {
+		return
+	}
+	fmt.Fprintln(w, "Active:")
+	for _, name := range activeFeatures(conf) {
+		fmt.Fprintf(w, "  %s\n", name)
+	}
+}
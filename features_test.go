@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestActiveFeatures(t *testing.T) {
+	conf := &Configuration{processingBackend: goProcessor, metrics: true, iiif: true, cachePeerURL: "http://10.0.0.1:3000"}
+	expected := []string{"cache-peers", "iiif", "metrics", "processing-backend:go"}
+	if features := activeFeatures(conf); !reflect.DeepEqual(features, expected) {
+		t.Errorf("Expected %v, got: %v", expected, features)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	oldConfig, oldPermissions := currentConfig(), permissionsByKey
+	defer func() { setConfig(oldConfig); permissionsByKey = oldPermissions }()
+	setConfig(&Configuration{processingBackend: goProcessor, metrics: true})
+	permissionsByKey = map[string]map[string]bool{"ADMIN": {AdminPermission: true}, "KEY": {ReadPermission: true}}
+
+	for _, c := range []struct {
+		key      string
+		status   int
+		features bool
+	}{{"", http.StatusOK, false}, {"ADMIN", http.StatusOK, true}, {"KEY", http.StatusUnauthorized, false}} {
+		res := httptest.NewRecorder()
+		status, body := versionHandler(martini.Params{"apikey": c.key}, httptest.NewRequest("GET", "/version", nil), res)
+		var response VersionResponse
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatal(err)
+		}
+		if status != c.status || (len(response.Features) > 0) != c.features {
+			t.Errorf("Expected %d with features %v for %q, got: %d %s", c.status, c.features, c.key, status, body)
+		}
+		if status == http.StatusOK && (response.Version != version || response.Build == nil) {
+			t.Errorf("Expected the version and build features, got: %s", body)
+		}
+	}
+}
+
+func TestPrintFeatures(t *testing.T) {
+	var buf bytes.Buffer
+	printFeatures(&buf, nil)
+	if !strings.Contains(buf.String(), "  vips: ") || strings.Contains(buf.String(), "Active:") {
+		t.Errorf("Expected only the compiled in subsystems, got: %s", buf.String())
+	}
+	buf.Reset()
+	printFeatures(&buf, &Configuration{processingBackend: goProcessor, grpcAddress: ":3001"})
+	if !strings.Contains(buf.String(), "Active:\n  grpc\n  processing-backend:go\n") {
+		t.Errorf("Expected the active features, got: %s", buf.String())
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// flightGroup makes sure only one call of a function is in progress for
+// a given key at a time. Callers arriving while it runs wait for it and
+// share its result.
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// do calls fn unless a call for the same key is in progress, the last
+// return value reports whether the result was shared with another caller.
+// When fn panics, the callers waiting for it get an error and the panic goes
+// on in the caller which made the call.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error, bool) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.Unlock()
+		call.Wait()
+		return call.value, call.err, true
+	}
+	call := new(flightCall)
+	call.Add(1)
+	g.calls[key] = call
+	g.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			call.err = fmt.Errorf("processing failed: %v", r)
+			g.finish(key, call)
+			panic(r)
+		}
+		g.finish(key, call)
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
+
+// finish hands the result of a call to the callers waiting for it
+func (g *flightGroup) finish(key string, call *flightCall) {
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+	call.Done()
+}
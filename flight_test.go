@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err, _ := g.do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(50 * time.Millisecond)
+				return "result", nil
+			})
+			if err != nil || value != "result" {
+				t.Errorf("Unexpected result: %v, %v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected 1 call, actual: %d", calls)
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup
+	started, waiting := make(chan bool), make(chan error)
+	go func() {
+		defer func() { recover() }()
+		g.do("key", func() (interface{}, error) {
+			close(started)
+			time.Sleep(20 * time.Millisecond)
+			panic("corrupt image")
+		})
+	}()
+	<-started
+	go func() {
+		_, err, _ := g.do("key", func() (interface{}, error) { return "result", nil })
+		waiting <- err
+	}()
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the waiting caller to be released")
+	}
+
+	// Later calls aren't blocked
+	if value, err, _ := g.do("key", func() (interface{}, error) { return "result", nil }); err != nil || value != "result" {
+		t.Errorf("Expected a new call, got: %v, %v", value, err)
+	}
+}
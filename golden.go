@@ -0,0 +1,33 @@
+package main
+
+import "github.com/ReshNesh/pixlserv/engine"
+
+// makeDeterministic turns off what makes the images of identical requests
+// differ between machines and runs: native backends and external encoders,
+// whose output depends on their version, and the original's timestamp.
+// Images are then encoded like engine.EncodeDeterministic encodes them,
+// with the metadata kept.
+func (c *Configuration) makeDeterministic() {
+	c.deterministic = true
+	c.processingBackend = goProcessor
+	c.jpegEncoderCommand = ""
+	c.pngOptimization = nil
+	c.largeSourceCommand = ""
+	keep := make([]uint16, 0, len(c.metadataKeep))
+	for _, tag := range c.metadataKeep {
+		if tag != exifTags["datetime"] {
+			keep = append(keep, tag)
+		}
+	}
+	c.metadataKeep = keep
+}
+
+// transformGolden transforms an image file on disk and compares the result
+// with its golden image in dir, or writes it there with update
+func transformGolden(path, parametersStr, dir string, update bool) error {
+	outputName, encoded, err := transformFileData(path, parametersStr)
+	if err != nil {
+		return err
+	}
+	return engine.CompareGolden(dir, outputName, encoded, update)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+func TestMakeDeterministic(t *testing.T) {
+	conf, err := parseConfig(map[interface{}]interface{}{
+		"deterministic": true,
+		"metadata":      map[interface{}]interface{}{"keep": []interface{}{"DateTime", "Copyright"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.deterministic || conf.processingBackend != goProcessor || conf.pngOptimization != nil {
+		t.Errorf("Expected the Go pipeline without external encoders, got: %+v", conf)
+	}
+	if len(conf.metadataKeep) != 1 || conf.metadataKeep[0] != exifTags["copyright"] {
+		t.Errorf("Expected only the copyright to be kept, got: %v", conf.metadataKeep)
+	}
+}
+
+func TestDeterministicEncoding(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	conf, err := parseConfig(map[interface{}]interface{}{"deterministic": true, "jpeg-quality": 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(conf)
+
+	img := image.NewRGBA64(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	for _, format := range []string{"jpeg", "png"} {
+		var served, library bytes.Buffer
+		if err := writeImage(img, format, &served); err != nil {
+			t.Fatal(err)
+		}
+		options := &jpegenc.Options{Quality: conf.jpegQuality, Subsampling: conf.jpegSubsampling}
+		if err := engine.EncodeDeterministic(&library, img, format, options); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(served.Bytes(), library.Bytes()) {
+			t.Errorf("Expected %s images encoded by the library to be identical to those served", format)
+		}
+	}
+}
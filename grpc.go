@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/pixlservpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Metadata key carrying an API key, tokens are sent using authorization
+	// like in HTTP requests
+	grpcKeyMetadata = "x-pixlserv-key"
+
+	// Size of the chunks transformed images are streamed in
+	grpcChunkSize = 64 * 1024
+)
+
+var grpcServerImpl *grpc.Server
+
+// grpcServer implements the gRPC API, it offers what the HTTP API does for
+// image transformations, uploads and purging
+type grpcServer struct{}
+
+// grpcInit starts serving the gRPC API when an address is configured
+func grpcInit() error {
+	if currentConfig().grpcAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", currentConfig().grpcAddress)
+	if err != nil {
+		return err
+	}
+
+	// Uploads are streamed in chunks, only they need to fit in a message
+	grpcServerImpl = grpc.NewServer(grpc.MaxRecvMsgSize(grpcChunkSize + 1024))
+	pixlservpb.RegisterPixlservServer(grpcServerImpl, grpcServer{})
+	go func() {
+		slog.Info("serving gRPC", "address", currentConfig().grpcAddress)
+		err := grpcServerImpl.Serve(listener)
+		if err != nil {
+			slog.Error("serving gRPC failed", "address", currentConfig().grpcAddress, "error", err)
+		}
+	}()
+	return nil
+}
+
+func grpcCleanUp() {
+	if grpcServerImpl != nil {
+		grpcServerImpl.GracefulStop()
+	}
+}
+
+// grpcAuthorised checks the credentials sent in a call's metadata
+func grpcAuthorised(ctx context.Context, permission string) error {
+	key, token := grpcCredentials(ctx)
+	if !credentialsAuthorised(key, token, permission) {
+		return status.Error(codes.PermissionDenied, "API key invalid or missing")
+	}
+	return nil
+}
+
+func grpcCredentials(ctx context.Context) (string, string) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", ""
+	}
+	var key, token string
+	if values := md.Get(grpcKeyMetadata); len(values) > 0 {
+		key = values[0]
+	}
+	if values := md.Get("authorization"); len(values) > 0 {
+		token = parseBearerToken(values[0])
+	}
+	return key, token
+}
+
+// grpcAuditEvent describes an action taken by a call which returned err
+func grpcAuditEvent(ctx context.Context, action, target string, err error) AuditEvent {
+	key, token := grpcCredentials(ctx)
+	event := AuditEvent{
+		Time:     time.Now(),
+		Action:   action,
+		Actor:    auditActor(key, token),
+		Target:   target,
+		Result:   auditSucceeded,
+		Protocol: "grpc",
+	}
+	if err != nil {
+		event.Result = auditFailed
+		if status.Code(err) == codes.PermissionDenied {
+			event.Result = auditDenied
+		}
+	}
+	return event
+}
+
+// grpcError converts errors to statuses with the codes the HTTP API would
+// use status codes for
+func grpcError(err error) error {
+	switch err.(type) {
+	case imageTooLargeError, unsupportedFormatError, invalidUploadError:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case stageTimeoutError:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	if err == ErrNotFound {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if err == errOverloaded {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if err == errContentBlocked {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (grpcServer) TransformImage(req *pixlservpb.TransformImageRequest, stream pixlservpb.Pixlserv_TransformImageServer) error {
+	ctx := stream.Context()
+	key, token := grpcCredentials(ctx)
+	if !accessAuthorised(transformationAccess(currentConfig(), req.Parameters), key, token) {
+		return status.Error(codes.PermissionDenied, "API key invalid or missing")
+	}
+
+	// Like uploads, gRPC requests are served without a tenant
+	imagePath, err := (*Tenant)(nil).storagePath(req.ImagePath)
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	transformation, _, baseImagePath, err := resolveTransformation(currentConfig(), req.Parameters, imagePath)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	transformation = transformation.withTextVariables(textVariables(key, nil, "", time.Now()))
+	fullImagePath, _ := transformation.createFilePath(baseImagePath)
+
+	data, err := transformedImage(ctx, fullImagePath, baseImagePath, transformation)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	chunks := splitChunks(data, grpcChunkSize)
+	for i, chunk := range chunks {
+		message := &pixlservpb.ImageChunk{Data: chunk}
+		if i == 0 {
+			message.ContentType = http.DetectContentType(data)
+			message.Size = int64(len(data))
+		}
+		if err := stream.Send(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transformedImage returns an encoded transformed image from one of the
+// caches or generates it, personalised images are always generated
+func transformedImage(ctx context.Context, fullImagePath, baseImagePath string, transformation Transformation) ([]byte, error) {
+	if transformation.personalised {
+		generated, err := generatePersonalisedImage(ctx, fullImagePath, baseImagePath, transformation)
+		if err != nil {
+			return nil, err
+		}
+		return generated.data, nil
+	}
+	if data, ok := cachedInMemory(fullImagePath); ok {
+		cacheUpdateLastAccess(cacheKey(fullImagePath))
+		cacheRecordHit(len(data))
+		return data, nil
+	}
+	cached, err := openFromCache(fullImagePath)
+	if err == nil {
+		defer cached.Close()
+		data, err := ioutil.ReadAll(cached)
+		if err != nil {
+			return nil, err
+		}
+		hotCache.put(fullImagePath, data)
+		cacheRecordHit(len(data))
+		return data, nil
+	}
+
+	if isKnownMissing(baseImagePath) {
+		return nil, ErrNotFound
+	}
+	// The shared call doesn't stop when the caller which made it is
+	// cancelled since others wait for it, like in serveImage
+	generated, err, _ := inFlight.do(fullImagePath, func() (interface{}, error) {
+		return generateImage(context.WithoutCancel(ctx), fullImagePath, baseImagePath, transformation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return generated.(*generatedImage).data, nil
+}
+
+// splitChunks splits data into chunks of at most size bytes, there is always
+// at least one chunk
+func splitChunks(data []byte, size int) [][]byte {
+	chunks := make([][]byte, 0, len(data)/size+1)
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return append(chunks, data)
+}
+
+func (grpcServer) GetInfo(ctx context.Context, req *pixlservpb.GetInfoRequest) (*pixlservpb.ImageInfo, error) {
+	if err := grpcAuthorised(ctx, ReadPermission); err != nil {
+		return nil, err
+	}
+
+	imagePath, err := (*Tenant)(nil).storagePath(req.ImagePath)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	source, err := sourceMetadata(imagePath)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	variants, err := cachedVariants(imagePath)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &pixlservpb.ImageInfo{
+		ImagePath:      req.ImagePath,
+		Format:         source.Format,
+		Width:          int32(source.Width),
+		Height:         int32(source.Height),
+		Size:           source.Size,
+		Modified:       source.ModTime.Unix(),
+		CachedVariants: int32(len(variants)),
+	}, nil
+}
+
+func (grpcServer) Purge(ctx context.Context, req *pixlservpb.PurgeRequest) (_ *pixlservpb.PurgeResponse, err error) {
+	if auditEnabled() {
+		defer func() { writeAudit(grpcAuditEvent(ctx, auditPurge, req.ImagePath, err)) }()
+	}
+	if err := grpcAuthorised(ctx, AdminPermission); err != nil {
+		return nil, err
+	}
+
+	removed, err := purgeImage(req.ImagePath)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &pixlservpb.PurgeResponse{Removed: int32(removed)}, nil
+}
+
+func (grpcServer) Upload(stream pixlservpb.Pixlserv_UploadServer) (err error) {
+	ctx := stream.Context()
+	var imagePath string
+	if auditEnabled() {
+		defer func() { writeAudit(grpcAuditEvent(ctx, auditUpload, imagePath, err)) }()
+	}
+	if err := grpcAuthorised(ctx, WritePermission); err != nil {
+		return err
+	}
+
+	var data []byte
+	var first *pixlservpb.UploadRequest
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			first = req
+		}
+		if len(data)+len(req.Data) > currentConfig().uploadMaxFileSize {
+			return status.Error(codes.ResourceExhausted, "max file size exceeded")
+		}
+		data = append(data, req.Data...)
+	}
+	if first == nil {
+		return status.Error(codes.InvalidArgument, "missing image")
+	}
+
+	// Like for HTTP uploads, a signature is needed when using an API key
+	key, token := grpcCredentials(ctx)
+	if key != "" && (currentConfig().jwtAuth == nil || token == "") {
+		err := checkUploadSignature(key, first.Timestamp, first.Signature)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	imagePath, err = storeUpload(bytes.NewReader(data), nil)
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(&pixlservpb.UploadResponse{ImagePath: imagePath})
+}
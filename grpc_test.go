@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitChunks(t *testing.T) {
+	data := []byte("abcdefghij")
+	tests := []struct {
+		size int
+		exp  []string
+	}{
+		{3, []string{"abc", "def", "ghi", "j"}},
+		{5, []string{"abcde", "fghij"}},
+		{20, []string{"abcdefghij"}},
+	}
+	for _, test := range tests {
+		chunks := splitChunks(data, test.size)
+		if len(chunks) != len(test.exp) {
+			t.Errorf("Expected %d chunks of size %d, got: %d", len(test.exp), test.size, len(chunks))
+			continue
+		}
+		for i, chunk := range chunks {
+			if string(chunk) != test.exp[i] {
+				t.Errorf("Expected chunk %d of size %d to be %q, got: %q", i, test.size, test.exp[i], chunk)
+			}
+		}
+	}
+
+	chunks := splitChunks(nil, 3)
+	if len(chunks) != 1 || !bytes.Equal(chunks[0], nil) {
+		t.Errorf("Expected an empty image to be sent in one chunk, got: %d", len(chunks))
+	}
+}
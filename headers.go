@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Parameter asking for an image to be downloaded as a file
+	parameterDownload = "dl"
+
+	maxDownloadFilenameLength = 200 // Bytes
+)
+
+// CacheControl specifies the Cache-Control header sent with images
+type CacheControl struct {
+	maxAge, sMaxAge    int // -1 if not set
+	private, immutable bool
+}
+
+// PathCacheControl is a Cache-Control policy for images under a path prefix
+type PathCacheControl struct {
+	prefix       string
+	cacheControl *CacheControl
+}
+
+// String returns the value of the Cache-Control header
+func (c *CacheControl) String() string {
+	directives := []string{"public"}
+	if c.private {
+		directives[0] = "private"
+	}
+	if c.maxAge >= 0 {
+		directives = append(directives, "max-age="+strconv.Itoa(c.maxAge))
+	}
+	if c.sMaxAge >= 0 && !c.private {
+		directives = append(directives, "s-maxage="+strconv.Itoa(c.sMaxAge))
+	}
+	if c.immutable {
+		directives = append(directives, "immutable")
+	}
+	return strings.Join(directives, ", ")
+}
+
+// parseCacheControl reads a Cache-Control policy from configuration
+func parseCacheControl(m map[interface{}]interface{}) (*CacheControl, error) {
+	c := &CacheControl{-1, -1, false, false}
+
+	if value, ok := m["max-age"]; ok {
+		maxAge, ok := value.(int)
+		if !ok || maxAge < 0 {
+			return nil, fmt.Errorf("invalid max-age: %v", value)
+		}
+		c.maxAge = maxAge
+	}
+	if value, ok := m["s-maxage"]; ok {
+		sMaxAge, ok := value.(int)
+		if !ok || sMaxAge < 0 {
+			return nil, fmt.Errorf("invalid s-maxage: %v", value)
+		}
+		c.sMaxAge = sMaxAge
+	}
+	c.private, _ = m["private"].(bool)
+	c.immutable, _ = m["immutable"].(bool)
+
+	return c, nil
+}
+
+// cacheControlFor returns the Cache-Control header value for an image, the
+// policy of a named transformation takes precedence over the one for the
+// longest matching path prefix and then the default one
+func cacheControlFor(transformation *Transformation, imagePath string) string {
+	if transformation.cacheControl != nil {
+		return transformation.cacheControl.String()
+	}
+	for _, pathCacheControl := range currentConfig().pathCacheControls {
+		if strings.HasPrefix(imagePath, pathCacheControl.prefix) {
+			return pathCacheControl.cacheControl.String()
+		}
+	}
+	if currentConfig().cacheControl != nil {
+		return currentConfig().cacheControl.String()
+	}
+	return ""
+}
+
+// downloadFilename returns a safe name for an image downloaded as a file, the
+// name of the image is used when the requested one has nothing left
+func downloadFilename(requested, imagePath string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, r == 0x7f, r == '"', r == '\\', r == '/', r == ':', r == '*', r == '?', r == '<', r == '>', r == '|':
+			return '_'
+		}
+		return r
+	}, path.Base("/"+requested))
+	name = strings.Trim(name, ". ")
+	if name == "" {
+		name = path.Base("/" + imagePath)
+	}
+	if len(name) > maxDownloadFilenameLength {
+		name = name[:maxDownloadFilenameLength]
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+	return name
+}
+
+// setContentDisposition makes browsers download a response as a file with
+// the given name instead of displaying it
+func setContentDisposition(res http.ResponseWriter, filename string) {
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+}
+
+// imageETag returns a strong ETag for an image's contents
+func imageETag(data []byte) string {
+	sum := sha1.Sum(data)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+// etagMatches reports whether an If-None-Match header value matches an ETag.
+// Weak comparison is used as per RFC 7232.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary adds header names to the Vary header of a response, it should be
+// called whenever a request header affects the response so that caches
+// don't serve it to clients sending different values
+func addVary(res http.ResponseWriter, names ...string) {
+	present := make(map[string]bool)
+	values := make([]string, 0)
+	for _, value := range res.Header()[http.CanonicalHeaderKey("Vary")] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !present[strings.ToLower(name)] {
+				present[strings.ToLower(name)] = true
+				values = append(values, name)
+			}
+		}
+	}
+	for _, name := range names {
+		if !present[strings.ToLower(name)] {
+			present[strings.ToLower(name)] = true
+			values = append(values, http.CanonicalHeaderKey(name))
+		}
+	}
+	res.Header().Set("Vary", strings.Join(values, ", "))
+}
+
+// notModifiedSince reports whether an If-Modified-Since header value is not
+// before the modification time (which is only precise to seconds in headers)
+func notModifiedSince(ifModifiedSince string, modTime time.Time) bool {
+	if ifModifiedSince == "" || modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(t)
+}
+
+// respondWithImage sets caching headers for an image and answers conditional
+// requests with 304 Not Modified and range requests with 206 Partial Content.
+// modTime is the modification time of the original image, it is ignored if
+// zero. The image is written to the response straight away, 0 is returned
+// then.
+func respondWithImage(res http.ResponseWriter, req *http.Request, data []byte, modTime time.Time) (int, string) {
+	_, span := tracer.Start(req.Context(), "respond", trace.WithAttributes(attribute.Int("pixlserv.bytes", len(data))))
+	defer span.End()
+
+	etag := imageETag(data)
+	if notModified(res, req, etag, modTime) {
+		return http.StatusNotModified, ""
+	}
+	r, err := requestedRange(req, int64(len(data)), etag, modTime)
+	if err != nil {
+		res.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+		return http.StatusRequestedRangeNotSatisfiable, ""
+	}
+	res.Header().Set("Content-Type", http.DetectContentType(data))
+	if r != nil {
+		res.Header().Set("Content-Range", r.contentRange(int64(len(data))))
+		res.Header().Set("Content-Length", strconv.FormatInt(r.length, 10))
+		res.WriteHeader(http.StatusPartialContent)
+		res.Write(data[r.start : r.start+r.length])
+		return 0, ""
+	}
+	res.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	res.WriteHeader(http.StatusOK)
+	res.Write(data)
+	return 0, ""
+}
+
+// streamImage responds with a cached image like respondWithImage does but
+// copies it to the response in chunks instead of reading it into memory
+func streamImage(res http.ResponseWriter, req *http.Request, cached *cachedImage, modTime time.Time) (int, string) {
+	_, span := tracer.Start(req.Context(), "respond", trace.WithAttributes(attribute.Int("pixlserv.bytes", cached.size)))
+	defer span.End()
+
+	if notModified(res, req, cached.etag, modTime) {
+		return http.StatusNotModified, ""
+	}
+	r, err := requestedRange(req, int64(cached.size), cached.etag, modTime)
+	if err != nil {
+		res.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", cached.size))
+		return http.StatusRequestedRangeNotSatisfiable, ""
+	}
+	res.Header().Set("Content-Type", contentTypeFor(cached.format))
+	if r != nil {
+		// Storage backends can't all seek, the bytes before the range are
+		// skipped instead
+		_, err = io.CopyN(ioutil.Discard, cached, r.start)
+		if err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+		res.Header().Set("Content-Range", r.contentRange(int64(cached.size)))
+		res.Header().Set("Content-Length", strconv.FormatInt(r.length, 10))
+		res.WriteHeader(http.StatusPartialContent)
+		_, err = io.CopyN(res, cached, r.length)
+	} else {
+		res.Header().Set("Content-Length", strconv.Itoa(cached.size))
+		res.WriteHeader(http.StatusOK)
+		_, err = io.Copy(res, cached)
+	}
+	if err != nil {
+		// Usually the client went away
+		slog.Debug("streaming an image failed", "error", err)
+	}
+	return 0, ""
+}
+
+// notModified sets the ETag, Last-Modified and Accept-Ranges headers of an
+// image and tells whether the request's conditions say the client's copy is
+// up to date
+func notModified(res http.ResponseWriter, req *http.Request, etag string, modTime time.Time) bool {
+	res.Header().Set("ETag", etag)
+	res.Header().Set("Accept-Ranges", "bytes")
+	if !modTime.IsZero() {
+		res.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	// If-None-Match takes precedence when both are present
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	return notModifiedSince(req.Header.Get("If-Modified-Since"), modTime)
+}
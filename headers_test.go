@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := imageETag([]byte("image"))
+
+	cases := []struct {
+		ifNoneMatch string
+		exp         bool
+	}{
+		{"", false},
+		{"*", true},
+		{etag, true},
+		{"W/" + etag, true},
+		{"\"other\", " + etag, true},
+		{"\"other\"", false},
+	}
+	for _, c := range cases {
+		if act := etagMatches(c.ifNoneMatch, etag); act != c.exp {
+			t.Errorf("%q: expected: %v, actual: %v", c.ifNoneMatch, c.exp, act)
+		}
+	}
+}
+
+func TestNotModifiedSince(t *testing.T) {
+	modTime := time.Date(2015, 3, 1, 12, 0, 0, 500, time.UTC)
+
+	cases := []struct {
+		ifModifiedSince string
+		modTime         time.Time
+		exp             bool
+	}{
+		{"", modTime, false},
+		{modTime.Format(http.TimeFormat), modTime, true},
+		{modTime.Add(time.Hour).Format(http.TimeFormat), modTime, true},
+		{modTime.Add(-time.Hour).Format(http.TimeFormat), modTime, false},
+		{modTime.Format(http.TimeFormat), time.Time{}, false},
+		{"invalid", modTime, false},
+	}
+	for _, c := range cases {
+		if act := notModifiedSince(c.ifModifiedSince, c.modTime); act != c.exp {
+			t.Errorf("%q: expected: %v, actual: %v", c.ifModifiedSince, c.exp, act)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	cases := []struct {
+		cacheControl CacheControl
+		exp          string
+	}{
+		{CacheControl{-1, -1, false, false}, "public"},
+		{CacheControl{3600, 86400, false, true}, "public, max-age=3600, s-maxage=86400, immutable"},
+		{CacheControl{60, 86400, true, false}, "private, max-age=60"},
+	}
+	for _, c := range cases {
+		if act := c.cacheControl.String(); act != c.exp {
+			t.Errorf("Expected: %q, actual: %q", c.exp, act)
+		}
+	}
+}
+
+func TestCacheControlFor(t *testing.T) {
+	defer func(c Configuration) { *currentConfig() = c }(*currentConfig())
+	currentConfig().cacheControl = &CacheControl{60, -1, false, false}
+	currentConfig().pathCacheControls = []PathCacheControl{
+		{"avatars/big/", &CacheControl{10, -1, false, false}},
+		{"avatars/", &CacheControl{20, -1, true, false}},
+	}
+	named := &Transformation{cacheControl: &CacheControl{30, -1, false, true}}
+
+	cases := []struct {
+		transformation *Transformation
+		path, exp      string
+	}{
+		{&Transformation{}, "cat.jpg", "public, max-age=60"},
+		{&Transformation{}, "avatars/cat.jpg", "private, max-age=20"},
+		{&Transformation{}, "avatars/big/cat.jpg", "public, max-age=10"},
+		{named, "avatars/cat.jpg", "public, max-age=30, immutable"},
+	}
+	for _, c := range cases {
+		if act := cacheControlFor(c.transformation, c.path); act != c.exp {
+			t.Errorf("%s: expected: %q, actual: %q", c.path, c.exp, act)
+		}
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	res := httptest.NewRecorder()
+	res.Header().Set("Vary", "Accept-Encoding")
+
+	addVary(res, "Origin")
+	addVary(res, "origin", "Save-Data")
+
+	exp := "Accept-Encoding, Origin, Save-Data"
+	if act := res.Header().Get("Vary"); act != exp {
+		t.Errorf("Expected: %q, actual: %q", exp, act)
+	}
+}
+
+func TestStreamImage(t *testing.T) {
+	data := []byte("\x89PNG\r\n\x1a\nimage")
+	etag := imageETag(data)
+	open := func() *cachedImage {
+		return &cachedImage{ioutil.NopCloser(bytes.NewReader(data)), "png", etag, len(data)}
+	}
+
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/image/w_100/cat.png", nil)
+	if status, _ := streamImage(res, req, open(), time.Time{}); status != 0 {
+		t.Fatalf("Expected the response to be written, got status %d", status)
+	}
+	if res.Code != http.StatusOK || res.Body.String() != string(data) {
+		t.Errorf("Expected the image, got: %d %q", res.Code, res.Body.String())
+	}
+	if res.Header().Get("ETag") != etag || res.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Unexpected headers: %v", res.Header())
+	}
+
+	res = httptest.NewRecorder()
+	req.Header.Set("If-None-Match", etag)
+	if status, _ := streamImage(res, req, open(), time.Time{}); status != http.StatusNotModified {
+		t.Errorf("Expected 304 Not Modified, got: %d", status)
+	}
+}
+
+func TestDownloadFilename(t *testing.T) {
+	cases := []struct {
+		requested, imagePath, expected string
+	}{
+		{"cat.jpg", "photos/cat.jpg", "cat.jpg"},
+		{"../../etc/passwd", "cat.jpg", "passwd"},
+		{"my \"best\" cat?.jpg", "cat.jpg", "my _best_ cat_.jpg"},
+		{"..", "photos/cat.jpg", "cat.jpg"},
+		{"chat-noir-é.jpg", "cat.jpg", "chat-noir-é.jpg"},
+	}
+	for _, c := range cases {
+		if name := downloadFilename(c.requested, c.imagePath); name != c.expected {
+			t.Errorf("%q: expected: %q, actual: %q", c.requested, c.expected, name)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	setContentDisposition(res, "chat-noir-é.jpg")
+	if disposition := res.Header().Get("Content-Disposition"); disposition != "attachment; filename*=utf-8''chat-noir-%C3%A9.jpg" {
+		t.Errorf("Unexpected Content-Disposition: %s", disposition)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Checks taking longer than this count as failed
+	readinessTimeout = 5 * time.Second
+
+	// File looked up in the storage to check it can be reached, it doesn't
+	// need to exist
+	readinessProbePath = ".pixlserv-readiness-probe"
+)
+
+// ReadinessResponse is a struct to represent a JSON response for the readiness handler
+type ReadinessResponse struct {
+	Status       string            `json:"status"`
+	ErrorMessage string            `json:"errorMessage,omitempty"`
+	Checks       map[string]string `json:"checks"`
+}
+
+// healthHandler answers liveness probes, the process is alive when it can
+// answer at all
+func healthHandler() (int, string) {
+	return http.StatusOK, "OK"
+}
+
+// readinessHandler answers readiness probes, the server is ready when the
+// storage, redis and, for local storage, the cache directories can be used.
+// Without redis it is only degraded when it still serves reads.
+func readinessHandler(res http.ResponseWriter) (int, string) {
+	checks := map[string]func() error{
+		"storage": checkStorage,
+		"redis":   checkRedis,
+	}
+	if storageName == "local" || len(currentConfig().cachePaths) > 0 {
+		checks["cache-directory"] = checkCacheDirectory
+	}
+
+	response := ReadinessResponse{Status: "ok", Checks: runReadinessChecks(checks, readinessTimeout)}
+	var failed []string
+	for name, result := range response.Checks {
+		if result == "ok" {
+			continue
+		}
+		if name == "redis" && !currentConfig().degradedReadsClosed {
+			response.Status = "degraded"
+			continue
+		}
+		failed = append(failed, name)
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		response.Status = "error"
+		response.ErrorMessage = "not ready: " + strings.Join(failed, ", ")
+		return jsonResponse(res, http.StatusServiceUnavailable, response)
+	}
+	return jsonResponse(res, http.StatusOK, response)
+}
+
+// runReadinessChecks runs checks concurrently and returns "ok" or an error
+// message for each of them
+func runReadinessChecks(checks map[string]func() error, timeout time.Duration) map[string]string {
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func(name string, check func() error) {
+			results <- result{name, check()}
+		}(name, check)
+	}
+
+	statuses := make(map[string]string, len(checks))
+	for name := range checks {
+		statuses[name] = "timed out"
+	}
+	deadline := time.After(timeout)
+	for range checks {
+		select {
+		case r := <-results:
+			statuses[r.name] = "ok"
+			if r.err != nil {
+				statuses[r.name] = r.err.Error()
+			}
+		case <-deadline:
+			return statuses
+		}
+	}
+	return statuses
+}
+
+func checkStorage() error {
+	_, err := storageImpl.Stat(readinessProbePath)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func checkRedis() error {
+	// The shared connection can't be used concurrently with requests
+	conn, err := redisDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("PING")
+	return err
+}
+
+func checkCacheDirectory() error {
+	dirs := currentConfig().cachePaths
+	if storageName == "local" {
+		dirs = append([]string{currentConfig().localPath}, dirs...)
+	}
+	for _, dir := range dirs {
+		err := checkWritableDirectory(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkWritableDirectory(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, readinessProbePath)
+	if err != nil {
+		return fmt.Errorf("not writable: %s", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunReadinessChecks(t *testing.T) {
+	checks := map[string]func() error{
+		"ok":     func() error { return nil },
+		"failed": func() error { return errors.New("connection refused") },
+		"slow": func() error {
+			time.Sleep(time.Second)
+			return nil
+		},
+	}
+
+	statuses := runReadinessChecks(checks, 50*time.Millisecond)
+	exp := map[string]string{"ok": "ok", "failed": "connection refused", "slow": "timed out"}
+	for name, status := range exp {
+		if statuses[name] != status {
+			t.Errorf("Expected check %s to end with %q, got: %q", name, status, statuses[name])
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
+)
+
+// The history of an original is kept in redis as a sorted set of the
+// parameters of its variants by when they were last generated, and a hash of
+// how many times each was generated
+func historyKey(imagePath string) string {
+	return "history:" + imagePath
+}
+
+func historyCountKey(imagePath string) string {
+	return "historycount:" + imagePath
+}
+
+// VariantHistory is a variant of an original which was generated, it isn't
+// necessarily still cached
+type VariantHistory struct {
+	Parameters    string    `json:"parameters"`
+	Generated     int       `json:"generated"`
+	LastGenerated time.Time `json:"lastGenerated"`
+}
+
+// ImageHistoryResponse is a struct to represent a JSON response for the
+// history handler
+type ImageHistoryResponse struct {
+	Status       string           `json:"status"`
+	ErrorMessage string           `json:"errorMessage,omitempty"`
+	Variants     []VariantHistory `json:"variants,omitempty"`
+	Cached       []*CacheEntry    `json:"cached,omitempty"`
+	CachedSize   int              `json:"cachedSize"`
+}
+
+// recordHistory records that a variant of an original was generated, images
+// personalised for one request aren't recorded
+func recordHistory(imagePath string, transformation *Transformation) {
+	if !currentConfig().cacheHistory || transformation.personalised {
+		return
+	}
+	parameters := transformation.cacheParameters()
+	Conn.Do("ZADD", historyKey(imagePath), time.Now().Unix(), parameters)
+	Conn.Do("HINCRBY", historyCountKey(imagePath), parameters, 1)
+}
+
+// imageHistory returns the variants generated of an original, the most
+// recently generated first
+func imageHistory(imagePath string) ([]VariantHistory, error) {
+	values, err := redis.Strings(Conn.Do("ZREVRANGE", historyKey(imagePath), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	counts, err := redis.IntMap(Conn.Do("HGETALL", historyCountKey(imagePath)))
+	if err != nil {
+		return nil, err
+	}
+	return parseHistory(values, counts), nil
+}
+
+// parseHistory turns the members of a history's sorted set with their scores
+// and the counts into variants
+func parseHistory(values []string, counts map[string]int) []VariantHistory {
+	variants := make([]VariantHistory, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		generated, _ := strconv.ParseInt(values[i+1], 10, 64)
+		variants = append(variants, VariantHistory{values[i], counts[values[i]], time.Unix(generated, 0)})
+	}
+	return variants
+}
+
+// historyHandler lists the variants generated of an original and the ones
+// which are cached with their sizes
+func historyHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, ImageHistoryResponse{"error", "API key invalid or missing", nil, nil, 0})
+	}
+
+	tenant := tenantFor(req)
+	imagePath, err := tenant.storagePath(params["_1"])
+	if err != nil {
+		return jsonResponse(res, http.StatusNotFound, ImageHistoryResponse{"error", err.Error(), nil, nil, 0})
+	}
+	variants, err := imageHistory(imagePath)
+	if err != nil {
+		return jsonResponse(res, http.StatusInternalServerError, ImageHistoryResponse{"error", err.Error(), nil, nil, 0})
+	}
+	cachedPaths, err := cachedVariants(imagePath)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, ImageHistoryResponse{"error", err.Error(), nil, nil, 0})
+	}
+
+	sort.Strings(cachedPaths)
+	cached := make([]*CacheEntry, 0, len(cachedPaths))
+	cachedSize := 0
+	for _, cachedPath := range cachedPaths {
+		entry, err := getCacheEntry(cachedPath)
+		if err != nil {
+			// Files in the storage without a record aren't counted
+			continue
+		}
+		cachedSize += entry.Size
+		if tenant != nil {
+			entry.Path = strings.TrimPrefix(entry.Path, tenant.prefix)
+		}
+		cached = append(cached, entry)
+	}
+	return jsonResponse(res, http.StatusOK, ImageHistoryResponse{"ok", "", variants, cached, cachedSize})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestParseHistory(t *testing.T) {
+	values := []string{"c_e,g_c,h_200,w_200,f_none,s_1", "1700000100", "hash_0123", "1700000000"}
+	counts := map[string]int{"c_e,g_c,h_200,w_200,f_none,s_1": 3, "hash_0123": 1}
+	variants := parseHistory(values, counts)
+	if len(variants) != 2 {
+		t.Fatalf("Expected 2 variants, got: %v", variants)
+	}
+	if variants[0].Parameters != "c_e,g_c,h_200,w_200,f_none,s_1" || variants[0].Generated != 3 || !variants[0].LastGenerated.Equal(time.Unix(1700000100, 0)) {
+		t.Errorf("Unexpected variant: %+v", variants[0])
+	}
+	if variants[1].Parameters != "hash_0123" || variants[1].Generated != 1 {
+		t.Errorf("Unexpected variant: %+v", variants[1])
+	}
+	if variants := parseHistory(nil, nil); len(variants) != 0 {
+		t.Errorf("Expected no variants, got: %v", variants)
+	}
+}
+
+func TestHistoryHandlerUnauthorised(t *testing.T) {
+	oldPermissions := permissionsByKey
+	defer func() { permissionsByKey = oldPermissions }()
+	permissionsByKey = map[string]map[string]bool{"KEY": {ReadPermission: true, WritePermission: true}}
+
+	req := httptest.NewRequest("GET", "/KEY/history/cat.jpg", nil)
+	if status, _ := historyHandler(martini.Params{"apikey": "KEY", "_1": "cat.jpg"}, req, httptest.NewRecorder()); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 Unauthorized, got: %d", status)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hotlinkAllowed checks whether an image can be embedded by the page given in
+// a Referer header. Pages served from the same host are always allowed, other
+// ones need to be on an allowed domain ("example.com" or "*.example.com" for
+// all its subdomains).
+func hotlinkAllowed(referer, host string, allowedDomains []string, allowEmpty bool) bool {
+	if referer == "" {
+		return allowEmpty
+	}
+
+	refererURL, err := url.Parse(referer)
+	if err != nil || refererURL.Host == "" {
+		return false
+	}
+	refererHost := strings.ToLower(hostWithoutPort(refererURL.Host))
+	if refererHost == strings.ToLower(hostWithoutPort(host)) {
+		return true
+	}
+
+	for _, domain := range allowedDomains {
+		domain = strings.ToLower(domain)
+		if strings.HasPrefix(domain, "*.") {
+			if strings.HasSuffix(refererHost, domain[1:]) {
+				return true
+			}
+		} else if refererHost == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// checkHotlink responds to requests from pages which aren't allowed to
+// embed images, it reports whether the request was answered
+func checkHotlink(req *http.Request, res http.ResponseWriter) (int, string, bool) {
+	if !currentConfig().hotlinkProtection {
+		return 0, "", false
+	}
+
+	// Responses differ for different pages
+	addVary(res, "Referer")
+	if hotlinkAllowed(req.Referer(), req.Host, currentConfig().hotlinkAllowedDomains, currentConfig().hotlinkAllowEmpty) {
+		return 0, "", false
+	}
+
+	if currentConfig().hotlinkPlaceholder != nil {
+		res.Header().Set("Content-Type", http.DetectContentType(currentConfig().hotlinkPlaceholder))
+		return http.StatusForbidden, string(currentConfig().hotlinkPlaceholder), true
+	}
+	return http.StatusForbidden, "Hotlinking not allowed", true
+}
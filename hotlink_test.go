@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHotlinkAllowed(t *testing.T) {
+	allowed := []string{"example.com", "*.example.org"}
+	cases := []struct {
+		referer string
+		exp     bool
+	}{
+		{"", true},
+		{"https://example.com/page", true},
+		{"https://www.example.com/page", false},
+		{"https://cdn.example.org/page", true},
+		{"https://example.org/page", false},
+		{"https://badexample.org/page", false},
+		{"http://images.local:8080/gallery", true},
+		{"https://evil.com/?example.com", false},
+		{"not a url", false},
+	}
+	for _, c := range cases {
+		if act := hotlinkAllowed(c.referer, "images.local:3000", allowed, true); act != c.exp {
+			t.Errorf("Referer %q: expected %v, actual %v", c.referer, c.exp, act)
+		}
+	}
+
+	if hotlinkAllowed("", "images.local", allowed, false) {
+		t.Error("Expected an empty referer not to be allowed")
+	}
+}
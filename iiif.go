@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+const (
+	iiifContext  = "http://iiif.io/api/image/3/context.json"
+	iiifProtocol = "http://iiif.io/api/image"
+
+	// Cached IIIF images are named like cat--iiif_HASH--.jpg
+	iiifCachePrefix = "iiif_"
+
+	// Size of the tiles viewers are told to request
+	iiifTileSize = 512
+)
+
+var (
+	// Output formats by their IIIF extensions
+	iiifFormats = map[string]string{
+		"jpg": "jpeg",
+		"png": "png",
+	}
+
+	// Features beyond those of level 1
+	iiifExtraFeatures = []string{"regionByPct", "sizeByConfinedWh", "sizeByPct", "sizeUpscaling"}
+
+	// Requests for images end with rotation/quality.format
+	iiifImageRequestRe = regexp.MustCompile(`[^/]+/[^/]+/[^/]+/!?[0-9.]+/\w+\.\w+$`)
+)
+
+// iiifRequestError is returned for requests which aren't valid, the IIIF
+// Image API asks for 400 Bad Request
+type iiifRequestError string
+
+func (e iiifRequestError) Error() string {
+	return string(e)
+}
+
+// iiifNotImplementedError is returned for valid requests using features which
+// aren't supported, the IIIF Image API asks for 501 Not Implemented
+type iiifNotImplementedError string
+
+func (e iiifNotImplementedError) Error() string {
+	return string(e)
+}
+
+// iiifRegion is the part of an image a IIIF request asks for
+type iiifRegion struct {
+	full, square, percent bool
+	x, y, w, h            float64
+}
+
+// iiifSize is the size a IIIF request asks for, width or height is 0 when
+// it is to be calculated
+type iiifSize struct {
+	max, upscale, confined bool
+	percent                float64
+	width, height          int
+}
+
+// iiifRequest is a parsed request for an image like
+// /iiif/cat.jpg/full/max/0/default.jpg
+type iiifRequest struct {
+	identifier                          string
+	region                              iiifRegion
+	size                                iiifSize
+	regionStr, sizeStr, quality, format string
+}
+
+func parseIIIFRegion(region string) (iiifRegion, error) {
+	switch region {
+	case "full":
+		return iiifRegion{full: true}, nil
+	case "square":
+		return iiifRegion{square: true}, nil
+	}
+
+	var r iiifRegion
+	if strings.HasPrefix(region, "pct:") {
+		r.percent = true
+		region = region[len("pct:"):]
+	}
+	values := strings.Split(region, ",")
+	if len(values) != 4 {
+		return r, iiifRequestError("invalid region: " + region)
+	}
+	parsed := make([]float64, 4)
+	for i, value := range values {
+		var err error
+		parsed[i], err = strconv.ParseFloat(value, 64)
+		if err != nil || parsed[i] < 0 || (!r.percent && parsed[i] != math.Trunc(parsed[i])) {
+			return r, iiifRequestError("invalid region: " + region)
+		}
+	}
+	r.x, r.y, r.w, r.h = parsed[0], parsed[1], parsed[2], parsed[3]
+	if r.w == 0 || r.h == 0 {
+		return r, iiifRequestError("empty region: " + region)
+	}
+	return r, nil
+}
+
+// rect returns the region of an image of the given size, parts outside of
+// the image are left out
+func (r iiifRegion) rect(width, height int) (image.Rectangle, error) {
+	bounds := image.Rect(0, 0, width, height)
+	switch {
+	case r.full:
+		return bounds, nil
+	case r.square:
+		side := width
+		if height < side {
+			side = height
+		}
+		return image.Rect(0, 0, side, side).Add(image.Pt((width-side)/2, (height-side)/2)), nil
+	}
+
+	x, y, w, h := r.x, r.y, r.w, r.h
+	if r.percent {
+		x, w = x*float64(width)/100, w*float64(width)/100
+		y, h = y*float64(height)/100, h*float64(height)/100
+	}
+	rect := image.Rect(int(x), int(y), int(math.Round(x+w)), int(math.Round(y+h))).Intersect(bounds)
+	if rect.Empty() {
+		return rect, iiifRequestError("region outside of the image")
+	}
+	return rect, nil
+}
+
+func parseIIIFSize(size string) (iiifSize, error) {
+	var s iiifSize
+	if strings.HasPrefix(size, "^") {
+		s.upscale = true
+		size = size[1:]
+	}
+	if size == "max" {
+		s.max = true
+		return s, nil
+	}
+	if strings.HasPrefix(size, "pct:") {
+		percent, err := strconv.ParseFloat(size[len("pct:"):], 64)
+		if err != nil || percent <= 0 || (percent > 100 && !s.upscale) {
+			return s, iiifRequestError("invalid size: " + size)
+		}
+		s.percent = percent
+		return s, nil
+	}
+	if strings.HasPrefix(size, "!") {
+		s.confined = true
+		size = size[1:]
+	}
+
+	values := strings.Split(size, ",")
+	if len(values) != 2 || (values[0] == "" && values[1] == "") || (s.confined && (values[0] == "" || values[1] == "")) {
+		return s, iiifRequestError("invalid size: " + size)
+	}
+	dimensions := make([]int, 2)
+	for i, value := range values {
+		if value == "" {
+			continue
+		}
+		var err error
+		dimensions[i], err = strconv.Atoi(value)
+		if err != nil || dimensions[i] <= 0 {
+			return s, iiifRequestError("invalid size: " + size)
+		}
+	}
+	s.width, s.height = dimensions[0], dimensions[1]
+	return s, nil
+}
+
+// dimensions returns the size of the image a region of the given size is
+// scaled to, images are only made bigger than the region when the size
+// allows upscaling and never bigger than the limits
+func (s iiifSize) dimensions(width, height int, limits engine.Limits) (int, int, error) {
+	ratio := float64(width) / float64(height)
+	w, h := s.width, s.height
+	switch {
+	case s.max:
+		w, h = width, height
+		if s.upscale && limits.MaxWidth > 0 && limits.MaxHeight > 0 {
+			w, h = limits.MaxWidth, limits.MaxHeight
+			w, h = confine(w, h, ratio)
+		}
+	case s.percent > 0:
+		w = int(math.Round(float64(width) * s.percent / 100))
+		h = int(math.Round(float64(height) * s.percent / 100))
+	case s.confined:
+		w, h = confine(w, h, ratio)
+	case w == 0:
+		w = int(math.Round(float64(h) * ratio))
+	case h == 0:
+		h = int(math.Round(float64(w) / ratio))
+	}
+	if s.max {
+		// max is the biggest size allowed
+		if limits.MaxWidth > 0 && w > limits.MaxWidth || limits.MaxHeight > 0 && h > limits.MaxHeight {
+			w, h = confine(minPositive(w, limits.MaxWidth), minPositive(h, limits.MaxHeight), ratio)
+		}
+		if limits.MaxPixels > 0 && w*h > limits.MaxPixels {
+			scale := math.Sqrt(float64(limits.MaxPixels) / float64(w*h))
+			w, h = int(float64(w)*scale), int(float64(h)*scale)
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	if !s.upscale && (w > width || h > height) {
+		return 0, 0, iiifRequestError("size bigger than the region, use ^ to allow upscaling")
+	}
+	params := engine.Params{Width: w, Height: h, Scale: 1}
+	if err := params.CheckLimits(limits); err != nil {
+		return 0, 0, iiifRequestError(err.Error())
+	}
+	return w, h, nil
+}
+
+// confine returns the biggest size with the given aspect ratio which fits
+// within a width and a height
+func confine(width, height int, ratio float64) (int, int) {
+	if float64(width)/float64(height) > ratio {
+		return int(math.Round(float64(height) * ratio)), height
+	}
+	return width, int(math.Round(float64(width) / ratio))
+}
+
+func minPositive(a, b int) int {
+	if b > 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// parseIIIFRequest parses the path after /iiif/ of a request for an image,
+// identifiers are paths of images and can contain slashes
+func parseIIIFRequest(path string) (*iiifRequest, error) {
+	segments := strings.Split(path, "/")
+	n := len(segments)
+	if n < 5 || segments[0] == "" {
+		return nil, iiifRequestError("invalid request: " + path)
+	}
+
+	var err error
+	r := &iiifRequest{identifier: strings.Join(segments[:n-4], "/"), regionStr: segments[n-4], sizeStr: segments[n-3]}
+	r.region, err = parseIIIFRegion(r.regionStr)
+	if err != nil {
+		return nil, err
+	}
+	r.size, err = parseIIIFSize(r.sizeStr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch rotation := segments[n-2]; rotation {
+	case "0", "!0":
+		if rotation == "!0" {
+			return nil, iiifNotImplementedError("mirroring isn't supported")
+		}
+	default:
+		if _, err := strconv.ParseFloat(strings.TrimPrefix(rotation, "!"), 64); err != nil {
+			return nil, iiifRequestError("invalid rotation: " + rotation)
+		}
+		return nil, iiifNotImplementedError("rotation isn't supported")
+	}
+
+	i := strings.LastIndex(segments[n-1], ".")
+	if i == -1 {
+		return nil, iiifRequestError("missing format")
+	}
+	r.quality = segments[n-1][:i]
+	switch r.quality {
+	case "default", "color", "gray":
+	case "bitonal":
+		return nil, iiifNotImplementedError("bitonal quality isn't supported")
+	default:
+		return nil, iiifRequestError("invalid quality: " + r.quality)
+	}
+	format, ok := iiifFormats[segments[n-1][i+1:]]
+	if !ok {
+		return nil, iiifNotImplementedError("unsupported format: " + segments[n-1][i+1:])
+	}
+	r.format = format
+	return r, nil
+}
+
+// cachePath returns the name the requested image is cached under, it is
+// found among the cached variants of the original when purging
+func (r *iiifRequest) cachePath() (string, error) {
+	i := strings.LastIndex(r.identifier, ".")
+	if i == -1 {
+		return "", iiifRequestError("invalid identifier")
+	}
+	sum := sha1.Sum([]byte(r.regionStr + "/" + r.sizeStr + "/" + r.quality + "." + r.format))
+	return r.identifier[:i] + "--" + iiifCachePrefix + hex.EncodeToString(sum[:]) + cacheNamespaceSuffix(currentConfig().cacheNamespace) + "--" + r.identifier[i:], nil
+}
+
+func (r *iiifRequest) filter() string {
+	if r.quality == "gray" {
+		return engine.FilterGrayScale
+	}
+	return engine.DefaultFilter
+}
+
+func iiifHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Images are written to the response by serveIIIF itself
+	status, body := serveIIIF(params, req, res)
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// serveIIIF answers requests of the IIIF Image API, image information and
+// images are authorised like other image requests
+func serveIIIF(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, ReadPermission) {
+		return http.StatusUnauthorized, ""
+	}
+	// Viewers load images from other origins
+	if res.Header().Get("Access-Control-Allow-Origin") == "" {
+		res.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	if status, body, answered := checkHotlink(req, res); answered {
+		return status, body
+	}
+
+	tenant := tenantFor(req)
+	path := params["_1"]
+	if strings.HasSuffix(path, "/info.json") {
+		return serveIIIFInfo(params, req, res, strings.TrimSuffix(path, "/info.json"))
+	}
+	if !iiifImageRequestRe.MatchString(path) {
+		// The base URI of an image redirects to its information
+		res.Header().Set("Location", iiifBaseURL(params, req)+"/"+escapeIIIFIdentifier(strings.TrimSuffix(path, "/"))+"/info.json")
+		return http.StatusSeeOther, ""
+	}
+
+	r, err := parseIIIFRequest(path)
+	if err != nil {
+		return iiifErrorStatus(err), err.Error()
+	}
+	requestedPath := r.identifier
+	r.identifier, err = tenant.storagePath(requestedPath)
+	if err != nil {
+		return http.StatusNotFound, "Image not found: " + requestedPath
+	}
+	fullImagePath, err := r.cachePath()
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	limits := tenant.config().outputLimits()
+	return serveRegionImage(params, req, res, r.identifier, fullImagePath, iiifErrorStatus, func(ctx context.Context) (*generatedImage, error) {
+		return generateIIIFImage(ctx, fullImagePath, r, limits)
+	})
+}
+
+// serveRegionImage serves an image cut out of an original from the caches or
+// generates it, for IIIF and Deep Zoom requests. Errors of generate are
+// answered with the status errorStatus returns.
+func serveRegionImage(params martini.Params, req *http.Request, res http.ResponseWriter, identifier, fullImagePath string, errorStatus func(error) int, generate func(context.Context) (*generatedImage, error)) (int, string) {
+	entry := requestLogFor(req)
+	entry.imagePath = identifier
+	if cacheControl := cacheControlFor(&Transformation{}, identifier); cacheControl != "" {
+		res.Header().Set("Cache-Control", cacheControl)
+	}
+
+	clientKey := rateLimitKey(params, req)
+	if data, ok := cachedInMemory(fullImagePath); ok {
+		entry.cacheStatus = "memory"
+		if rateLimited(currentConfig().hitRateLimiter, clientKey, res) {
+			return http.StatusTooManyRequests, "Too many requests"
+		}
+		cacheUpdateLastAccess(cacheKey(fullImagePath))
+		cacheRecordHit(len(data))
+		return respondWithImage(res, req, data, cacheSourceModTime(fullImagePath))
+	}
+	if cached, err := openFromCache(fullImagePath); err == nil {
+		defer cached.Close()
+		entry.cacheStatus = "hit"
+		if rateLimited(currentConfig().hitRateLimiter, clientKey, res) {
+			return http.StatusTooManyRequests, "Too many requests"
+		}
+		cacheRecordHit(cached.size)
+		return streamImage(res, req, cached, cacheSourceModTime(fullImagePath))
+	}
+
+	entry.cacheStatus = "miss"
+	if isKnownMissing(identifier) {
+		return http.StatusNotFound, "Image not found: " + identifier
+	}
+	if rateLimited(currentConfig().missRateLimiter, clientKey, res) {
+		return http.StatusTooManyRequests, "Too many requests"
+	}
+	// Like in serveImage, the shared call doesn't stop when the request
+	// which made it is cancelled since the others wait for it
+	generated, err, _ := inFlight.do(fullImagePath, func() (interface{}, error) {
+		return generate(context.WithoutCancel(req.Context()))
+	})
+	if err == errOverloaded {
+		res.Header().Set("Retry-After", strconv.Itoa(currentConfig().processingRetryAfter))
+	}
+	if err == ErrNotFound {
+		return http.StatusNotFound, "Image not found: " + identifier
+	}
+	if err != nil {
+		return errorStatus(err), err.Error()
+	}
+	result := generated.(*generatedImage)
+	return respondWithImage(res, req, result.data, result.modTime)
+}
+
+// iiifErrorStatus returns the status code a failed request is answered with
+func iiifErrorStatus(err error) int {
+	switch err.(type) {
+	case iiifRequestError:
+		return http.StatusBadRequest
+	case iiifNotImplementedError:
+		return http.StatusNotImplemented
+	case imageTooLargeError, unsupportedFormatError:
+		return http.StatusUnprocessableEntity
+	case stageTimeoutError:
+		return http.StatusGatewayTimeout
+	}
+	switch err {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case errOverloaded:
+		return currentConfig().processingOverloadStatus
+	case errContentBlocked:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// iiifBaseURL returns the URL identifiers are appended to, API keys in the
+// path of the request are kept
+func iiifBaseURL(params martini.Params, req *http.Request) string {
+	if currentConfig().iiifBaseURL != "" {
+		return strings.TrimSuffix(currentConfig().iiifBaseURL, "/")
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + req.Host
+	if key := params["apikey"]; key != "" {
+		base += "/" + key
+	}
+	return base + "/iiif"
+}
+
+// escapeIIIFIdentifier escapes slashes of identifiers in URLs as the IIIF
+// Image API asks for
+func escapeIIIFIdentifier(identifier string) string {
+	return url.PathEscape(identifier)
+}
+
+// serveIIIFInfo answers requests for info.json describing an image and the
+// features of the server
+func serveIIIFInfo(params martini.Params, req *http.Request, res http.ResponseWriter, identifier string) (int, string) {
+	tenant := tenantFor(req)
+	imagePath, err := tenant.storagePath(identifier)
+	if err != nil || isKnownMissing(imagePath) {
+		return http.StatusNotFound, "Image not found: " + identifier
+	}
+	source, err := sourceMetadata(imagePath)
+	if err == ErrNotFound {
+		rememberMissing(imagePath)
+		return http.StatusNotFound, "Image not found: " + identifier
+	}
+	if err != nil {
+		return iiifErrorStatus(err), err.Error()
+	}
+
+	limits := tenant.config().outputLimits()
+	info := map[string]interface{}{
+		"@context":       iiifContext,
+		"id":             iiifBaseURL(params, req) + "/" + escapeIIIFIdentifier(identifier),
+		"type":           "ImageService3",
+		"protocol":       iiifProtocol,
+		"profile":        "level1",
+		"width":          source.Width,
+		"height":         source.Height,
+		"tiles":          []map[string]interface{}{{"width": iiifTileSize, "scaleFactors": []int{1, 2, 4, 8, 16}}},
+		"extraFormats":   []string{"png"},
+		"extraQualities": []string{"color", "gray"},
+		"extraFeatures":  iiifExtraFeatures,
+	}
+	if limits.MaxWidth > 0 {
+		info["maxWidth"] = limits.MaxWidth
+	}
+	if limits.MaxHeight > 0 {
+		info["maxHeight"] = limits.MaxHeight
+	}
+	if limits.MaxPixels > 0 {
+		info["maxArea"] = limits.MaxPixels
+	}
+
+	status, body := jsonResponse(res, http.StatusOK, info)
+	addVary(res, "Accept")
+	if status == http.StatusOK && strings.Contains(req.Header.Get("Accept"), "application/ld+json") {
+		res.Header().Set("Content-Type", `application/ld+json;profile="`+iiifContext+`"`)
+	}
+	return status, body
+}
+
+// generateIIIFImage cuts out the requested region of an original image,
+// scales it within limits and caches the result
+func generateIIIFImage(ctx context.Context, fullImagePath string, r *iiifRequest, limits engine.Limits) (*generatedImage, error) {
+	return generateRegionImage(ctx, fullImagePath, r.identifier, r.format, r.filter(), func(width, height int) (engine.Geometry, error) {
+		region, err := r.region.rect(width, height)
+		if err != nil {
+			return engine.Geometry{}, err
+		}
+		w, h, err := r.size.dimensions(region.Dx(), region.Dy(), limits)
+		if err != nil {
+			return engine.Geometry{}, err
+		}
+		return engine.Geometry{Crop: region, Width: w, Height: h}, nil
+	})
+}
+
+// generateRegionImage cuts a region out of an original image, scales it as
+// plan says for the size of the original and caches the result
+func generateRegionImage(ctx context.Context, fullImagePath, identifier, outputFormat, filter string, plan func(width, height int) (engine.Geometry, error)) (*generatedImage, error) {
+	sourceInfo, err := statSource(identifier)
+	if err == ErrNotFound {
+		rememberMissing(identifier)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := fetchImage(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	// The region and the size depend on the size of the original
+	format, err := checkImage(data)
+	if err != nil {
+		return nil, err
+	}
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %q", identifier)
+	}
+	geometry, err := plan(imageConfig.Width, imageConfig.Height)
+	if err != nil {
+		return nil, err
+	}
+	params := engine.Params{Width: geometry.Width, Height: geometry.Height, Scale: 1, Cropping: engine.CroppingModeExact, Gravity: engine.DefaultGravity, Filter: filter}
+
+	ctx = trackStages(ctx)
+	err = processingPool.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAfterStages(ctx, processingPool.release)
+	size := estimateMemory(data, imageConfig.Width, imageConfig.Height, geometry)
+	err = processingMemory.reserve(size)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAfterStages(ctx, func() { processingMemory.free(size) })
+
+	var encoded []byte
+	native := false
+	if format == outputFormat {
+		encoded, native, err = processNatively(ctx, data, format, geometry, &Transformation{params: &params})
+	}
+	if !native {
+		encoded, err = cropAndScaleInGo(data, identifier, outputFormat, geometry, params)
+	}
+	if err != nil {
+		slog.Error("processing an image failed", "path", fullImagePath, "error", err)
+		return nil, err
+	}
+	hotCache.put(fullImagePath, encoded)
+	cacheRecordMiss(len(encoded))
+
+	// Cache the image asynchronously to speed up the response
+	go func() {
+		err := addEncodedToCache(fullImagePath, encoded, outputFormat)
+		if err != nil {
+			slog.Error("saving an image to cache failed", "path", fullImagePath, "error", err)
+			return
+		}
+		setCacheSource(fullImagePath, sourceInfo)
+		setCacheExpiry(fullImagePath, nil)
+	}()
+	return &generatedImage{encoded, sourceInfo.ModTime, nil}, nil
+}
+
+// cropAndScaleInGo cuts out a region of an image and scales it using the
+// pure-Go pipeline
+func cropAndScaleInGo(data []byte, identifier, format string, geometry engine.Geometry, params engine.Params) ([]byte, error) {
+	img, _, err := decodeImage(data, identifier)
+	if err != nil {
+		return nil, err
+	}
+	var region draw.Image = image.NewRGBA(image.Rect(0, 0, geometry.Crop.Dx(), geometry.Crop.Dy()))
+	if engine.IsHighBitDepth(img) {
+		region = image.NewRGBA64(region.Bounds())
+	}
+	draw.Draw(region, region.Bounds(), img, img.Bounds().Min.Add(geometry.Crop.Min), draw.Src)
+	imgNew := engine.Transform(region, params)
+
+	buffer := getEncodeBuffer()
+	defer putEncodeBuffer(buffer)
+	err = writeImage(imgNew, format, buffer)
+	if err != nil {
+		return nil, err
+	}
+	// The encoded image outlives the buffer in the caches
+	return append([]byte(nil), buffer.Bytes()...), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestIIIFRegion(t *testing.T) {
+	cases := []struct {
+		region string
+		rect   image.Rectangle
+	}{
+		{"full", image.Rect(0, 0, 800, 600)},
+		{"square", image.Rect(100, 0, 700, 600)},
+		{"10,20,300,200", image.Rect(10, 20, 310, 220)},
+		{"700,500,300,200", image.Rect(700, 500, 800, 600)},
+		{"pct:50,50,50,50", image.Rect(400, 300, 800, 600)},
+	}
+	for _, c := range cases {
+		region, err := parseIIIFRegion(c.region)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.region, err)
+			continue
+		}
+		rect, err := region.rect(800, 600)
+		if err != nil || rect != c.rect {
+			t.Errorf("%s: expected: %v, actual: %v %v", c.region, c.rect, rect, err)
+		}
+	}
+
+	for _, region := range []string{"", "0,0,100", "0,0,0,100", "-1,0,100,100", "1.5,0,100,100", "pct:a,0,10,10"} {
+		if _, err := parseIIIFRegion(region); err == nil {
+			t.Errorf("%s: expected an error", region)
+		}
+	}
+	region, _ := parseIIIFRegion("900,0,100,100")
+	if _, err := region.rect(800, 600); err == nil {
+		t.Error("Expected an error for a region outside of the image")
+	}
+}
+
+func TestIIIFSize(t *testing.T) {
+	limits := engine.Limits{MaxWidth: 1000, MaxHeight: 1000}
+	cases := []struct {
+		size          string
+		width, height int
+	}{
+		{"max", 800, 600},
+		{"^max", 1000, 750},
+		{"400,", 400, 300},
+		{",300", 400, 300},
+		{"pct:25", 200, 150},
+		{"200,200", 200, 200},
+		{"!200,200", 200, 150},
+		{"^1000,", 1000, 750},
+	}
+	for _, c := range cases {
+		size, err := parseIIIFSize(c.size)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.size, err)
+			continue
+		}
+		width, height, err := size.dimensions(800, 600, limits)
+		if err != nil || width != c.width || height != c.height {
+			t.Errorf("%s: expected: %dx%d, actual: %dx%d %v", c.size, c.width, c.height, width, height, err)
+		}
+	}
+
+	for _, size := range []string{"", ",", "!200,", "0,100", "pct:0", "pct:150", "full"} {
+		if _, err := parseIIIFSize(size); err == nil {
+			t.Errorf("%s: expected an error", size)
+		}
+	}
+	for _, str := range []string{"1000,", "^2000,"} {
+		size, _ := parseIIIFSize(str)
+		if _, _, err := size.dimensions(800, 600, limits); err == nil {
+			t.Errorf("%s: expected an error", str)
+		}
+	}
+}
+
+func TestParseIIIFRequest(t *testing.T) {
+	r, err := parseIIIFRequest("photos/cat.jpg/full/max/0/gray.png")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r.identifier != "photos/cat.jpg" || r.format != "png" || r.filter() != engine.FilterGrayScale {
+		t.Errorf("Unexpected request: %+v", r)
+	}
+	path, _ := r.cachePath()
+	if matches := cachedPathRe.FindStringSubmatch(path); matches == nil || matches[1]+matches[2] != "photos/cat.jpg" {
+		t.Errorf("Expected the cache path to be recognised as a variant of the original, got: %s", path)
+	}
+
+	cases := []struct {
+		path     string
+		expected error
+	}{
+		{"cat.jpg/full/max/90/default.jpg", iiifNotImplementedError("")},
+		{"cat.jpg/full/max/!0/default.jpg", iiifNotImplementedError("")},
+		{"cat.jpg/full/max/0/bitonal.jpg", iiifNotImplementedError("")},
+		{"cat.jpg/full/max/0/default.webp", iiifNotImplementedError("")},
+		{"cat.jpg/full/max/0/sepia.jpg", iiifRequestError("")},
+		{"cat.jpg/full/max/x/default.jpg", iiifRequestError("")},
+		{"full/max/0/default.jpg", iiifRequestError("")},
+	}
+	for _, c := range cases {
+		_, err := parseIIIFRequest(c.path)
+		if iiifErrorStatus(err) != iiifErrorStatus(c.expected) {
+			t.Errorf("%s: expected status %d, got: %v", c.path, iiifErrorStatus(c.expected), err)
+		}
+	}
+}
+
+func TestServeRegionImageCancelledRequest(t *testing.T) {
+	defer func(conn redis.Conn) { Conn = conn }(Conn)
+	Conn = &reconnectingConn{}
+	oldConfig, oldStorage := currentConfig(), storageImpl
+	defer func() { setConfig(oldConfig); storageImpl = oldStorage }()
+	setConfig(&Configuration{})
+	storageImpl = &localStorage{t.TempDir()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/iiif/cat.jpg/full/max/0/default.jpg", nil).WithContext(ctx)
+
+	var generateErr error
+	status, _ := serveRegionImage(nil, req, httptest.NewRecorder(), "cat.jpg", "cat--iiif-cancelled.jpg", iiifErrorStatus, func(ctx context.Context) (*generatedImage, error) {
+		generateErr = ctx.Err()
+		return nil, errors.New("not generated")
+	})
+	if generateErr != nil {
+		t.Errorf("Expected the shared generation not to be cancelled, got: %s", generateErr)
+	}
+	if status == http.StatusOK {
+		t.Errorf("Expected an error status, actual: %d", status)
+	}
+}
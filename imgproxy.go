@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+const (
+	imgproxyKeyEnvVar  = "PIXLSERV_IMGPROXY_KEY"
+	imgproxySaltEnvVar = "PIXLSERV_IMGPROXY_SALT"
+
+	// imgproxy's replacements of a signature in URLs which aren't signed
+	imgproxyInsecure = "insecure"
+)
+
+var (
+	imgproxyKey, imgproxySalt []byte
+
+	// Cropping modes matching imgproxy's resizing types
+	imgproxyResizingTypes = map[string]string{
+		"fit":       engine.CroppingModeAll,
+		"fill":      engine.CroppingModePart,
+		"fill-down": engine.CroppingModePart,
+		"auto":      engine.CroppingModePart,
+		"force":     engine.CroppingModeExact,
+	}
+
+	// Gravities matching imgproxy's gravity types
+	imgproxyGravities = map[string]string{
+		"no":   engine.GravityNorth,
+		"noea": engine.GravityNorthEast,
+		"ea":   engine.GravityEast,
+		"soea": engine.GravitySouthEast,
+		"so":   engine.GravitySouth,
+		"sowe": engine.GravitySouthWest,
+		"we":   engine.GravityWest,
+		"nowe": engine.GravityNorthWest,
+		"ce":   engine.GravityCenter,
+		"sm":   engine.GravityCenter,
+	}
+)
+
+// imgproxyExpiredError is returned for URLs past their expiry, imgproxy
+// answers them with 404 Not Found
+type imgproxyExpiredError string
+
+func (e imgproxyExpiredError) Error() string {
+	return string(e)
+}
+
+// imgproxyInit loads the hex-encoded key and salt imgproxy URLs are signed
+// with when they are enabled, they can only be left out when unsigned URLs
+// are allowed
+func imgproxyInit() error {
+	var err error
+	imgproxyKey, err = hex.DecodeString(os.Getenv(imgproxyKeyEnvVar))
+	if err != nil {
+		return fmt.Errorf("%s is not hex-encoded", imgproxyKeyEnvVar)
+	}
+	imgproxySalt, err = hex.DecodeString(os.Getenv(imgproxySaltEnvVar))
+	if err != nil {
+		return fmt.Errorf("%s is not hex-encoded", imgproxySaltEnvVar)
+	}
+	if currentConfig().imgproxy && !currentConfig().imgproxyAllowInsecure && (len(imgproxyKey) == 0 || len(imgproxySalt) == 0) {
+		return fmt.Errorf("%s and %s not set", imgproxyKeyEnvVar, imgproxySaltEnvVar)
+	}
+	return nil
+}
+
+// imgproxySignature computes the signature of the part of an imgproxy URL
+// after the signature the way imgproxy does, truncated to size bytes
+func imgproxySignature(path string, key, salt []byte, size int) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	io.WriteString(mac, path)
+	sum := mac.Sum(nil)
+	if size > 0 && size < len(sum) {
+		sum = sum[:size]
+	}
+	return base64.RawURLEncoding.EncodeToString(sum)
+}
+
+// imgproxySignatureLength returns the number of characters of signatures of
+// the given size in bytes
+func imgproxySignatureLength(size int) int {
+	return base64.RawURLEncoding.EncodedLen(size)
+}
+
+// parseImgproxyPath translates the processing options of an imgproxy URL to
+// parameters and returns them together with the source URL, e.g. for
+// rs:fill:300:200/g:no/aHR0cDovL2V4YW1wbGUuY29tL2NhdC5qcGc.jpg
+func parseImgproxyPath(path string, now time.Time) (engine.Params, string, error) {
+	params := engine.Params{Scale: engine.DefaultScale, Cropping: engine.CroppingModeAll, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	segments := strings.Split(path, "/")
+
+	i := 0
+	for ; i < len(segments); i++ {
+		if segments[i] == "plain" || !strings.Contains(segments[i], ":") {
+			break
+		}
+		args := strings.Split(segments[i], ":")
+		name, args := args[0], args[1:]
+		var err error
+		switch name {
+		case "resize", "rs":
+			if len(args) > 0 && args[0] != "" {
+				err = setImgproxyResizingType(&params, args[0])
+			}
+			if err == nil && len(args) > 1 {
+				err = setImgproxySize(&params, args[1:])
+			}
+		case "size", "s":
+			err = setImgproxySize(&params, args)
+		case "resizing_type", "rt":
+			err = setImgproxyResizingType(&params, args[0])
+		case "width", "w":
+			params.Width, err = parseImgproxyDimension(args[0])
+		case "height", "h":
+			params.Height, err = parseImgproxyDimension(args[0])
+		case "gravity", "g":
+			gravity, ok := imgproxyGravities[args[0]]
+			if !ok {
+				err = fmt.Errorf("unsupported gravity: %s", args[0])
+			}
+			params.Gravity = gravity
+		case "dpr":
+			params.Scale, err = strconv.Atoi(args[0])
+			if err != nil || params.Scale < 1 {
+				err = fmt.Errorf("unsupported dpr: %s", args[0])
+			}
+		case "expires", "exp":
+			var expires int64
+			expires, err = strconv.ParseInt(args[0], 10, 64)
+			if err == nil && expires > 0 && now.Unix() > expires {
+				return params, "", imgproxyExpiredError("URL has expired")
+			}
+		case "enlarge", "el", "quality", "q", "cachebuster", "cb", "strip_metadata", "sm", "filename", "fn":
+			// Images are enlarged anyway, other options don't change them
+		default:
+			return params, "", fmt.Errorf("unsupported imgproxy option: %s", name)
+		}
+		if err != nil {
+			return params, "", err
+		}
+	}
+	if i == len(segments) {
+		return params, "", errors.New("missing source URL")
+	}
+
+	sourceURL, err := decodeImgproxySource(segments[i:])
+	if err != nil {
+		return params, "", err
+	}
+	if params.Width == 0 || params.Height == 0 {
+		// Resized keeping the aspect ratio
+		params.Cropping = engine.CroppingModeExact
+	}
+	return params, sourceURL, nil
+}
+
+func setImgproxyResizingType(params *engine.Params, resizingType string) error {
+	cropping, ok := imgproxyResizingTypes[resizingType]
+	if !ok {
+		return fmt.Errorf("unsupported resizing type: %s", resizingType)
+	}
+	params.Cropping = cropping
+	return nil
+}
+
+// setImgproxySize sets the width and the height given in the arguments of
+// size and resize, later arguments (enlarge, extend) are ignored
+func setImgproxySize(params *engine.Params, args []string) error {
+	var err error
+	if len(args) > 0 && args[0] != "" {
+		params.Width, err = parseImgproxyDimension(args[0])
+		if err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 && args[1] != "" {
+		params.Height, err = parseImgproxyDimension(args[1])
+	}
+	return err
+}
+
+func parseImgproxyDimension(str string) (int, error) {
+	value, err := strconv.Atoi(str)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %s", str)
+	}
+	return value, nil
+}
+
+// decodeImgproxySource returns the source URL of an imgproxy URL, either
+// base64-encoded (split by slashes or not) or plain after /plain/, followed
+// by the extension of the output format
+func decodeImgproxySource(segments []string) (string, error) {
+	if segments[0] == "plain" {
+		plain := strings.Join(segments[1:], "/")
+		if i := strings.LastIndex(plain, "@"); i != -1 {
+			plain = plain[:i]
+		}
+		sourceURL, err := url.PathUnescape(plain)
+		if err != nil || sourceURL == "" {
+			return "", errors.New("invalid source URL")
+		}
+		return sourceURL, nil
+	}
+
+	encoded := strings.Join(segments, "")
+	if i := strings.LastIndex(encoded, "."); i != -1 {
+		encoded = encoded[:i]
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil || len(decoded) == 0 {
+		return "", errors.New("invalid source URL")
+	}
+	return string(decoded), nil
+}
+
+// imgproxyImagePath maps a source URL to the path of an image in the
+// storage, only URLs starting with the configured prefix are served
+func imgproxyImagePath(sourceURL, prefix string) (string, error) {
+	if !strings.HasPrefix(sourceURL, prefix) {
+		return "", fmt.Errorf("source URL not served: %s", sourceURL)
+	}
+	imagePath := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(sourceURL, prefix)), "/")
+	if imagePath == "" || imagePath == "." {
+		return "", errors.New("missing image path")
+	}
+	return imagePath, nil
+}
+
+// imgproxyExtension returns the extension of the output format requested by
+// an imgproxy URL, empty when the format of the original is kept
+func imgproxyExtension(path string) string {
+	last := path[strings.LastIndex(path, "/")+1:]
+	if strings.Contains(path, "/plain/") || strings.HasPrefix(path, "plain/") {
+		if i := strings.LastIndex(last, "@"); i != -1 {
+			return last[i+1:]
+		}
+		return ""
+	}
+	if i := strings.LastIndex(last, "."); i != -1 {
+		return last[i+1:]
+	}
+	return ""
+}
+
+// sameFormat reports whether an extension names the format of an image
+func sameFormat(extension, imagePath string) bool {
+	normalise := func(ext string) string {
+		ext = strings.ToLower(ext)
+		if ext == "jpg" {
+			return "jpeg"
+		}
+		return ext
+	}
+	return normalise(extension) == normalise(strings.TrimPrefix(path.Ext(imagePath), "."))
+}
+
+func imgproxyHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Images are written to the response by serveImgproxy itself
+	status, body := serveImgproxy(params, req, res)
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// serveImgproxy answers requests using imgproxy's URL syntax, signed URLs are
+// authorised by their signature, unsigned ones like other image requests
+func serveImgproxy(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	// Signatures cover the path as it was sent
+	signature := params["signature"]
+	path := strings.TrimPrefix(req.URL.EscapedPath(), "/"+signature+"/")
+	if signature == imgproxyInsecure || signature == "_" {
+		if !currentConfig().imgproxyAllowInsecure {
+			return http.StatusForbidden, "Unsigned URLs aren't allowed"
+		}
+		if !isAuthorised(params, req, ReadPermission) {
+			return http.StatusUnauthorized, ""
+		}
+	} else if len(imgproxyKey) == 0 || !hmac.Equal([]byte(signature), []byte(imgproxySignature("/"+path, imgproxyKey, imgproxySalt, currentConfig().imgproxySignatureSize))) {
+		return http.StatusForbidden, "Invalid URL: invalid signature"
+	}
+
+	if status, body, answered := checkHotlink(req, res); answered {
+		return status, body
+	}
+
+	parameters, sourceURL, err := parseImgproxyPath(path, time.Now())
+	if _, ok := err.(imgproxyExpiredError); ok {
+		return http.StatusNotFound, err.Error()
+	}
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	requestedPath, err := imgproxyImagePath(sourceURL, currentConfig().imgproxySourcePrefix)
+	if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	if extension := imgproxyExtension(path); extension != "" && !sameFormat(extension, requestedPath) {
+		return http.StatusBadRequest, "Converting images to other formats isn't supported"
+	}
+	tenant := tenantFor(req)
+	imagePath, err := tenant.storagePath(requestedPath)
+	if err != nil {
+		return http.StatusNotFound, "Image not found: " + requestedPath
+	}
+	err = parameters.CheckLimits(tenant.config().outputLimits())
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	return serveImage(params, req, res, Transformation{params: &parameters}, "", imagePath)
+}
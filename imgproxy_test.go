@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseImgproxyPath(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		path, params, sourceURL string
+	}{
+		// local:///photos/cat.jpg
+		{"rs:fill:300:200/g:no/bG9jYWw6Ly8vcGhvdG9zL2NhdC5qcGc.jpg", "c_p,g_n,h_200,w_300,f_none,s_1", "local:///photos/cat.jpg"},
+		{"rs:fill:300:200/bG9jYWw6Ly8v/cGhvdG9zL2NhdC5qcGc", "c_p,g_c,h_200,w_300,f_none,s_1", "local:///photos/cat.jpg"},
+		{"s:300:200/plain/local:///photos/cat.jpg@jpg", "c_a,g_c,h_200,w_300,f_none,s_1", "local:///photos/cat.jpg"},
+		{"w:300/q:80/plain/local:///photos/cat%20dog.jpg", "c_e,g_c,h_0,w_300,f_none,s_1", "local:///photos/cat dog.jpg"},
+		{"rt:force/w:300/h:200/dpr:2/exp:1800000000/plain/local:///cat.jpg", "c_e,g_c,h_200,w_300,f_none,s_2", "local:///cat.jpg"},
+	}
+	for _, c := range cases {
+		params, sourceURL, err := parseImgproxyPath(c.path, now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.path, err)
+			continue
+		}
+		if params.ToString() != c.params || sourceURL != c.sourceURL {
+			t.Errorf("%s: expected: %s %s, actual: %s %s", c.path, c.params, c.sourceURL, params.ToString(), sourceURL)
+		}
+	}
+
+	for _, path := range []string{"rs:fill:300:200", "rs:crop:300:200/plain/local:///cat.jpg", "pr:thumb/plain/local:///cat.jpg", "w:-1/plain/local:///cat.jpg", "g:fp:0.5:0.5/plain/local:///cat.jpg", "w:300/!!!.jpg"} {
+		if _, _, err := parseImgproxyPath(path, now); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+	if _, _, err := parseImgproxyPath("exp:1600000000/plain/local:///cat.jpg", now); err == nil {
+		t.Error("Expected an error for an expired URL")
+	} else if _, ok := err.(imgproxyExpiredError); !ok {
+		t.Errorf("Expected an expiry error, got: %v", err)
+	}
+}
+
+func TestImgproxySignature(t *testing.T) {
+	// Example from imgproxy's documentation
+	key := []byte("secret")
+	salt := []byte("hello")
+	path := "/rs:fill:300:400:0/g:sm/aHR0cDovL2V4YW1w/bGUuY29tL2ltYWdl/cy9jdXJpb3NpdHku/anBn.png"
+	signature := imgproxySignature(path, key, salt, 32)
+	if signature != "oKfUtW34Dvo2BGQehJFR4Nr0_rIjOtdtzJ3QFsUcXH8" {
+		t.Errorf("Expected imgproxy's signature, got: %s", signature)
+	}
+	truncated := imgproxySignature(path, key, salt, 8)
+	if len(truncated) != imgproxySignatureLength(8) || truncated != signature[:len(truncated)] {
+		t.Errorf("Expected a truncated signature, got: %s", truncated)
+	}
+}
+
+func TestImgproxyImagePath(t *testing.T) {
+	imagePath, err := imgproxyImagePath("local:///photos/../cat.jpg", "local:///")
+	if err != nil || imagePath != "cat.jpg" {
+		t.Errorf("Expected cat.jpg, got: %s %v", imagePath, err)
+	}
+	if _, err := imgproxyImagePath("https://example.com/cat.jpg", "local:///"); err == nil {
+		t.Error("Expected an error for a source URL outside of the storage")
+	}
+	if !sameFormat("jpg", "cat.jpeg") || sameFormat("png", "cat.jpg") {
+		t.Error("Expected extensions to be compared by format")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"regexp"
 	"strconv"
+
+	"github.com/ReshNesh/pixlserv/jpegenc"
 )
 
 var (
@@ -18,10 +20,16 @@ var (
 // Writes a given image of the given format to the given destination.
 // Returns error.
 func writeImage(img image.Image, format string, w io.Writer) error {
+	return writeImageWithOptions(img, format, &jpegenc.Options{Quality: currentConfig().jpegQuality, Subsampling: currentConfig().jpegSubsampling}, nil, w)
+}
+
+// Like writeImage, JPEG images are encoded with the given quality and chroma
+// subsampling and PNG images are optimized when options are given
+func writeImageWithOptions(img image.Image, format string, jpegOptions *jpegenc.Options, pngOptimization *PNGOptimization, w io.Writer) error {
 	if format == "png" {
-		return png.Encode(w, img)
+		return encodePNG(img, pngOptimization, w)
 	}
-	return jpeg.Encode(w, img, &jpeg.Options{Config.jpegQuality})
+	return writeJPEG(img, jpegOptions, w)
 }
 
 func readImage(reader io.Reader, format string) (image.Image, error) {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Endpoints which change data or expose information about the server
+	adminURLRe = regexp.MustCompile("^/(([A-Z0-9]+/)?(upload|cache/|keys|config/)|metrics|debug/)")
+	// Other management routes, served on the admin address like admin ones
+	managementURLRe = regexp.MustCompile("^/([A-Z0-9]+/)?(usage|analytics|history/|dashboard|batch|downloads)")
+)
+
+// isManagementPath reports whether a request path is one of the admin,
+// metrics, upload or other management routes, the name of a tenant selected
+// by the path is left out
+func isManagementPath(host, path string) bool {
+	path = routedPath(host, path)
+	return adminURLRe.MatchString(path) || managementURLRe.MatchString(path)
+}
+
+// ipList is a list of networks
+type ipList []*net.IPNet
+
+// IPFilter allows requests from the allowed networks (all when empty)
+// except for the denied ones
+type IPFilter struct {
+	allow, deny ipList
+}
+
+// parseIPList parses CIDR notation networks or single IP addresses
+func parseIPList(values []interface{}) (ipList, error) {
+	list := make(ipList, 0, len(values))
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("not a network: %v", value)
+		}
+		if !strings.Contains(str, "/") {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", str)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			str = fmt.Sprintf("%s/%d", str, bits)
+		}
+		_, network, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+func (l ipList) contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *IPFilter) allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil || f.deny.contains(ip) {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow.contains(ip)
+}
+
+// clientIP returns the address of the client making a request. When the
+// request comes from a trusted proxy the address is taken from the
+// X-Forwarded-For header instead, skipping other trusted proxies.
+func clientIP(req *http.Request) net.IP {
+	ip := net.ParseIP(hostWithoutPort(req.RemoteAddr))
+	if ip == nil || !currentConfig().trustedProxies.contains(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !currentConfig().trustedProxies.contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// ipFilter rejects requests from networks which aren't allowed before
+// anything else is done with them, the admin filter applies to the routes
+// served on the admin address
+func ipFilter(res http.ResponseWriter, req *http.Request) {
+	if currentConfig().ipFilter == nil && currentConfig().adminIPFilter == nil {
+		return
+	}
+
+	ip := clientIP(req)
+	admin := isManagementPath(req.Host, req.URL.Path)
+	if !currentConfig().ipFilter.allowed(ip) || (admin && !currentConfig().adminIPFilter.allowed(ip)) {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	allow, _ := parseIPList([]interface{}{"10.0.0.0/8", "192.168.1.1"})
+	deny, _ := parseIPList([]interface{}{"10.1.0.0/16"})
+	f := &IPFilter{allow, deny}
+
+	cases := map[string]bool{
+		"10.2.3.4":    true,
+		"10.1.2.3":    false,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"::1":         false,
+	}
+	for ip, exp := range cases {
+		if act := f.allowed(net.ParseIP(ip)); act != exp {
+			t.Errorf("%s: expected %v, actual %v", ip, exp, act)
+		}
+	}
+
+	if _, err := parseIPList([]interface{}{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected an invalid network to be rejected")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	currentConfig().trustedProxies, _ = parseIPList([]interface{}{"10.0.0.0/8"})
+	defer func() { currentConfig().trustedProxies = nil }()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 10.0.0.2")
+	if ip := clientIP(req); ip.String() != "5.6.7.8" {
+		t.Errorf("Expected the last untrusted address, actual: %s", ip)
+	}
+
+	req.RemoteAddr = "9.9.9.9:1234"
+	if ip := clientIP(req); ip.String() != "9.9.9.9" {
+		t.Errorf("Expected the forwarded header to be ignored, actual: %s", ip)
+	}
+}
+
+func TestIPFilterAdminPaths(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	allow, _ := parseIPList([]interface{}{"10.0.0.0/8"})
+	setConfig(&Configuration{
+		adminIPFilter: &IPFilter{allow: allow},
+		tenants:       []*Tenant{{name: "acme", prefix: "acme/"}},
+	})
+
+	cases := map[string]int{
+		"/image/w_400/cat.jpg":      http.StatusOK,
+		"/acme/image/w_400/cat.jpg": http.StatusOK,
+		"/KEY/cache/stats":          http.StatusForbidden,
+		"/acme/cache/stats":         http.StatusForbidden,
+		"/acme/KEY/upload":          http.StatusForbidden,
+		"/acme/keys":                http.StatusForbidden,
+		"/acme/config/reload":       http.StatusForbidden,
+		"/KEY/usage":                http.StatusForbidden,
+		"/acme/dashboard":           http.StatusForbidden,
+	}
+	for path, exp := range cases {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		res := httptest.NewRecorder()
+		ipFilter(res, req)
+		if res.Code != exp {
+			t.Errorf("%s: expected %d, actual %d", path, exp, res.Code)
+		}
+	}
+}
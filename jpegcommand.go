@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+// writeJPEG encodes an image as JPEG using the configured command, e.g.
+// MozJPEG's cjpeg, or the Go encoder when there is none or the command fails.
+// Images with 16 bits per channel are dithered down to 8.
+func writeJPEG(img image.Image, options *jpegenc.Options, w io.Writer) error {
+	img = engine.Dither(img)
+	if currentConfig().jpegEncoderCommand == "" {
+		return jpegenc.Encode(w, img, options)
+	}
+	data, err := encodeWithCommand(img, options)
+	if err != nil {
+		slog.Error("encoding an image using the JPEG encoder command failed", "command", currentConfig().jpegEncoderCommand, "error", err)
+		return jpegenc.Encode(w, img, options)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// jpegEncoderArgs returns cjpeg's arguments for the options, trellis
+// quantization is on by default in MozJPEG
+func jpegEncoderArgs(options *jpegenc.Options) []string {
+	args := []string{"-quality", strconv.Itoa(options.Quality), "-optimize"}
+	if currentConfig().jpegEncoderProgressive {
+		args = append(args, "-progressive")
+	} else {
+		args = append(args, "-baseline")
+	}
+	if options.Subsampling == jpegenc.Subsampling444 {
+		args = append(args, "-sample", "1x1")
+	} else {
+		args = append(args, "-sample", "2x2")
+	}
+	return args
+}
+
+// encodeWithCommand pipes an image as PPM (PGM for grayscale images) to the
+// JPEG encoder command and returns what it writes
+func encodeWithCommand(img image.Image, options *jpegenc.Options) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(currentConfig().jpegEncoderTimeout)*time.Millisecond)
+	defer cancel()
+
+	var input, output, stderr bytes.Buffer
+	err := writePNM(img, &input)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, currentConfig().jpegEncoderCommand, jpegEncoderArgs(options)...)
+	cmd.Stdin = &input
+	cmd.Stdout = &output
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if output.Len() < 2 || output.Bytes()[0] != 0xff || output.Bytes()[1] != 0xd8 {
+		return nil, fmt.Errorf("the command's output isn't a JPEG image")
+	}
+	return output.Bytes(), nil
+}
+
+// writePNM writes an image as binary PPM, grayscale images as PGM. Like the
+// Go encoder, transparent pixels become black.
+func writePNM(img image.Image, w io.Writer) error {
+	bounds := img.Bounds()
+	bw := bufio.NewWriter(w)
+	if gray, ok := img.(*image.Gray); ok {
+		fmt.Fprintf(bw, "P5\n%d %d\n255\n", bounds.Dx(), bounds.Dy())
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			i := gray.PixOffset(bounds.Min.X, y)
+			bw.Write(gray.Pix[i : i+bounds.Dx()])
+		}
+		return bw.Flush()
+	}
+
+	fmt.Fprintf(bw, "P6\n%d %d\n255\n", bounds.Dx(), bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			bw.WriteByte(byte(r >> 8))
+			bw.WriteByte(byte(g >> 8))
+			bw.WriteByte(byte(b >> 8))
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+func TestWritePNM(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.SetRGBA(0, 0, color.RGBA{255, 0, 0, 255})
+	img.SetRGBA(1, 0, color.RGBA{0, 0, 255, 255})
+	var buf bytes.Buffer
+	writePNM(img, &buf)
+	if buf.String() != "P6\n2 1\n255\n\xff\x00\x00\x00\x00\xff" {
+		t.Errorf("Unexpected PPM: %q", buf.String())
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 2, 2))
+	gray.Pix = []uint8{1, 2, 3, 4}
+	buf.Reset()
+	writePNM(gray, &buf)
+	if buf.String() != "P5\n2 2\n255\n\x01\x02\x03\x04" {
+		t.Errorf("Unexpected PGM: %q", buf.String())
+	}
+}
+
+func TestWriteJPEGWithCommand(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Records its arguments and the input's header, answers with a JPEG marker
+	command := filepath.Join(dir, "cjpeg")
+	script := "#!/bin/sh\necho \"$@\" > " + dir + "/args\nhead -c 2 > " + dir + "/input\nprintf '\\377\\330encoded'\n"
+	err = ioutil.WriteFile(command, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(&Configuration{jpegEncoderCommand: command, jpegEncoderProgressive: true, jpegEncoderTimeout: defaultJpegEncoderTimeout})
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	var buf bytes.Buffer
+	err = writeJPEG(img, &jpegenc.Options{Quality: 80, Subsampling: jpegenc.Subsampling444}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "\xff\xd8encoded" {
+		t.Errorf("Expected the command's output, got: %q", buf.String())
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if strings.TrimSpace(string(args)) != "-quality 80 -optimize -progressive -sample 1x1" {
+		t.Errorf("Unexpected arguments: %s", args)
+	}
+	input, _ := ioutil.ReadFile(filepath.Join(dir, "input"))
+	if string(input) != "P6" {
+		t.Errorf("Expected a PPM input, got: %q", input)
+	}
+
+	// The Go encoder takes over when the command fails
+	currentConfig().jpegEncoderCommand = filepath.Join(dir, "missing")
+	buf.Reset()
+	err = writeJPEG(img, &jpegenc.Options{Quality: 80}, &buf)
+	if err != nil || !bytes.HasPrefix(buf.Bytes(), []byte("\xff\xd8")) || buf.String() == "\xff\xd8encoded" {
+		t.Errorf("Expected the Go encoder's output, got: %d bytes %v", buf.Len(), err)
+	}
+}
@@ -0,0 +1,98 @@
+package jpegenc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// redText returns an image with thin red lines on white, which 4:2:0
+// subsampling smears
+func redText() *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, 33, 17))
+	for y := 0; y < 17; y++ {
+		for x := 0; x < 33; x++ {
+			c := color.RGBA{255, 255, 255, 255}
+			if x%4 == 1 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+// redError sums how far the red channel is from the original's
+func redError(t *testing.T, m *image.RGBA, data []byte) int {
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for y := 0; y < 17; y++ {
+		for x := 0; x < 33; x++ {
+			r0, g0, _, _ := m.At(x, y).RGBA()
+			r1, g1, _, _ := decoded.At(x, y).RGBA()
+			total += abs(int(r0>>8)-int(r1>>8)) + abs(int(g0>>8)-int(g1>>8))
+		}
+	}
+	return total
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func TestEncodeSubsampling(t *testing.T) {
+	m := redText()
+	errors := make(map[Subsampling]int)
+	for _, c := range []struct {
+		subsampling Subsampling
+		ratio       image.YCbCrSubsampleRatio
+	}{
+		{Subsampling420, image.YCbCrSubsampleRatio420},
+		{Subsampling444, image.YCbCrSubsampleRatio444},
+	} {
+		var buf bytes.Buffer
+		err := Encode(&buf, m, &Options{Quality: 90, Subsampling: c.subsampling})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ycbcr, ok := decoded.(*image.YCbCr)
+		if !ok || ycbcr.SubsampleRatio != c.ratio {
+			t.Errorf("Expected a %v image, got: %T", c.ratio, decoded)
+		}
+		if decoded.Bounds() != m.Bounds() {
+			t.Errorf("Expected bounds %v, got: %v", m.Bounds(), decoded.Bounds())
+		}
+		errors[c.subsampling] = redError(t, m, buf.Bytes())
+	}
+	if errors[Subsampling444] >= errors[Subsampling420] {
+		t.Errorf("Expected 4:4:4 to keep the colors better, got errors: %v", errors)
+	}
+}
+
+func TestEncodeGray(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 20, 10))
+	var buf bytes.Buffer
+	err := Encode(&buf, m, &Options{Quality: 75, Subsampling: Subsampling444})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.(*image.Gray); !ok {
+		t.Errorf("Expected a grayscale image, got: %T", decoded)
+	}
+}
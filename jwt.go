@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	jwtSecretEnvVar = "PIXLSERV_JWT_SECRET"
+
+	jwtHS256 = "HS256"
+	jwtRS256 = "RS256"
+
+	// Allowed difference between clocks of the issuer and the server
+	jwtLeeway = 60 * time.Second
+
+	// How often keys are fetched from a JWKS URL at most
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+)
+
+// jwtVerifier checks signatures and claims of JSON Web Tokens
+type jwtVerifier struct {
+	algorithm, issuer, audience, permissionsClaim string
+	secret                                        []byte
+	publicKey                                     *rsa.PublicKey
+	jwks                                          *jwksCache
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwksCache keeps public keys from a JWKS URL by their IDs
+type jwksCache struct {
+	sync.Mutex
+	url     string
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+type jwksKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+func jwtInit(c *Configuration) error {
+	c.jwtAuth = nil
+	if c.jwtAlgorithm == "" {
+		return nil
+	}
+
+	v := &jwtVerifier{
+		algorithm:        c.jwtAlgorithm,
+		issuer:           c.jwtIssuer,
+		audience:         c.jwtAudience,
+		permissionsClaim: c.jwtPermissionsClaim,
+	}
+
+	switch v.algorithm {
+	case jwtHS256:
+		secret := os.Getenv(jwtSecretEnvVar)
+		if secret == "" {
+			return fmt.Errorf("%s not set", jwtSecretEnvVar)
+		}
+		v.secret = []byte(secret)
+	case jwtRS256:
+		if c.jwtPublicKey != "" {
+			data, err := ioutil.ReadFile(c.jwtPublicKey)
+			if err != nil {
+				return err
+			}
+			v.publicKey, err = parseRSAPublicKey(data)
+			if err != nil {
+				return err
+			}
+		} else if c.jwtJWKSURL != "" {
+			v.jwks = &jwksCache{url: c.jwtJWKSURL}
+		} else {
+			return errors.New("RS256 needs a public key or a JWKS URL")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", v.algorithm)
+	}
+
+	c.jwtAuth = v
+	return nil
+}
+
+// bearerToken returns a token from the Authorization header or ""
+func bearerToken(req *http.Request) string {
+	return parseBearerToken(req.Header.Get("Authorization"))
+}
+
+func parseBearerToken(authorization string) string {
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// isAuthorised checks whether a request carries a bearer token or an API
+// key with the given permission
+func isAuthorised(params martini.Params, req *http.Request, permission string) bool {
+	return credentialsAuthorised(requestKey(params, req), bearerToken(req), permission)
+}
+
+// credentialsAuthorised checks a permission is granted by a bearer token when
+// one is given and tokens are accepted, by an API key otherwise
+func credentialsAuthorised(key, token, permission string) bool {
+	if jwtAuth := currentConfig().jwtAuth; token != "" && jwtAuth != nil {
+		permissions, err := jwtAuth.verify(token, time.Now())
+		if err != nil {
+			slog.Info("invalid bearer token", "error", err)
+			return false
+		}
+		return permissions[permission]
+	}
+	return hasPermission(key, permission)
+}
+
+// verify checks a token and returns the permissions it grants
+func (v *jwtVerifier) verify(token string, now time.Time) (map[string]bool, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	// Never let the token choose the algorithm
+	if header.Algorithm != v.algorithm {
+		return nil, fmt.Errorf("unexpected algorithm: %s", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := parts[0] + "." + parts[1]
+	switch v.algorithm {
+	case jwtHS256:
+		if !hmac.Equal(signature, hmacSHA256(v.secret, signed)) {
+			return nil, errors.New("invalid signature")
+		}
+	case jwtRS256:
+		publicKey := v.publicKey
+		if v.jwks != nil {
+			publicKey, err = v.jwks.key(header.KeyID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		hash := sha256.Sum256([]byte(signed))
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature) != nil {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	claims := make(map[string]interface{})
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+	err = v.checkClaims(claims, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwtPermissions(claims[v.permissionsClaim]), nil
+}
+
+func (v *jwtVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if exp, ok := claims["exp"].(float64); ok && now.Add(-jwtLeeway).Unix() > int64(exp) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Unix() < int64(nbf) {
+		return errors.New("token not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return fmt.Errorf("unexpected issuer: %v", claims["iss"])
+	}
+	if v.audience != "" && !jwtHasAudience(claims["aud"], v.audience) {
+		return fmt.Errorf("unexpected audience: %v", claims["aud"])
+	}
+	return nil
+}
+
+// The audience claim can be a string or an array of strings
+func jwtHasAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Permissions can be a space separated string (like OAuth 2 scopes) or an
+// array of strings
+func jwtPermissions(claim interface{}) map[string]bool {
+	var names []string
+	switch permissions := claim.(type) {
+	case string:
+		names = strings.Fields(permissions)
+	case []interface{}:
+		for _, permission := range permissions {
+			if name, ok := permission.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	result := make(map[string]bool)
+	for _, name := range names {
+		if permission, ok := validPermission(name); ok {
+			result[permission] = true
+		}
+	}
+	return result
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		if publicKey, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return publicKey, nil
+		}
+		return nil, errors.New("not an RSA certificate")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaPublicKey, nil
+}
+
+// key returns a public key with the given ID, the keys are fetched again
+// when they get old or an unknown ID is requested (to pick up rotated keys)
+func (c *jwksCache) key(id string) (*rsa.PublicKey, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	publicKey, ok := c.keys[id]
+	age := time.Since(c.fetched)
+	if (!ok && age > jwksMinRefreshInterval) || age > jwksRefreshInterval {
+		err := c.fetch()
+		if err != nil {
+			if ok {
+				slog.Warn("refreshing JWKS failed", "url", currentConfig().jwtJWKSURL, "error", err)
+				return publicKey, nil
+			}
+			return nil, err
+		}
+		publicKey, ok = c.keys[id]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %s", id)
+	}
+	return publicKey, nil
+}
+
+func (c *jwksCache) fetch() error {
+	c.fetched = time.Now()
+
+	resp, err := http.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching JWKS failed: %s", resp.Status)
+	}
+
+	var jwks struct {
+		Keys []jwksKey `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range jwks.Keys {
+		if key.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			continue
+		}
+		keys[key.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	c.keys = keys
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func encodeJWTPart(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestJWTVerifyHS256(t *testing.T) {
+	v := &jwtVerifier{algorithm: jwtHS256, issuer: "idp", audience: "pixlserv", permissionsClaim: "scope", secret: []byte("secret")}
+	now := time.Unix(1000, 0)
+	sign := func(header, claims interface{}, secret string) string {
+		signed := encodeJWTPart(header) + "." + encodeJWTPart(claims)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256([]byte(secret), signed))
+	}
+	header := map[string]string{"alg": jwtHS256}
+
+	token := sign(header, map[string]interface{}{"iss": "idp", "aud": []string{"pixlserv"}, "exp": 2000, "scope": "read admin other"}, "secret")
+	permissions, err := v.verify(token, now)
+	if err != nil || !permissions[ReadPermission] || !permissions[AdminPermission] || permissions[WritePermission] {
+		t.Errorf("Unexpected permissions: %v (%v)", permissions, err)
+	}
+
+	invalid := map[string]string{
+		"wrong secret":   sign(header, map[string]interface{}{"iss": "idp", "aud": "pixlserv"}, "other"),
+		"wrong issuer":   sign(header, map[string]interface{}{"iss": "other", "aud": "pixlserv"}, "secret"),
+		"wrong audience": sign(header, map[string]interface{}{"iss": "idp", "aud": "other"}, "secret"),
+		"expired":        sign(header, map[string]interface{}{"iss": "idp", "aud": "pixlserv", "exp": 500}, "secret"),
+		"algorithm":      sign(map[string]string{"alg": "none"}, map[string]interface{}{"iss": "idp", "aud": "pixlserv"}, "secret"),
+		"malformed":      "abc.def",
+	}
+	for name, token := range invalid {
+		if _, err := v.verify(token, now); err == nil {
+			t.Errorf("Expected the token to be rejected: %s", name)
+		}
+	}
+}
+
+func TestJWTVerifyRS256WithJWKS(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys": [{"kty": "RSA", "kid": "k1", "n": "%s", "e": "%s"}]}`,
+			base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes()))
+	}))
+	defer server.Close()
+
+	v := &jwtVerifier{algorithm: jwtRS256, permissionsClaim: "permissions", jwks: &jwksCache{url: server.URL}}
+	sign := func(kid string) string {
+		signed := encodeJWTPart(map[string]string{"alg": jwtRS256, "kid": kid}) + "." + encodeJWTPart(map[string]interface{}{"permissions": []string{"write"}})
+		hash := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	permissions, err := v.verify(sign("k1"), time.Now())
+	if err != nil || !permissions[WritePermission] {
+		t.Errorf("Unexpected permissions: %v (%v)", permissions, err)
+	}
+	if _, err := v.verify(sign("k2"), time.Now()); err == nil {
+		t.Error("Expected a token signed with an unknown key to be rejected")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+// Quality large JPEG originals are shrunk at, the result is encoded again
+const largeSourceJPEGQuality = 95
+
+// isLargeSource reports whether an original has too many pixels to be decoded
+// in memory and is shrunk by the large sources command first
+func isLargeSource(width, height int) bool {
+	return currentConfig().largeSourceCommand != "" && width*height > currentConfig().largeSourcePixels
+}
+
+// shrunkSize returns the size an original is shrunk to for a geometry, so
+// that its crop still has at least the pixels of the result. It reports
+// false when the original can't be made smaller.
+func shrunkSize(width, height int, geometry engine.Geometry) (int, int, bool) {
+	if geometry.Crop.Empty() {
+		return 0, 0, false
+	}
+	scale := math.Max(float64(geometry.Width)/float64(geometry.Crop.Dx()), float64(geometry.Height)/float64(geometry.Crop.Dy()))
+	if scale >= 1 {
+		return 0, 0, false
+	}
+	return int(math.Ceil(float64(width) * scale)), int(math.Ceil(float64(height) * scale)), true
+}
+
+// largeSourceArgs returns vipsthumbnail's arguments to shrink input to
+// exactly width x height, leaving the orientation as it is like the Go
+// pipeline does
+func largeSourceArgs(input, output, format string, width, height int) []string {
+	if format == "jpeg" {
+		output += "[Q=" + strconv.Itoa(largeSourceJPEGQuality) + "]"
+	}
+	return []string{input, "--size", fmt.Sprintf("%dx%d!", width, height), "--no-rotate", "-o", output}
+}
+
+// shrinkLargeSource shrinks an original too big to be decoded in memory using
+// the large sources command, which reads it from a temporary file and
+// decodes only what it needs to. The result has the original's format and
+// just enough pixels for the geometry, nil is returned when the original
+// can't be made smaller.
+func shrinkLargeSource(ctx context.Context, data []byte, format string, width, height int, geometry engine.Geometry) ([]byte, error) {
+	shrunkWidth, shrunkHeight, ok := shrunkSize(width, height, geometry)
+	if !ok {
+		return nil, nil
+	}
+
+	dir, err := ioutil.TempDir("", "pixlserv-large")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	extension := "." + formatExtension(format)
+	input, output := filepath.Join(dir, "source"+extension), filepath.Join(dir, "shrunk"+extension)
+	err = ioutil.WriteFile(input, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(currentConfig().largeSourceTimeout)*time.Millisecond)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, currentConfig().largeSourceCommand, largeSourceArgs(input, output, format, shrunkWidth, shrunkHeight)...)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("shrinking a large image failed: %s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	shrunk, err := ioutil.ReadFile(output)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(shrunk))
+	if err != nil || config.Width != shrunkWidth || config.Height != shrunkHeight {
+		return nil, fmt.Errorf("shrinking a large image failed: the command's output isn't a %dx%d image", shrunkWidth, shrunkHeight)
+	}
+	return shrunk, nil
+}
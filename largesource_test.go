@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestShrunkSize(t *testing.T) {
+	params := engine.Params{Width: 400, Height: 300, Scale: 1, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter}
+	geometry := engine.Plan(params, 16000, 12000)
+	width, height, ok := shrunkSize(16000, 12000, geometry)
+	if !ok || width != 400 || height != 300 {
+		t.Errorf("Expected 400x300, got %dx%d, %v", width, height, ok)
+	}
+	if shrunk := engine.Plan(params, width, height); shrunk.Width != geometry.Width || shrunk.Height != geometry.Height {
+		t.Errorf("Expected the shrunk image to give a %dx%d result, got %dx%d", geometry.Width, geometry.Height, shrunk.Width, shrunk.Height)
+	}
+
+	// Crops at the original scale can't be made smaller
+	params.Cropping = engine.CroppingModeKeepScale
+	if _, _, ok := shrunkSize(16000, 12000, engine.Plan(params, 16000, 12000)); ok {
+		t.Errorf("Expected crops keeping the scale not to be shrunk")
+	}
+}
+
+func TestShrinkLargeSource(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var shrunk bytes.Buffer
+	png.Encode(&shrunk, image.NewRGBA(image.Rect(0, 0, 40, 30)))
+	err = ioutil.WriteFile(filepath.Join(dir, "shrunk.png"), shrunk.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records its arguments and writes the shrunk image where it's told to
+	command := filepath.Join(dir, "vipsthumbnail")
+	script := "#!/bin/sh\necho \"$@\" > " + dir + "/args\ncp " + dir + "/shrunk.png \"$6\"\n"
+	err = ioutil.WriteFile(command, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(&Configuration{largeSourceCommand: command, largeSourcePixels: 1000, largeSourceTimeout: defaultLargeSourceTimeout})
+
+	if !isLargeSource(400, 300) || isLargeSource(20, 20) {
+		t.Errorf("Expected only originals over 1000 pixels to be large")
+	}
+	params := engine.Params{Width: 40, Height: 30, Scale: 1, Cropping: engine.CroppingModeExact, Gravity: engine.GravityCenter}
+	data, err := shrinkLargeSource(context.Background(), []byte("original"), "png", 400, 300, engine.Plan(params, 400, 300))
+	if err != nil || !bytes.Equal(data, shrunk.Bytes()) {
+		t.Errorf("Expected the command's output, got %d bytes, %v", len(data), err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if fields := strings.Fields(string(args)); len(fields) != 6 || fields[2] != "40x30!" || fields[3] != "--no-rotate" {
+		t.Errorf("Unexpected arguments: %s", args)
+	}
+
+	// Outputs of another size are refused
+	params.Width, params.Height = 80, 60
+	if _, err := shrinkLargeSource(context.Background(), []byte("original"), "png", 400, 300, engine.Plan(params, 400, 300)); err == nil {
+		t.Errorf("Expected an error for a 40x30 image instead of 80x60")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+const (
+	defaultPort = "3000"
+
+	// File descriptors passed by systemd start after stdin, stdout and stderr
+	systemdFirstFD = 3
+)
+
+// servedOn restricts a handler to the requests meant for a listener: the
+// management routes on the admin address and the others on the public one.
+// Both answer health checks.
+func servedOn(handler http.Handler, admin bool) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		if path != "/healthz" && path != "/readyz" && isManagementPath(req.Host, path) != admin {
+			http.NotFound(res, req)
+			return
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+// serveAdmin serves the management routes on the admin address, without TLS
+func serveAdmin(handler http.Handler) error {
+	listener, err := net.Listen("tcp", currentConfig().adminAddress)
+	if err != nil {
+		return err
+	}
+	slog.Info("listening for management requests", "address", listener.Addr().String())
+	return http.Serve(listener, servedOn(handler, true))
+}
+
+// listen opens the listener requests are accepted from: a socket passed by
+// systemd, a unix socket or a TCP address
+func listen() (net.Listener, error) {
+	if n := systemdListenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid()); n > 0 {
+		if n > 1 {
+			slog.Warn("systemd passed more than one socket, using the first one", "sockets", n)
+		}
+		// Not meant for child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		file := os.NewFile(systemdFirstFD, "systemd-socket")
+		defer file.Close()
+		return net.FileListener(file)
+	}
+
+	if currentConfig().unixSocket != "" {
+		return listenUnix(currentConfig().unixSocket, currentConfig().unixSocketMode, currentConfig().unixSocketOwner, currentConfig().unixSocketGroup)
+	}
+
+	return net.Listen("tcp", listenAddress())
+}
+
+// listenAddress returns the address to listen on taken from the HOST and
+// PORT environment variables like martini does
+func listenAddress() string {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = defaultPort
+	}
+	return os.Getenv("HOST") + ":" + port
+}
+
+// systemdListenFDs returns the number of sockets systemd passed to the
+// process with the given pid using socket activation
+func systemdListenFDs(listenPID, listenFDs string, pid int) int {
+	if listenPID != strconv.Itoa(pid) {
+		return 0
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// listenUnix listens on a unix socket, a socket left behind by a previous run
+// is replaced. The socket gets the given mode (when not 0) and owner and group
+// (when not "").
+func listenUnix(path string, mode os.FileMode, owner, group string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setSocketPermissions(path, mode, owner, group)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func setSocketPermissions(path string, mode os.FileMode, owner, group string) error {
+	if mode != 0 {
+		err := os.Chmod(path, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	err := os.Chown(path, uid, gid)
+	if err != nil {
+		return fmt.Errorf("changing the owner of %s failed: %s", path, err)
+	}
+	return nil
+}
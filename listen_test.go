@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSystemdListenFDs(t *testing.T) {
+	cases := []struct {
+		listenPID, listenFDs string
+		exp                  int
+	}{
+		{"", "", 0},
+		{"42", "2", 2},
+		{"41", "2", 0},
+		{"42", "x", 0},
+		{"42", "-1", 0},
+	}
+
+	for _, c := range cases {
+		n := systemdListenFDs(c.listenPID, c.listenFDs, 42)
+		if n != c.exp {
+			t.Errorf("Expected %d sockets for LISTEN_PID=%q LISTEN_FDS=%q, got: %d", c.exp, c.listenPID, c.listenFDs, n)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pixlserv.sock")
+
+	for i := 0; i < 2; i++ {
+		listener, err := listenUnix(path, 0660, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.Mode().Perm() != 0660 {
+			t.Errorf("Expected the socket to have mode 0660, got: %v, %v", info, err)
+		}
+		// Leave the socket behind like a crashed process would
+		if l, ok := listener.(interface{ SetUnlinkOnClose(bool) }); ok {
+			l.SetUnlinkOnClose(false)
+		}
+		listener.Close()
+	}
+}
+
+func TestServedOn(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{tenants: []*Tenant{{name: "acme", prefix: "acme/"}}})
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {})
+	public, admin := servedOn(handler, false), servedOn(handler, true)
+	for _, c := range []struct {
+		path          string
+		public, admin int
+	}{
+		{"/image/w_400/cat.jpg", http.StatusOK, http.StatusNotFound},
+		{"/KEY/image/w_400/cat.jpg", http.StatusOK, http.StatusNotFound},
+		{"/KEY/upload", http.StatusNotFound, http.StatusOK},
+		{"/uploads/abc", http.StatusNotFound, http.StatusOK},
+		{"/KEY/cache/stats", http.StatusNotFound, http.StatusOK},
+		{"/KEY/usage", http.StatusNotFound, http.StatusOK},
+		{"/metrics", http.StatusNotFound, http.StatusOK},
+		{"/KEY/downloads", http.StatusNotFound, http.StatusOK},
+		{"/download/cat.jpg", http.StatusOK, http.StatusNotFound},
+		{"/KEY/batch", http.StatusNotFound, http.StatusOK},
+		{"/acme/image/w_400/cat.jpg", http.StatusOK, http.StatusNotFound},
+		{"/acme/KEY/upload", http.StatusNotFound, http.StatusOK},
+		{"/acme/cache/purge", http.StatusNotFound, http.StatusOK},
+		{"/acme/keys", http.StatusNotFound, http.StatusOK},
+		{"/acme/KEY/usage", http.StatusNotFound, http.StatusOK},
+		{"/readyz", http.StatusOK, http.StatusOK},
+	} {
+		for _, l := range []struct {
+			handler http.Handler
+			exp     int
+		}{{public, c.public}, {admin, c.admin}} {
+			res := httptest.NewRecorder()
+			l.handler.ServeHTTP(res, httptest.NewRequest("GET", c.path, nil))
+			if res.Code != l.exp {
+				t.Errorf("Expected %d for %s, got: %d", l.exp, c.path, res.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Environment variables overriding the log settings from the config file
+	logFormatEnvVar = "PIXLSERV_LOG_FORMAT"
+	logLevelEnvVar  = "PIXLSERV_LOG_LEVEL"
+
+	// Header identifying a request in logs, taken from the client (usually
+	// a load balancer) when it is set and sent back in responses
+	requestIDHeader = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// requestLog collects what a request was about for its log entry
+type requestLog struct {
+	id, traceID, imagePath, parameters, transformation, cacheStatus string
+
+	// Sent back in debug headers when the request asks for them, only known
+	// for images the request generated
+	debug                        bool
+	queueWait, transformDuration time.Duration
+	sourceWidth, sourceHeight    int
+}
+
+type requestLogKey struct{}
+
+// loggingInit switches the server's logs to structured logs in the
+// configured format, messages logged using the log package end up there too
+func loggingInit() error {
+	handler, err := newLogHandler(currentConfig())
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// newLogHandler returns a handler writing logs in the format and from the
+// level of a configuration, unless the environment overrides them
+func newLogHandler(c *Configuration) (slog.Handler, error) {
+	format := c.logFormat
+	if env := os.Getenv(logFormatEnvVar); env != "" {
+		format = env
+	}
+	levelName := c.logLevel
+	if env := os.Getenv(logLevelEnvVar); env != "" {
+		levelName = env
+	}
+
+	level, ok := logLevels[strings.ToLower(levelName)]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level: %s", levelName)
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, options), nil
+	case "logfmt":
+		return slog.NewTextHandler(os.Stderr, options), nil
+	}
+	return nil, fmt.Errorf("unknown log format: %s", format)
+}
+
+// logRequests is a middleware logging every request once it is answered
+func logRequests(c martini.Context, res http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+
+	entry := &requestLog{id: req.Header.Get(requestIDHeader)}
+	if entry.id == "" || len(entry.id) > maxRequestIDLength {
+		entry.id = newRequestID()
+	}
+	res.Header().Set(requestIDHeader, entry.id)
+	c.Map(req.WithContext(context.WithValue(req.Context(), requestLogKey{}, entry)))
+
+	c.Next()
+
+	rw := res.(martini.ResponseWriter)
+	attrs := []slog.Attr{
+		slog.String("request_id", entry.id),
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.Int("status", rw.Status()),
+		slog.Float64("duration_ms", float64(time.Since(start))/float64(time.Millisecond)),
+		slog.Int("bytes", rw.Size()),
+	}
+	if entry.traceID != "" {
+		attrs = append(attrs, slog.String("trace_id", entry.traceID))
+	}
+	if entry.imagePath != "" {
+		attrs = append(attrs, slog.String("image", entry.imagePath), slog.String("parameters", entry.parameters))
+	}
+	if entry.cacheStatus != "" {
+		attrs = append(attrs, slog.String("cache", entry.cacheStatus))
+	}
+
+	if currentConfig().dashboard {
+		recentRequests.add(RecentRequest{start, req.Method, req.URL.Path, rw.Status(), rw.Size(), time.Since(start), entry.transformation, entry.cacheStatus})
+	}
+
+	level := slog.LevelInfo
+	if rw.Status() >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.LogAttrs(req.Context(), level, "request", attrs...)
+}
+
+// requestLogFor returns the log entry of a request, requests which aren't
+// logged get one which is thrown away
+func requestLogFor(req *http.Request) *requestLog {
+	return requestLogFromContext(req.Context())
+}
+
+// requestLogFromContext is requestLogFor for the context of a request
+func requestLogFromContext(ctx context.Context) *requestLog {
+	entry, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return &requestLog{}
+	}
+	return entry
+}
+
+// errorWithRequestID adds the ID of a request to an error message, so that
+// failures reported by clients can be found in the logs
+func errorWithRequestID(res http.ResponseWriter, message string) string {
+	id := res.Header().Get(requestIDHeader)
+	if id == "" {
+		return message
+	}
+	return message + " (request ID: " + id + ")"
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
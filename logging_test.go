@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestLoggingInit(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer os.Unsetenv(logLevelEnvVar)
+
+	cases := []struct {
+		format, level, envLevel string
+		ok                      bool
+	}{
+		{"logfmt", "info", "", true},
+		{"JSON", "debug", "", true},
+		{"xml", "info", "", false},
+		{"logfmt", "verbose", "", false},
+		{"logfmt", "verbose", "warn", true},
+	}
+
+	for _, c := range cases {
+		currentConfig().logFormat = c.format
+		currentConfig().logLevel = c.level
+		os.Setenv(logLevelEnvVar, c.envLevel)
+		err := loggingInit()
+		if (err == nil) != c.ok {
+			t.Errorf("Expected loggingInit() with format %q and level %q (env %q) to succeed: %t, got error: %v", c.format, c.level, c.envLevel, c.ok, err)
+		}
+	}
+}
+
+func TestRequestIDInErrors(t *testing.T) {
+	res := httptest.NewRecorder()
+	if message := errorWithRequestID(res, "Image not found"); message != "Image not found" {
+		t.Errorf("Expected the message to be kept without an ID, got: %s", message)
+	}
+	res.Header().Set(requestIDHeader, "abc123")
+	if message := errorWithRequestID(res, "Image not found"); message != "Image not found (request ID: abc123)" {
+		t.Errorf("Unexpected message: %s", message)
+	}
+
+	_, body := jsonResponse(res, http.StatusNotFound, UploadResponse{"error", "not found", ""})
+	if body != `{"status":"error","errorMessage":"not found","imagePath":"","requestId":"abc123"}` {
+		t.Errorf("Unexpected body: %s", body)
+	}
+	_, body = jsonResponse(res, http.StatusOK, UploadResponse{"ok", "", "cat.jpg"})
+	if body != `{"status":"ok","errorMessage":"","imagePath":"cat.jpg"}` {
+		t.Errorf("Expected no request ID in successful responses, got: %s", body)
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	permissionsByKey = map[string]map[string]bool{"ADMIN": {AdminPermission: true}, "READER": {ReadPermission: true}}
+	req := httptest.NewRequest("GET", "/image/w_400/cat.jpg", nil)
+	if wantsDebugHeaders(martini.Params{"apikey": "ADMIN"}, req) {
+		t.Error("Expected no debug headers without asking for them")
+	}
+	req.Header.Set(debugHeader, "1")
+	if !wantsDebugHeaders(martini.Params{"apikey": "ADMIN"}, req) {
+		t.Error("Expected debug headers for admins")
+	}
+	if wantsDebugHeaders(martini.Params{"apikey": "READER"}, req) {
+		t.Error("Expected no debug headers without the admin permission")
+	}
+
+	res := httptest.NewRecorder()
+	setDebugHeaders(res, &requestLog{cacheStatus: "miss"})
+	if len(res.Header()) != 0 {
+		t.Errorf("Expected no headers without debugging, got: %v", res.Header())
+	}
+	setDebugHeaders(res, &requestLog{cacheStatus: "miss", debug: true, queueWait: 2500 * time.Microsecond, transformDuration: 40 * time.Millisecond, sourceWidth: 4000, sourceHeight: 3000})
+	expected := map[string]string{"Pixlserv-Cache": "miss", "Pixlserv-Queue-Wait": "2.5", "Pixlserv-Transform-Duration": "40.0", "Pixlserv-Source-Dimensions": "4000x3000"}
+	for name, value := range expected {
+		if res.Header().Get(name) != value {
+			t.Errorf("Expected %s: %s, got: %q", name, value, res.Header().Get(name))
+		}
+	}
+
+	res = httptest.NewRecorder()
+	setDebugHeaders(res, &requestLog{cacheStatus: "hit", debug: true})
+	if res.Header().Get("Pixlserv-Cache") != "hit" || res.Header().Get("Pixlserv-Transform-Duration") != "" {
+		t.Errorf("Unexpected headers for a cache hit: %v", res.Header())
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"log/slog"
+	"net/http"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Previews are meant to be inlined in pages, they are kept small
+	maxLQIPWidth       = 64
+	lqipJPEGQuality    = 50
+	lqipLinkParameters = "; rel=preload; as=image"
+)
+
+// lqipDataURI returns a tiny preview of an encoded image, at most width
+// pixels wide, as a data URI. Previews of images with transparency are PNG
+// images, the others JPEG ones.
+func lqipDataURI(data []byte, width int) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if img.Bounds().Dx() > width {
+		params := engine.Params{Width: width, Scale: 1, Cropping: engine.CroppingModeExact, Gravity: engine.DefaultGravity, Filter: engine.DefaultFilter}
+		img = engine.Transform(img, params)
+	}
+
+	var buffer bytes.Buffer
+	format := "jpeg"
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		format = "png"
+		err = png.Encode(&buffer, engine.Dither(img))
+	} else {
+		err = jpegenc.Encode(&buffer, engine.Dither(img), &jpegenc.Options{Quality: lqipJPEGQuality, Subsampling: jpegenc.Subsampling420})
+	}
+	if err != nil {
+		return "", err
+	}
+	return "data:image/" + format + ";base64," + base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+// setLQIPHeader adds the preview of a transformed image to a response when
+// previews are configured, videos and WebP images (which Go can't decode)
+// have none. Previews are kept with cached
+// images, data is only decoded when there is none yet and may be nil when
+// it isn't at hand.
+func setLQIPHeader(res http.ResponseWriter, transformation *Transformation, fullImagePath string, data []byte) {
+	if currentConfig().lqipHeader == "" || transformation.videoFormat != "" || transformation.webp != nil {
+		return
+	}
+	key := cacheKey(fullImagePath)
+	preview := ""
+	if !transformation.personalised {
+		preview, _ = redis.String(Conn.Do("HGET", key, "preview"))
+	}
+	if preview == "" {
+		if data == nil {
+			return
+		}
+		var err error
+		preview, err = lqipDataURI(data, currentConfig().lqipWidth)
+		if err != nil {
+			slog.Error("generating a preview failed", "path", fullImagePath, "error", err)
+			return
+		}
+		// Only kept for images which are cached already
+		if !transformation.personalised {
+			if cached, _ := redis.Bool(Conn.Do("HEXISTS", key, "size")); cached {
+				Conn.Do("HSET", key, "preview", preview)
+			}
+		}
+	}
+
+	if currentConfig().lqipHeader == "Link" {
+		res.Header().Add("Link", "<"+preview+">"+lqipLinkParameters)
+	} else {
+		res.Header().Set(currentConfig().lqipHeader, preview)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLQIPDataURI(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var buffer bytes.Buffer
+	png.Encode(&buffer, img)
+
+	uri, err := lqipDataURI(buffer.Bytes(), 16)
+	if err != nil || !strings.HasPrefix(uri, "data:image/jpeg;base64,") {
+		t.Fatalf("Expected a JPEG data URI, got %q, %v", uri, err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, "data:image/jpeg;base64,"))
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || config.Width != 16 || config.Height != 8 {
+		t.Errorf("Expected a 16x8 preview, got %+v, %v", config, err)
+	}
+
+	// Transparency is kept
+	img.SetNRGBA(0, 0, color.NRGBA{0, 0, 0, 0})
+	buffer.Reset()
+	png.Encode(&buffer, img)
+	if uri, _ := lqipDataURI(buffer.Bytes(), 300); !strings.HasPrefix(uri, "data:image/png;base64,") {
+		t.Errorf("Expected a PNG data URI, got %q", uri)
+	}
+}
+
+func TestSetLQIPHeader(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	var buffer bytes.Buffer
+	png.Encode(&buffer, image.NewGray(image.Rect(0, 0, 40, 40)))
+	// Personalised images aren't cached, their previews aren't looked up
+	transformation := &Transformation{personalised: true}
+
+	setConfig(&Configuration{lqipHeader: defaultLQIPHeader, lqipWidth: defaultLQIPWidth})
+	res := httptest.NewRecorder()
+	setLQIPHeader(res, transformation, "cat--w_40--.jpg", buffer.Bytes())
+	if link := res.Header().Get("Link"); !strings.HasPrefix(link, "<data:image/jpeg;base64,") || !strings.HasSuffix(link, ">; rel=preload; as=image") {
+		t.Errorf("Unexpected Link header: %s", link)
+	}
+
+	setConfig(&Configuration{lqipHeader: "X-Preview", lqipWidth: defaultLQIPWidth})
+	res = httptest.NewRecorder()
+	setLQIPHeader(res, transformation, "cat--w_40--.jpg", buffer.Bytes())
+	if preview := res.Header().Get("X-Preview"); !strings.HasPrefix(preview, "data:image/jpeg;base64,") || res.Header().Get("Link") != "" {
+		t.Errorf("Expected the preview in X-Preview, got %v", res.Header())
+	}
+
+	res = httptest.NewRecorder()
+	setLQIPHeader(res, &Transformation{personalised: true, videoFormat: videoFormatMP4}, "cat--w_40--.gif", buffer.Bytes())
+	if len(res.Header()) != 0 {
+		t.Errorf("Expected videos to have no preview, got %v", res.Header())
+	}
+}
+
+func TestParseLQIPConfig(t *testing.T) {
+	conf, err := parseConfig(map[interface{}]interface{}{"lqip": map[interface{}]interface{}{"header": "x-preview"}})
+	if err != nil || conf.lqipHeader != "X-Preview" || conf.lqipWidth != defaultLQIPWidth {
+		t.Errorf("Unexpected preview settings: %v", err)
+	}
+	for _, width := range []interface{}{0, 65, "small"} {
+		m := map[interface{}]interface{}{"lqip": map[interface{}]interface{}{"width": width}}
+		if _, err := parseConfig(m); err == nil {
+			t.Errorf("Expected an error for width %v", width)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Redis key of the report of the last maintenance run
+	cacheMaintenanceReportKey = "cache:maintenance:report"
+	// Redis key used so that only one instance runs each scheduled run
+	cacheMaintenanceLockKey     = "cache:maintenance:lock"
+	cacheMaintenanceLockSeconds = 60 * 60
+)
+
+// 1 while runCacheMaintenance is running
+var maintaining int32
+
+// CacheMaintenanceReport describes what a maintenance run of the cache did
+type CacheMaintenanceReport struct {
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+	// Images past their TTL
+	Expired int `json:"expired"`
+	// Images whose originals were deleted
+	Orphaned int `json:"orphaned"`
+	// Images whose originals were replaced since they were generated
+	Outdated int `json:"outdated"`
+	// Records of the cache index without an image, or the other way round
+	Compacted int `json:"compacted"`
+	// Images moved to the cache directory they belong in
+	Rebalanced int `json:"rebalanced,omitempty"`
+	// The cache after the run
+	Entries int64 `json:"entries"`
+	Size    int64 `json:"size"`
+}
+
+// cacheMaintenanceLoop runs the maintenance of the cache at the times its
+// schedule says, the schedule is checked every minute so that changing it
+// only needs a reload
+func cacheMaintenanceLoop() {
+	for now := range time.Tick(time.Minute) {
+		schedule := currentConfig().cacheMaintenanceSchedule
+		if schedule == nil || !schedule.matches(now) {
+			continue
+		}
+		// Instances sharing redis take turns
+		minute := strconv.FormatInt(now.Unix()/60, 10)
+		_, err := redis.String(Conn.Do("SET", cacheMaintenanceLockKey+":"+minute, instanceID, "NX", "EX", cacheMaintenanceLockSeconds))
+		if err != nil {
+			continue
+		}
+		go runCacheMaintenance()
+	}
+}
+
+// runCacheMaintenance moves cached images to the cache directories they
+// belong in, removes expired, orphaned and outdated cached images and records
+// missing from either the cache index or the storage, then fixes the total
+// size of the cache. Its report is logged and kept in redis.
+func runCacheMaintenance() *CacheMaintenanceReport {
+	if !atomic.CompareAndSwapInt32(&maintaining, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&maintaining, 0)
+
+	report := &CacheMaintenanceReport{Started: time.Now()}
+	slog.Info("cache maintenance started")
+	err := maintainCache(report)
+	if err != nil {
+		report.ErrorMessage = err.Error()
+		slog.Error("cache maintenance failed", "error", err)
+	}
+	report.Finished = time.Now()
+	slog.Info("cache maintenance finished", "expired", report.Expired, "orphaned", report.Orphaned, "outdated", report.Outdated, "compacted", report.Compacted, "rebalanced", report.Rebalanced,
+		"entries", report.Entries, "size", report.Size, "duration", report.Finished.Sub(report.Started))
+
+	data, _ := json.Marshal(report)
+	Conn.Do("SET", cacheMaintenanceReportKey, data)
+	return report
+}
+
+func maintainCache(report *CacheMaintenanceReport) error {
+	// Images in the wrong cache directory would look missing below
+	if storageShards != nil {
+		moved, err := storageShards.rebalance()
+		report.Rebalanced = moved
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := redis.Strings(Conn.Do("ZRANGE", "imageaccesstimestamps", 0, -1))
+	if err != nil {
+		return err
+	}
+	// Versions of the originals, nil when they are missing or can't be read
+	originals := make(map[string]*FileInfo)
+	missing := make(map[string]bool)
+	changed := make(map[string]bool)
+	for _, key := range keys {
+		filePath := strings.TrimPrefix(key, "image:")
+		if !inCacheNamespace(filePath) {
+			continue
+		}
+		values, err := redis.Strings(Conn.Do("HMGET", key, "size", "expires", "source"))
+		if err != nil {
+			return err
+		}
+		if values[0] == "" {
+			// Only left in the access lists
+			Conn.Do("ZREM", "imageaccesstimestamps", key)
+			Conn.Do("ZREM", "imageaccesscounts", key)
+			report.Compacted++
+			continue
+		}
+		size, _ := strconv.Atoi(values[0])
+		if expires, err := strconv.ParseInt(values[1], 10, 64); err == nil && expires <= time.Now().Unix() {
+			removeFromCache(key)
+			report.Expired++
+			continue
+		}
+
+		if original, ok := originalPath(filePath); ok {
+			sourceInfo, checked := originals[original]
+			if !checked {
+				var err error
+				sourceInfo, err = storageImpl.Stat(original)
+				originals[original] = sourceInfo
+				missing[original] = err == ErrNotFound
+			}
+			if missing[original] {
+				removeFromCache(key)
+				report.Orphaned++
+				continue
+			}
+			// Images generated before versions were recorded are kept
+			if sourceInfo != nil && values[2] != "" && values[2] != fileVersion(sourceInfo) {
+				removeFromCache(key)
+				report.Outdated++
+				changed[original] = true
+				continue
+			}
+		}
+
+		if fileMissing(filePath) {
+			hotCache.remove(filePath)
+			Conn.Do("DEL", key)
+			Conn.Do("ZREM", "imageaccesstimestamps", key)
+			Conn.Do("ZREM", "imageaccesscounts", key)
+			Conn.Do("DECRBY", "totalcachesize", size)
+			report.Compacted++
+		}
+	}
+
+	// Images of replaced originals are generated again when they are
+	// requested next
+	replaced := make([]string, 0, len(changed))
+	for original := range changed {
+		forgetSourceMetadata(original)
+		replaced = append(replaced, original)
+	}
+	cdnPurge(replaced)
+
+	// Counts of images no longer in the cache
+	counted, err := redis.Strings(Conn.Do("ZRANGE", "imageaccesscounts", 0, -1))
+	if err != nil {
+		return err
+	}
+	for _, key := range counted {
+		score, err := Conn.Do("ZSCORE", "imageaccesstimestamps", key)
+		if err == nil && score == nil && inCacheNamespace(strings.TrimPrefix(key, "image:")) {
+			Conn.Do("ZREM", "imageaccesscounts", key)
+			report.Compacted++
+		}
+	}
+
+	// The total size drifts when instances stop in the middle of updates
+	keys, err = redis.Strings(Conn.Do("ZRANGE", "imageaccesstimestamps", 0, -1))
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, key := range keys {
+		size, _ := redis.Int64(Conn.Do("HGET", key, "size"))
+		total += size
+	}
+	Conn.Do("SET", "totalcachesize", total)
+	report.Entries = int64(len(keys))
+	report.Size = total
+	return nil
+}
+
+// fileMissing reports whether a file is gone from the storage, errors
+// reading it don't count so that nothing is removed while it is unavailable
+func fileMissing(filePath string) bool {
+	_, err := storageImpl.Stat(filePath)
+	return err == ErrNotFound
+}
+
+// lastCacheMaintenance returns the report of the last maintenance run, nil
+// when there was none
+func lastCacheMaintenance() (*CacheMaintenanceReport, error) {
+	data, err := redis.Bytes(Conn.Do("GET", cacheMaintenanceReportKey))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var report CacheMaintenanceReport
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// CacheMaintenanceResponse is a struct to represent a JSON response for the
+// cache maintenance handlers
+type CacheMaintenanceResponse struct {
+	Status       string                  `json:"status"`
+	ErrorMessage string                  `json:"errorMessage,omitempty"`
+	Report       *CacheMaintenanceReport `json:"report,omitempty"`
+}
+
+// cacheMaintenanceHandler returns the report of the last maintenance run
+func cacheMaintenanceHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, CacheMaintenanceResponse{Status: "error", ErrorMessage: "API key invalid or missing"})
+	}
+	report, err := lastCacheMaintenance()
+	if err != nil {
+		slog.Error("retrieving the cache maintenance report failed", "error", err)
+		return jsonResponse(res, http.StatusInternalServerError, CacheMaintenanceResponse{Status: "error", ErrorMessage: "server error"})
+	}
+	if report == nil {
+		return jsonResponse(res, http.StatusNotFound, CacheMaintenanceResponse{Status: "error", ErrorMessage: "no maintenance run yet"})
+	}
+	return jsonResponse(res, http.StatusOK, CacheMaintenanceResponse{Status: "ok", Report: report})
+}
+
+// cacheMaintenanceStartHandler runs the maintenance straight away, in the
+// background
+func cacheMaintenanceStartHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, CacheMaintenanceResponse{Status: "error", ErrorMessage: "API key invalid or missing"})
+	}
+	if atomic.LoadInt32(&maintaining) == 1 {
+		return jsonResponse(res, http.StatusConflict, CacheMaintenanceResponse{Status: "error", ErrorMessage: "maintenance already running"})
+	}
+	go runCacheMaintenance()
+	return jsonResponse(res, http.StatusAccepted, CacheMaintenanceResponse{Status: "ok"})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"path"
+	"regexp"
+)
+
+// Parameter cutting images out with a mask image (mask_star.png)
+const parameterMask = "mask"
+
+// Names of mask images, they are looked up in the mask path
+var maskNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+\.(png|jpg|jpeg)$`)
+
+// removeMask removes the mask parameter from a parameters string like
+// "w_400,mask_star.png" and returns its value, "" when there is none
+func removeMask(parametersStr string) (string, string, error) {
+	rest, value := removeParameter(parametersStr, parameterMask)
+	if value != "" && !maskNameRe.MatchString(value) {
+		return rest, "", fmt.Errorf("invalid mask: %s (needs to be the name of a PNG or JPEG image)", value)
+	}
+	return rest, value, nil
+}
+
+// loadMask loads a mask image from the storage, masks are kept apart from
+// originals in the configured mask path
+func loadMask(name string) (image.Image, error) {
+	mask, _, err := loadImage(path.Join(currentConfig().maskPath, name))
+	return mask, err
+}
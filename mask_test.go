@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveMask(t *testing.T) {
+	rest, mask, err := removeMask("w_400,mask_star.png,h_300")
+	if err != nil || rest != "w_400,h_300" || mask != "star.png" {
+		t.Errorf("Unexpected result: %s %s %v", rest, mask, err)
+	}
+	for _, parameters := range []string{"w_400,mask_star", "w_400,mask_..%2Fcat.png", "w_400,mask_star.gif"} {
+		if _, _, err := removeMask(parameters); err == nil {
+			t.Errorf("Expected an error for %s", parameters)
+		}
+	}
+}
+
+func TestTransformCropAndResizeMask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Keeps the left half
+	mask := image.NewGray(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		mask.SetGray(0, y, color.Gray{255})
+		mask.SetGray(1, y, color.Gray{255})
+	}
+	var buffer bytes.Buffer
+	png.Encode(&buffer, mask)
+	os.Mkdir(filepath.Join(dir, "masks"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "masks", "half.png"), buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig, oldStorage := currentConfig(), storageImpl
+	defer func() { setConfig(oldConfig); storageImpl = oldStorage }()
+	setConfig(&Configuration{allowedFormats: supportedFormats, maskPath: defaultMaskPath})
+	storageImpl = &localStorage{dir}
+
+	params, _ := parseParameters("w_4,h_4", currentConfig())
+	transformation := Transformation{params: &params, mask: "half.png"}
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	masked, err := transformCropAndResize(img, "jpeg", "cat.jpg", &transformation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := masked.At(0, 0).RGBA(); a != 0xffff {
+		t.Errorf("Expected the left half to be kept, got alpha %d", a)
+	}
+	if _, _, _, a := masked.At(3, 0).RGBA(); a != 0 {
+		t.Errorf("Expected the right half to be cut, got alpha %d", a)
+	}
+	if format := transformation.outputFormat("jpeg"); format != "png" {
+		t.Errorf("Expected masked JPEG images to be encoded as PNG, got %s", format)
+	}
+
+	transformation.mask = "missing.png"
+	if _, err := transformCropAndResize(img, "jpeg", "cat.jpg", &transformation); err == nil {
+		t.Errorf("Expected an error for a missing mask")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Parameter capping the size of encoded images in bytes (maxbytes_50000)
+	parameterMaxBytes = "maxbytes"
+
+	// JPEG images are encoded at a lower quality first and made smaller once
+	// even this one is too big
+	maxBytesMinQuality = 30
+	// Each step makes images this much smaller, at most maxBytesSteps times
+	maxBytesScaleStep = 0.8
+	maxBytesSteps     = 10
+
+	// Tells what was done to images to fit in their size cap
+	fitHeader = "Pixlserv-Fit"
+)
+
+// sizeFit is what was done to an image so that it fits in its size cap
+type sizeFit struct {
+	quality int     // JPEG quality it was encoded at, 0 if it wasn't lowered
+	scale   float64 // Factor its dimensions were reduced by, 1 if they weren't
+}
+
+// String describes a fit for the Pixlserv-Fit header, e.g. quality=62 or
+// quality=30, scale=0.64
+func (f *sizeFit) String() string {
+	if f == nil {
+		return "none"
+	}
+	parts := make([]string, 0, 2)
+	if f.quality != 0 {
+		parts = append(parts, "quality="+strconv.Itoa(f.quality))
+	}
+	if f.scale != 1 {
+		parts = append(parts, "scale="+strconv.FormatFloat(f.scale, 'g', 4, 64))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// removeMaxBytes removes the size cap parameter from a parameters string like
+// "w_400,maxbytes_50000" and returns its value, 0 when there is none
+func removeMaxBytes(parametersStr string) (string, int, error) {
+	rest, value := removeParameter(parametersStr, parameterMaxBytes)
+	if value == "" {
+		return rest, 0, nil
+	}
+	maxBytes, err := strconv.Atoi(value)
+	if err != nil || maxBytes < 1 {
+		return rest, 0, fmt.Errorf("invalid max bytes: %s (needs to be a positive number)", value)
+	}
+	return rest, maxBytes, nil
+}
+
+// outputMaxBytes returns the size cap of the transformation's images, the
+// lower of its own and the configured one, 0 when there is none
+func (t *Transformation) outputMaxBytes() int {
+	maxBytes := currentConfig().outputMaxBytes
+	if t.maxBytes != 0 && (maxBytes == 0 || t.maxBytes < maxBytes) {
+		maxBytes = t.maxBytes
+	}
+	return maxBytes
+}
+
+// fitToMaxBytes encodes an image in at most maxBytes bytes. JPEG images are
+// encoded at the highest quality down to maxBytesMinQuality which fits, then
+// images are made smaller step by step. Images which don't fit even after the
+// last step are refused.
+func fitToMaxBytes(img image.Image, format string, transformation *Transformation, maxBytes int) ([]byte, *sizeFit, error) {
+	var buffer bytes.Buffer
+	options := *transformation.jpegOptions()
+	fit := &sizeFit{scale: 1}
+	if format != "png" {
+		// Sizes shrink with the quality, so the highest one which fits is
+		// searched for
+		var best []byte
+		low, high := maxBytesMinQuality, options.Quality-1
+		for low <= high {
+			options.Quality = (low + high) / 2
+			buffer.Reset()
+			if err := writeJPEG(img, &options, &buffer); err != nil {
+				return nil, nil, err
+			}
+			if buffer.Len() <= maxBytes {
+				best = append(best[:0], buffer.Bytes()...)
+				fit.quality = options.Quality
+				low = options.Quality + 1
+			} else {
+				high = options.Quality - 1
+			}
+		}
+		if best != nil {
+			return best, fit, nil
+		}
+		options.Quality = maxBytesMinQuality
+		fit.quality = maxBytesMinQuality
+	}
+
+	bounds := img.Bounds()
+	for step := 1; step <= maxBytesSteps; step++ {
+		fit.scale *= maxBytesScaleStep
+		width, height := int(float64(bounds.Dx())*fit.scale), int(float64(bounds.Dy())*fit.scale)
+		if width < 1 || height < 1 {
+			break
+		}
+		params := engine.Params{Width: width, Height: height, Scale: 1, Cropping: engine.CroppingModeExact, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+		smaller := engine.Transform(img, params)
+		buffer.Reset()
+		if err := writeImageWithOptions(smaller, format, &options, transformation.pngOptions(), &buffer); err != nil {
+			return nil, nil, err
+		}
+		if buffer.Len() <= maxBytes {
+			return buffer.Bytes(), fit, nil
+		}
+	}
+	return nil, nil, imageTooLargeError(fmt.Sprintf("the image doesn't fit in %d bytes", maxBytes))
+}
+
+// setCacheFit records what was done to a cached image to fit in its size cap
+func setCacheFit(filePath string, fit *sizeFit) {
+	Conn.Do("HSET", cacheKey(filePath), "fit", fit.String())
+}
+
+// setFitHeader tells what was done to an image of a transformation with a
+// size cap to fit in it, the fit of cached images (nil) is looked up
+func setFitHeader(res http.ResponseWriter, transformation *Transformation, fullImagePath string, fit *sizeFit) {
+	if transformation.outputMaxBytes() == 0 {
+		return
+	}
+	description := ""
+	if fit != nil {
+		description = fit.String()
+	} else {
+		description = cachedFit(fullImagePath)
+	}
+	// Images cached before they had a cap aren't described
+	if description != "" {
+		res.Header().Set(fitHeader, description)
+	}
+}
+
+// cachedFit returns what was done to a cached image to fit in its size cap
+func cachedFit(filePath string) string {
+	fit, _ := redis.String(Conn.Do("HGET", cacheKey(filePath), "fit"))
+	return fit
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestRemoveMaxBytes(t *testing.T) {
+	rest, maxBytes, err := removeMaxBytes("w_400,maxbytes_50000,h_300")
+	if err != nil || rest != "w_400,h_300" || maxBytes != 50000 {
+		t.Errorf("Unexpected result: %s, %d, %v", rest, maxBytes, err)
+	}
+	if _, maxBytes, err := removeMaxBytes("w_400"); err != nil || maxBytes != 0 {
+		t.Errorf("Expected no cap, got: %d, %v", maxBytes, err)
+	}
+	for _, parametersStr := range []string{"maxbytes_0", "maxbytes_-5", "maxbytes_50k"} {
+		if _, _, err := removeMaxBytes(parametersStr); err == nil {
+			t.Errorf("%s: expected an error", parametersStr)
+		}
+	}
+}
+
+func TestOutputMaxBytes(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{})
+
+	if maxBytes := (&Transformation{}).outputMaxBytes(); maxBytes != 0 {
+		t.Errorf("Expected no cap, got: %d", maxBytes)
+	}
+	if maxBytes := (&Transformation{maxBytes: 5000}).outputMaxBytes(); maxBytes != 5000 {
+		t.Errorf("Expected the transformation's cap, got: %d", maxBytes)
+	}
+	currentConfig().outputMaxBytes = 2000
+	if maxBytes := (&Transformation{maxBytes: 5000}).outputMaxBytes(); maxBytes != 2000 {
+		t.Errorf("Expected the configured cap, got: %d", maxBytes)
+	}
+	if maxBytes := (&Transformation{maxBytes: 1000}).outputMaxBytes(); maxBytes != 1000 {
+		t.Errorf("Expected the lower cap, got: %d", maxBytes)
+	}
+}
+
+func TestSizeFitString(t *testing.T) {
+	tests := []struct {
+		fit      *sizeFit
+		expected string
+	}{
+		{nil, "none"},
+		{&sizeFit{scale: 1}, "none"},
+		{&sizeFit{quality: 62, scale: 1}, "quality=62"},
+		{&sizeFit{quality: 30, scale: 0.8 * 0.8 * 0.8}, "quality=30, scale=0.512"},
+		{&sizeFit{scale: 0.64}, "scale=0.64"},
+	}
+	for _, test := range tests {
+		if actual := test.fit.String(); actual != test.expected {
+			t.Errorf("Expected: %s, actual: %s", test.expected, actual)
+		}
+	}
+}
+
+// noisyImage returns an image which compresses badly
+func noisyImage(width, height int) *image.RGBA {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 255})
+		}
+	}
+	return img
+}
+
+func TestFitToMaxBytes(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{jpegQuality: 90})
+	img := noisyImage(200, 200)
+	transformation := &Transformation{params: &engine.Params{}}
+
+	// Lowering the quality is enough
+	data, fit, err := fitToMaxBytes(img, "jpeg", transformation, 40000)
+	if err != nil || len(data) > 40000 || fit.quality < maxBytesMinQuality || fit.quality >= 90 || fit.scale != 1 {
+		t.Errorf("Unexpected result: %d bytes, %+v, %v", len(data), fit, err)
+	}
+
+	// Then the image is made smaller
+	data, fit, err = fitToMaxBytes(img, "jpeg", transformation, 8000)
+	if err != nil || len(data) > 8000 || fit.quality != maxBytesMinQuality || fit.scale >= 1 {
+		t.Errorf("Unexpected result: %d bytes, %+v, %v", len(data), fit, err)
+	}
+
+	// PNG images can only be made smaller
+	data, fit, err = fitToMaxBytes(img, "png", transformation, 60000)
+	if err != nil || len(data) > 60000 || fit.quality != 0 || fit.scale >= 1 {
+		t.Errorf("Unexpected result: %d bytes, %+v, %v", len(data), fit, err)
+	}
+	if decoded, err := png.Decode(bytes.NewReader(data)); err != nil || decoded.Bounds().Dx() != int(200*fit.scale) {
+		t.Errorf("Expected a %dpx wide image, got: %v, %v", int(200*fit.scale), decoded, err)
+	}
+
+	if _, _, err := fitToMaxBytes(img, "jpeg", transformation, 10); err == nil {
+		t.Error("Expected an error for a cap nothing fits in")
+	} else if _, ok := err.(imageTooLargeError); !ok {
+		t.Errorf("Expected an imageTooLargeError, got: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+var (
+	// hotCache keeps encoded bytes of the most recently served images
+	hotCache = newMemoryCache(0)
+)
+
+// memoryCache is an LRU cache of encoded images limited by the total number
+// of bytes it holds, it is safe for concurrent use
+type memoryCache struct {
+	sync.Mutex
+	limit, size  int
+	items        map[string]*list.Element
+	order        *list.List // Front = most recently used
+	hits, misses uint64
+}
+
+type memoryCacheItem struct {
+	key  string
+	data []byte
+}
+
+// MemoryCacheStats describes the state of the in-memory cache
+type MemoryCacheStats struct {
+	Entries int     `json:"entries"`
+	Size    int     `json:"size"`
+	Limit   int     `json:"limit"`
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hitRate"`
+}
+
+// newMemoryCache creates a cache holding at most limit bytes, 0 disables it
+func newMemoryCache(limit int) *memoryCache {
+	return &memoryCache{limit: limit, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *memoryCache) get(key string) ([]byte, bool) {
+	if c.limit == 0 {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*memoryCacheItem).data, true
+}
+
+// accepts tells whether an image of size bytes would be kept, a single image
+// isn't allowed to flush the whole cache
+func (c *memoryCache) accepts(size int) bool {
+	return c.limit != 0 && size <= c.limit/2
+}
+
+func (c *memoryCache) put(key string, data []byte) {
+	if !c.accepts(len(data)) {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+	c.items[key] = c.order.PushFront(&memoryCacheItem{key, data})
+	c.size += len(data)
+
+	for c.size > c.limit {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *memoryCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *memoryCache) removeElement(elem *list.Element) {
+	item := elem.Value.(*memoryCacheItem)
+	c.order.Remove(elem)
+	delete(c.items, item.key)
+	c.size -= len(item.data)
+}
+
+func (c *memoryCache) stats() MemoryCacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	stats := MemoryCacheStats{len(c.items), c.size, c.limit, c.hits, c.misses, 0}
+	if c.hits+c.misses > 0 {
+		stats.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return stats
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMemoryCache(t *testing.T) {
+	c := newMemoryCache(10)
+
+	c.put("a", []byte("aaaa"))
+	c.put("b", []byte("bbbb"))
+	if _, ok := c.get("a"); !ok {
+		t.Error("Expected a to be cached")
+	}
+
+	// b is the least recently used one now
+	c.put("c", []byte("cccc"))
+	if _, ok := c.get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	if data, ok := c.get("c"); !ok || string(data) != "cccc" {
+		t.Errorf("Unexpected value for c: %q", data)
+	}
+
+	// Too big to be cached
+	c.put("d", []byte("dddddddddd"))
+	if _, ok := c.get("d"); ok {
+		t.Error("Expected d not to be cached")
+	}
+
+	stats := c.stats()
+	if stats.Entries != 2 || stats.Size != 8 || stats.Hits != 2 || stats.Misses != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestMemoryCacheDisabled(t *testing.T) {
+	c := newMemoryCache(0)
+	c.put("a", []byte("a"))
+	if _, ok := c.get("a"); ok {
+		t.Error("Expected nothing to be cached")
+	}
+}
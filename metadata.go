@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+)
+
+var (
+	// EXIF tags of the first IFD which can be copied from originals to
+	// transformed images. GPS and camera details (the Exif IFD) are never
+	// copied.
+	exifTags = map[string]uint16{
+		"imagedescription": 0x010e,
+		"make":             0x010f,
+		"model":            0x0110,
+		"orientation":      0x0112,
+		"software":         0x0131,
+		"datetime":         0x0132,
+		"artist":           0x013b,
+		"copyright":        0x8298,
+	}
+
+	// Sizes of the values of TIFF field types in bytes
+	tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+	exifHeader = []byte("Exif\x00\x00")
+)
+
+// parseMetadataKeep reads the names of the EXIF tags to keep, e.g. Copyright
+// and Artist, and returns their numbers
+func parseMetadataKeep(names []string) ([]uint16, error) {
+	tags := make([]uint16, 0, len(names))
+	for _, name := range names {
+		tag, ok := exifTags[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid metadata tag: %s (available: Artist, Copyright, DateTime, ImageDescription, Make, Model, Orientation, Software)", name)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// keepMetadata copies the EXIF tags the configuration keeps from an original
+// to an image transformed from it and encoded in format, all other metadata
+// is left out
+func keepMetadata(original, encoded []byte, sourceFormat, format string) []byte {
+	if len(currentConfig().metadataKeep) == 0 {
+		return encoded
+	}
+	tiff := filterEXIF(readEXIF(original, sourceFormat), currentConfig().metadataKeep)
+	if tiff == nil {
+		return encoded
+	}
+	switch format {
+	case "jpeg":
+		return setJPEGEXIF(encoded, tiff)
+	case "png":
+		return setPNGEXIF(encoded, tiff)
+	}
+	return encoded
+}
+
+// readEXIF returns the EXIF data (a TIFF structure) of a JPEG or PNG image,
+// nil when there is none
+func readEXIF(data []byte, format string) []byte {
+	switch format {
+	case "jpeg":
+		// Segments up to the start of the scan, APP1 holds EXIF
+		for offset := 2; offset+4 <= len(data) && data[offset] == 0xff && data[offset+1] != 0xda; {
+			end := offset + 2 + int(binary.BigEndian.Uint16(data[offset+2:]))
+			if end > len(data) {
+				return nil
+			}
+			if data[offset+1] == 0xe1 && bytes.HasPrefix(data[offset+4:end], exifHeader) {
+				return data[offset+4+len(exifHeader) : end]
+			}
+			offset = end
+		}
+	case "png":
+		for offset := len(pngSignature); offset+12 <= len(data); {
+			end := offset + 12 + int(binary.BigEndian.Uint32(data[offset:]))
+			if end < offset || end > len(data) {
+				return nil
+			}
+			if string(data[offset+4:offset+8]) == "eXIf" {
+				return data[offset+8 : end-4]
+			}
+			offset = end
+		}
+	}
+	return nil
+}
+
+// exifOrientation returns the EXIF orientation (1-8) of a JPEG or PNG image,
+// 1 when it has none
+func exifOrientation(data []byte, format string) int {
+	tiff := filterEXIF(readEXIF(data, format), []uint16{exifTags["orientation"]})
+	// The header, the entry count and one entry of type SHORT
+	if len(tiff) < 22 {
+		return 1
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if string(tiff[:2]) == "II" {
+		order = binary.LittleEndian
+	}
+	if order.Uint16(tiff[12:]) != 3 {
+		return 1
+	}
+	orientation := int(order.Uint16(tiff[18:]))
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// filterEXIF returns EXIF data with only the given tags of the first IFD, nil
+// when it has none of them or can't be read
+func filterEXIF(tiff []byte, keep []uint16) []byte {
+	if len(tiff) < 8 {
+		return nil
+	}
+	var order interface {
+		binary.ByteOrder
+		binary.AppendByteOrder
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return nil
+	}
+
+	type entry struct {
+		tag, typ uint16
+		count    uint32
+		value    []byte
+	}
+	var entries []entry
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		start := ifd + 2 + 12*i
+		if start+12 > len(tiff) {
+			return nil
+		}
+		e := entry{tag: order.Uint16(tiff[start:]), typ: order.Uint16(tiff[start+2:]), count: order.Uint32(tiff[start+4:])}
+		if !containsTag(keep, e.tag) {
+			continue
+		}
+		size, ok := tiffTypeSizes[e.typ]
+		if !ok || uint64(size)*uint64(e.count) > uint64(len(tiff)) {
+			continue
+		}
+		size *= int(e.count)
+		if size <= 4 {
+			e.value = tiff[start+8 : start+8+size]
+		} else {
+			offset := int(order.Uint32(tiff[start+8:]))
+			if offset < 0 || offset+size > len(tiff) {
+				continue
+			}
+			e.value = tiff[offset : offset+size]
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	// Header, the IFD and then the values which don't fit in their entries
+	filtered := make([]byte, 8, 256)
+	copy(filtered, tiff[:4])
+	order.PutUint32(filtered[4:], 8)
+	filtered = order.AppendUint16(filtered, uint16(len(entries)))
+	dataOffset := 8 + 2 + 12*len(entries) + 4
+	var values []byte
+	for _, e := range entries {
+		filtered = order.AppendUint16(filtered, e.tag)
+		filtered = order.AppendUint16(filtered, e.typ)
+		filtered = order.AppendUint32(filtered, e.count)
+		if len(e.value) <= 4 {
+			inline := make([]byte, 4)
+			copy(inline, e.value)
+			filtered = append(filtered, inline...)
+			continue
+		}
+		filtered = order.AppendUint32(filtered, uint32(dataOffset+len(values)))
+		values = append(values, e.value...)
+		// Values start on word boundaries
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	filtered = order.AppendUint32(filtered, 0) // No next IFD
+	return append(filtered, values...)
+}
+
+func containsTag(tags []uint16, tag uint16) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// setJPEGEXIF adds an APP1 segment with EXIF data to a JPEG image without
+// one, after its JFIF segment if it has one
+func setJPEGEXIF(data []byte, tiff []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 || len(exifHeader)+len(tiff)+2 > 0xffff {
+		return data
+	}
+	at := 2
+	if data[2] == 0xff && data[3] == 0xe0 && len(data) >= 6 {
+		at = 4 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(2+len(exifHeader)+len(tiff)))
+	segment = append(segment, exifHeader...)
+	segment = append(segment, tiff...)
+
+	updated := make([]byte, 0, len(data)+len(segment))
+	updated = append(updated, data[:at]...)
+	updated = append(updated, segment...)
+	return append(updated, data[at:]...)
+}
+
+// setPNGEXIF adds an eXIf chunk with EXIF data after the header of a PNG
+// image
+func setPNGEXIF(data []byte, tiff []byte) []byte {
+	if !bytes.HasPrefix(data, pngSignature) || len(data) < len(pngSignature)+25 {
+		return data
+	}
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(tiff)))
+	chunk = append(chunk, "eXIf"...)
+	chunk = append(chunk, tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// The header chunk always comes first and is 13 bytes long
+	at := len(pngSignature) + 25
+	updated := make([]byte, 0, len(data)+len(chunk))
+	updated = append(updated, data[:at]...)
+	updated = append(updated, chunk...)
+	return append(updated, data[at:]...)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testEXIF builds little endian EXIF data with an artist, a copyright, an
+// orientation and a GPS IFD pointer
+func testEXIF() []byte {
+	order := binary.LittleEndian
+	artist, copyright := []byte("Jane Doe\x00"), []byte("(c) 2024 Jane Doe\x00")
+	tiff := []byte("II*\x00")
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 4)
+	dataOffset := uint32(8 + 2 + 4*12 + 4)
+	entry := func(tag, typ uint16, count, value uint32) {
+		tiff = order.AppendUint16(tiff, tag)
+		tiff = order.AppendUint16(tiff, typ)
+		tiff = order.AppendUint32(tiff, count)
+		tiff = order.AppendUint32(tiff, value)
+	}
+	entry(0x0112, 3, 1, 6)
+	entry(0x013b, 2, uint32(len(artist)), dataOffset)
+	entry(0x8298, 2, uint32(len(copyright)), dataOffset+uint32(len(artist)))
+	entry(0x8825, 4, 1, 0)
+	tiff = order.AppendUint32(tiff, 0)
+	tiff = append(tiff, artist...)
+	return append(tiff, copyright...)
+}
+
+func TestParseMetadataKeep(t *testing.T) {
+	tags, err := parseMetadataKeep([]string{"Copyright", "artist"})
+	if err != nil || len(tags) != 2 || tags[0] != 0x8298 || tags[1] != 0x013b {
+		t.Errorf("Unexpected tags: %v, %v", tags, err)
+	}
+	for _, name := range []string{"GPSLatitude", "GPS", "Flash"} {
+		if _, err := parseMetadataKeep([]string{name}); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestFilterEXIF(t *testing.T) {
+	filtered := filterEXIF(testEXIF(), []uint16{0x8298, 0x0112, 0x8825 + 1})
+	if filtered == nil {
+		t.Fatal("Expected EXIF data")
+	}
+	if n := binary.LittleEndian.Uint16(filtered[8:]); n != 2 {
+		t.Errorf("Expected 2 tags, got %d", n)
+	}
+	if !bytes.Contains(filtered, []byte("(c) 2024 Jane Doe")) || bytes.Contains(filtered, []byte("Jane Doe\x00(c)")) {
+		t.Errorf("Expected only the copyright to be kept: %q", filtered)
+	}
+	if filterEXIF(testEXIF(), []uint16{0x010f}) != nil {
+		t.Error("Expected no EXIF data without any of the tags")
+	}
+	if filterEXIF([]byte("garbage"), []uint16{0x8298}) != nil {
+		t.Error("Expected no EXIF data for invalid data")
+	}
+}
+
+func TestKeepMetadata(t *testing.T) {
+	var buffer bytes.Buffer
+	jpeg.Encode(&buffer, image.NewGray(image.Rect(0, 0, 4, 4)), nil)
+	encoded := buffer.Bytes()
+	original := setJPEGEXIF(encoded, testEXIF())
+
+	if kept := keepMetadata(original, encoded, "jpeg", "jpeg"); !bytes.Equal(kept, encoded) {
+		t.Error("Expected no metadata to be kept by default")
+	}
+
+	currentConfig().metadataKeep = []uint16{0x013b, 0x8298}
+	defer func() { currentConfig().metadataKeep = nil }()
+	kept := keepMetadata(original, encoded, "jpeg", "jpeg")
+	exif := readEXIF(kept, "jpeg")
+	if exif == nil || !bytes.Contains(exif, []byte("Jane Doe\x00")) || !bytes.Contains(exif, []byte("(c) 2024 Jane Doe")) || binary.LittleEndian.Uint16(exif[8:]) != 2 {
+		t.Errorf("Expected the artist and the copyright to be kept: %q", exif)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(kept)); err != nil {
+		t.Errorf("Expected the image to stay valid: %s", err)
+	}
+
+	buffer.Reset()
+	png.Encode(&buffer, image.NewGray(image.Rect(0, 0, 4, 4)))
+	pngOriginal := setPNGEXIF(buffer.Bytes(), testEXIF())
+	kept = keepMetadata(pngOriginal, buffer.Bytes(), "png", "png")
+	if exif := readEXIF(kept, "png"); exif == nil || binary.LittleEndian.Uint16(exif[8:]) != 2 {
+		t.Errorf("Expected an eXIf chunk with 2 tags: %q", exif)
+	}
+	if _, err := png.Decode(bytes.NewReader(kept)); err != nil {
+		t.Errorf("Expected the image to stay valid: %s", err)
+	}
+}
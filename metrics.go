@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixlserv_http_requests_total",
+		Help: "Number of HTTP requests by method and status code.",
+	}, []string{"method", "status"})
+
+	cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixlserv_cache_requests_total",
+		Help: "Number of image requests served from the cache (hit) or generated (miss).",
+	}, []string{"result"})
+
+	sourceMetadataLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixlserv_source_metadata_lookups_total",
+		Help: "Number of lookups of remembered metadata of originals, by whether it was found (hit) or not (miss).",
+	}, []string{"result"})
+
+	cachePeerFetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixlserv_cache_peer_fetches_total",
+		Help: "Number of cached images asked for from other instances, by whether they had it (hit), not (miss) or failed (error).",
+	}, []string{"result"})
+
+	transformDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pixlserv_transform_duration_seconds",
+		Help:    "Time taken to transform and encode an image by cropping mode and output format.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"cropping", "format"})
+
+	transformationsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pixlserv_transformations_in_flight",
+		Help: "Number of images being generated at the moment.",
+	})
+
+	transformationsQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pixlserv_transformations_queued",
+		Help: "Number of images waiting for a worker to be generated.",
+	})
+
+	overloadRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixlserv_overload_rejections_total",
+		Help: "Number of images not generated because the server was overloaded, by the limit reached.",
+	}, []string{"reason"})
+
+	stageTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixlserv_stage_timeouts_total",
+		Help: "Number of images given up on because a stage of generating them timed out, by stage.",
+	}, []string{"stage"})
+
+	processingMemoryBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pixlserv_processing_memory_bytes",
+		Help: "Estimated memory taken by images being generated.",
+	})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pixlserv_storage_duration_seconds",
+		Help:    "Latency of storage backend operations.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"backend", "operation"})
+
+	storageErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixlserv_storage_errors_total",
+		Help: "Number of failed storage backend operations (not counting missing files).",
+	}, []string{"backend", "operation"})
+
+	shadowComparisonsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixlserv_shadow_comparisons_total",
+		Help: "Number of requests processed with both the active and the candidate configuration, by result.",
+	}, []string{"result"})
+
+	shadowSizeRatio = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pixlserv_shadow_size_ratio",
+		Help:    "Size of images generated with the candidate configuration relative to the active one.",
+		Buckets: []float64{0.5, 0.75, 0.9, 0.95, 1, 1.05, 1.1, 1.25, 1.5, 2},
+	})
+
+	shadowDurationRatio = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pixlserv_shadow_duration_ratio",
+		Help:    "Time taken to generate images with the candidate configuration relative to the active one.",
+		Buckets: []float64{0.5, 0.75, 0.9, 1, 1.1, 1.25, 1.5, 2, 4},
+	})
+
+	shadowSSIM = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pixlserv_shadow_ssim",
+		Help:    "Structural similarity of images generated with the candidate configuration to the active one.",
+		Buckets: []float64{0.8, 0.9, 0.95, 0.98, 0.99, 0.995, 0.999, 1},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsTotal, cacheRequestsTotal, sourceMetadataLookupsTotal, cachePeerFetchesTotal, transformDuration, transformationsInFlight, transformationsQueued, overloadRejectionsTotal, stageTimeoutsTotal, processingMemoryBytes, storageDuration, storageErrorsTotal,
+		shadowComparisonsTotal, shadowSizeRatio, shadowDurationRatio, shadowSSIM)
+}
+
+// countRequests is a middleware counting responses by their status
+func countRequests(c martini.Context, res http.ResponseWriter, req *http.Request) {
+	c.Next()
+	rw := res.(martini.ResponseWriter)
+	httpRequestsTotal.WithLabelValues(req.Method, strconv.Itoa(rw.Status())).Inc()
+}
+
+// observeTransformation records how long a transformation took
+func observeTransformation(params *engine.Params, format string, start time.Time) {
+	transformDuration.WithLabelValues(params.Cropping, format).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedStorage measures latencies of operations of another storage
+type instrumentedStorage struct {
+	Storage
+	name string
+}
+
+func (s *instrumentedStorage) observe(operation string, start time.Time, err error) {
+	storageDuration.WithLabelValues(s.name, operation).Observe(time.Since(start).Seconds())
+	if err != nil && err != ErrNotFound {
+		storageErrorsTotal.WithLabelValues(s.name, operation).Inc()
+	}
+}
+
+func (s *instrumentedStorage) Get(filePath string) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := s.Storage.Get(filePath)
+	s.observe("get", start, err)
+	return reader, err
+}
+
+func (s *instrumentedStorage) Put(filePath string, data []byte, contentType string) error {
+	start := time.Now()
+	err := s.Storage.Put(filePath, data, contentType)
+	s.observe("put", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) Delete(filePath string) error {
+	start := time.Now()
+	err := s.Storage.Delete(filePath)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) List(prefix string) ([]string, error) {
+	start := time.Now()
+	paths, err := s.Storage.List(prefix)
+	s.observe("list", start, err)
+	return paths, err
+}
+
+func (s *instrumentedStorage) Stat(filePath string) (*FileInfo, error) {
+	start := time.Now()
+	info, err := s.Storage.Stat(filePath)
+	s.observe("stat", start, err)
+	return info, err
+}
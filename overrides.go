@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v1"
+)
+
+const (
+	// Environment variables like PIXLSERV_CACHE__MAX_ENTRIES override options
+	// in the configuration file, sections are separated by two underscores
+	configEnvVarPrefix    = "PIXLSERV_"
+	configEnvVarSeparator = "__"
+)
+
+// Options set on the command line (e.g. cache.max-entries=1000), they take
+// precedence over the environment and the configuration file
+var configFlags []string
+
+// envConfigPath returns the option an environment variable overrides, e.g.
+// cache max-entries for PIXLSERV_CACHE__MAX_ENTRIES
+func envConfigPath(name string) []string {
+	if !strings.HasPrefix(name, configEnvVarPrefix) || len(name) == len(configEnvVarPrefix) {
+		return nil
+	}
+	path := strings.Split(strings.TrimPrefix(name, configEnvVarPrefix), configEnvVarSeparator)
+	for i, key := range path {
+		if key == "" {
+			return nil
+		}
+		path[i] = strings.Replace(strings.ToLower(key), "_", "-", -1)
+	}
+	return path
+}
+
+// parseConfigValue reads the value of an option the way the configuration
+// file would, values YAML can't read are taken as strings
+func parseConfigValue(value string) interface{} {
+	var v interface{}
+	err := yaml.Unmarshal([]byte(value), &v)
+	if err != nil || v == nil {
+		return value
+	}
+	return v
+}
+
+// setConfigValue sets an option in a configuration read from a file, the
+// sections on its path are created when needed
+func setConfigValue(m map[interface{}]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		section, ok := m[key].(map[interface{}]interface{})
+		if !ok {
+			section = make(map[interface{}]interface{})
+			m[key] = section
+		}
+		m = section
+	}
+	m[path[len(path)-1]] = value
+}
+
+// applyConfigOverrides sets the options given in environment variables
+// (in the KEY=value form of os.Environ) and then the ones given on the
+// command line (cache.max-entries=1000) in a configuration
+func applyConfigOverrides(m map[interface{}]interface{}, environ, flags []string) error {
+	for _, variable := range environ {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if path := envConfigPath(parts[0]); path != nil {
+			setConfigValue(m, path, parseConfigValue(parts[1]))
+		}
+	}
+
+	for _, flag := range flags {
+		parts := strings.SplitN(flag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid option: %s (expected section.option=value)", flag)
+		}
+		path := strings.Split(parts[0], ".")
+		for _, key := range path {
+			if key == "" {
+				return fmt.Errorf("invalid option: %s (expected section.option=value)", flag)
+			}
+		}
+		setConfigValue(m, path, parseConfigValue(parts[1]))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvConfigPath(t *testing.T) {
+	cases := []struct {
+		name string
+		path []string
+	}{
+		{"PIXLSERV_STORAGE", []string{"storage"}},
+		{"PIXLSERV_CACHE__MAX_ENTRIES", []string{"cache", "max-entries"}},
+		{"PIXLSERV_OUTPUT_LIMITS__MAX_WIDTH", []string{"output-limits", "max-width"}},
+		{"PIXLSERV_", nil},
+		{"PIXLSERV_CACHE__", nil},
+		{"HOME", nil},
+	}
+	for _, c := range cases {
+		if path := envConfigPath(c.name); !reflect.DeepEqual(path, c.path) {
+			t.Errorf("%s: expected: %v, actual: %v", c.name, c.path, path)
+		}
+	}
+}
+
+func TestApplyConfigOverrides(t *testing.T) {
+	m := map[interface{}]interface{}{
+		"storage": "local",
+		"cache":   map[interface{}]interface{}{"strategy": "LRU", "limit": 1000},
+	}
+	environ := []string{
+		"HOME=/root",
+		"PIXLSERV_STORAGE=s3",
+		"PIXLSERV_CACHE__STRATEGY=LFU",
+		"PIXLSERV_TLS__CERT_FILE=/etc/cert.pem",
+	}
+	flags := []string{"storage=gcs", "grpc.listen=:9000"}
+	err := applyConfigOverrides(m, environ, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m["storage"] != "gcs" {
+		t.Errorf("Expected the command line to take precedence, got: %v", m["storage"])
+	}
+	cache := m["cache"].(map[interface{}]interface{})
+	if cache["strategy"] != "LFU" || cache["limit"] != 1000 {
+		t.Errorf("Expected the environment to override the file, got: %v", cache)
+	}
+	if m["tls"].(map[interface{}]interface{})["cert-file"] != "/etc/cert.pem" {
+		t.Errorf("Expected sections missing in the file to be created, got: %v", m["tls"])
+	}
+	if m["grpc"].(map[interface{}]interface{})["listen"] != ":9000" {
+		t.Errorf("Unexpected grpc section: %v", m["grpc"])
+	}
+	if _, ok := m["home"]; ok {
+		t.Error("Expected other environment variables to be ignored")
+	}
+
+	for _, flag := range []string{"storage", "=s3", "cache..limit=1"} {
+		if err := applyConfigOverrides(map[interface{}]interface{}{}, nil, []string{flag}); err == nil {
+			t.Errorf("Expected an error for %s", flag)
+		}
+	}
+}
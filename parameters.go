@@ -1,126 +1,152 @@
 package main
 
 import (
-	"fmt"
 	"regexp"
-	"strconv"
 	"strings"
-)
 
-const (
-	parameterWidth    = "w"
-	parameterHeight   = "h"
-	parameterCropping = "c"
-	parameterGravity  = "g"
-	parameterFilter   = "f"
-	parameterScale    = "s"
-
-	// CroppingModeExact crops an image exactly to given dimensions
-	CroppingModeExact = "e"
-	// CroppingModeAll crops an image so that all of it is displayed in a frame of at most given dimensions
-	CroppingModeAll = "a"
-	// CroppingModePart crops an image so that it fills a frame of given dimensions
-	CroppingModePart = "p"
-	// CroppingModeKeepScale crops an image so that it fills a frame of given dimensions, keeps scale
-	CroppingModeKeepScale = "k"
-
-	GravityNorth     = "n"
-	GravityNorthEast = "ne"
-	GravityEast      = "e"
-	GravitySouthEast = "se"
-	GravitySouth     = "s"
-	GravitySouthWest = "sw"
-	GravityWest      = "w"
-	GravityNorthWest = "nw"
-	GravityCenter    = "c"
-
-	FilterGrayScale = "grayscale"
-
-	DefaultScale        = 1
-	DefaultCroppingMode = CroppingModeExact
-	DefaultGravity      = GravityNorthWest
-	DefaultFilter       = "none"
+	"github.com/ReshNesh/pixlserv/engine"
 )
 
+const versionPrefix = "v_"
+
 var (
-	transformationNameRe = regexp.MustCompile("^t_([0-9A-Za-z-]+)$")
+	transformationNameRe = regexp.MustCompile("^t_([0-9A-Za-z-]+(@[0-9A-Za-z-]+)?)$")
+
+	// Matches a version token (e.g. v_3 or v_1700000000) in front of an
+	// image path
+	versionRe = regexp.MustCompile("^" + versionPrefix + "([0-9A-Za-z.-]{1,64})/")
+
+	// Parameters of a single request which aren't part of its
+	// transformation (e.g. t_thumb,q_auto), they follow the engine's
+	// parameters in this order in canonical URLs. removeRequestOptions
+	// removes each of them.
+	requestParameters = []string{parameterQuality, parameterSubsampling, parameterDPI, parameterMaxBytes, parameterMask, parameterVideoFormat, parameterLossless, parameterNearLossless, parameterDownload}
+
+	// Equivalents of Cloudinary's crop modes
+	cloudinaryCroppingModes = map[string]string{
+		"scale": engine.CroppingModeExact,
+		"fit":   engine.CroppingModeAll,
+		"limit": engine.CroppingModeAll,
+		"mfit":  engine.CroppingModeAll,
+		"fill":  engine.CroppingModePart,
+		"lfill": engine.CroppingModePart,
+		"thumb": engine.CroppingModePart,
+		"crop":  engine.CroppingModeKeepScale,
+	}
+
+	// Equivalents of Cloudinary's gravities, faces aren't detected so they
+	// are centred like automatic gravity
+	cloudinaryGravities = map[string]string{
+		"north":      engine.GravityNorth,
+		"north_east": engine.GravityNorthEast,
+		"east":       engine.GravityEast,
+		"south_east": engine.GravitySouthEast,
+		"south":      engine.GravitySouth,
+		"south_west": engine.GravitySouthWest,
+		"west":       engine.GravityWest,
+		"north_west": engine.GravityNorthWest,
+		"center":     engine.GravityCenter,
+		"auto":       engine.GravityCenter,
+		"face":       engine.GravityCenter,
+		"faces":      engine.GravityCenter,
+	}
 )
 
-// Params is a struct of parameters specifying an image transformation
-type Params struct {
-	width, height, scale      int
-	cropping, gravity, filter string
+// Turns a string like "w_400,h_300" from a URL into a Params struct checked
+// against the output limits and the parameter policy of a configuration. With
+// strict-parameters, parameters which would be ignored are errors.
+func parseParameters(parametersStr string, c *Configuration) (engine.Params, error) {
+	return parsePolicedParameters(parametersStr, c, nil)
 }
 
-// ToString turns parameters into a unique string for each possible assignment of parameters
-func (p Params) ToString() string {
-	// 0 as a value for width or height means that it will be calculated
-	return fmt.Sprintf("%s_%s,%s_%s,%s_%d,%s_%d,%s_%s,%s_%d", parameterCropping, p.cropping, parameterGravity, p.gravity, parameterHeight, p.height, parameterWidth, p.width, parameterFilter, p.filter, parameterScale, p.scale)
+// parsePolicedParameters is parseParameters also checking the parameters
+// against another policy, e.g. the one for an image's path
+func parsePolicedParameters(parametersStr string, c *Configuration, policy *ParameterPolicy) (engine.Params, error) {
+	if c.cloudinaryURLs {
+		parametersStr = translateCloudinaryParameters(parametersStr)
+	}
+	if c.strictParameters {
+		if err := engine.CheckParameters(parametersStr); err != nil {
+			return engine.Params{}, err
+		}
+	}
+	expanded, pipeline := expandFilterPipeline(parametersStr, c.filterPipelines)
+	params, err := engine.ParseParameters(expanded, c.outputLimits())
+	if err != nil {
+		return params, err
+	}
+	// Pipelines are allowed by their name
+	checked := params
+	if pipeline != "" {
+		checked.Filter = pipeline
+	}
+	err = c.parameterPolicy.check(parametersStr, checked)
+	if err != nil {
+		return params, err
+	}
+	return params, policy.check(parametersStr, checked)
 }
 
-// WithScale returns a copy of a Params struct with the scale set to the given value
-func (p Params) WithScale(scale int) Params {
-	return Params{p.width, p.height, scale, p.cropping, p.gravity, p.filter}
+// parseTrustedParameters is parseParameters for parameters set by admins, in
+// named transformations and scripts, which the parameter policy doesn't apply to
+func parseTrustedParameters(parametersStr string, c *Configuration) (engine.Params, error) {
+	if c.cloudinaryURLs {
+		parametersStr = translateCloudinaryParameters(parametersStr)
+	}
+	parametersStr, _ = expandFilterPipeline(parametersStr, c.filterPipelines)
+	return engine.ParseParameters(parametersStr, c.outputLimits())
 }
 
-// Turns a string like "w_400,h_300" and an image path into a Params struct
-// The second return value is an error message
-// Also validates the parameters to make sure they have valid values
-// w = width, h = height
-func parseParameters(parametersStr string) (Params, error) {
-	params := Params{0, 0, DefaultScale, DefaultCroppingMode, DefaultGravity, DefaultFilter}
+// translateCloudinaryParameters turns Cloudinary's names in a parameters
+// string like "w_400,h_300,c_fill,g_auto" into the ones used here. Native
+// names are kept, Cloudinary's formats (f_auto), effects other than
+// grayscale and parameters without an equivalent (e.g. q_auto) are left out.
+func translateCloudinaryParameters(parametersStr string) string {
 	parts := strings.Split(parametersStr, ",")
+	translated := make([]string, 0, len(parts))
 	for _, part := range parts {
 		keyAndValue := strings.SplitN(part, "_", 2)
-		key := keyAndValue[0]
-		value := keyAndValue[1]
+		if len(keyAndValue) != 2 {
+			translated = append(translated, part)
+			continue
+		}
+		key, value := keyAndValue[0], strings.ToLower(keyAndValue[1])
 
 		switch key {
-		case parameterWidth, parameterHeight:
-			value, err := strconv.Atoi(value)
-			if err != nil {
-				return params, fmt.Errorf("could not parse value for parameter: %q", key)
-			}
-			if value <= 0 {
-				return params, fmt.Errorf("value %d must be > 0: %q", value, key)
-			}
-			if key == parameterWidth {
-				params.width = value
-			} else {
-				params.height = value
-			}
-		case parameterCropping:
-			value = strings.ToLower(value)
-			if len(value) > 1 {
-				return params, fmt.Errorf("value %q must have only 1 character", key)
+		case engine.ParameterCropping:
+			if mode, ok := cloudinaryCroppingModes[value]; ok {
+				part = engine.ParameterCropping + "_" + mode
 			}
-			if !isValidCroppingMode(value) {
-				return params, fmt.Errorf("invalid value for %q", key)
+		case engine.ParameterGravity:
+			if gravity, ok := cloudinaryGravities[value]; ok {
+				part = engine.ParameterGravity + "_" + gravity
 			}
-			params.cropping = value
-		case parameterGravity:
-			value = strings.ToLower(value)
-			if len(value) > 2 {
-				return params, fmt.Errorf("value %q must have at most 2 characters", key)
+		case engine.ParameterFilter:
+			// Cloudinary's f is the format
+			if !engine.IsValidFilter(value) {
+				continue
 			}
-			if !isValidGravity(value) {
-				return params, fmt.Errorf("invalid value for %q", key)
+		case "e":
+			if value != "grayscale" {
+				continue
 			}
-			params.gravity = value
-		case parameterFilter:
-			value = strings.ToLower(value)
-			if !isValidFilter(value) {
-				return params, fmt.Errorf("invalid value for %q", key)
-			}
-			params.filter = value
+			part = engine.ParameterFilter + "_" + engine.FilterGrayScale
+		case "q", "dpr", "fl":
+			continue
 		}
+		translated = append(translated, part)
 	}
+	return strings.Join(translated, ",")
+}
 
-	if params.width == 0 && params.height == 0 {
-		return params, fmt.Errorf("both width and height can't be 0")
+// outputLimits returns the limits transformed images need to fit in
+func (c *Configuration) outputLimits() engine.Limits {
+	return engine.Limits{
+		MaxWidth:  c.outputMaxWidth,
+		MaxHeight: c.outputMaxHeight,
+		MaxPixels: c.outputMaxPixels,
+		MaxScale:  c.outputMaxScale,
 	}
-
-	return params, nil
 }
 
 // Parses transformation name from a parameters string (e.g. photo from t_photo).
@@ -133,22 +159,67 @@ func parseTransformationName(parametersStr string) string {
 	return matches[1]
 }
 
-func isValidCroppingMode(str string) bool {
-	return str == CroppingModeExact || str == CroppingModeAll || str == CroppingModePart || str == CroppingModeKeepScale
-}
-
-func isValidGravity(str string) bool {
-	return str == GravityNorth || str == GravityNorthEast || str == GravityEast || str == GravitySouthEast || str == GravitySouth || str == GravitySouthWest || str == GravityWest || str == GravityNorthWest || str == GravityCenter
+// splitVersion separates a version token (v_3/cat.jpg) from an image path,
+// the token is "" when there is none
+func splitVersion(imagePath string) (string, string) {
+	matches := versionRe.FindStringSubmatch(imagePath)
+	if len(matches) == 0 {
+		return imagePath, ""
+	}
+	return imagePath[len(matches[0]):], matches[1]
 }
 
-func isValidFilter(str string) bool {
-	return str == FilterGrayScale
+// requestOptions are the values of a request's requestParameters
+type requestOptions struct {
+	autoQuality                                  bool
+	subsampling, mask, videoFormat, downloadName string
+	dpi, maxBytes                                int
+	webp                                         *WebPOptions
 }
 
-func isEasternGravity(str string) bool {
-	return str == GravityNorthEast || str == GravityEast || str == GravitySouthEast
+// removeRequestOptions removes the requestParameters from a parameters
+// string and returns their values. The parameters are removed even when one
+// of them is invalid.
+func removeRequestOptions(parametersStr string) (string, requestOptions, error) {
+	var options requestOptions
+	var errs [7]error
+	parametersStr, options.autoQuality, errs[0] = removeQuality(parametersStr)
+	parametersStr, options.subsampling, errs[1] = removeSubsampling(parametersStr)
+	parametersStr, options.dpi, errs[2] = removeDPI(parametersStr)
+	parametersStr, options.maxBytes, errs[3] = removeMaxBytes(parametersStr)
+	parametersStr, options.mask, errs[4] = removeMask(parametersStr)
+	parametersStr, options.videoFormat, errs[5] = removeVideoFormat(parametersStr)
+	parametersStr, options.webp, errs[6] = removeWebPOptions(parametersStr)
+	parametersStr, options.downloadName = removeParameter(parametersStr, parameterDownload)
+	for _, err := range errs {
+		if err != nil {
+			return parametersStr, options, err
+		}
+	}
+	return parametersStr, options, nil
 }
 
-func isSouthernGravity(str string) bool {
-	return str == GravitySouthWest || str == GravitySouth || str == GravitySouthEast
+// apply sets the options given with a request on its transformation
+func (o requestOptions) apply(t *Transformation) {
+	if o.autoQuality {
+		t.autoQuality = true
+	}
+	if o.subsampling != "" {
+		t.subsampling = o.subsampling
+	}
+	if o.dpi != 0 {
+		t.dpi = o.dpi
+	}
+	if o.maxBytes != 0 {
+		t.maxBytes = o.maxBytes
+	}
+	if o.mask != "" {
+		t.mask = o.mask
+	}
+	if o.videoFormat != "" {
+		t.videoFormat = o.videoFormat
+	}
+	if o.webp != nil {
+		t.webp = o.webp
+	}
 }
@@ -4,16 +4,88 @@ import (
 	"testing"
 )
 
-func TestParseParameters(t *testing.T) {
-	act, _ := parseParameters("w_400,h_300")
-	exp := Params{400, 300, DefaultScale, DefaultCroppingMode, DefaultGravity, DefaultFilter}
-	if act != exp {
-		t.Errorf("Expected: %v, actual: %v", exp, act)
+func TestParseParametersUsesGivenConfig(t *testing.T) {
+	// Named transformations of a configuration being loaded are checked
+	// against its limits rather than those of the current one
+	loading := &Configuration{outputMaxWidth: 100}
+	if _, err := parseParameters("w_200", loading); err == nil {
+		t.Error("Expected parameters exceeding the limits of the given configuration to be rejected")
 	}
+	if _, err := parseParameters("w_200", currentConfig()); err != nil {
+		t.Errorf("Expected parameters within the limits of the current configuration to be accepted, got: %s", err)
+	}
+}
+
+func TestParseParametersStrict(t *testing.T) {
+	c := &Configuration{}
+	if params, err := parseParameters("wd_400,h_300", c); err != nil || params.Height != 300 {
+		t.Errorf("Expected unknown parameters to be ignored by default: %+v, %v", params, err)
+	}
+	c.strictParameters = true
+	for _, parametersStr := range []string{"wd_400,h_300", "w_400,w_500", "w_400,h300"} {
+		if _, err := parseParameters(parametersStr, c); err == nil {
+			t.Errorf("%s: expected an error", parametersStr)
+		}
+	}
+	if _, err := parseParameters("w_400,h_300,c_p", c); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
 
-	act, _ = parseParameters("w_200,h_300,c_k,g_c")
-	exp = Params{200, 300, DefaultScale, CroppingModeKeepScale, GravityCenter, DefaultFilter}
-	if act != exp {
-		t.Errorf("Expected: %v, actual: %v", exp, act)
+func TestTranslateCloudinaryParameters(t *testing.T) {
+	cases := []struct {
+		parameters, exp string
+	}{
+		{"w_400,h_300,c_fill,g_auto", "w_400,h_300,c_p,g_c"},
+		{"w_400,c_fit,q_auto,f_auto", "w_400,c_a"},
+		{"w_400,g_north_east,e_grayscale", "w_400,g_ne,f_grayscale"},
+		{"w_400,c_p,g_se,f_grayscale", "w_400,c_p,g_se,f_grayscale"},
+		{"w_400,e_sharpen,dpr_2.0", "w_400"},
+	}
+	for _, c := range cases {
+		if act := translateCloudinaryParameters(c.parameters); act != c.exp {
+			t.Errorf("%s: expected: %q, actual: %q", c.parameters, c.exp, act)
+		}
+	}
+}
+
+func TestSplitVersion(t *testing.T) {
+	cases := []struct {
+		path, imagePath, version string
+	}{
+		{"v_3/cat.jpg", "cat.jpg", "3"},
+		{"v_1700000000/products/cat.jpg", "products/cat.jpg", "1700000000"},
+		{"cat.jpg", "cat.jpg", ""},
+		{"products/v_3/cat.jpg", "products/v_3/cat.jpg", ""},
+		{"v_/cat.jpg", "v_/cat.jpg", ""},
+		{"v_a/b/cat.jpg", "b/cat.jpg", "a"},
+	}
+	for _, c := range cases {
+		imagePath, version := splitVersion(c.path)
+		if imagePath != c.imagePath || version != c.version {
+			t.Errorf("%s: expected: %s %s, actual: %s %s", c.path, c.imagePath, c.version, imagePath, version)
+		}
+	}
+}
+
+func TestRemoveRequestOptions(t *testing.T) {
+	rest, options, err := removeRequestOptions("t_thumb,q_auto,cs_444,dpi_300,maxbytes_5000,mask_star.png,fmt_mp4,dl_cat")
+	if err != nil || rest != "t_thumb" {
+		t.Fatalf("Expected t_thumb, got: %s (%v)", rest, err)
+	}
+	expected := requestOptions{autoQuality: true, subsampling: "444", mask: "star.png", videoFormat: "mp4", downloadName: "cat", dpi: 300, maxBytes: 5000}
+	if options != expected {
+		t.Errorf("Expected %+v, got: %+v", expected, options)
+	}
+
+	// Every request parameter is removed, even invalid ones
+	for _, key := range requestParameters {
+		rest, _, _ := removeRequestOptions("t_thumb," + key + "_x")
+		if rest != "t_thumb" {
+			t.Errorf("Expected %s to be removed, got: %s", key, rest)
+		}
+	}
+	if _, _, err := removeRequestOptions("t_thumb,mask_../star.png"); err == nil {
+		t.Error("Expected an invalid mask to be refused")
 	}
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Instances fetch cached images from each other at this path
+	cachePeerPath         = "/_peers/cache/"
+	cachePeerSecretHeader = "X-Pixlserv-Peer-Secret"
+
+	// How often instances waiting for another one to generate an image check
+	// whether it's done
+	cachePeerPollInterval = 50 * time.Millisecond
+)
+
+var cachePeerClient = &http.Client{}
+
+// Instances sharing redis fetch images cached by another one from it instead
+// of generating them again, e.g. when the cache is on local disks. Which
+// instance holds an image is recorded with the image's cache metadata.
+func cachePeersEnabled() bool {
+	return currentConfig().cachePeerURL != ""
+}
+
+func generationClaimKey(fullImagePath string) string {
+	return "generating:" + fullImagePath
+}
+
+// setCachePeer records that this instance holds a cached image, the other
+// instances waiting for it can fetch it now
+func setCachePeer(fullImagePath string) {
+	if !cachePeersEnabled() {
+		return
+	}
+	Conn.Do("HSET", cacheKey(fullImagePath), "peer", currentConfig().cachePeerURL)
+	Conn.Do("DEL", generationClaimKey(fullImagePath))
+}
+
+// cachePeerFor returns the URL of another instance holding a cached image, ""
+// when this one or none does
+func cachePeerFor(fullImagePath string) string {
+	peer, _ := redis.String(Conn.Do("HGET", cacheKey(fullImagePath), "peer"))
+	if peer == currentConfig().cachePeerURL {
+		return ""
+	}
+	return peer
+}
+
+// fetchFromPeer asks another instance for an image it cached
+func fetchFromPeer(ctx context.Context, peer, fullImagePath string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(currentConfig().cachePeerTimeout)*time.Millisecond)
+	defer cancel()
+
+	segments := strings.Split(fullImagePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", peer+cachePeerPath+strings.Join(segments, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(cachePeerSecretHeader, currentConfig().cachePeerSecret)
+	// Peers log the request under the same ID
+	if id := requestLogFromContext(ctx).id; id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := cachePeerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer answered %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// generatedByPeer returns an image another instance generated and cached
+func generatedByPeer(ctx context.Context, fullImagePath string) (*generatedImage, bool) {
+	peer := cachePeerFor(fullImagePath)
+	if peer == "" {
+		return nil, false
+	}
+	data, err := fetchFromPeer(ctx, peer, fullImagePath)
+	if err == ErrNotFound {
+		cachePeerFetchesTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	if err != nil {
+		cachePeerFetchesTotal.WithLabelValues("error").Inc()
+		slog.Warn("fetching a cached image from a peer failed", "path", fullImagePath, "peer", peer, "error", err)
+		return nil, false
+	}
+	cachePeerFetchesTotal.WithLabelValues("hit").Inc()
+	hotCache.put(fullImagePath, data)
+	cacheRecordHit(len(data))
+	return &generatedImage{data, cacheSourceModTime(fullImagePath), nil}, true
+}
+
+// generateWithPeers returns an image another instance cached or else
+// generates it. Only one instance generates an image at a time, the others
+// wait for it for up to the peer timeout and then generate it themselves.
+func generateWithPeers(ctx context.Context, fullImagePath, baseImagePath string, transformation Transformation) (*generatedImage, error) {
+	if generated, ok := generatedByPeer(ctx, fullImagePath); ok {
+		return generated, nil
+	}
+
+	claimKey := generationClaimKey(fullImagePath)
+	claimed, _ := redis.String(Conn.Do("SET", claimKey, currentConfig().cachePeerURL, "NX", "PX", currentConfig().cachePeerTimeout))
+	if claimed != "OK" {
+		deadline := time.Now().Add(time.Duration(currentConfig().cachePeerTimeout) * time.Millisecond)
+		for time.Now().Before(deadline) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(cachePeerPollInterval):
+			}
+			// The claim is removed once the image is cached, or when
+			// generating it failed
+			claimExists, _ := redis.Bool(Conn.Do("EXISTS", claimKey))
+			if generated, ok := generatedByPeer(ctx, fullImagePath); ok {
+				return generated, nil
+			}
+			if !claimExists {
+				break
+			}
+		}
+	}
+
+	generated, err := generateImage(ctx, fullImagePath, baseImagePath, transformation)
+	if err != nil && claimed == "OK" {
+		Conn.Do("DEL", claimKey)
+	}
+	return generated, err
+}
+
+// peerCacheHandler serves cached images to other instances
+func peerCacheHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	secret := req.Header.Get(cachePeerSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(currentConfig().cachePeerSecret)) != 1 {
+		return http.StatusForbidden, ""
+	}
+
+	fullImagePath := params["_1"]
+	if data, ok := cachedInMemory(fullImagePath); ok {
+		return respondWithImage(res, req, data, time.Time{})
+	}
+	cached, err := openFromCache(fullImagePath)
+	if err != nil {
+		return http.StatusNotFound, ""
+	}
+	defer cached.Close()
+	return streamImage(res, req, cached, time.Time{})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestFetchFromPeer(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{cachePeerURL: "http://10.0.0.1:3000", cachePeerSecret: "secret", cachePeerTimeout: 1000})
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(cachePeerSecretHeader) != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.EscapedPath() != "/_peers/cache/photos/a%20cat--w_100--.jpg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("image"))
+	}))
+	defer peer.Close()
+
+	data, err := fetchFromPeer(context.Background(), peer.URL, "photos/a cat--w_100--.jpg")
+	if err != nil || string(data) != "image" {
+		t.Errorf("Unexpected result: %q, %v", data, err)
+	}
+	if _, err := fetchFromPeer(context.Background(), peer.URL, "photos/dog--w_100--.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+	currentConfig().cachePeerSecret = "other"
+	if _, err := fetchFromPeer(context.Background(), peer.URL, "photos/a cat--w_100--.jpg"); err == nil || err == ErrNotFound {
+		t.Errorf("Expected an error, got: %v", err)
+	}
+}
+
+func TestPeerCacheHandlerSecret(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{cachePeerURL: "http://10.0.0.1:3000", cachePeerSecret: "secret"})
+
+	for _, secret := range []string{"", "wrong", "secre"} {
+		req := httptest.NewRequest("GET", "/_peers/cache/cat--w_100--.jpg", nil)
+		req.Header.Set(cachePeerSecretHeader, secret)
+		if status, _ := peerCacheHandler(martini.Params{"_1": "cat--w_100--.jpg"}, req, httptest.NewRecorder()); status != http.StatusForbidden {
+			t.Errorf("%q: expected 403 Forbidden, got: %d", secret, status)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+// Pipelines are named like filters
+var pipelineNameRe = regexp.MustCompile("^[a-z0-9-]+$")
+
+// parseFilterPipelines reads named chains of filters, e.g.
+// editorial: grayscale|vignette:30, which are applied using f_editorial. The
+// chains are kept in their canonical form.
+func parseFilterPipelines(m map[interface{}]interface{}) (map[string]string, error) {
+	pipelines := make(map[string]string, len(m))
+	for key, value := range m {
+		name := strings.ToLower(fmt.Sprint(key))
+		if !pipelineNameRe.MatchString(name) || name == engine.DefaultFilter || engine.IsFilterName(name) {
+			return nil, fmt.Errorf("invalid filter pipeline name: %s", name)
+		}
+		chain, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("filter pipeline %s needs to be like grayscale|vignette:30", name)
+		}
+		canonical, err := engine.CanonicalFilter(chain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter pipeline %s: %s", name, err)
+		}
+		pipelines[name] = canonical
+	}
+	return pipelines, nil
+}
+
+// expandFilterPipeline replaces a filter pipeline's name in a parameters
+// string (e.g. "w_400,f_editorial") by its chain of filters, it returns the
+// name of the pipeline as well, "" when there isn't one
+func expandFilterPipeline(parametersStr string, pipelines map[string]string) (string, string) {
+	if len(pipelines) == 0 {
+		return parametersStr, ""
+	}
+	parts := strings.Split(parametersStr, ",")
+	for i, part := range parts {
+		name := strings.ToLower(strings.TrimPrefix(part, engine.ParameterFilter+"_"))
+		if chain, ok := pipelines[name]; ok && name != strings.ToLower(part) {
+			parts[i] = engine.ParameterFilter + "_" + chain
+			return strings.Join(parts, ","), name
+		}
+	}
+	return parametersStr, ""
+}
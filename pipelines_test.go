@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseFilterPipelines(t *testing.T) {
+	pipelines, err := parseFilterPipelines(map[interface{}]interface{}{
+		"Editorial": "grayscale|vignette:30",
+		"warm":      "tint:F90:20",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if pipelines["editorial"] != "grayscale|vignette:30" || pipelines["warm"] != "tint:ff9900:20" {
+		t.Errorf("Unexpected pipelines: %v", pipelines)
+	}
+
+	invalid := []map[interface{}]interface{}{
+		{"grayscale": "grayscale|vignette"},
+		{"hue": "grayscale"},
+		{"none": "grayscale"},
+		{"with space": "grayscale"},
+		{"editorial": "grayscale|sepia"},
+		{"editorial": 10},
+	}
+	for _, m := range invalid {
+		if _, err := parseFilterPipelines(m); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
+
+func TestFilterPipelineParameters(t *testing.T) {
+	c := &Configuration{filterPipelines: map[string]string{"editorial": "grayscale|vignette:30"}}
+	params, err := parseParameters("w_400,f_editorial", c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if params.Filter != "grayscale|vignette:30" {
+		t.Errorf("Expected the pipeline's filters, got: %s", params.Filter)
+	}
+
+	// Pipelines are allowed by their name
+	c.parameterPolicy, err = parseParameterPolicy(map[interface{}]interface{}{"filters": []interface{}{"editorial"}}, c.filterPipelines)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := parseParameters("w_400,f_editorial", c); err != nil {
+		t.Errorf("Expected the pipeline to be allowed, got: %s", err)
+	}
+	if _, err := parseParameters("w_400,f_grayscale", c); err == nil {
+		t.Error("Expected an error for a filter which isn't allowed")
+	}
+
+	if expanded, name := expandFilterPipeline("w_400,h_editorial", c.filterPipelines); expanded != "w_400,h_editorial" || name != "" {
+		t.Errorf("Expected only filters to be expanded, got: %s %s", expanded, name)
+	}
+}
@@ -0,0 +1,363 @@
+// Code generated by protoc-gen-go.
+// source: pixlserv.proto
+// DO NOT EDIT!
+
+/*
+Package pixlservpb is a generated protocol buffer package.
+
+It is generated from these files:
+
+	pixlserv.proto
+
+It has these top-level messages:
+
+	TransformImageRequest
+	ImageChunk
+	GetInfoRequest
+	ImageInfo
+	PurgeRequest
+	PurgeResponse
+	UploadRequest
+	UploadResponse
+*/
+package pixlservpb
+
+import proto "github.com/golang/protobuf/proto"
+
+import (
+	context "context"
+
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+
+type TransformImageRequest struct {
+	// Parameters or a named transformation, e.g. "w_400,h_300" or "t_square"
+	Parameters string `protobuf:"bytes,1,opt,name=parameters" json:"parameters,omitempty"`
+	// Path of the original image, e.g. "products/cat@2x.jpg"
+	ImagePath string `protobuf:"bytes,2,opt,name=image_path" json:"image_path,omitempty"`
+}
+
+func (m *TransformImageRequest) Reset()         { *m = TransformImageRequest{} }
+func (m *TransformImageRequest) String() string { return proto.CompactTextString(m) }
+func (*TransformImageRequest) ProtoMessage()    {}
+
+type ImageChunk struct {
+	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	// Set in the first chunk only
+	ContentType string `protobuf:"bytes,2,opt,name=content_type" json:"content_type,omitempty"`
+	Size        int64  `protobuf:"varint,3,opt,name=size" json:"size,omitempty"`
+}
+
+func (m *ImageChunk) Reset()         { *m = ImageChunk{} }
+func (m *ImageChunk) String() string { return proto.CompactTextString(m) }
+func (*ImageChunk) ProtoMessage()    {}
+
+type GetInfoRequest struct {
+	ImagePath string `protobuf:"bytes,1,opt,name=image_path" json:"image_path,omitempty"`
+}
+
+func (m *GetInfoRequest) Reset()         { *m = GetInfoRequest{} }
+func (m *GetInfoRequest) String() string { return proto.CompactTextString(m) }
+func (*GetInfoRequest) ProtoMessage()    {}
+
+type ImageInfo struct {
+	ImagePath string `protobuf:"bytes,1,opt,name=image_path" json:"image_path,omitempty"`
+	Format    string `protobuf:"bytes,2,opt,name=format" json:"format,omitempty"`
+	Width     int32  `protobuf:"varint,3,opt,name=width" json:"width,omitempty"`
+	Height    int32  `protobuf:"varint,4,opt,name=height" json:"height,omitempty"`
+	Size      int64  `protobuf:"varint,5,opt,name=size" json:"size,omitempty"`
+	// UNIX timestamp in seconds
+	Modified int64 `protobuf:"varint,6,opt,name=modified" json:"modified,omitempty"`
+	// Number of cached transformed versions
+	CachedVariants int32 `protobuf:"varint,7,opt,name=cached_variants" json:"cached_variants,omitempty"`
+}
+
+func (m *ImageInfo) Reset()         { *m = ImageInfo{} }
+func (m *ImageInfo) String() string { return proto.CompactTextString(m) }
+func (*ImageInfo) ProtoMessage()    {}
+
+type PurgeRequest struct {
+	ImagePath string `protobuf:"bytes,1,opt,name=image_path" json:"image_path,omitempty"`
+}
+
+func (m *PurgeRequest) Reset()         { *m = PurgeRequest{} }
+func (m *PurgeRequest) String() string { return proto.CompactTextString(m) }
+func (*PurgeRequest) ProtoMessage()    {}
+
+type PurgeResponse struct {
+	Removed int32 `protobuf:"varint,1,opt,name=removed" json:"removed,omitempty"`
+}
+
+func (m *PurgeResponse) Reset()         { *m = PurgeResponse{} }
+func (m *PurgeResponse) String() string { return proto.CompactTextString(m) }
+func (*PurgeResponse) ProtoMessage()    {}
+
+type UploadRequest struct {
+	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	// Needed in the first message when uploading with an API key
+	Timestamp int64  `protobuf:"varint,2,opt,name=timestamp" json:"timestamp,omitempty"`
+	Signature string `protobuf:"bytes,3,opt,name=signature" json:"signature,omitempty"`
+}
+
+func (m *UploadRequest) Reset()         { *m = UploadRequest{} }
+func (m *UploadRequest) String() string { return proto.CompactTextString(m) }
+func (*UploadRequest) ProtoMessage()    {}
+
+type UploadResponse struct {
+	ImagePath string `protobuf:"bytes,1,opt,name=image_path" json:"image_path,omitempty"`
+}
+
+func (m *UploadResponse) Reset()         { *m = UploadResponse{} }
+func (m *UploadResponse) String() string { return proto.CompactTextString(m) }
+func (*UploadResponse) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*TransformImageRequest)(nil), "pixlserv.TransformImageRequest")
+	proto.RegisterType((*ImageChunk)(nil), "pixlserv.ImageChunk")
+	proto.RegisterType((*GetInfoRequest)(nil), "pixlserv.GetInfoRequest")
+	proto.RegisterType((*ImageInfo)(nil), "pixlserv.ImageInfo")
+	proto.RegisterType((*PurgeRequest)(nil), "pixlserv.PurgeRequest")
+	proto.RegisterType((*PurgeResponse)(nil), "pixlserv.PurgeResponse")
+	proto.RegisterType((*UploadRequest)(nil), "pixlserv.UploadRequest")
+	proto.RegisterType((*UploadResponse)(nil), "pixlserv.UploadResponse")
+}
+
+// Client API for Pixlserv service
+
+type PixlservClient interface {
+	// Transforms an image like GET /image/PARAMETERS/PATH does, the encoded
+	// result is streamed in chunks
+	TransformImage(ctx context.Context, in *TransformImageRequest, opts ...grpc.CallOption) (Pixlserv_TransformImageClient, error)
+	// Describes an original image
+	GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*ImageInfo, error)
+	// Removes cached transformed versions of an image like DELETE /cache/PATH
+	Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (*PurgeResponse, error)
+	// Uploads an image like POST /upload, the first message carries the
+	// signature (when needed), all of them chunks of the image
+	Upload(ctx context.Context, opts ...grpc.CallOption) (Pixlserv_UploadClient, error)
+}
+
+type pixlservClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPixlservClient(cc grpc.ClientConnInterface) PixlservClient {
+	return &pixlservClient{cc}
+}
+
+func (c *pixlservClient) TransformImage(ctx context.Context, in *TransformImageRequest, opts ...grpc.CallOption) (Pixlserv_TransformImageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Pixlserv_serviceDesc.Streams[0], "/pixlserv.Pixlserv/TransformImage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pixlservTransformImageClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Pixlserv_TransformImageClient interface {
+	Recv() (*ImageChunk, error)
+	grpc.ClientStream
+}
+
+type pixlservTransformImageClient struct {
+	grpc.ClientStream
+}
+
+func (x *pixlservTransformImageClient) Recv() (*ImageChunk, error) {
+	m := new(ImageChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *pixlservClient) GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*ImageInfo, error) {
+	out := new(ImageInfo)
+	err := c.cc.Invoke(ctx, "/pixlserv.Pixlserv/GetInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pixlservClient) Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (*PurgeResponse, error) {
+	out := new(PurgeResponse)
+	err := c.cc.Invoke(ctx, "/pixlserv.Pixlserv/Purge", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pixlservClient) Upload(ctx context.Context, opts ...grpc.CallOption) (Pixlserv_UploadClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Pixlserv_serviceDesc.Streams[1], "/pixlserv.Pixlserv/Upload", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pixlservUploadClient{stream}
+	return x, nil
+}
+
+type Pixlserv_UploadClient interface {
+	Send(*UploadRequest) error
+	CloseAndRecv() (*UploadResponse, error)
+	grpc.ClientStream
+}
+
+type pixlservUploadClient struct {
+	grpc.ClientStream
+}
+
+func (x *pixlservUploadClient) Send(m *UploadRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *pixlservUploadClient) CloseAndRecv() (*UploadResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Pixlserv service
+
+type PixlservServer interface {
+	// Transforms an image like GET /image/PARAMETERS/PATH does, the encoded
+	// result is streamed in chunks
+	TransformImage(*TransformImageRequest, Pixlserv_TransformImageServer) error
+	// Describes an original image
+	GetInfo(context.Context, *GetInfoRequest) (*ImageInfo, error)
+	// Removes cached transformed versions of an image like DELETE /cache/PATH
+	Purge(context.Context, *PurgeRequest) (*PurgeResponse, error)
+	// Uploads an image like POST /upload, the first message carries the
+	// signature (when needed), all of them chunks of the image
+	Upload(Pixlserv_UploadServer) error
+}
+
+func RegisterPixlservServer(s grpc.ServiceRegistrar, srv PixlservServer) {
+	s.RegisterService(&_Pixlserv_serviceDesc, srv)
+}
+
+func _Pixlserv_TransformImage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TransformImageRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PixlservServer).TransformImage(m, &pixlservTransformImageServer{stream})
+}
+
+type Pixlserv_TransformImageServer interface {
+	Send(*ImageChunk) error
+	grpc.ServerStream
+}
+
+type pixlservTransformImageServer struct {
+	grpc.ServerStream
+}
+
+func (x *pixlservTransformImageServer) Send(m *ImageChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Pixlserv_GetInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PixlservServer).GetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pixlserv.Pixlserv/GetInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PixlservServer).GetInfo(ctx, req.(*GetInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pixlserv_Purge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PixlservServer).Purge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pixlserv.Pixlserv/Purge",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PixlservServer).Purge(ctx, req.(*PurgeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pixlserv_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PixlservServer).Upload(&pixlservUploadServer{stream})
+}
+
+type Pixlserv_UploadServer interface {
+	SendAndClose(*UploadResponse) error
+	Recv() (*UploadRequest, error)
+	grpc.ServerStream
+}
+
+type pixlservUploadServer struct {
+	grpc.ServerStream
+}
+
+func (x *pixlservUploadServer) SendAndClose(m *UploadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *pixlservUploadServer) Recv() (*UploadRequest, error) {
+	m := new(UploadRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Pixlserv_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "pixlserv.Pixlserv",
+	HandlerType: (*PixlservServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetInfo",
+			Handler:    _Pixlserv_GetInfo_Handler,
+		},
+		{
+			MethodName: "Purge",
+			Handler:    _Pixlserv_Purge_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TransformImage",
+			Handler:       _Pixlserv_TransformImage_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Upload",
+			Handler:       _Pixlserv_Upload_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pixlserv.proto",
+}
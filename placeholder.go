@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/ReshNesh/go-colorful"
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+	"github.com/golang/freetype/truetype"
+)
+
+const (
+	// Placeholders never change, so they can be cached for good
+	placeholderCacheControl = "public, max-age=31536000, immutable"
+
+	// Limit on each side when the output limits don't set a smaller one
+	maxPlaceholderSize = 4000
+)
+
+var (
+	placeholderSizeRe = regexp.MustCompile("^(\\d+)x(\\d+)(?:\\.(png|jpe?g))?$")
+	hexColorRe        = regexp.MustCompile("^(?:[0-9A-Fa-f]{3}){1,2}$")
+
+	defaultPlaceholderBackground = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+	defaultPlaceholderForeground = color.RGBA{0x55, 0x55, 0x55, 0xff}
+)
+
+// placeholder describes a generated placeholder image, its width and height
+// include scaling
+type placeholder struct {
+	width, height          int
+	format, label          string
+	background, foreground color.Color
+}
+
+// parsePlaceholder reads a placeholder from a size like 300x200@2x.png and
+// the bg, fg and text query parameters, the label is the size by default
+func parsePlaceholder(size string, query url.Values, limits engine.Limits) (*placeholder, error) {
+	size, scale := parseBasePathAndScale(size)
+	matches := placeholderSizeRe.FindStringSubmatch(size)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid placeholder size: %s", size)
+	}
+	width, _ := strconv.Atoi(matches[1])
+	height, _ := strconv.Atoi(matches[2])
+	if width < 1 || height < 1 || scale < 1 {
+		return nil, fmt.Errorf("invalid placeholder size: %s", size)
+	}
+
+	params := engine.Params{Width: width, Height: height, Scale: scale}
+	err := params.CheckLimits(limits)
+	if err != nil {
+		return nil, err
+	}
+	if width*scale > maxPlaceholderSize || height*scale > maxPlaceholderSize {
+		return nil, fmt.Errorf("placeholders can be at most %dx%d", maxPlaceholderSize, maxPlaceholderSize)
+	}
+
+	p := &placeholder{
+		width:      width * scale,
+		height:     height * scale,
+		format:     "png",
+		label:      fmt.Sprintf("%dx%d", width, height),
+		background: defaultPlaceholderBackground,
+		foreground: defaultPlaceholderForeground,
+	}
+	if matches[3] != "" && matches[3] != "png" {
+		p.format = "jpeg"
+	}
+	if texts, ok := query["text"]; ok {
+		p.label = texts[0]
+	}
+	if bg := query.Get("bg"); bg != "" {
+		p.background, err = parseHexColor(bg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fg := query.Get("fg"); fg != "" {
+		p.foreground, err = parseHexColor(fg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// parseHexColor reads a colour like ccc or 336699, without a # which would
+// start the fragment of a URL
+func parseHexColor(str string) (color.Color, error) {
+	if !hexColorRe.MatchString(str) {
+		return nil, fmt.Errorf("invalid colour: %s", str)
+	}
+	return colorful.Hex("#" + str)
+}
+
+// renderLabelledImage draws a label centred on an image of a single colour,
+// the label is left out without a font
+func renderLabelledImage(width, height int, background, foreground color.Color, label string, font *truetype.Font) (image.Image, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.ZP, draw.Src)
+	if font == nil || label == "" {
+		return img, nil
+	}
+
+	// Roughly as big as fits the width, at most an eighth of the height
+	size := 2 * width / (len(label) + 2)
+	if size > height/8 {
+		size = height / 8
+	}
+	if size < 6 {
+		size = 6
+	}
+	text := &engine.Text{Content: label, Gravity: engine.GravityCenter, Size: size, Font: font, Color: foreground}
+	return engine.DrawTexts(img, []*engine.Text{text}, 1)
+}
+
+// placeholderHandler answers requests for generated placeholder images
+func placeholderHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Images are written to the response by servePlaceholder itself
+	status, body := servePlaceholder(params, req, res)
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// servePlaceholder generates a placeholder image, it returns 0 when it wrote
+// the response itself
+func servePlaceholder(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, ReadPermission) {
+		return http.StatusUnauthorized, ""
+	}
+
+	p, err := parsePlaceholder(params["size"], req.URL.Query(), configFor(req).outputLimits())
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+
+	img, err := renderLabelledImage(p.width, p.height, p.background, p.foreground, p.label, currentConfig().defaultFont)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	var buffer bytes.Buffer
+	err = writeImage(img, p.format, &buffer)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+
+	res.Header().Set("Cache-Control", placeholderCacheControl)
+	return respondWithImage(res, req, buffer.Bytes(), time.Time{})
+}
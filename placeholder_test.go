@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestParsePlaceholder(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{outputMaxWidth: 2000})
+
+	p, err := parsePlaceholder("300x200", url.Values{}, currentConfig().outputLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.width != 300 || p.height != 200 || p.format != "png" || p.label != "300x200" || p.background != defaultPlaceholderBackground {
+		t.Errorf("Unexpected placeholder: %+v", p)
+	}
+
+	p, err = parsePlaceholder("300x200@2x.jpg", url.Values{"bg": {"336699"}, "fg": {"fff"}, "text": {""}}, currentConfig().outputLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.width != 600 || p.height != 400 || p.format != "jpeg" || p.label != "" {
+		t.Errorf("Unexpected placeholder: %+v", p)
+	}
+	r, g, b, _ := p.background.RGBA()
+	if r>>8 != 0x33 || g>>8 != 0x66 || b>>8 != 0x99 {
+		t.Errorf("Expected a #336699 background, got: %v", p.background)
+	}
+
+	invalid := []struct {
+		size  string
+		query url.Values
+	}{
+		{"300", nil},
+		{"0x200", nil},
+		{"300x200.gif", nil},
+		{"3000x200", nil},
+		{"1500x200@2x.png", nil},
+		{"300x200", url.Values{"bg": {"#ccc"}}},
+		{"300x200", url.Values{"fg": {"red"}}},
+	}
+	for _, c := range invalid {
+		if _, err := parsePlaceholder(c.size, c.query, currentConfig().outputLimits()); err == nil {
+			t.Errorf("Expected an error for %s %v", c.size, c.query)
+		}
+	}
+}
+
+func TestServePlaceholder(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{jpegQuality: 75})
+	oldPermissions := permissionsByKey
+	defer func() { permissionsByKey = oldPermissions }()
+	permissionsByKey = map[string]map[string]bool{"": {ReadPermission: true}}
+
+	req := httptest.NewRequest("GET", "/placeholder/120x80.png?bg=eee", nil)
+	res := httptest.NewRecorder()
+	status, body := servePlaceholder(martini.Params{"size": "120x80.png"}, req, res)
+	if status != 0 {
+		t.Fatalf("Expected the placeholder to be written, got: %d %s", status, body)
+	}
+	if res.Header().Get("Content-Type") != "image/png" || res.Header().Get("Cache-Control") != placeholderCacheControl || res.Header().Get("ETag") == "" {
+		t.Errorf("Unexpected headers: %v", res.Header())
+	}
+	img, err := png.Decode(bytes.NewReader(res.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Expected a PNG image: %s", err)
+	}
+	if img.Bounds().Dx() != 120 || img.Bounds().Dy() != 80 {
+		t.Errorf("Expected a 120x80 image, got: %v", img.Bounds())
+	}
+
+	res = httptest.NewRecorder()
+	servePlaceholder(martini.Params{"size": "64x64@2x.jpg"}, httptest.NewRequest("GET", "/placeholder/64x64@2x.jpg", nil), res)
+	img, err = jpeg.Decode(bytes.NewReader(res.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Expected a JPEG image: %s", err)
+	}
+	if img.Bounds().Dx() != 128 {
+		t.Errorf("Expected a 128x128 image, got: %v", img.Bounds())
+	}
+
+	status, _ = servePlaceholder(martini.Params{"size": "big"}, httptest.NewRequest("GET", "/placeholder/big", nil), httptest.NewRecorder())
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid size, got: %d", status)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"sort"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+const (
+	pngCompressionDefault = "default"
+	pngCompressionBest    = "best"
+	pngCompressionSpeed   = "speed"
+	pngCompressionNone    = "none"
+
+	maxPNGColors = 256
+
+	// Colors are counted with fewer bits per channel when an image has more
+	// distinct colors than this
+	maxPNGHistogram = 1 << 16
+)
+
+// PNGOptimization says how PNG images are made smaller
+type PNGOptimization struct {
+	colors      int  // Max. palette size, 0 keeps the colors
+	dither      bool // Whether quantized images are dithered
+	compression png.CompressionLevel
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	pngCompressionDefault: png.DefaultCompression,
+	pngCompressionBest:    png.BestCompression,
+	pngCompressionSpeed:   png.BestSpeed,
+	pngCompressionNone:    png.NoCompression,
+}
+
+// parsePNGOptimization reads PNG optimization options from configuration
+func parsePNGOptimization(m map[interface{}]interface{}) (*PNGOptimization, error) {
+	o := &PNGOptimization{dither: true}
+
+	if value, ok := m["colors"]; ok {
+		colors, ok := value.(int)
+		if !ok || colors < 0 || colors == 1 || colors > maxPNGColors {
+			return nil, fmt.Errorf("colors need to be between 2 and %d (0 keeps them): %v", maxPNGColors, value)
+		}
+		o.colors = colors
+	}
+	if dither, ok := m["dither"].(bool); ok {
+		o.dither = dither
+	}
+	if value, ok := m["compression"]; ok {
+		name, _ := value.(string)
+		level, ok := pngCompressionLevels[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid compression: %v (available: %s, %s, %s, %s)", value, pngCompressionDefault, pngCompressionBest, pngCompressionSpeed, pngCompressionNone)
+		}
+		o.compression = level
+	}
+	return o, nil
+}
+
+func (o *PNGOptimization) String() string {
+	str := fmt.Sprintf("colors=%d,dither=%t,best=%t", o.colors, o.dither, o.compression == png.BestCompression)
+	// Kept out for the levels there used to be so cached images keep their names
+	if o.compression == png.BestSpeed || o.compression == png.NoCompression {
+		str += fmt.Sprintf(",level=%d", o.compression)
+	}
+	return str
+}
+
+// encodePNG encodes an image as PNG, quantized to a palette and compressed
+// harder when optimization options are given. Images with 16 bits per channel
+// are dithered down to 8.
+func encodePNG(img image.Image, o *PNGOptimization, w io.Writer) error {
+	img = engine.Dither(img)
+	if o == nil {
+		return png.Encode(w, img)
+	}
+	encoder := png.Encoder{CompressionLevel: o.compression}
+	if o.colors > 0 {
+		img = quantize(img, o.colors, o.dither)
+	}
+	return encoder.Encode(w, img)
+}
+
+// colorCount is a color of an image and how many of its pixels have it
+type colorCount struct {
+	color color.NRGBA
+	count int
+}
+
+// quantize turns an image into a paletted one with at most the given number
+// of colors. Images which have few enough colors keep them exactly, the
+// palette of others is chosen by median cut.
+func quantize(img image.Image, colors int, dither bool) *image.Paletted {
+	if paletted, ok := img.(*image.Paletted); ok && len(paletted.Palette) <= colors {
+		return paletted
+	}
+
+	counts := colorHistogram(img, 0)
+	exact := len(counts) <= colors
+	if len(counts) > maxPNGHistogram {
+		counts = colorHistogram(img, 3)
+	}
+
+	var palette color.Palette
+	if exact {
+		for _, c := range counts {
+			palette = append(palette, c.color)
+		}
+	} else {
+		palette = medianCut(counts, colors)
+	}
+
+	bounds := img.Bounds()
+	paletted := image.NewPaletted(bounds, palette)
+	if dither && !exact {
+		draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+		return paletted
+	}
+
+	// Neighbouring pixels mostly share colors, their indexes are remembered
+	indexes := make(map[color.NRGBA]uint8)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := normalizedNRGBA(img.At(x, y))
+			index, ok := indexes[c]
+			if !ok {
+				index = uint8(palette.Index(c))
+				indexes[c] = index
+			}
+			paletted.SetColorIndex(x, y, index)
+		}
+	}
+	return paletted
+}
+
+// normalizedNRGBA converts a color, fully transparent colors are all the same
+func normalizedNRGBA(c color.Color) color.NRGBA {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if n.A == 0 {
+		return color.NRGBA{}
+	}
+	return n
+}
+
+// colorHistogram counts the colors of an image, dropping the given number of
+// low bits of each channel
+func colorHistogram(img image.Image, shift uint) []colorCount {
+	mask := uint8(0xff << shift)
+	histogram := make(map[color.NRGBA]int)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := normalizedNRGBA(img.At(x, y))
+			c.R, c.G, c.B, c.A = c.R&mask, c.G&mask, c.B&mask, c.A&mask
+			histogram[c]++
+		}
+	}
+
+	counts := make([]colorCount, 0, len(histogram))
+	for c, count := range histogram {
+		counts = append(counts, colorCount{c, count})
+	}
+	// Map iteration order isn't stable, palettes should be
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return nrgbaKey(counts[i].color) < nrgbaKey(counts[j].color)
+	})
+	return counts
+}
+
+func nrgbaKey(c color.NRGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
+
+// channel returns one of the R, G, B and A channels of a color
+func channel(c color.NRGBA, i int) uint8 {
+	return [4]uint8{c.R, c.G, c.B, c.A}[i]
+}
+
+// medianCut picks a palette of at most the given number of colors by
+// splitting the box of colors with the most pixels times range along its
+// widest channel at the median pixel until there are enough boxes
+func medianCut(counts []colorCount, colors int) color.Palette {
+	boxes := [][]colorCount{counts}
+	for len(boxes) < colors {
+		best, bestScore, bestChannel := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			widest, width := widestChannel(box)
+			pixels := 0
+			for _, c := range box {
+				pixels += c.count
+			}
+			if score := width * pixels; score > bestScore {
+				best, bestScore, bestChannel = i, score, widest
+			}
+		}
+		if best == -1 {
+			break
+		}
+
+		box := boxes[best]
+		sort.SliceStable(box, func(i, j int) bool {
+			return channel(box[i].color, bestChannel) < channel(box[j].color, bestChannel)
+		})
+		total := 0
+		for _, c := range box {
+			total += c.count
+		}
+		split, seen := 1, 0
+		for i, c := range box[:len(box)-1] {
+			seen += c.count
+			if seen*2 >= total {
+				split = i + 1
+				break
+			}
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		palette = append(palette, averageColor(box))
+	}
+	return palette
+}
+
+// widestChannel returns the channel whose values differ the most in a box
+// and how much they differ
+func widestChannel(box []colorCount) (int, int) {
+	widest, width := 0, -1
+	for i := 0; i < 4; i++ {
+		low, high := uint8(255), uint8(0)
+		for _, c := range box {
+			v := channel(c.color, i)
+			if v < low {
+				low = v
+			}
+			if v > high {
+				high = v
+			}
+		}
+		if int(high)-int(low) > width {
+			widest, width = i, int(high)-int(low)
+		}
+	}
+	return widest, width
+}
+
+// averageColor returns the color of a box weighted by how many pixels have
+// each color
+func averageColor(box []colorCount) color.NRGBA {
+	var r, g, b, a, total int
+	for _, c := range box {
+		r += int(c.color.R) * c.count
+		g += int(c.color.G) * c.count
+		b += int(c.color.B) * c.count
+		a += int(c.color.A) * c.count
+		total += c.count
+	}
+	return color.NRGBA{uint8(r / total), uint8(g / total), uint8(b / total), uint8(a / total)}
+}
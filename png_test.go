@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestParsePNGOptimization(t *testing.T) {
+	o, err := parsePNGOptimization(map[interface{}]interface{}{"colors": 64, "compression": "best"})
+	if err != nil || o.colors != 64 || !o.dither || o.compression != png.BestCompression {
+		t.Errorf("Unexpected options: %+v %v", o, err)
+	}
+	for _, m := range []map[interface{}]interface{}{{"colors": 1}, {"colors": 300}, {"compression": "fast"}} {
+		if _, err := parsePNGOptimization(m); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	// Few colors are kept exactly
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x / 4 * 60), 0, 0, 255})
+		}
+	}
+	img.SetNRGBA(0, 0, color.NRGBA{10, 20, 30, 0})
+	paletted := quantize(img, 16, true)
+	if len(paletted.Palette) != 5 {
+		t.Errorf("Expected 5 colors, got: %d", len(paletted.Palette))
+	}
+	for y := 0; y < 16; y++ {
+		for x := 1; x < 16; x++ {
+			if paletted.At(x, y) != img.At(x, y) {
+				t.Fatalf("Expected %v at %d,%d, got: %v", img.At(x, y), x, y, paletted.At(x, y))
+			}
+		}
+	}
+
+	// Others get a palette of the given size
+	gradient := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+	paletted = quantize(gradient, 32, false)
+	if len(paletted.Palette) != 32 {
+		t.Errorf("Expected 32 colors, got: %d", len(paletted.Palette))
+	}
+}
+
+func TestEncodePNG(t *testing.T) {
+	// Noise has many colors which don't compress well
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	var plain, optimized bytes.Buffer
+	if err := encodePNG(img, nil, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodePNG(img, &PNGOptimization{colors: 64, compression: png.BestCompression}, &optimized); err != nil {
+		t.Fatal(err)
+	}
+	if optimized.Len() >= plain.Len() {
+		t.Errorf("Expected the optimized image to be smaller, got %d bytes (%d)", optimized.Len(), plain.Len())
+	}
+	decoded, err := png.Decode(&optimized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Errorf("Expected bounds %v, got: %v", img.Bounds(), decoded.Bounds())
+	}
+}
+
+func TestEncodePNGHighBitDepth(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	var buffer bytes.Buffer
+	if err := encodePNG(img, nil, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if engine.IsHighBitDepth(decoded) {
+		t.Errorf("Expected an 8-bit image, got: %T", decoded)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+// ParameterPolicy restricts the parameters of custom transformations (ad-hoc
+// URLs) to bound the number of variants, named transformations and scripts
+// are chosen by admins and aren't restricted. Empty lists allow anything.
+type ParameterPolicy struct {
+	parameters                    []string // Keys which can be given (w, h...)
+	widths, heights, scales       []int
+	croppings, gravities, filters []string
+}
+
+// parseParameterPolicy reads a parameter policy from configuration, filters
+// can be the names of the given filter pipelines as well
+func parseParameterPolicy(m map[interface{}]interface{}, filterPipelines map[string]string) (*ParameterPolicy, error) {
+	p := &ParameterPolicy{}
+
+	known := []string{engine.ParameterWidth, engine.ParameterHeight, engine.ParameterCropping, engine.ParameterGravity, engine.ParameterFilter, engine.ParameterScale}
+	for _, key := range policyStrings(m, "parameters") {
+		if !containsString(known, key) {
+			return nil, fmt.Errorf("unknown parameter: %s (available: %s)", key, strings.Join(known, ", "))
+		}
+		p.parameters = append(p.parameters, key)
+	}
+
+	for name, values := range map[string]*[]int{"widths": &p.widths, "heights": &p.heights, "scales": &p.scales} {
+		list, _ := m[name].([]interface{})
+		for _, value := range list {
+			n, ok := value.(int)
+			if !ok || n <= 0 {
+				return nil, fmt.Errorf("%v is not a valid value in %s", value, name)
+			}
+			*values = append(*values, n)
+		}
+	}
+
+	checks := []struct {
+		name   string
+		values *[]string
+		valid  func(string) bool
+	}{
+		{"croppings", &p.croppings, engine.IsValidCroppingMode},
+		{"gravities", &p.gravities, engine.IsValidGravity},
+		{"filters", &p.filters, func(name string) bool {
+			_, ok := filterPipelines[name]
+			return ok || engine.IsFilterName(name)
+		}},
+	}
+	for _, c := range checks {
+		for _, value := range policyStrings(m, c.name) {
+			value = strings.ToLower(value)
+			if !c.valid(value) {
+				return nil, fmt.Errorf("%s is not a valid value in %s", value, c.name)
+			}
+			*c.values = append(*c.values, value)
+		}
+	}
+	return p, nil
+}
+
+func policyStrings(m map[interface{}]interface{}, name string) []string {
+	list, _ := m[name].([]interface{})
+	return stringList(list)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+// check makes sure a parameters string (e.g. "w_400,h_300") and the
+// parameters parsed from it are allowed, nil policies allow anything
+func (p *ParameterPolicy) check(parametersStr string, params engine.Params) error {
+	if p == nil {
+		return nil
+	}
+
+	if len(p.parameters) > 0 {
+		for _, part := range strings.Split(parametersStr, ",") {
+			key := strings.SplitN(part, "_", 2)[0]
+			if !containsString(p.parameters, key) {
+				return fmt.Errorf("parameter not allowed: %s", key)
+			}
+		}
+	}
+
+	ints := []struct {
+		name    string
+		value   int
+		allowed []int
+	}{
+		// 0 means the dimension is calculated
+		{"width", params.Width, p.widths},
+		{"height", params.Height, p.heights},
+	}
+	for _, c := range ints {
+		if c.value != 0 && len(c.allowed) > 0 && !containsInt(c.allowed, c.value) {
+			return fmt.Errorf("%s %d not allowed (allowed: %s)", c.name, c.value, strings.Trim(fmt.Sprint(c.allowed), "[]"))
+		}
+	}
+	err := p.checkScale(params.Scale)
+	if err != nil {
+		return err
+	}
+
+	strs := []struct {
+		name, value, defaultValue string
+		allowed                   []string
+	}{
+		{"cropping", params.Cropping, engine.DefaultCroppingMode, p.croppings},
+		// Gravities with offsets (c:50:-20) are allowed by their name
+		{"gravity", engine.GravityName(params.Gravity), engine.DefaultGravity, p.gravities},
+		// Filters with arguments (hue:90) are allowed by their name
+		{"filter", engine.FilterName(params.Filter), engine.DefaultFilter, p.filters},
+	}
+	for _, c := range strs {
+		// Defaults are always allowed
+		if c.value != c.defaultValue && len(c.allowed) > 0 && !containsString(c.allowed, c.value) {
+			return fmt.Errorf("%s %s not allowed (allowed: %s)", c.name, c.value, strings.Join(c.allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// checkScale makes sure a scale, from the parameters or the image path
+// (e.g. cat@2x.jpg), is allowed
+func (p *ParameterPolicy) checkScale(scale int) error {
+	if p == nil || scale == engine.DefaultScale || len(p.scales) == 0 || containsInt(p.scales, scale) {
+		return nil
+	}
+	return fmt.Errorf("scale %d not allowed (allowed: %s)", scale, strings.Trim(fmt.Sprint(p.scales), "[]"))
+}
+
+// PathPolicy governs the transformations of images whose paths start with a
+// prefix, e.g. avatars/ only allowing square named transformations
+type PathPolicy struct {
+	prefix                     string
+	transformations            []string // Named transformations which can be used, empty for all
+	allowCustomTransformations bool
+	parameterPolicy            *ParameterPolicy // Applies to custom transformations on top of the configuration's
+}
+
+// parsePathPolicies reads the path-policies section, named transformations
+// have to exist and prefixes have to be unique
+func parsePathPolicies(conf *Configuration, list []interface{}) ([]*PathPolicy, error) {
+	policies := make([]*PathPolicy, 0, len(list))
+	seen := make(map[string]bool)
+	for _, item := range list {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid path policy: %v", item)
+		}
+		prefix, _ := m["prefix"].(string)
+		prefix = strings.TrimPrefix(prefix, "/")
+		if prefix == "" {
+			return nil, fmt.Errorf("path policies need a prefix")
+		}
+		if seen[prefix] {
+			return nil, fmt.Errorf("duplicate path policy prefix: %s", prefix)
+		}
+		seen[prefix] = true
+
+		p := &PathPolicy{prefix: prefix, allowCustomTransformations: true}
+		for _, name := range policyStrings(m, "transformations") {
+			if _, ok := conf.transformations[name]; !ok {
+				return nil, fmt.Errorf("unknown transformation in the path policy for %s: %s", prefix, name)
+			}
+			p.transformations = append(p.transformations, name)
+		}
+		if allowCustom, ok := m["allow-custom-transformations"].(bool); ok {
+			p.allowCustomTransformations = allowCustom
+		}
+		var err error
+		p.parameterPolicy, err = parseParameterPolicy(m, conf.filterPipelines)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path policy for %s: %s", prefix, err)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// pathPolicy returns the policy with the longest prefix of an image path,
+// nil when none matches
+func (c *Configuration) pathPolicy(imagePath string) *PathPolicy {
+	imagePath = strings.TrimPrefix(imagePath, "/")
+	var matched *PathPolicy
+	for _, p := range c.pathPolicies {
+		if strings.HasPrefix(imagePath, p.prefix) && (matched == nil || len(p.prefix) > len(matched.prefix)) {
+			matched = p
+		}
+	}
+	return matched
+}
+
+// checkTransformation makes sure a named transformation ("" for custom ones)
+// can be used, nil policies allow anything
+func (p *PathPolicy) checkTransformation(transformationName string) error {
+	if p == nil {
+		return nil
+	}
+	if transformationName == "" {
+		if !p.allowCustomTransformations {
+			return fmt.Errorf("custom transformations not allowed for %s", p.prefix)
+		}
+		return nil
+	}
+	if len(p.transformations) > 0 && !containsString(p.transformations, transformationName) {
+		return fmt.Errorf("transformation %s not allowed for %s (allowed: %s)", transformationName, p.prefix, strings.Join(p.transformations, ", "))
+	}
+	return nil
+}
+
+// parameters returns the parameter policy of custom transformations, nil
+// for no restrictions
+func (p *PathPolicy) parameters() *ParameterPolicy {
+	if p == nil {
+		return nil
+	}
+	return p.parameterPolicy
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestParseParameterPolicy(t *testing.T) {
+	p, err := parseParameterPolicy(map[interface{}]interface{}{
+		"parameters": []interface{}{"w", "h", "c"},
+		"widths":     []interface{}{320, 640},
+		"croppings":  []interface{}{"P", "e"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.parameters) != 3 || len(p.widths) != 2 || p.croppings[0] != "p" {
+		t.Errorf("Unexpected policy: %+v", p)
+	}
+
+	invalid := []map[interface{}]interface{}{
+		{"parameters": []interface{}{"x"}},
+		{"widths": []interface{}{0}},
+		{"scales": []interface{}{"two"}},
+		{"gravities": []interface{}{"up"}},
+	}
+	for _, m := range invalid {
+		if _, err := parseParameterPolicy(m, nil); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
+
+func TestParameterPolicyCheck(t *testing.T) {
+	conf := &Configuration{parameterPolicy: &ParameterPolicy{
+		parameters: []string{"w", "h", "c", "s"},
+		widths:     []int{320, 640},
+		croppings:  []string{"p"},
+		scales:     []int{2},
+	}}
+	cases := []struct {
+		parametersStr string
+		allowed       bool
+	}{
+		{"w_320", true},
+		{"w_640,h_300,c_p", true},
+		{"h_300", true},
+		{"w_641", false},
+		{"w_320,f_grayscale", false},
+		{"w_320,c_k", false},
+	}
+	for _, c := range cases {
+		_, err := parseParameters(c.parametersStr, conf)
+		if (err == nil) != c.allowed {
+			t.Errorf("%s: expected allowed: %t, got: %v", c.parametersStr, c.allowed, err)
+		}
+	}
+
+	if conf.parameterPolicy.checkScale(2) != nil || conf.parameterPolicy.checkScale(3) == nil {
+		t.Error("Expected only the listed scales to be allowed")
+	}
+	if _, err := parseTrustedParameters("w_500,f_grayscale", conf); err != nil {
+		t.Errorf("Expected named transformations not to be restricted, got: %v", err)
+	}
+	if err := (*ParameterPolicy)(nil).check("w_500", engine.Params{Width: 500}); err != nil {
+		t.Errorf("Expected no policy to allow anything, got: %v", err)
+	}
+}
+
+func TestPathPolicies(t *testing.T) {
+	conf := &Configuration{
+		allowCustomTransformations: true,
+		allowCustomScale:           true,
+		transformations: map[string]Transformation{
+			"avatar":  {params: &engine.Params{Width: 100, Height: 100, Scale: 1, Cropping: engine.CroppingModePart}},
+			"product": {params: &engine.Params{Width: 400, Scale: 1}},
+		},
+	}
+	var err error
+	conf.pathPolicies, err = parsePathPolicies(conf, []interface{}{
+		map[interface{}]interface{}{"prefix": "avatars/", "transformations": []interface{}{"avatar"}, "allow-custom-transformations": false},
+		map[interface{}]interface{}{"prefix": "/banners/", "parameters": []interface{}{"w", "h", "c", "g", "s"}, "scales": []interface{}{2}},
+		map[interface{}]interface{}{"prefix": "banners/legacy/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		parametersStr, imagePath string
+		allowed                  bool
+	}{
+		{"t_avatar", "avatars/bob.jpg", true},
+		{"t_product", "avatars/bob.jpg", false},
+		{"w_100,h_100,c_p", "avatars/bob.jpg", false},
+		{"w_1200,h_300,c_p", "banners/spring.jpg", true},
+		{"w_1200,f_grayscale", "banners/spring.jpg", false},
+		{"w_1200", "banners/spring@2x.jpg", true},
+		{"w_1200", "banners/spring@3x.jpg", false},
+		{"t_product", "banners/spring.jpg", true},
+		// The longest prefix applies
+		{"w_1200,f_grayscale", "banners/legacy/spring.jpg", true},
+		{"w_100,f_grayscale", "products/shoe.jpg", true},
+	}
+	for _, c := range cases {
+		_, _, _, err := resolveTransformation(conf, c.parametersStr, c.imagePath)
+		if (err == nil) != c.allowed {
+			t.Errorf("%s/%s: expected allowed: %t, got: %v", c.parametersStr, c.imagePath, c.allowed, err)
+		}
+	}
+
+	invalid := [][]interface{}{
+		{map[interface{}]interface{}{"transformations": []interface{}{"avatar"}}},
+		{map[interface{}]interface{}{"prefix": "avatars/", "transformations": []interface{}{"unknown"}}},
+		{map[interface{}]interface{}{"prefix": "avatars/"}, map[interface{}]interface{}{"prefix": "/avatars/"}},
+		{map[interface{}]interface{}{"prefix": "banners/", "croppings": []interface{}{"x"}}},
+	}
+	for _, list := range invalid {
+		if _, err := parsePathPolicies(conf, list); err == nil {
+			t.Errorf("Expected an error for %v", list)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+const (
+	// Bytes per pixel of decoded images, most of them end up as RGBA
+	bytesPerPixel = 4
+
+	// Buffers which grew bigger aren't kept for reuse
+	maxPooledBufferSize = 16 * 1024 * 1024
+)
+
+// errOverloaded is returned when an image can't even be queued for
+// processing, requests failing with it should be retried later
+var errOverloaded = errors.New("too many images being processed, try again later")
+
+// workerPool limits how many images are decoded, transformed and encoded at
+// the same time. Callers beyond the limit wait in a queue of limited length,
+// for a limited time if maxWait is set.
+type workerPool struct {
+	slots    chan struct{}
+	queued   int64
+	maxQueue int64
+	maxWait  time.Duration
+}
+
+// memoryBudget tracks approximately how much memory the images being
+// processed take, an image which would exceed the limit isn't processed
+type memoryBudget struct {
+	used, limit int64
+}
+
+var (
+	// processingPool is nil when processing isn't limited
+	processingPool *workerPool
+
+	// processingMemory is nil when memory isn't limited
+	processingMemory *memoryBudget
+
+	// encodeBuffers are reused for encoding images, they tend to grow to
+	// similar sizes
+	encodeBuffers = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+)
+
+func processingInit() {
+	processingPool = newWorkerPool(currentConfig().processingWorkers, currentConfig().processingQueue, time.Duration(currentConfig().processingMaxWait)*time.Millisecond)
+	processingMemory = newMemoryBudget(currentConfig().processingMemoryLimit)
+}
+
+// newWorkerPool returns a pool of the given number of workers or nil when
+// workers is 0, queued callers wait for up to maxWait (0 = no limit)
+func newWorkerPool(workers, queue int, maxWait time.Duration) *workerPool {
+	if workers <= 0 {
+		return nil
+	}
+	return &workerPool{slots: make(chan struct{}, workers), maxQueue: int64(queue), maxWait: maxWait}
+}
+
+// full reports whether a caller of acquire would be turned away straight
+// away, so that requests can be rejected before any work is done for them
+func (p *workerPool) full() bool {
+	if p == nil {
+		return false
+	}
+	return len(p.slots) == cap(p.slots) && atomic.LoadInt64(&p.queued) >= p.maxQueue
+}
+
+// acquire takes a worker, waiting for one when all of them are busy. It
+// fails with errOverloaded when the queue is full or the wait is longer than
+// maxWait and with the context's error when the context is done while
+// waiting.
+func (p *workerPool) acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt64(&p.queued, 1) > p.maxQueue {
+		atomic.AddInt64(&p.queued, -1)
+		overloadRejectionsTotal.WithLabelValues("queue").Inc()
+		return errOverloaded
+	}
+	transformationsQueued.Inc()
+	defer func() {
+		atomic.AddInt64(&p.queued, -1)
+		transformationsQueued.Dec()
+	}()
+
+	var timeout <-chan time.Time
+	if p.maxWait > 0 {
+		timer := time.NewTimer(p.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		overloadRejectionsTotal.WithLabelValues("wait").Inc()
+		return errOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release returns a worker taken by acquire
+func (p *workerPool) release() {
+	if p == nil {
+		return
+	}
+	<-p.slots
+}
+
+// newMemoryBudget returns a budget of limit bytes or nil when limit is 0
+func newMemoryBudget(limit int) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{limit: int64(limit)}
+}
+
+// reserve takes size bytes from the budget, it fails with errOverloaded when
+// there isn't enough left. An image bigger than the whole budget is only
+// processed when nothing else is.
+func (b *memoryBudget) reserve(size int64) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used > 0 && used+size > b.limit {
+			overloadRejectionsTotal.WithLabelValues("memory").Inc()
+			return errOverloaded
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+size) {
+			processingMemoryBytes.Add(float64(size))
+			return nil
+		}
+	}
+}
+
+// free returns size bytes taken by reserve
+func (b *memoryBudget) free(size int64) {
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&b.used, -size)
+	processingMemoryBytes.Sub(float64(size))
+}
+
+// estimateMemory returns roughly how many bytes transforming an image takes:
+// the encoded original, the decoded one and the result
+func estimateMemory(data []byte, width, height int, geometry engine.Geometry) int64 {
+	decoded := int64(width) * int64(height) * bytesPerPixel
+	result := int64(geometry.Width) * int64(geometry.Height) * bytesPerPixel
+	return int64(len(data)) + decoded + result
+}
+
+// getEncodeBuffer returns an empty buffer from the pool, it needs to be
+// given back using putEncodeBuffer once its content isn't used anymore
+func getEncodeBuffer() *bytes.Buffer {
+	buffer := encodeBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+func putEncodeBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+	encodeBuffers.Put(buffer)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	p := newWorkerPool(1, 1, 0)
+	ctx := context.Background()
+	if err := p.acquire(ctx); err != nil {
+		t.Fatalf("Expected a free worker, got: %s", err)
+	}
+
+	// Waits in the queue until the worker is released
+	acquired := make(chan error)
+	go func() {
+		acquired <- p.acquire(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := p.acquire(ctx); err != errOverloaded {
+		t.Errorf("Expected the full queue to be reported, got: %v", err)
+	}
+
+	p.release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("Expected the queued caller to get the worker, got: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the queued caller to get the worker")
+	}
+
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := p.acquire(cancelled); err != context.DeadlineExceeded {
+		t.Errorf("Expected waiting to end with the context, got: %v", err)
+	}
+	p.release()
+
+	var unlimited *workerPool
+	if err := unlimited.acquire(ctx); err != nil {
+		t.Errorf("Expected processing without a pool not to be limited, got: %s", err)
+	}
+	unlimited.release()
+}
+
+func TestWorkerPoolMaxWait(t *testing.T) {
+	p := newWorkerPool(1, 1, 10*time.Millisecond)
+	ctx := context.Background()
+	if p.full() {
+		t.Error("Expected an idle pool not to be full")
+	}
+	if err := p.acquire(ctx); err != nil {
+		t.Fatalf("Expected a free worker, got: %s", err)
+	}
+	if p.full() {
+		t.Error("Expected the queue to take more callers")
+	}
+	if err := p.acquire(ctx); err != errOverloaded {
+		t.Errorf("Expected waiting to be limited, got: %v", err)
+	}
+	p.release()
+
+	var unlimited *workerPool
+	if unlimited.full() {
+		t.Error("Expected processing without a pool never to be full")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100)
+	if err := b.reserve(60); err != nil {
+		t.Fatalf("Expected memory within the budget, got: %s", err)
+	}
+	if err := b.reserve(60); err != errOverloaded {
+		t.Errorf("Expected the exceeded budget to be reported, got: %v", err)
+	}
+	b.free(60)
+
+	// An image bigger than the budget is processed on its own
+	if err := b.reserve(150); err != nil {
+		t.Errorf("Expected an image bigger than the budget to be processed alone, got: %s", err)
+	}
+	if err := b.reserve(1); err != errOverloaded {
+		t.Errorf("Expected nothing else to be processed meanwhile, got: %v", err)
+	}
+	b.free(150)
+
+	var unlimited *memoryBudget
+	if err := unlimited.reserve(1 << 40); err != nil {
+		t.Errorf("Expected no limit without a budget, got: %s", err)
+	}
+}
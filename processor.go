@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the pure-Go pipeline, it is always available
+const goProcessor = "go"
+
+// Processor transforms encoded images in one step, without decoding them
+// into Go images, e.g. using a native library
+type Processor interface {
+	// Init is called once before any image is processed
+	Init() error
+	// Process resizes and crops an image as the geometry specifies and
+	// applies a filter, the result is encoded in the same format (JPEG
+	// images with the given quality and chroma subsampling) or as WebP when
+	// webpOptions isn't nil. Backends without a WebP encoder return an error.
+	Process(data []byte, format string, geometry engine.Geometry, filter string, jpegOptions *jpegenc.Options, webpOptions *WebPOptions) ([]byte, error)
+	// Supports tells whether images of a format can be processed using a
+	// filter, other images are processed by the Go pipeline
+	Supports(format, filter string) bool
+	// Close releases the processor's resources when pixlserv stops
+	Close()
+}
+
+var (
+	processors = make(map[string]Processor)
+
+	// Processor in use, nil when images are processed in Go
+	processorImpl Processor
+)
+
+// RegisterProcessor makes a processing backend available under the given
+// name so that it can be selected using the processing backend configuration
+// option. Backends depending on native libraries register themselves from
+// files compiled in using build tags.
+func RegisterProcessor(name string, processor Processor) {
+	if processor == nil {
+		panic("processor: processor is nil for " + name)
+	}
+	if _, ok := processors[name]; ok || name == goProcessor {
+		panic("processor: registered twice: " + name)
+	}
+	processors[name] = processor
+}
+
+// processorInit sets up the configured backend, the Go pipeline is used
+// when it wasn't compiled in
+func processorInit() error {
+	name := currentConfig().processingBackend
+	if name == "" || name == goProcessor {
+		return nil
+	}
+
+	processor, ok := processors[name]
+	if !ok {
+		slog.Warn("processing backend not compiled in, using the Go pipeline", "backend", name)
+		return nil
+	}
+	err := processor.Init()
+	if err != nil {
+		return err
+	}
+	processorImpl = processor
+	slog.Info("using processing backend", "backend", name)
+	return nil
+}
+
+func processorCleanUp() {
+	if processorImpl != nil {
+		processorImpl.Close()
+	}
+}
+
+// processNatively transforms an image using the configured backend, false is
+// returned when the transformation needs the Go pipeline. Watermarks, texts
+// and scripts are only drawn in Go, automatic quality is only picked, gamma
+// and exposure are only adjusted and PNG images are only optimized in Go.
+func processNatively(ctx context.Context, data []byte, format string, geometry engine.Geometry, transformation *Transformation) ([]byte, bool, error) {
+	if processorImpl == nil || transformation.watermark != nil || len(transformation.texts) != 0 || transformation.mask != "" || transformation.script != nil || transformation.autoQuality || transformation.params.HasAdjustments() || transformation.params.Transparency != 0 {
+		return nil, false, nil
+	}
+	// PNG images are optimized unless they are encoded as WebP
+	if format == "png" && transformation.pngOptions() != nil && transformation.webp == nil {
+		return nil, false, nil
+	}
+	filter := transformation.params.Filter
+	if !processorImpl.Supports(format, filter) {
+		return nil, false, nil
+	}
+	if geometry.Crop.Empty() || geometry.Width <= 0 || geometry.Height <= 0 {
+		return nil, false, nil
+	}
+	// Enlargements are left to the upscaler hook
+	if currentConfig().upscalerURL != "" && geometry.Enlarges() {
+		return nil, false, nil
+	}
+
+	_, span := tracer.Start(ctx, "process", trace.WithAttributes(attribute.String("pixlserv.backend", currentConfig().processingBackend)))
+	// The backend decodes, transforms and encodes in one go
+	var processed []byte
+	err := runStage(ctx, stageTransform, func(ctx context.Context) error {
+		var err error
+		processed, err = processorImpl.Process(data, format, geometry, filter, transformation.jpegOptions(), transformation.webp)
+		return err
+	})
+	endSpan(span, err)
+	if err != nil {
+		return nil, true, err
+	}
+	return processed, true, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+// recordingProcessor remembers the geometry and WebP options of the last
+// image it processed
+type recordingProcessor struct {
+	geometry engine.Geometry
+	webp     *WebPOptions
+}
+
+func (p *recordingProcessor) Init() error { return nil }
+func (p *recordingProcessor) Close()      {}
+
+func (p *recordingProcessor) Supports(format, filter string) bool {
+	return filter == engine.DefaultFilter
+}
+
+func (p *recordingProcessor) Process(data []byte, format string, geometry engine.Geometry, filter string, jpegOptions *jpegenc.Options, webpOptions *WebPOptions) ([]byte, error) {
+	p.geometry, p.webp = geometry, webpOptions
+	return []byte("processed"), nil
+}
+
+func TestProcessNatively(t *testing.T) {
+	data := []byte("original")
+	processor := &recordingProcessor{}
+	processorImpl = processor
+	defer func() { processorImpl = nil }()
+
+	params := engine.Params{Width: 100, Height: 100, Scale: 1, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	geometry := engine.Plan(params, 800, 400)
+	processed, native, err := processNatively(context.Background(), data, "png", geometry, &Transformation{params: &params})
+	if err != nil || !native || string(processed) != "processed" {
+		t.Fatalf("Expected the image to be processed natively, got: %q, %t, %v", processed, native, err)
+	}
+	if processor.geometry != geometry {
+		t.Errorf("Expected geometry %v, got: %v", geometry, processor.geometry)
+	}
+
+	// Watermarks, unsupported filters and empty crops need the Go pipeline
+	_, native, _ = processNatively(context.Background(), data, "png", geometry, &Transformation{params: &params, watermark: &Watermark{}})
+	if native {
+		t.Error("Expected a transformation with a watermark to be left to the Go pipeline")
+	}
+	_, native, _ = processNatively(context.Background(), data, "png", engine.Geometry{}, &Transformation{params: &params})
+	if native {
+		t.Error("Expected an empty crop to be left to the Go pipeline")
+	}
+	params.Filter = engine.FilterGrayScale
+	_, native, _ = processNatively(context.Background(), data, "png", geometry, &Transformation{params: &params})
+	if native {
+		t.Error("Expected an unsupported filter to be left to the Go pipeline")
+	}
+}
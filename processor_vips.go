@@ -0,0 +1,101 @@
+//go:build vips
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// vipsProcessor processes images using libvips, it streams them through
+// memory instead of decoding whole images into Go images
+type vipsProcessor struct{}
+
+func init() {
+	RegisterProcessor("vips", vipsProcessor{})
+}
+
+func (vipsProcessor) Init() error {
+	vips.LoggingSettings(func(domain string, level vips.LogLevel, message string) {
+		slog.Debug("libvips", "domain", domain, "message", message)
+	}, vips.LogLevelWarning)
+	// The worker pool decides how many images are processed at the same time
+	vips.Startup(&vips.Config{ConcurrencyLevel: 1})
+	return nil
+}
+
+func (vipsProcessor) Supports(format, filter string) bool {
+	if format != "jpeg" && format != "png" {
+		return false
+	}
+	// Registered filters are Go functions
+	return filter == engine.DefaultFilter || filter == engine.FilterGrayScale
+}
+
+func (vipsProcessor) Process(data []byte, format string, geometry engine.Geometry, filter string, jpegOptions *jpegenc.Options, webpOptions *WebPOptions) ([]byte, error) {
+	img, err := vips.NewImageFromBuffer(data)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	if geometry.Crop.Dx() != img.Width() || geometry.Crop.Dy() != img.Height() {
+		err = img.ExtractArea(geometry.Crop.Min.X, geometry.Crop.Min.Y, geometry.Crop.Dx(), geometry.Crop.Dy())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if geometry.Width != img.Width() || geometry.Height != img.Height() {
+		hScale := float64(geometry.Width) / float64(img.Width())
+		vScale := float64(geometry.Height) / float64(img.Height())
+		err = img.ResizeWithVScale(hScale, vScale, vips.KernelLinear)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if filter == engine.FilterGrayScale {
+		err = img.ToColorSpace(vips.InterpretationBW)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var processed []byte
+	switch {
+	case webpOptions != nil:
+		params := vips.NewWebpExportParams()
+		params.StripMetadata = true
+		params.Lossless = true
+		if webpOptions.NearLossless {
+			// libvips takes the level of near-lossless preprocessing from Q
+			params.NearLossless = true
+			params.Quality = webpOptions.Level
+		}
+		processed, _, err = img.ExportWebp(params)
+	case format == "jpeg":
+		params := vips.NewJpegExportParams()
+		params.Quality = jpegOptions.Quality
+		// Metadata is copied as the configuration says afterwards
+		params.StripMetadata = true
+		params.SubsampleMode = vips.VipsForeignSubsampleOn
+		if jpegOptions.Subsampling == jpegenc.Subsampling444 {
+			params.SubsampleMode = vips.VipsForeignSubsampleOff
+		}
+		processed, _, err = img.ExportJpeg(params)
+	case format == "png":
+		params := vips.NewPngExportParams()
+		params.StripMetadata = true
+		processed, _, err = img.ExportPng(params)
+	default:
+		err = fmt.Errorf("unsupported format: %s", format)
+	}
+	return processed, err
+}
+
+func (vipsProcessor) Close() {
+	vips.Shutdown()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/twinj/uuid"
+)
+
+const (
+	// PurgeJobRunning = purge job still in progress
+	PurgeJobRunning = "running"
+	// PurgeJobDone = purge job finished successfully
+	PurgeJobDone = "done"
+	// PurgeJobFailed = purge job finished with an error
+	PurgeJobFailed = "failed"
+
+	purgeJobExpiration     = 24 * 60 * 60 // Seconds
+	purgeJobUpdateInterval = 100          // Update progress after this many files
+)
+
+// PurgeJob describes a purge of all cached images whose originals match
+// a pattern. Jobs are kept in redis so that their status can be checked
+// using any instance.
+type PurgeJob struct {
+	ID           string    `json:"id"`
+	Pattern      string    `json:"pattern"`
+	State        string    `json:"state"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+	Total        int       `json:"total"`
+	Removed      int       `json:"removed"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+}
+
+func purgeJobKey(id string) string {
+	return "purgejob:" + id
+}
+
+// Starts purging cached images matching a pattern in the background.
+func startPurge(pattern string) (*PurgeJob, error) {
+	if pattern == "" {
+		return nil, errors.New("missing pattern")
+	}
+
+	job := &PurgeJob{ID: uuid.NewV4().String(), Pattern: pattern, State: PurgeJobRunning, Started: time.Now()}
+	key := purgeJobKey(job.ID)
+	_, err := Conn.Do("HMSET", key, "pattern", pattern, "state", job.State, "total", 0, "removed", 0, "started", job.Started.Unix())
+	if err != nil {
+		return nil, err
+	}
+	Conn.Do("EXPIRE", key, purgeJobExpiration)
+
+	go runPurge(job)
+
+	return job, nil
+}
+
+func runPurge(job *PurgeJob) {
+	key := purgeJobKey(job.ID)
+	slog.Info("purge job started", "job", job.ID, "pattern", job.Pattern)
+
+	cachedPaths, err := cachedImagesMatching(job.Pattern)
+	if err != nil {
+		slog.Error("purge job failed", "job", job.ID, "error", err)
+		Conn.Do("HMSET", key, "state", PurgeJobFailed, "error", err.Error(), "finished", time.Now().Unix())
+		return
+	}
+	Conn.Do("HSET", key, "total", len(cachedPaths))
+
+	removed := 0
+	originals := make(map[string]bool)
+	for i, cachedPath := range cachedPaths {
+		if removeCachedFile(cachedPath) {
+			removed++
+		}
+		if original, ok := originalPath(cachedPath); ok {
+			originals[original] = true
+		}
+		if (i+1)%purgeJobUpdateInterval == 0 {
+			Conn.Do("HSET", key, "removed", removed)
+		}
+	}
+
+	Conn.Do("INCRBY", statsPurgedKey, removed)
+
+	imagePaths := make([]string, 0, len(originals))
+	for original := range originals {
+		purgeDerived(original)
+		imagePaths = append(imagePaths, original)
+	}
+	cdnPurge(imagePaths)
+
+	Conn.Do("HMSET", key, "state", PurgeJobDone, "removed", removed, "finished", time.Now().Unix())
+	slog.Info("purge job finished", "job", job.ID, "removed", removed)
+}
+
+// Returns the current state of a purge job.
+func getPurgeJob(id string) (*PurgeJob, error) {
+	values, err := redis.StringMap(Conn.Do("HGETALL", purgeJobKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errors.New("purge job not found")
+	}
+
+	job := &PurgeJob{ID: id, Pattern: values["pattern"], State: values["state"], ErrorMessage: values["error"]}
+	job.Total, _ = strconv.Atoi(values["total"])
+	job.Removed, _ = strconv.Atoi(values["removed"])
+	if started, err := strconv.ParseInt(values["started"], 10, 64); err == nil {
+		job.Started = time.Unix(started, 0)
+	}
+	if finished, err := strconv.ParseInt(values["finished"], 10, 64); err == nil {
+		job.Finished = time.Unix(finished, 0)
+	}
+
+	return job, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"log/slog"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+const (
+	// Parameter asking for the JPEG quality to be picked per image (q_auto)
+	parameterQuality = "q"
+	qualityAuto      = "auto"
+
+	// Parameter choosing the chroma subsampling of JPEG images (cs_444)
+	parameterSubsampling = "cs"
+	subsampling444       = "444"
+	subsampling420       = "420"
+
+	// Images are compared in windows of this many pixels squared
+	ssimWindow = 8
+)
+
+// removeQuality removes the quality parameter from a parameters string like
+// "w_400,q_auto" and tells whether automatic quality was asked for
+func removeQuality(parametersStr string) (string, bool, error) {
+	rest, value := removeParameter(parametersStr, parameterQuality)
+	if value != "" && value != qualityAuto {
+		return rest, false, fmt.Errorf("invalid quality: %s (only %s_%s is supported)", value, parameterQuality, qualityAuto)
+	}
+	return rest, value == qualityAuto, nil
+}
+
+// removeSubsampling removes the chroma subsampling parameter from a
+// parameters string like "w_400,cs_444" and returns its value, "" when there
+// is none
+func removeSubsampling(parametersStr string) (string, string, error) {
+	rest, value := removeParameter(parametersStr, parameterSubsampling)
+	if value != "" && value != subsampling444 && value != subsampling420 {
+		return rest, "", fmt.Errorf("invalid chroma subsampling: %s (available: %s, %s)", value, subsampling444, subsampling420)
+	}
+	return rest, value, nil
+}
+
+// parseSubsampling turns a chroma subsampling like 444 into the encoder's
+func parseSubsampling(value string) jpegenc.Subsampling {
+	if value == subsampling444 {
+		return jpegenc.Subsampling444
+	}
+	return jpegenc.Subsampling420
+}
+
+// encodeAutoQuality encodes an image as JPEG with the lowest quality between
+// the configured bounds whose result is still similar enough to the image
+func encodeAutoQuality(img image.Image, subsampling jpegenc.Subsampling, w io.Writer) error {
+	img = engine.Dither(img)
+	reference := lumaOf(img)
+	var best []byte
+	bestQuality := 0
+	var buffer bytes.Buffer
+
+	// Similarity grows with the quality, so the lowest good one is searched
+	low, high := currentConfig().autoQualityMin, currentConfig().autoQualityMax
+	for low <= high {
+		quality := (low + high) / 2
+		buffer.Reset()
+		err := jpegenc.Encode(&buffer, img, &jpegenc.Options{Quality: quality, Subsampling: subsampling})
+		if err != nil {
+			return err
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(buffer.Bytes()))
+		if err != nil {
+			return err
+		}
+		if ssim(reference, lumaOf(decoded)) >= currentConfig().autoQualityTarget {
+			best = append(best[:0], buffer.Bytes()...)
+			bestQuality = quality
+			high = quality - 1
+		} else {
+			low = quality + 1
+		}
+	}
+
+	if best == nil {
+		return writeJPEG(img, &jpegenc.Options{Quality: currentConfig().autoQualityMax, Subsampling: subsampling}, w)
+	}
+	slog.Debug("picked JPEG quality", "quality", bestQuality)
+	// The quality is searched for with the Go encoder, which is faster
+	if currentConfig().jpegEncoderCommand != "" {
+		return writeJPEG(img, &jpegenc.Options{Quality: bestQuality, Subsampling: subsampling}, w)
+	}
+	_, err := w.Write(best)
+	return err
+}
+
+// lumaOf returns the luma channel of an image, decoded JPEG images have it
+// already
+func lumaOf(img image.Image) *image.Gray {
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		return &image.Gray{Pix: ycbcr.Y, Stride: ycbcr.YStride, Rect: ycbcr.Rect}
+	}
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+	return gray
+}
+
+// ssim returns the mean structural similarity of two images of the same size
+// over windows of their luma, 1 means they are identical
+func ssim(a, b *image.Gray) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+		n  = ssimWindow * ssimWindow
+	)
+
+	width, height := a.Rect.Dx(), a.Rect.Dy()
+	total, windows := 0.0, 0
+	for y := 0; y+ssimWindow <= height; y += ssimWindow {
+		for x := 0; x+ssimWindow <= width; x += ssimWindow {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for j := y; j < y+ssimWindow; j++ {
+				rowA := a.Pix[j*a.Stride:]
+				rowB := b.Pix[j*b.Stride:]
+				for i := x; i < x+ssimWindow; i++ {
+					pa, pb := float64(rowA[i]), float64(rowB[i])
+					sumA += pa
+					sumB += pb
+					sumAA += pa * pa
+					sumBB += pb * pb
+					sumAB += pa * pb
+				}
+			}
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			covariance := sumAB/n - meanA*meanB
+			total += (2*meanA*meanB + c1) * (2*covariance + c2) / ((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+
+	// Images smaller than a window can't be told apart
+	if windows == 0 {
+		return 1
+	}
+	return total / float64(windows)
+}
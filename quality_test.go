@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+func TestRemoveQuality(t *testing.T) {
+	rest, auto, err := removeQuality("w_400,q_auto,h_300")
+	if err != nil || !auto || rest != "w_400,h_300" {
+		t.Errorf("Expected w_400,h_300 with automatic quality, got: %s %v %v", rest, auto, err)
+	}
+	rest, auto, err = removeQuality("t_thumb")
+	if err != nil || auto || rest != "t_thumb" {
+		t.Errorf("Expected t_thumb without automatic quality, got: %s %v %v", rest, auto, err)
+	}
+	_, _, err = removeQuality("w_400,q_80")
+	if err == nil {
+		t.Error("Expected an error for q_80")
+	}
+}
+
+func TestRemoveSubsampling(t *testing.T) {
+	rest, subsampling, err := removeSubsampling("t_screenshot,cs_444")
+	if err != nil || subsampling != subsampling444 || rest != "t_screenshot" {
+		t.Errorf("Expected t_screenshot with 4:4:4, got: %s %s %v", rest, subsampling, err)
+	}
+	_, _, err = removeSubsampling("w_400,cs_422")
+	if err == nil {
+		t.Error("Expected an error for cs_422")
+	}
+	if parseSubsampling(subsampling444) != jpegenc.Subsampling444 || parseSubsampling("") != jpegenc.Subsampling420 {
+		t.Error("Unexpected parsed subsampling")
+	}
+}
+
+func TestSSIM(t *testing.T) {
+	noise := image.NewGray(image.Rect(0, 0, 64, 64))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+	flat := image.NewGray(noise.Rect)
+	for i := range flat.Pix {
+		flat.Pix[i] = 128
+	}
+
+	if s := ssim(noise, noise); s < 0.9999 {
+		t.Errorf("Expected identical images to have an SSIM of 1, got: %f", s)
+	}
+	if s := ssim(noise, flat); s > 0.5 {
+		t.Errorf("Expected different images to have a low SSIM, got: %f", s)
+	}
+	tiny := image.NewGray(image.Rect(0, 0, 4, 4))
+	if s := ssim(tiny, tiny); s != 1 {
+		t.Errorf("Expected images smaller than a window to have an SSIM of 1, got: %f", s)
+	}
+}
+
+func TestEncodeAutoQuality(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{autoQualityTarget: defaultAutoQualityTarget, autoQualityMin: defaultAutoQualityMin, autoQualityMax: defaultAutoQualityMax})
+
+	// A smooth gradient doesn't need a high quality
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 2), 100, 255})
+		}
+	}
+	var auto, high bytes.Buffer
+	err := encodeAutoQuality(img, jpegenc.Subsampling420, &auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpeg.Encode(&high, img, &jpeg.Options{Quality: defaultAutoQualityMax})
+	if auto.Len() >= high.Len() {
+		t.Errorf("Expected a smaller image than at quality %d, got %d bytes (%d)", defaultAutoQualityMax, auto.Len(), high.Len())
+	}
+	decoded, err := jpeg.Decode(&auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ssim(lumaOf(img), lumaOf(decoded)); s < defaultAutoQualityTarget {
+		t.Errorf("Expected an SSIM of at least %f, got: %f", defaultAutoQualityTarget, s)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
+)
+
+const (
+	usageKeyPrefix   = "usage:"
+	usageDayFormat   = "2006-01-02"
+	usageMonthFormat = "2006-01"
+
+	// Usage is kept for a while after its period ends for chargeback
+	usageDayExpiration   = 35 * 24 * 60 * 60  // Seconds
+	usageMonthExpiration = 400 * 24 * 60 * 60 // Seconds
+)
+
+// Quota limits the images an API key or a tenant can have transformed, 0
+// means no limit
+type Quota struct {
+	DailyTransformations   int64 `json:"dailyTransformations,omitempty"`
+	MonthlyTransformations int64 `json:"monthlyTransformations,omitempty"`
+	DailyBytes             int64 `json:"dailyBytes,omitempty"`
+	MonthlyBytes           int64 `json:"monthlyBytes,omitempty"`
+}
+
+// Usage counts the images transformed in a day or a month and their size
+type Usage struct {
+	Period          string `json:"period"`
+	Transformations int64  `json:"transformations"`
+	Bytes           int64  `json:"bytes"`
+}
+
+// SubjectUsage is the usage of an API key or a tenant and its quota
+type SubjectUsage struct {
+	Subject string `json:"subject"`
+	Daily   Usage  `json:"daily"`
+	Monthly Usage  `json:"monthly"`
+	Quota   *Quota `json:"quota,omitempty"`
+}
+
+// UsageResponse is a struct to represent a JSON response for the usage handler
+type UsageResponse struct {
+	Status       string         `json:"status"`
+	ErrorMessage string         `json:"errorMessage,omitempty"`
+	Usage        []SubjectUsage `json:"usage,omitempty"`
+}
+
+// parseQuota reads a quota from configuration
+func parseQuota(m map[interface{}]interface{}) (*Quota, error) {
+	q := &Quota{}
+	limits := map[string]*int64{
+		"daily-transformations":   &q.DailyTransformations,
+		"monthly-transformations": &q.MonthlyTransformations,
+		"daily-bytes":             &q.DailyBytes,
+		"monthly-bytes":           &q.MonthlyBytes,
+	}
+	for name, limit := range limits {
+		value, ok := m[name]
+		if !ok {
+			continue
+		}
+		n, ok := value.(int)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("%v is not a valid %s", value, name)
+		}
+		*limit = int64(n)
+	}
+	return q, nil
+}
+
+// exceeded reports whether usage has reached the quota
+func (q *Quota) exceeded(daily, monthly Usage) bool {
+	reached := func(used, limit int64) bool {
+		return limit > 0 && used >= limit
+	}
+	return reached(daily.Transformations, q.DailyTransformations) ||
+		reached(monthly.Transformations, q.MonthlyTransformations) ||
+		reached(daily.Bytes, q.DailyBytes) ||
+		reached(monthly.Bytes, q.MonthlyBytes)
+}
+
+// usageSubjects returns who the transformations of a request are accounted
+// to: its API key and its tenant
+func usageSubjects(params martini.Params, req *http.Request) []string {
+	subjects := make([]string, 0, 2)
+	if key := requestKey(params, req); key != "" {
+		subjects = append(subjects, "key:"+key)
+	}
+	if tenant := tenantFor(req); tenant != nil {
+		subjects = append(subjects, "tenant:"+tenant.name)
+	}
+	return subjects
+}
+
+// quotaFor returns the quota of an API key or a tenant, nil if there is none
+func quotaFor(subject string) *Quota {
+	switch {
+	case strings.HasPrefix(subject, "key:"):
+		if quota, ok := currentConfig().keyQuotas[strings.TrimPrefix(subject, "key:")]; ok {
+			return quota
+		}
+		return currentConfig().defaultKeyQuota
+	case strings.HasPrefix(subject, "tenant:"):
+		for _, tenant := range currentConfig().tenants {
+			if tenant.name == strings.TrimPrefix(subject, "tenant:") {
+				return tenant.quota
+			}
+		}
+	}
+	return nil
+}
+
+func usageKeys(subject string, now time.Time) (string, string) {
+	now = now.UTC()
+	return usageKeyPrefix + subject + ":" + now.Format(usageDayFormat), usageKeyPrefix + subject + ":" + now.Format(usageMonthFormat)
+}
+
+// getUsage returns the usage of an API key or a tenant today and this month
+func getUsage(subject string, now time.Time) (Usage, Usage, error) {
+	dayKey, monthKey := usageKeys(subject, now)
+	daily := Usage{Period: now.UTC().Format(usageDayFormat)}
+	monthly := Usage{Period: now.UTC().Format(usageMonthFormat)}
+	for _, u := range []struct {
+		key   string
+		usage *Usage
+	}{{dayKey, &daily}, {monthKey, &monthly}} {
+		values, err := redis.Strings(Conn.Do("HMGET", u.key, "transformations", "bytes"))
+		if err != nil {
+			return daily, monthly, err
+		}
+		u.usage.Transformations, _ = strconv.ParseInt(values[0], 10, 64)
+		u.usage.Bytes, _ = strconv.ParseInt(values[1], 10, 64)
+	}
+	return daily, monthly, nil
+}
+
+// recordUsage accounts a transformed image of the given size to subjects
+func recordUsage(subjects []string, size int, now time.Time) {
+	for _, subject := range subjects {
+		dayKey, monthKey := usageKeys(subject, now)
+		Conn.Do("HINCRBY", dayKey, "transformations", 1)
+		Conn.Do("HINCRBY", dayKey, "bytes", size)
+		Conn.Do("EXPIRE", dayKey, usageDayExpiration)
+		Conn.Do("HINCRBY", monthKey, "transformations", 1)
+		Conn.Do("HINCRBY", monthKey, "bytes", size)
+		Conn.Do("EXPIRE", monthKey, usageMonthExpiration)
+	}
+}
+
+// quotaExceeded returns the first of subjects whose quota is used up,
+// requests are let through when usage can't be read
+func quotaExceeded(subjects []string, now time.Time) (string, bool) {
+	for _, subject := range subjects {
+		quota := quotaFor(subject)
+		if quota == nil {
+			continue
+		}
+		daily, monthly, err := getUsage(subject, now)
+		if err != nil {
+			slog.Error("reading usage failed", "subject", subject, "error", err)
+			continue
+		}
+		if quota.exceeded(daily, monthly) {
+			return subject, true
+		}
+	}
+	return "", false
+}
+
+// usageHandler returns the usage and quotas of the request's API key and
+// tenant, admins can ask for any key or tenant
+func usageHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, ReadPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, UsageResponse{"error", "API key invalid or missing", nil})
+	}
+
+	subjects := usageSubjects(params, req)
+	key, tenant := req.URL.Query().Get("key"), req.URL.Query().Get("tenant")
+	if key != "" || tenant != "" {
+		if !isAuthorised(params, req, AdminPermission) {
+			return jsonResponse(res, http.StatusForbidden, UsageResponse{"error", "only admins can read the usage of others", nil})
+		}
+		subjects = subjects[:0]
+		if key != "" {
+			subjects = append(subjects, "key:"+key)
+		}
+		if tenant != "" {
+			subjects = append(subjects, "tenant:"+tenant)
+		}
+	}
+	if len(subjects) == 0 {
+		return jsonResponse(res, http.StatusBadRequest, UsageResponse{"error", "usage is only kept for API keys and tenants", nil})
+	}
+
+	now := time.Now()
+	usage := make([]SubjectUsage, 0, len(subjects))
+	for _, subject := range subjects {
+		daily, monthly, err := getUsage(subject, now)
+		if err != nil {
+			slog.Error("reading usage failed", "subject", subject, "error", err)
+			return jsonResponse(res, http.StatusInternalServerError, UsageResponse{"error", "reading usage failed", nil})
+		}
+		usage = append(usage, SubjectUsage{subject, daily, monthly, quotaFor(subject)})
+	}
+	return jsonResponse(res, http.StatusOK, UsageResponse{"ok", "", usage})
+}
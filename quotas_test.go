@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestParseQuota(t *testing.T) {
+	q, err := parseQuota(map[interface{}]interface{}{"daily-transformations": 100, "monthly-bytes": 5000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *q != (Quota{DailyTransformations: 100, MonthlyBytes: 5000000}) {
+		t.Errorf("Unexpected quota: %+v", q)
+	}
+
+	for _, m := range []map[interface{}]interface{}{{"daily-bytes": -1}, {"monthly-transformations": "many"}} {
+		if _, err := parseQuota(m); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	q := &Quota{DailyTransformations: 10, MonthlyBytes: 1000}
+	cases := []struct {
+		daily, monthly Usage
+		exceeded       bool
+	}{
+		{Usage{Transformations: 9, Bytes: 500}, Usage{Transformations: 9, Bytes: 500}, false},
+		{Usage{Transformations: 10}, Usage{Transformations: 10}, true},
+		{Usage{Transformations: 1, Bytes: 100}, Usage{Transformations: 50, Bytes: 1000}, true},
+	}
+	for _, c := range cases {
+		if q.exceeded(c.daily, c.monthly) != c.exceeded {
+			t.Errorf("%+v %+v: expected exceeded: %t", c.daily, c.monthly, c.exceeded)
+		}
+	}
+	if (&Quota{}).exceeded(Usage{Transformations: 1 << 40}, Usage{Bytes: 1 << 40}) {
+		t.Error("Expected a quota without limits to never be exceeded")
+	}
+}
+
+func TestUsageSubjects(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	acme := &Tenant{name: "acme", quota: &Quota{DailyBytes: 1}}
+	setConfig(&Configuration{
+		tenants:         []*Tenant{acme},
+		defaultKeyQuota: &Quota{DailyTransformations: 100},
+		keyQuotas:       map[string]*Quota{"BIG": {DailyTransformations: 10000}},
+	})
+
+	req := httptest.NewRequest("GET", "/image/w_100/cat.jpg", nil)
+	if subjects := usageSubjects(martini.Params{}, req); len(subjects) != 0 {
+		t.Errorf("Expected anonymous requests not to be accounted, got: %v", subjects)
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), tenantKey{}, &tenantSelection{acme, true}))
+	subjects := usageSubjects(martini.Params{"apikey": "ABC"}, req)
+	if len(subjects) != 2 || subjects[0] != "key:ABC" || subjects[1] != "tenant:acme" {
+		t.Errorf("Unexpected subjects: %v", subjects)
+	}
+
+	if quotaFor("key:ABC") != currentConfig().defaultKeyQuota || quotaFor("key:BIG").DailyTransformations != 10000 || quotaFor("tenant:acme") != acme.quota || quotaFor("tenant:globex") != nil {
+		t.Error("Unexpected quotas")
+	}
+
+	day, month := usageKeys("key:ABC", time.Date(2026, 1, 31, 23, 30, 0, 0, time.FixedZone("", -3600)))
+	if day != "usage:key:ABC:2026-02-01" || month != "usage:key:ABC:2026-02" {
+		t.Errorf("Expected periods in UTC, got: %s %s", day, month)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errRangeNotSatisfiable is returned for ranges starting after the end of a
+// response
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is the part of a response a request asks for with a Range header
+type byteRange struct {
+	start, length int64
+}
+
+// contentRange returns the Content-Range header value of the range of a
+// response of the given size
+func (r *byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// requestedRange returns the range of a response of the given size a request
+// asks for, nil when the whole response should be sent. Only single ranges
+// are served, requests for several ranges and invalid or outdated (If-Range)
+// ones get the whole response as RFC 7233 allows.
+func requestedRange(req *http.Request, size int64, etag string, modTime time.Time) (*byteRange, error) {
+	header := req.Header.Get("Range")
+	if header == "" || !strings.HasPrefix(header, "bytes=") || !ifRangeMatches(req.Header.Get("If-Range"), etag, modTime) {
+		return nil, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	dash := strings.Index(spec, "-")
+	if dash < 0 || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	// A suffix range asks for the last bytes
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 || size == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return &byteRange{size - n, n}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return nil, nil
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+	return &byteRange{start, end - start + 1}, nil
+}
+
+// ifRangeMatches reports whether the response a range is taken from is still
+// the one an If-Range header value names, by a strong ETag or the
+// modification time
+func ifRangeMatches(ifRange, etag string, modTime time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		return ifRange == etag && !strings.HasPrefix(etag, "W/")
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !modTime.IsZero() && modTime.Truncate(time.Second).Equal(t)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestedRange(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	etag := `"abc"`
+	cases := []struct {
+		rangeHeader, ifRange string
+		expected             *byteRange
+		err                  error
+	}{
+		{"", "", nil, nil},
+		{"bytes=0-9", "", &byteRange{0, 10}, nil},
+		{"bytes=90-", "", &byteRange{90, 10}, nil},
+		{"bytes=95-200", "", &byteRange{95, 5}, nil},
+		{"bytes=-20", "", &byteRange{80, 20}, nil},
+		{"bytes=-200", "", &byteRange{0, 100}, nil},
+		{"bytes=100-", "", nil, errRangeNotSatisfiable},
+		{"bytes=-0", "", nil, errRangeNotSatisfiable},
+		// Ignored
+		{"bytes=0-9,20-29", "", nil, nil},
+		{"bytes=9-0", "", nil, nil},
+		{"bytes=a-b", "", nil, nil},
+		{"items=0-9", "", nil, nil},
+		// If-Range
+		{"bytes=0-9", `"abc"`, &byteRange{0, 10}, nil},
+		{"bytes=0-9", `"old"`, nil, nil},
+		{"bytes=0-9", `W/"abc"`, nil, nil},
+		{"bytes=0-9", modTime.Format(http.TimeFormat), &byteRange{0, 10}, nil},
+		{"bytes=0-9", modTime.Add(-time.Hour).Format(http.TimeFormat), nil, nil},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/image/w_100/cat.png", nil)
+		req.Header.Set("Range", c.rangeHeader)
+		req.Header.Set("If-Range", c.ifRange)
+		r, err := requestedRange(req, 100, etag, modTime)
+		if err != c.err || (r == nil) != (c.expected == nil) || (r != nil && *r != *c.expected) {
+			t.Errorf("%q (If-Range: %q): expected %v, %v, actual: %v, %v", c.rangeHeader, c.ifRange, c.expected, c.err, r, err)
+		}
+	}
+}
+
+func TestRespondWithImageRange(t *testing.T) {
+	data := []byte("\x89PNG\r\n\x1a\nimage data")
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/image/w_100/cat.png", nil)
+	req.Header.Set("Range", "bytes=8-12")
+	respondWithImage(res, req, data, time.Time{})
+	if res.Code != http.StatusPartialContent || res.Body.String() != "image" {
+		t.Errorf("Expected the range, got: %d %q", res.Code, res.Body.String())
+	}
+	if res.Header().Get("Content-Range") != "bytes 8-12/18" || res.Header().Get("Content-Length") != "5" || res.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Unexpected headers: %v", res.Header())
+	}
+
+	res = httptest.NewRecorder()
+	req.Header.Set("Range", "bytes=50-")
+	if status, _ := respondWithImage(res, req, data, time.Time{}); status != http.StatusRequestedRangeNotSatisfiable || res.Header().Get("Content-Range") != "bytes */18" {
+		t.Errorf("Expected 416 Range Not Satisfiable, got: %d %v", status, res.Header())
+	}
+
+	// Streamed from the cache
+	res = httptest.NewRecorder()
+	req.Header.Set("Range", "bytes=-4")
+	cached := &cachedImage{ioutil.NopCloser(bytes.NewReader(data)), "png", imageETag(data), len(data)}
+	streamImage(res, req, cached, time.Time{})
+	if res.Code != http.StatusPartialContent || res.Body.String() != "data" || res.Header().Get("Content-Range") != "bytes 14-17/18" {
+		t.Errorf("Expected the range, got: %d %q %v", res.Code, res.Body.String(), res.Header())
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
+)
+
+const (
+	// Buckets are dropped from memory once there are more than this many
+	// and they are full again
+	rateLimitMaxBuckets = 10000
+)
+
+// RateLimit is a token bucket refilled at rate tokens per minute holding
+// at most burst tokens
+type RateLimit struct {
+	rate, burst int
+}
+
+// rateLimiter decides whether a client identified by a key can make another
+// request, if not it returns how long the client should wait
+type rateLimiter interface {
+	take(key string, now time.Time) (bool, time.Duration)
+}
+
+// rateLimitInit sets up the limiters of a configuration, those of the
+// previous one (nil for none) are kept when the limits didn't change so that
+// clients don't get full buckets again
+func rateLimitInit(c, previous *Configuration) {
+	if previous != nil && reflect.DeepEqual(previous.rateLimitHits, c.rateLimitHits) &&
+		reflect.DeepEqual(previous.rateLimitMisses, c.rateLimitMisses) && previous.rateLimitRedis == c.rateLimitRedis {
+		c.hitRateLimiter, c.missRateLimiter = previous.hitRateLimiter, previous.missRateLimiter
+		return
+	}
+	c.hitRateLimiter = newRateLimiter("hits", c.rateLimitHits, c.rateLimitRedis)
+	c.missRateLimiter = newRateLimiter("misses", c.rateLimitMisses, c.rateLimitRedis)
+}
+
+func newRateLimiter(name string, limit *RateLimit, shared bool) rateLimiter {
+	if limit == nil {
+		return nil
+	}
+	if shared {
+		return &redisRateLimiter{"ratelimit:" + name + ":", *limit, newMemoryRateLimiter(*limit)}
+	}
+	return newMemoryRateLimiter(*limit)
+}
+
+// rateLimitKey identifies the client making a request by its API key or IP,
+// keys which weren't added don't count as clients would get a new bucket
+// with every made up key otherwise
+func rateLimitKey(params martini.Params, req *http.Request) string {
+	if key := requestKey(params, req); isKnownKey(key) {
+		return "key:" + key
+	}
+	return "ip:" + clientIP(req).String()
+}
+
+// rateLimited takes a token from a limiter, when there is none it sets the
+// Retry-After header and reports that the request should be rejected
+func rateLimited(limiter rateLimiter, key string, res http.ResponseWriter) bool {
+	if limiter == nil {
+		return false
+	}
+	ok, retryAfter := limiter.take(key, time.Now())
+	if ok {
+		return false
+	}
+	res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return true
+}
+
+// Returns how long it takes to refill a bucket with tokens tokens.
+func (l RateLimit) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens * float64(time.Minute) / float64(l.rate))
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// memoryRateLimiter keeps buckets in memory, limits are per instance
+type memoryRateLimiter struct {
+	sync.Mutex
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newMemoryRateLimiter(limit RateLimit) *memoryRateLimiter {
+	return &memoryRateLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *memoryRateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimitMaxBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{float64(l.limit.burst), now}
+		l.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.updated)
+	bucket.tokens = math.Min(float64(l.limit.burst), bucket.tokens+elapsed.Minutes()*float64(l.limit.rate))
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, l.limit.refillTime(1 - bucket.tokens)
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Removes buckets which would be full by now, they are the same as new ones.
+func (l *memoryRateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= l.limit.refillTime(float64(l.limit.burst)-bucket.tokens) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Refills a bucket stored in a hash and takes a token from it atomically.
+// Returns 1 and 0 if a token was taken, 0 and the milliseconds until the
+// next token otherwise.
+var takeTokenScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1]) / 60000
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate))
+return {allowed, wait}
+`)
+
+// redisRateLimiter keeps buckets in redis so that limits are shared by all
+// instances
+type redisRateLimiter struct {
+	prefix string
+	limit  RateLimit
+	local  *memoryRateLimiter // Limits per instance while redis is unavailable
+}
+
+func (l *redisRateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	if !redisAvailable() {
+		return l.local.take(key, now)
+	}
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	values, err := redis.Int64s(takeTokenScript.Do(Conn, l.prefix+key, l.limit.rate, l.limit.burst, nowMillis))
+	if err != nil || len(values) != 2 {
+		// Don't turn a redis problem into an outage
+		return true, 0
+	}
+	return values[0] == 1, time.Duration(values[1]) * time.Millisecond
+}
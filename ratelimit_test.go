@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	l := newMemoryRateLimiter(RateLimit{rate: 60, burst: 2})
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("a", now); !ok {
+			t.Errorf("Expected request %d to be allowed", i+1)
+		}
+	}
+	ok, retryAfter := l.take("a", now)
+	if ok || retryAfter != time.Second {
+		t.Errorf("Expected the request to be limited for a second, got: %v, %v", ok, retryAfter)
+	}
+	if ok, _ := l.take("b", now); !ok {
+		t.Error("Expected another client not to be limited")
+	}
+
+	// One token per second
+	if ok, _ := l.take("a", now.Add(time.Second)); !ok {
+		t.Error("Expected the bucket to be refilled")
+	}
+}
+
+func TestRateLimitInit(t *testing.T) {
+	previous := &Configuration{rateLimitHits: &RateLimit{60, 10}}
+	rateLimitInit(previous, nil)
+	if previous.hitRateLimiter == nil || previous.missRateLimiter != nil {
+		t.Fatalf("Expected only hits to be limited")
+	}
+
+	// Unchanged limits keep their buckets
+	c := &Configuration{rateLimitHits: &RateLimit{60, 10}}
+	rateLimitInit(c, previous)
+	if c.hitRateLimiter != previous.hitRateLimiter {
+		t.Error("Expected the previous limiter to be kept")
+	}
+	c = &Configuration{rateLimitHits: &RateLimit{120, 10}}
+	rateLimitInit(c, previous)
+	if c.hitRateLimiter == previous.hitRateLimiter {
+		t.Error("Expected a new limiter for new limits")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	oldPermissions := permissionsByKey
+	defer func() { permissionsByKey = oldPermissions }()
+	permissionsByKey = map[string]map[string]bool{"": {ReadPermission: true}, "KEY": {ReadPermission: true}}
+
+	req := httptest.NewRequest("GET", "/image/t_thumb/cat.jpg", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	for key, expected := range map[string]string{"KEY": "key:KEY", "MADEUP": "ip:192.0.2.1", "": "ip:192.0.2.1"} {
+		if got := rateLimitKey(martini.Params{"apikey": key}, req); got != expected {
+			t.Errorf("Expected %s for %q, got: %s", expected, key, got)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Parameters asking for an original image as it is stored, t_raw only does
+// when there is no named transformation called raw
+const (
+	originalParameters = "original"
+	rawParameters      = "t_raw"
+)
+
+// isOriginalRequest reports whether parameters ask for an original image as
+// it is stored
+func isOriginalRequest(conf *Configuration, parametersStr string) bool {
+	if parametersStr == rawParameters {
+		_, named := conf.transformations[strings.TrimPrefix(rawParameters, "t_")]
+		return !named
+	}
+	return parametersStr == originalParameters
+}
+
+// originalURL returns the public URL of an original image when one is
+// configured for the storage backend in use
+func originalURL(imagePath string) (string, bool) {
+	baseURL, ok := currentConfig().originalURLs[storageName]
+	if !ok || baseURL == "" {
+		return "", false
+	}
+	segments := strings.Split(imagePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.Join(segments, "/"), true
+}
+
+// redirectToOriginal answers a request with a redirect to the public URL of
+// the original image, it reports false when there is none
+func redirectToOriginal(res http.ResponseWriter, imagePath string) (int, string, bool) {
+	location, ok := originalURL(imagePath)
+	if !ok {
+		return 0, "", false
+	}
+	res.Header().Set("Location", location)
+	return http.StatusFound, "", true
+}
+
+// serveOriginal answers a request with the original image as it is stored,
+// by redirecting to its public URL or streaming it from the storage when
+// originals are served. It reports false when they are neither.
+func serveOriginal(res http.ResponseWriter, req *http.Request, imagePath string) (int, string, bool) {
+	if status, body, redirected := redirectToOriginal(res, imagePath); redirected {
+		return status, body, true
+	}
+	if !currentConfig().serveOriginals {
+		return 0, "", false
+	}
+	status, body := streamOriginal(res, req, imagePath)
+	return status, body, true
+}
+
+// streamOriginal copies an original image from the storage to the response
+// without decoding it, with the caching headers of images and support for
+// conditional and range requests
+func streamOriginal(res http.ResponseWriter, req *http.Request, imagePath string) (int, string) {
+	return streamStoredOriginal(res, req, imagePath, cacheControlFor(&Transformation{}, imagePath))
+}
+
+// streamStoredOriginal is streamOriginal with the given Cache-Control header,
+// none when it's ""
+func streamStoredOriginal(res http.ResponseWriter, req *http.Request, imagePath, cacheControl string) (int, string) {
+	if isKnownMissing(imagePath) {
+		return http.StatusNotFound, "Image not found: " + imagePath
+	}
+	// The version is needed for the headers, remembered metadata could be
+	// of an original replaced since
+	info, err := storageImpl.Stat(imagePath)
+	if err == ErrNotFound {
+		rememberMissing(imagePath)
+		return http.StatusNotFound, "Image not found: " + imagePath
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	reader, err := storageImpl.Get(imagePath)
+	if err != nil {
+		return iiifErrorStatus(err), err.Error()
+	}
+	defer reader.Close()
+
+	buffered := bufio.NewReader(reader)
+	header, _ := buffered.Peek(16)
+	format := originalFormat(header, imagePath)
+	if format == "" {
+		return http.StatusUnprocessableEntity, "not an image"
+	}
+	if cacheControl != "" {
+		res.Header().Set("Cache-Control", cacheControl)
+	}
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	requestLogFor(req).imagePath = imagePath
+
+	etag := "\"" + strings.Trim(fileVersion(info), "\"") + "\""
+	original := &cachedImage{struct {
+		io.Reader
+		io.Closer
+	}{buffered, reader}, format, etag, int(info.Size)}
+	return streamImage(res, req, original, info.ModTime)
+}
+
+// originalFormat returns the format an original is served as, going by its
+// first bytes or its extension for formats which can't be processed. "" is
+// returned for files which aren't images or videos and for SVG images, which
+// can carry scripts.
+func originalFormat(header []byte, imagePath string) string {
+	if format := sniffImageFormat(header); format != "" {
+		return format
+	}
+	contentType, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(path.Ext(imagePath))))
+	mediaType, format, _ := strings.Cut(contentType, "/")
+	if (mediaType != "image" && mediaType != "video") || format == "svg+xml" {
+		return ""
+	}
+	if mediaType == "video" && format != videoFormatMP4 && format != videoFormatWebM {
+		return ""
+	}
+	return format
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedirectToOriginal(t *testing.T) {
+	oldConfig, oldStorageName := currentConfig(), storageName
+	defer func() { setConfig(oldConfig); storageName = oldStorageName }()
+	setConfig(&Configuration{originalURLs: map[string]string{"s3": "https://bucket.s3.amazonaws.com/"}})
+
+	storageName = "local"
+	if _, _, redirected := redirectToOriginal(httptest.NewRecorder(), "cat.heic"); redirected {
+		t.Error("Expected no redirect without a URL for the storage backend")
+	}
+
+	storageName = "s3"
+	res := httptest.NewRecorder()
+	status, _, redirected := redirectToOriginal(res, "photos/black cat.heic")
+	if !redirected || status != http.StatusFound {
+		t.Fatalf("Expected a redirect, got: %d", status)
+	}
+	if location := res.Header().Get("Location"); location != "https://bucket.s3.amazonaws.com/photos/black%20cat.heic" {
+		t.Errorf("Unexpected location: %s", location)
+	}
+}
+
+func TestIsOriginalRequest(t *testing.T) {
+	conf := &Configuration{transformations: map[string]Transformation{}}
+	if !isOriginalRequest(conf, "original") || !isOriginalRequest(conf, "t_raw") || isOriginalRequest(conf, "w_100") {
+		t.Error("Expected original and t_raw to ask for originals")
+	}
+	conf.transformations["raw"] = Transformation{}
+	if isOriginalRequest(conf, "t_raw") {
+		t.Error("Expected a named transformation called raw to take precedence")
+	}
+}
+
+func TestOriginalFormat(t *testing.T) {
+	cases := map[string]string{
+		"cat.jpg":  "jpeg",
+		"cat.webp": "webp",
+		"cat.svg":  "",
+		"cat.html": "",
+		"cat":      "",
+	}
+	for imagePath, expected := range cases {
+		if format := originalFormat([]byte("<html>"), imagePath); format != expected {
+			t.Errorf("%s: expected %q, actual: %q", imagePath, expected, format)
+		}
+	}
+	if format := originalFormat([]byte("\x89PNG\r\n\x1a\n"), "cat.jpg"); format != "png" {
+		t.Errorf("Expected the content to take precedence, got: %q", format)
+	}
+}
+
+func TestStreamOriginal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("\x89PNG\r\n\x1a\noriginal")
+	if err := ioutil.WriteFile(filepath.Join(dir, "cat.png"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig, oldStorage := currentConfig(), storageImpl
+	defer func() { setConfig(oldConfig); storageImpl = oldStorage }()
+	setConfig(&Configuration{})
+	storageImpl = &localStorage{dir}
+
+	req := httptest.NewRequest("GET", "/image/t_raw/cat.png", nil)
+	if _, _, served := serveOriginal(httptest.NewRecorder(), req, "cat.png"); served {
+		t.Error("Expected originals not to be served by default")
+	}
+
+	currentConfig().serveOriginals = true
+	res := httptest.NewRecorder()
+	if status, _, served := serveOriginal(res, req, "cat.png"); !served || status != 0 {
+		t.Fatalf("Expected the original to be streamed, got: %d", status)
+	}
+	if res.Code != http.StatusOK || res.Body.String() != string(data) || res.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Unexpected response: %d %q %v", res.Code, res.Body.String(), res.Header())
+	}
+	etag := res.Header().Get("ETag")
+	if etag == "" || res.Header().Get("Last-Modified") == "" {
+		t.Errorf("Expected caching headers: %v", res.Header())
+	}
+
+	res = httptest.NewRecorder()
+	req.Header.Set("Range", "bytes=8-")
+	streamOriginal(res, req, "cat.png")
+	if res.Code != http.StatusPartialContent || res.Body.String() != "original" {
+		t.Errorf("Expected the range, got: %d %q", res.Code, res.Body.String())
+	}
+
+	req.Header.Set("If-None-Match", etag)
+	if status, _ := streamOriginal(httptest.NewRecorder(), req, "cat.png"); status != http.StatusNotModified {
+		t.Errorf("Expected 304 Not Modified, got: %d", status)
+	}
+	if status, _ := streamOriginal(httptest.NewRecorder(), req, "dog.png"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 Not Found, got: %d", status)
+	}
+}
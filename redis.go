@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
+	"log/slog"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/soveran/redisurl"
@@ -12,28 +16,203 @@ const (
 	redisPortEnvVar  = "PIXLSERV_REDIS_PORT"
 	redisURLEnvVar   = "PIXLSERV_REDIS_URL"
 	redisDefaultPort = 6379
+
+	redisResubscribeDelay = 5 * time.Second
+	redisReconnectDelay   = 2 * time.Second
 )
 
 var (
 	// Conn is a global redis connection object
 	Conn redis.Conn
+
+	// Returned by Conn while redis can't be reached
+	errRedisUnavailable = errors.New("redis unavailable")
+
+	// Called once redis can be reached again after it couldn't
+	redisReconnectHooks []func()
 )
 
 func redisInit() error {
+	conn, err := redisDial()
+	if err != nil {
+		return err
+	}
+	Conn = &reconnectingConn{conn: conn, dial: redisDial}
+	return nil
+}
+
+// onRedisReconnect calls fn whenever redis can be reached again, e.g. to
+// reload what changed in the meantime
+func onRedisReconnect(fn func()) {
+	redisReconnectHooks = append(redisReconnectHooks, fn)
+}
+
+// redisAvailable reports whether redis can be reached, the server runs in
+// degraded mode when it can't
+func redisAvailable() bool {
+	if c, ok := Conn.(*reconnectingConn); ok {
+		return c.available()
+	}
+	return true
+}
+
+// reconnectingConn is a redis connection which fails straight away while
+// redis can't be reached and reconnects in the background, redigo
+// connections can't be used again after network errors
+type reconnectingConn struct {
+	sync.Mutex
+	conn redis.Conn // nil while redis is unavailable
+	dial func() (redis.Conn, error)
+}
+
+func (c *reconnectingConn) current() (redis.Conn, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		return nil, errRedisUnavailable
+	}
+	return c.conn, nil
+}
+
+func (c *reconnectingConn) available() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.conn != nil
+}
+
+// check drops a connection which broke and starts reconnecting, other
+// errors (e.g. wrong types) leave connections usable
+func (c *reconnectingConn) check(conn redis.Conn) {
+	err := conn.Err()
+	if err == nil {
+		return
+	}
+	c.Lock()
+	if c.conn != conn {
+		c.Unlock()
+		return
+	}
+	c.conn = nil
+	c.Unlock()
+	conn.Close()
+	slog.Warn("redis unavailable, running in degraded mode", "error", err)
+	go c.reconnect()
+}
+
+func (c *reconnectingConn) reconnect() {
+	for {
+		time.Sleep(redisReconnectDelay)
+		conn, err := c.dial()
+		if err != nil {
+			continue
+		}
+		c.Lock()
+		c.conn = conn
+		c.Unlock()
+		slog.Info("redis available again")
+		for _, fn := range redisReconnectHooks {
+			go fn()
+		}
+		return
+	}
+}
+
+func (c *reconnectingConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	conn, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.Do(commandName, args...)
+	c.check(conn)
+	return reply, err
+}
+
+func (c *reconnectingConn) Send(commandName string, args ...interface{}) error {
+	conn, err := c.current()
+	if err != nil {
+		return err
+	}
+	err = conn.Send(commandName, args...)
+	c.check(conn)
+	return err
+}
+
+func (c *reconnectingConn) Flush() error {
+	conn, err := c.current()
+	if err != nil {
+		return err
+	}
+	err = conn.Flush()
+	c.check(conn)
+	return err
+}
+
+func (c *reconnectingConn) Receive() (interface{}, error) {
+	conn, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.Receive()
+	c.check(conn)
+	return reply, err
+}
+
+func (c *reconnectingConn) Err() error {
+	conn, err := c.current()
+	if err != nil {
+		return err
+	}
+	return conn.Err()
+}
+
+func (c *reconnectingConn) Close() error {
+	conn, err := c.current()
+	if err != nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// redisDial opens a new connection to redis
+func redisDial() (redis.Conn, error) {
 	url := os.Getenv(redisURLEnvVar)
-	var err error
 	if url != "" {
-		Conn, err = redisurl.ConnectToURL(url)
-	} else {
-		port, errLocal := strconv.Atoi(os.Getenv(redisPortEnvVar))
-		if errLocal != nil {
-			port = redisDefaultPort
+		return redisurl.ConnectToURL(url)
+	}
+
+	port, err := strconv.Atoi(os.Getenv(redisPortEnvVar))
+	if err != nil {
+		port = redisDefaultPort
+	}
+	return redis.Dial("tcp", ":"+strconv.Itoa(port))
+}
+
+// redisSubscribe calls handler for every message published to the given
+// channel. It uses its own connection and reconnects when it is lost.
+func redisSubscribe(channel string, handler func(data string)) {
+	for {
+		conn, err := redisDial()
+		if err != nil {
+			slog.Error("subscribing to a redis channel failed", "channel", channel, "error", err)
+			time.Sleep(redisResubscribeDelay)
+			continue
 		}
 
-		Conn, errLocal = redis.Dial("tcp", ":"+strconv.Itoa(port))
-		err = errLocal
+		psc := redis.PubSubConn{Conn: conn}
+		err = psc.Subscribe(channel)
+		for err == nil {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				handler(string(v.Data))
+			case error:
+				err = v
+			}
+		}
+		psc.Close()
+
+		slog.Warn("redis subscription lost", "channel", channel, "error", err)
+		time.Sleep(redisResubscribeDelay)
 	}
-	return err
 }
 
 func redisCleanUp() {
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+)
+
+var (
+	// Path of the configuration file the server was started with
+	configFilePath string
+
+	// Only one reload at a time
+	reloadLock sync.Mutex
+)
+
+// ConfigReloadResponse is a struct to represent a JSON response for the config reload handler
+type ConfigReloadResponse struct {
+	Status       string `json:"status"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// reloadConfig reads the configuration file again and switches to it when
+// it is valid. Storage, the listener and middleware set up at startup
+// (throttling, CORS, metrics, debug endpoints, access log, tracing, TLS) and
+// the size of the memory cache keep their settings until a restart.
+func reloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	c, err := loadConfig(configFilePath)
+	if err != nil {
+		return err
+	}
+	previous := currentConfig()
+	// Cached images stay where they are
+	c.storage, c.localPath = previous.storage, previous.localPath
+
+	// Requests are served with the previous configuration until everything
+	// depending on the new one is ready, it's dropped when anything fails
+	handler, err := newLogHandler(c)
+	if err != nil {
+		return err
+	}
+	err = prepareConfig(c, previous)
+	if err != nil {
+		return err
+	}
+	permissions, err := readPermissions(c)
+	if err != nil {
+		return err
+	}
+
+	setConfig(c)
+	slog.SetDefault(slog.New(handler))
+	setPermissions(permissions)
+	upscalerInit()
+	binding.MaxMemory = int64(c.uploadMemoryLimit)
+	return nil
+}
+
+// prepareConfig builds what a configuration needs before it's used, the
+// rate limiters of the previous one (nil for none) are kept when they can be
+func prepareConfig(c, previous *Configuration) error {
+	err := jwtInit(c)
+	if err != nil {
+		return err
+	}
+	err = checkURLSigning(c)
+	if err != nil {
+		return err
+	}
+	err = checkDownloads(c)
+	if err != nil {
+		return err
+	}
+	err = cdnInit(c)
+	if err != nil {
+		return err
+	}
+	rateLimitInit(c, previous)
+	return nil
+}
+
+// reloadOnHangup reloads the configuration whenever the process gets SIGHUP
+func reloadOnHangup() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := reloadConfig()
+		if err != nil {
+			slog.Error("reloading the configuration failed", "error", err)
+			continue
+		}
+		slog.Info("configuration reloaded", "path", configFilePath)
+	}
+}
+
+func configReloadHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return http.StatusUnauthorized, ""
+	}
+
+	err := reloadConfig()
+	if err != nil {
+		slog.Error("reloading the configuration failed", "error", err)
+		return jsonResponse(res, http.StatusUnprocessableEntity, ConfigReloadResponse{"error", err.Error()})
+	}
+	slog.Info("configuration reloaded", "path", configFilePath)
+	return jsonResponse(res, http.StatusOK, ConfigReloadResponse{"ok", ""})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// saveDataRequested reports whether a client asks for less data to be
+// used with a Save-Data: on header
+func saveDataRequested(req *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(req.Header.Get("Save-Data")), "on")
+}
+
+// applySaveData returns the transformation to use for a request, clients
+// asking to save data get lower quality images without scaling and within
+// the configured dimensions
+func applySaveData(req *http.Request, res http.ResponseWriter, transformation Transformation) Transformation {
+	if !currentConfig().saveData {
+		return transformation
+	}
+
+	// Responses differ depending on the header
+	addVary(res, "Save-Data")
+	if !saveDataRequested(req) {
+		return transformation
+	}
+
+	params := *transformation.params
+	params.Scale = 1
+	params.Width, params.Height = capDimension(params.Width, params.Height, currentConfig().saveDataMaxWidth)
+	params.Height, params.Width = capDimension(params.Height, params.Width, currentConfig().saveDataMaxHeight)
+	transformation.params = &params
+	transformation.quality = currentConfig().saveDataQuality
+	return transformation
+}
+
+// capDimension limits a dimension to max and scales the other one along when
+// it is set
+func capDimension(dimension, other, max int) (int, int) {
+	if max <= 0 || dimension <= max {
+		return dimension, other
+	}
+	return max, (other*max + dimension/2) / dimension
+}
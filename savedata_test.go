@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestApplySaveData(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{saveData: true, saveDataQuality: 40, saveDataMaxWidth: 800, jpegQuality: 75})
+
+	params := engine.Params{Width: 1600, Height: 900, Scale: 2, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	transformation := Transformation{params: &params}
+
+	req := httptest.NewRequest("GET", "/image/w_1600,h_900,c_p/cat.jpg", nil)
+	res := httptest.NewRecorder()
+	unchanged := applySaveData(req, res, transformation)
+	if unchanged.params != &params || unchanged.jpegQuality() != 75 {
+		t.Error("Expected the transformation to be left alone without Save-Data")
+	}
+	if res.Header().Get("Vary") != "Save-Data" {
+		t.Errorf("Expected Vary: Save-Data, got: %q", res.Header().Get("Vary"))
+	}
+
+	req.Header.Set("Save-Data", "on")
+	saving := applySaveData(req, httptest.NewRecorder(), transformation)
+	if saving.params.ToString() != "c_p,g_c,h_450,w_800,f_none,s_1" || saving.jpegQuality() != 40 {
+		t.Errorf("Expected a smaller lower quality image, got: %s at %d", saving.params.ToString(), saving.jpegQuality())
+	}
+	if params.Width != 1600 {
+		t.Error("Expected the parameters of the transformation to be left alone")
+	}
+
+	original, _ := transformation.createFilePath("cat.jpg")
+	saved, _ := saving.createFilePath("cat.jpg")
+	params.Width, params.Height, params.Scale = 800, 450, 1
+	sameSize, _ := transformation.createFilePath("cat.jpg")
+	if saved == original || saved == sameSize {
+		t.Error("Expected images with a lower quality to be cached separately")
+	}
+}
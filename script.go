@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"runtime/metrics"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	// Lua function scripts need to define
+	scriptFunction = "transform"
+
+	// Name of the metatable of images passed to scripts
+	scriptImageType = "image"
+
+	// Limits of the Lua stacks, scripts don't need deep recursion
+	scriptCallStackSize   = 128
+	scriptRegistrySize    = 4096
+	scriptRegistryMaxSize = 64 * 1024
+
+	// Longest string string.rep creates
+	scriptMaxStringLength = 16 * 1024 * 1024
+
+	// How often the heap is checked while scripts run
+	scriptMemoryCheckInterval = 10 * time.Millisecond
+)
+
+// Script is a compiled Lua script processing images of a named
+// transformation instead of its parameters
+type Script struct {
+	path  string
+	proto *lua.FunctionProto
+	sum   []byte
+}
+
+// scriptRun is the state of one run of a script
+type scriptRun struct {
+	format         string
+	transformation *Transformation
+	pixelsLeft     int
+}
+
+func loadScript(path string) (*Script, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(source), path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(source)
+	return &Script{path: path, proto: proto, sum: sum[:]}, nil
+}
+
+// hash tells versions of scripts apart in cached images' names
+func (s *Script) hash() []byte {
+	return s.sum
+}
+
+// run calls the script's transform function with the image and a table
+// describing the request, it returns the image the function returns
+func (s *Script) run(img image.Image, format, imagePath string, transformation *Transformation) (image.Image, error) {
+	L := newScriptState()
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(currentConfig().scriptTimeout)*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	var outOfMemory atomic.Bool
+	if maxMemory := currentConfig().scriptMaxMemory; maxMemory > 0 {
+		go guardScriptMemory(ctx, cancel, uint64(maxMemory), &outOfMemory)
+	}
+	fail := func(err error) error {
+		if outOfMemory.Load() {
+			return fmt.Errorf("script %s exceeded the limit of %d bytes of memory", s.path, currentConfig().scriptMaxMemory)
+		}
+		return fmt.Errorf("script %s failed: %s", s.path, err)
+	}
+
+	run := &scriptRun{format: format, transformation: transformation, pixelsLeft: currentConfig().scriptMaxPixels}
+	mt := L.NewTypeMetatable(scriptImageType)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), run.imageMethods()))
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	err := L.PCall(0, lua.MultRet, nil)
+	if err != nil {
+		return nil, fail(err)
+	}
+	fn := L.GetGlobal(scriptFunction)
+	if fn.Type() != lua.LTFunction {
+		return nil, fmt.Errorf("script %s doesn't define a %s function", s.path, scriptFunction)
+	}
+
+	request := L.NewTable()
+	request.RawSetString("path", lua.LString(imagePath))
+	request.RawSetString("parameters", lua.LString(transformation.params.ToString()))
+	request.RawSetString("width", lua.LNumber(transformation.params.Width))
+	request.RawSetString("height", lua.LNumber(transformation.params.Height))
+	request.RawSetString("scale", lua.LNumber(transformation.params.Scale))
+
+	err = L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, wrapImage(L, img), request)
+	if err != nil {
+		return nil, fail(err)
+	}
+	result, ok := L.Get(-1).(*lua.LUserData)
+	if !ok {
+		return nil, fmt.Errorf("script %s didn't return an image", s.path)
+	}
+	imgNew, ok := result.Value.(image.Image)
+	if !ok {
+		return nil, fmt.Errorf("script %s didn't return an image", s.path)
+	}
+	return imgNew, nil
+}
+
+// guardScriptMemory stops a script, by cancelling its context, when the heap
+// grows by more than limit bytes while it runs. Lua doesn't account for the
+// memory of its values and the heap is shared with other requests, so this
+// catches scripts growing strings or tables without bound rather than
+// keeping them to an exact budget.
+func guardScriptMemory(ctx context.Context, cancel context.CancelFunc, limit uint64, outOfMemory *atomic.Bool) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	start := sample[0].Value.Uint64()
+
+	ticker := time.NewTicker(scriptMemoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metrics.Read(sample)
+			if used := sample[0].Value.Uint64(); used > start && used-start > limit {
+				outOfMemory.Store(true)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// scriptStringRep is string.rep refusing to create strings longer than
+// scriptMaxStringLength
+func scriptStringRep(L *lua.LState) int {
+	str, n, sep := L.CheckString(1), L.CheckInt(2), L.OptString(3, "")
+	if n <= 0 {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if n > scriptMaxStringLength || len(str)*n+len(sep)*(n-1) > scriptMaxStringLength {
+		L.RaiseError("string.rep would create a string longer than %d bytes", scriptMaxStringLength)
+	}
+	L.Push(lua.LString(strings.Repeat(str+sep, n-1) + str))
+	return 1
+}
+
+// newScriptState creates a Lua state without access to files, the OS or
+// loading code
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallStackSize,
+		RegistrySize:    scriptRegistrySize,
+		RegistryMaxSize: scriptRegistryMaxSize,
+	})
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetField(L.GetGlobal(lua.StringLibName), "rep", L.NewFunction(scriptStringRep))
+	return L
+}
+
+func (r *scriptRun) imageMethods() map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		"width": func(L *lua.LState) int {
+			L.Push(lua.LNumber(r.checkImage(L).Bounds().Dx()))
+			return 1
+		},
+		"height": func(L *lua.LState) int {
+			L.Push(lua.LNumber(r.checkImage(L).Bounds().Dy()))
+			return 1
+		},
+		"format": func(L *lua.LState) int {
+			r.checkImage(L)
+			L.Push(lua.LString(r.format))
+			return 1
+		},
+		// pixel returns the colour of a pixel as r, g, b, a between 0 and 255
+		"pixel": func(L *lua.LState) int {
+			img := r.checkImage(L)
+			bounds := img.Bounds()
+			red, green, blue, alpha := img.At(bounds.Min.X+L.CheckInt(2), bounds.Min.Y+L.CheckInt(3)).RGBA()
+			for _, value := range []uint32{red, green, blue, alpha} {
+				L.Push(lua.LNumber(value >> 8))
+			}
+			return 4
+		},
+		// apply transforms the image using a parameters string, the
+		// transformation's parameters by default
+		"apply": func(L *lua.LState) int {
+			img := r.checkImage(L)
+			params := *r.transformation.params
+			if parametersStr := L.OptString(2, ""); parametersStr != "" {
+				var err error
+				params, err = parseTrustedParameters(parametersStr, currentConfig())
+				if err != nil {
+					L.RaiseError("invalid parameters: %s", err)
+				}
+				params = params.WithScale(r.transformation.params.Scale)
+			}
+			L.Push(r.newImage(L, engine.Transform(img, params)))
+			return 1
+		},
+		"filter": func(L *lua.LState) int {
+			img := r.checkImage(L)
+			name := L.CheckString(2)
+			if !engine.IsValidFilter(name) {
+				L.ArgError(2, "unknown filter: "+name)
+			}
+			bounds := img.Bounds()
+			params := engine.Params{Width: bounds.Dx(), Height: bounds.Dy(), Scale: 1, Cropping: engine.CroppingModeKeepScale, Gravity: engine.DefaultGravity, Filter: name}
+			L.Push(r.newImage(L, engine.Transform(img, params)))
+			return 1
+		},
+		"crop": func(L *lua.LState) int {
+			img := r.checkImage(L)
+			bounds := img.Bounds()
+			rect := image.Rect(L.CheckInt(2), L.CheckInt(3), L.CheckInt(2)+L.CheckInt(4), L.CheckInt(3)+L.CheckInt(5)).Add(bounds.Min).Intersect(bounds)
+			if rect.Empty() {
+				L.RaiseError("crop outside of the image")
+			}
+			var cropped draw.Image = image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+			if engine.IsHighBitDepth(img) {
+				cropped = image.NewRGBA64(cropped.Bounds())
+			}
+			draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+			L.Push(r.newImage(L, cropped))
+			return 1
+		},
+		"watermark": func(L *lua.LState) int {
+			img := r.checkImage(L)
+			path := L.CheckString(2)
+			gravity := L.OptString(3, engine.GravitySouthEast)
+			if !engine.IsValidGravity(gravity) {
+				L.ArgError(3, "invalid gravity: "+gravity)
+			}
+			scale := r.transformation.params.Scale
+			watermark, err := loadWatermark(path, scale)
+			if err != nil {
+				L.RaiseError("loading a watermark failed: %s", err)
+			}
+			L.Push(r.newImage(L, engine.DrawWatermark(img, watermark, gravity, L.OptInt(4, 0), L.OptInt(5, 0), scale)))
+			return 1
+		},
+	}
+}
+
+// newImage wraps an image for the script, the pixels of all images created
+// during a run count towards the limit
+func (r *scriptRun) newImage(L *lua.LState, img image.Image) *lua.LUserData {
+	r.pixelsLeft -= img.Bounds().Dx() * img.Bounds().Dy()
+	if currentConfig().scriptMaxPixels > 0 && r.pixelsLeft < 0 {
+		L.RaiseError("images created by the script exceed the limit of %d pixels", currentConfig().scriptMaxPixels)
+	}
+	return wrapImage(L, img)
+}
+
+func wrapImage(L *lua.LState, img image.Image) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = img
+	L.SetMetatable(ud, L.GetTypeMetatable(scriptImageType))
+	return ud
+}
+
+func (r *scriptRun) checkImage(L *lua.LState) image.Image {
+	img, ok := L.CheckUserData(1).Value.(image.Image)
+	if !ok {
+		L.ArgError(1, "image expected")
+	}
+	return img
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runTestScript runs a script with the given source on a small image
+func runTestScript(t *testing.T, source string) (image.Image, error) {
+	path := filepath.Join(t.TempDir(), "test.lua")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script, err := loadScript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := parseParameters("w_10,h_10", currentConfig())
+	return script.run(image.NewRGBA(image.Rect(0, 0, 10, 10)), "png", "cat.png", &Transformation{params: &params})
+}
+
+func TestScript(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{scriptTimeout: 1000})
+
+	img, err := runTestScript(t, `
+function transform(img, request)
+	local name = string.rep("a", 3, "-") .. ("b"):rep(2)
+	if name ~= "a-a-abb" or request.width ~= 10 then
+		error("unexpected values")
+	end
+	return img:crop(0, 0, 4, 2)
+end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(4, 2) {
+		t.Errorf("Expected a 4x2 image, got %v", size)
+	}
+
+	if _, err := runTestScript(t, `function transform(img) return "image" end`); err == nil || !strings.Contains(err.Error(), "didn't return an image") {
+		t.Errorf("Expected scripts to return images, got %v", err)
+	}
+}
+
+func TestScriptSandbox(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{scriptTimeout: 1000})
+
+	for _, name := range []string{"io", "os", "load", "loadstring", "loadfile", "dofile", "require", "module", "debug", "package"} {
+		_, err := runTestScript(t, `
+function transform(img)
+	if `+name+` ~= nil then
+		error("available")
+	end
+	return img
+end`)
+		if err != nil {
+			t.Errorf("Expected %s to be unavailable: %s", name, err)
+		}
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+
+	setConfig(&Configuration{scriptTimeout: 50})
+	if _, err := runTestScript(t, `function transform(img) while true do end end`); err == nil {
+		t.Errorf("Expected scripts running too long to be stopped")
+	}
+
+	setConfig(&Configuration{scriptTimeout: 1000, scriptMaxPixels: 250})
+	if _, err := runTestScript(t, `function transform(img) return img:crop(0, 0, 10, 10) end`); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	_, err := runTestScript(t, `
+function transform(img)
+	img:crop(0, 0, 10, 10)
+	img:crop(0, 0, 10, 10)
+	return img:crop(0, 0, 10, 10)
+end`)
+	if err == nil || !strings.Contains(err.Error(), "250 pixels") {
+		t.Errorf("Expected the pixel limit to be exceeded, got %v", err)
+	}
+
+	_, err = runTestScript(t, `function transform(img) local s = string.rep("abc", 100000000) return img end`)
+	if err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("Expected string.rep to be limited, got %v", err)
+	}
+
+	setConfig(&Configuration{scriptTimeout: 10000, scriptMaxMemory: 16 * 1024 * 1024})
+	_, err = runTestScript(t, `
+function transform(img)
+	local t = {}
+	for i = 1, 100000000 do
+		t[i] = "value " .. i
+	end
+	return img
+end`)
+	if err == nil || !strings.Contains(err.Error(), "bytes of memory") {
+		t.Errorf("Expected the memory limit to be exceeded, got %v", err)
+	}
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -21,11 +25,14 @@ import (
 
 	"github.com/PuerkitoBio/throttled"
 	"github.com/PuerkitoBio/throttled/store"
+	"github.com/ReshNesh/pixlserv/engine"
 	"github.com/codegangsta/cli"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/cors"
-	"github.com/tgulacsi/go/temp"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // UploadForm is a form structure to use when an image is POSTed to the server
@@ -35,8 +42,19 @@ type UploadForm struct {
 	Signature   string                `form:"signature" binding:"required"`
 }
 
+const (
+	// Max. size of an upload request apart from the image itself
+	uploadFormOverhead = 64 * 1024
+
+	// Header to skip the negative cache when debugging missing images
+	bypassNegativeCacheHeader = "X-Pixlserv-Bypass-Negative-Cache"
+)
+
 var (
-	uploadURLRe = regexp.MustCompile("/upload$")
+	uploadURLRe = regexp.MustCompile("/upload(s(/[^/]+)?)?$")
+
+	// Images being generated
+	inFlight flightGroup
 )
 
 func init() {
@@ -50,7 +68,9 @@ func main() {
 
 	// Connect to redis
 	err := redisInit()
-	if err != nil {
+	if err != nil && (len(os.Args) < 2 || (os.Args[1] != "config" && os.Args[1] != "version")) {
+		// Validating the configuration reports redis problems itself and
+		// versions don't need it
 		log.Println("Connecting to redis failed", err)
 		return
 	}
@@ -58,20 +78,22 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "pixlserv"
 	app.Usage = "transform and serve images"
-	app.Version = "1.0"
+	app.Version = version
 	app.Commands = []cli.Command{
 		{
 			Name:  "run",
-			Usage: "Runs the server (run [config-file])",
+			Usage: "Runs the server (run [--set section.option=value]... [config-file])",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{Name: "set", Value: &cli.StringSlice{}, Usage: "set an option, overriding the config file and the environment"},
+			},
 			Action: func(c *cli.Context) {
 				// Set up logging for server
 				log.SetPrefix("[pixlserv] ")
 
-				if len(c.Args()) < 1 {
-					log.Println("You need to provide a path to a config file")
-					return
-				}
+				// Without a config file the options come from the
+				// environment and the command line
 				configFilePath := c.Args().First()
+				configFlags = c.StringSlice("set")
 
 				// Initialise configuration
 				err := configInit(configFilePath)
@@ -79,7 +101,14 @@ func main() {
 					log.Println("Configuration reading failed:", err)
 					return
 				}
-				log.Printf("Running with config: %+v", Config)
+
+				// Switch to structured logs
+				err = loggingInit()
+				if err != nil {
+					log.Println("Logging initialisation failed:", err)
+					return
+				}
+				slog.Info("running", "config", fmt.Sprintf("%+v", *currentConfig()))
 
 				// Initialise authentication
 				err = authInit()
@@ -88,6 +117,41 @@ func main() {
 					return
 				}
 
+				// Initialise JWT authentication
+				err = jwtInit(currentConfig())
+				if err != nil {
+					log.Println("JWT initialisation failed:", err)
+					return
+				}
+
+				// Initialise URL signing
+				err = signingInit()
+				if err != nil {
+					log.Println("URL signing initialisation failed:", err)
+					return
+				}
+
+				// Initialise download URLs
+				err = downloadsInit()
+				if err != nil {
+					log.Println("Download URL initialisation failed:", err)
+					return
+				}
+
+				// Initialise Thumbor URLs
+				err = thumborInit()
+				if err != nil {
+					log.Println("Thumbor URL initialisation failed:", err)
+					return
+				}
+
+				// Initialise imgproxy URLs
+				err = imgproxyInit()
+				if err != nil {
+					log.Println("imgproxy URL initialisation failed:", err)
+					return
+				}
+
 				// Initialise storage
 				err = storageInit()
 				if err != nil {
@@ -95,10 +159,78 @@ func main() {
 					return
 				}
 
+				cacheInit()
+				rateLimitInit(currentConfig(), nil)
+				processingInit()
+				upscalerInit()
+
+				// Initialise the processing backend
+				err = processorInit()
+				if err != nil {
+					log.Println("Processing backend initialisation failed:", err)
+					return
+				}
+
+				// Initialise CDN purging
+				err = cdnInit(currentConfig())
+				if err != nil {
+					log.Println("CDN initialisation failed:", err)
+					return
+				}
+
+				// Start pushing variants to edge stores
+				err = edgePushInit()
+				if err != nil {
+					log.Println("Edge push initialisation failed:", err)
+					return
+				}
+
+				// Open the access log
+				err = accessLogInit()
+				if err != nil {
+					log.Println("Opening the access log failed:", err)
+					return
+				}
+
+				// Open the audit log
+				err = auditInit()
+				if err != nil {
+					log.Println("Opening the audit log failed:", err)
+					return
+				}
+
+				// Initialise tracing
+				err = tracingInit()
+				if err != nil {
+					log.Println("Tracing initialisation failed:", err)
+					return
+				}
+
+				// Parts of uploads bigger than this are stored in temporary files
+				binding.MaxMemory = int64(currentConfig().uploadMemoryLimit)
+
 				// Run the server
-				m := martini.Classic()
-				if Config.throttlingRate > 0 {
-					m.Use(throttler(Config.throttlingRate))
+				// Like martini.Classic() without its logger, requests are
+				// logged by logRequests
+				r := martini.NewRouter()
+				m := &martini.ClassicMartini{Martini: martini.New(), Router: r}
+				m.Use(martini.Recovery())
+				m.Use(martini.Static("public"))
+				m.MapTo(r, (*martini.Routes)(nil))
+				m.Action(r.Handle)
+				m.Use(logRequests)
+				m.Use(writeAccessLog)
+				m.Use(ipFilter)
+				m.Use(degradedMode)
+				m.Use(selectTenant)
+				m.Use(traceRequests)
+				m.Use(countRequests)
+				if currentConfig().analytics {
+					m.Use(recordAnalytics)
+				}
+				m.Use(customHeaders)
+				if currentConfig().throttlingRate > 0 {
+					m.Use(throttler(currentConfig().throttlingRate))
 				}
 				m.Use(func(res http.ResponseWriter, req *http.Request) {
 					if uploadURLRe.MatchString(req.URL.Path) {
@@ -106,17 +238,117 @@ func main() {
 						res.Header().Set("Content-Type", "application/json")
 					}
 				})
-				if Config.corsAllowOrigins != nil {
+				if currentConfig().corsAllowOrigins != nil {
 					m.Use(cors.Allow(&cors.Options{
-						AllowOrigins: Config.corsAllowOrigins,
+						AllowAllOrigins: len(currentConfig().corsAllowOrigins) == 1 && currentConfig().corsAllowOrigins[0] == "*",
+						AllowOrigins:    currentConfig().corsAllowOrigins,
+						AllowMethods:    currentConfig().corsAllowMethods,
+						AllowHeaders:    currentConfig().corsAllowHeaders,
+						ExposeHeaders:   currentConfig().corsExposeHeaders,
+						MaxAge:          time.Duration(currentConfig().corsMaxAge) * time.Second,
 					}))
+					// The allowed origin sent back depends on the request
+					m.Use(func(res http.ResponseWriter) {
+						addVary(res, "Origin")
+					})
+					// Preflight requests are answered by the CORS middleware,
+					// they only need a successful status
+					m.Options("/**", func() int {
+						return http.StatusNoContent
+					})
 				}
 				m.Get("/", func() string {
 					return "It works!"
 				})
+				m.Get("/healthz", healthHandler)
+				m.Get("/readyz", readinessHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?version", versionHandler)
 				m.Get("/((?P<apikey>[A-Z0-9]+)/)?image/:parameters/**", transformationHandler)
-				m.Post("/((?P<apikey>[A-Z0-9]+)/)?upload", binding.MultipartForm(UploadForm{}), uploadHandler)
-				go m.Run()
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?upload", audited(auditUpload), limitUploadSize, binding.MultipartForm(UploadForm{}), uploadHandler)
+				m.Options("/((?P<apikey>[A-Z0-9]+)/)?uploads", tusOptionsHandler)
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?uploads", tusCreateHandler)
+				m.Head("/((?P<apikey>[A-Z0-9]+)/)?uploads/:id", tusStatusHandler)
+				m.Patch("/((?P<apikey>[A-Z0-9]+)/)?uploads/:id", tusAppendHandler)
+				m.Delete("/((?P<apikey>[A-Z0-9]+)/)?uploads/:id", audited(auditUploadCancel), tusDeleteHandler)
+				if currentConfig().deduplicateUploads {
+					m.Get("/((?P<apikey>[A-Z0-9]+)/)?uploads/hashes/:hash", uploadHashHandler)
+				}
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?srcset/:parameters/**", srcsetHandler)
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?sprites", spriteSheetHandler)
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?batch", batchHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?collage", collageHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?diff", diffHandler)
+				if currentConfig().placeholders {
+					m.Get("/((?P<apikey>[A-Z0-9]+)/)?placeholder/:size", placeholderHandler)
+				}
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?cache/stats", cacheStatsHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?cache/maintenance", cacheMaintenanceHandler)
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?cache/maintenance", cacheMaintenanceStartHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?usage", usageHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?analytics", analyticsHandler)
+				m.Delete("/((?P<apikey>[A-Z0-9]+)/)?analytics", analyticsResetHandler)
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?cache/purge", audited(auditPurgeJob), purgeJobStartHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?cache/purge/:id", purgeJobStatusHandler)
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?cache/warm", warmJobStartHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?cache/warm/:id", warmJobStatusHandler)
+				m.Delete("/((?P<apikey>[A-Z0-9]+)/)?cache/**", audited(auditPurge), cachePurgeHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?history/**", historyHandler)
+				if currentConfig().metrics {
+					m.Get("/metrics", promhttp.Handler().ServeHTTP)
+				}
+				if cachePeersEnabled() {
+					m.Get(cachePeerPath+"**", peerCacheHandler)
+				}
+				if currentConfig().debugEndpoints {
+					debugRoutes(m)
+				}
+				if currentConfig().dashboard {
+					m.Get("/((?P<apikey>[A-Z0-9]+)/)?dashboard", dashboardHandler)
+				}
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?config/reload", configReloadHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?keys", keysListHandler)
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?keys", audited(auditKeyCreate), keyCreateHandler)
+				m.Put("/((?P<apikey>[A-Z0-9]+)/)?keys/:key", audited(auditKeyUpdate), keyUpdateHandler)
+				m.Delete("/((?P<apikey>[A-Z0-9]+)/)?keys/:key", audited(auditKeyRemove), keyRemoveHandler)
+				if currentConfig().iiif {
+					m.Get("/((?P<apikey>[A-Z0-9]+)/)?iiif/**", iiifHandler)
+				}
+				if currentConfig().dzi {
+					m.Get("/((?P<apikey>[A-Z0-9]+)/)?dzi/**", dziHandler)
+				}
+				if currentConfig().downloads {
+					m.Post("/((?P<apikey>[A-Z0-9]+)/)?downloads", audited(auditDownloadURL), downloadCreateHandler)
+					m.Get(downloadPath+"**", downloadHandler)
+				}
+				if len(currentConfig().socialCards) > 0 {
+					m.Get("/((?P<apikey>[A-Z0-9]+)/)?cards/:template", socialCardHandler)
+				}
+				if currentConfig().thumbor {
+					// Signatures are 28 characters of URL-safe base64
+					m.Get("/(?P<signature>unsafe|[A-Za-z0-9_=-]{28})/**", thumborHandler)
+				}
+				if currentConfig().imgproxy {
+					m.Get(fmt.Sprintf("/(?P<signature>insecure|_|[A-Za-z0-9_-]{%d})/**", imgproxySignatureLength(currentConfig().imgproxySignatureSize)), imgproxyHandler)
+				}
+				go func() {
+					err := serve(m)
+					slog.Error("serving failed", "error", err)
+					os.Exit(1)
+				}()
+				if currentConfig().adminAddress != "" {
+					go func() {
+						err := serveAdmin(m)
+						slog.Error("serving management requests failed", "address", currentConfig().adminAddress, "error", err)
+						os.Exit(1)
+					}()
+				}
+				err = grpcInit()
+				if err != nil {
+					log.Println("gRPC initialisation failed:", err)
+					return
+				}
+				go reloadOnHangup()
+				go cacheMaintenanceLoop()
 
 				// Wait for when the program is terminated
 				ch := make(chan os.Signal)
@@ -124,8 +356,298 @@ func main() {
 				<-ch
 
 				// Clean up
+				grpcCleanUp()
 				redisCleanUp()
 				storageCleanUp()
+				processorCleanUp()
+				tracingCleanUp()
+				accessLogCleanUp()
+				auditCleanUp()
+			},
+		},
+		{
+			Name:  "transform",
+			Usage: "Transforms images without running the server (transform [config-file] [parameters] [file-or-glob]...)",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "prefix", Usage: "transform original images in the storage starting with this prefix and cache the results instead of files"},
+				cli.StringFlag{Name: "output", Usage: "directory for transformed files (next to the originals by default)"},
+				cli.StringFlag{Name: "golden", Usage: "compare transformed files with the golden images in this directory instead of saving them"},
+				cli.BoolFlag{Name: "update-golden", Usage: "write the golden images with --golden"},
+				cli.IntFlag{Name: "concurrency", Value: runtime.NumCPU(), Usage: "number of images transformed at the same time"},
+				cli.StringSliceFlag{Name: "set", Value: &cli.StringSlice{}, Usage: "set an option, overriding the config file and the environment"},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) < 2 {
+					log.Println("You need to provide a path to a config file and parameters")
+					return
+				}
+				configFlags = c.StringSlice("set")
+				err := configInit(c.Args().First())
+				if err != nil {
+					log.Println("Configuration reading failed:", err)
+					return
+				}
+				parametersStr := c.Args()[1]
+				err = processorInit()
+				if err != nil {
+					log.Println("Processing backend initialisation failed:", err)
+					return
+				}
+				defer processorCleanUp()
+				upscalerInit()
+
+				var paths []string
+				var transform func(string) error
+				if prefix := c.String("prefix"); prefix != "" {
+					err = storageInit()
+					if err != nil {
+						log.Println("Storage initialisation failed:", err)
+						return
+					}
+					defer storageCleanUp()
+					cacheInit()
+					paths, err = storageOriginals(prefix)
+					transform = func(path string) error {
+						return transformStored(path, parametersStr)
+					}
+				} else {
+					if len(c.Args()) < 3 {
+						log.Println("You need to provide files to transform or a storage prefix")
+						return
+					}
+					paths, err = expandGlobs(c.Args()[2:])
+					outputDir := c.String("output")
+					transform = func(path string) error {
+						return transformFile(path, parametersStr, outputDir)
+					}
+					if goldenDir := c.String("golden"); goldenDir != "" {
+						update := c.Bool("update-golden")
+						transform = func(path string) error {
+							return transformGolden(path, parametersStr, goldenDir, update)
+						}
+					}
+				}
+				if err != nil {
+					log.Println("Finding images failed:", err)
+					return
+				}
+
+				start := time.Now()
+				failed := runBatch(paths, c.Int("concurrency"), transform, func(done int, path string, err error) {
+					if err != nil {
+						log.Printf("[%d/%d] %s failed: %s", done, len(paths), path, err)
+						return
+					}
+					log.Printf("[%d/%d] %s", done, len(paths), path)
+				})
+				log.Printf("Transformed %d of %d images in %s", len(paths)-failed, len(paths), time.Since(start))
+				if failed > 0 {
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "warm",
+			Usage: "Pre-generates the variants of images for named transformations and caches them (warm [config-file] [image-path]...)",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "prefix", Usage: "warm up the original images in the storage starting with this prefix"},
+				cli.StringFlag{Name: "transformations", Usage: "comma separated names of transformations (all named transformations by default)"},
+				cli.StringFlag{Name: "tenant", Usage: "warm up images of this tenant using its transformations"},
+				cli.IntFlag{Name: "concurrency", Value: runtime.NumCPU(), Usage: "number of images transformed at the same time"},
+				cli.StringSliceFlag{Name: "set", Value: &cli.StringSlice{}, Usage: "set an option, overriding the config file and the environment"},
+			},
+			Action: func(c *cli.Context) {
+				configFlags = c.StringSlice("set")
+				err := configInit(c.Args().First())
+				if err != nil {
+					log.Println("Configuration reading failed:", err)
+					return
+				}
+
+				var tenant *Tenant
+				if name := c.String("tenant"); name != "" {
+					for _, t := range currentConfig().tenants {
+						if t.name == name {
+							tenant = t
+						}
+					}
+					if tenant == nil {
+						log.Println("Unknown tenant:", name)
+						return
+					}
+				}
+				var names []string
+				if c.String("transformations") != "" {
+					names = strings.Split(c.String("transformations"), ",")
+				}
+				transformations, err := warmTransformations(tenant.config(), names)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+
+				err = processorInit()
+				if err != nil {
+					log.Println("Processing backend initialisation failed:", err)
+					return
+				}
+				defer processorCleanUp()
+				upscalerInit()
+				err = storageInit()
+				if err != nil {
+					log.Println("Storage initialisation failed:", err)
+					return
+				}
+				defer storageCleanUp()
+				cacheInit()
+
+				var paths []string
+				if prefix := c.String("prefix"); prefix != "" {
+					if tenant != nil {
+						prefix = tenant.prefix + prefix
+					}
+					paths, err = storageOriginals(prefix)
+					if err != nil {
+						log.Println("Finding images failed:", err)
+						return
+					}
+				} else {
+					if len(c.Args()) < 2 {
+						log.Println("You need to provide image paths or a storage prefix")
+						return
+					}
+					for _, imagePath := range c.Args()[1:] {
+						storagePath, err := tenant.storagePath(imagePath)
+						if err != nil {
+							log.Println(imagePath, err)
+							return
+						}
+						paths = append(paths, storagePath)
+					}
+				}
+
+				start := time.Now()
+				failed := runBatch(paths, c.Int("concurrency"), func(path string) error {
+					return warmImage(tenant.config(), path, transformations)
+				}, func(done int, path string, err error) {
+					if err != nil {
+						log.Printf("[%d/%d] %s failed: %s", done, len(paths), path, err)
+						return
+					}
+					log.Printf("[%d/%d] %s", done, len(paths), path)
+				})
+				log.Printf("Warmed up %d of %d images for %s in %s", len(paths)-failed, len(paths), strings.Join(transformations, ", "), time.Since(start))
+				if failed > 0 {
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Manages the configuration",
+			Subcommands: []cli.Command{
+				{
+					Name:  "validate",
+					Usage: "Checks a configuration and the connections to the storage and redis without running the server (validate [--set section.option=value]... [config-file])",
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{Name: "set", Value: &cli.StringSlice{}, Usage: "set an option, overriding the config file and the environment"},
+					},
+					Action: func(c *cli.Context) {
+						configFlags = c.StringSlice("set")
+						problems := validateConfig(c.Args().First())
+						if len(problems) == 0 {
+							// Connections are only checked with a valid configuration
+							err := configInit(c.Args().First())
+							if err != nil {
+								problems = append(problems, err.Error())
+							} else {
+								problems = connectionProblems()
+							}
+						}
+						if len(problems) > 0 {
+							for _, problem := range problems {
+								log.Println(problem)
+							}
+							log.Printf("Found %d problem(s) in the configuration", len(problems))
+							os.Exit(1)
+						}
+						log.Println("The configuration is valid")
+					},
+				},
+			},
+		},
+		{
+			Name:  "version",
+			Usage: "Prints the version (version [--features] [config-file])",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "features", Usage: "list the compiled in subsystems and, with a configuration, the features it turns on"},
+			},
+			Action: func(c *cli.Context) {
+				if !c.Bool("features") {
+					fmt.Println("pixlserv", version)
+					return
+				}
+				var conf *Configuration
+				if configFilePath := c.Args().First(); configFilePath != "" {
+					err := configInit(configFilePath)
+					if err != nil {
+						log.Println("Configuration reading failed:", err)
+						os.Exit(1)
+					}
+					conf = currentConfig()
+				}
+				printFeatures(os.Stdout, conf)
+			},
+		},
+		{
+			Name:  "sign",
+			Usage: "Signs an image URL using " + urlSigningSecretEnvVar + " (sign [parameters] [image-path] [expires-in-seconds])",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) < 2 {
+					log.Println("You need to provide parameters and an image path")
+					return
+				}
+				secret := os.Getenv(urlSigningSecretEnvVar)
+				if secret == "" {
+					log.Println(urlSigningSecretEnvVar, "not set")
+					return
+				}
+				var expires int64
+				if len(c.Args()) > 2 {
+					seconds, err := strconv.Atoi(c.Args()[2])
+					if err != nil || seconds <= 0 {
+						log.Println("Expiry needs to be a positive number of seconds")
+						return
+					}
+					expires = time.Now().Unix() + int64(seconds)
+				}
+				imagePath := c.Args()[1]
+				log.Printf("/image/%s/%s", signURL(c.Args().First(), imagePath, secret, expires), imagePath)
+			},
+		},
+		{
+			Name:  "sign-download",
+			Usage: "Creates a download URL of an original using " + downloadSigningSecretEnvVar + " (sign-download [image-path] [expires-in-seconds] [filename])",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) < 2 {
+					log.Println("You need to provide an image path and an expiry")
+					return
+				}
+				secret := os.Getenv(downloadSigningSecretEnvVar)
+				if secret == "" {
+					log.Println(downloadSigningSecretEnvVar, "not set")
+					return
+				}
+				seconds, err := strconv.Atoi(c.Args()[1])
+				if err != nil || seconds <= 0 {
+					log.Println("Expiry needs to be a positive number of seconds")
+					return
+				}
+				filename := ""
+				if len(c.Args()) > 2 {
+					filename = downloadFilename(c.Args()[2], c.Args().First())
+				}
+				log.Println(downloadURL("", c.Args().First(), filename, time.Now().Unix()+int64(seconds), secret))
 			},
 		},
 		{
@@ -134,11 +656,15 @@ func main() {
 			Subcommands: []cli.Command{
 				{
 					Name:  "add",
-					Usage: "Adds a new one",
+					Usage: "Adds a new one (add [" + authPermissionsOptions() + "]..., " + ReadPermission + " and " + WritePermission + " by default)",
 					Action: func(c *cli.Context) {
-						key, secretKey, err := generateKey()
+						permissions := defaultKeyPermissions
+						if len(c.Args()) > 0 {
+							permissions = c.Args()
+						}
+						key, secretKey, err := generateKey(permissions)
 						if err != nil {
-							log.Println("Adding a new API key failed, please try again")
+							log.Println("Adding a new API key failed:", err)
 							return
 						}
 
@@ -233,72 +759,851 @@ func main() {
 	app.Run(os.Args)
 }
 
-func transformationHandler(params martini.Params) (int, string) {
-	if !hasPermission(params["apikey"], GetPermission) {
-		return http.StatusUnauthorized, ""
+func transformationHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Images are written to the response by serveTransformation itself
+	status, body := serveTransformation(params, req, res)
+	if status >= http.StatusBadRequest {
+		body = errorWithRequestID(res, body)
+	}
+	if status >= http.StatusBadRequest && currentConfig().errorImages && respondWithErrorImage(res, status, body, params["parameters"]) {
+		return
+	}
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// serveTransformation answers a request for a transformed image, it returns
+// 0 when it wrote the response itself
+func serveTransformation(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	tenant := tenantFor(req)
+	conf := tenant.config()
+	parametersStr, signed, status, body := authoriseImageRequest(params, req, tenant, conf)
+	if status != 0 {
+		return status, body
+	}
+	// Signatures cover the parameters as they were signed
+	if conf.canonicalURLs && !signed {
+		if status, body, redirected := redirectToCanonical(res, req, params["parameters"], parametersStr, conf); redirected {
+			return status, body
+		}
+	}
+
+	ctx := req.Context()
+
+	// Ended explicitly once the request is parsed, later calls are ignored
+	_, parseSpan := tracer.Start(ctx, "parse")
+	defer parseSpan.End()
+
+	// The version token only changes which variants are cached
+	requestedPath, version := splitVersion(params["_1"])
+	imagePath, err := tenant.storagePath(requestedPath)
+	if err != nil {
+		return http.StatusNotFound, "Image not found: " + requestedPath
+	}
+
+	if status, body, answered := checkHotlink(req, res); answered {
+		return status, body
+	}
+
+	parametersStr, options, err := removeRequestOptions(parametersStr)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	// Downloads share cached images with other requests
+	if options.downloadName != "" {
+		setContentDisposition(res, downloadFilename(options.downloadName, requestedPath))
+	}
+
+	if isOriginalRequest(conf, parametersStr) {
+		if status, body, served := serveOriginal(res, req, imagePath); served {
+			return status, body
+		}
+		return http.StatusBadRequest, "Originals aren't served"
+	}
+
+	transformation, transformationName, baseImagePath, err := resolveTransformation(conf, parametersStr, imagePath)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	transformation.version = version
+	options.apply(&transformation)
+	if transformation.videoFormat != "" {
+		if err := checkVideoTransformation(&transformation); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+	}
+	if transformation.webp != nil {
+		if err := checkWebPTransformation(&transformation); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+	}
+	parseSpan.SetAttributes(
+		attribute.String("pixlserv.image", baseImagePath),
+		attribute.String("pixlserv.parameters", transformation.params.ToString()),
+	)
+	parseSpan.End()
+
+	if tenant == nil {
+		shadowRequest(parametersStr, imagePath, transformation, options)
+	}
+	return serveImage(params, req, res, transformation, transformationName, baseImagePath)
+}
+
+// serveImage answers a request for an image transformed as a named or custom
+// transformation says from one of the caches or by generating it, it returns
+// 0 when it wrote the response itself
+func serveImage(params martini.Params, req *http.Request, res http.ResponseWriter, transformation Transformation, transformationName, baseImagePath string) (int, string) {
+	ctx := req.Context()
+	transformation = applyClientHints(req, res, transformation)
+	transformation = applySaveData(req, res, transformation)
+	transformation = transformation.withTextVariables(requestTextVariables(requestKey(params, req), req))
+	entry := requestLogFor(req)
+	entry.imagePath = baseImagePath
+	entry.parameters = transformation.params.ToString()
+	entry.transformation = transformationName
+	entry.debug = wantsDebugHeaders(params, req)
+
+	if transformation.personalised {
+		res.Header().Set("Cache-Control", personalisedCacheControl)
+	} else if cacheControl := cacheControlFor(&transformation, baseImagePath); cacheControl != "" {
+		res.Header().Set("Cache-Control", cacheControl)
+	}
+	if currentConfig().cdnSurrogateKeys {
+		setSurrogateKeys(res, surrogateKeys(transformationName, baseImagePath))
+	}
+	cdnRecordURL(baseImagePath, req.URL.EscapedPath())
+
+	// Check if the image with the given parameters already exists
+	// and return it
+	fullImagePath, _ := transformation.createFilePath(baseImagePath)
+	clientKey := rateLimitKey(params, req)
+	_, lookupSpan := tracer.Start(ctx, "cache lookup")
+	if data, ok := cachedInMemory(fullImagePath); ok {
+		entry.cacheStatus = "memory"
+		lookupSpan.SetAttributes(attribute.String("pixlserv.cache", entry.cacheStatus))
+		lookupSpan.End()
+		if rateLimited(currentConfig().hitRateLimiter, clientKey, res) {
+			return http.StatusTooManyRequests, "Too many requests"
+		}
+		cacheUpdateLastAccess(cacheKey(fullImagePath))
+		cacheRecordHit(len(data))
+		revalidate(fullImagePath, baseImagePath, transformation)
+		setFitHeader(res, &transformation, fullImagePath, nil)
+		setLQIPHeader(res, &transformation, fullImagePath, data)
+		setDebugHeaders(res, entry)
+		return respondWithImage(res, req, data, cacheSourceModTime(fullImagePath))
+	}
+	cached, err := openFromCache(fullImagePath)
+	if err == nil {
+		defer cached.Close()
+		entry.cacheStatus = "hit"
+		lookupSpan.SetAttributes(attribute.String("pixlserv.cache", entry.cacheStatus))
+		lookupSpan.End()
+		if rateLimited(currentConfig().hitRateLimiter, clientKey, res) {
+			return http.StatusTooManyRequests, "Too many requests"
+		}
+		cacheRecordHit(cached.size)
+		revalidate(fullImagePath, baseImagePath, transformation)
+		setFitHeader(res, &transformation, fullImagePath, nil)
+		setDebugHeaders(res, entry)
+
+		// Images which fit are kept in memory, those cached without an ETag
+		// need to be read to get one
+		if hotCache.accepts(cached.size) || cached.etag == "" {
+			data, err := ioutil.ReadAll(cached)
+			if err != nil {
+				return http.StatusInternalServerError, err.Error()
+			}
+			hotCache.put(fullImagePath, data)
+			setLQIPHeader(res, &transformation, fullImagePath, data)
+			return respondWithImage(res, req, data, cacheSourceModTime(fullImagePath))
+		}
+		setLQIPHeader(res, &transformation, fullImagePath, nil)
+		return streamImage(res, req, cached, cacheSourceModTime(fullImagePath))
+	}
+
+	entry.cacheStatus = "miss"
+	lookupSpan.SetAttributes(attribute.String("pixlserv.cache", entry.cacheStatus))
+	lookupSpan.End()
+
+	// Load the original image and process it
+	bypassNegativeCache := req.Header.Get(bypassNegativeCacheHeader) != ""
+	if !bypassNegativeCache && isKnownMissing(baseImagePath) {
+		return serveFallback(params, req, res, transformation, transformationName, baseImagePath)
+	}
+
+	if rateLimited(currentConfig().missRateLimiter, clientKey, res) {
+		return http.StatusTooManyRequests, "Too many requests"
+	}
+	subjects := usageSubjects(params, req)
+	if subject, exceeded := quotaExceeded(subjects, time.Now()); exceeded {
+		return http.StatusTooManyRequests, "Quota exceeded for " + subject
+	}
+
+	// Concurrent requests for the same image share one transformation, it
+	// is accounted to the request which made it. Personalised images are
+	// never found in the caches, nor added to them. The shared call doesn't
+	// stop when the request which made it is cancelled since the others
+	// wait for it, its stages have their own timeouts.
+	generate := generateImage
+	if transformation.personalised {
+		generate = generatePersonalisedImage
+	} else if cachePeersEnabled() {
+		generate = generateWithPeers
+	}
+	generated, err, _ := inFlight.do(fullImagePath, func() (interface{}, error) {
+		generated, err := generate(context.WithoutCancel(ctx), fullImagePath, baseImagePath, transformation)
+		if err == nil {
+			recordUsage(subjects, len(generated.data), time.Now())
+		}
+		return generated, err
+	})
+	if err == ErrNotFound {
+		return serveFallback(params, req, res, transformation, transformationName, baseImagePath)
+	}
+	if err == errOverloaded {
+		res.Header().Set("Retry-After", strconv.Itoa(currentConfig().processingRetryAfter))
+		return currentConfig().processingOverloadStatus, err.Error()
+	}
+	if err == errContentBlocked {
+		return http.StatusForbidden, err.Error()
+	}
+	if _, ok := err.(stageTimeoutError); ok {
+		return http.StatusGatewayTimeout, err.Error()
+	}
+	if _, ok := err.(imageTooLargeError); ok {
+		return http.StatusUnprocessableEntity, err.Error()
+	}
+	if _, ok := err.(videoSourceError); ok {
+		return http.StatusUnprocessableEntity, err.Error()
+	}
+	if _, ok := err.(webpSourceError); ok {
+		return http.StatusUnprocessableEntity, err.Error()
 	}
+	if _, ok := err.(unsupportedFormatError); ok {
+		// Originals which can't be processed can still be shown as they are
+		if status, body, served := serveOriginal(res, req, baseImagePath); served {
+			return status, body
+		}
+		return http.StatusUnprocessableEntity, err.Error()
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	if bypassNegativeCache {
+		forgetMissing(baseImagePath)
+	}
+
+	result := generated.(*generatedImage)
+	setFitHeader(res, &transformation, fullImagePath, result.fit)
+	setLQIPHeader(res, &transformation, fullImagePath, result.data)
+	setDebugHeaders(res, entry)
+	return respondWithImage(res, req, result.data, result.modTime)
+}
 
+// resolveTransformation returns the named or custom transformation described
+// by a parameters string and the path of the original image, scaled when an
+// image path like photo@2x.jpg asks for it
+func resolveTransformation(conf *Configuration, parametersStr, imagePath string) (Transformation, string, string, error) {
 	var transformation Transformation
-	transformationName := parseTransformationName(params["parameters"])
+	transformationName := parseTransformationName(parametersStr)
+	pathPolicy := conf.pathPolicy(imagePath)
+	if err := pathPolicy.checkTransformation(transformationName); err != nil {
+		return transformation, "", "", err
+	}
 	if transformationName != "" {
 		var ok bool
-		transformation, ok = Config.transformations[transformationName]
+		transformation, ok = conf.transformations[transformationName]
 		if !ok {
-			return http.StatusBadRequest, "Unknown transformation: " + transformationName
+			return transformation, "", "", fmt.Errorf("Unknown transformation: %s", transformationName)
 		}
-	} else if Config.allowCustomTransformations {
-		parameters, err := parseParameters(params["parameters"])
+	} else if conf.allowCustomTransformations {
+		parameters, err := parsePolicedParameters(parametersStr, conf, pathPolicy.parameters())
 		if err != nil {
-			return http.StatusBadRequest, err.Error()
+			return transformation, "", "", err
 		}
-		transformation = Transformation{&parameters, nil, make([]*Text, 0)}
+		transformation = Transformation{params: &parameters, texts: make([]*Text, 0)}
 	} else {
-		return http.StatusBadRequest, "Custom transformations not allowed"
+		return transformation, "", "", errors.New("Custom transformations not allowed")
 	}
-	baseImagePath, scale := parseBasePathAndScale(params["_1"])
-	if Config.allowCustomScale {
+
+	baseImagePath, scale := parseBasePathAndScale(imagePath)
+	if conf.allowCustomScale {
 		parameters := transformation.params.WithScale(scale)
+		if err := parameters.CheckLimits(conf.outputLimits()); err != nil {
+			return transformation, "", "", err
+		}
+		if transformationName == "" {
+			if err := conf.parameterPolicy.checkScale(parameters.Scale); err != nil {
+				return transformation, "", "", err
+			}
+			if err := pathPolicy.parameters().checkScale(parameters.Scale); err != nil {
+				return transformation, "", "", err
+			}
+		}
 		transformation.params = &parameters
 	}
+	return transformation, transformationName, baseImagePath, nil
+}
 
-	// Check if the image with the given parameters already exists
-	// and return it
-	fullImagePath, _ := transformation.createFilePath(baseImagePath)
-	img, format, err := loadFromCache(fullImagePath)
-	if err == nil {
-		var buffer bytes.Buffer
-		writeImage(img, format, &buffer)
+// generatedImage is an encoded transformed image
+type generatedImage struct {
+	data    []byte
+	modTime time.Time // Modification time of the original
+	fit     *sizeFit  // What was done to fit the image in its size cap, nil if unknown
+}
 
-		return http.StatusOK, buffer.String()
+// generateImage transforms an original image, caches and returns the result
+func generateImage(ctx context.Context, fullImagePath, baseImagePath string, transformation Transformation) (*generatedImage, error) {
+	ctx = trackStages(ctx)
+	_, fetchSpan := tracer.Start(ctx, "storage fetch", trace.WithAttributes(attribute.String("pixlserv.storage", storageName)))
+	sourceInfo, err := statSource(baseImagePath)
+	if err == ErrNotFound {
+		rememberMissing(baseImagePath)
+		endSpan(fetchSpan, err)
+		return nil, err
+	}
+	if err != nil {
+		endSpan(fetchSpan, err)
+		return nil, err
 	}
 
-	// Load the original image and process it
-	if !imageExists(baseImagePath) {
-		return http.StatusNotFound, "Image not found: " + baseImagePath
+	// A persisted variant saves transforming the original again
+	if encoded, format, ok := loadDerived(fullImagePath, sourceInfo); ok {
+		endSpan(fetchSpan, nil)
+		hotCache.put(fullImagePath, encoded)
+		cacheRecordMiss(len(encoded))
+		go cacheGeneratedImage(fullImagePath, encoded, format, sourceInfo, &transformation, nil)
+		return &generatedImage{encoded, sourceInfo.ModTime, nil}, nil
 	}
 
-	img, format, err = loadImage(baseImagePath)
+	// Nothing is fetched for requests which would be turned away anyway
+	if processingPool.full() {
+		endSpan(fetchSpan, errOverloaded)
+		overloadRejectionsTotal.WithLabelValues("queue").Inc()
+		return nil, errOverloaded
+	}
+
+	transformationsInFlight.Inc()
+	defer transformationsInFlight.Dec()
+
+	var data []byte
+	err = runStage(ctx, stageFetch, func(ctx context.Context) error {
+		var err error
+		data, err = fetchImage(baseImagePath)
+		return err
+	})
+	fetchSpan.SetAttributes(attribute.Int("pixlserv.bytes", len(data)))
+	endSpan(fetchSpan, err)
 	if err != nil {
-		return http.StatusInternalServerError, err.Error()
+		return nil, err
 	}
 
-	imgNew := transformCropAndResize(img, &transformation)
+	entry := requestLogFromContext(ctx)
+	if entry.debug {
+		if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			entry.sourceWidth, entry.sourceHeight = config.Width, config.Height
+		}
+	}
+
+	// Decoding, transforming and encoding take most of the memory and CPU
+	_, queueSpan := tracer.Start(ctx, "queue")
+	queued := time.Now()
+	err = processingPool.acquire(ctx)
+	entry.queueWait = time.Since(queued)
+	endSpan(queueSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAfterStages(ctx, processingPool.release)
 
-	var buffer bytes.Buffer
-	err = writeImage(imgNew, format, &buffer)
+	encoded, format, fit, start, err := processImage(ctx, data, fullImagePath, baseImagePath, &transformation)
 	if err != nil {
-		log.Println("Writing an image to the response failed:", err)
+		return nil, err
 	}
+	entry.transformDuration = time.Since(start)
+	observeTransformation(transformation.params, format, start)
+	hotCache.put(fullImagePath, encoded)
+	cacheRecordMiss(len(encoded))
 
 	// Cache the image asynchronously to speed up the response
 	go func() {
-		err = addToCache(fullImagePath, imgNew, format)
+		persistDerived(fullImagePath, encoded, format)
+		pushToEdges(fullImagePath, encoded, format)
+		cacheGeneratedImage(fullImagePath, encoded, format, sourceInfo, &transformation, fit)
+		rememberSource(baseImagePath, sourceInfo, data)
+		recordHistory(baseImagePath, &transformation)
+	}()
+
+	return &generatedImage{encoded, sourceInfo.ModTime, fit}, nil
+}
+
+// cacheGeneratedImage adds a generated image to the cache and remembers the
+// version of its original, its parameters and how it was fitted in its size
+// cap (unless fit is nil)
+func cacheGeneratedImage(fullImagePath string, encoded []byte, format string, sourceInfo *FileInfo, transformation *Transformation, fit *sizeFit) {
+	err := addEncodedToCache(fullImagePath, encoded, format)
+	if err != nil {
+		slog.Error("saving an image to cache failed", "path", fullImagePath, "error", err)
+		return
+	}
+	setCacheSource(fullImagePath, sourceInfo)
+	setCacheParameters(fullImagePath, transformation)
+	setCacheExpiry(fullImagePath, transformation)
+	if fit != nil {
+		setCacheFit(fullImagePath, fit)
+	}
+	setCachePeer(fullImagePath)
+}
+
+// processImage transforms an original image using the configured processing
+// backend or the pure-Go pipeline. It returns the encoded result, its format,
+// what was done to fit it in its size cap (nil without one) and when the
+// transformation started.
+func processImage(ctx context.Context, data []byte, fullImagePath, baseImagePath string, transformation *Transformation) ([]byte, string, *sizeFit, time.Time, error) {
+	ctx = trackStages(ctx)
+	format, err := checkImage(data)
+	if err != nil {
+		return nil, "", nil, time.Time{}, err
+	}
+
+	// Images which would take more memory than is left aren't processed
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", nil, time.Time{}, fmt.Errorf("cannot decode image: %q", baseImagePath)
+	}
+	transformation = transformation.forSource(imageConfig.Width, imageConfig.Height, format)
+	geometry := engine.Plan(*transformation.params, imageConfig.Width, imageConfig.Height)
+	if transformation.params.Cropping == engine.CroppingModeMinimum {
+		// Covering a frame makes one dimension bigger than the parameters say
+		err = engine.Params{Width: geometry.Width, Height: geometry.Height, Scale: 1}.CheckLimits(currentConfig().outputLimits())
+		if err != nil {
+			return nil, "", nil, time.Time{}, imageTooLargeError(err.Error())
+		}
+	}
+
+	// Originals too big to be decoded in memory are shrunk to what the
+	// geometry needs first, their metadata is still taken from the original
+	source := data
+	if transformation.videoFormat == "" && isLargeSource(imageConfig.Width, imageConfig.Height) {
+		_, shrinkSpan := tracer.Start(ctx, "shrink")
+		var shrunk []byte
+		err = runStage(ctx, stageDecode, func(ctx context.Context) error {
+			var err error
+			shrunk, err = shrinkLargeSource(ctx, data, format, imageConfig.Width, imageConfig.Height, geometry)
+			return err
+		})
+		endSpan(shrinkSpan, err)
+		if err != nil {
+			return nil, "", nil, time.Time{}, err
+		}
+		if shrunk != nil {
+			source = shrunk
+			imageConfig, _, _ = image.DecodeConfig(bytes.NewReader(source))
+			geometry = engine.Plan(*transformation.params, imageConfig.Width, imageConfig.Height)
+		}
+	}
+	size := estimateMemory(source, imageConfig.Width, imageConfig.Height, geometry)
+	err = processingMemory.reserve(size)
+	if err != nil {
+		return nil, "", nil, time.Time{}, err
+	}
+	defer releaseAfterStages(ctx, func() { processingMemory.free(size) })
+
+	start := time.Now()
+	if transformation.videoFormat != "" {
+		encoded, err := transcodeVideo(ctx, data, format, imageConfig.Width, imageConfig.Height, transformation)
+		return encoded, transformation.videoFormat, nil, start, err
+	}
+	maxBytes := transformation.outputMaxBytes()
+	encoded, native, err := processNatively(ctx, source, format, geometry, transformation)
+	if transformation.webp != nil && !native {
+		// Only the backend encodes WebP images
+		return nil, format, nil, start, webpSourceError(format + " images can't be encoded as WebP by the " + currentConfig().processingBackend + " backend")
+	}
+	if transformation.webp != nil && err == nil && maxBytes != 0 && len(encoded) > maxBytes {
+		return nil, format, nil, start, imageTooLargeError(fmt.Sprintf("the image doesn't fit in %d bytes", maxBytes))
+	}
+	if native && err == nil && maxBytes != 0 && len(encoded) > maxBytes {
+		// Images over their size cap are fitted in it by the Go pipeline
+		native = false
+	}
+	var fit *sizeFit
+	if !native {
+		start, encoded, fit, err = transformInGo(ctx, source, fullImagePath, baseImagePath, transformation, maxBytes)
+	} else if err != nil {
+		slog.Error("processing an image failed", "path", fullImagePath, "backend", currentConfig().processingBackend, "error", err)
+	} else if maxBytes != 0 {
+		fit = &sizeFit{scale: 1}
+	}
+	if err != nil {
+		return nil, format, nil, start, err
+	}
+	withMetadata := addOutputMetadata(data, encoded, format, transformation)
+
+	// Kept metadata counts towards the size cap as well
+	if maxBytes != 0 && len(withMetadata) > maxBytes {
+		budget := maxBytes - (len(withMetadata) - len(encoded))
+		if budget < 1 {
+			return nil, format, nil, start, imageTooLargeError(fmt.Sprintf("the image's metadata doesn't fit in %d bytes", maxBytes))
+		}
+		start, encoded, fit, err = transformInGo(ctx, source, fullImagePath, baseImagePath, transformation, budget)
+		if err != nil {
+			return nil, format, nil, start, err
+		}
+		withMetadata = addOutputMetadata(data, encoded, format, transformation)
+	}
+	return withMetadata, transformation.outputFormat(format), fit, start, nil
+}
+
+// addOutputMetadata adds the metadata kept from the original and the density
+// to an image encoded from an original of the given format
+func addOutputMetadata(original, encoded []byte, format string, transformation *Transformation) []byte {
+	outputFormat := transformation.outputFormat(format)
+	encoded = keepMetadata(original, encoded, format, outputFormat)
+	if transformation.dpi != 0 {
+		encoded = setDensity(encoded, outputFormat, transformation.dpi)
+	}
+	return encoded
+}
+
+// transformInGo decodes, transforms and encodes an image using the pure-Go
+// pipeline, it returns when the transformation started after decoding. Images
+// bigger than maxBytes (unless it's 0) are fitted in it.
+func transformInGo(ctx context.Context, data []byte, fullImagePath, baseImagePath string, transformation *Transformation, maxBytes int) (time.Time, []byte, *sizeFit, error) {
+	_, decodeSpan := tracer.Start(ctx, "decode")
+	var img image.Image
+	var format string
+	err := runStage(ctx, stageDecode, func(ctx context.Context) error {
+		var err error
+		img, format, err = decodeImage(data, baseImagePath)
+		return err
+	})
+	endSpan(decodeSpan, err)
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+
+	start := time.Now()
+	_, transformSpan := tracer.Start(ctx, "transform")
+	var imgNew image.Image
+	err = runStage(ctx, stageTransform, func(ctx context.Context) error {
+		var err error
+		imgNew, err = transformCropAndResize(img, format, baseImagePath, transformation)
+		return err
+	})
+	endSpan(transformSpan, err)
+	if err != nil {
+		slog.Error("transforming an image failed", "path", fullImagePath, "error", err)
+		return start, nil, nil, err
+	}
+	format = transformation.outputFormat(format)
+
+	_, encodeSpan := tracer.Start(ctx, "encode", trace.WithAttributes(attribute.String("pixlserv.format", format)))
+	buffer := getEncodeBuffer()
+	var fit *sizeFit
+	err = runStage(ctx, stageEncode, func(ctx context.Context) error {
+		var err error
+		if transformation.autoQuality && transformation.quality == 0 && format != "png" {
+			err = encodeAutoQuality(imgNew, transformation.jpegOptions().Subsampling, buffer)
+		} else {
+			err = writeImageWithOptions(imgNew, format, transformation.jpegOptions(), transformation.pngOptions(), buffer)
+		}
+		if err != nil || maxBytes == 0 {
+			return err
+		}
+		fit = &sizeFit{scale: 1}
+		if buffer.Len() <= maxBytes {
+			return nil
+		}
+		fitted, stepped, err := fitToMaxBytes(imgNew, format, transformation, maxBytes)
+		if err != nil {
+			return err
+		}
+		fit = stepped
+		buffer.Reset()
+		_, err = buffer.Write(fitted)
+		return err
+	})
+	endSpan(encodeSpan, err)
+	if err != nil {
+		// The buffer may still be written to by an encoder given up on
+		slog.Error("encoding an image failed", "path", fullImagePath, "error", err)
+		return start, nil, nil, err
+	}
+	defer putEncodeBuffer(buffer)
+	// The encoded image outlives the buffer in the caches
+	return start, append([]byte(nil), buffer.Bytes()...), fit, nil
+}
+
+// revalidate checks in the background whether the original of a cached image
+// changed since the image was generated and if so, generates it again. The
+// stale image is served in the meantime.
+func revalidate(fullImagePath, baseImagePath string, transformation Transformation) {
+	if !cacheShouldRevalidate(fullImagePath) {
+		return
+	}
+
+	go func() {
+		sourceInfo, err := storageImpl.Stat(baseImagePath)
+		if err != nil || !cacheSourceChanged(fullImagePath, sourceInfo) {
+			return
+		}
+
+		slog.Info("original changed, regenerating", "path", fullImagePath)
+		forgetSourceMetadata(baseImagePath)
+		data, err := fetchImage(baseImagePath)
+		if err != nil {
+			slog.Error("regenerating a cached image failed", "path", fullImagePath, "error", err)
+			return
+		}
+
+		// Regenerated like on a miss so videos, size caps and request
+		// options give the same result
+		ctx := trackStages(context.Background())
+		err = processingPool.acquire(ctx)
 		if err != nil {
-			log.Println("Saving an image to cache failed:", err)
+			slog.Error("regenerating a cached image failed", "path", fullImagePath, "error", err)
+			return
 		}
+		encoded, format, fit, _, err := processImage(ctx, data, fullImagePath, baseImagePath, &transformation)
+		releaseAfterStages(ctx, processingPool.release)
+		if err != nil {
+			slog.Error("regenerating a cached image failed", "path", fullImagePath, "error", err)
+			return
+		}
+		persistDerived(fullImagePath, encoded, format)
+		pushToEdges(fullImagePath, encoded, format)
+		cacheGeneratedImage(fullImagePath, encoded, format, sourceInfo, &transformation, fit)
+		rememberSource(baseImagePath, sourceInfo, data)
+		refreshCached(fullImagePath)
+		cdnPurge([]string{baseImagePath})
 	}()
+}
+
+// CacheStatsResponse is a struct to represent a JSON response for the cache statistics handler
+type CacheStatsResponse struct {
+	Cache  CacheStats       `json:"cache"`
+	Memory MemoryCacheStats `json:"memory"`
+}
+
+func cacheStatsHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return http.StatusUnauthorized, ""
+	}
+
+	stats, err := getCacheStats()
+	if err != nil {
+		slog.Error("retrieving cache statistics failed", "error", err)
+		return http.StatusInternalServerError, ""
+	}
+	return jsonResponse(res, http.StatusOK, CacheStatsResponse{stats, hotCache.stats()})
+}
 
-	return http.StatusOK, buffer.String()
+// CachePurgeResponse is a struct to represent a JSON response for the cache purge handler
+type CachePurgeResponse struct {
+	Status       string `json:"status"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Removed      int    `json:"removed"`
+}
+
+func cachePurgeHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, CachePurgeResponse{"error", "API key invalid or missing", 0})
+	}
+
+	imagePath, err := tenantFor(req).storagePath(params["_1"])
+	if err != nil {
+		return jsonResponse(res, http.StatusNotFound, CachePurgeResponse{"error", err.Error(), 0})
+	}
+	setAuditTarget(req, imagePath)
+	removed, err := purgeImage(imagePath)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, CachePurgeResponse{"error", err.Error(), removed})
+	}
+	return jsonResponse(res, http.StatusOK, CachePurgeResponse{"ok", "", removed})
+}
+
+// PurgeJobResponse is a struct to represent a JSON response for the purge job handlers
+type PurgeJobResponse struct {
+	Status       string    `json:"status"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+	Job          *PurgeJob `json:"job,omitempty"`
+}
+
+func purgeJobStartHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, PurgeJobResponse{"error", "API key invalid or missing", nil})
+	}
+
+	pattern := req.FormValue("pattern")
+	if tenant := tenantFor(req); tenant != nil && pattern != "" {
+		pattern = tenant.prefix + pattern
+	}
+	setAuditTarget(req, pattern)
+	job, err := startPurge(pattern)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, PurgeJobResponse{"error", err.Error(), nil})
+	}
+	return jsonResponse(res, http.StatusAccepted, PurgeJobResponse{"ok", "", job})
+}
+
+func purgeJobStatusHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, PurgeJobResponse{"error", "API key invalid or missing", nil})
+	}
+
+	job, err := getPurgeJob(params["id"])
+	if err != nil {
+		return jsonResponse(res, http.StatusNotFound, PurgeJobResponse{"error", err.Error(), nil})
+	}
+	return jsonResponse(res, http.StatusOK, PurgeJobResponse{"ok", "", job})
+}
+
+// WarmJobResponse is a struct to represent a JSON response for the warm-up job handlers
+type WarmJobResponse struct {
+	Status       string   `json:"status"`
+	ErrorMessage string   `json:"errorMessage,omitempty"`
+	Job          *WarmJob `json:"job,omitempty"`
+}
+
+func warmJobStartHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, WarmJobResponse{"error", "API key invalid or missing", nil})
+	}
+
+	req.ParseForm()
+	tenant := tenantFor(req)
+	paths := make([]string, 0, len(req.Form["path"]))
+	for _, imagePath := range req.Form["path"] {
+		storagePath, err := tenant.storagePath(imagePath)
+		if err != nil {
+			return jsonResponse(res, http.StatusBadRequest, WarmJobResponse{"error", err.Error(), nil})
+		}
+		paths = append(paths, storagePath)
+	}
+	prefix := req.FormValue("prefix")
+	if tenant != nil && prefix != "" {
+		prefix = tenant.prefix + prefix
+	}
+	var transformations []string
+	if transformationsStr := req.FormValue("transformations"); transformationsStr != "" {
+		transformations = strings.Split(transformationsStr, ",")
+	}
+	concurrency, _ := strconv.Atoi(req.FormValue("concurrency"))
+
+	job, err := startWarm(configFor(req), paths, prefix, transformations, concurrency)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, WarmJobResponse{"error", err.Error(), nil})
+	}
+	return jsonResponse(res, http.StatusAccepted, WarmJobResponse{"ok", "", job})
+}
+
+func warmJobStatusHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, WarmJobResponse{"error", "API key invalid or missing", nil})
+	}
+
+	job, err := getWarmJob(params["id"])
+	if err != nil {
+		return jsonResponse(res, http.StatusNotFound, WarmJobResponse{"error", err.Error(), nil})
+	}
+	return jsonResponse(res, http.StatusOK, WarmJobResponse{"ok", "", job})
+}
+
+// KeysResponse is a struct to represent a JSON response for the API key handlers
+type KeysResponse struct {
+	Status       string   `json:"status"`
+	ErrorMessage string   `json:"errorMessage,omitempty"`
+	Keys         []APIKey `json:"keys,omitempty"`
+}
+
+func keysListHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, KeysResponse{"error", "API key invalid or missing", nil})
+	}
+
+	keys, err := listKeysWithPermissions()
+	if err != nil {
+		slog.Error("listing API keys failed", "error", err)
+		return jsonResponse(res, http.StatusInternalServerError, KeysResponse{"error", "server error", nil})
+	}
+	return jsonResponse(res, http.StatusOK, KeysResponse{"ok", "", keys})
+}
+
+func keyCreateHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, KeysResponse{"error", "API key invalid or missing", nil})
+	}
+
+	permissions := defaultKeyPermissions
+	if permissionsStr := req.FormValue("permissions"); permissionsStr != "" {
+		permissions = strings.Split(permissionsStr, ",")
+	}
+	permissions, err := validPermissions(permissions)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, KeysResponse{"error", err.Error(), nil})
+	}
+
+	key, secret, err := generateKey(permissions)
+	if err != nil {
+		slog.Error("adding an API key failed", "error", err)
+		return jsonResponse(res, http.StatusInternalServerError, KeysResponse{"error", "server error", nil})
+	}
+	setAuditTarget(req, key)
+	return jsonResponse(res, http.StatusCreated, KeysResponse{"ok", "", []APIKey{{key, secret, permissions}}})
+}
+
+func keyUpdateHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, KeysResponse{"error", "API key invalid or missing", nil})
+	}
+
+	key := params["key"]
+	if err := checkKeyExists(key); err != nil {
+		return jsonResponse(res, http.StatusNotFound, KeysResponse{"error", err.Error(), nil})
+	}
+	permissions := make([]string, 0)
+	if permissionsStr := req.FormValue("permissions"); permissionsStr != "" {
+		permissions = strings.Split(permissionsStr, ",")
+	}
+	err := setKeyPermissions(key, permissions)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, KeysResponse{"error", err.Error(), nil})
+	}
+
+	permissions, _ = infoAboutKey(key)
+	return jsonResponse(res, http.StatusOK, KeysResponse{"ok", "", []APIKey{{Key: key, Permissions: permissions}}})
+}
+
+func keyRemoveHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, AdminPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, KeysResponse{"error", "API key invalid or missing", nil})
+	}
+
+	err := removeKey(params["key"])
+	if err != nil {
+		return jsonResponse(res, http.StatusNotFound, KeysResponse{"error", err.Error(), nil})
+	}
+	return jsonResponse(res, http.StatusOK, KeysResponse{"ok", "", nil})
+}
+
+// jsonResponse serialises v and sets the response's content type accordingly
+func jsonResponse(res http.ResponseWriter, status int, v interface{}) (int, string) {
+	res.Header().Set("Content-Type", "application/json")
+	str, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("constructing a JSON response failed", "response", fmt.Sprintf("%v", v))
+		return http.StatusInternalServerError, "{\"status\": \"error\", \"errorMessage\": \"server error\"}"
+	}
+	// Failed requests can be found in the logs by their ID
+	if id := res.Header().Get(requestIDHeader); status >= http.StatusBadRequest && id != "" && len(str) > 2 && str[0] == '{' {
+		quoted, _ := json.Marshal(id)
+		str = append(str[:len(str)-1], ",\"requestId\":"+string(quoted)+"}"...)
+	}
+	return status, string(str)
 }
 
 // UploadResponse is a struct to represent a JSON response for the upload handler
@@ -311,7 +1616,7 @@ type UploadResponse struct {
 func uploadResponse(response UploadResponse) string {
 	str, err := json.Marshal(response)
 	if err != nil {
-		log.Printf("Error constructing JSON response for %v", response)
+		slog.Error("constructing a JSON response failed", "response", fmt.Sprintf("%v", response))
 		return "{\"status\": \"error\", \"errorMessage\": \"server error\"}"
 	}
 	return string(str[:])
@@ -325,8 +1630,22 @@ func uploadSuccess(imagePath string) string {
 	return uploadResponse(UploadResponse{"ok", "", imagePath})
 }
 
-func uploadHandler(params martini.Params, uf UploadForm) (int, string) {
-	if !hasPermission(params["apikey"], UploadPermission) {
+// limitUploadSize rejects uploads bigger than allowed before they are read,
+// either straight away using their Content-Length or when reading them gets
+// past the limit
+func limitUploadSize(res http.ResponseWriter, req *http.Request) {
+	// Leave some space for the other form fields and multipart headers
+	limit := int64(configFor(req).uploadMaxFileSize) + uploadFormOverhead
+	if req.ContentLength > limit {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		res.Write([]byte(uploadError("max file size exceeded")))
+		return
+	}
+	req.Body = http.MaxBytesReader(res, req.Body, limit)
+}
+
+func uploadHandler(params martini.Params, req *http.Request, uf UploadForm) (int, string) {
+	if !isAuthorised(params, req, WritePermission) {
 		return http.StatusUnauthorized, uploadError("API key invalid or missing")
 	}
 
@@ -336,23 +1655,12 @@ func uploadHandler(params martini.Params, uf UploadForm) (int, string) {
 
 	// Check signature only when API key is used
 	// Note: when no API key is passed in but required for uploads, the above
-	// hasPermission check should fail
-	if params["apikey"] != "" {
-		uploadTime := time.Unix(uf.Timestamp, 0)
-		delta := time.Since(uploadTime).Minutes()
-		if delta < 0 || delta > 5 {
-			return http.StatusBadRequest, uploadError("invalid timestamp")
-		}
-
-		queryParams := make(map[string]string)
-		queryParams["timestamp"] = strconv.FormatInt(uf.Timestamp, 10)
-
-		secret, err := getSecretForKey(params["apikey"])
+	// isAuthorised check should fail
+	apiKey := requestKey(params, req)
+	if apiKey != "" && (currentConfig().jwtAuth == nil || bearerToken(req) == "") {
+		err := checkUploadSignature(apiKey, uf.Timestamp, uf.Signature)
 		if err != nil {
-			return http.StatusBadRequest, uploadError("authorization error")
-		}
-		if !isValidSignature(uf.Signature, secret, queryParams) {
-			return http.StatusBadRequest, uploadError("invalid signature")
+			return http.StatusBadRequest, uploadError(err.Error())
 		}
 	}
 
@@ -360,74 +1668,204 @@ func uploadHandler(params martini.Params, uf UploadForm) (int, string) {
 	if err != nil {
 		return http.StatusBadRequest, uploadError(err.Error())
 	}
+	defer file.Close()
 
-	reader, err := temp.NewReadSeeker(file)
-	if err != nil {
+	baseImagePath, err := storeUpload(file, tenantFor(req))
+	setAuditTarget(req, baseImagePath)
+	if _, ok := err.(invalidUploadError); ok {
 		return http.StatusBadRequest, uploadError(err.Error())
 	}
-
-	c, _, err := image.DecodeConfig(reader)
 	if err != nil {
-		return http.StatusBadRequest, uploadError(err.Error())
+		return http.StatusInternalServerError, uploadError("error saving image: " + err.Error())
 	}
-	reader.Seek(0, 0)
 
-	pixels := c.Width * c.Height
-	if pixels > Config.uploadMaxPixels {
-		return http.StatusBadRequest, uploadError(fmt.Sprintf("too many pixels: %d, allowed: %d", pixels, Config.uploadMaxPixels))
+	return http.StatusOK, uploadSuccess(baseImagePath)
+}
+
+// invalidUploadError is returned for uploads which aren't acceptable images
+type invalidUploadError string
+
+func (e invalidUploadError) Error() string {
+	return string(e)
+}
+
+// checkUploadSignature checks the signature of an upload made using an API
+// key, uploads need to be signed within 5 minutes
+func checkUploadSignature(apiKey string, timestamp int64, signature string) error {
+	uploadTime := time.Unix(timestamp, 0)
+	delta := time.Since(uploadTime).Minutes()
+	if delta < 0 || delta > 5 {
+		return errors.New("invalid timestamp")
 	}
 
-	limit := io.LimitReader(reader, int64(Config.uploadMaxFileSize+1))
-	data, err := ioutil.ReadAll(limit)
+	queryParams := make(map[string]string)
+	queryParams["timestamp"] = strconv.FormatInt(timestamp, 10)
+
+	secret, err := getSecretForKey(apiKey)
 	if err != nil {
-		return http.StatusBadRequest, uploadError(err.Error())
+		return errors.New("authorization error")
 	}
-	if len(data) > Config.uploadMaxFileSize {
-		return http.StatusBadRequest, uploadError("max file size exceeded")
+	if !isValidSignature(signature, secret, queryParams) {
+		return errors.New("invalid signature")
 	}
+	return nil
+}
+
+// storeUpload checks an uploaded image, saves it under a new name and runs
+// eager transformations on it. It returns the image's path, for a tenant
+// without its prefix.
+func storeUpload(file io.ReadSeeker, tenant *Tenant) (string, error) {
+	conf := tenant.config()
 
-	img, format, err := image.Decode(bytes.NewReader(data))
+	// Files bigger than binding.MaxMemory are read from a temporary file
+	size, err := file.Seek(0, 2)
 	if err != nil {
-		return http.StatusBadRequest, uploadError(err.Error())
+		return "", invalidUploadError(err.Error())
+	}
+	if size > int64(conf.uploadMaxFileSize) {
+		return "", invalidUploadError("max file size exceeded")
 	}
+	file.Seek(0, 0)
 
-	defer file.Close()
+	format, err := checkImageFormat(file, conf.allowedFormats)
+	if err != nil {
+		return "", invalidUploadError(err.Error())
+	}
 
-	// Not a big fan of .jpeg file extensions
+	// Uploads have their own pixel limit, a format's can only be lower
+	limits := conf.sourceLimits(format)
+	limits.maxPixels = conf.uploadMaxPixels
+	if formatMax := conf.sourceFormatLimits[format].maxPixels; formatMax > 0 && (limits.maxPixels == 0 || formatMax < limits.maxPixels) {
+		limits.maxPixels = formatMax
+	}
+	err = checkImageLimits(file, limits)
+	if err != nil {
+		return "", invalidUploadError(err.Error())
+	}
+
+	// An image uploaded again is not stored a second time
+	hash := ""
+	if currentConfig().deduplicateUploads {
+		hash, err = contentHash(file)
+		if err != nil {
+			return "", invalidUploadError(err.Error())
+		}
+		existingPath, err := uploadedWithHash(tenant, hash)
+		if err != nil {
+			slog.Warn("looking up an uploaded image by its hash failed", "hash", hash, "error", err)
+		} else if existingPath != "" {
+			slog.Info("upload already stored", "image", existingPath)
+			if tenant != nil {
+				return strings.TrimPrefix(existingPath, tenant.prefix), nil
+			}
+			return existingPath, nil
+		}
+	}
+
+	// Large images are stored as they were uploaded rather than decoded
+	// and encoded again
+	var img image.Image
+	var original []byte
+	imageConfig, _, err := image.DecodeConfig(file)
+	file.Seek(0, 0)
+	if err == nil && isLargeSource(imageConfig.Width, imageConfig.Height) {
+		original, err = ioutil.ReadAll(file)
+	} else {
+		img, format, err = image.Decode(file)
+	}
+	if err != nil {
+		return "", invalidUploadError(err.Error())
+	}
+
+	// The extension is based on the content, not the uploaded file's name
 	now := time.Now()
 	randomInt := rand.Intn(1000)
-	baseImagePath := fmt.Sprintf("%d-%d.%s", now.Unix(), randomInt, strings.Replace(format, "jpeg", "jpg", 1))
-	log.Printf("Uploading %s", baseImagePath)
+	baseImagePath := fmt.Sprintf("%d-%d.%s", now.Unix(), randomInt, formatExtension(format))
+	imagePath := baseImagePath
+	if tenant != nil {
+		imagePath = tenant.prefix + baseImagePath
+	}
+
+	if conf.contentSafetyURL != "" {
+		file.Seek(0, 0)
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return "", invalidUploadError(err.Error())
+		}
+		if checkContentSafety(conf, imagePath, contentSourceUpload, data) == errContentBlocked {
+			return "", invalidUploadError(errContentBlocked.Error())
+		}
+	}
+	slog.Info("uploading", "image", imagePath)
+
+	save := func() error {
+		if original != nil {
+			return storageImpl.Put(imagePath, original, contentTypeFor(format))
+		}
+		_, err := saveImage(img, format, imagePath)
+		return err
+	}
 
 	// Eager transformations
 	eagerlyTransform := func() {
-		if len(Config.eagerTransformations) > 0 {
-			for _, transformation := range Config.eagerTransformations {
-				imgNew := transformCropAndResize(img, &transformation)
-				fullImagePath, _ := transformation.createFilePath(baseImagePath)
-				addToCache(fullImagePath, imgNew, format)
+		if len(conf.eagerTransformations) > 0 {
+			for _, transformation := range conf.eagerTransformations {
+				if transformation.hasTextVariables() {
+					continue
+				}
+				if original != nil {
+					// Shrunk first like when they are requested
+					fullImagePath, _ := transformation.createFilePath(imagePath)
+					_, err := generateImage(context.Background(), fullImagePath, imagePath, transformation)
+					if err != nil {
+						slog.Error("eager transformation failed", "image", imagePath, "error", err)
+					}
+					continue
+				}
+				imgNew, err := transformCropAndResize(img, format, imagePath, &transformation)
+				if err != nil {
+					slog.Error("eager transformation failed", "image", imagePath, "error", err)
+					continue
+				}
+				fullImagePath, _ := transformation.createFilePath(imagePath)
+				outputFormat := transformation.forSource(img.Bounds().Dx(), img.Bounds().Dy(), format).outputFormat(format)
+				if addToCache(fullImagePath, imgNew, outputFormat) == nil {
+					setCacheParameters(fullImagePath, &transformation)
+					setCacheExpiry(fullImagePath, &transformation)
+					recordHistory(imagePath, &transformation)
+				}
 			}
 		}
 	}
 
-	if Config.asyncUploads {
+	if currentConfig().asyncUploads {
 		go func() {
-			_, err := saveImage(img, format, baseImagePath)
+			err := save()
 			if err != nil {
-				log.Println("Error saving image:", err)
+				slog.Error("saving an uploaded image failed", "image", imagePath, "error", err)
 				return
 			}
+			if hash != "" {
+				rememberUploadHash(tenant, hash, imagePath)
+			}
+			forgetMissing(imagePath)
+			forgetSourceMetadata(imagePath)
 			go eagerlyTransform()
 		}()
 	} else {
-		_, err := saveImage(img, format, baseImagePath)
+		err := save()
 		if err != nil {
-			return http.StatusInternalServerError, uploadError("error saving image: " + err.Error())
+			return "", err
+		}
+		if hash != "" {
+			rememberUploadHash(tenant, hash, imagePath)
 		}
+		forgetMissing(imagePath)
+		forgetSourceMetadata(imagePath)
 		go eagerlyTransform()
 	}
 
-	return http.StatusOK, uploadSuccess(baseImagePath)
+	return baseImagePath, nil
 }
 
 func throttler(perMinRate int) http.Handler {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+const (
+	defaultShadowSampleRatio = 0.01
+	// Shadow comparisons running at the same time, requests sampled while
+	// they all run aren't compared
+	shadowConcurrency = 2
+)
+
+var shadowSlots = make(chan struct{}, shadowConcurrency)
+
+// ShadowComparison describes how an image generated with the candidate
+// configuration differs from the one generated with the active one
+type ShadowComparison struct {
+	Size, CandidateSize         int
+	Duration, CandidateDuration time.Duration
+	SSIM, DifferentPercent      float64
+}
+
+// loadShadowConfig reads the candidate configuration of the shadow section
+func loadShadowConfig(configFilePath string) (*Configuration, error) {
+	m, err := readConfig(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := m["shadow"]; ok {
+		return nil, fmt.Errorf("a candidate configuration can't have a shadow section")
+	}
+	return parseConfig(m)
+}
+
+// shadowRequest processes a sample of image requests with the candidate
+// configuration as well in the background and records how the results differ
+// from those of the active configuration. Responses aren't affected.
+func shadowRequest(parametersStr, imagePath string, transformation Transformation, options requestOptions) {
+	conf := currentConfig()
+	candidate := conf.shadowConfig
+	if candidate == nil || transformation.videoFormat != "" || transformation.webp != nil || rand.Float64() >= conf.shadowSampleRatio {
+		return
+	}
+	select {
+	case shadowSlots <- struct{}{}:
+	default:
+		shadowComparisonsTotal.WithLabelValues("skipped").Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-shadowSlots }()
+		candidateTransformation, _, _, err := resolveTransformation(candidate, parametersStr, imagePath)
+		if err != nil {
+			shadowComparisonsTotal.WithLabelValues("failed").Inc()
+			slog.Warn("shadow request failed", "image", imagePath, "parameters", parametersStr, "error", err)
+			return
+		}
+		options.apply(&candidateTransformation)
+
+		comparison, err := compareShadow(imagePath, &transformation, conf, &candidateTransformation, candidate)
+		if err != nil {
+			shadowComparisonsTotal.WithLabelValues("failed").Inc()
+			slog.Warn("shadow request failed", "image", imagePath, "parameters", parametersStr, "error", err)
+			return
+		}
+		shadowComparisonsTotal.WithLabelValues("compared").Inc()
+		shadowSizeRatio.Observe(float64(comparison.CandidateSize) / float64(comparison.Size))
+		shadowDurationRatio.Observe(comparison.CandidateDuration.Seconds() / comparison.Duration.Seconds())
+		shadowSSIM.Observe(comparison.SSIM)
+		slog.Info("shadow request compared", "image", imagePath, "parameters", parametersStr,
+			"size", comparison.Size, "candidate_size", comparison.CandidateSize,
+			"duration", comparison.Duration, "candidate_duration", comparison.CandidateDuration,
+			"ssim", comparison.SSIM, "different_percent", comparison.DifferentPercent)
+	}()
+}
+
+// compareShadow generates an image with both configurations using the Go
+// pipeline and compares the results
+func compareShadow(imagePath string, transformation *Transformation, conf *Configuration, candidateTransformation *Transformation, candidate *Configuration) (*ShadowComparison, error) {
+	data, err := fetchImage(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	img, format, err := decodeImage(data, imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, duration, err := shadowGenerate(img, format, imagePath, transformation, conf)
+	if err != nil {
+		return nil, err
+	}
+	candidateEncoded, candidateDuration, err := shadowGenerate(img, format, imagePath, candidateTransformation, candidate)
+	if err != nil {
+		return nil, fmt.Errorf("candidate: %s", err)
+	}
+
+	result, _, err := image.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	candidateResult, _, err := image.Decode(bytes.NewReader(candidateEncoded))
+	if err != nil {
+		return nil, fmt.Errorf("candidate: %s", err)
+	}
+	diff, err := diffImages(result, candidateResult, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowComparison{len(encoded), len(candidateEncoded), duration, candidateDuration, diff.SSIM, diff.DifferentPercent}, nil
+}
+
+// shadowGenerate transforms and encodes an image with the encoding settings
+// of a configuration and returns how long it took
+func shadowGenerate(img image.Image, format, imagePath string, transformation *Transformation, conf *Configuration) ([]byte, time.Duration, error) {
+	start := time.Now()
+	imgNew, err := transformCropAndResize(img, format, imagePath, transformation)
+	if err != nil {
+		return nil, 0, err
+	}
+	jpegOptions := &jpegenc.Options{Quality: transformation.quality, Subsampling: conf.jpegSubsampling}
+	if jpegOptions.Quality == 0 {
+		jpegOptions.Quality = conf.jpegQuality
+	}
+	if transformation.subsampling != "" {
+		jpegOptions.Subsampling = parseSubsampling(transformation.subsampling)
+	}
+	pngOptions := transformation.pngOptimization
+	if pngOptions == nil {
+		pngOptions = conf.pngOptimization
+	}
+
+	format = transformation.forSource(img.Bounds().Dx(), img.Bounds().Dy(), format).outputFormat(format)
+	var buffer bytes.Buffer
+	if transformation.autoQuality && transformation.quality == 0 && format != "png" {
+		err = encodeAutoQuality(imgNew, jpegOptions.Subsampling, &buffer)
+	} else {
+		err = writeImageWithOptions(imgNew, format, jpegOptions, pngOptions, &buffer)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return buffer.Bytes(), time.Since(start), nil
+}
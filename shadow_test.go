@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestShadowGenerate(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(256))
+	}
+	img.Set(0, 0, color.White)
+	params := engine.Params{Width: 32, Height: 32, Scale: 1, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	transformation := &Transformation{params: &params}
+
+	high, _, err := shadowGenerate(img, "jpeg", "a.jpg", transformation, &Configuration{jpegQuality: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	low, _, err := shadowGenerate(img, "jpeg", "a.jpg", transformation, &Configuration{jpegQuality: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(low) >= len(high) {
+		t.Errorf("Expected the candidate's quality to be used, got %d bytes at q20 and %d at q95", len(low), len(high))
+	}
+
+	decoded, _, err := image.DecodeConfig(bytes.NewReader(low))
+	if err != nil || decoded.Width != 32 || decoded.Height != 32 {
+		t.Errorf("Unexpected shadow image: %+v, %v", decoded, err)
+	}
+}
+
+func TestParseShadowConfig(t *testing.T) {
+	invalid := []map[interface{}]interface{}{
+		{"shadow": map[interface{}]interface{}{}},
+		{"shadow": map[interface{}]interface{}{"config": "missing.yaml"}},
+	}
+	for _, m := range invalid {
+		if _, err := parseConfig(m); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	urlSigningSecretEnvVar = "PIXLSERV_URL_SIGNING_SECRET"
+
+	parameterSignature = "s"
+	parameterExpires   = "e"
+)
+
+var (
+	urlSigningSecret string
+)
+
+// signingInit loads the secret used to sign image URLs when signing is enabled
+func signingInit() error {
+	urlSigningSecret = os.Getenv(urlSigningSecretEnvVar)
+	return checkURLSigning(currentConfig())
+}
+
+// checkURLSigning makes sure there is a secret when a configuration signs URLs
+func checkURLSigning(c *Configuration) error {
+	if (c.signedURLs || c.socialCardsSigned) && urlSigningSecret == "" {
+		return fmt.Errorf("%s not set", urlSigningSecretEnvVar)
+	}
+	return nil
+}
+
+// Removes all parameters with the given key from a parameters string like
+// "w_400,h_300,s_abc", returns the remaining parameters and the value of the
+// last removed one.
+func removeParameter(parametersStr, key string) (string, string) {
+	return removeParameterIf(parametersStr, key, func(string) bool { return true })
+}
+
+// removeExpiry removes expiries like removeParameter does, Cloudinary's
+// effects (e.g. e_grayscale) share the key but aren't timestamps
+func removeExpiry(parametersStr string) (string, string) {
+	return removeParameterIf(parametersStr, parameterExpires, func(value string) bool {
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	})
+}
+
+// removeParameterIf removes the parameters with the given key whose values
+// match
+func removeParameterIf(parametersStr, key string, match func(string) bool) (string, string) {
+	parts := strings.Split(parametersStr, ",")
+	kept := make([]string, 0, len(parts))
+	value := ""
+	for _, part := range parts {
+		if strings.HasPrefix(part, key+"_") && match(part[len(key)+1:]) {
+			value = part[len(key)+1:]
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ","), value
+}
+
+// urlSignature computes the signature of an image URL, it covers all
+// parameters except for the signature itself (including the expiry) and
+// the image path
+func urlSignature(unsignedParameters, imagePath, secret string) string {
+	return hex.EncodeToString(hmacSHA256([]byte(secret), unsignedParameters+"/"+imagePath))
+}
+
+// signURL returns parameters including a signature for an image path,
+// expires is a Unix timestamp (0 = the URL never expires)
+func signURL(parametersStr, imagePath, secret string, expires int64) string {
+	if expires > 0 {
+		parametersStr += "," + parameterExpires + "_" + strconv.FormatInt(expires, 10)
+	}
+	return parametersStr + "," + parameterSignature + "_" + urlSignature(parametersStr, imagePath, secret)
+}
+
+// verifyURLSignature checks the signature and expiry in a parameters string
+// and returns the parameters without them
+func verifyURLSignature(parametersStr, imagePath, secret string, now time.Time) (string, error) {
+	unsigned, signature := removeParameter(parametersStr, parameterSignature)
+	rest, expiresStr := removeExpiry(unsigned)
+	if signature == "" {
+		return rest, errors.New("missing signature")
+	}
+
+	decodedSignature, err := hex.DecodeString(signature)
+	if err != nil {
+		return rest, errors.New("invalid signature")
+	}
+	expected, _ := hex.DecodeString(urlSignature(unsigned, imagePath, secret))
+	if !hmac.Equal(decodedSignature, expected) {
+		return rest, errors.New("invalid signature")
+	}
+
+	if expiresStr != "" {
+		// Only numeric values are taken for expiries
+		expires, _ := strconv.ParseInt(expiresStr, 10, 64)
+		if now.Unix() > expires {
+			return rest, errors.New("URL expired")
+		}
+	}
+
+	return rest, nil
+}
+
+// stripURLSignature removes a signature and an expiry from parameters when
+// signing is disabled
+func stripURLSignature(parametersStr string) string {
+	unsigned, _ := removeParameter(parametersStr, parameterSignature)
+	rest, _ := removeExpiry(unsigned)
+	return rest
+}
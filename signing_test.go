@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemoveParameter(t *testing.T) {
+	rest, value := removeParameter("w_400,s_abc,h_300", "s")
+	if rest != "w_400,h_300" || value != "abc" {
+		t.Errorf("Unexpected result: %q, %q", rest, value)
+	}
+}
+
+func TestRemoveExpiry(t *testing.T) {
+	rest, value := removeExpiry("w_400,e_grayscale,e_1000")
+	if rest != "w_400,e_grayscale" || value != "1000" {
+		t.Errorf("Unexpected result: %q, %q", rest, value)
+	}
+}
+
+func TestURLSignature(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	signed := signURL("w_400,h_300", "cat.jpg", "secret", 0)
+	rest, err := verifyURLSignature(signed, "cat.jpg", "secret", now)
+	if err != nil || rest != "w_400,h_300" {
+		t.Errorf("Expected a valid signature, got: %q, %v", rest, err)
+	}
+
+	if _, err := verifyURLSignature(signed, "dog.jpg", "secret", now); err == nil {
+		t.Error("Expected the signature not to be valid for another image")
+	}
+	if _, err := verifyURLSignature(signed, "cat.jpg", "other", now); err == nil {
+		t.Error("Expected the signature not to be valid with another secret")
+	}
+	if _, err := verifyURLSignature("w_400,h_300", "cat.jpg", "secret", now); err == nil {
+		t.Error("Expected a missing signature to be rejected")
+	}
+
+	signed = signURL("t_square", "cat.jpg", "secret", 1500)
+	rest, err = verifyURLSignature(signed, "cat.jpg", "secret", now)
+	if err != nil || rest != "t_square" {
+		t.Errorf("Expected a valid signature, got: %q, %v", rest, err)
+	}
+	if _, err := verifyURLSignature(signed, "cat.jpg", "secret", time.Unix(2000, 0)); err == nil {
+		t.Error("Expected the URL to be expired")
+	}
+}
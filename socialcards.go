@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+const (
+	// The size Open Graph and Twitter cards are shown at
+	socialCardWidth  = 1200
+	socialCardHeight = 630
+
+	// Cached cards are named after their background like cat--card_HASH--.jpg
+	socialCardCachePrefix = "card_"
+
+	defaultSocialCardFormat   = "jpg"
+	defaultSocialCardMaxLines = 3
+	maxSocialCardTitleLength  = 300
+)
+
+var errInvalidCardSignature = errors.New("invalid signature")
+
+// SocialCard is a template of social cards (Open Graph images): a background
+// image filling the card, a logo drawn over it like a watermark and a title
+type SocialCard struct {
+	name          string
+	background    string // Used when requests don't name an image, "" for none
+	logo          *Watermark
+	title         *Text // Its content is the title of requests without one
+	titleMaxWidth int
+	titleMaxLines int
+	format        string // jpg or png
+}
+
+// socialCardPayload is what signed requests for cards carry, base64 encoded
+type socialCardPayload struct {
+	Image string `json:"image"`
+	Title string `json:"title"`
+}
+
+// parseSocialCards reads the templates of the social-cards section
+func parseSocialCards(list []interface{}) (map[string]*SocialCard, error) {
+	cards := make(map[string]*SocialCard)
+	for _, item := range list {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid social card template: %v", item)
+		}
+		name, _ := m["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("social card templates need a name")
+		}
+		if _, ok := cards[name]; ok {
+			return nil, fmt.Errorf("duplicate social card template: %s", name)
+		}
+		card, err := parseSocialCard(name, m)
+		if err != nil {
+			return nil, fmt.Errorf("social card template %s: %s", name, err)
+		}
+		cards[name] = card
+	}
+	return cards, nil
+}
+
+func parseSocialCard(name string, m map[interface{}]interface{}) (*SocialCard, error) {
+	card := &SocialCard{name: name, titleMaxLines: defaultSocialCardMaxLines, format: defaultSocialCardFormat}
+	card.background, _ = m["background"].(string)
+	if logo, ok := m["logo"].(map[interface{}]interface{}); ok {
+		var err error
+		card.logo, err = parseWatermark(logo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	title, ok := m["title"].(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("a title needs to be specified")
+	}
+	var err error
+	card.title, err = parseText(title)
+	if err != nil {
+		return nil, err
+	}
+	// Titles keep the same distance from both sides by default
+	card.titleMaxWidth = socialCardWidth - 2*card.title.X
+	if maxWidth, ok := title["max-width"].(int); ok {
+		card.titleMaxWidth = maxWidth
+	}
+	if card.titleMaxWidth < 1 || card.titleMaxWidth > socialCardWidth {
+		return nil, fmt.Errorf("invalid title max-width: %d", card.titleMaxWidth)
+	}
+	if maxLines, ok := title["max-lines"].(int); ok {
+		if maxLines < 0 {
+			return nil, fmt.Errorf("invalid title max-lines: %d", maxLines)
+		}
+		card.titleMaxLines = maxLines
+	}
+
+	if format, ok := m["format"].(string); ok {
+		if _, ok := iiifFormats[format]; !ok {
+			return nil, fmt.Errorf("invalid format: %s (available: jpg, png)", format)
+		}
+		card.format = format
+	}
+	return card, nil
+}
+
+// socialCardSignature computes the signature of a card's payload
+func socialCardSignature(template, payload, secret string) string {
+	return hex.EncodeToString(hmacSHA256([]byte(secret), "cards/"+template+"/"+payload))
+}
+
+// parseRequest returns the path of the background image and the title a
+// request asks for, from the query or a signed payload. Only signed payloads
+// are accepted when signed is true.
+func (card *SocialCard) parseRequest(req *http.Request, signed bool) (string, string, error) {
+	query := req.URL.Query()
+	imagePath, title := query.Get("image"), query.Get("title")
+	if payload := query.Get("payload"); payload != "" {
+		signature := socialCardSignature(card.name, payload, urlSigningSecret)
+		if urlSigningSecret == "" || !hmac.Equal([]byte(query.Get(parameterSignature)), []byte(signature)) {
+			return "", "", errInvalidCardSignature
+		}
+		data, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid payload")
+		}
+		var p socialCardPayload
+		if err := json.Unmarshal(data, &p); err != nil {
+			return "", "", fmt.Errorf("invalid payload")
+		}
+		imagePath, title = p.Image, p.Title
+	} else if signed {
+		return "", "", errInvalidCardSignature
+	}
+
+	if imagePath == "" {
+		imagePath = card.background
+	}
+	if imagePath == "" {
+		return "", "", fmt.Errorf("an image is needed")
+	}
+	if title == "" {
+		title = card.title.Content
+	}
+	if utf8.RuneCountInString(title) > maxSocialCardTitleLength {
+		return "", "", fmt.Errorf("titles can have at most %d characters", maxSocialCardTitleLength)
+	}
+	return imagePath, title, nil
+}
+
+// cachePath returns the name a card is cached under, it is found among the
+// cached variants of the background when purging
+func (card *SocialCard) cachePath(imagePath, title string) (string, error) {
+	i := strings.LastIndex(imagePath, ".")
+	if i == -1 {
+		return "", fmt.Errorf("invalid image path")
+	}
+	h := sha1.New()
+	io.WriteString(h, card.name)
+	io.WriteString(h, card.format)
+	io.WriteString(h, strconv.Itoa(card.titleMaxWidth))
+	io.WriteString(h, strconv.Itoa(card.titleMaxLines))
+	if card.logo != nil {
+		h.Write(card.logo.hash())
+	}
+	h.Write(card.title.hash())
+	io.WriteString(h, title)
+	return imagePath[:i] + "--" + socialCardCachePrefix + hex.EncodeToString(h.Sum(nil)) + cacheNamespaceSuffix(currentConfig().cacheNamespace) + "--" + imagePath[i:], nil
+}
+
+// render composes a card out of a background image and a title
+func (card *SocialCard) render(background image.Image, title string) ([]byte, error) {
+	params := engine.Params{Width: socialCardWidth, Height: socialCardHeight, Scale: 1, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	img := engine.Transform(background, params)
+
+	if card.logo != nil {
+		logo, err := loadWatermark(card.logo.imagePath, 1)
+		if err != nil {
+			slog.Error("loading a logo failed", "path", card.logo.imagePath, "error", err)
+		} else {
+			img = engine.DrawWatermark(img, logo, card.logo.gravity, card.logo.x, card.logo.y, 1)
+		}
+	}
+
+	if title != "" {
+		text := card.title.Text
+		text.Content = title
+		block, err := engine.TextBlock(&text, card.titleMaxWidth, card.titleMaxLines)
+		if err != nil {
+			return nil, err
+		}
+		img = engine.DrawWatermark(img, block, text.Gravity, text.X, text.Y, 1)
+	}
+
+	buffer := getEncodeBuffer()
+	defer putEncodeBuffer(buffer)
+	transformation := &Transformation{}
+	err := writeImageWithOptions(img, iiifFormats[card.format], transformation.jpegOptions(), transformation.pngOptions(), buffer)
+	if err != nil {
+		return nil, err
+	}
+	// The encoded card outlives the buffer in the caches
+	return append([]byte(nil), buffer.Bytes()...), nil
+}
+
+// generateSocialCard composes a card and caches it like other variants of
+// its background image
+func generateSocialCard(ctx context.Context, fullImagePath, imagePath, title string, card *SocialCard) (*generatedImage, error) {
+	sourceInfo, err := statSource(imagePath)
+	if err == ErrNotFound {
+		rememberMissing(imagePath)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := fetchImage(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = processingPool.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer processingPool.release()
+	background, _, err := decodeImage(data, imagePath)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := card.render(background, title)
+	if err != nil {
+		slog.Error("composing a social card failed", "path", fullImagePath, "error", err)
+		return nil, err
+	}
+	hotCache.put(fullImagePath, encoded)
+	cacheRecordMiss(len(encoded))
+
+	// Cache the card asynchronously to speed up the response
+	go func() {
+		err := addEncodedToCache(fullImagePath, encoded, iiifFormats[card.format])
+		if err != nil {
+			slog.Error("saving an image to cache failed", "path", fullImagePath, "error", err)
+			return
+		}
+		setCacheSource(fullImagePath, sourceInfo)
+		setCacheExpiry(fullImagePath, nil)
+	}()
+	return &generatedImage{encoded, sourceInfo.ModTime, nil}, nil
+}
+
+func socialCardHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Cards are written to the response by serveSocialCard itself
+	status, body := serveSocialCard(params, req, res)
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// serveSocialCard answers requests for social cards, which are composed when
+// first requested and cached
+func serveSocialCard(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, ReadPermission) {
+		return http.StatusUnauthorized, ""
+	}
+	card, ok := currentConfig().socialCards[params["template"]]
+	if !ok {
+		return http.StatusNotFound, "Unknown card template: " + params["template"]
+	}
+	requestedPath, title, err := card.parseRequest(req, currentConfig().socialCardsSigned || currentConfig().signedURLs)
+	if err == errInvalidCardSignature {
+		return http.StatusForbidden, err.Error()
+	}
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	imagePath, err := tenantFor(req).storagePath(requestedPath)
+	if err != nil {
+		return http.StatusNotFound, "Image not found: " + requestedPath
+	}
+	fullImagePath, err := card.cachePath(imagePath, title)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	return serveRegionImage(params, req, res, imagePath, fullImagePath, iiifErrorStatus, func(ctx context.Context) (*generatedImage, error) {
+		return generateSocialCard(ctx, fullImagePath, imagePath, title, card)
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testSocialCard(t *testing.T) *SocialCard {
+	cards, err := parseSocialCards([]interface{}{
+		map[interface{}]interface{}{
+			"name":       "article",
+			"background": "cards/default.jpg",
+			"title": map[interface{}]interface{}{
+				"content":   "Example",
+				"size":      48,
+				"color":     "#ffffff",
+				"gravity":   "sw",
+				"x-pos":     60,
+				"y-pos":     60,
+				"max-lines": 2,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	card := cards["article"]
+	if card == nil || card.titleMaxWidth != 1080 || card.titleMaxLines != 2 || card.format != "jpg" {
+		t.Fatalf("Unexpected card: %+v", card)
+	}
+	return card
+}
+
+func TestParseSocialCards(t *testing.T) {
+	testSocialCard(t)
+	invalid := []map[interface{}]interface{}{
+		{"title": map[interface{}]interface{}{"size": 48, "color": "#ffffff", "gravity": "sw"}},
+		{"name": "article"},
+		{"name": "article", "title": map[interface{}]interface{}{"size": 48, "color": "#ffffff", "gravity": "sw", "max-width": 2000}},
+		{"name": "article", "format": "gif", "title": map[interface{}]interface{}{"size": 48, "color": "#ffffff", "gravity": "sw"}},
+	}
+	for _, m := range invalid {
+		if _, err := parseSocialCards([]interface{}{m}); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
+
+func TestSocialCardRequest(t *testing.T) {
+	card := testSocialCard(t)
+	oldSecret := urlSigningSecret
+	defer func() { urlSigningSecret = oldSecret }()
+	urlSigningSecret = "secret"
+
+	req := httptest.NewRequest("GET", "/cards/article?image=photos/cat.jpg&title=Cats+of+the+week", nil)
+	imagePath, title, err := card.parseRequest(req, false)
+	if err != nil || imagePath != "photos/cat.jpg" || title != "Cats of the week" {
+		t.Errorf("Unexpected result: %s, %q, %v", imagePath, title, err)
+	}
+	if _, _, err := card.parseRequest(req, true); err != errInvalidCardSignature {
+		t.Errorf("Expected unsigned requests to be refused, got: %v", err)
+	}
+	req = httptest.NewRequest("GET", "/cards/article", nil)
+	if imagePath, title, err := card.parseRequest(req, false); err != nil || imagePath != "cards/default.jpg" || title != "Example" {
+		t.Errorf("Expected the defaults, got: %s, %q, %v", imagePath, title, err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"image":"photos/dog.jpg","title":"Dogs"}`))
+	query := url.Values{"payload": {payload}, "s": {socialCardSignature("article", payload, "secret")}}
+	req = httptest.NewRequest("GET", "/cards/article?"+query.Encode(), nil)
+	if imagePath, title, err := card.parseRequest(req, true); err != nil || imagePath != "photos/dog.jpg" || title != "Dogs" {
+		t.Errorf("Unexpected result: %s, %q, %v", imagePath, title, err)
+	}
+	query.Set("s", socialCardSignature("other", payload, "secret"))
+	req = httptest.NewRequest("GET", "/cards/article?"+query.Encode(), nil)
+	if _, _, err := card.parseRequest(req, false); err != errInvalidCardSignature {
+		t.Errorf("Expected an invalid signature, got: %v", err)
+	}
+}
+
+func TestSocialCardCachePath(t *testing.T) {
+	card := testSocialCard(t)
+	a, err := card.cachePath("photos/cat.jpg", "Cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := card.cachePath("photos/cat.jpg", "More cats")
+	if a == b || a[:len("photos/cat--card_")] != "photos/cat--card_" {
+		t.Errorf("Unexpected cache paths: %s, %s", a, b)
+	}
+}
+
+func TestSocialCardRender(t *testing.T) {
+	card := testSocialCard(t)
+	background := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	for i := range background.Pix {
+		background.Pix[i] = 0x80
+	}
+	encoded, err := card.render(background, "A title long enough to be wrapped onto a second line of the card")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 1200 || img.Bounds().Dy() != 630 {
+		t.Errorf("Unexpected card size: %v", img.Bounds())
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// SourceMetadata describes an original image as read from its headers
+type SourceMetadata struct {
+	FileInfo
+	Format        string
+	Width, Height int
+	Orientation   int // EXIF orientation, 1 when there is none
+	Frames        int
+}
+
+func sourceMetadataKey(imagePath string) string {
+	return "sourcemeta:" + imagePath
+}
+
+// probeSource reads the metadata of an original image from its headers
+// without decoding it, after checking its format and size
+func probeSource(info *FileInfo, data []byte) (*SourceMetadata, error) {
+	format, err := checkImage(data)
+	if err != nil {
+		return nil, err
+	}
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, unsupportedFormatError(fmt.Sprintf("cannot decode image: %q", info.Path))
+	}
+	frames := 1
+	if format == "gif" {
+		frames = gifFrameCount(bufio.NewReader(bytes.NewReader(data)), math.MaxInt32)
+	}
+	return &SourceMetadata{*info, format, imageConfig.Width, imageConfig.Height, exifOrientation(data, format), frames}, nil
+}
+
+// check applies the allowed formats and the limits of the configuration to
+// metadata remembered from before, as checkImage does to the image itself
+func (m *SourceMetadata) check() error {
+	if !containsString(currentConfig().allowedFormats, m.Format) {
+		return unsupportedFormatError("image format not allowed: " + m.Format)
+	}
+	pixels := m.Width * m.Height
+	if currentConfig().sourceMaxPixels > 0 && pixels > currentConfig().sourceMaxPixels {
+		return imageTooLargeError(fmt.Sprintf("too many pixels: %d, allowed: %d", pixels, currentConfig().sourceMaxPixels))
+	}
+	if currentConfig().sourceMaxFrames > 0 && m.Frames > currentConfig().sourceMaxFrames {
+		return imageTooLargeError(fmt.Sprintf("too many frames: more than %d", currentConfig().sourceMaxFrames))
+	}
+	return nil
+}
+
+// Returns the remembered metadata of an original image, nil if there is
+// none or it expired.
+func cachedSourceMetadata(imagePath string) *SourceMetadata {
+	if currentConfig().cacheMetadataTTL == 0 {
+		return nil
+	}
+	values, err := redis.StringMap(Conn.Do("HGETALL", sourceMetadataKey(imagePath)))
+	if err != nil || values["format"] == "" {
+		sourceMetadataLookupsTotal.WithLabelValues("miss").Inc()
+		return nil
+	}
+	sourceMetadataLookupsTotal.WithLabelValues("hit").Inc()
+	m := &SourceMetadata{FileInfo: FileInfo{Path: imagePath, ETag: values["etag"]}, Format: values["format"]}
+	m.Size, _ = strconv.ParseInt(values["size"], 10, 64)
+	modified, _ := strconv.ParseInt(values["modified"], 10, 64)
+	m.ModTime = time.Unix(0, modified)
+	m.Width, _ = strconv.Atoi(values["width"])
+	m.Height, _ = strconv.Atoi(values["height"])
+	m.Orientation, _ = strconv.Atoi(values["orientation"])
+	m.Frames, _ = strconv.Atoi(values["frames"])
+	return m
+}
+
+// Remembers the metadata of an original image for the configured time so
+// that requests for other variants of it don't need to ask the storage.
+func setSourceMetadata(imagePath string, m *SourceMetadata) {
+	if currentConfig().cacheMetadataTTL == 0 {
+		return
+	}
+	key := sourceMetadataKey(imagePath)
+	Conn.Do("HMSET", key, "size", m.Size, "modified", m.ModTime.UnixNano(), "etag", m.ETag,
+		"format", m.Format, "width", m.Width, "height", m.Height, "orientation", m.Orientation, "frames", m.Frames)
+	Conn.Do("EXPIRE", key, currentConfig().cacheMetadataTTL)
+}
+
+// Forgets the metadata of an original image, e.g. when it gets replaced.
+func forgetSourceMetadata(imagePath string) {
+	if currentConfig().cacheMetadataTTL == 0 {
+		return
+	}
+	Conn.Do("DEL", sourceMetadataKey(imagePath))
+}
+
+// rememberSource probes an original image which was fetched anyway and
+// remembers its metadata unless it is remembered already
+func rememberSource(imagePath string, info *FileInfo, data []byte) {
+	if currentConfig().cacheMetadataTTL == 0 {
+		return
+	}
+	exists, err := redis.Bool(Conn.Do("EXISTS", sourceMetadataKey(imagePath)))
+	if err != nil || exists {
+		return
+	}
+	m, err := probeSource(info, data)
+	if err == nil {
+		setSourceMetadata(imagePath, m)
+	}
+}
+
+// statSource returns the version of an original image, from its remembered
+// metadata when there is some and from the storage otherwise
+func statSource(imagePath string) (*FileInfo, error) {
+	if m := cachedSourceMetadata(imagePath); m != nil {
+		return &m.FileInfo, nil
+	}
+	return storageImpl.Stat(imagePath)
+}
+
+// sourceMetadata returns the metadata of an original image, it is only
+// fetched from the storage and probed when it isn't remembered
+func sourceMetadata(imagePath string) (*SourceMetadata, error) {
+	if m := cachedSourceMetadata(imagePath); m != nil {
+		return m, m.check()
+	}
+	info, err := storageImpl.Stat(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fetchImage(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := probeSource(info, data)
+	if err != nil {
+		return nil, err
+	}
+	setSourceMetadata(imagePath, m)
+	return m, nil
+}
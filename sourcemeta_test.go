@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+func TestProbeSource(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{allowedFormats: []string{"jpeg", "gif"}})
+
+	var jpegData bytes.Buffer
+	jpeg.Encode(&jpegData, image.NewGray(image.Rect(0, 0, 40, 30)), nil)
+	info := &FileInfo{Path: "cat.jpg", Size: 123, ModTime: time.Unix(1700000000, 0), ETag: "abc"}
+	m, err := probeSource(info, setJPEGEXIF(jpegData.Bytes(), testEXIF()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Format != "jpeg" || m.Width != 40 || m.Height != 30 || m.Orientation != 6 || m.Frames != 1 || m.FileInfo != *info {
+		t.Errorf("Unexpected metadata: %+v", m)
+	}
+	if m, err := probeSource(info, jpegData.Bytes()); err != nil || m.Orientation != 1 {
+		t.Errorf("Expected the orientation to default to 1: %+v, %v", m, err)
+	}
+
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), palette.Plan9))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var gifData bytes.Buffer
+	gif.EncodeAll(&gifData, anim)
+	m, err = probeSource(info, gifData.Bytes())
+	if err != nil || m.Format != "gif" || m.Frames != 3 {
+		t.Errorf("Unexpected metadata of an animation: %+v, %v", m, err)
+	}
+
+	if _, err := probeSource(info, []byte("not an image")); err == nil {
+		t.Error("Expected an error for data which isn't an image")
+	}
+}
+
+func TestSourceMetadataCheck(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{allowedFormats: []string{"jpeg", "gif"}, sourceMaxPixels: 10000, sourceMaxFrames: 5})
+
+	if err := (&SourceMetadata{Format: "jpeg", Width: 100, Height: 100, Frames: 1}).check(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, ok := (&SourceMetadata{Format: "png", Width: 10, Height: 10, Frames: 1}).check().(unsupportedFormatError); !ok {
+		t.Error("Expected formats which are no longer allowed to be rejected")
+	}
+	if _, ok := (&SourceMetadata{Format: "jpeg", Width: 101, Height: 100, Frames: 1}).check().(imageTooLargeError); !ok {
+		t.Error("Expected the image to have too many pixels")
+	}
+	if _, ok := (&SourceMetadata{Format: "gif", Width: 10, Height: 10, Frames: 6}).check().(imageTooLargeError); !ok {
+		t.Error("Expected the animation to have too many frames")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+// Max. number of images in a sprite sheet
+const maxSpriteImages = 256
+
+// SpriteSheetResponse has a sprite sheet as a data URI and where each image
+// is on it
+type SpriteSheetResponse struct {
+	Status       string                       `json:"status"`
+	ErrorMessage string                       `json:"errorMessage,omitempty"`
+	Width        int                          `json:"width,omitempty"`
+	Height       int                          `json:"height,omitempty"`
+	Image        string                       `json:"image,omitempty"`
+	Sprites      map[string]SpriteCoordinates `json:"sprites,omitempty"`
+}
+
+// SpriteCoordinates is the part of a sprite sheet showing an image
+type SpriteCoordinates struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// spriteSheetRequest is a parsed request for a sprite sheet
+type spriteSheetRequest struct {
+	images                []string
+	cellWidth, cellHeight int
+	columns               int
+	cropping, format      string
+}
+
+// parseSpriteSheetRequest reads the images (repeated or comma separated),
+// the size of the cells (e.g. 64x64) and optionally the number of columns,
+// the cropping mode and the format (png or jpg) of a request
+func parseSpriteSheetRequest(req *http.Request) (*spriteSheetRequest, error) {
+	err := req.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	r := &spriteSheetRequest{cropping: engine.CroppingModeAll, format: "png"}
+	for _, value := range req.Form["images"] {
+		for _, imagePath := range strings.Split(value, ",") {
+			if imagePath = strings.TrimSpace(imagePath); imagePath != "" {
+				r.images = append(r.images, imagePath)
+			}
+		}
+	}
+	if len(r.images) == 0 || len(r.images) > maxSpriteImages {
+		return nil, fmt.Errorf("between 1 and %d images are needed", maxSpriteImages)
+	}
+
+	size := strings.SplitN(req.FormValue("size"), "x", 2)
+	if len(size) != 2 {
+		return nil, fmt.Errorf("size needs to be like 64x64")
+	}
+	r.cellWidth, err = strconv.Atoi(size[0])
+	if err == nil {
+		r.cellHeight, err = strconv.Atoi(size[1])
+	}
+	if err != nil || r.cellWidth <= 0 || r.cellHeight <= 0 {
+		return nil, fmt.Errorf("invalid size: %s", req.FormValue("size"))
+	}
+
+	r.columns = int(math.Ceil(math.Sqrt(float64(len(r.images)))))
+	if columnsStr := req.FormValue("columns"); columnsStr != "" {
+		r.columns, err = strconv.Atoi(columnsStr)
+		if err != nil || r.columns <= 0 {
+			return nil, fmt.Errorf("invalid columns: %s", columnsStr)
+		}
+		if r.columns > len(r.images) {
+			r.columns = len(r.images)
+		}
+	}
+	if cropping := strings.ToLower(req.FormValue("cropping")); cropping != "" {
+		if !engine.IsValidCroppingMode(cropping) {
+			return nil, fmt.Errorf("invalid cropping: %s", cropping)
+		}
+		r.cropping = cropping
+	}
+	if format := req.FormValue("format"); format != "" {
+		var ok bool
+		r.format, ok = iiifFormats[format]
+		if !ok {
+			return nil, fmt.Errorf("invalid format: %s (available: jpg, png)", format)
+		}
+	}
+	return r, nil
+}
+
+// size returns the size of the sprite sheet
+func (r *spriteSheetRequest) size() (int, int) {
+	rows := (len(r.images) + r.columns - 1) / r.columns
+	return r.columns * r.cellWidth, rows * r.cellHeight
+}
+
+// spriteSheetHandler composites images into a single sprite sheet, each of
+// them resized to fit (or fill with cropping=p) a cell and centred in it
+func spriteSheetHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if !isAuthorised(params, req, ReadPermission) {
+		return jsonResponse(res, http.StatusUnauthorized, SpriteSheetResponse{Status: "error", ErrorMessage: "API key invalid or missing"})
+	}
+	r, err := parseSpriteSheetRequest(req)
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, SpriteSheetResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+	width, height := r.size()
+	err = engine.Params{Width: width, Height: height, Scale: 1}.CheckLimits(currentConfig().outputLimits())
+	if err != nil {
+		return jsonResponse(res, http.StatusBadRequest, SpriteSheetResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+
+	tenant := tenantFor(req)
+	images := make([]image.Image, len(r.images))
+	for i, requestedPath := range r.images {
+		imagePath, err := tenant.storagePath(requestedPath)
+		if err == nil {
+			images[i], err = loadStoredImage(imagePath)
+		}
+		if err == ErrNotFound || err == errTenantImageNotFound {
+			return jsonResponse(res, http.StatusNotFound, SpriteSheetResponse{Status: "error", ErrorMessage: "Image not found: " + requestedPath})
+		}
+		if err != nil {
+			return jsonResponse(res, iiifErrorStatus(err), SpriteSheetResponse{Status: "error", ErrorMessage: err.Error()})
+		}
+	}
+
+	err = processingPool.acquire(req.Context())
+	if err != nil {
+		res.Header().Set("Retry-After", strconv.Itoa(currentConfig().processingRetryAfter))
+		return jsonResponse(res, currentConfig().processingOverloadStatus, SpriteSheetResponse{Status: "error", ErrorMessage: err.Error()})
+	}
+	sheet, sprites := r.composite(images)
+	buffer := getEncodeBuffer()
+	defer putEncodeBuffer(buffer)
+	err = writeImage(sheet, r.format, buffer)
+	processingPool.release()
+	if err != nil {
+		slog.Error("encoding a sprite sheet failed", "error", err)
+		return jsonResponse(res, http.StatusInternalServerError, SpriteSheetResponse{Status: "error", ErrorMessage: "server error"})
+	}
+
+	return jsonResponse(res, http.StatusOK, SpriteSheetResponse{
+		Status:  "ok",
+		Width:   width,
+		Height:  height,
+		Image:   "data:" + contentTypeFor(r.format) + ";base64," + base64.StdEncoding.EncodeToString(buffer.Bytes()),
+		Sprites: sprites,
+	})
+}
+
+// loadStoredImage fetches and decodes a stored image, remembering missing ones
+func loadStoredImage(imagePath string) (image.Image, error) {
+	if isKnownMissing(imagePath) {
+		return nil, ErrNotFound
+	}
+	data, err := fetchImage(imagePath)
+	if err == ErrNotFound {
+		rememberMissing(imagePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := decodeImage(data, imagePath)
+	return img, err
+}
+
+// composite draws the images into their cells row by row and returns where
+// each of them ended up, by their paths
+func (r *spriteSheetRequest) composite(images []image.Image) (image.Image, map[string]SpriteCoordinates) {
+	width, height := r.size()
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	sprites := make(map[string]SpriteCoordinates, len(images))
+	for i, img := range images {
+		params := engine.Params{Width: r.cellWidth, Height: r.cellHeight, Scale: 1, Cropping: r.cropping, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+		resized := engine.Transform(img, params)
+		bounds := resized.Bounds()
+
+		cell := image.Pt(i%r.columns*r.cellWidth, i/r.columns*r.cellHeight)
+		// Images smaller than the cell are centred in it
+		offset := image.Pt((r.cellWidth-bounds.Dx())/2, (r.cellHeight-bounds.Dy())/2)
+		dst := image.Rectangle{cell.Add(offset), cell.Add(offset).Add(bounds.Size())}
+		draw.Draw(sheet, dst, resized, bounds.Min, draw.Src)
+		sprites[r.images[i]] = SpriteCoordinates{dst.Min.X, dst.Min.Y, dst.Dx(), dst.Dy()}
+	}
+	return sheet, sprites
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseSpriteSheetRequest(t *testing.T) {
+	form := url.Values{"images": {"icons/a.png,icons/b.png", "icons/c.png"}, "size": {"32x16"}}
+	req := httptest.NewRequest("POST", "/sprites", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r, err := parseSpriteSheetRequest(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(r.images) != 3 || r.cellWidth != 32 || r.cellHeight != 16 || r.columns != 2 || r.format != "png" {
+		t.Errorf("Unexpected request: %+v", r)
+	}
+	if width, height := r.size(); width != 64 || height != 32 {
+		t.Errorf("Expected a sheet of 64x32, got: %dx%d", width, height)
+	}
+
+	for _, query := range []string{"size=32x32", "images=a.png", "images=a.png&size=32", "images=a.png&size=32x32&columns=0", "images=a.png&size=32x32&format=gif"} {
+		req := httptest.NewRequest("POST", "/sprites?"+query, nil)
+		if _, err := parseSpriteSheetRequest(req); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestSpriteSheetComposite(t *testing.T) {
+	r := &spriteSheetRequest{images: []string{"wide.png", "square.png", "tall.png"}, cellWidth: 20, cellHeight: 20, columns: 2, cropping: "a", format: "png"}
+	wide := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	square := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	tall := image.NewRGBA(image.Rect(0, 0, 10, 40))
+	for _, img := range []*image.RGBA{wide, square, tall} {
+		for i := range img.Pix {
+			img.Pix[i] = 255
+		}
+	}
+
+	sheet, sprites := r.composite([]image.Image{wide, square, tall})
+	if sheet.Bounds() != image.Rect(0, 0, 40, 40) {
+		t.Errorf("Unexpected bounds: %v", sheet.Bounds())
+	}
+	expected := map[string]SpriteCoordinates{
+		"wide.png":   {0, 5, 20, 10},
+		"square.png": {20, 0, 20, 20},
+		"tall.png":   {7, 20, 5, 20},
+	}
+	for path, coordinates := range expected {
+		if sprites[path] != coordinates {
+			t.Errorf("%s: expected %+v, got: %+v", path, coordinates, sprites[path])
+		}
+	}
+	if c := color.RGBAModel.Convert(sheet.At(10, 2)).(color.RGBA); c.A != 0 {
+		t.Errorf("Expected the space around a sprite to be transparent, got: %v", c)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// srcsetImage is one of the variants of an image listed in a srcset
+type srcsetImage struct {
+	URL     string `json:"url"`
+	Width   int    `json:"width,omitempty"`
+	Density int    `json:"density,omitempty"`
+}
+
+// srcsetVariantName returns the name of the variant of a named
+// transformation at a breakpoint width, e.g. hero-640w
+func srcsetVariantName(name string, width int) string {
+	return name + "-" + strconv.Itoa(width) + "w"
+}
+
+// srcsetVariants returns the transformations resizing the result of a named
+// transformation to each of its breakpoint widths by their names, the height
+// is scaled along when the transformation has both dimensions
+func srcsetVariants(name string, t Transformation) map[string]Transformation {
+	variants := make(map[string]Transformation, len(t.srcset))
+	for _, width := range t.srcset {
+		params := *t.params
+		if params.Width > 0 && params.Height > 0 {
+			params.Height = (params.Height*width + params.Width/2) / params.Width
+		} else {
+			params.Height = 0
+		}
+		params.Width = width
+		variant := t
+		variant.params = &params
+		variant.srcset = nil
+		variants[srcsetVariantName(name, width)] = variant
+	}
+	return variants
+}
+
+// srcsetHandler lists the URLs of the breakpoint variants of an image for a
+// named transformation, or of its variants at each of its densities (e.g.
+// photo@2x.jpg), as JSON or as a srcset attribute with format=text.
+// With warm=true the variants which aren't cached are generated in the
+// background.
+func srcsetHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	// Listed URLs are signed like the request with the same expiry
+	tenant := tenantFor(req)
+	conf := tenant.config()
+	parametersStr, signed, status, body := authoriseImageRequest(params, req, tenant, conf)
+	if status != 0 {
+		return status, body
+	}
+	expires := int64(0)
+	if signed {
+		unsigned, _ := removeParameter(params["parameters"], parameterSignature)
+		_, expiresStr := removeExpiry(unsigned)
+		expires, _ = strconv.ParseInt(expiresStr, 10, 64)
+	}
+
+	name := parseTransformationName(parametersStr)
+	transformation, ok := conf.transformations[name]
+	if !ok {
+		return http.StatusBadRequest, fmt.Sprintf("Unknown transformation: %s", parametersStr)
+	}
+	if len(transformation.srcset) == 0 && len(transformation.densities) == 0 {
+		return http.StatusBadRequest, fmt.Sprintf("No srcset widths or densities configured for %s", name)
+	}
+	// Listed URLs keep the version token
+	imagePath := params["_1"]
+	requestedPath, version := splitVersion(imagePath)
+	storagePath, err := tenant.storagePath(requestedPath)
+	if err != nil {
+		return http.StatusNotFound, "Image not found: " + requestedPath
+	}
+
+	prefix := tenantURLPrefix(req) + "/"
+	if key := params["apikey"]; key != "" {
+		prefix += key + "/"
+	}
+	images := make([]srcsetImage, 0, len(transformation.srcset)+len(transformation.densities))
+	candidates := make([]string, 0, cap(images))
+	for _, width := range transformation.srcset {
+		variantParameters := "t_" + srcsetVariantName(name, width)
+		if signed {
+			variantParameters = signURL(variantParameters, imagePath, tenant.urlSigningSecret(), expires)
+		}
+		url := prefix + "image/" + variantParameters + "/" + imagePath
+		images = append(images, srcsetImage{url, width, 0})
+		candidates = append(candidates, url+" "+strconv.Itoa(width)+"w")
+	}
+	for _, density := range transformation.densities {
+		scaledPath, err := densityPath(imagePath, density)
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		variantParameters := "t_" + name
+		if signed {
+			variantParameters = signURL(variantParameters, scaledPath, tenant.urlSigningSecret(), expires)
+		}
+		url := prefix + "image/" + variantParameters + "/" + scaledPath
+		images = append(images, srcsetImage{url, transformation.params.Width * density, density})
+		candidates = append(candidates, url+" "+strconv.Itoa(density)+"x")
+	}
+	srcset := strings.Join(candidates, ", ")
+
+	if req.URL.Query().Get("warm") == "true" {
+		if rateLimited(currentConfig().missRateLimiter, rateLimitKey(params, req), res) {
+			return http.StatusTooManyRequests, "Too many requests"
+		}
+		for _, width := range transformation.srcset {
+			variant := conf.transformations[srcsetVariantName(name, width)]
+			variant.version = version
+			go warmVariant(storagePath, variant)
+		}
+		// Variants at each density are transformations of the image itself
+		basePath, _ := parseBasePathAndScale(storagePath)
+		for _, density := range transformation.densities {
+			variant := transformation
+			params := transformation.params.WithScale(density)
+			variant.params = &params
+			variant.version = version
+			go warmVariant(basePath, variant)
+		}
+	}
+
+	if req.URL.Query().Get("format") == "text" {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		return http.StatusOK, srcset
+	}
+	return jsonResponse(res, http.StatusOK, map[string]interface{}{
+		"srcset": srcset,
+		"images": images,
+	})
+}
+
+// densityPath returns the path of an image at a density, e.g. photo@2x.jpg,
+// the path itself at density 1
+func densityPath(imagePath string, density int) (string, error) {
+	basePath, _ := parseBasePathAndScale(imagePath)
+	if density == 1 {
+		return basePath, nil
+	}
+	return constructScaledPath(basePath, density)
+}
+
+// warmVariant generates and caches a transformed image unless it's cached
+// already
+func warmVariant(imagePath string, transformation Transformation) {
+	fullImagePath, err := transformation.createFilePath(imagePath)
+	if err != nil {
+		return
+	}
+	if _, ok := cachedInMemory(fullImagePath); ok {
+		return
+	}
+	if cached, err := openFromCache(fullImagePath); err == nil {
+		cached.Close()
+		return
+	}
+	_, err, _ = inFlight.do(fullImagePath, func() (interface{}, error) {
+		return generateImage(context.Background(), fullImagePath, imagePath, transformation)
+	})
+	if err != nil {
+		slog.Error("warming a srcset variant failed", "path", fullImagePath, "error", err)
+	}
+}
+
+// sortedWidths returns breakpoint widths in ascending order without
+// duplicates
+func sortedWidths(widths []int) []int {
+	sort.Ints(widths)
+	unique := make([]int, 0, len(widths))
+	for _, width := range widths {
+		if len(unique) == 0 || width != unique[len(unique)-1] {
+			unique = append(unique, width)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+func TestSrcsetVariants(t *testing.T) {
+	params := engine.Params{Width: 400, Height: 300, Scale: 1, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	transformation := Transformation{params: &params, srcset: sortedWidths([]int{640, 320, 640, 1000})}
+	if len(transformation.srcset) != 3 || transformation.srcset[0] != 320 || transformation.srcset[2] != 1000 {
+		t.Fatalf("Expected sorted unique widths, got: %v", transformation.srcset)
+	}
+
+	variants := srcsetVariants("hero", transformation)
+	expected := map[string]string{
+		"hero-320w":  "c_p,g_c,h_240,w_320,f_none,s_1",
+		"hero-640w":  "c_p,g_c,h_480,w_640,f_none,s_1",
+		"hero-1000w": "c_p,g_c,h_750,w_1000,f_none,s_1",
+	}
+	if len(variants) != len(expected) {
+		t.Fatalf("Expected %d variants, got: %d", len(expected), len(variants))
+	}
+	for name, parameters := range expected {
+		variant, ok := variants[name]
+		if !ok {
+			t.Errorf("Missing variant %s", name)
+			continue
+		}
+		if variant.params.ToString() != parameters || variant.srcset != nil {
+			t.Errorf("%s: expected: %s, actual: %s", name, parameters, variant.params.ToString())
+		}
+	}
+	if params.Width != 400 {
+		t.Error("Expected the parameters of the transformation to be left alone")
+	}
+
+	// Only the width is set when the height follows the aspect ratio
+	params.Height = 0
+	variant := srcsetVariants("hero", transformation)["hero-640w"]
+	if variant.params.Width != 640 || variant.params.Height != 0 {
+		t.Errorf("Expected a width of 640 only, got: %s", variant.params.ToString())
+	}
+}
+
+func TestDensityPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		density  int
+		expected string
+	}{
+		{"photos/cat.jpg", 1, "photos/cat.jpg"},
+		{"photos/cat.jpg", 2, "photos/cat@2x.jpg"},
+		{"photos/cat@2x.jpg", 3, "photos/cat@3x.jpg"},
+		{"photos/cat@2x.jpg", 1, "photos/cat.jpg"},
+		{"v_1700000000/cat.png", 2, "v_1700000000/cat@2x.png"},
+	}
+	for _, test := range tests {
+		if actual, err := densityPath(test.path, test.density); err != nil || actual != test.expected {
+			t.Errorf("%s at %dx: expected: %s, actual: %s, %v", test.path, test.density, test.expected, actual, err)
+		}
+	}
+}
+
+func TestSrcsetHandlerDensities(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	params := engine.Params{Width: 200, Height: 200, Scale: 1, Cropping: engine.CroppingModeExact, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	setConfig(&Configuration{allowCustomScale: true, transformations: map[string]Transformation{
+		"thumb": {params: &params, densities: []int{1, 2, 3}, access: AccessPublic},
+	}})
+
+	req := httptest.NewRequest("GET", "/srcset/t_thumb/cat.jpg?format=text", nil)
+	status, body := srcsetHandler(martini.Params{"parameters": "t_thumb", "_1": "cat.jpg"}, req, httptest.NewRecorder())
+	expected := "/image/t_thumb/cat.jpg 1x, /image/t_thumb/cat@2x.jpg 2x, /image/t_thumb/cat@3x.jpg 3x"
+	if status != http.StatusOK || body != expected {
+		t.Errorf("Unexpected response: %d %s", status, body)
+	}
+}
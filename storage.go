@@ -2,289 +2,230 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
-	"log"
-	"net/http"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-
-	"code.google.com/p/goauth2/oauth/jwt"
-	gcs "code.google.com/p/google-api-go-client/storage/v1beta1"
-	"github.com/mitchellh/goamz/aws"
-	"github.com/mitchellh/goamz/s3"
-)
-
-const (
-	awsKeyEnvVar    = "AWS_ACCESS_KEY_ID"
-	awsSecretEnvVar = "AWS_SECRET_ACCESS_KEY"
-	s3BucketEnvVar  = "PIXLSERV_S3_BUCKET"
-
-	gcsIssEnvVar    = "GCS_ISS"
-	gcsKeyEnvVar    = "GCS_KEY"
-	gcsBucketEnvVar = "PIXLSERV_GCS_BUCKET"
+	"time"
 )
 
 var (
-	storageImpl storage
-)
-
-type storage interface {
-	init() error
-
-	loadImage(imagePath string) (image.Image, string, error)
-
-	saveImage(img image.Image, format string, imagePath string) (int, error)
-
-	deleteImage(imagePath string) error
-
-	imageExists(imagePath string) bool
-}
-
-func storageInit() error {
-	if os.Getenv(awsKeyEnvVar) != "" && os.Getenv(awsSecretEnvVar) != "" && os.Getenv(s3BucketEnvVar) != "" {
-		storageImpl = new(s3Storage)
-		log.Println("Using S3 storage")
-	} else if os.Getenv(gcsIssEnvVar) != "" && os.Getenv(gcsKeyEnvVar) != "" && os.Getenv(gcsBucketEnvVar) != "" {
-		storageImpl = new(gcsStorage)
-		log.Println("Using GCS storage")
-	} else {
-		storageImpl = new(localStorage)
-		log.Println("Using local storage")
-	}
+	storageImpl      Storage
+	storageName      string
+	storageReplicas  *replicatedStorage // nil without replicas
+	storageFactories = make(map[string]StorageFactory)
 
-	return storageImpl.init()
-}
+	// ErrNotFound is returned by storage backends when a file does not exist
+	ErrNotFound = errors.New("file not found")
+)
 
-func storageCleanUp() {
-}
+// Storage is implemented by all storage backends. Paths are relative to the
+// root of the storage and use forward slashes as separators.
+type Storage interface {
+	// Init is called once before the storage is used
+	Init() error
 
-func loadImage(imagePath string) (image.Image, string, error) {
-	return storageImpl.loadImage(imagePath)
-}
+	// Get returns a reader for the contents of a file, ErrNotFound if there
+	// is no such file
+	Get(path string) (io.ReadCloser, error)
 
-func saveImage(img image.Image, format string, imagePath string) (int, error) {
-	return storageImpl.saveImage(img, format, imagePath)
-}
+	// Put stores a file, overwriting it if it already exists
+	Put(path string, data []byte, contentType string) error
 
-func deleteImage(imagePath string) error {
-	return storageImpl.deleteImage(imagePath)
-}
+	// Delete removes a file
+	Delete(path string) error
 
-func imageExists(imagePath string) bool {
-	return storageImpl.imageExists(imagePath)
-}
+	// List returns paths of all files whose path starts with prefix
+	List(prefix string) ([]string, error)
 
-// localStorage is a storage implementation using local disk
-type localStorage struct {
-	path string
+	// Stat returns information about a file, ErrNotFound if there is no
+	// such file
+	Stat(path string) (*FileInfo, error)
 }
 
-func (s *localStorage) init() error {
-	path := Config.localPath
-	s.path = path
-	return nil
+// FileInfo describes a file kept in storage
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	ETag    string
 }
 
-func (s *localStorage) loadImage(imagePath string) (image.Image, string, error) {
-	reader, err := os.Open(s.path + "/" + imagePath)
-	defer reader.Close()
+// StorageFactory creates a new, uninitialised storage backend
+type StorageFactory func() Storage
 
-	if err != nil {
-		return nil, "", fmt.Errorf("image not found: %q", imagePath)
+// RegisterStorage makes a storage backend available under the given name so
+// that it can be selected using the storage configuration option. Custom
+// backends can be compiled in by adding a file which calls this function
+// from init().
+func RegisterStorage(name string, factory StorageFactory) {
+	if factory == nil {
+		panic("storage: factory is nil for " + name)
 	}
-	img, format, err := image.Decode(reader)
-	if err != nil {
-		return nil, "", fmt.Errorf("cannot decode image: %q", imagePath)
+	if _, ok := storageFactories[name]; ok {
+		panic("storage: registered twice: " + name)
 	}
-	return img, format, nil
+	storageFactories[name] = factory
 }
 
-func (s *localStorage) saveImage(img image.Image, format string, imagePath string) (int, error) {
-	// Open file for writing, overwrite if it already exists
-	fullPath := s.path + "/" + imagePath
-	writer, err := os.Create(fullPath)
-	defer writer.Close()
-
-	if err != nil {
-		return 0, err
-	}
-
-	err = writeImage(img, format, writer)
-	if err != nil {
-		return 0, err
+func storageNames() []string {
+	names := make([]string, 0, len(storageFactories))
+	for name := range storageFactories {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	f, err := os.Open(fullPath)
-	if err != nil {
-		return 0, nil
+func storageInit() error {
+	name := currentConfig().storage
+	if name == "" {
+		name = detectStorage()
 	}
 
-	stat, err := f.Stat()
-	if err != nil {
-		return 0, nil
+	factory, ok := storageFactories[name]
+	if !ok {
+		return fmt.Errorf("unknown storage: %s (available: %s)", name, strings.Join(storageNames(), ", "))
 	}
-	size := stat.Size()
 
-	return int(size), err
-}
-
-func (s *localStorage) deleteImage(imagePath string) error {
-	return os.Remove(s.path + "/" + imagePath)
-}
-
-func (s *localStorage) imageExists(imagePath string) bool {
-	if _, err := os.Stat(s.path + "/" + imagePath); os.IsNotExist(err) {
-		return false
+	backend := factory()
+	if len(currentConfig().storageFallbacks) > 0 {
+		failover, err := newFailoverStorage(backend, name, currentConfig().storageFallbacks, time.Duration(currentConfig().storageFallbackTimeout)*time.Millisecond, currentConfig().storageBackfill)
+		if err != nil {
+			return err
+		}
+		backend = failover
 	}
-	return true
-}
-
-// s3Storage is a storage implementation using Amazon S3
-type s3Storage struct {
-	bucket *s3.Bucket
-}
-
-func (s *s3Storage) init() error {
-	auth, err := aws.EnvAuth()
-	if err != nil {
-		return err
+	storageReplicas = nil
+	if len(currentConfig().storageReplicas) > 0 {
+		replicated, err := newReplicatedStorage(backend, name, currentConfig().storageReplicas)
+		if err != nil {
+			return err
+		}
+		backend = replicated
+		storageReplicas = replicated
 	}
-
-	bucketName := os.Getenv(s3BucketEnvVar)
-	if bucketName == "" {
-		return fmt.Errorf("%s not set", s3BucketEnvVar)
+	storageShards = nil
+	if len(currentConfig().cachePaths) > 0 {
+		storageShards = newShardedStorage(backend, currentConfig().cachePaths)
+		backend = storageShards
 	}
+	storageImpl = &instrumentedStorage{&tenantStorage{backend}, name}
+	storageName = name
+	slog.Info("using storage", "storage", name)
 
-	conn := s3.New(auth, aws.EUWest)
-	s.bucket = conn.Bucket(bucketName)
-
-	return nil
+	return storageImpl.Init()
 }
 
-func (s *s3Storage) loadImage(imagePath string) (image.Image, string, error) {
-	rc, err := s.bucket.GetReader(imagePath)
-	if err != nil {
-		return nil, "", err
+// detectStorage picks one of the built-in backends depending on which
+// environment variables are set
+func detectStorage() string {
+	if os.Getenv(awsKeyEnvVar) != "" && os.Getenv(awsSecretEnvVar) != "" && os.Getenv(s3BucketEnvVar) != "" {
+		return "s3"
+	} else if os.Getenv(gcsIssEnvVar) != "" && os.Getenv(gcsKeyEnvVar) != "" && os.Getenv(gcsBucketEnvVar) != "" {
+		return "gcs"
 	}
-	defer rc.Close()
+	return "local"
+}
 
-	format := strings.TrimLeft(filepath.Ext(imagePath), ".")
-	image, err := readImage(rc, format)
-	if err != nil {
-		return nil, "", err
+func storageCleanUp() {
+	// Writes still being copied to replicas would be lost
+	if storageReplicas != nil {
+		storageReplicas.wait()
 	}
-
-	return image, format, nil
 }
 
-func (s *s3Storage) saveImage(img image.Image, format string, imagePath string) (int, error) {
-	var buffer bytes.Buffer
-	err := writeImage(img, format, &buffer)
+func loadImage(imagePath string) (image.Image, string, error) {
+	data, err := fetchImage(imagePath)
 	if err != nil {
-		return 0, err
+		return nil, "", err
 	}
-
-	size := buffer.Len()
-	return size, s.bucket.Put(imagePath, buffer.Bytes(), "image/"+format, s3.Private)
+	return decodeImage(data, imagePath)
 }
 
-func (s *s3Storage) deleteImage(imagePath string) error {
-	return s.bucket.Del(imagePath)
-}
-
-func (s *s3Storage) imageExists(imagePath string) bool {
-	resp, err := s.bucket.List(imagePath, "/", "", 10)
+// fetchImage reads an original image from the storage
+func fetchImage(imagePath string) ([]byte, error) {
+	reader, err := storageImpl.Get(imagePath)
 	if err != nil {
-		log.Printf("Error while listing S3 bucket: %s\n", err.Error())
-		return false
-	}
-	if resp == nil {
-		log.Println("Error while listing S3 bucket: empty response")
-	}
-
-	for _, element := range resp.Contents {
-		if element.Key == imagePath {
-			return true
-		}
+		return nil, err
 	}
+	defer reader.Close()
 
-	return false
-}
-
-// gcsStorage is a storage implementation using Google Cloud Storage
-type gcsStorage struct {
-	client  *http.Client
-	service *gcs.Service
-	bucket  string
+	return ioutil.ReadAll(reader)
 }
 
-func (s *gcsStorage) init() error {
-	jwtToken := jwt.NewToken(os.Getenv(gcsIssEnvVar), gcs.DevstorageRead_writeScope, []byte(os.Getenv(gcsKeyEnvVar)))
-	oauthToken, err := jwtToken.Assert(http.DefaultClient)
+// checkImage checks the format and size of an original image before it is
+// processed and returns its format
+func checkImage(data []byte) (string, error) {
+	dataReader := bytes.NewReader(data)
+	format, err := checkImageFormat(dataReader, currentConfig().allowedFormats)
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	client := (&jwt.Transport{jwtToken, oauthToken, http.DefaultTransport}).Client()
-
-	service, err := gcs.New(client)
-	if err != nil {
-		return err
+	err = checkImageLimits(dataReader, currentConfig().sourceLimits(format))
+	if _, ok := err.(imageTooLargeError); ok {
+		return "", err
 	}
-
-	s.client = client
-	s.service = service
-	s.bucket = os.Getenv(gcsBucketEnvVar)
-
-	return nil
+	return format, nil
 }
 
-func (s *gcsStorage) loadImage(imagePath string) (image.Image, string, error) {
-	obj, err := s.service.Objects.Get(s.bucket, imagePath).Do()
-	if err != nil {
-		return nil, "", err
-	}
-
-	resp, err := s.client.Get(obj.Media.Link)
+// decodeImage decodes an original image after checking its format and size
+func decodeImage(data []byte, imagePath string) (image.Image, string, error) {
+	_, err := checkImage(data)
 	if err != nil {
 		return nil, "", err
 	}
-	defer resp.Body.Close()
 
-	format := strings.TrimLeft(filepath.Ext(imagePath), ".")
-	image, err := readImage(resp.Body, format)
+	img, format, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return nil, "", err
+		return nil, "", fmt.Errorf("cannot decode image: %q", imagePath)
 	}
-
-	return image, format, nil
+	return img, format, nil
 }
 
-func (s *gcsStorage) saveImage(img image.Image, format string, imagePath string) (int, error) {
-	buffer := &bytes.Buffer{}
-	err := writeImage(img, format, buffer)
+func saveImage(img image.Image, format string, imagePath string) (int, error) {
+	var buffer bytes.Buffer
+	var err error
+	if format == "png" {
+		// Originals keep 16 bits per channel, only transformed images are
+		// dithered down to 8
+		err = png.Encode(&buffer, img)
+	} else {
+		err = writeImage(img, format, &buffer)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	size := buffer.Len()
-	_, err = s.service.Objects.Insert(s.bucket, &gcs.Object{Name: imagePath}).Media(buffer).Do()
+	err = storageImpl.Put(imagePath, buffer.Bytes(), "image/"+format)
 	if err != nil {
 		return 0, err
 	}
-	return size, err
+	return buffer.Len(), nil
 }
 
-func (s *gcsStorage) deleteImage(imagePath string) error {
-	return s.service.Objects.Delete(s.bucket, imagePath).Do()
+func deleteImage(imagePath string) error {
+	return storageImpl.Delete(imagePath)
 }
 
-func (s *gcsStorage) imageExists(imagePath string) bool {
-	obj, err := s.service.Objects.Get(s.bucket, imagePath).Do()
-	if err != nil {
-		return false
+func imageExists(imagePath string) bool {
+	_, err := storageImpl.Stat(imagePath)
+	if err != nil && err != ErrNotFound {
+		slog.Error("checking if an image exists failed", "image", imagePath, "error", err)
 	}
-	return obj != nil
+	return err == nil
+}
+
+// envBool reports whether an environment variable is set to a true value
+// (1, t, true...)
+func envBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// errStorageTimeout is returned when a storage doesn't answer in time and
+// another one can be tried
+var errStorageTimeout = errors.New("storage timed out")
+
+// failoverStorage reads files from a list of backends in order, trying the
+// next one when a file isn't found or a backend fails or is too slow. Files
+// are written to the first backend only.
+type failoverStorage struct {
+	Storage
+	fallbacks []*storageFallback
+	timeout   time.Duration // 0 = no timeout
+	backfill  bool          // Copy files found in a fallback to the first backend
+}
+
+// storageFallback is a backend files are read from when the ones before it
+// don't have them
+type storageFallback struct {
+	Storage
+	name string
+}
+
+// newFailoverStorage creates a storage reading from the registered backends
+// or HTTP origins of the given names when a file isn't in the primary one
+func newFailoverStorage(primary Storage, primaryName string, names []string, timeout time.Duration, backfill bool) (*failoverStorage, error) {
+	s := &failoverStorage{Storage: primary, timeout: timeout, backfill: backfill}
+	seen := map[string]bool{primaryName: true}
+	for _, name := range names {
+		factory, ok := storageFactories[name]
+		if origin, isOrigin := currentConfig().httpOrigins[name]; isOrigin {
+			factory, ok = httpOriginFactory(origin), true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown storage fallback: %s", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("storage fallback used twice: %s", name)
+		}
+		seen[name] = true
+		s.fallbacks = append(s.fallbacks, &storageFallback{&instrumentedStorage{factory(), name}, name})
+	}
+	return s, nil
+}
+
+func (s *failoverStorage) Init() error {
+	err := s.Storage.Init()
+	if err != nil {
+		return err
+	}
+	for _, fallback := range s.fallbacks {
+		err := fallback.Init()
+		if err != nil {
+			return fmt.Errorf("storage fallback %s: %s", fallback.name, err)
+		}
+		slog.Info("falling back to storage", "storage", fallback.name)
+	}
+	return nil
+}
+
+// backends returns the backends in the order they are read from
+func (s *failoverStorage) backends() []Storage {
+	backends := []Storage{s.Storage}
+	for _, fallback := range s.fallbacks {
+		backends = append(backends, fallback)
+	}
+	return backends
+}
+
+type readResult struct {
+	value interface{}
+	err   error
+}
+
+// read runs an operation on a backend, giving up after the timeout unless it
+// is the last backend. Readers returned after giving up are closed.
+func (s *failoverStorage) read(operation func() (interface{}, error), last bool) (interface{}, error) {
+	if s.timeout == 0 || last {
+		return operation()
+	}
+	done := make(chan readResult, 1)
+	go func() {
+		value, err := operation()
+		done <- readResult{value, err}
+	}()
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-timer.C:
+		go func() {
+			result := <-done
+			if reader, ok := result.value.(io.ReadCloser); ok && result.err == nil {
+				reader.Close()
+			}
+		}()
+		return nil, errStorageTimeout
+	}
+}
+
+func (s *failoverStorage) Get(filePath string) (io.ReadCloser, error) {
+	backends := s.backends()
+	var err error
+	for i, backend := range backends {
+		var value interface{}
+		value, err = s.read(func() (interface{}, error) { return backend.Get(filePath) }, i == len(backends)-1)
+		if err == nil {
+			reader := value.(io.ReadCloser)
+			if fallback, ok := backend.(*storageFallback); ok && currentConfig().contentSafetyURL != "" && currentConfig().httpOrigins[fallback.name] != nil {
+				reader, err = s.classifyFile(filePath, reader)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if i > 0 && s.backfill {
+				return s.backfillFile(filePath, reader)
+			}
+			return reader, nil
+		}
+		if err != ErrNotFound {
+			slog.Warn("reading from storage failed, trying the next one", "file", filePath, "error", err)
+		}
+	}
+	return nil, err
+}
+
+// classifyFile checks a file fetched from an HTTP origin with the classifier
+// before it is backfilled or processed
+func (s *failoverStorage) classifyFile(filePath string, reader io.ReadCloser) (io.ReadCloser, error) {
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	err = checkContentSafety(currentConfig(), filePath, contentSourceOrigin, data)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// backfillFile copies a file found in a fallback to the first backend in the
+// background
+func (s *failoverStorage) backfillFile(filePath string, reader io.ReadCloser) (io.ReadCloser, error) {
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := s.Storage.Put(filePath, data, http.DetectContentType(data))
+		if err != nil {
+			slog.Error("backfilling a file failed", "file", filePath, "error", err)
+		}
+	}()
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *failoverStorage) Stat(filePath string) (*FileInfo, error) {
+	backends := s.backends()
+	var err error
+	for i, backend := range backends {
+		var value interface{}
+		value, err = s.read(func() (interface{}, error) { return backend.Stat(filePath) }, i == len(backends)-1)
+		if err == nil {
+			return value.(*FileInfo), nil
+		}
+	}
+	return nil, err
+}
+
+// List returns the paths found in any of the backends, backends which fail
+// are left out
+func (s *failoverStorage) List(prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	var paths []string
+	var err error
+	listed := false
+	for _, backend := range s.backends() {
+		var backendPaths []string
+		backendPaths, err = backend.List(prefix)
+		if err != nil {
+			slog.Warn("listing files in storage failed", "prefix", prefix, "error", err)
+			continue
+		}
+		listed = true
+		for _, path := range backendPaths {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	if !listed {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
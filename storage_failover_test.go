@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// slowStorage answers reads after a delay
+type slowStorage struct {
+	Storage
+	delay time.Duration
+}
+
+func (s *slowStorage) Get(filePath string) (io.ReadCloser, error) {
+	time.Sleep(s.delay)
+	return s.Storage.Get(filePath)
+}
+
+func TestFailoverStorage(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "pixlserv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+
+	primary, fallback := &localStorage{dirs[0]}, &localStorage{dirs[1]}
+	primary.Put("a.jpg", []byte("primary"), "image/jpeg")
+	fallback.Put("a.jpg", []byte("fallback"), "image/jpeg")
+	fallback.Put("dir/b.jpg", []byte("fallback"), "image/jpeg")
+	s := &failoverStorage{Storage: primary, fallbacks: []*storageFallback{{fallback, "fallback"}}}
+
+	for path, expected := range map[string]string{"a.jpg": "primary", "dir/b.jpg": "fallback"} {
+		reader, err := s.Get(path)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", path, err)
+		}
+		data, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if string(data) != expected {
+			t.Errorf("Expected %s to be read from the %s storage, got %q", path, expected, data)
+		}
+	}
+	if _, err := s.Get("c.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Stat("dir/b.jpg"); err != nil {
+		t.Errorf("Expected the fallback storage to be checked, got %v", err)
+	}
+	if paths, _ := s.List(""); len(paths) != 2 || paths[0] != "a.jpg" || paths[1] != "dir/b.jpg" {
+		t.Errorf("Unexpected list result: %v", paths)
+	}
+	if _, err := primary.Stat("dir/b.jpg"); err != ErrNotFound {
+		t.Error("Expected no backfill unless enabled")
+	}
+
+	// Slow storages are skipped
+	s.Storage = &slowStorage{primary, time.Second}
+	s.timeout = 10 * time.Millisecond
+	reader, err := s.Get("a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "fallback" {
+		t.Errorf("Expected a slow storage to be skipped, got %q", data)
+	}
+}
+
+func TestFailoverStorageBackfill(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "pixlserv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+
+	primary, fallback := &localStorage{dirs[0]}, &localStorage{dirs[1]}
+	fallback.Put("a.jpg", []byte("fallback"), "image/jpeg")
+	s := &failoverStorage{Storage: primary, fallbacks: []*storageFallback{{fallback, "fallback"}}, backfill: true}
+	reader, err := s.Get("a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+
+	for i := 0; i < 100; i++ {
+		if _, err = primary.Stat("a.jpg"); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the image to be copied to the primary storage")
+}
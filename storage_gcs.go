@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"code.google.com/p/goauth2/oauth/jwt"
+	gcs "code.google.com/p/google-api-go-client/storage/v1beta1"
+)
+
+const (
+	gcsIssEnvVar    = "GCS_ISS"
+	gcsKeyEnvVar    = "GCS_KEY"
+	gcsBucketEnvVar = "PIXLSERV_GCS_BUCKET"
+)
+
+func init() {
+	RegisterStorage("gcs", func() Storage {
+		return new(gcsStorage)
+	})
+}
+
+// gcsStorage is a storage implementation using Google Cloud Storage
+type gcsStorage struct {
+	client  *http.Client
+	service *gcs.Service
+	bucket  string
+}
+
+func (s *gcsStorage) Init() error {
+	jwtToken := jwt.NewToken(os.Getenv(gcsIssEnvVar), gcs.DevstorageRead_writeScope, []byte(os.Getenv(gcsKeyEnvVar)))
+	oauthToken, err := jwtToken.Assert(http.DefaultClient)
+	if err != nil {
+		return err
+	}
+
+	client := (&jwt.Transport{jwtToken, oauthToken, http.DefaultTransport}).Client()
+
+	service, err := gcs.New(client)
+	if err != nil {
+		return err
+	}
+
+	s.client = client
+	s.service = service
+	s.bucket = os.Getenv(gcsBucketEnvVar)
+
+	return nil
+}
+
+func (s *gcsStorage) Get(path string) (io.ReadCloser, error) {
+	obj, err := s.service.Objects.Get(s.bucket, path).Do()
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	resp, err := s.client.Get(obj.Media.Link)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("downloading %s failed: %s", path, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (s *gcsStorage) Put(path string, data []byte, contentType string) error {
+	object := &gcs.Object{Name: path, Media: &gcs.ObjectMedia{ContentType: contentType}}
+	_, err := s.service.Objects.Insert(s.bucket, object).Media(bytes.NewReader(data)).Do()
+	return err
+}
+
+func (s *gcsStorage) Delete(path string) error {
+	return s.service.Objects.Delete(s.bucket, path).Do()
+}
+
+func (s *gcsStorage) List(prefix string) ([]string, error) {
+	paths := make([]string, 0)
+	pageToken := ""
+	for {
+		objects, err := s.service.Objects.List(s.bucket).Prefix(prefix).PageToken(pageToken).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects.Items {
+			paths = append(paths, obj.Name)
+		}
+		if objects.NextPageToken == "" {
+			return paths, nil
+		}
+		pageToken = objects.NextPageToken
+	}
+}
+
+func (s *gcsStorage) Stat(path string) (*FileInfo, error) {
+	obj, err := s.service.Objects.Get(s.bucket, path).Do()
+	if err != nil || obj == nil {
+		return nil, ErrNotFound
+	}
+
+	info := &FileInfo{Path: path}
+	if obj.Media != nil {
+		info.Size = int64(obj.Media.Length)
+		info.ModTime, _ = time.Parse(time.RFC3339, obj.Media.TimeCreated)
+		info.ETag = obj.Media.Hash
+	}
+	return info, nil
+}
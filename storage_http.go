@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHTTPOriginTimeout = 10000 // Milliseconds
+
+// errReadOnlyStorage is returned when writing to an HTTP origin
+var errReadOnlyStorage = errors.New("storage is read-only")
+
+// httpOrigin is an HTTP server or a bucket images are read from, with the
+// credentials needed for private ones
+type httpOrigin struct {
+	baseURL string
+	timeout int // Milliseconds
+	headers map[string]string
+
+	username, password string // Basic authentication
+
+	awsRegion, awsService string // Requests are signed when a region is set
+}
+
+// parseHTTPOrigins reads the http-origins section, origins are used as
+// storages under their names
+func parseHTTPOrigins(m map[interface{}]interface{}) (map[string]*httpOrigin, error) {
+	origins := make(map[string]*httpOrigin)
+	for key, value := range m {
+		name := fmt.Sprint(key)
+		if _, ok := storageFactories[name]; ok {
+			return nil, fmt.Errorf("invalid HTTP origin name: %s (used by a storage)", name)
+		}
+		settings, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid HTTP origin: %s", name)
+		}
+
+		origin := &httpOrigin{timeout: defaultHTTPOriginTimeout, headers: make(map[string]string)}
+		baseURL, _ := settings["url"].(string)
+		parsed, err := url.Parse(baseURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid url of HTTP origin %s: %s", name, baseURL)
+		}
+		origin.baseURL = strings.TrimSuffix(baseURL, "/") + "/"
+		timeout, ok := settings["timeout"].(int)
+		if ok && timeout > 0 {
+			origin.timeout = timeout
+		}
+		headers, _ := settings["headers"].(map[interface{}]interface{})
+		for header, value := range headers {
+			origin.headers[fmt.Sprint(header)] = fmt.Sprint(value)
+		}
+		basicAuth, ok := settings["basic-auth"].(map[interface{}]interface{})
+		if ok {
+			origin.username, _ = basicAuth["username"].(string)
+			origin.password, _ = basicAuth["password"].(string)
+		}
+		awsSigV4, ok := settings["aws-sigv4"].(map[interface{}]interface{})
+		if ok {
+			origin.awsRegion, _ = awsSigV4["region"].(string)
+			if origin.awsRegion == "" {
+				return nil, fmt.Errorf("invalid aws-sigv4 of HTTP origin %s: region missing", name)
+			}
+			origin.awsService, _ = awsSigV4["service"].(string)
+			if origin.awsService == "" {
+				origin.awsService = "s3"
+			}
+		}
+		origins[name] = origin
+	}
+	return origins, nil
+}
+
+// httpOriginFactory returns a factory of storages reading from an origin
+func httpOriginFactory(origin *httpOrigin) StorageFactory {
+	return func() Storage {
+		return &httpStorage{origin: origin}
+	}
+}
+
+// httpStorage reads images from an HTTP origin, it can't store any
+type httpStorage struct {
+	origin      *httpOrigin
+	client      *http.Client
+	credentials awsCredentials
+}
+
+func (s *httpStorage) Init() error {
+	s.client = &http.Client{Timeout: time.Duration(s.origin.timeout) * time.Millisecond}
+	if s.origin.awsRegion != "" {
+		s.credentials = awsCredentials{os.Getenv(awsKeyEnvVar), os.Getenv(awsSecretEnvVar), os.Getenv("AWS_SESSION_TOKEN")}
+		if s.credentials.accessKey == "" || s.credentials.secretKey == "" {
+			return fmt.Errorf("%s and %s need to be set to sign requests", awsKeyEnvVar, awsSecretEnvVar)
+		}
+	}
+	return nil
+}
+
+// newRequest creates an authenticated request for a file
+func (s *httpStorage) newRequest(method, filePath string) (*http.Request, error) {
+	segments := strings.Split(filePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	req, err := http.NewRequest(method, s.origin.baseURL+strings.Join(segments, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	for header, value := range s.origin.headers {
+		req.Header.Set(header, value)
+	}
+	if s.origin.username != "" {
+		req.SetBasicAuth(s.origin.username, s.origin.password)
+	}
+	if s.origin.awsRegion != "" {
+		emptyHash := sha256.Sum256(nil)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(emptyHash[:]))
+		signAWSRequestV4(req, nil, s.credentials, s.origin.awsRegion, s.origin.awsService, time.Now())
+	}
+	return req, nil
+}
+
+// do sends a request for a file, responses other than 200 OK are errors
+func (s *httpStorage) do(method, filePath string) (*http.Response, error) {
+	req, err := s.newRequest(method, filePath)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("HTTP origin answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *httpStorage) Get(filePath string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", filePath)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *httpStorage) Put(filePath string, data []byte, contentType string) error {
+	return errReadOnlyStorage
+}
+
+func (s *httpStorage) Delete(filePath string) error {
+	return errReadOnlyStorage
+}
+
+func (s *httpStorage) List(prefix string) ([]string, error) {
+	return nil, errors.New("HTTP origins can't be listed")
+}
+
+func (s *httpStorage) Stat(filePath string) (*FileInfo, error) {
+	resp, err := s.do("HEAD", filePath)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	etag := strings.Trim(resp.Header.Get("ETag"), "\"")
+
+	return &FileInfo{filePath, size, modTime, etag}, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTTPStorage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if r.Header.Get("X-Api-Key") != "secret" || username != "pixlserv" || password != "password" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.EscapedPath() != "/images/dir/a%20b.jpg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", "\"abc\"")
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	origins, err := parseHTTPOrigins(map[interface{}]interface{}{
+		"legacy": map[interface{}]interface{}{
+			"url":        server.URL + "/images",
+			"headers":    map[interface{}]interface{}{"X-Api-Key": "secret"},
+			"basic-auth": map[interface{}]interface{}{"username": "pixlserv", "password": "password"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &httpStorage{origin: origins["legacy"]}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := s.Get("dir/a b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "data" {
+		t.Errorf("Unexpected data: %q", data)
+	}
+	if info, err := s.Stat("dir/a b.jpg"); err != nil || info.Size != 4 || info.ETag != "abc" {
+		t.Errorf("Unexpected stat result: %+v, %v", info, err)
+	}
+	if _, err := s.Get("b.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := s.Put("b.jpg", data, "image/jpeg"); err != errReadOnlyStorage {
+		t.Errorf("Expected origins to be read-only, got %v", err)
+	}
+
+	s.origin.password = "wrong"
+	if _, err := s.Get("dir/a b.jpg"); err == nil || err == ErrNotFound {
+		t.Errorf("Expected an error for a refused request, got %v", err)
+	}
+}
+
+func TestHTTPStorageAWSSigV4(t *testing.T) {
+	var authorization, contentHash string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization, contentHash = r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256")
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	os.Setenv(awsKeyEnvVar, "AKIDEXAMPLE")
+	os.Setenv(awsSecretEnvVar, "secret")
+	defer os.Unsetenv(awsKeyEnvVar)
+	defer os.Unsetenv(awsSecretEnvVar)
+
+	s := &httpStorage{origin: &httpOrigin{baseURL: server.URL + "/", timeout: 1000, awsRegion: "eu-west-1", awsService: "s3"}}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(authorization, "/eu-west-1/s3/aws4_request") {
+		t.Errorf("Expected a signed request, got %q", authorization)
+	}
+	if contentHash != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("Unexpected content hash: %q", contentHash)
+	}
+}
+
+func TestParseHTTPOrigins(t *testing.T) {
+	invalid := []map[interface{}]interface{}{
+		{"legacy": map[interface{}]interface{}{"url": "ftp://example.com/"}},
+		{"legacy": map[interface{}]interface{}{"url": "https://example.com/", "aws-sigv4": map[interface{}]interface{}{}}},
+		{"local": map[interface{}]interface{}{"url": "https://example.com/"}},
+	}
+	for _, m := range invalid {
+		if _, err := parseHTTPOrigins(m); err == nil {
+			t.Errorf("Expected an error for %v", m)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterStorage("local", func() Storage {
+		return new(localStorage)
+	})
+}
+
+// localStorage is a storage implementation using local disk
+type localStorage struct {
+	path string
+}
+
+func (s *localStorage) Init() error {
+	s.path = currentConfig().localPath
+	return nil
+}
+
+func (s *localStorage) fullPath(filePath string) string {
+	return filepath.Join(s.path, filepath.FromSlash(filePath))
+}
+
+func (s *localStorage) Get(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(s.fullPath(filePath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (s *localStorage) Put(filePath string, data []byte, contentType string) error {
+	fullPath := s.fullPath(filePath)
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fullPath, data, 0644)
+}
+
+func (s *localStorage) Delete(filePath string) error {
+	err := os.Remove(s.fullPath(filePath))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *localStorage) List(prefix string) ([]string, error) {
+	// Only walk the deepest directory the prefix is certain to be in
+	root := s.path
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		root = s.fullPath(prefix[:i])
+	}
+
+	paths := make([]string, 0)
+	err := filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.path, fullPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, prefix) {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+func (s *localStorage) Stat(filePath string) (*FileInfo, error) {
+	info, err := os.Stat(s.fullPath(filePath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+
+	modTime := info.ModTime()
+	etag := fmt.Sprintf("%x-%x", modTime.UnixNano(), info.Size())
+
+	return &FileInfo{path.Clean(filePath), info.Size(), modTime, etag}, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &localStorage{dir}
+
+	if _, err := s.Stat("a.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, actual: %v", err)
+	}
+
+	for _, path := range []string{"a.jpg", "dir/b.png", "dir/c.png"} {
+		if err := s.Put(path, []byte("data"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := s.Stat("dir/b.png")
+	if err != nil || info.Size != 4 {
+		t.Errorf("Unexpected stat result: %+v, %v", info, err)
+	}
+
+	paths, err := s.List("dir/")
+	sort.Strings(paths)
+	if err != nil || len(paths) != 2 || paths[0] != "dir/b.png" || paths[1] != "dir/c.png" {
+		t.Errorf("Unexpected list result: %v, %v", paths, err)
+	}
+
+	if err := s.Delete("a.jpg"); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Get("a.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, actual: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Writes waiting to be copied to each replica, requests making writes wait
+// while a replica's queue is full
+const replicationQueueSize = 1000
+
+// replicatedStorage writes files to a primary backend and copies the writes
+// to replicas in the background, files are read from the primary only
+type replicatedStorage struct {
+	Storage
+	replicas []*storageReplica
+	pending  sync.WaitGroup
+}
+
+// storageReplica is a backend which writes are copied to one at a time, in
+// the order they were made in
+type storageReplica struct {
+	Storage
+	name  string
+	queue chan replicatedWrite
+}
+
+// replicatedWrite is a Put, or a Delete when data is nil
+type replicatedWrite struct {
+	path, contentType string
+	data              []byte
+}
+
+// newReplicatedStorage creates replicas of a primary backend using the
+// registered backends of the given names
+func newReplicatedStorage(primary Storage, primaryName string, names []string) (*replicatedStorage, error) {
+	s := &replicatedStorage{Storage: primary}
+	seen := map[string]bool{primaryName: true}
+	for _, name := range names {
+		factory, ok := storageFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown storage replica: %s", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("storage replica used twice: %s", name)
+		}
+		seen[name] = true
+		s.replicas = append(s.replicas, &storageReplica{&instrumentedStorage{factory(), name}, name, make(chan replicatedWrite, replicationQueueSize)})
+	}
+	return s, nil
+}
+
+func (s *replicatedStorage) Init() error {
+	err := s.Storage.Init()
+	if err != nil {
+		return err
+	}
+	for _, replica := range s.replicas {
+		err := replica.Init()
+		if err != nil {
+			return fmt.Errorf("storage replica %s: %s", replica.name, err)
+		}
+		go s.replicate(replica)
+		slog.Info("replicating storage", "storage", replica.name)
+	}
+	return nil
+}
+
+// replicate copies writes made to the primary to a replica
+func (s *replicatedStorage) replicate(replica *storageReplica) {
+	for write := range replica.queue {
+		s.apply(replica, write)
+	}
+}
+
+func (s *replicatedStorage) apply(replica *storageReplica, write replicatedWrite) {
+	defer s.pending.Done()
+	var err error
+	if write.data == nil {
+		err = replica.Delete(write.path)
+	} else {
+		err = replica.Put(write.path, write.data, write.contentType)
+	}
+	if err != nil && err != ErrNotFound {
+		slog.Error("replicating a file failed", "storage", replica.name, "file", write.path, "error", err)
+	}
+}
+
+func (s *replicatedStorage) enqueue(write replicatedWrite) {
+	for _, replica := range s.replicas {
+		s.pending.Add(1)
+		replica.queue <- write
+	}
+}
+
+func (s *replicatedStorage) Put(filePath string, data []byte, contentType string) error {
+	err := s.Storage.Put(filePath, data, contentType)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	s.enqueue(replicatedWrite{filePath, contentType, data})
+	return nil
+}
+
+func (s *replicatedStorage) Delete(filePath string) error {
+	err := s.Storage.Delete(filePath)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	s.enqueue(replicatedWrite{path: filePath})
+	return err
+}
+
+// wait returns once all writes made so far were copied to the replicas
+func (s *replicatedStorage) wait() {
+	s.pending.Wait()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReplicatedStorage(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "pixlserv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+
+	primary, replica := &localStorage{dirs[0]}, &localStorage{dirs[1]}
+	s := &replicatedStorage{Storage: primary}
+	s.replicas = []*storageReplica{{replica, "replica", make(chan replicatedWrite, 1)}}
+	go s.replicate(s.replicas[0])
+
+	// Writes wait for the queue when it is full
+	for _, path := range []string{"a.jpg", "dir/b.png", "c.png"} {
+		if err := s.Put(path, []byte("data"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("c.png"); err != nil {
+		t.Fatal(err)
+	}
+	s.wait()
+
+	for _, path := range []string{"a.jpg", "dir/b.png"} {
+		if info, err := replica.Stat(path); err != nil || info.Size != 4 {
+			t.Errorf("Expected %s to be copied to the replica, got %+v, %v", path, info, err)
+		}
+	}
+	if _, err := replica.Stat("c.png"); err != ErrNotFound {
+		t.Errorf("Expected c.png to be removed from the replica, got %v", err)
+	}
+}
+
+func TestNewReplicatedStorage(t *testing.T) {
+	if _, err := newReplicatedStorage(&localStorage{}, "local", []string{"local"}); err == nil {
+		t.Error("Expected an error for the primary used as a replica")
+	}
+	if _, err := newReplicatedStorage(&localStorage{}, "local", []string{"nonexistent"}); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+const (
+	awsKeyEnvVar    = "AWS_ACCESS_KEY_ID"
+	awsSecretEnvVar = "AWS_SECRET_ACCESS_KEY"
+	s3BucketEnvVar  = "PIXLSERV_S3_BUCKET"
+
+	// Optional, for S3-compatible services (MinIO, Ceph RGW, Cloudflare R2...)
+	s3RegionEnvVar         = "PIXLSERV_S3_REGION"
+	s3EndpointEnvVar       = "PIXLSERV_S3_ENDPOINT"
+	s3ForcePathStyleEnvVar = "PIXLSERV_S3_FORCE_PATH_STYLE"
+	s3InsecureEnvVar       = "PIXLSERV_S3_INSECURE_SKIP_VERIFY"
+
+	s3ListMaxKeys = 1000
+)
+
+func init() {
+	RegisterStorage("s3", func() Storage {
+		return new(s3Storage)
+	})
+}
+
+// s3Storage is a storage implementation using Amazon S3
+type s3Storage struct {
+	bucket *s3.Bucket
+}
+
+func (s *s3Storage) Init() error {
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		return err
+	}
+
+	bucketName := os.Getenv(s3BucketEnvVar)
+	if bucketName == "" {
+		return fmt.Errorf("%s not set", s3BucketEnvVar)
+	}
+
+	region, err := s3Region()
+	if err != nil {
+		return err
+	}
+
+	insecure := envBool(s3InsecureEnvVar)
+	if insecure {
+		slog.Warn("TLS certificate verification for S3 is disabled")
+	}
+	s.bucket = newS3(auth, region, insecure, 0).Bucket(bucketName)
+
+	return nil
+}
+
+// newS3 connects to S3 or an S3-compatible service, insecure skips
+// certificate verification for endpoints with self-signed ones. Requests are
+// given up after timeout (none when 0), goamz doesn't take contexts.
+func newS3(auth aws.Auth, region aws.Region, insecure bool, timeout time.Duration) *s3.S3 {
+	transport := http.DefaultTransport
+	if insecure {
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	client := &http.Client{
+		Transport: &s3SigV4Transport{transport, awsCredentials{auth.AccessKey, auth.SecretKey, auth.Token}, region.Name},
+		Timeout:   timeout,
+	}
+	conn := s3.New(auth, region)
+	conn.HTTPClient = func() *http.Client {
+		return client
+	}
+	return conn
+}
+
+// s3SigV4Transport signs the requests made by goamz with AWS Signature
+// Version 4 instead of Version 2, which Cloudflare R2 and the AWS regions
+// opened since 2014 reject
+type s3SigV4Transport struct {
+	base        http.RoundTripper
+	credentials awsCredentials
+	region      string
+}
+
+func (t *s3SigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+	var payload []byte
+	if req.Body != nil {
+		var err error
+		payload, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		signed.Body = io.NopCloser(bytes.NewReader(payload))
+		signed.ContentLength = int64(len(payload))
+	}
+
+	// goamz puts escaped paths (with the host for full URLs) in Opaque
+	if escaped := signed.URL.Opaque; escaped != "" {
+		escaped = strings.TrimPrefix(escaped, "//"+signed.URL.Host)
+		unescaped, err := url.PathUnescape(escaped)
+		if err != nil {
+			return nil, err
+		}
+		signed.URL.Opaque, signed.URL.Path, signed.URL.RawPath = "", unescaped, escaped
+	}
+
+	// The host sent is signed, not the one goamz signed
+	signed.Header.Del("Host")
+	signed.Header.Del("Authorization")
+	payloadHash := sha256.Sum256(payload)
+	signed.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	signAWSRequestV4(signed, payload, t.credentials, t.region, "s3", time.Now())
+	return t.base.RoundTrip(signed)
+}
+
+// s3Region returns the region to connect to, either one of the AWS regions
+// or a custom one pointing at an S3-compatible endpoint
+func s3Region() (aws.Region, error) {
+	return s3RegionFor(os.Getenv(s3RegionEnvVar), os.Getenv(s3EndpointEnvVar), envBool(s3ForcePathStyleEnvVar))
+}
+
+// s3RegionFor returns the AWS region of the given name or, with an endpoint,
+// a custom one with buckets in the host name unless pathStyle is set
+func s3RegionFor(name, endpoint string, pathStyle bool) (aws.Region, error) {
+	if endpoint == "" {
+		if name == "" {
+			return aws.EUWest, nil
+		}
+		region, ok := aws.Regions[name]
+		if !ok {
+			return aws.Region{}, fmt.Errorf("unknown S3 region: %s", name)
+		}
+		return region, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return aws.Region{}, fmt.Errorf("invalid S3 endpoint: %q", endpoint)
+	}
+	if name == "" {
+		name = "us-east-1"
+	}
+
+	region := aws.Region{Name: name, S3Endpoint: strings.TrimRight(endpoint, "/")}
+	// An empty bucket endpoint makes goamz put the bucket name in the path
+	if !pathStyle {
+		region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+	}
+	slog.Info("using S3 endpoint", "endpoint", region.S3Endpoint, "region", region.Name)
+
+	return region, nil
+}
+
+// s3Error maps "not found" errors returned by S3 to ErrNotFound
+func s3Error(err error) error {
+	if e, ok := err.(*s3.Error); ok && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey") {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *s3Storage) Get(path string) (io.ReadCloser, error) {
+	rc, err := s.bucket.GetReader(path)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return rc, nil
+}
+
+func (s *s3Storage) Put(path string, data []byte, contentType string) error {
+	return s.bucket.Put(path, data, contentType, s3.Private)
+}
+
+func (s *s3Storage) Delete(path string) error {
+	return s3Error(s.bucket.Del(path))
+}
+
+func (s *s3Storage) List(prefix string) ([]string, error) {
+	paths := make([]string, 0)
+	marker := ""
+	for {
+		resp, err := s.bucket.List(prefix, "", marker, s3ListMaxKeys)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range resp.Contents {
+			paths = append(paths, key.Key)
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return paths, nil
+		}
+		marker = resp.Contents[len(resp.Contents)-1].Key
+	}
+}
+
+func (s *s3Storage) Stat(path string) (*FileInfo, error) {
+	resp, err := s.bucket.Head(path)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	etag := strings.Trim(resp.Header.Get("ETag"), "\"")
+
+	return &FileInfo{path, size, modTime, etag}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestS3RegionFor(t *testing.T) {
+	cases := []struct {
+		name, endpoint string
+		pathStyle      bool
+		// Expected region
+		region, s3Endpoint, bucketEndpoint string
+	}{
+		{"", "", false, "eu-west-1", "https://s3-eu-west-1.amazonaws.com", ""},
+		{"us-east-1", "", false, "us-east-1", "https://s3.amazonaws.com", ""},
+		// MinIO
+		{"", "http://minio.local:9000", true, "us-east-1", "http://minio.local:9000", ""},
+		{"", "http://minio.local:9000/", false, "us-east-1", "http://minio.local:9000", "http://${bucket}.minio.local:9000"},
+		// Cloudflare R2
+		{"auto", "https://account.r2.cloudflarestorage.com", false, "auto", "https://account.r2.cloudflarestorage.com", "https://${bucket}.account.r2.cloudflarestorage.com"},
+		{"auto", "https://account.r2.cloudflarestorage.com", true, "auto", "https://account.r2.cloudflarestorage.com", ""},
+	}
+	for _, c := range cases {
+		region, err := s3RegionFor(c.name, c.endpoint, c.pathStyle)
+		if err != nil {
+			t.Errorf("%q %q: unexpected error: %v", c.name, c.endpoint, err)
+			continue
+		}
+		if region.Name != c.region || region.S3Endpoint != c.s3Endpoint || region.S3BucketEndpoint != c.bucketEndpoint {
+			t.Errorf("%q %q path style %v: unexpected region: %+v", c.name, c.endpoint, c.pathStyle, region)
+		}
+	}
+
+	for _, c := range []struct{ name, endpoint string }{
+		{"mars-north-1", ""},
+		{"", "minio.local:9000"},
+		{"", "http://"},
+	} {
+		if _, err := s3RegionFor(c.name, c.endpoint, false); err == nil {
+			t.Errorf("Expected %q %q to be invalid", c.name, c.endpoint)
+		}
+	}
+}
+
+func TestNewS3Insecure(t *testing.T) {
+	client := newS3(aws.Auth{}, aws.EUWest, true, 0).HTTPClient()
+	signing, ok := client.Transport.(*s3SigV4Transport)
+	if !ok {
+		t.Fatalf("Expected requests to be signed, got %+v", client.Transport)
+	}
+	transport, ok := signing.base.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("Expected certificates not to be verified, got %+v", signing.base)
+	}
+}
+
+func TestS3SigV4Transport(t *testing.T) {
+	credentials := awsCredentials{"AKIDEXAMPLE", "secret", ""}
+	data := []byte("image data")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/images/a cat.jpg" || !bytes.Equal(body, data) {
+			t.Errorf("Unexpected request: %s %q", r.URL.Path, body)
+		}
+		payloadHash := sha256.Sum256(data)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+			t.Errorf("Unexpected payload hash: %s", r.Header.Get("X-Amz-Content-Sha256"))
+		}
+
+		// Sign the headers which were signed again and compare
+		authorization := r.Header.Get("Authorization")
+		match := regexp.MustCompile(`SignedHeaders=([^,]+)`).FindStringSubmatch(authorization)
+		if match == nil {
+			t.Errorf("Expected a Signature Version 4 authorization, got %q", authorization)
+			return
+		}
+		check := httptest.NewRequest(r.Method, "http://"+r.Host+r.RequestURI, nil)
+		for _, name := range strings.Split(match[1], ";") {
+			if name != "host" {
+				check.Header.Set(name, r.Header.Get(name))
+			}
+		}
+		signedAt, _ := time.Parse(awsSigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+		signAWSRequestV4(check, body, credentials, "auto", "s3", signedAt)
+		if check.Header.Get("Authorization") != authorization {
+			t.Errorf("Expected %q, got %q", check.Header.Get("Authorization"), authorization)
+		}
+		if strings.Contains(match[1], "authorization") {
+			t.Errorf("Expected the Signature Version 2 authorization to be dropped: %s", match[1])
+		}
+	}))
+	defer server.Close()
+
+	// Requests as goamz makes them
+	req, _ := http.NewRequest("PUT", server.URL, bytes.NewReader(data))
+	req.URL.Opaque = "//" + req.URL.Host + "/images/a%20cat.jpg"
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("Content-Type", "image/jpeg")
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Authorization", "AWS AKIDEXAMPLE:signature")
+	client := &http.Client{Transport: &s3SigV4Transport{http.DefaultTransport, credentials, "auto"}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Points each cache directory has on the hash ring, more spread cached
+// images more evenly
+const shardRingPoints = 160
+
+var (
+	storageShards *shardedStorage // nil without cache paths
+
+	// Matches names of cached images, e.g. cat--c_e,h_300,w_400--.jpg
+	cachedNameRe = regexp.MustCompile("--[^/]*--\\.[^./]+$")
+)
+
+// shardedStorage keeps cached images in several local directories, e.g. on
+// different disks, and everything else in the storage it wraps. Each cached
+// image has a directory picked by consistent hashing of its path, so adding
+// a directory only moves the images it takes over.
+type shardedStorage struct {
+	Storage
+	shards      []*localStorage
+	ring        *hashRing
+	rebalancing sync.Mutex
+}
+
+// hashRing maps keys to shards by the first point of a shard at or after
+// the key's hash
+type hashRing struct {
+	points []uint32
+	shards []int // Shard of each point
+}
+
+func newShardedStorage(backend Storage, paths []string) *shardedStorage {
+	s := &shardedStorage{Storage: backend}
+	for _, shardPath := range paths {
+		s.shards = append(s.shards, &localStorage{shardPath})
+	}
+	// Points depend on the directories themselves rather than their order
+	s.ring = newHashRing(paths)
+	return s
+}
+
+func newHashRing(names []string) *hashRing {
+	type point struct {
+		hash  uint32
+		shard int
+	}
+	points := make([]point, 0, len(names)*shardRingPoints)
+	for shard, name := range names {
+		for i := 0; i < shardRingPoints; i++ {
+			points = append(points, point{crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i))), shard})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r := &hashRing{make([]uint32, len(points)), make([]int, len(points))}
+	for i, p := range points {
+		r.points[i], r.shards[i] = p.hash, p.shard
+	}
+	return r
+}
+
+func (r *hashRing) shard(key string) int {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[i]
+}
+
+// isShardedPath reports whether a file is a cached image kept in one of the
+// cache directories, persisted variants stay in the storage
+func isShardedPath(filePath string) bool {
+	return cachedNameRe.MatchString(path.Base(filePath)) && !isDerivedPath(filePath)
+}
+
+// shardFor returns the cache directory a cached image belongs in
+func (s *shardedStorage) shardFor(filePath string) *localStorage {
+	return s.shards[s.ring.shard(path.Clean(filePath))]
+}
+
+func (s *shardedStorage) Init() error {
+	err := s.Storage.Init()
+	if err != nil {
+		return err
+	}
+	// Images cached before a directory was added are moved in the
+	// background, until then they are generated again when requested
+	go func() {
+		moved, err := s.rebalance()
+		if err != nil {
+			slog.Error("rebalancing the cache directories failed", "error", err)
+			return
+		}
+		if moved > 0 {
+			slog.Info("rebalanced the cache directories", "moved", moved)
+		}
+	}()
+	return nil
+}
+
+func (s *shardedStorage) Get(filePath string) (io.ReadCloser, error) {
+	if isShardedPath(filePath) {
+		return s.shardFor(filePath).Get(filePath)
+	}
+	return s.Storage.Get(filePath)
+}
+
+func (s *shardedStorage) Put(filePath string, data []byte, contentType string) error {
+	if isShardedPath(filePath) {
+		return s.shardFor(filePath).Put(filePath, data, contentType)
+	}
+	return s.Storage.Put(filePath, data, contentType)
+}
+
+// Delete removes cached images from every directory they are in, those not
+// moved yet by a rebalance are removed too
+func (s *shardedStorage) Delete(filePath string) error {
+	if !isShardedPath(filePath) {
+		return s.Storage.Delete(filePath)
+	}
+	result := ErrNotFound
+	for _, shard := range s.shards {
+		err := shard.Delete(filePath)
+		if err == nil && result == ErrNotFound {
+			result = nil
+		} else if err != nil && err != ErrNotFound {
+			result = err
+		}
+	}
+	return result
+}
+
+// List returns files from the storage and all cache directories
+func (s *shardedStorage) List(prefix string) ([]string, error) {
+	paths, err := s.Storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(paths))
+	for _, filePath := range paths {
+		seen[filePath] = true
+	}
+	for _, shard := range s.shards {
+		shardPaths, err := shard.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, filePath := range shardPaths {
+			if !seen[filePath] {
+				seen[filePath] = true
+				paths = append(paths, filePath)
+			}
+		}
+	}
+	return paths, nil
+}
+
+func (s *shardedStorage) Stat(filePath string) (*FileInfo, error) {
+	if isShardedPath(filePath) {
+		return s.shardFor(filePath).Stat(filePath)
+	}
+	return s.Storage.Stat(filePath)
+}
+
+// rebalance moves cached images which are in another directory than the
+// one they belong in and returns how many were moved. Images already in
+// the right directory too (generated again since) are only removed.
+func (s *shardedStorage) rebalance() (int, error) {
+	s.rebalancing.Lock()
+	defer s.rebalancing.Unlock()
+	moved := 0
+	for _, shard := range s.shards {
+		paths, err := shard.List("")
+		if err != nil {
+			return moved, err
+		}
+		for _, filePath := range paths {
+			owner := s.shardFor(filePath)
+			if owner == shard || !isShardedPath(filePath) {
+				continue
+			}
+			if _, err := owner.Stat(filePath); err == ErrNotFound {
+				data, err := readAll(shard, filePath)
+				if err != nil {
+					return moved, err
+				}
+				err = owner.Put(filePath, data, mime.TypeByExtension(path.Ext(filePath)))
+				if err != nil {
+					return moved, err
+				}
+			}
+			err = shard.Delete(filePath)
+			if err != nil && err != ErrNotFound {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// readAll reads a whole file from a storage
+func readAll(s Storage, filePath string) ([]byte, error) {
+	reader, err := s.Get(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
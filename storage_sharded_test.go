@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := newHashRing([]string{"/mnt/a", "/mnt/b", "/mnt/c"})
+	counts := make([]int, 3)
+	keys := make([]string, 3000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("photos/%d--c_e,h_300,w_400--.jpg", i)
+		counts[ring.shard(keys[i])]++
+	}
+	for shard, count := range counts {
+		if count < 600 || count > 1400 {
+			t.Errorf("Expected about a third of the keys in shard %d, got %d", shard, count)
+		}
+	}
+
+	// Keys only move to a directory which is added, and the order of the
+	// directories doesn't matter
+	grown := newHashRing([]string{"/mnt/c", "/mnt/a", "/mnt/d", "/mnt/b"})
+	names := []string{"/mnt/a", "/mnt/b", "/mnt/c"}
+	grownNames := []string{"/mnt/c", "/mnt/a", "/mnt/d", "/mnt/b"}
+	moved := 0
+	for _, key := range keys {
+		before, after := names[ring.shard(key)], grownNames[grown.shard(key)]
+		if before != after {
+			if after != "/mnt/d" {
+				t.Fatalf("Expected %s to stay in %s or move to /mnt/d, got %s", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved < 450 || moved > 1050 {
+		t.Errorf("Expected about a quarter of the keys to move, got %d", moved)
+	}
+}
+
+func TestShardedStorage(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{derivedPrefix: defaultDerivedPrefix})
+	var dirs []string
+	for i := 0; i < 4; i++ {
+		dir, err := ioutil.TempDir("", "pixlserv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	backend := &localStorage{dirs[0]}
+
+	s := newShardedStorage(backend, dirs[1:3])
+	cached := make([]string, 40)
+	for i := range cached {
+		cached[i] = fmt.Sprintf("photos/cat%d--c_e,h_300,w_400--.jpg", i)
+		if err := s.Put(cached[i], []byte("data"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, filePath := range []string{"photos/cat.jpg", "derived/photos/cat--c_e,h_300,w_400--.jpg"} {
+		if err := s.Put(filePath, []byte("data"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := backend.Stat(filePath); err != nil {
+			t.Errorf("Expected %s in the storage, got %v", filePath, err)
+		}
+	}
+	for _, filePath := range cached {
+		if _, err := backend.Stat(filePath); err != ErrNotFound {
+			t.Errorf("Expected %s not to be in the storage, got %v", filePath, err)
+		}
+		if _, err := s.Stat(filePath); err != nil {
+			t.Errorf("Expected %s in a cache directory, got %v", filePath, err)
+		}
+	}
+	paths, err := s.List("photos/")
+	if err != nil || len(paths) != len(cached)+1 {
+		t.Errorf("Expected %d files, got %v, %v", len(cached)+1, paths, err)
+	}
+
+	// Images taken over by an added directory are moved to it
+	grown := newShardedStorage(backend, []string{dirs[1], dirs[3], dirs[2]})
+	moved, err := grown.rebalance()
+	if err != nil || moved == 0 {
+		t.Errorf("Expected images to be moved, got %d, %v", moved, err)
+	}
+	for _, filePath := range cached {
+		if _, err := grown.Stat(filePath); err != nil {
+			t.Errorf("Expected %s in its cache directory, got %v", filePath, err)
+		}
+	}
+	if moved, _ := grown.rebalance(); moved != 0 {
+		t.Errorf("Expected nothing to move, got %d", moved)
+	}
+
+	if err := grown.Delete(cached[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := grown.Delete(cached[0]); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
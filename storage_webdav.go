@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	webdavURLEnvVar      = "PIXLSERV_WEBDAV_URL" // e.g. https://cloud.example.com/remote.php/dav/files/user/Images/
+	webdavUsernameEnvVar = "PIXLSERV_WEBDAV_USERNAME"
+	webdavPasswordEnvVar = "PIXLSERV_WEBDAV_PASSWORD"
+
+	defaultWebDAVTimeout = 30 * time.Second
+)
+
+// The properties of files asked for with PROPFIND
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/></d:prop></d:propfind>`
+
+func init() {
+	RegisterStorage("webdav", func() Storage {
+		return new(webdavStorage)
+	})
+}
+
+// webdavStorage is a storage implementation using a directory (collection) on
+// a WebDAV server, e.g. a Nextcloud or ownCloud share
+type webdavStorage struct {
+	baseURL            *url.URL // Ends with a slash
+	username, password string
+	client             *http.Client
+}
+
+// webdavMultistatus is the response to PROPFIND requests
+type webdavMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength int64  `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ETag          string `xml:"DAV: getetag"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// webdavEntry is a file or a collection found with PROPFIND
+type webdavEntry struct {
+	path       string // Relative to the base URL
+	collection bool
+	info       FileInfo
+}
+
+func (s *webdavStorage) Init() error {
+	rawURL := os.Getenv(webdavURLEnvVar)
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid %s: %q", webdavURLEnvVar, rawURL)
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+		u.User = nil
+	}
+	if username := os.Getenv(webdavUsernameEnvVar); username != "" {
+		s.username = username
+		s.password = os.Getenv(webdavPasswordEnvVar)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	u.RawPath = ""
+	s.baseURL = u
+	s.client = &http.Client{Timeout: defaultWebDAVTimeout}
+	return nil
+}
+
+// fileURL returns the URL of a file, paths can't get outside of the base URL
+func (s *webdavStorage) fileURL(filePath string) string {
+	segments := strings.Split(strings.TrimPrefix(path.Clean("/"+filePath), "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return s.baseURL.String() + strings.Join(segments, "/")
+}
+
+// request sends an authenticated request for a file
+func (s *webdavStorage) request(method, filePath string, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.fileURL(filePath), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for header, value := range headers {
+		req.Header.Set(header, value)
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return s.client.Do(req)
+}
+
+// webdavError turns unexpected responses into errors, 404 into ErrNotFound
+func webdavError(method string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return fmt.Errorf("WebDAV %s answered %s", method, resp.Status)
+}
+
+func (s *webdavStorage) Get(filePath string) (io.ReadCloser, error) {
+	resp, err := s.request("GET", filePath, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, webdavError("GET", resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *webdavStorage) Put(filePath string, data []byte, contentType string) error {
+	put := func() (int, error) {
+		resp, err := s.request("PUT", filePath, data, map[string]string{"Content-Type": contentType})
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+			return resp.StatusCode, webdavError("PUT", resp)
+		}
+		return resp.StatusCode, nil
+	}
+
+	// 409 Conflict means the collection the file goes into doesn't exist
+	status, err := put()
+	if status != http.StatusConflict {
+		return err
+	}
+	err = s.makeCollections(path.Dir(path.Clean("/" + filePath)))
+	if err != nil {
+		return err
+	}
+	_, err = put()
+	return err
+}
+
+// makeCollections creates a collection and those it is in, like mkdir -p
+func (s *webdavStorage) makeCollections(dir string) error {
+	collection := ""
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		collection += name + "/"
+		resp, err := s.request("MKCOL", collection, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		// 405 Method Not Allowed is the answer for existing collections
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return webdavError("MKCOL", resp)
+		}
+	}
+	return nil
+}
+
+func (s *webdavStorage) Delete(filePath string) error {
+	resp, err := s.request("DELETE", filePath, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return webdavError("DELETE", resp)
+	}
+	return nil
+}
+
+// propfind returns a file or collection and, with depth 1, what the
+// collection contains
+func (s *webdavStorage) propfind(filePath string, depth int) ([]webdavEntry, error) {
+	resp, err := s.request("PROPFIND", filePath, []byte(webdavPropfindBody), map[string]string{
+		"Content-Type": "application/xml; charset=utf-8",
+		"Depth":        fmt.Sprint(depth),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, webdavError("PROPFIND", resp)
+	}
+	var multistatus webdavMultistatus
+	err = xml.NewDecoder(resp.Body).Decode(&multistatus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebDAV PROPFIND response: %s", err)
+	}
+
+	entries := make([]webdavEntry, 0, len(multistatus.Responses))
+	for _, response := range multistatus.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil || !strings.HasPrefix(href.Path, s.baseURL.Path) {
+			continue
+		}
+		entry := webdavEntry{path: strings.Trim(strings.TrimPrefix(href.Path, s.baseURL.Path), "/")}
+		for _, propstat := range response.Propstats {
+			if !strings.Contains(propstat.Status, " 200") {
+				continue
+			}
+			prop := propstat.Prop
+			entry.collection = prop.ResourceType.Collection != nil
+			entry.info.Size = prop.ContentLength
+			entry.info.ModTime, _ = http.ParseTime(prop.LastModified)
+			entry.info.ETag = strings.Trim(strings.TrimPrefix(prop.ETag, "W/"), "\"")
+		}
+		entry.info.Path = entry.path
+		if entry.info.ETag == "" {
+			entry.info.ETag = fmt.Sprintf("%x-%x", entry.info.ModTime.UnixNano(), entry.info.Size)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Collections are listed one at a time as many servers don't allow PROPFIND
+// with infinite depth
+func (s *webdavStorage) List(prefix string) ([]string, error) {
+	root := ""
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		root = prefix[:i+1]
+	}
+
+	paths := make([]string, 0)
+	collections := []string{root}
+	for len(collections) > 0 {
+		collection := collections[0]
+		collections = collections[1:]
+		entries, err := s.propfind(collection, 1)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			// The collection itself is a part of the response
+			if entry.path == strings.TrimSuffix(collection, "/") {
+				continue
+			}
+			if entry.collection {
+				if strings.HasPrefix(entry.path+"/", prefix) || strings.HasPrefix(prefix, entry.path+"/") {
+					collections = append(collections, entry.path+"/")
+				}
+			} else if strings.HasPrefix(entry.path, prefix) {
+				paths = append(paths, entry.path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+func (s *webdavStorage) Stat(filePath string) (*FileInfo, error) {
+	entries, err := s.propfind(filePath, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || entries[0].collection {
+		return nil, ErrNotFound
+	}
+	info := entries[0].info
+	info.Path = path.Clean(filePath)
+	return &info, nil
+}
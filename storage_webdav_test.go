@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebDAV is a WebDAV server keeping files and collections in memory
+type fakeWebDAV struct {
+	mutex       sync.Mutex
+	files       map[string][]byte
+	collections map[string]bool
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	username, password, _ := r.BasicAuth()
+	if username != "pixlserv" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimSuffix(r.URL.Path, "/")
+	switch r.Method {
+	case "GET":
+		data, ok := f.files[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case "PUT":
+		if !f.collections[path.Dir(name)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.files[name], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		if f.collections[name] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		f.collections[name] = true
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		if _, ok := f.files[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		_, isFile := f.files[name]
+		if !isFile && !f.collections[name] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		names := []string{name}
+		if !isFile && r.Header.Get("Depth") == "1" {
+			for other := range f.files {
+				if path.Dir(other) == name {
+					names = append(names, other)
+				}
+			}
+			for other := range f.collections {
+				if path.Dir(other) == name && other != name {
+					names = append(names, other)
+				}
+			}
+		}
+		sort.Strings(names)
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+		for _, n := range names {
+			if data, ok := f.files[n]; ok {
+				fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:resourcetype/><d:getcontentlength>%d</d:getcontentlength><d:getlastmodified>Wed, 01 May 2024 12:00:00 GMT</d:getlastmodified><d:getetag>"%x"</d:getetag></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, strings.ReplaceAll(n, " ", "%20"), len(data), len(data))
+			} else {
+				fmt.Fprintf(w, `<d:response><d:href>%s/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat><d:propstat><d:prop><d:getetag/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat></d:response>`, n)
+			}
+		}
+		fmt.Fprint(w, `</d:multistatus>`)
+	}
+}
+
+func TestWebDAVStorage(t *testing.T) {
+	dav := &fakeWebDAV{files: make(map[string][]byte), collections: map[string]bool{"/dav": true, "/dav/images": true}}
+	server := httptest.NewServer(dav)
+	defer server.Close()
+
+	os.Setenv(webdavURLEnvVar, server.URL+"/dav/images")
+	os.Setenv(webdavUsernameEnvVar, "pixlserv")
+	os.Setenv(webdavPasswordEnvVar, "secret")
+	defer os.Unsetenv(webdavURLEnvVar)
+	defer os.Unsetenv(webdavUsernameEnvVar)
+	defer os.Unsetenv(webdavPasswordEnvVar)
+	s := new(webdavStorage)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filePath := range []string{"cat.jpg", "photos/dogs/a b.jpg", "photos/cats/c.jpg", "other/d.jpg"} {
+		if err := s.Put(filePath, []byte("data of "+filePath), "image/jpeg"); err != nil {
+			t.Fatalf("Putting %s failed: %v", filePath, err)
+		}
+	}
+	if !dav.collections["/dav/images/photos/dogs"] {
+		t.Error("Expected the collections to be created")
+	}
+
+	reader, err := s.Get("photos/dogs/a b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "data of photos/dogs/a b.jpg" {
+		t.Errorf("Unexpected data: %q", data)
+	}
+	if _, err := s.Get("missing.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+
+	info, err := s.Stat("photos/dogs/a b.jpg")
+	if err != nil || info.Size != 27 || info.ETag != "1b" || !info.ModTime.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) || info.Path != "photos/dogs/a b.jpg" {
+		t.Errorf("Unexpected stat result: %+v, %v", info, err)
+	}
+	if _, err := s.Stat("photos"); err != ErrNotFound {
+		t.Errorf("Expected collections not to be files, got: %v", err)
+	}
+
+	paths, err := s.List("photos/")
+	sort.Strings(paths)
+	if err != nil || strings.Join(paths, ",") != "photos/cats/c.jpg,photos/dogs/a b.jpg" {
+		t.Errorf("Unexpected paths: %v, %v", paths, err)
+	}
+	if paths, err := s.List(""); err != nil || len(paths) != 4 {
+		t.Errorf("Expected all files to be listed: %v, %v", paths, err)
+	}
+	if paths, err := s.List("missing/"); err != nil || len(paths) != 0 {
+		t.Errorf("Expected no files: %v, %v", paths, err)
+	}
+
+	if err := s.Delete("cat.jpg"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := s.Delete("cat.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+var (
+	tenantNameRe = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+	// First path segments of routes, tenants can't be selected by them
+	reservedTenantNames = map[string]bool{
+		"image": true, "upload": true, "uploads": true, "srcset": true, "placeholder": true, "cache": true, "config": true,
+		"keys": true, "metrics": true, "debug": true, "healthz": true, "readyz": true, "iiif": true, "dashboard": true, "analytics": true,
+		"version": true, "usage": true, "history": true, "batch": true, "sprites": true, "collage": true, "diff": true, "downloads": true,
+		"download": true, "cards": true, "dzi": true, "unsafe": true, "insecure": true, "_peers": true,
+	}
+
+	errTenantImageNotFound = errors.New("image not found")
+)
+
+// Tenant is a customer served by the same server with images, named
+// transformations, output limits and a URL signing secret of its own
+type Tenant struct {
+	name, prefix  string // Images are kept under prefix
+	hosts         []string
+	storage       Storage // nil when images are under prefix in the shared storage
+	signingSecret string
+	quota         *Quota
+	conf          *Configuration
+}
+
+type tenantKey struct{}
+
+// tenantSelection is the tenant a request was made for
+type tenantSelection struct {
+	tenant *Tenant
+	byPath bool // Whether the tenant's name is the first segment of the URL
+}
+
+// tenantSigningSecretEnvVar returns the environment variable with the URL
+// signing secret of a tenant, e.g. PIXLSERV_URL_SIGNING_SECRET_ACME_INC
+func tenantSigningSecretEnvVar(name string) string {
+	return urlSigningSecretEnvVar + "_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// parseTenant reads a tenant from configuration, it inherits everything but
+// named transformations from conf
+func parseTenant(conf *Configuration, m map[interface{}]interface{}) (*Tenant, error) {
+	name, ok := m["name"].(string)
+	if !ok || !tenantNameRe.MatchString(name) || reservedTenantNames[name] {
+		return nil, fmt.Errorf("invalid tenant name: %v", m["name"])
+	}
+
+	t := &Tenant{name: name, prefix: name + "/"}
+	if prefix, ok := m["prefix"].(string); ok {
+		t.prefix = strings.Trim(prefix, "/") + "/"
+		if t.prefix == "/" {
+			return nil, fmt.Errorf("the prefix of tenant %s can't be empty", name)
+		}
+	}
+	if localPath, ok := m["local-path"].(string); ok {
+		t.storage = &localStorage{localPath}
+	}
+	for _, host := range stringList(toList(m["hosts"])) {
+		t.hosts = append(t.hosts, strings.ToLower(host))
+	}
+	if quota, ok := m["quotas"].(map[interface{}]interface{}); ok {
+		var err error
+		t.quota, err = parseQuota(quota)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota for tenant %s: %s", name, err)
+		}
+	}
+
+	tenantConf := *conf
+	tenantConf.transformations = make(map[string]Transformation)
+	tenantConf.transformationVersions = nil
+	tenantConf.eagerTransformations = nil
+	tenantConf.transformationHeaders = false
+	tenantConf.tenants = nil
+	if outputLimits, ok := m["output-limits"].(map[interface{}]interface{}); ok {
+		parseOutputLimits(&tenantConf, outputLimits)
+	}
+	if parameterPolicy, ok := m["parameter-policy"].(map[interface{}]interface{}); ok {
+		policy, err := parseParameterPolicy(parameterPolicy, conf.filterPipelines)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter policy for tenant %s: %s", name, err)
+		}
+		tenantConf.parameterPolicy = policy
+	}
+	if uploadMaxFileSize, ok := m["upload-max-file-size"].(int); ok && uploadMaxFileSize > 0 {
+		tenantConf.uploadMaxFileSize = uploadMaxFileSize
+	}
+	if signedURLs, ok := m["signed-urls"].(bool); ok {
+		tenantConf.signedURLs = signedURLs
+	}
+	// Restricted transformations accept signed URLs without signed-urls too
+	t.signingSecret = os.Getenv(tenantSigningSecretEnvVar(name))
+	if tenantConf.signedURLs && t.signingSecret == "" {
+		return nil, fmt.Errorf("%s not set", tenantSigningSecretEnvVar(name))
+	}
+	if transformationVersions, ok := m["transformation-versions"].(map[interface{}]interface{}); ok {
+		var err error
+		tenantConf.transformationVersions, err = parseTransformationVersions(transformationVersions)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %s", name, err)
+		}
+	}
+	if transformations, ok := m["transformations"].([]interface{}); ok {
+		err := parseTransformations(&tenantConf, transformations)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %s", name, err)
+		}
+	}
+	t.conf = &tenantConf
+
+	return t, nil
+}
+
+// parseTenants reads the tenants section, names, hosts and prefixes need to
+// be unique and no prefix can contain another
+func parseTenants(conf *Configuration, tenants []interface{}) ([]*Tenant, error) {
+	parsed := make([]*Tenant, 0, len(tenants))
+	names := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for _, value := range tenants {
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		t, err := parseTenant(conf, m)
+		if err != nil {
+			return nil, err
+		}
+		if names[t.name] {
+			return nil, fmt.Errorf("tenant %s configured twice", t.name)
+		}
+		names[t.name] = true
+		for _, host := range t.hosts {
+			if hosts[host] {
+				return nil, fmt.Errorf("host %s used by several tenants", host)
+			}
+			hosts[host] = true
+		}
+		for _, other := range parsed {
+			if strings.HasPrefix(t.prefix, other.prefix) || strings.HasPrefix(other.prefix, t.prefix) {
+				return nil, fmt.Errorf("prefixes of tenants %s and %s overlap", other.name, t.name)
+			}
+		}
+		parsed = append(parsed, t)
+	}
+	return parsed, nil
+}
+
+// toList returns a list from configuration, nil for other values
+func toList(value interface{}) []interface{} {
+	list, _ := value.([]interface{})
+	return list
+}
+
+// findTenant returns the tenant a request is for, selected by the host name
+// or else by the first segment of the path
+func findTenant(tenants []*Tenant, host, path string) (*Tenant, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, t := range tenants {
+		for _, tenantHost := range t.hosts {
+			if host == tenantHost {
+				return t, false
+			}
+		}
+	}
+
+	segment := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	for _, t := range tenants {
+		if segment == t.name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// routedPath returns the path a request is routed by, without the name of a
+// tenant selected by its first segment
+func routedPath(host, path string) string {
+	t, byPath := findTenant(currentConfig().tenants, host, path)
+	if !byPath {
+		return path
+	}
+	return strings.TrimPrefix(path, "/"+t.name)
+}
+
+// selectTenant is a middleware finding the tenant of a request, the tenant's
+// name is removed from the path so requests are routed as usual
+func selectTenant(c martini.Context, req *http.Request) {
+	if len(currentConfig().tenants) == 0 {
+		return
+	}
+	t, byPath := findTenant(currentConfig().tenants, req.Host, req.URL.Path)
+	if t == nil {
+		return
+	}
+	if byPath {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/"+t.name)
+		req.URL.RawPath = ""
+	}
+	c.Map(req.WithContext(context.WithValue(req.Context(), tenantKey{}, &tenantSelection{t, byPath})))
+}
+
+// tenantFor returns the tenant a request was made for, nil if there is none
+func tenantFor(req *http.Request) *Tenant {
+	selection, ok := req.Context().Value(tenantKey{}).(*tenantSelection)
+	if !ok {
+		return nil
+	}
+	return selection.tenant
+}
+
+// tenantURLPrefix returns what URLs of a tenant start with when it is
+// selected by the path
+func tenantURLPrefix(req *http.Request) string {
+	selection, ok := req.Context().Value(tenantKey{}).(*tenantSelection)
+	if !ok || !selection.byPath {
+		return ""
+	}
+	return "/" + selection.tenant.name
+}
+
+// configFor returns the configuration a request is served with
+func configFor(req *http.Request) *Configuration {
+	return tenantFor(req).config()
+}
+
+func (t *Tenant) config() *Configuration {
+	if t == nil {
+		return currentConfig()
+	}
+	return t.conf
+}
+
+// urlSigningSecret returns the secret URLs of the tenant are signed with
+func (t *Tenant) urlSigningSecret() string {
+	if t == nil {
+		return urlSigningSecret
+	}
+	return t.signingSecret
+}
+
+// storagePath returns the path of a tenant's image in the storage, requests
+// without a tenant can't read images of tenants
+func (t *Tenant) storagePath(imagePath string) (string, error) {
+	// Paths like ../other/cat.jpg can't leave the prefix
+	cleanPath := strings.TrimPrefix(path.Clean("/"+imagePath), "/")
+	if t != nil {
+		return t.prefix + cleanPath, nil
+	}
+	for _, tenant := range currentConfig().tenants {
+		if strings.HasPrefix(cleanPath, tenant.prefix) {
+			return "", errTenantImageNotFound
+		}
+	}
+	return imagePath, nil
+}
+
+// tenantStorage passes operations on images of tenants with a storage of
+// their own on to it, paths without their prefix
+type tenantStorage struct {
+	Storage
+}
+
+func (s *tenantStorage) route(filePath string) (Storage, string, string) {
+	for _, t := range currentConfig().tenants {
+		if t.storage != nil && strings.HasPrefix(filePath, t.prefix) {
+			return t.storage, t.prefix, strings.TrimPrefix(filePath, t.prefix)
+		}
+	}
+	return s.Storage, "", filePath
+}
+
+func (s *tenantStorage) Get(filePath string) (io.ReadCloser, error) {
+	storage, _, filePath := s.route(filePath)
+	return storage.Get(filePath)
+}
+
+func (s *tenantStorage) Put(filePath string, data []byte, contentType string) error {
+	storage, _, filePath := s.route(filePath)
+	return storage.Put(filePath, data, contentType)
+}
+
+func (s *tenantStorage) Delete(filePath string) error {
+	storage, _, filePath := s.route(filePath)
+	return storage.Delete(filePath)
+}
+
+func (s *tenantStorage) List(prefix string) ([]string, error) {
+	storage, tenantPrefix, prefix := s.route(prefix)
+	paths, err := storage.List(prefix)
+	if err != nil || tenantPrefix == "" {
+		return paths, err
+	}
+	for i, filePath := range paths {
+		paths[i] = tenantPrefix + filePath
+	}
+	return paths, nil
+}
+
+func (s *tenantStorage) Stat(filePath string) (*FileInfo, error) {
+	storage, tenantPrefix, filePath := s.route(filePath)
+	info, err := storage.Stat(filePath)
+	if err != nil || tenantPrefix == "" {
+		return info, err
+	}
+	tenantInfo := *info
+	tenantInfo.Path = tenantPrefix + info.Path
+	return &tenantInfo, nil
+}
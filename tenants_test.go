@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestParseTenants(t *testing.T) {
+	os.Setenv("PIXLSERV_URL_SIGNING_SECRET_ACME_INC", "secret")
+	defer os.Unsetenv("PIXLSERV_URL_SIGNING_SECRET_ACME_INC")
+
+	conf := &Configuration{transformations: map[string]Transformation{}, outputMaxWidth: 2000, outputMaxHeight: 2000, jpegQuality: 75}
+	tenants, err := parseTenants(conf, []interface{}{
+		map[interface{}]interface{}{
+			"name":          "acme-inc",
+			"hosts":         []interface{}{"Images.Acme.com"},
+			"signed-urls":   true,
+			"output-limits": map[interface{}]interface{}{"max-width": 800},
+			"transformations": []interface{}{
+				map[interface{}]interface{}{"name": "thumb", "parameters": "w_100,h_100"},
+			},
+		},
+		map[interface{}]interface{}{"name": "globex", "prefix": "/customers/globex"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 2 {
+		t.Fatalf("Expected 2 tenants, got: %d", len(tenants))
+	}
+
+	acme, globex := tenants[0], tenants[1]
+	if acme.prefix != "acme-inc/" || acme.hosts[0] != "images.acme.com" || acme.signingSecret != "secret" {
+		t.Errorf("Unexpected tenant: %+v", acme)
+	}
+	if acme.conf.outputMaxWidth != 800 || acme.conf.outputMaxHeight != 2000 || !acme.conf.signedURLs {
+		t.Errorf("Expected the limits to be overridden and inherited, got: %+v", acme.conf.outputLimits())
+	}
+	if _, ok := acme.conf.transformations["thumb"]; !ok || len(conf.transformations) != 0 {
+		t.Error("Expected the transformations to belong to the tenant")
+	}
+	if globex.prefix != "customers/globex/" || globex.conf.signedURLs {
+		t.Errorf("Unexpected tenant: %+v", globex)
+	}
+
+	invalid := [][]interface{}{
+		{map[interface{}]interface{}{"name": "Acme"}},
+		{map[interface{}]interface{}{"name": "image"}},
+		{map[interface{}]interface{}{"name": "signed", "signed-urls": true}},
+		{map[interface{}]interface{}{"name": "a"}, map[interface{}]interface{}{"name": "a"}},
+		{map[interface{}]interface{}{"name": "a", "prefix": "shared/"}, map[interface{}]interface{}{"name": "b", "prefix": "shared/b"}},
+		{map[interface{}]interface{}{"name": "a", "hosts": []interface{}{"x.com"}}, map[interface{}]interface{}{"name": "b", "hosts": []interface{}{"x.com"}}},
+	}
+	for _, tenants := range invalid {
+		if _, err := parseTenants(conf, tenants); err == nil {
+			t.Errorf("Expected an error for %v", tenants)
+		}
+	}
+}
+
+func TestFindTenant(t *testing.T) {
+	acme := &Tenant{name: "acme", prefix: "acme/", hosts: []string{"images.acme.com"}}
+	globex := &Tenant{name: "globex", prefix: "globex/"}
+	tenants := []*Tenant{acme, globex}
+
+	cases := []struct {
+		host, path string
+		tenant     *Tenant
+		byPath     bool
+	}{
+		{"images.acme.com:8080", "/image/t_thumb/cat.jpg", acme, false},
+		{"IMAGES.ACME.COM", "/globex/image/t_thumb/cat.jpg", acme, false},
+		{"localhost", "/globex/image/t_thumb/cat.jpg", globex, true},
+		{"localhost", "/globexx/image/t_thumb/cat.jpg", nil, false},
+		{"localhost", "/image/t_thumb/globex/cat.jpg", nil, false},
+	}
+	for _, c := range cases {
+		tenant, byPath := findTenant(tenants, c.host, c.path)
+		if tenant != c.tenant || byPath != c.byPath {
+			t.Errorf("%s%s: expected: %v %t, actual: %v %t", c.host, c.path, c.tenant, c.byPath, tenant, byPath)
+		}
+	}
+}
+
+func TestTenantStoragePath(t *testing.T) {
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	acme := &Tenant{name: "acme", prefix: "acme/"}
+	setConfig(&Configuration{tenants: []*Tenant{acme}})
+
+	cases := []struct {
+		tenant    *Tenant
+		imagePath string
+		expected  string
+	}{
+		{acme, "cat.jpg", "acme/cat.jpg"},
+		{acme, "../globex/cat.jpg", "acme/globex/cat.jpg"},
+		{nil, "cat.jpg", "cat.jpg"},
+		{nil, "acme/cat.jpg", ""},
+		{nil, "x/../acme/cat.jpg", ""},
+	}
+	for _, c := range cases {
+		actual, err := c.tenant.storagePath(c.imagePath)
+		if actual != c.expected || (err != nil) != (c.expected == "") {
+			t.Errorf("%s: expected: %q, actual: %q (%v)", c.imagePath, c.expected, actual, err)
+		}
+	}
+}
+
+func TestTenantImageRoutes(t *testing.T) {
+	oldConfig, oldPermissions := currentConfig(), permissionsByKey
+	defer func() { setConfig(oldConfig); permissionsByKey = oldPermissions }()
+	setConfig(&Configuration{
+		tenants:            []*Tenant{{name: "acme", prefix: "acme/"}, {name: "beta", prefix: "beta/"}},
+		thumborAllowUnsafe: true,
+		dziFormat:          "jpg",
+	})
+	permissionsByKey = map[string]map[string]bool{"": {ReadPermission: true}}
+
+	// Requests without a tenant can't read images of tenants
+	cases := []struct {
+		serve func(martini.Params, *http.Request, http.ResponseWriter) (int, string)
+		path  string
+	}{
+		{serveIIIF, "beta/cat.jpg/info.json"},
+		{serveIIIF, "beta/cat.jpg/full/max/0/default.jpg"},
+		{serveDZI, "beta/cat.jpg.dzi"},
+		{serveDZI, "beta/cat.jpg_files/0/0_0.jpg"},
+		{serveThumbor, "300x200/beta/cat.jpg"},
+	}
+	for _, c := range cases {
+		params := martini.Params{"_1": c.path, "signature": thumborUnsafe}
+		status, _ := c.serve(params, httptest.NewRequest("GET", "/"+c.path, nil), httptest.NewRecorder())
+		if status != http.StatusNotFound {
+			t.Errorf("%s: expected %d, actual %d", c.path, http.StatusNotFound, status)
+		}
+	}
+}
+
+func TestTenantStorage(t *testing.T) {
+	shared, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(shared)
+	own, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(own)
+
+	oldConfig := currentConfig()
+	defer func() { setConfig(oldConfig) }()
+	setConfig(&Configuration{tenants: []*Tenant{{name: "acme", prefix: "acme/", storage: &localStorage{own}}}})
+
+	s := &tenantStorage{&localStorage{shared}}
+	for _, path := range []string{"acme/cat.jpg", "dog.jpg"} {
+		if err := s.Put(path, []byte("data"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(own, "cat.jpg")); err != nil {
+		t.Error("Expected the tenant's image in its own storage")
+	}
+	if _, err := os.Stat(filepath.Join(shared, "dog.jpg")); err != nil {
+		t.Error("Expected other images in the shared storage")
+	}
+
+	info, err := s.Stat("acme/cat.jpg")
+	if err != nil || info.Path != "acme/cat.jpg" {
+		t.Errorf("Unexpected stat result: %+v, %v", info, err)
+	}
+	paths, err := s.List("acme/")
+	if err != nil || len(paths) != 1 || paths[0] != "acme/cat.jpg" {
+		t.Errorf("Unexpected list result: %v, %v", paths, err)
+	}
+}
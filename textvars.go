@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Variables of text overlays, filled in per request: {key}, {tenant}, {ip},
+// {requester} (the API key or else the IP address), {date} and {time} (UTC)
+var textVariableRe = regexp.MustCompile(`\{(key|tenant|ip|requester|date|time)\}`)
+
+// Cache-Control of images whose texts have variables, they are generated for
+// every request and never cached
+const personalisedCacheControl = "private, no-store"
+
+// hasTextVariables reports whether any of the texts of a transformation has
+// variables to be filled in
+func (t *Transformation) hasTextVariables() bool {
+	for _, text := range t.texts {
+		if textVariableRe.MatchString(text.Content) {
+			return true
+		}
+	}
+	return false
+}
+
+// textVariables returns the values of the variables of texts for a request
+// made with an API key (or not) from an IP address
+func textVariables(key string, tenant *Tenant, ip string, now time.Time) map[string]string {
+	values := map[string]string{
+		"key":       key,
+		"ip":        ip,
+		"requester": key,
+		"date":      now.UTC().Format("2006-01-02"),
+		"time":      now.UTC().Format("2006-01-02 15:04:05"),
+	}
+	if key == "" {
+		values["requester"] = ip
+	}
+	if tenant != nil {
+		values["tenant"] = tenant.name
+	}
+	return values
+}
+
+// requestTextVariables returns the values of the variables of texts for an
+// HTTP request made with an API key (or not)
+func requestTextVariables(key string, req *http.Request) map[string]string {
+	ip := ""
+	if clientIP := clientIP(req); clientIP != nil {
+		ip = clientIP.String()
+	}
+	return textVariables(key, tenantFor(req), ip, time.Now())
+}
+
+// withTextVariables returns a transformation whose texts have their variables
+// filled in, it is marked personalised so that the result isn't cached. A
+// transformation without variables is returned as it is.
+func (t Transformation) withTextVariables(values map[string]string) Transformation {
+	if !t.hasTextVariables() {
+		return t
+	}
+	texts := make([]*Text, len(t.texts))
+	for i, text := range t.texts {
+		filled := *text
+		filled.Content = textVariableRe.ReplaceAllStringFunc(text.Content, func(variable string) string {
+			return values[variable[1:len(variable)-1]]
+		})
+		texts[i] = &filled
+	}
+	t.texts = texts
+	t.personalised = true
+	return t
+}
+
+// generatePersonalisedImage transforms an original image for one request,
+// the result isn't cached as it differs for other requests
+func generatePersonalisedImage(ctx context.Context, fullImagePath, baseImagePath string, transformation Transformation) (*generatedImage, error) {
+	if isKnownMissing(baseImagePath) {
+		return nil, ErrNotFound
+	}
+	sourceInfo, err := statSource(baseImagePath)
+	if err == ErrNotFound {
+		rememberMissing(baseImagePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = runStage(ctx, stageFetch, func(ctx context.Context) error {
+		var err error
+		data, err = fetchImage(baseImagePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = trackStages(ctx)
+	err = processingPool.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAfterStages(ctx, processingPool.release)
+	encoded, format, fit, start, err := processImage(ctx, data, fullImagePath, baseImagePath, &transformation)
+	if err != nil {
+		return nil, err
+	}
+	observeTransformation(transformation.params, format, start)
+	return &generatedImage{encoded, sourceInfo.ModTime, fit}, nil
+}
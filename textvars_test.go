@@ -0,0 +1,57 @@
+package main
+
+import (
+	"image/color"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestWithTextVariables(t *testing.T) {
+	params := engine.Params{Width: 100, Height: 100, Scale: 1}
+	static := &Text{engine.Text{Content: "Preview {unknown}", Color: color.White}, "font.ttf"}
+	variable := &Text{engine.Text{Content: "{requester} {date} {time} {tenant}", Color: color.White}, "font.ttf"}
+	transformation := Transformation{params: &params, texts: []*Text{static, variable}}
+	if !transformation.hasTextVariables() {
+		t.Fatal("Expected the texts to have variables")
+	}
+
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	filled := transformation.withTextVariables(textVariables("", &Tenant{name: "acme"}, "192.0.2.1", now))
+	if !filled.personalised || filled.hasTextVariables() {
+		t.Errorf("Expected a personalised transformation without variables: %+v", filled)
+	}
+	if content := filled.texts[1].Content; content != "192.0.2.1 2024-05-01 2024-05-01 10:30:00 acme" {
+		t.Errorf("Unexpected text: %q", content)
+	}
+	if filled.texts[0].Content != "Preview {unknown}" || variable.Content != "{requester} {date} {time} {tenant}" {
+		t.Error("Expected other texts and the original transformation to be left alone")
+	}
+
+	path, _ := transformation.createFilePath("cat.jpg")
+	filledPath, _ := filled.createFilePath("cat.jpg")
+	otherRequester := transformation.withTextVariables(textVariables("KEY", nil, "192.0.2.1", now))
+	other, _ := otherRequester.createFilePath("cat.jpg")
+	if path == filledPath || filledPath == other {
+		t.Error("Expected each requester to get a different image")
+	}
+
+	transformation.texts = []*Text{static}
+	if transformation.hasTextVariables() || transformation.withTextVariables(nil).personalised {
+		t.Error("Expected a transformation without variables to be left alone")
+	}
+}
+
+func TestRequestTextVariables(t *testing.T) {
+	req := httptest.NewRequest("GET", "/image/t_preview/cat.jpg", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	values := requestTextVariables("KEY", req)
+	if values["key"] != "KEY" || values["requester"] != "KEY" || values["ip"] != "192.0.2.1" || values["tenant"] != "" {
+		t.Errorf("Unexpected values: %v", values)
+	}
+	if values := requestTextVariables("", req); values["requester"] != "192.0.2.1" {
+		t.Errorf("Expected the IP address to identify requests without an API key, got: %v", values)
+	}
+}
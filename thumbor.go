@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/go-martini/martini"
+)
+
+const (
+	thumborKeyEnvVar = "PIXLSERV_THUMBOR_KEY"
+
+	// Thumbor's replacement of a signature in URLs which aren't signed
+	thumborUnsafe = "unsafe"
+)
+
+var (
+	thumborKey string
+
+	thumborSizeRe   = regexp.MustCompile(`^(-?)(\d*)x(-?)(\d*)$`)
+	thumborCropRe   = regexp.MustCompile(`^\d+x\d+:\d+x\d+$`)
+	thumborFilterRe = regexp.MustCompile(`(\w+)\(([^)]*)\)`)
+
+	// Gravities matching Thumbor's horizontal and vertical alignments
+	thumborGravities = map[string]string{
+		"top/left":      engine.GravityNorthWest,
+		"top/center":    engine.GravityNorth,
+		"top/right":     engine.GravityNorthEast,
+		"middle/left":   engine.GravityWest,
+		"middle/center": engine.GravityCenter,
+		"middle/right":  engine.GravityEast,
+		"bottom/left":   engine.GravitySouthWest,
+		"bottom/center": engine.GravitySouth,
+		"bottom/right":  engine.GravitySouthEast,
+	}
+)
+
+// thumborInit loads the key Thumbor URLs are signed with when they are
+// enabled, it can only be left out when unsigned URLs are allowed
+func thumborInit() error {
+	thumborKey = os.Getenv(thumborKeyEnvVar)
+	if currentConfig().thumbor && !currentConfig().thumborAllowUnsafe && thumborKey == "" {
+		return fmt.Errorf("%s not set", thumborKeyEnvVar)
+	}
+	return nil
+}
+
+// thumborSignature computes the signature of the part of a Thumbor URL after
+// the signature the way Thumbor does
+func thumborSignature(path, key string) string {
+	mac := hmac.New(sha1.New, []byte(key))
+	io.WriteString(mac, path)
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseThumborPath translates the options of a Thumbor URL to parameters and
+// returns them together with the image path, e.g. for
+// fit-in/300x200/filters:grayscale()/photos/cat.jpg
+func parseThumborPath(path string) (engine.Params, string, error) {
+	params := engine.Params{Scale: engine.DefaultScale, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	segments := strings.Split(path, "/")
+	halign, valign := "center", "middle"
+	fitIn, sized := false, false
+
+	i := 0
+options:
+	for ; i < len(segments); i++ {
+		segment := segments[i]
+		switch {
+		case segment == "meta", segment == "trim", strings.HasPrefix(segment, "trim:"), thumborCropRe.MatchString(segment):
+			return params, "", fmt.Errorf("unsupported Thumbor option: %s", segment)
+		case segment == "fit-in", segment == "adaptive-fit-in", segment == "full-fit-in", segment == "adaptive-full-fit-in":
+			fitIn = true
+		case !sized && thumborSizeRe.MatchString(segment):
+			matches := thumborSizeRe.FindStringSubmatch(segment)
+			if matches[1] != "" || matches[3] != "" {
+				return params, "", errors.New("flipping images isn't supported")
+			}
+			params.Width, _ = strconv.Atoi(matches[2])
+			params.Height, _ = strconv.Atoi(matches[4])
+			sized = true
+		case segment == "left", segment == "center", segment == "right":
+			halign = segment
+		case segment == "top", segment == "middle", segment == "bottom":
+			valign = segment
+		case segment == "smart":
+			// Focal points aren't detected, the image is centred
+		case strings.HasPrefix(segment, "filters:"):
+			// Only grayscale has an equivalent, other filters are ignored
+			for _, filter := range thumborFilterRe.FindAllStringSubmatch(segment, -1) {
+				if filter[1] == "grayscale" {
+					params.Filter = engine.FilterGrayScale
+				}
+			}
+		default:
+			break options
+		}
+	}
+
+	imagePath := strings.Join(segments[i:], "/")
+	if imagePath == "" {
+		return params, "", errors.New("missing image path")
+	}
+	if params.Width == 0 && params.Height == 0 {
+		return params, "", errors.New("a width or a height is needed")
+	}
+
+	switch {
+	case params.Width == 0 || params.Height == 0:
+		// Resized keeping the aspect ratio
+		params.Cropping = engine.CroppingModeExact
+	case fitIn:
+		params.Cropping = engine.CroppingModeAll
+	default:
+		params.Gravity = thumborGravities[valign+"/"+halign]
+	}
+	return params, imagePath, nil
+}
+
+func thumborHandler(params martini.Params, req *http.Request, res http.ResponseWriter) {
+	// Images are written to the response by serveThumbor itself
+	status, body := serveThumbor(params, req, res)
+	if status != 0 {
+		res.WriteHeader(status)
+		io.WriteString(res, body)
+	}
+}
+
+// serveThumbor answers requests using Thumbor's URL syntax, signed URLs are
+// authorised by their signature, unsigned ones like other image requests
+func serveThumbor(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	signature := params["signature"]
+	path := params["_1"]
+	if signature == thumborUnsafe {
+		if !currentConfig().thumborAllowUnsafe {
+			return http.StatusForbidden, "Unsigned URLs aren't allowed"
+		}
+		if !isAuthorised(params, req, ReadPermission) {
+			return http.StatusUnauthorized, ""
+		}
+	} else if thumborKey == "" || !hmac.Equal([]byte(signature), []byte(thumborSignature(path, thumborKey))) {
+		return http.StatusForbidden, "Invalid URL: invalid signature"
+	}
+
+	if status, body, answered := checkHotlink(req, res); answered {
+		return status, body
+	}
+
+	parameters, requestedPath, err := parseThumborPath(path)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	tenant := tenantFor(req)
+	imagePath, err := tenant.storagePath(requestedPath)
+	if err != nil {
+		return http.StatusNotFound, "Image not found: " + requestedPath
+	}
+	err = parameters.CheckLimits(tenant.config().outputLimits())
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	return serveImage(params, req, res, Transformation{params: &parameters}, "", imagePath)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseThumborPath(t *testing.T) {
+	cases := []struct {
+		path, params, imagePath string
+	}{
+		{"300x200/photos/cat.jpg", "c_p,g_c,h_200,w_300,f_none,s_1", "photos/cat.jpg"},
+		{"300x200/smart/photos/cat.jpg", "c_p,g_c,h_200,w_300,f_none,s_1", "photos/cat.jpg"},
+		{"300x200/left/top/cat.jpg", "c_p,g_nw,h_200,w_300,f_none,s_1", "cat.jpg"},
+		{"300x200/right/cat.jpg", "c_p,g_e,h_200,w_300,f_none,s_1", "cat.jpg"},
+		{"fit-in/300x200/cat.jpg", "c_a,g_c,h_200,w_300,f_none,s_1", "cat.jpg"},
+		{"300x0/cat.jpg", "c_e,g_c,h_0,w_300,f_none,s_1", "cat.jpg"},
+		{"x200/filters:quality(80):grayscale()/cat.jpg", "c_e,g_c,h_200,w_0,f_grayscale,s_1", "cat.jpg"},
+	}
+	for _, c := range cases {
+		params, imagePath, err := parseThumborPath(c.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.path, err)
+			continue
+		}
+		if params.ToString() != c.params || imagePath != c.imagePath {
+			t.Errorf("%s: expected: %s %s, actual: %s %s", c.path, c.params, c.imagePath, params.ToString(), imagePath)
+		}
+	}
+
+	for _, path := range []string{"300x200/", "cat.jpg", "-300x200/cat.jpg", "trim/300x200/cat.jpg", "10x10:90x90/300x200/cat.jpg"} {
+		if _, _, err := parseThumborPath(path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
+
+func TestThumborSignature(t *testing.T) {
+	signature := thumborSignature("300x200/smart/cat.jpg", "secret")
+	if len(signature) != 28 {
+		t.Errorf("Expected 28 characters like Thumbor's signatures, got: %q", signature)
+	}
+	if signature == thumborSignature("300x200/smart/dog.jpg", "secret") || signature == thumborSignature("300x200/smart/cat.jpg", "other") {
+		t.Error("Expected signatures to depend on the path and the key")
+	}
+}
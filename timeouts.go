@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Stages of generating an image which can be given a timeout
+const (
+	stageFetch     = "fetch"
+	stageDecode    = "decode"
+	stageTransform = "transform"
+	stageEncode    = "encode"
+)
+
+var processingStages = []string{stageFetch, stageDecode, stageTransform, stageEncode}
+
+// stageTimeoutError is returned when a stage of generating an image takes
+// longer than its timeout
+type stageTimeoutError string
+
+func (e stageTimeoutError) Error() string {
+	return string(e) + " of the image timed out"
+}
+
+// stageTimeout returns how long a stage may take, 0 when it isn't limited
+func stageTimeout(stage string) time.Duration {
+	return time.Duration(currentConfig().processingTimeouts[stage]) * time.Millisecond
+}
+
+// stageTracker counts the stages of generating an image which are still
+// running, including those given up on, and holds what they use until they
+// have all returned
+type stageTracker struct {
+	sync.Mutex
+	running  int
+	releases []func()
+}
+
+type stageTrackerKey struct{}
+
+// trackStages returns a context whose stages are tracked by
+// releaseAfterStages, ctx itself when they already are
+func trackStages(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(stageTrackerKey{}).(*stageTracker); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, stageTrackerKey{}, &stageTracker{})
+}
+
+// releaseAfterStages calls release, e.g. to free a worker or reserved memory,
+// once the stages run with ctx have returned, straight away when none of
+// them is still running in the background
+func releaseAfterStages(ctx context.Context, release func()) {
+	tracker, ok := ctx.Value(stageTrackerKey{}).(*stageTracker)
+	if ok {
+		tracker.Lock()
+		if tracker.running > 0 {
+			tracker.releases = append(tracker.releases, release)
+			tracker.Unlock()
+			return
+		}
+		tracker.Unlock()
+	}
+	release()
+}
+
+func (t *stageTracker) start() {
+	t.Lock()
+	t.running++
+	t.Unlock()
+}
+
+func (t *stageTracker) finish() {
+	t.Lock()
+	t.running--
+	var releases []func()
+	if t.running == 0 {
+		releases, t.releases = t.releases, nil
+	}
+	t.Unlock()
+	for _, release := range releases {
+		release()
+	}
+}
+
+// runStage runs a stage of generating an image and gives up on it when it
+// takes longer than its timeout or the request's context is done. The context
+// passed to the stage is cancelled then, so that external commands and
+// requests stop. Go code can't be interrupted, it finishes in the background
+// and its result is dropped. The worker and memory it was given with
+// releaseAfterStages stay taken until then, so that they still bound what is
+// really in use.
+func runStage(ctx context.Context, stage string, run func(ctx context.Context) error) error {
+	timeout := stageTimeout(stage)
+	if timeout == 0 {
+		return run(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tracker, tracked := ctx.Value(stageTrackerKey{}).(*stageTracker)
+	if tracked {
+		tracker.start()
+	}
+	done := make(chan error, 1)
+	go func() {
+		if tracked {
+			defer tracker.finish()
+		}
+		done <- run(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			stageTimeoutsTotal.WithLabelValues(stage).Inc()
+			return stageTimeoutError(stage)
+		}
+		return ctx.Err()
+	}
+}
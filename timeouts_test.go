@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunStage(t *testing.T) {
+	defer func(conf *Configuration) { setConfig(conf) }(currentConfig())
+	setConfig(&Configuration{processingTimeouts: map[string]int{stageDecode: 10}})
+	ctx := context.Background()
+
+	failed := errors.New("failed")
+	if err := runStage(ctx, stageDecode, func(ctx context.Context) error { return failed }); err != failed {
+		t.Errorf("Expected the stage's error, got: %v", err)
+	}
+
+	cancelled := make(chan bool, 1)
+	err := runStage(ctx, stageDecode, func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- true
+		return nil
+	})
+	if err != stageTimeoutError(stageDecode) {
+		t.Errorf("Expected the stage to time out, got: %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the stage's context to be cancelled")
+	}
+
+	// Stages without a timeout run as they are
+	if err := runStage(ctx, stageEncode, func(ctx context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}); err != nil {
+		t.Errorf("Expected a stage without a timeout to finish, got: %v", err)
+	}
+}
+
+func TestReleaseAfterStages(t *testing.T) {
+	defer func(conf *Configuration) { setConfig(conf) }(currentConfig())
+	setConfig(&Configuration{processingTimeouts: map[string]int{stageDecode: 10}})
+	ctx := trackStages(context.Background())
+
+	finish := make(chan bool)
+	err := runStage(ctx, stageDecode, func(context.Context) error {
+		<-finish
+		return nil
+	})
+	if err != stageTimeoutError(stageDecode) {
+		t.Fatalf("Expected the stage to time out, got: %v", err)
+	}
+	released := make(chan bool, 1)
+	releaseAfterStages(ctx, func() { released <- true })
+	select {
+	case <-released:
+		t.Error("Expected the release to wait for the stage still running")
+	default:
+	}
+	close(finish)
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Error("Expected the release once the stage returned")
+	}
+
+	// Without stages running releases are immediate
+	releaseAfterStages(ctx, func() { released <- true })
+	if len(released) != 1 {
+		t.Error("Expected an immediate release")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// How often certificate files are checked for changes
+	certificateCheckInterval = time.Minute
+)
+
+// certificateReloader serves a certificate loaded from files and loads it
+// again when the files change, e.g. when they are renewed by certbot
+type certificateReloader struct {
+	certFile, keyFile string
+
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	_, err := r.reloadIfChanged()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reloadIfChanged loads the certificate when either of its files was modified
+// since it was loaded last time, it reports whether it did
+func (r *certificateReloader) reloadIfChanged() (bool, error) {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.RLock()
+	changed := !modTime.Equal(r.modTime)
+	r.lock.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.certificate = &certificate
+	r.modTime = modTime
+	return true, nil
+}
+
+// watch checks the files periodically, a broken certificate (e.g. when only
+// one of the files was replaced so far) is ignored until it is fixed
+func (r *certificateReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := r.reloadIfChanged()
+		if err != nil {
+			slog.Error("reloading the TLS certificate failed", "cert-file", r.certFile, "error", err)
+		} else if reloaded {
+			slog.Info("TLS certificate reloaded", "cert-file", r.certFile)
+		}
+	}
+}
+
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.certificate, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// serve answers requests using handler over HTTPS when a certificate is
+// configured or obtained automatically, over HTTP otherwise. HTTP/2 is
+// negotiated over TLS, HTTP/3 is served alongside when enabled.
+func serve(handler http.Handler) error {
+	listener, err := listen()
+	if err != nil {
+		return err
+	}
+	if currentConfig().adminAddress != "" {
+		handler = servedOn(handler, false)
+	}
+	server := &http.Server{Addr: listener.Addr().String(), Handler: handler}
+
+	switch {
+	case len(currentConfig().autocertDomains) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(currentConfig().autocertDomains...),
+			Cache:      autocert.DirCache(currentConfig().autocertCacheDir),
+			Email:      currentConfig().autocertEmail,
+		}
+		// Answers HTTP-01 challenges and redirects everything else to HTTPS
+		go func() {
+			err := http.ListenAndServe(currentConfig().autocertHTTPAddress, manager.HTTPHandler(nil))
+			slog.Error("serving ACME challenges failed", "address", currentConfig().autocertHTTPAddress, "error", err)
+		}()
+		server.TLSConfig = manager.TLSConfig()
+		slog.Info("using automatic certificates", "domains", currentConfig().autocertDomains)
+
+	case currentConfig().tlsCertFile != "":
+		var reloader *certificateReloader
+		reloader, err = newCertificateReloader(currentConfig().tlsCertFile, currentConfig().tlsKeyFile)
+		if err != nil {
+			return err
+		}
+		go reloader.watch(certificateCheckInterval)
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.getCertificate}
+
+	default:
+		slog.Info("listening", "address", server.Addr)
+		return server.Serve(listener)
+	}
+
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+	if currentConfig().http3 && listener.Addr().Network() == "tcp" {
+		// QUIC listens on the same port, over UDP
+		http3Server := &http3.Server{
+			Addr:      server.Addr,
+			Handler:   handler,
+			TLSConfig: http3.ConfigureTLSConfig(server.TLSConfig.Clone()),
+		}
+		go func() {
+			err := http3Server.ListenAndServe()
+			slog.Error("serving HTTP/3 failed", "address", server.Addr, "error", err)
+		}()
+		server.Handler = advertiseHTTP3(http3Server, handler)
+	}
+
+	slog.Info("listening with TLS", "address", server.Addr, "http3", currentConfig().http3)
+	return server.ServeTLS(listener, "", "")
+}
+
+// advertiseHTTP3 tells clients connecting over TCP that they can switch to
+// HTTP/3 using the Alt-Svc header
+func advertiseHTTP3(http3Server *http3.Server, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http3Server.SetQUICHeaders(res.Header())
+		handler.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	modTime := time.Now().Add(-time.Hour)
+	writeTestCertificate(t, certFile, keyFile, "old.example.com", modTime)
+	r, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, _ := r.reloadIfChanged(); reloaded {
+		t.Error("Expected unchanged files not to be loaded again")
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "new.example.com", modTime.Add(time.Minute))
+	if reloaded, err := r.reloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("Expected changed files to be loaded again, got: %t, %v", reloaded, err)
+	}
+	certificate, _ := r.getCertificate(nil)
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil || parsed.Subject.CommonName != "new.example.com" {
+		t.Errorf("Expected the new certificate to be served, got: %v", parsed.Subject.CommonName)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/go-martini/martini"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	imageURLRe = regexp.MustCompile("^/([A-Z0-9]+/)?image/")
+
+	// Spans are dropped by a no-op provider unless tracing is configured
+	tracer = otel.Tracer("github.com/ReshNesh/pixlserv")
+
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// tracingInit sets up exporting spans over OTLP/HTTP. The collector's address
+// and other exporter settings are taken from the standard OTEL_EXPORTER_OTLP_*
+// environment variables.
+func tracingInit() error {
+	// Trace context is propagated even when spans aren't exported so that
+	// traces stay connected when pixlserv sits between traced services
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !currentConfig().tracing {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return fmt.Errorf("creating the OTLP exporter failed: %s", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "pixlserv"))),
+		// Follow the caller's decision when it made one
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(currentConfig().tracingSampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	return nil
+}
+
+// tracingCleanUp exports spans which haven't been sent yet
+func tracingCleanUp() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tracerProvider.Shutdown(ctx)
+}
+
+// traceRequests is a middleware starting a span for every request, continuing
+// a trace started by the client if there is one. Handlers get a request whose
+// context carries the span.
+func traceRequests(c martini.Context, res http.ResponseWriter, req *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracer.Start(ctx, req.Method+" "+routeName(req.URL.Path),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.RequestURI()),
+		))
+	defer span.End()
+	if spanContext := span.SpanContext(); spanContext.IsValid() {
+		requestLogFor(req).traceID = spanContext.TraceID().String()
+	}
+
+	c.Map(req.WithContext(ctx))
+	c.Next()
+
+	status := res.(martini.ResponseWriter).Status()
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// routeName groups request paths into a small number of span names
+func routeName(path string) string {
+	switch {
+	case imageURLRe.MatchString(path):
+		return "/image"
+	case adminURLRe.MatchString(path):
+		return "/admin"
+	case path == "/":
+		return path
+	}
+	return "/other"
+}
+
+// endSpan ends a span, marking it as failed when err isn't nil
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != ErrNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,31 +1,57 @@
 package main
 
-// TODO - refactor out a resizing function
-
 import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"image"
-	"image/color"
-	"image/draw"
 	"io"
-	"log"
+	"log/slog"
+	"path"
 	"strconv"
 	"strings"
 
 	"crypto/sha1"
 
-	"github.com/golang/freetype"
-	"github.com/golang/freetype/truetype"
-	"github.com/nfnt/resize"
+	"github.com/ReshNesh/pixlserv/engine"
+	"github.com/ReshNesh/pixlserv/jpegenc"
+)
+
+const (
+	// Cached images are named after a hash of their parameters, like
+	// cat--hash_HASH--.jpg, when their names would be longer than this
+	maxCacheNameLength = 255
+
+	hashedCachePrefix    = "hash_"
+	hashedCacheNameBytes = 12
 )
 
 // Transformation specifies parameters and a watermark to be used when transforming an image
 type Transformation struct {
-	params    *Params
-	watermark *Watermark
-	texts     []*Text
+	params       *engine.Params
+	watermark    *Watermark
+	texts        []*Text
+	cacheControl *CacheControl
+	cacheTTL     int // Seconds cached images are served for, the configured TTL if 0
+	script       *Script
+	srcset       []int  // Breakpoint widths of variants
+	densities    []int  // Scales of the variants (photo@2x.jpg) listed for high density screens
+	quality      int    // JPEG quality, the configured one if 0
+	autoQuality  bool   // JPEG quality picked per image (q_auto) unless quality is set
+	subsampling  string // JPEG chroma subsampling (cs_444 or cs_420), the configured one if ""
+	dpi          int    // Density recorded in JPEG and PNG images (dpi_300), none if 0
+	maxBytes     int    // Size cap of encoded images (maxbytes_50000), the configured one if 0
+	headers      map[string]string
+	version      string // Token from the URL (v_<token>) for cache busting
+	preset       string // Name and version of a versioned named transformation (photo@2)
+	access       string // AccessPublic, AccessRestricted or "" for the server's settings
+	personalised bool   // Texts were filled in for one request, the result isn't cached
+
+	pngOptimization *PNGOptimization // The configured one if nil
+	videoFormat     string           // Animated GIFs are transcoded to mp4 or webm (fmt_mp4) when set
+	webp            *WebPOptions     // Images are encoded as lossless WebP (ll_1, nl_60) when set
+	mask            string           // Mask image the result is cut out with (mask_star.png), none if ""
+	conditions      []*Condition     // Change the parameters for originals they match
 }
 
 // Watermark specifies a watermark to be applied to an image
@@ -34,28 +60,37 @@ type Watermark struct {
 	x, y               int
 }
 
-// Text specifies a text overlay to be applied to an image
+// Text specifies a text overlay to be applied to an image, the font file's
+// path tells texts apart in cached images' names
 type Text struct {
-	content, gravity, fontFilePath string
-	x, y, size                     int
-	font                           *truetype.Font
-	color                          color.Color
-}
-
-// FontMetrics defines font metrics for a Text struct as rounded up integers
-type FontMetrics struct {
-	width, height, ascent, descent float64
+	engine.Text
+	fontFilePath string
 }
 
 // Turns an image file path and a transformation parameters into a file path combining both.
 // It can then be used for file lookups.
 // The function assumes that imagePath contains an extension at the end.
+// Paths whose file names would be too long (or all of them when configured)
+// are named after a hash of the image path and the parameters instead.
 func (t *Transformation) createFilePath(imagePath string) (string, error) {
 	i := strings.LastIndex(imagePath, ".")
 	if i == -1 {
 		return "", fmt.Errorf("invalid image path")
 	}
 
+	parameters := t.cacheParameters()
+	namespace := cacheNamespaceSuffix(currentConfig().cacheNamespace)
+	filePath := imagePath[:i] + "--" + parameters + namespace + "--" + imagePath[i:]
+	if currentConfig().cacheHashedNames || len(path.Base(filePath)) > maxCacheNameLength {
+		hash := sha1.Sum([]byte(imagePath + "/" + parameters))
+		filePath = imagePath[:i] + "--" + hashedCachePrefix + hex.EncodeToString(hash[:hashedCacheNameBytes]) + namespace + "--" + imagePath[i:]
+	}
+	return filePath, nil
+}
+
+// cacheParameters returns what tells cached images of the transformation
+// apart from those of other transformations of the same original
+func (t *Transformation) cacheParameters() string {
 	sum := make([]byte, sha1.Size)
 
 	// Watermark
@@ -74,12 +109,142 @@ func (t *Transformation) createFilePath(imagePath string) (string, error) {
 		}
 	}
 
+	// Script
+	if t.script != nil {
+		hash := t.script.hash()
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	// Quality
+	if t.quality != 0 {
+		hash := sha1.Sum([]byte("quality" + strconv.Itoa(t.quality)))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	if t.autoQuality {
+		hash := sha1.Sum([]byte("quality" + qualityAuto))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	if t.subsampling != "" {
+		hash := sha1.Sum([]byte("subsampling" + t.subsampling))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	if t.dpi != 0 {
+		hash := sha1.Sum([]byte("dpi" + strconv.Itoa(t.dpi)))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	if t.maxBytes != 0 {
+		hash := sha1.Sum([]byte("maxbytes" + strconv.Itoa(t.maxBytes)))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	if t.pngOptimization != nil {
+		hash := sha1.Sum([]byte("png" + t.pngOptimization.String()))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	if t.videoFormat != "" {
+		hash := sha1.Sum([]byte("video" + t.videoFormat))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	if t.webp != nil {
+		hash := sha1.Sum([]byte("webp" + t.webp.String()))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	if t.mask != "" {
+		hash := sha1.Sum([]byte("mask" + t.mask))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	for _, condition := range t.conditions {
+		hash := condition.hash()
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	// Each version of a named transformation has its own variants
+	if t.preset != "" {
+		hash := sha1.Sum([]byte("preset" + t.preset))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
 	extraHash := ""
-	if t.watermark != nil || len(t.texts) != 0 {
+	if t.watermark != nil || len(t.texts) != 0 || t.script != nil || t.quality != 0 || t.autoQuality || t.subsampling != "" || t.dpi != 0 || t.maxBytes != 0 || t.pngOptimization != nil || t.videoFormat != "" || t.webp != nil || t.mask != "" || len(t.conditions) != 0 || t.preset != "" {
 		extraHash = "--" + hex.EncodeToString(sum)
 	}
 
-	return imagePath[:i] + "--" + t.params.ToString() + extraHash + "--" + imagePath[i:], nil
+	// Variants of each version are cached separately
+	version := ""
+	if t.version != "" {
+		version = "--" + versionPrefix + t.version
+	}
+
+	return t.params.ToString() + extraHash + version
+}
+
+// jpegQuality returns the quality JPEG images are encoded with
+func (t *Transformation) jpegQuality() int {
+	if t.quality != 0 {
+		return t.quality
+	}
+	return currentConfig().jpegQuality
+}
+
+// outputFormat returns the format images of a given format are encoded in,
+// only PNG keeps the transparency of masked and faded ones
+func (t *Transformation) outputFormat(format string) string {
+	if t.mask != "" || t.params.Transparency != 0 {
+		return "png"
+	}
+	if t.webp != nil {
+		return "webp"
+	}
+	return format
+}
+
+// pngOptions returns how PNG images are optimized, nil when they aren't
+func (t *Transformation) pngOptions() *PNGOptimization {
+	if t.pngOptimization != nil {
+		return t.pngOptimization
+	}
+	return currentConfig().pngOptimization
+}
+
+// jpegOptions returns how JPEG images are encoded
+func (t *Transformation) jpegOptions() *jpegenc.Options {
+	options := &jpegenc.Options{Quality: t.jpegQuality(), Subsampling: currentConfig().jpegSubsampling}
+	if t.subsampling != "" {
+		options.Subsampling = parseSubsampling(t.subsampling)
+	}
+	return options
 }
 
 func (w *Watermark) hash() []byte {
@@ -101,12 +266,12 @@ func (t *Text) hash() []byte {
 		h.Write(bs)
 	}
 
-	r, g, b, a := t.color.RGBA()
-	io.WriteString(h, t.content)
-	io.WriteString(h, t.gravity)
-	io.WriteString(h, strconv.Itoa(t.x))
-	io.WriteString(h, strconv.Itoa(t.y))
-	io.WriteString(h, strconv.Itoa(t.size))
+	r, g, b, a := t.Color.RGBA()
+	io.WriteString(h, t.Content)
+	io.WriteString(h, t.Gravity)
+	io.WriteString(h, strconv.Itoa(t.X))
+	io.WriteString(h, strconv.Itoa(t.Y))
+	io.WriteString(h, strconv.Itoa(t.Size))
 	io.WriteString(h, t.fontFilePath)
 	writeUint(r)
 	writeUint(g)
@@ -116,248 +281,78 @@ func (t *Text) hash() []byte {
 	return h.Sum(nil)
 }
 
-func (t *Text) getFontMetrics(scale int) FontMetrics {
-	// Adapted from: https://code.google.com/p/plotinum/
-
-	// Converts truetype.FUnit to float64
-	fUnit2Float64 := float64(t.size) / float64(t.font.FUnitsPerEm())
-
-	width := 0
-	prev, hasPrev := truetype.Index(0), false
-	for _, rune := range t.content {
-		index := t.font.Index(rune)
-		if hasPrev {
-			width += int(t.font.Kerning(t.font.FUnitsPerEm(), prev, index))
+// transformCropAndResize transforms an image as the parameters (with those of
+// the conditions the image matches) or the script of a transformation specify
+// and adds its watermark and texts, the result is cut out with its mask and
+// faded last
+func transformCropAndResize(img image.Image, format, imagePath string, transformation *Transformation) (imgNew image.Image, err error) {
+	transformation = transformation.forSource(img.Bounds().Dx(), img.Bounds().Dy(), format)
+	scale := transformation.params.Scale
+	if transformation.script != nil {
+		imgNew, err = transformation.script.run(img, format, imagePath, transformation)
+		if err != nil {
+			return nil, err
 		}
-		width += int(t.font.HMetric(t.font.FUnitsPerEm(), index).AdvanceWidth)
-		prev, hasPrev = index, true
-	}
-	widthFloat := float64(width) * fUnit2Float64 * float64(scale)
-
-	bounds := t.font.Bounds(t.font.FUnitsPerEm())
-	height := float64(bounds.YMax-bounds.YMin) * fUnit2Float64 * float64(scale)
-	ascent := float64(bounds.YMax) * fUnit2Float64 * float64(scale)
-	descent := float64(bounds.YMin) * fUnit2Float64 * float64(scale)
-
-	return FontMetrics{widthFloat, height, ascent, descent}
-}
-
-func transformCropAndResize(img image.Image, transformation *Transformation) (imgNew image.Image) {
-	parameters := transformation.params
-	width := parameters.width
-	height := parameters.height
-	gravity := parameters.gravity
-	scale := parameters.scale
-
-	imgWidth := img.Bounds().Dx()
-	imgHeight := img.Bounds().Dy()
-
-	// Scaling factor
-	if parameters.cropping != CroppingModeKeepScale {
-		width *= scale
-		height *= scale
-	}
-
-	// Resize and crop
-	switch parameters.cropping {
-	case CroppingModeExact:
-		imgNew = resize.Resize(uint(width), uint(height), img, resize.Bilinear)
-	case CroppingModeAll:
-		if float32(width)*(float32(imgHeight)/float32(imgWidth)) > float32(height) {
-			// Keep height
-			imgNew = resize.Resize(0, uint(height), img, resize.Bilinear)
-		} else {
-			// Keep width
-			imgNew = resize.Resize(uint(width), 0, img, resize.Bilinear)
-		}
-	case CroppingModePart:
-		var croppedRect image.Rectangle
-		if float32(width)*(float32(imgHeight)/float32(imgWidth)) > float32(height) {
-			// Whole width displayed
-			newHeight := int((float32(imgWidth) / float32(width)) * float32(height))
-			croppedRect = image.Rect(0, 0, imgWidth, newHeight)
-		} else {
-			// Whole height displayed
-			newWidth := int((float32(imgHeight) / float32(height)) * float32(width))
-			croppedRect = image.Rect(0, 0, newWidth, imgHeight)
-		}
-
-		topLeftPoint := calculateTopLeftPointFromGravity(gravity, croppedRect.Dx(), croppedRect.Dy(), imgWidth, imgHeight)
-		imgDraw := image.NewRGBA(croppedRect)
-
-		draw.Draw(imgDraw, croppedRect, img, topLeftPoint, draw.Src)
-		imgNew = resize.Resize(uint(width), uint(height), imgDraw, resize.Bilinear)
-	case CroppingModeKeepScale:
-		// If passed in dimensions are bigger use those of the image
-		if width > imgWidth {
-			width = imgWidth
-		}
-		if height > imgHeight {
-			height = imgHeight
-		}
-
-		croppedRect := image.Rect(0, 0, width, height)
-		topLeftPoint := calculateTopLeftPointFromGravity(gravity, width, height, imgWidth, imgHeight)
-		imgDraw := image.NewRGBA(croppedRect)
-
-		draw.Draw(imgDraw, croppedRect, img, topLeftPoint, draw.Src)
-		imgNew = imgDraw.SubImage(croppedRect)
-	}
-
-	// Filters
-	if parameters.filter == FilterGrayScale {
-		bounds := imgNew.Bounds()
-		w, h := bounds.Max.X, bounds.Max.Y
-		gray := image.NewGray(bounds)
-		for x := 0; x < w; x++ {
-			for y := 0; y < h; y++ {
-				oldColor := imgNew.At(x, y)
-				grayColor := color.GrayModel.Convert(oldColor)
-				gray.Set(x, y, grayColor)
-			}
-		}
-		imgNew = gray
+	} else {
+		imgNew = engine.Transform(img, *transformation.params)
 	}
 
 	if transformation.watermark != nil {
 		w := transformation.watermark
-
-		var watermarkSrcScaled image.Image
-		var watermarkBounds image.Rectangle
-
-		// Try to load a scaled watermark first
-		if scale > 1 {
-			scaledPath, err := constructScaledPath(w.imagePath, scale)
-			if err != nil {
-				log.Println("Error:", err)
-				return
-			}
-
-			watermarkSrc, _, err := loadImage(scaledPath)
-			if err != nil {
-				log.Println("Error: could not load a watermark", err)
-			} else {
-				watermarkBounds = watermarkSrc.Bounds()
-				watermarkSrcScaled = watermarkSrc
-			}
+		watermark, err := loadWatermark(w.imagePath, scale)
+		if err != nil {
+			slog.Error("loading a watermark failed", "path", w.imagePath, "error", err)
+			return imgNew, nil
 		}
+		imgNew = engine.DrawWatermark(imgNew, watermark, w.gravity, w.x, w.y, scale)
+	}
 
-		if watermarkSrcScaled == nil {
-			watermarkSrc, _, err := loadImage(w.imagePath)
-			if err != nil {
-				log.Println("Error: could not load a watermark", err)
-				return
-			}
-			watermarkBounds = image.Rect(0, 0, watermarkSrc.Bounds().Max.X*scale, watermarkSrc.Bounds().Max.Y*scale)
-			watermarkSrcScaled = resize.Resize(uint(watermarkBounds.Max.X), uint(watermarkBounds.Max.Y), watermarkSrc, resize.Bilinear)
+	if transformation.texts != nil {
+		texts := make([]*engine.Text, len(transformation.texts))
+		for i, text := range transformation.texts {
+			texts[i] = &text.Text
 		}
-
-		bounds := imgNew.Bounds()
-
-		// Make sure we have a transparent watermark if possible
-		watermark := image.NewRGBA(watermarkBounds)
-		draw.Draw(watermark, watermarkBounds, watermarkSrcScaled, watermarkBounds.Min, draw.Src)
-
-		pt := calculateTopLeftPointFromGravity(w.gravity, watermarkBounds.Dx(), watermarkBounds.Dy(), bounds.Dx(), bounds.Dy())
-		pt = pt.Add(getTranslation(w.gravity, w.x*scale, w.y*scale))
-		wX := pt.X
-		wY := pt.Y
-
-		watermarkRect := image.Rect(wX, wY, watermarkBounds.Dx()+wX, watermarkBounds.Dy()+wY)
-		finalImage := image.NewRGBA(bounds)
-		draw.Draw(finalImage, bounds, imgNew, bounds.Min, draw.Src)
-		draw.Draw(finalImage, watermarkRect, watermark, watermarkBounds.Min, draw.Over)
-		imgNew = finalImage.SubImage(bounds)
+		withTexts, err := engine.DrawTexts(imgNew, texts, scale)
+		if err != nil {
+			slog.Error("adding text failed", "error", err)
+			return imgNew, nil
+		}
+		imgNew = withTexts
 	}
 
-	if transformation.texts != nil {
-		bounds := imgNew.Bounds()
-		rgba := image.NewRGBA(bounds)
-		draw.Draw(rgba, bounds, imgNew, image.ZP, draw.Src)
-
-		dpi := float64(72) // Multiply this by scale for a baaad time
-
-		c := freetype.NewContext()
-		c.SetDPI(dpi)
-		c.SetClip(rgba.Bounds())
-		c.SetDst(rgba)
-
-		for _, text := range transformation.texts {
-			size := float64(text.size * scale)
-
-			c.SetSrc(image.NewUniform(text.color))
-			c.SetFont(text.font)
-			c.SetFontSize(size)
-
-			fontMetrics := text.getFontMetrics(scale)
-			width := int(c.PointToFix32(fontMetrics.width) >> 8)
-			height := int(c.PointToFix32(fontMetrics.height) >> 8)
-
-			pt := calculateTopLeftPointFromGravity(text.gravity, width, height, bounds.Dx(), bounds.Dy())
-			pt = pt.Add(getTranslation(text.gravity, text.x*scale, text.y*scale))
-			x := pt.X
-			y := pt.Y + int(c.PointToFix32(fontMetrics.ascent)>>8)
-
-			_, err := c.DrawString(text.content, freetype.Pt(x, y))
-			if err != nil {
-				log.Println("Error adding text:", err)
-				return
-			}
+	if transformation.mask != "" {
+		mask, err := loadMask(transformation.mask)
+		if err != nil {
+			return nil, fmt.Errorf("loading mask %s failed: %s", transformation.mask, err)
 		}
+		imgNew = engine.Mask(imgNew, mask)
+	}
 
-		imgNew = rgba
+	if transformation.params.Transparency != 0 {
+		imgNew = engine.Fade(imgNew, transformation.params.Opacity())
 	}
 
-	return
+	return imgNew, nil
 }
 
-func calculateTopLeftPointFromGravity(gravity string, width, height, imgWidth, imgHeight int) image.Point {
-	// Assuming width <= imgWidth && height <= imgHeight
-	switch gravity {
-	case GravityNorth:
-		return image.Point{(imgWidth - width) / 2, 0}
-	case GravityNorthEast:
-		return image.Point{imgWidth - width, 0}
-	case GravityEast:
-		return image.Point{imgWidth - width, (imgHeight - height) / 2}
-	case GravitySouthEast:
-		return image.Point{imgWidth - width, imgHeight - height}
-	case GravitySouth:
-		return image.Point{(imgWidth - width) / 2, imgHeight - height}
-	case GravitySouthWest:
-		return image.Point{0, imgHeight - height}
-	case GravityWest:
-		return image.Point{0, (imgHeight - height) / 2}
-	case GravityNorthWest:
-		return image.Point{0, 0}
-	case GravityCenter:
-		return image.Point{(imgWidth - width) / 2, (imgHeight - height) / 2}
+// loadWatermark loads a watermark for images of the given scale, a version
+// made for the scale (e.g. logo@2x.png) is preferred to a resized one
+func loadWatermark(imagePath string, scale int) (image.Image, error) {
+	if scale > 1 {
+		scaledPath, err := constructScaledPath(imagePath, scale)
+		if err != nil {
+			return nil, err
+		}
+		watermark, _, err := loadImage(scaledPath)
+		if err == nil {
+			return watermark, nil
+		}
+		slog.Error("loading a watermark failed", "path", scaledPath, "error", err)
 	}
-	panic("This point should not be reached")
-}
 
-// getTranslation returns a point specifying a translation by a given
-// horizontal and vertical offset according to gravity
-func getTranslation(gravity string, h, v int) image.Point {
-	switch gravity {
-	case GravityNorth:
-		return image.Point{0, v}
-	case GravityNorthEast:
-		return image.Point{-h, v}
-	case GravityEast:
-		return image.Point{-h, 0}
-	case GravitySouthEast:
-		return image.Point{-h, -v}
-	case GravitySouth:
-		return image.Point{0, -v}
-	case GravitySouthWest:
-		return image.Point{h, -v}
-	case GravityWest:
-		return image.Point{h, 0}
-	case GravityNorthWest:
-		return image.Point{h, v}
-	case GravityCenter:
-		return image.Point{0, 0}
+	watermark, _, err := loadImage(imagePath)
+	if err != nil {
+		return nil, err
 	}
-	panic("This point should not be reached")
+	return engine.ScaleWatermark(watermark, scale), nil
 }
@@ -2,58 +2,213 @@ package main
 
 import (
 	"image"
+	"image/color"
+	"image/draw"
+	"path"
+	"strings"
 	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
 )
 
-func TestCalculateTopLeftPointFromGravity(t *testing.T) {
-	exp := image.Point{200, 0}
-	act := calculateTopLeftPointFromGravity(GravityNorth, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("N failed", act, exp)
+func TestCreateFilePathAndOriginalPath(t *testing.T) {
+	params, _ := parseParameters("w_400,h_300", currentConfig())
+	transformation := Transformation{params: &params, watermark: &Watermark{"logo.png", engine.GravityCenter, 0, 0}}
+
+	for _, imagePath := range []string{"cat.jpg", "products/2015/cat.png", "a--b.jpg"} {
+		filePath, err := transformation.createFilePath(imagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		act, ok := originalPath(filePath)
+		if !ok || act != imagePath {
+			t.Errorf("Expected: %s, actual: %s (%s)", imagePath, act, filePath)
+		}
+	}
+
+	if _, ok := originalPath("cat.jpg"); ok {
+		t.Error("Expected cat.jpg not to be recognised as a cached image")
+	}
+}
+
+func TestCreateFilePathWithScript(t *testing.T) {
+	params, _ := parseParameters("w_400,h_300", currentConfig())
+	plain := Transformation{params: &params}
+	scripted := Transformation{params: &params, script: &Script{path: "a.lua", sum: []byte("0123456789abcdefghij")}}
+	changed := Transformation{params: &params, script: &Script{path: "a.lua", sum: []byte("0123456789abcdefghik")}}
+
+	plainPath, _ := plain.createFilePath("cat.jpg")
+	scriptedPath, _ := scripted.createFilePath("cat.jpg")
+	changedPath, _ := changed.createFilePath("cat.jpg")
+	if scriptedPath == plainPath || scriptedPath == changedPath {
+		t.Errorf("Expected scripts and their versions to be told apart: %s, %s, %s", plainPath, scriptedPath, changedPath)
+	}
+	if act, ok := originalPath(scriptedPath); !ok || act != "cat.jpg" {
+		t.Errorf("Expected: cat.jpg, actual: %s (%s)", act, scriptedPath)
+	}
+}
+
+func TestCreateFilePathWithVersion(t *testing.T) {
+	params, _ := parseParameters("w_400,h_300", currentConfig())
+	plain := Transformation{params: &params}
+	versioned := Transformation{params: &params, version: "2"}
+	bumped := Transformation{params: &params, version: "3"}
+
+	plainPath, _ := plain.createFilePath("cat.jpg")
+	versionedPath, _ := versioned.createFilePath("cat.jpg")
+	bumpedPath, _ := bumped.createFilePath("cat.jpg")
+	if versionedPath == plainPath || versionedPath == bumpedPath {
+		t.Errorf("Expected versions to be cached separately: %s, %s, %s", plainPath, versionedPath, bumpedPath)
+	}
+	if act, ok := originalPath(versionedPath); !ok || act != "cat.jpg" {
+		t.Errorf("Expected: cat.jpg, actual: %s (%s)", act, versionedPath)
+	}
+}
+
+func TestCreateFilePathHashed(t *testing.T) {
+	params, _ := parseParameters("w_400,h_300", currentConfig())
+	short := Transformation{params: &params}
+	shortPath, _ := short.createFilePath("photos/cat.jpg")
+	if strings.Contains(shortPath, hashedCachePrefix) {
+		t.Errorf("Expected short names to be kept, got %s", shortPath)
+	}
+
+	long := Transformation{params: &params, version: strings.Repeat("1", 64)}
+	longPath, _ := long.createFilePath("photos/" + strings.Repeat("cat", 60) + ".jpg")
+	if !strings.Contains(longPath, "--"+hashedCachePrefix) || len(path.Base(longPath)) > maxCacheNameLength {
+		t.Errorf("Expected long names to be hashed, got %s", longPath)
+	}
+	if act, ok := originalPath(longPath); !ok || act != "photos/"+strings.Repeat("cat", 60)+".jpg" {
+		t.Errorf("Expected hashed names to be recognised as cached images, got %s", act)
+	}
+
+	currentConfig().cacheHashedNames = true
+	defer func() { currentConfig().cacheHashedNames = false }()
+	hashedPath, _ := short.createFilePath("photos/cat.jpg")
+	otherPath, _ := short.createFilePath("photos/dog.jpg")
+	if !strings.HasPrefix(hashedPath, "photos/cat--"+hashedCachePrefix) || !strings.HasSuffix(hashedPath, "--.jpg") || hashedPath == otherPath {
+		t.Errorf("Expected all names to be hashed, got %s and %s", hashedPath, otherPath)
+	}
+	if short.cacheParameters() != params.ToString() {
+		t.Errorf("Unexpected parameters: %s", short.cacheParameters())
+	}
+}
+
+func TestCreateFilePathNamespace(t *testing.T) {
+	params, _ := parseParameters("w_400,h_300", currentConfig())
+	transformation := Transformation{params: &params, version: "2"}
+	currentConfig().cacheNamespace = "staging"
+	defer func() { currentConfig().cacheNamespace = "" }()
+
+	filePath, _ := transformation.createFilePath("photos/cat.jpg")
+	if filePath != "photos/cat--"+params.ToString()+"--v_2--ns_staging--.jpg" {
+		t.Errorf("Unexpected path: %s", filePath)
+	}
+	if original, ok := originalPath(filePath); !ok || original != "photos/cat.jpg" {
+		t.Errorf("Expected namespaced names to be recognised as cached images, got %s", original)
+	}
+	if !inCacheNamespace(filePath) {
+		t.Errorf("Expected %s to be in the namespace", filePath)
 	}
 
-	exp = image.Point{400, 0}
-	act = calculateTopLeftPointFromGravity(GravityNorthEast, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("NE failed", act, exp)
+	currentConfig().cacheHashedNames = true
+	defer func() { currentConfig().cacheHashedNames = false }()
+	hashedPath, _ := transformation.createFilePath("photos/cat.jpg")
+	if !strings.HasSuffix(hashedPath, "--ns_staging--.jpg") || !inCacheNamespace(hashedPath) {
+		t.Errorf("Expected hashed names to keep the namespace, got %s", hashedPath)
 	}
 
-	exp = image.Point{400, 150}
-	act = calculateTopLeftPointFromGravity(GravityEast, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("E failed", act, exp)
+	for _, other := range []string{"photos/cat--" + params.ToString() + "--.jpg", "photos/cat--" + params.ToString() + "--ns_production--.jpg"} {
+		if inCacheNamespace(other) {
+			t.Errorf("Expected %s not to be in the namespace", other)
+		}
 	}
+}
 
-	exp = image.Point{400, 300}
-	act = calculateTopLeftPointFromGravity(GravitySouthEast, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("SE failed", act, exp)
+func TestCacheExpiryEnabled(t *testing.T) {
+	original := currentConfig()
+	defer func() { setConfig(original) }()
+	setConfig(&Configuration{transformations: make(map[string]Transformation)})
+	err := parseTransformations(currentConfig(), []interface{}{
+		map[interface{}]interface{}{"name": "thumb", "parameters": "w_200,h_200"},
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	exp = image.Point{200, 300}
-	act = calculateTopLeftPointFromGravity(GravitySouth, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("S failed", act, exp)
+	if cacheExpiryEnabled() {
+		t.Error("Expected cached images not to expire without TTLs")
 	}
-	exp = image.Point{0, 300}
-	act = calculateTopLeftPointFromGravity(GravitySouthWest, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("SW failed", act, exp)
+
+	err = parseTransformations(currentConfig(), []interface{}{
+		map[interface{}]interface{}{"name": "news", "parameters": "w_800", "cache-ttl": 300},
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	exp = image.Point{0, 150}
-	act = calculateTopLeftPointFromGravity(GravityWest, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("W failed", act, exp)
+	if currentConfig().transformations["news"].cacheTTL != 300 || !cacheExpiryEnabled() {
+		t.Error("Expected the TTL of a transformation to make cached images expire")
 	}
+}
 
-	exp = image.Point{0, 0}
-	act = calculateTopLeftPointFromGravity(GravityNorthWest, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("NW failed", act, exp)
+func TestVersionedTransformations(t *testing.T) {
+	photo := func(version int, parameters string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"name": "photo", "version": version, "parameters": parameters}
+	}
+	conf := &Configuration{transformations: make(map[string]Transformation)}
+	err := parseTransformations(conf, []interface{}{photo(1, "w_200"), photo(2, "w_200")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.transformations["photo"].preset != "photo@2" {
+		t.Errorf("Expected the latest version to be current, got %q", conf.transformations["photo"].preset)
+	}
+	paths := make(map[string]string)
+	for _, name := range []string{"photo", "photo@1", "photo@2"} {
+		transformation := conf.transformations[name]
+		paths[name], _ = transformation.createFilePath("cat.jpg")
+	}
+	current, first, second := paths["photo"], paths["photo@1"], paths["photo@2"]
+	if current != second || first == second {
+		t.Errorf("Expected versions to be cached apart and the name to share the current one's variants, got %s, %s, %s", current, second, first)
+	}
+	if parseTransformationName("t_photo@2") != "photo@2" {
+		t.Error("Expected versions to be requested as t_photo@2")
+	}
+
+	conf = &Configuration{transformations: make(map[string]Transformation), transformationVersions: map[string]int{"photo": 1}}
+	err = parseTransformations(conf, []interface{}{photo(1, "w_200"), photo(2, "w_400")})
+	if err != nil || conf.transformations["photo"].params.Width != 200 {
+		t.Errorf("Expected transformation-versions to set the current version, got %v", err)
 	}
 
-	exp = image.Point{200, 150}
-	act = calculateTopLeftPointFromGravity(GravityCenter, 400, 300, 800, 600)
-	if act != exp {
-		t.Errorf("C failed", act, exp)
+	invalid := []map[string]int{{"photo": 3}, {"thumb": 1}}
+	for _, versions := range invalid {
+		conf = &Configuration{transformations: make(map[string]Transformation), transformationVersions: versions}
+		if err := parseTransformations(conf, []interface{}{photo(1, "w_200")}); err == nil {
+			t.Errorf("Expected an error for %v", versions)
+		}
+	}
+	conf = &Configuration{transformations: make(map[string]Transformation)}
+	unversioned := map[interface{}]interface{}{"name": "photo", "parameters": "w_200"}
+	if err := parseTransformations(conf, []interface{}{photo(1, "w_200"), unversioned}); err == nil {
+		t.Error("Expected an error for a transformation with and without versions")
+	}
+}
+
+func TestTransformCropAndResizeOpacity(t *testing.T) {
+	params, _ := parseParameters("w_4,h_4,o_50", currentConfig())
+	transformation := Transformation{params: &params}
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+
+	faded, err := transformCropAndResize(img, "jpeg", "cat.jpg", &transformation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := faded.At(1, 1).RGBA(); a>>8 != 128 {
+		t.Errorf("Expected half of the alpha, got %d", a>>8)
+	}
+	if format := transformation.outputFormat("jpeg"); format != "png" {
+		t.Errorf("Expected faded JPEG images to be encoded as PNG, got %s", format)
 	}
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-martini/martini"
+	"github.com/twinj/uuid"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+
+	// Unfinished uploads are forgotten after this many seconds without a
+	// chunk
+	tusUploadExpiration = 24 * 60 * 60
+	// Seconds a chunk can take to be appended before another one can be
+	tusLockExpiration = 60
+)
+
+// errTusChunksMissing is returned when chunks of an upload were received by
+// another instance
+var errTusChunksMissing = errors.New("the upload was started on another instance")
+
+// tusUploadKey returns the redis key of the state of a resumable upload
+func tusUploadKey(id string) string {
+	return "tusupload:" + id
+}
+
+// tusChunksPath returns the file the chunks of an upload are appended to
+func tusChunksPath(id string) string {
+	return filepath.Join(currentConfig().uploadChunksPath, id)
+}
+
+// appendTusChunk writes what is read from r to the chunks of an upload at
+// offset, anything after it left by an interrupted chunk is dropped. It
+// returns how many bytes were written even when reading r failed.
+func appendTusChunk(filePath string, offset int64, r io.Reader) (int64, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < offset {
+		return 0, errTusChunksMissing
+	}
+	err = file.Truncate(offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(file, r)
+}
+
+// removeAbandonedTusUploads removes chunks of uploads in dir which got no
+// chunk for longer than their state is kept in redis
+func removeAbandonedTusUploads(dir string, now time.Time) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if now.Sub(file.ModTime()) > tusUploadExpiration*time.Second {
+			os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+}
+
+// tusUpload is the state of a resumable upload
+type tusUpload struct {
+	length, offset int64
+	tenant         string
+	imagePath      string // Set once the upload is complete
+}
+
+// tenantName returns the name of a tenant, an empty string without tenants
+func tenantName(t *Tenant) string {
+	if t == nil {
+		return ""
+	}
+	return t.name
+}
+
+// parseUploadMetadata reads an Upload-Metadata header, pairs of keys and
+// base64 encoded values separated by commas
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		keyAndValue := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(keyAndValue) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(keyAndValue[1])
+			if err != nil {
+				return nil, errors.New("invalid Upload-Metadata")
+			}
+			value = string(decoded)
+		}
+		metadata[keyAndValue[0]] = value
+	}
+	return metadata, nil
+}
+
+// setTusHeaders sets the headers all tus responses carry
+func setTusHeaders(res http.ResponseWriter) {
+	res.Header().Set("Tus-Resumable", tusVersion)
+	res.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusRequest checks a tus request can be answered, it returns an error
+// status when it can't
+func checkTusRequest(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	setTusHeaders(res)
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		res.Header().Set("Tus-Version", tusVersion)
+		return http.StatusPreconditionFailed, "unsupported tus version"
+	}
+	if !isAuthorised(params, req, WritePermission) {
+		return http.StatusUnauthorized, uploadError("API key invalid or missing")
+	}
+	return 0, ""
+}
+
+// tusOptionsHandler tells clients which tus version and extensions are
+// supported
+func tusOptionsHandler(req *http.Request, res http.ResponseWriter) int {
+	res.Header().Set("Tus-Resumable", tusVersion)
+	res.Header().Set("Tus-Version", tusVersion)
+	res.Header().Set("Tus-Extension", tusExtensions)
+	res.Header().Set("Tus-Max-Size", strconv.Itoa(configFor(req).uploadMaxFileSize))
+	return http.StatusNoContent
+}
+
+// tusCreateHandler starts a resumable upload of Upload-Length bytes
+func tusCreateHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if status, body := checkTusRequest(params, req, res); status != 0 {
+		return status, body
+	}
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return http.StatusBadRequest, uploadError("invalid Upload-Length")
+	}
+	tenant := tenantFor(req)
+	if length > int64(tenant.config().uploadMaxFileSize) {
+		return http.StatusRequestEntityTooLarge, uploadError("max file size exceeded")
+	}
+	metadata, err := parseUploadMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return http.StatusBadRequest, uploadError(err.Error())
+	}
+
+	// API keys sign uploads like for the upload endpoint, in the metadata
+	apiKey := requestKey(params, req)
+	if apiKey != "" && (currentConfig().jwtAuth == nil || bearerToken(req) == "") {
+		timestamp, _ := strconv.ParseInt(metadata["timestamp"], 10, 64)
+		err := checkUploadSignature(apiKey, timestamp, metadata["signature"])
+		if err != nil {
+			return http.StatusBadRequest, uploadError(err.Error())
+		}
+	}
+
+	id := uuid.NewV4().String()
+	key := tusUploadKey(id)
+	err = os.MkdirAll(currentConfig().uploadChunksPath, 0700)
+	if err != nil {
+		return http.StatusInternalServerError, uploadError("error starting the upload")
+	}
+	_, err = Conn.Do("HMSET", key, "length", length, "offset", 0, "tenant", tenantName(tenant))
+	if err != nil {
+		return http.StatusInternalServerError, uploadError("error starting the upload")
+	}
+	Conn.Do("EXPIRE", key, tusUploadExpiration)
+	removeAbandonedTusUploads(currentConfig().uploadChunksPath, time.Now())
+	res.Header().Set("Location", tenantURLPrefix(req)+strings.TrimSuffix(req.URL.Path, "/")+"/"+id)
+	return http.StatusCreated, ""
+}
+
+// getTusUpload returns the state of a resumable upload of a tenant
+func getTusUpload(id string, tenant *Tenant) (*tusUpload, error) {
+	values, err := redis.StringMap(Conn.Do("HGETALL", tusUploadKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 || values["tenant"] != tenantName(tenant) {
+		return nil, ErrNotFound
+	}
+	upload := &tusUpload{tenant: values["tenant"], imagePath: values["imagepath"]}
+	upload.length, _ = strconv.ParseInt(values["length"], 10, 64)
+	upload.offset, _ = strconv.ParseInt(values["offset"], 10, 64)
+	return upload, nil
+}
+
+// tusStatusHandler tells how much of an upload was received, and the path
+// of the image once it is complete
+func tusStatusHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	// HEAD responses have no body
+	if status, _ := checkTusRequest(params, req, res); status != 0 {
+		return status, ""
+	}
+	upload, err := getTusUpload(params["id"], tenantFor(req))
+	if err == ErrNotFound {
+		return http.StatusNotFound, ""
+	}
+	if err != nil {
+		return http.StatusInternalServerError, ""
+	}
+	setTusUploadHeaders(res, upload)
+	return http.StatusOK, ""
+}
+
+// setTusUploadHeaders sets the headers describing how far an upload got
+func setTusUploadHeaders(res http.ResponseWriter, upload *tusUpload) {
+	res.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	res.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	if upload.imagePath != "" {
+		res.Header().Set("Pixlserv-Image-Path", upload.imagePath)
+	}
+}
+
+// tusAppendHandler appends a chunk to an upload at Upload-Offset, the image
+// is stored like uploaded ones once all of it was received
+func tusAppendHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if status, body := checkTusRequest(params, req, res); status != 0 {
+		return status, body
+	}
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return http.StatusUnsupportedMediaType, uploadError("chunks need to be sent as application/offset+octet-stream")
+	}
+	id := params["id"]
+	key := tusUploadKey(id)
+	tenant := tenantFor(req)
+
+	// Chunks of an upload are appended one at a time
+	locked, _ := redis.String(Conn.Do("SET", key+":lock", 1, "NX", "EX", tusLockExpiration))
+	if locked != "OK" {
+		return http.StatusConflict, uploadError("another chunk is being appended")
+	}
+	defer Conn.Do("DEL", key+":lock")
+
+	upload, err := getTusUpload(id, tenant)
+	if err == ErrNotFound {
+		return http.StatusNotFound, uploadError("upload not found")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, uploadError("error reading the upload")
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.offset || upload.imagePath != "" {
+		setTusUploadHeaders(res, upload)
+		return http.StatusConflict, uploadError("invalid Upload-Offset")
+	}
+
+	// Chunks are streamed to disk, what was received is kept even when the
+	// connection breaks
+	chunksPath := tusChunksPath(id)
+	written, err := appendTusChunk(chunksPath, upload.offset, io.LimitReader(req.Body, upload.length-upload.offset))
+	if written > 0 {
+		upload.offset, _ = redis.Int64(Conn.Do("HINCRBY", key, "offset", written))
+		Conn.Do("EXPIRE", key, tusUploadExpiration)
+	}
+	if err == errTusChunksMissing {
+		setTusUploadHeaders(res, upload)
+		return http.StatusConflict, uploadError(err.Error())
+	}
+	if _, ok := err.(*os.PathError); ok {
+		return http.StatusInternalServerError, uploadError("error saving the chunk")
+	}
+	if err != nil {
+		return http.StatusBadRequest, uploadError(err.Error())
+	}
+
+	if upload.offset == upload.length {
+		file, err := os.Open(chunksPath)
+		if err != nil {
+			return http.StatusInternalServerError, uploadError("error reading the upload")
+		}
+		upload.imagePath, err = storeUpload(file, tenant)
+		file.Close()
+		// Uploads which failed to be stored can be tried again with an
+		// empty chunk
+		if _, ok := err.(invalidUploadError); ok || err == nil {
+			os.Remove(chunksPath)
+		}
+		if _, ok := err.(invalidUploadError); ok {
+			Conn.Do("DEL", key)
+			auditTusUpload(params, req, id, http.StatusBadRequest)
+			return http.StatusBadRequest, uploadError(err.Error())
+		}
+		if err != nil {
+			auditTusUpload(params, req, id, http.StatusInternalServerError)
+			return http.StatusInternalServerError, uploadError("error saving image: " + err.Error())
+		}
+		auditTusUpload(params, req, upload.imagePath, http.StatusNoContent)
+		Conn.Do("HSET", key, "imagepath", upload.imagePath)
+	}
+	setTusUploadHeaders(res, upload)
+	return http.StatusNoContent, ""
+}
+
+// auditTusUpload adds a completed upload to the audit log, its target is the
+// stored image or else the upload ID
+func auditTusUpload(params martini.Params, req *http.Request, target string, status int) {
+	if auditEnabled() {
+		writeAudit(httpAuditEvent(params, req, auditUpload, target, status))
+	}
+}
+
+// tusDeleteHandler cancels an upload
+func tusDeleteHandler(params martini.Params, req *http.Request, res http.ResponseWriter) (int, string) {
+	if status, body := checkTusRequest(params, req, res); status != 0 {
+		return status, body
+	}
+	id := params["id"]
+	if _, err := getTusUpload(id, tenantFor(req)); err == ErrNotFound {
+		return http.StatusNotFound, uploadError("upload not found")
+	}
+	Conn.Do("DEL", tusUploadKey(id))
+	os.Remove(tusChunksPath(id))
+	return http.StatusNoContent, ""
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	metadata, err := parseUploadMetadata("filename Y2F0LmpwZw==, timestamp MTQwMDAwMDAwMA==,empty")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]string{"filename": "cat.jpg", "timestamp": "1400000000", "empty": ""}
+	if len(metadata) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, metadata)
+	}
+	for key, value := range expected {
+		if metadata[key] != value {
+			t.Errorf("Expected %s to be %q, got %q", key, value, metadata[key])
+		}
+	}
+
+	if metadata, _ := parseUploadMetadata(""); len(metadata) != 0 {
+		t.Errorf("Expected no metadata, got %v", metadata)
+	}
+	if _, err := parseUploadMetadata("filename not-base64!"); err == nil {
+		t.Error("Expected an error for values which aren't base64")
+	}
+}
+
+func TestCheckTusRequestVersion(t *testing.T) {
+	req, _ := http.NewRequest("HEAD", "/uploads/1", nil)
+	res := httptest.NewRecorder()
+	status, _ := checkTusRequest(martini.Params{}, req, res)
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("Expected requests without Tus-Resumable to fail, got %d", status)
+	}
+	if version := res.Header().Get("Tus-Version"); version != tusVersion {
+		t.Errorf("Expected the supported version to be sent, got %q", version)
+	}
+	if res.Header().Get("Tus-Resumable") != tusVersion {
+		t.Error("Expected responses to carry Tus-Resumable")
+	}
+}
+
+func TestAppendTusChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv-tus-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "upload")
+
+	for _, c := range []struct {
+		offset int64
+		chunk  string
+	}{{0, "first"}, {5, " second"}, {12, " third"}} {
+		written, err := appendTusChunk(filePath, c.offset, strings.NewReader(c.chunk))
+		if err != nil || written != int64(len(c.chunk)) {
+			t.Fatalf("Unexpected result: %d, %v", written, err)
+		}
+	}
+	// An interrupted chunk is sent again from where it was received
+	if _, err := appendTusChunk(filePath, 18, strings.NewReader(" broken")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appendTusChunk(filePath, 18, strings.NewReader(" fourth")); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(filePath)
+	if string(data) != "first second third fourth" {
+		t.Errorf("Expected the chunks in order, got %q", data)
+	}
+
+	if _, err := appendTusChunk(filepath.Join(dir, "elsewhere"), 5, strings.NewReader("chunk")); err != errTusChunksMissing {
+		t.Errorf("Expected chunks received by another instance to be missing, got %v", err)
+	}
+}
+
+func TestRemoveAbandonedTusUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixlserv-tus-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"abandoned", "active"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("chunk"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-25 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "abandoned"), old, old)
+
+	removeAbandonedTusUploads(dir, time.Now())
+	if _, err := os.Stat(filepath.Join(dir, "abandoned")); !os.IsNotExist(err) {
+		t.Error("Expected the abandoned upload to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "active")); err != nil {
+		t.Error("Expected the active upload to be kept")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+// Max. size of an upscaler's response
+const maxUpscalerResponseSize = 256 * 1024 * 1024
+
+// upscalerInit makes the engine enlarge images using the configured upscaler
+// hook, or in Go without one
+func upscalerInit() {
+	if currentConfig().upscalerURL == "" {
+		engine.SetUpscaler(nil)
+		return
+	}
+	engine.SetUpscaler(upscaleWithHook)
+}
+
+// upscaleWithHook sends an image as PNG to the upscaler hook with the size it
+// should be enlarged to in the width and height query parameters and decodes
+// the image it responds with. Errors are logged, the engine enlarges the image
+// itself then.
+func upscaleWithHook(img image.Image, width, height int) (image.Image, error) {
+	start := time.Now()
+	upscaled, err := requestUpscale(currentConfig().upscalerURL, time.Duration(currentConfig().upscalerTimeout)*time.Millisecond, img, width, height)
+	if err != nil {
+		slog.Error("upscaling an image using the upscaler hook failed", "url", currentConfig().upscalerURL, "error", err)
+		return nil, err
+	}
+	slog.Debug("image upscaled", "width", width, "height", height, "duration", time.Since(start))
+	return upscaled, nil
+}
+
+func requestUpscale(hookURL string, timeout time.Duration, img image.Image, width, height int) (image.Image, error) {
+	var body bytes.Buffer
+	err := png.Encode(&body, img)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(hookURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("width", strconv.Itoa(width))
+	query.Set("height", strconv.Itoa(height))
+	u.RawQuery = query.Encode()
+
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Post(u.String(), "image/png", &body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, maxUpscalerResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	upscaled, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding the response failed: %s", err)
+	}
+	return upscaled, nil
+}
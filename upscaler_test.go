@@ -0,0 +1,50 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestUpscale(t *testing.T) {
+	var width, height string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		width, height = r.URL.Query().Get("width"), r.URL.Query().Get("height")
+		if r.Header.Get("Content-Type") != "image/png" {
+			http.Error(w, "expected a PNG image", http.StatusBadRequest)
+			return
+		}
+		if _, err := png.Decode(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		upscaled := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+		upscaled.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+		png.Encode(w, upscaled)
+	}))
+	defer server.Close()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 5))
+	upscaled, err := requestUpscale(server.URL+"/upscale?model=x4", time.Second, img, 40, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != "40" || height != "20" {
+		t.Errorf("Expected the size in the query, got: %s x %s", width, height)
+	}
+	if upscaled.Bounds().Dx() != 40 || upscaled.Bounds().Dy() != 20 {
+		t.Errorf("Unexpected bounds: %v", upscaled.Bounds())
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	if _, err := requestUpscale(failing.URL, time.Second, img, 40, 20); err == nil {
+		t.Error("Expected an error for a failing hook")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Hints printed with failed connectivity checks
+var connectionCheckHints = map[string]string{
+	"storage":         "check the storage option and the credentials and bucket in the environment",
+	"redis":           "check " + redisURLEnvVar + " or " + redisPortEnvVar,
+	"cache-directory": "check that local-path and the cache paths exist and are writable",
+}
+
+// validateConfig reads a configuration file ("" for none) the way the server
+// would and returns the problems found in it, every named transformation is
+// checked rather than stopping at the first invalid one
+func validateConfig(path string) []string {
+	m, err := readConfig(path)
+	if err != nil {
+		return []string{fmt.Sprintf("reading the configuration failed: %s", err)}
+	}
+
+	// The other options are parsed first as the transformations depend on
+	// the output limits
+	options := make(map[interface{}]interface{}, len(m))
+	for key, value := range m {
+		if key != "transformations" && key != "tenants" {
+			options[key] = value
+		}
+	}
+	conf, err := parseConfig(options)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	problems := transformationProblems(conf, "", m["transformations"])
+	tenants, _ := m["tenants"].([]interface{})
+	for i, tenantMap := range tenants {
+		tenant, ok := tenantMap.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		name, ok := tenant["name"].(string)
+		if !ok {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		tenantConf := *conf
+		outputLimits, ok := tenant["output-limits"].(map[interface{}]interface{})
+		if ok {
+			parseOutputLimits(&tenantConf, outputLimits)
+		}
+		problems = append(problems, transformationProblems(&tenantConf, "tenant "+name+": ", tenant["transformations"])...)
+	}
+
+	// Whatever is left is caught when the whole configuration is parsed
+	if len(problems) == 0 {
+		_, err = parseConfig(m)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// transformationProblems checks named transformations one by one against the
+// limits of a configuration, prefix is added to the problems found
+func transformationProblems(conf *Configuration, prefix string, list interface{}) []string {
+	transformations, _ := list.([]interface{})
+	var problems []string
+	for i, transformationMap := range transformations {
+		label := fmt.Sprintf("#%d", i+1)
+		transformation, ok := transformationMap.(map[interface{}]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%stransformation %s: expected a section with a name and parameters", prefix, label))
+			continue
+		}
+		name, ok := transformation["name"].(string)
+		if ok {
+			label = name
+		} else {
+			problems = append(problems, fmt.Sprintf("%stransformation %s: missing name, it would be ignored", prefix, label))
+			continue
+		}
+		if _, ok := transformation["parameters"].(string); !ok {
+			problems = append(problems, fmt.Sprintf("%stransformation %s: missing parameters, it would be ignored", prefix, label))
+			continue
+		}
+
+		scratch := *conf
+		scratch.transformations = make(map[string]Transformation)
+		// Versions are checked across all transformations when parsing
+		scratch.transformationVersions = nil
+		err := parseTransformations(&scratch, []interface{}{transformation})
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%stransformation %s: %s", prefix, label, err))
+		}
+	}
+	return problems
+}
+
+// connectionProblems checks that the storage (including the storages of
+// tenants) and redis can be used with the current configuration
+func connectionProblems() []string {
+	err := storageInit()
+	if err != nil {
+		return []string{fmt.Sprintf("storage: %s (%s)", err, connectionCheckHints["storage"])}
+	}
+	defer storageCleanUp()
+
+	checks := map[string]func() error{
+		"storage": checkStorage,
+		"redis":   checkRedis,
+	}
+	if storageName == "local" || len(currentConfig().cachePaths) > 0 {
+		checks["cache-directory"] = checkCacheDirectory
+	}
+	for _, tenant := range currentConfig().tenants {
+		if tenant.storage == nil {
+			continue
+		}
+		probePath := tenant.prefix + readinessProbePath
+		checks["storage of tenant "+tenant.name] = func() error {
+			_, err := storageImpl.Stat(probePath)
+			if err == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+	}
+
+	var problems []string
+	for name, result := range runReadinessChecks(checks, readinessTimeout) {
+		if result == "ok" {
+			continue
+		}
+		problem := fmt.Sprintf("%s: %s", name, result)
+		if hint, ok := connectionCheckHints[name]; ok {
+			problem += " (" + hint + ")"
+		}
+		problems = append(problems, problem)
+	}
+	sort.Strings(problems)
+	return problems
+}
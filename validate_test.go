@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransformationProblems(t *testing.T) {
+	conf := &Configuration{transformations: map[string]Transformation{}, outputMaxWidth: 1000, jpegQuality: 75}
+	problems := transformationProblems(conf, "tenant acme: ", []interface{}{
+		map[interface{}]interface{}{"name": "thumb", "parameters": "w_100,h_100"},
+		map[interface{}]interface{}{"name": "huge", "parameters": "w_5000"},
+		map[interface{}]interface{}{"name": "broken", "parameters": "w_abc"},
+		map[interface{}]interface{}{"name": "Bad Name", "parameters": "w_100"},
+		map[interface{}]interface{}{"parameters": "w_100"},
+		map[interface{}]interface{}{"name": "empty"},
+		"thumb",
+	})
+	expected := []string{"huge", "broken", "Bad Name", "#5", "empty", "#7"}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got: %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if !strings.HasPrefix(problem, "tenant acme: transformation "+expected[i]+":") {
+			t.Errorf("Unexpected problem: %s", problem)
+		}
+	}
+	if len(conf.transformations) != 0 {
+		t.Error("Expected the configuration to be left alone")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+const (
+	// Parameter asking for an animated GIF to be transcoded to a video
+	// (fmt_mp4 or fmt_webm)
+	parameterVideoFormat = "fmt"
+	videoFormatMP4       = "mp4"
+	videoFormatWebM      = "webm"
+)
+
+// videoSourceError is returned when an image can't be transcoded to a video
+type videoSourceError string
+
+func (e videoSourceError) Error() string {
+	return string(e)
+}
+
+// removeVideoFormat removes the video format parameter from a parameters
+// string like "w_400,fmt_mp4" and returns its value, "" when there is none
+func removeVideoFormat(parametersStr string) (string, string, error) {
+	rest, value := removeParameter(parametersStr, parameterVideoFormat)
+	if value != "" && value != videoFormatMP4 && value != videoFormatWebM {
+		return rest, "", fmt.Errorf("invalid video format: %s (available: %s, %s)", value, videoFormatMP4, videoFormatWebM)
+	}
+	return rest, value, nil
+}
+
+// checkVideoTransformation makes sure a transformation can be applied by
+// ffmpeg, watermarks, texts, scripts and filters other than grayscale are
+// only drawn in Go
+func checkVideoTransformation(t *Transformation) error {
+	if currentConfig().ffmpegCommand == "" {
+		return errors.New("videos need ffmpeg to be configured")
+	}
+	if t.watermark != nil || len(t.texts) != 0 || t.script != nil || t.mask != "" {
+		return errors.New("watermarks, texts, masks and scripts can't be applied to videos")
+	}
+	if t.params.HasAdjustments() {
+		return errors.New("gamma and exposure can't be adjusted in videos")
+	}
+	if t.params.Transparency != 0 {
+		return errors.New("videos can't be faded")
+	}
+	if t.params.Filter != engine.DefaultFilter && t.params.Filter != engine.FilterGrayScale {
+		return fmt.Errorf("filter %s can't be applied to videos", t.params.Filter)
+	}
+	return nil
+}
+
+// contentTypeFor returns the Content-Type of an encoded image or video format
+func contentTypeFor(format string) string {
+	if format == videoFormatMP4 || format == videoFormatWebM {
+		return "video/" + format
+	}
+	return "image/" + format
+}
+
+// videoArgs returns ffmpeg's arguments to crop and resize a GIF as the
+// geometry says and encode it as a silent video. Both dimensions need to be
+// even for yuv420p.
+func videoArgs(input, output string, geometry engine.Geometry, filter, videoFormat string) []string {
+	filters := []string{
+		fmt.Sprintf("crop=%d:%d:%d:%d", geometry.Crop.Dx(), geometry.Crop.Dy(), geometry.Crop.Min.X, geometry.Crop.Min.Y),
+		fmt.Sprintf("scale=%d:%d", evenDimension(geometry.Width), evenDimension(geometry.Height)),
+	}
+	if filter == engine.FilterGrayScale {
+		filters = append(filters, "hue=s=0")
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", input, "-vf", strings.Join(filters, ","), "-an", "-pix_fmt", "yuv420p"}
+	if videoFormat == videoFormatWebM {
+		args = append(args, "-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "33")
+	} else {
+		args = append(args, "-c:v", "libx264", "-crf", "23", "-movflags", "+faststart")
+	}
+	return append(args, output)
+}
+
+func evenDimension(d int) int {
+	if d < 2 {
+		return 2
+	}
+	return d - d%2
+}
+
+// runFFmpeg writes data to a temporary file, runs ffmpeg with the arguments
+// returned by args for the input and output files and returns the output.
+// Videos and other media are all handled by it.
+func runFFmpeg(ctx context.Context, data []byte, inputExtension, outputExtension string, args func(input, output string) []string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "pixlserv-ffmpeg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input."+inputExtension)
+	output := filepath.Join(dir, "output."+outputExtension)
+	err = ioutil.WriteFile(input, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(currentConfig().ffmpegTimeout)*time.Millisecond)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, currentConfig().ffmpegCommand, args(input, output)...)
+	message, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %s: %s", err, strings.TrimSpace(string(message)))
+	}
+	return ioutil.ReadFile(output)
+}
+
+// transcodeVideo turns a GIF into a video, resized and cropped like images
+func transcodeVideo(ctx context.Context, data []byte, format string, width, height int, transformation *Transformation) ([]byte, error) {
+	if format != "gif" {
+		return nil, videoSourceError("only GIF images can be transcoded to videos, not " + format)
+	}
+	geometry := engine.Plan(*transformation.params, width, height)
+	_, span := tracer.Start(ctx, "transcode")
+	encoded, err := runFFmpeg(ctx, data, format, transformation.videoFormat, func(input, output string) []string {
+		return videoArgs(input, output, geometry, transformation.params.Filter, transformation.videoFormat)
+	})
+	endSpan(span, err)
+	return encoded, err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"strings"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestRemoveVideoFormat(t *testing.T) {
+	rest, format, err := removeVideoFormat("w_400,fmt_mp4,h_300")
+	if err != nil || rest != "w_400,h_300" || format != videoFormatMP4 {
+		t.Errorf("Unexpected result: %q %q %v", rest, format, err)
+	}
+	rest, format, err = removeVideoFormat("w_400")
+	if err != nil || rest != "w_400" || format != "" {
+		t.Errorf("Unexpected result: %q %q %v", rest, format, err)
+	}
+	if _, _, err := removeVideoFormat("w_400,fmt_avi"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestVideoArgs(t *testing.T) {
+	geometry := engine.Geometry{Width: 201, Height: 100, Crop: image.Rect(10, 0, 410, 200)}
+	args := strings.Join(videoArgs("in.gif", "out.mp4", geometry, engine.FilterGrayScale, videoFormatMP4), " ")
+	if !strings.Contains(args, "-vf crop=400:200:10:0,scale=200:100,hue=s=0") {
+		t.Errorf("Unexpected filters: %s", args)
+	}
+	if !strings.Contains(args, "libx264") || !strings.HasSuffix(args, "out.mp4") {
+		t.Errorf("Unexpected arguments: %s", args)
+	}
+	args = strings.Join(videoArgs("in.gif", "out.webm", geometry, engine.DefaultFilter, videoFormatWebM), " ")
+	if !strings.Contains(args, "libvpx-vp9") || strings.Contains(args, "hue") {
+		t.Errorf("Unexpected arguments: %s", args)
+	}
+}
+
+func TestContentTypeFor(t *testing.T) {
+	for format, expected := range map[string]string{"mp4": "video/mp4", "webm": "video/webm", "png": "image/png"} {
+		if contentTypeFor(format) != expected {
+			t.Errorf("Expected %s for %s, got: %s", expected, format, contentTypeFor(format))
+		}
+	}
+}
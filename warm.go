@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/twinj/uuid"
+)
+
+const (
+	// WarmJobRunning = warm-up job still in progress
+	WarmJobRunning = "running"
+	// WarmJobDone = warm-up job finished, some images may have failed
+	WarmJobDone = "done"
+	// WarmJobFailed = warm-up job couldn't find the images to transform
+	WarmJobFailed = "failed"
+
+	warmJobExpiration     = 24 * 60 * 60 // Seconds
+	warmJobUpdateInterval = 10           // Update progress after this many images
+
+	// Warm-up jobs run next to requests, so they use few goroutines unless
+	// told otherwise
+	defaultWarmConcurrency = 2
+)
+
+// WarmJob describes pre-generating the variants of images for named
+// transformations. Jobs are kept in redis so that their status can be
+// checked using any instance.
+type WarmJob struct {
+	ID              string    `json:"id"`
+	Prefix          string    `json:"prefix,omitempty"`
+	Transformations []string  `json:"transformations"`
+	State           string    `json:"state"`
+	ErrorMessage    string    `json:"errorMessage,omitempty"`
+	Total           int       `json:"total"`
+	Done            int       `json:"done"`
+	Failed          int       `json:"failed"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+}
+
+func warmJobKey(id string) string {
+	return "warmjob:" + id
+}
+
+// warmTransformations checks that the named transformations exist, all
+// named transformations are returned when names is empty
+func warmTransformations(conf *Configuration, names []string) ([]string, error) {
+	if len(names) == 0 {
+		for name := range conf.transformations {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return nil, errors.New("there are no named transformations")
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	for _, name := range names {
+		if _, ok := conf.transformations[name]; !ok {
+			return nil, fmt.Errorf("unknown transformation: %s", name)
+		}
+	}
+	return names, nil
+}
+
+// warmImage transforms an original image in the storage with the named
+// transformations and caches the results, variants which are already cached
+// and up to date are skipped. The original is only fetched when needed.
+func warmImage(conf *Configuration, imagePath string, transformations []string) error {
+	var sourceInfo *FileInfo
+	var data []byte
+	for _, name := range transformations {
+		transformation, _, baseImagePath, err := resolveTransformation(conf, "t_"+name, imagePath)
+		if err != nil {
+			return err
+		}
+		// Texts with variables are filled in for every request
+		if transformation.hasTextVariables() {
+			continue
+		}
+		if sourceInfo == nil {
+			sourceInfo, err = statSource(baseImagePath)
+			if err != nil {
+				return err
+			}
+		}
+
+		fullImagePath, _ := transformation.createFilePath(baseImagePath)
+		cached, err := redis.Bool(Conn.Do("EXISTS", cacheKey(fullImagePath)))
+		if err == nil && cached && !cacheSourceChanged(fullImagePath, sourceInfo) {
+			continue
+		}
+
+		if data == nil {
+			data, err = fetchImage(baseImagePath)
+			if err != nil {
+				return err
+			}
+		}
+		ctx := trackStages(context.Background())
+		err = processingPool.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		encoded, format, fit, start, err := processImage(ctx, data, fullImagePath, baseImagePath, &transformation)
+		releaseAfterStages(ctx, processingPool.release)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		observeTransformation(transformation.params, format, start)
+		persistDerived(fullImagePath, encoded, format)
+		pushToEdges(fullImagePath, encoded, format)
+		err = addEncodedToCache(fullImagePath, encoded, format)
+		if err != nil {
+			return err
+		}
+		setCacheSource(fullImagePath, sourceInfo)
+		setCacheParameters(fullImagePath, &transformation)
+		setCacheExpiry(fullImagePath, &transformation)
+		if fit != nil {
+			setCacheFit(fullImagePath, fit)
+		}
+	}
+	return nil
+}
+
+// startWarm starts warming up the cache in the background for images given
+// by their paths or by a prefix of paths in the storage
+func startWarm(conf *Configuration, paths []string, prefix string, transformations []string, concurrency int) (*WarmJob, error) {
+	if len(paths) == 0 && prefix == "" {
+		return nil, errors.New("missing image paths or prefix")
+	}
+	transformations, err := warmTransformations(conf, transformations)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		concurrency = defaultWarmConcurrency
+	}
+	if concurrency > runtime.NumCPU() {
+		concurrency = runtime.NumCPU()
+	}
+
+	job := &WarmJob{ID: uuid.NewV4().String(), Prefix: prefix, Transformations: transformations, State: WarmJobRunning, Total: len(paths), Started: time.Now()}
+	key := warmJobKey(job.ID)
+	_, err = Conn.Do("HMSET", key, "prefix", prefix, "transformations", strings.Join(transformations, ","), "state", job.State, "total", job.Total, "done", 0, "failed", 0, "started", job.Started.Unix())
+	if err != nil {
+		return nil, err
+	}
+	Conn.Do("EXPIRE", key, warmJobExpiration)
+
+	go runWarm(job, conf, paths, concurrency)
+
+	return job, nil
+}
+
+func runWarm(job *WarmJob, conf *Configuration, paths []string, concurrency int) {
+	key := warmJobKey(job.ID)
+	slog.Info("warm-up job started", "job", job.ID, "prefix", job.Prefix, "transformations", strings.Join(job.Transformations, ","))
+
+	if job.Prefix != "" {
+		var err error
+		paths, err = storageOriginals(job.Prefix)
+		if err != nil {
+			slog.Error("warm-up job failed", "job", job.ID, "error", err)
+			Conn.Do("HMSET", key, "state", WarmJobFailed, "error", err.Error(), "finished", time.Now().Unix())
+			return
+		}
+		Conn.Do("HSET", key, "total", len(paths))
+	}
+
+	failed := runBatch(paths, concurrency, func(path string) error {
+		return warmImage(conf, path, job.Transformations)
+	}, func(done int, path string, err error) {
+		if err != nil {
+			slog.Error("warming up an image failed", "job", job.ID, "image", path, "error", err)
+			Conn.Do("HINCRBY", key, "failed", 1)
+		}
+		if done%warmJobUpdateInterval == 0 {
+			Conn.Do("HSET", key, "done", done)
+		}
+	})
+
+	Conn.Do("HMSET", key, "state", WarmJobDone, "done", len(paths), "finished", time.Now().Unix())
+	slog.Info("warm-up job finished", "job", job.ID, "images", len(paths), "failed", failed)
+}
+
+// Returns the current state of a warm-up job.
+func getWarmJob(id string) (*WarmJob, error) {
+	values, err := redis.StringMap(Conn.Do("HGETALL", warmJobKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errors.New("warm-up job not found")
+	}
+
+	job := &WarmJob{ID: id, Prefix: values["prefix"], State: values["state"], ErrorMessage: values["error"]}
+	if values["transformations"] != "" {
+		job.Transformations = strings.Split(values["transformations"], ",")
+	}
+	job.Total, _ = strconv.Atoi(values["total"])
+	job.Done, _ = strconv.Atoi(values["done"])
+	job.Failed, _ = strconv.Atoi(values["failed"])
+	if started, err := strconv.ParseInt(values["started"], 10, 64); err == nil {
+		job.Started = time.Unix(started, 0)
+	}
+	if finished, err := strconv.ParseInt(values["finished"], 10, 64); err == nil {
+		job.Finished = time.Unix(finished, 0)
+	}
+
+	return job, nil
+}
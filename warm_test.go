@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWarmTransformations(t *testing.T) {
+	conf := &Configuration{transformations: map[string]Transformation{"thumb": {}, "large": {}}}
+
+	names, err := warmTransformations(conf, nil)
+	if err != nil || !reflect.DeepEqual(names, []string{"large", "thumb"}) {
+		t.Errorf("Expected all named transformations, got: %v, %v", names, err)
+	}
+	names, err = warmTransformations(conf, []string{"thumb"})
+	if err != nil || !reflect.DeepEqual(names, []string{"thumb"}) {
+		t.Errorf("Unexpected transformations: %v, %v", names, err)
+	}
+	if _, err := warmTransformations(conf, []string{"thumb", "huge"}); err == nil {
+		t.Error("Expected an error for an unknown transformation")
+	}
+	if _, err := warmTransformations(&Configuration{}, nil); err == nil {
+		t.Error("Expected an error without named transformations")
+	}
+}
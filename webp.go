@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// Parameters asking for a lossless WebP image (ll_1), e.g. for logos and
+	// diagrams, or a near-lossless one (nl_60) whose pixels are adjusted
+	// beforehand to compress better, the lower the level the more
+	parameterLossless     = "ll"
+	parameterNearLossless = "nl"
+
+	maxNearLosslessLevel = 100
+)
+
+// WebPOptions says how WebP images are encoded, they are always lossless
+type WebPOptions struct {
+	// NearLossless adjusts pixels before encoding them as Level says, 0
+	// changes them most and 100 not at all
+	NearLossless bool
+	Level        int
+}
+
+func (o *WebPOptions) String() string {
+	if o.NearLossless {
+		return parameterNearLossless + "_" + strconv.Itoa(o.Level)
+	}
+	return parameterLossless + "_1"
+}
+
+// webpSourceError is returned when an image can't be encoded as WebP
+type webpSourceError string
+
+func (e webpSourceError) Error() string {
+	return string(e)
+}
+
+// removeWebPOptions removes the WebP parameters from a parameters string
+// like "w_400,ll_1" and returns the options they ask for, nil when there are
+// none. A near-lossless level takes precedence over ll_1.
+func removeWebPOptions(parametersStr string) (string, *WebPOptions, error) {
+	rest, lossless := removeParameter(parametersStr, parameterLossless)
+	rest, nearLossless := removeParameter(rest, parameterNearLossless)
+	if lossless != "" && lossless != "1" {
+		return rest, nil, fmt.Errorf("invalid lossless mode: %s (only %s_1 is supported)", lossless, parameterLossless)
+	}
+	if nearLossless != "" {
+		level, err := strconv.Atoi(nearLossless)
+		if err != nil || level < 0 || level > maxNearLosslessLevel {
+			return rest, nil, fmt.Errorf("invalid near-lossless level: %s (needs to be between 0 and %d)", nearLossless, maxNearLosslessLevel)
+		}
+		return rest, &WebPOptions{NearLossless: true, Level: level}, nil
+	}
+	if lossless != "" {
+		return rest, &WebPOptions{}, nil
+	}
+	return rest, nil, nil
+}
+
+// checkWebPTransformation makes sure a transformation can be encoded as WebP
+// by the processing backend, watermarks, texts, masks, scripts and
+// adjustments are only drawn in Go which has no WebP encoder
+func checkWebPTransformation(t *Transformation) error {
+	if processorImpl == nil {
+		return errors.New("WebP images need the vips processing backend")
+	}
+	if t.videoFormat != "" {
+		return errors.New("videos can't be encoded as WebP images")
+	}
+	if t.watermark != nil || len(t.texts) != 0 || t.script != nil || t.mask != "" {
+		return errors.New("watermarks, texts, masks and scripts can't be applied to WebP images")
+	}
+	if t.params.HasAdjustments() || t.params.Transparency != 0 {
+		return errors.New("WebP images can't be adjusted or faded")
+	}
+	if t.autoQuality || t.maxBytes != 0 {
+		return errors.New("WebP images are lossless, their quality and size can't be chosen")
+	}
+	return nil
+}
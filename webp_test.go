@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ReshNesh/pixlserv/engine"
+)
+
+func TestRemoveWebPOptions(t *testing.T) {
+	cases := []struct {
+		parameters, rest string
+		options          *WebPOptions
+	}{
+		{"w_400,ll_1", "w_400", &WebPOptions{}},
+		{"w_400,nl_60", "w_400", &WebPOptions{NearLossless: true, Level: 60}},
+		{"ll_1,w_400,nl_0", "w_400", &WebPOptions{NearLossless: true, Level: 0}},
+		{"w_400", "w_400", nil},
+	}
+	for _, c := range cases {
+		rest, options, err := removeWebPOptions(c.parameters)
+		if err != nil || rest != c.rest || (options == nil) != (c.options == nil) || (options != nil && *options != *c.options) {
+			t.Errorf("%s: expected %s %+v, got %s %+v %v", c.parameters, c.rest, c.options, rest, options, err)
+		}
+	}
+	for _, parameters := range []string{"ll_0", "ll_yes", "nl_101", "nl_-1", "nl_high"} {
+		if _, _, err := removeWebPOptions(parameters); err == nil {
+			t.Errorf("Expected %s to be invalid", parameters)
+		}
+	}
+}
+
+func TestWebPCachePath(t *testing.T) {
+	params := engine.Params{Width: 400, Height: 300, Scale: 1, Cropping: engine.CroppingModeExact, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	paths := make(map[string]string)
+	for _, webp := range []*WebPOptions{nil, {}, {NearLossless: true, Level: 60}, {NearLossless: true, Level: 40}} {
+		transformation := &Transformation{params: &params, webp: webp}
+		filePath, err := transformation.createFilePath("logo.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode := "none"
+		if webp != nil {
+			mode = webp.String()
+		}
+		if other, ok := paths[filePath]; ok {
+			t.Errorf("Expected %s and %s to be cached separately, both are %s", mode, other, filePath)
+		}
+		paths[filePath] = mode
+	}
+
+	if format := (&Transformation{params: &params, webp: &WebPOptions{}}).outputFormat("png"); format != "webp" {
+		t.Errorf("Expected WebP output, got %s", format)
+	}
+}
+
+func TestProcessNativelyWebP(t *testing.T) {
+	processor := &recordingProcessor{}
+	processorImpl = processor
+	defer func() { processorImpl = nil }()
+
+	params := engine.Params{Width: 100, Height: 100, Scale: 1, Cropping: engine.CroppingModePart, Gravity: engine.GravityCenter, Filter: engine.DefaultFilter}
+	geometry := engine.Plan(params, 800, 400)
+	webp := &WebPOptions{NearLossless: true, Level: 60}
+	// PNG images encoded as WebP aren't optimized in Go
+	transformation := &Transformation{params: &params, webp: webp, pngOptimization: &PNGOptimization{}}
+	_, native, err := processNatively(context.Background(), []byte("original"), "png", geometry, transformation)
+	if err != nil || !native {
+		t.Fatalf("Expected the image to be processed natively, got: %t, %v", native, err)
+	}
+	if processor.webp != webp {
+		t.Errorf("Expected the WebP options to be passed on, got: %+v", processor.webp)
+	}
+
+	if err := checkWebPTransformation(transformation); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := checkWebPTransformation(&Transformation{params: &params, webp: webp, watermark: &Watermark{}}); err == nil {
+		t.Error("Expected watermarks to be rejected")
+	}
+	processorImpl = nil
+	if err := checkWebPTransformation(transformation); err == nil {
+		t.Error("Expected WebP images to need a processing backend")
+	}
+}